@@ -1,174 +1,963 @@
-package main
-
-import (
-	"bufio"
-	"encoding/json"
-	"flag"
-	"fmt"
-	"go-im/protocol"
-	"go-im/service"
-	"log"
-	"net"
-	"os"
-	"strings"
-	"time"
-)
-
-func main() {
-	// Parse flags
-	serverAddr := flag.String("server", "127.0.0.1:8080", "Server address")
-	userID := flag.String("user", "user1", "User ID")
-	flag.Parse()
-
-	// Connect to server
-	conn, err := net.Dial("tcp", *serverAddr)
-	if err != nil {
-		log.Fatalf("Failed to connect: %v", err)
-	}
-	defer conn.Close()
-
-	log.Printf("Connected to server as %s", *userID)
-
-	// Generate token for this user
-	token, err := service.GenerateToken(*userID, *userID)
-	if err != nil {
-		log.Fatalf("Failed to generate token: %v", err)
-	}
-
-	// Start receiver goroutine
-	go receiveMessages(conn)
-
-	// Send auth request
-	sendAuth(conn, token)
-
-	// Start heartbeat
-	go heartbeat(conn)
-
-	// Read commands from stdin
-	scanner := bufio.NewScanner(os.Stdin)
-	fmt.Println("\nCommands:")
-	fmt.Println("  send <user_id> <message> - Send message to user")
-	fmt.Println("  quit - Exit")
-	fmt.Println()
-
-	for scanner.Scan() {
-		line := scanner.Text()
-		parts := strings.SplitN(line, " ", 3)
-
-		if len(parts) == 0 {
-			continue
-		}
-
-		switch parts[0] {
-		case "quit":
-			fmt.Println("Exiting...")
-			return
-		case "send":
-			if len(parts) < 3 {
-				fmt.Println("Usage: send <user_id> <message>")
-				continue
-			}
-			sendMessage(conn, parts[1], parts[2])
-		default:
-			fmt.Println("Unknown command. Use 'send <user_id> <message>' or 'quit'")
-		}
-	}
-}
-
-func receiveMessages(conn net.Conn) {
-	reader := bufio.NewReader(conn)
-	for {
-		msg, err := protocol.Unpack(reader)
-		if err != nil {
-			log.Printf("Receive error: %v", err)
-			return
-		}
-
-		switch msg.CmdType {
-		case protocol.CmdTypeAuthAck:
-			var resp map[string]interface{}
-			json.Unmarshal(msg.Body, &resp)
-			if resp["success"] == true {
-				log.Printf("✓ Authentication successful")
-			} else {
-				log.Printf("✗ Authentication failed: %v", resp["message"])
-			}
-
-		case protocol.CmdTypeMessage:
-			var chatMsg struct {
-				FromUserID string `json:"from_user_id"`
-				Content    string `json:"content"`
-				SeqID      int64  `json:"seq_id"`
-			}
-			json.Unmarshal(msg.Body, &chatMsg)
-			fmt.Printf("\n[%s] → %s\n", chatMsg.FromUserID, chatMsg.Content)
-
-			// Send ACK
-			sendAck(conn, chatMsg.SeqID)
-
-		case protocol.CmdTypeHeartbeat:
-			// Heartbeat response received
-
-		case protocol.CmdTypeKick:
-			log.Printf("Server requested reconnect: %s", string(msg.Body))
-
-		default:
-			log.Printf("Unknown message type: %d", msg.CmdType)
-		}
-	}
-}
-
-func sendAuth(conn net.Conn, token string) {
-	data, _ := json.Marshal(map[string]string{"token": token})
-	msg := &protocol.Message{
-		CmdType: protocol.CmdTypeAuth,
-		Body:    data,
-	}
-	sendPacket(conn, msg)
-}
-
-func sendMessage(conn net.Conn, toUserID, content string) {
-	data, _ := json.Marshal(map[string]string{
-		"to_user_id": toUserID,
-		"content":    content,
-	})
-	msg := &protocol.Message{
-		CmdType: protocol.CmdTypeMessage,
-		Body:    data,
-	}
-	sendPacket(conn, msg)
-	log.Printf("→ [%s] %s", toUserID, content)
-}
-
-func sendAck(conn net.Conn, seqID int64) {
-	data, _ := json.Marshal(map[string]int64{"seq_id": seqID})
-	msg := &protocol.Message{
-		CmdType: protocol.CmdTypeMessageAck,
-		Body:    data,
-	}
-	sendPacket(conn, msg)
-}
-
-func heartbeat(conn net.Conn) {
-	ticker := time.NewTicker(30 * time.Second)
-	defer ticker.Stop()
-
-	for range ticker.C {
-		msg := &protocol.Message{
-			CmdType: protocol.CmdTypeHeartbeat,
-			Body:    []byte("ping"),
-		}
-		if err := sendPacket(conn, msg); err != nil {
-			return
-		}
-	}
-}
-
-func sendPacket(conn net.Conn, msg *protocol.Message) error {
-	data, err := protocol.Pack(msg)
-	if err != nil {
-		return err
-	}
-	_, err = conn.Write(data)
-	return err
-}
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"go-im/protocol"
+	"go-im/server"
+	"go-im/service"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Current server connection. Replaced when the server migrates us to another gateway.
+var (
+	connMu sync.Mutex
+	conn   net.Conn
+)
+
+func currentConn() net.Conn {
+	connMu.Lock()
+	defer connMu.Unlock()
+	return conn
+}
+
+// compressFrames asks the server for dictionary-compressed frames at auth.
+var compressFrames bool
+
+// deviceID identifies this client among the user's devices (empty: server default).
+var deviceID string
+
+// frameSync prefixes each outgoing frame with the sync marker (server -frame-sync).
+var frameSync bool
+
+// authToken is reused to authenticate when reconnecting to another gateway.
+var authToken string
+
+// sessionID is the resumable session issued in the last AuthAck (empty: none).
+// reconnect presents it with lastSeq instead of authenticating again.
+var (
+	sessionMu sync.Mutex
+	sessionID string
+	resuming  bool // a CmdTypeReconnect is awaiting its AuthAck
+)
+
+// lastSeq is the highest sequence ID received and acked.
+var lastSeq atomic.Int64
+
+// clockOffset is the estimated server time minus local time in milliseconds,
+// updated by each time sync. Times sent to the server use serverNow.
+var clockOffset atomic.Int64
+
+// serverNow returns the local time corrected to the server's clock.
+func serverNow() time.Time {
+	return time.Now().Add(time.Duration(clockOffset.Load()) * time.Millisecond)
+}
+
+// sendTimeSync asks the server for its time; the reply updates clockOffset.
+func sendTimeSync(conn net.Conn) {
+	data, _ := json.Marshal(map[string]int64{"client_time": time.Now().UnixMilli()})
+	sendPacket(conn, &protocol.Message{CmdType: protocol.CmdTypeTimeSync, Body: data})
+}
+
+// applyTimeSync estimates the clock offset from a time sync reply.
+func applyTimeSync(body []byte) {
+	received := time.Now().UnixMilli()
+	var resp struct {
+		ClientTime int64 `json:"client_time"`
+		ServerRecv int64 `json:"server_recv"`
+		ServerSend int64 `json:"server_send"`
+	}
+	if err := json.Unmarshal(body, &resp); err != nil || resp.ClientTime == 0 {
+		return
+	}
+	offset, rtt := service.ClockOffset(resp.ClientTime, resp.ServerRecv, resp.ServerSend, received)
+	clockOffset.Store(offset)
+	log.Printf("Clock offset %+dms (rtt %dms)", offset, rtt)
+}
+
+// Send credit window granted by the server. When the server doesn't
+// grant credits (flow control disabled) sends are never held back.
+var (
+	creditMu      sync.Mutex
+	creditCond    = sync.NewCond(&creditMu)
+	credits       int
+	creditLimited bool
+)
+
+// resetCredits applies the initial grant from an auth response.
+func resetCredits(n int) {
+	creditMu.Lock()
+	credits = n
+	creditLimited = n > 0
+	creditMu.Unlock()
+	creditCond.Broadcast()
+}
+
+// addCredits applies a replenishment from the server.
+func addCredits(n int) {
+	creditMu.Lock()
+	credits += n
+	creditMu.Unlock()
+	creditCond.Broadcast()
+}
+
+// acquireCredit blocks until a send credit is available.
+func acquireCredit() {
+	creditMu.Lock()
+	defer creditMu.Unlock()
+	if creditLimited && credits <= 0 {
+		log.Printf("Send credits exhausted, waiting for server...")
+	}
+	for creditLimited && credits <= 0 {
+		creditCond.Wait()
+	}
+	if creditLimited {
+		credits--
+	}
+}
+
+func main() {
+	// Parse flags
+	serverAddr := flag.String("server", "127.0.0.1:8080", "Server address")
+	userID := flag.String("user", "user1", "User ID")
+	compress := flag.Bool("compress", false, "Negotiate dictionary compression of frames")
+	device := flag.String("device", "", "Device ID reported at auth (default: assigned by server)")
+	syncFrames := flag.Bool("frame-sync", false, "Prefix each frame with the sync marker (server must run with -frame-sync)")
+	flag.Parse()
+	compressFrames = *compress
+	deviceID = *device
+	frameSync = *syncFrames
+
+	// Connect to server
+	c, err := net.Dial("tcp", *serverAddr)
+	if err != nil {
+		log.Fatalf("Failed to connect: %v", err)
+	}
+	conn = c
+	defer func() { currentConn().Close() }()
+
+	log.Printf("Connected to server as %s", *userID)
+
+	// Generate token for this user
+	token, err := service.GenerateToken(*userID, *userID)
+	if err != nil {
+		log.Fatalf("Failed to generate token: %v", err)
+	}
+	authToken = token
+
+	// Start receiver goroutine
+	go receiveMessages(c)
+
+	// Send auth request and sync the clock
+	sendAuth(c, token)
+	sendTimeSync(c)
+
+	// Start heartbeat
+	go heartbeat()
+
+	// Read commands from stdin
+	scanner := bufio.NewScanner(os.Stdin)
+	fmt.Println("\nCommands:")
+	fmt.Println("  send <user_id> <message> - Send message to user")
+	fmt.Println("  group <group_id> <message> - Send message to group")
+	fmt.Println("  batch <user_id> <msg1>|<msg2>|... - Send several messages to a user in one frame")
+	fmt.Println("  react <user_id> <seq_id> [emoji] - React to a message (no emoji removes)")
+	fmt.Println("  schedule <user_id> <seconds> <message> - Send message after a delay")
+	fmt.Println("  unschedule <id> - Cancel a scheduled message")
+	fmt.Println("  typing <user_id> [off] - Send typing indicator")
+	fmt.Println("  status <online|away|busy> [text] - Set your status")
+	fmt.Println("  presence <user_id> - Query a user's status")
+	fmt.Println("  pin <user_id> <seq_id> / unpin <user_id> <seq_id> - Pin or unpin a message")
+	fmt.Println("  join <group_id> / leave <group_id> - Join or leave a group")
+	fmt.Println("  convs [limit] [all] - List conversations (all includes archived) / read <id> - Clear unread count")
+	fmt.Println("  archive <id> / unarchive <id> - Hide a conversation until its next message, or show it again")
+	fmt.Println("  pending <user_id>[,<user_id>...] - Count your undelivered messages per recipient")
+	fmt.Println("  nack <seq_id> - Ask the server to resend a message")
+	fmt.Println("  sub <topic> / unsub <topic> - Subscribe to or unsubscribe from a topic")
+	fmt.Println("  topics - List subscribed topics")
+	fmt.Println("  profile <user_id>[,<user_id>...] - Show users' profiles")
+	fmt.Println("  profile set <display_name> [avatar_url] - Update your profile")
+	fmt.Println("  pause / resume - Hold realtime delivery (messages queue offline) or resume and fetch them")
+	fmt.Println("  time - Resync the clock offset with the server")
+	fmt.Println("  whoami - Show current session info")
+	fmt.Println("  health - Check server health")
+	fmt.Println("  quit - Exit")
+	fmt.Println()
+
+	for scanner.Scan() {
+		line := scanner.Text()
+		parts := strings.SplitN(line, " ", 3)
+
+		if len(parts) == 0 {
+			continue
+		}
+
+		switch parts[0] {
+		case "quit":
+			fmt.Println("Exiting...")
+			return
+		case "schedule":
+			args := strings.SplitN(line, " ", 4)
+			if len(args) < 4 {
+				fmt.Println("Usage: schedule <user_id> <seconds> <message>")
+				continue
+			}
+			secs, err := strconv.Atoi(args[2])
+			if err != nil {
+				fmt.Println("Invalid seconds")
+				continue
+			}
+			sendScheduled(currentConn(), map[string]interface{}{
+				"action":     "schedule",
+				"to_user_id": args[1],
+				"content":    args[3],
+				"deliver_at": serverNow().Add(time.Duration(secs) * time.Second).UnixMilli(),
+			})
+		case "unschedule":
+			if len(parts) < 2 {
+				fmt.Println("Usage: unschedule <id>")
+				continue
+			}
+			sendScheduled(currentConn(), map[string]interface{}{"action": "cancel", "id": parts[1]})
+		case "typing":
+			if len(parts) < 2 {
+				fmt.Println("Usage: typing <user_id> [off]")
+				continue
+			}
+			sendTyping(currentConn(), parts[1], len(parts) < 3 || parts[2] != "off")
+		case "status":
+			if len(parts) < 2 {
+				fmt.Println("Usage: status <online|away|busy> [text]")
+				continue
+			}
+			text := ""
+			if len(parts) > 2 {
+				text = parts[2]
+			}
+			sendPresence(currentConn(), map[string]string{"action": "set", "status": parts[1], "text": text})
+		case "presence":
+			if len(parts) < 2 {
+				fmt.Println("Usage: presence <user_id>")
+				continue
+			}
+			sendPresence(currentConn(), map[string]string{"action": "get", "user_id": parts[1]})
+		case "convs":
+			limit, all := 20, false
+			for _, arg := range parts[1:] {
+				if arg == "all" {
+					all = true
+				} else {
+					limit, _ = strconv.Atoi(arg)
+				}
+			}
+			sendConversations(currentConn(), map[string]interface{}{"limit": limit, "include_archived": all})
+		case "read":
+			if len(parts) < 2 {
+				fmt.Println("Usage: read <conversation_id>")
+				continue
+			}
+			sendConversations(currentConn(), map[string]interface{}{"read": parts[1]})
+		case "archive", "unarchive":
+			if len(parts) < 2 {
+				fmt.Printf("Usage: %s <conversation_id>\n", parts[0])
+				continue
+			}
+			sendConversations(currentConn(), map[string]interface{}{parts[0]: parts[1]})
+		case "join", "leave":
+			if len(parts) < 2 {
+				fmt.Printf("Usage: %s <group_id>\n", parts[0])
+				continue
+			}
+			sendGroupEvent(currentConn(), parts[1], parts[0])
+		case "sub", "unsub":
+			if len(parts) < 2 {
+				fmt.Printf("Usage: %s <topic>\n", parts[0])
+				continue
+			}
+			action := "subscribe"
+			if parts[0] == "unsub" {
+				action = "unsubscribe"
+			}
+			sendTopic(currentConn(), map[string]string{"action": action, "topic": parts[1]})
+		case "topics":
+			sendTopic(currentConn(), map[string]string{"action": "list"})
+		case "profile":
+			if len(parts) < 2 {
+				fmt.Println("Usage: profile <user_id>[,<user_id>...] | profile set <display_name> [avatar_url]")
+				continue
+			}
+			var req interface{}
+			if parts[1] == "set" && len(parts) >= 3 {
+				fields := strings.Fields(parts[2])
+				set := map[string]string{"display_name": fields[0]}
+				if len(fields) > 1 {
+					set["avatar_url"] = fields[1]
+				}
+				req = map[string]interface{}{"set": set}
+			} else {
+				req = map[string][]string{"user_ids": strings.Split(parts[1], ",")}
+			}
+			data, _ := json.Marshal(req)
+			sendPacket(currentConn(), &protocol.Message{CmdType: protocol.CmdTypeProfileQuery, Body: data})
+		case "pin", "unpin":
+			if len(parts) < 3 {
+				fmt.Printf("Usage: %s <user_id> <seq_id>\n", parts[0])
+				continue
+			}
+			seqID, err := strconv.ParseInt(parts[2], 10, 64)
+			if err != nil {
+				fmt.Println("Invalid seq_id")
+				continue
+			}
+			sendPin(currentConn(), parts[1], seqID, parts[0] == "unpin")
+		case "whoami":
+			sendPacket(currentConn(), &protocol.Message{CmdType: protocol.CmdTypeWhoAmI})
+		case "time":
+			sendTimeSync(currentConn())
+		case "pause":
+			sendPacket(currentConn(), &protocol.Message{CmdType: protocol.CmdTypePause})
+		case "resume":
+			sendPacket(currentConn(), &protocol.Message{CmdType: protocol.CmdTypeResume})
+		case "health":
+			sendPacket(currentConn(), &protocol.Message{CmdType: protocol.CmdTypeHealth})
+		case "pending":
+			if len(parts) < 2 {
+				fmt.Println("Usage: pending <user_id>[,<user_id>...]")
+				continue
+			}
+			data, _ := json.Marshal(map[string][]string{"user_ids": strings.Split(parts[1], ",")})
+			sendPacket(currentConn(), &protocol.Message{CmdType: protocol.CmdTypeUndelivered, Body: data})
+		case "nack":
+			if len(parts) < 2 {
+				fmt.Println("Usage: nack <seq_id>")
+				continue
+			}
+			seqID, err := strconv.ParseInt(parts[1], 10, 64)
+			if err != nil {
+				fmt.Println("Invalid seq_id")
+				continue
+			}
+			sendNack(currentConn(), seqID)
+		case "send":
+			if len(parts) < 3 {
+				fmt.Println("Usage: send <user_id> <message>")
+				continue
+			}
+			sendMessage(currentConn(), parts[1], parts[2])
+		case "batch":
+			if len(parts) < 3 {
+				fmt.Println("Usage: batch <user_id> <msg1>|<msg2>|...")
+				continue
+			}
+			sendBatch(currentConn(), parts[1], strings.Split(parts[2], "|"))
+		case "group":
+			if len(parts) < 3 {
+				fmt.Println("Usage: group <group_id> <message>")
+				continue
+			}
+			sendGroupMessage(currentConn(), parts[1], parts[2])
+		case "react":
+			if len(parts) < 3 {
+				fmt.Println("Usage: react <user_id> <seq_id> [emoji]")
+				continue
+			}
+			args := strings.SplitN(parts[2], " ", 2)
+			seqID, err := strconv.ParseInt(args[0], 10, 64)
+			if err != nil {
+				fmt.Println("Invalid seq_id")
+				continue
+			}
+			emoji := ""
+			if len(args) > 1 {
+				emoji = args[1]
+			}
+			sendReaction(currentConn(), parts[1], seqID, emoji)
+		default:
+			fmt.Println("Unknown command. Use 'send <user_id> <message>' or 'quit'")
+		}
+	}
+}
+
+func receiveMessages(conn net.Conn) {
+	reader := bufio.NewReader(conn)
+	for {
+		msg, err := protocol.Unpack(reader)
+		if err != nil {
+			log.Printf("Receive error: %v", err)
+			return
+		}
+
+		switch msg.CmdType {
+		case protocol.CmdTypeAuthAck:
+			var resp map[string]interface{}
+			json.Unmarshal(msg.Body, &resp)
+			resumed := finishResume()
+			if resp["success"] == true {
+				if id, _ := resp["session_id"].(string); id != "" {
+					setSessionID(id)
+				}
+				if resp["resumed"] == true {
+					log.Printf("✓ Session resumed")
+				} else {
+					log.Printf("✓ Authentication successful")
+				}
+				if claims, ok := resp["claims"].(map[string]interface{}); ok {
+					log.Printf("  Claims: %v", claims)
+				}
+				n, _ := resp["credits"].(float64)
+				resetCredits(int(n))
+			} else if resumed {
+				// The session expired or was revoked: fall back to a full auth.
+				log.Printf("✗ Resume failed: %v, authenticating again", resp["message"])
+				setSessionID("")
+				sendAuth(conn, authToken)
+			} else {
+				log.Printf("✗ Authentication failed: %v", resp["message"])
+			}
+
+		case protocol.CmdTypeMessage:
+			var chatMsg struct {
+				FromUserID   string `json:"from_user_id"`
+				GroupID      string `json:"group_id"`
+				Topic        string `json:"topic"`
+				Content      string `json:"content"`
+				ContentBytes []byte `json:"content_bytes"`
+				SeqID        int64  `json:"seq_id"`
+			}
+			json.Unmarshal(msg.Body, &chatMsg)
+			if len(chatMsg.ContentBytes) > 0 {
+				chatMsg.Content = fmt.Sprintf("<%d bytes binary>", len(chatMsg.ContentBytes))
+			}
+			if chatMsg.Topic != "" {
+				fmt.Printf("\n[#%s] → %s\n", chatMsg.Topic, chatMsg.Content)
+			} else if chatMsg.GroupID != "" {
+				fmt.Printf("\n[%s@%s] → %s\n", chatMsg.FromUserID, chatMsg.GroupID, chatMsg.Content)
+				markSeen("group:"+chatMsg.GroupID, chatMsg.SeqID)
+			} else {
+				fmt.Printf("\n[%s] → %s\n", chatMsg.FromUserID, chatMsg.Content)
+				markSeen(chatMsg.FromUserID, chatMsg.SeqID)
+			}
+
+			// Send ACK
+			sendAck(conn, chatMsg.SeqID)
+
+		case protocol.CmdTypeReaction:
+			var chatMsg struct {
+				FromUserID string `json:"from_user_id"`
+				Content    string `json:"content"`
+				SeqID      int64  `json:"seq_id"`
+			}
+			json.Unmarshal(msg.Body, &chatMsg)
+			var reaction service.ReactionNotification
+			json.Unmarshal([]byte(chatMsg.Content), &reaction)
+			if reaction.Removed {
+				fmt.Printf("\n[%s] removed reaction on #%d\n", reaction.UserID, reaction.SeqID)
+			} else {
+				fmt.Printf("\n[%s] reacted %s on #%d\n", reaction.UserID, reaction.Emoji, reaction.SeqID)
+			}
+
+			sendAck(conn, chatMsg.SeqID)
+
+		case protocol.CmdTypeWhoAmI:
+			log.Printf("Session info: %s", string(msg.Body))
+
+		case protocol.CmdTypeHealthAck:
+			log.Printf("Health: %s", string(msg.Body))
+
+		case protocol.CmdTypeTyping:
+			var chatMsg struct {
+				Content string `json:"content"`
+			}
+			json.Unmarshal(msg.Body, &chatMsg)
+			var typing service.TypingNotification
+			json.Unmarshal([]byte(chatMsg.Content), &typing)
+			if typing.Typing {
+				fmt.Printf("\n[%s] is typing...\n", typing.UserID)
+			} else {
+				fmt.Printf("\n[%s] stopped typing\n", typing.UserID)
+			}
+
+		case protocol.CmdTypeConversations:
+			var resp struct {
+				Success       bool                    `json:"success"`
+				Message       string                  `json:"message"`
+				Conversations []*service.Conversation `json:"conversations"`
+				Archived      string                  `json:"archived"`
+				Unarchived    string                  `json:"unarchived"`
+			}
+			json.Unmarshal(msg.Body, &resp)
+			if !resp.Success {
+				log.Printf("Conversations: %s", resp.Message)
+				continue
+			}
+			if resp.Archived != "" {
+				fmt.Printf("\n[Archived %s]\n", resp.Archived)
+			}
+			if resp.Unarchived != "" {
+				fmt.Printf("\n[Unarchived %s]\n", resp.Unarchived)
+			}
+			for _, c := range resp.Conversations {
+				id := c.ID
+				if c.Archived {
+					id += " (archived)"
+				}
+				if c.Last != nil {
+					fmt.Printf("  %-20s (%d unread) %s: %s\n", id, c.Unread, c.Last.FromUserID, c.Last.Preview)
+				} else {
+					fmt.Printf("  %-20s (%d unread)\n", id, c.Unread)
+				}
+			}
+
+		case protocol.CmdTypeUndelivered:
+			var resp struct {
+				Success    bool                         `json:"success"`
+				Message    string                       `json:"message"`
+				Recipients []*service.RecipientDelivery `json:"recipients"`
+			}
+			json.Unmarshal(msg.Body, &resp)
+			if !resp.Success {
+				log.Printf("Undelivered: %s", resp.Message)
+				continue
+			}
+			for _, r := range resp.Recipients {
+				if r.Online {
+					fmt.Printf("  %-20s online\n", r.UserID)
+				} else {
+					fmt.Printf("  %-20s offline, %d undelivered\n", r.UserID, r.Pending)
+				}
+			}
+
+		case protocol.CmdTypeTopic:
+			log.Printf("Topic: %s", string(msg.Body))
+
+		case protocol.CmdTypeProfileQuery:
+			log.Printf("Profile: %s", string(msg.Body))
+
+		case protocol.CmdTypePause, protocol.CmdTypeResume:
+			log.Printf("%s: %s", protocol.CmdTypeName(msg.CmdType), string(msg.Body))
+
+		case protocol.CmdTypeTimeSync:
+			applyTimeSync(msg.Body)
+
+		case protocol.CmdTypeBatchMessage:
+			var ack service.BatchAck
+			json.Unmarshal(msg.Body, &ack)
+			log.Printf("Batch: %d sent, %d stored offline, %d failed", ack.Sent, ack.Stored, ack.Failed)
+			for _, r := range ack.Results {
+				if r.Status == service.BatchStatusFailed {
+					log.Printf("  #%d failed: %s", r.Index, r.Error)
+				}
+			}
+
+		case protocol.CmdTypeGroupEvent:
+			// Either a reply to our own request or a membership notification
+			var chatMsg struct {
+				Content string `json:"content"`
+				SeqID   int64  `json:"seq_id"`
+			}
+			json.Unmarshal(msg.Body, &chatMsg)
+			if chatMsg.Content == "" {
+				log.Printf("Group: %s", string(msg.Body))
+				continue
+			}
+			var ev service.GroupEvent
+			json.Unmarshal([]byte(chatMsg.Content), &ev)
+			if ev.By != ev.UserID {
+				fmt.Printf("\n[%s] %s: %s (by %s)\n", ev.GroupID, ev.Action, ev.UserID, ev.By)
+			} else {
+				fmt.Printf("\n[%s] %s: %s\n", ev.GroupID, ev.Action, ev.UserID)
+			}
+			sendAck(conn, chatMsg.SeqID)
+
+		case protocol.CmdTypePin, protocol.CmdTypeUnpin:
+			// Either a reply to our own request or a notification routed to us
+			var chatMsg struct {
+				Content string `json:"content"`
+				SeqID   int64  `json:"seq_id"`
+			}
+			json.Unmarshal(msg.Body, &chatMsg)
+			if chatMsg.Content == "" {
+				log.Printf("Pin: %s", string(msg.Body))
+				continue
+			}
+			var pin service.PinNotification
+			json.Unmarshal([]byte(chatMsg.Content), &pin)
+			if pin.Unpinned {
+				fmt.Printf("\n[%s] unpinned %s\n", pin.UserID, pin.MsgID)
+			} else {
+				fmt.Printf("\n[%s] pinned %s\n", pin.UserID, pin.MsgID)
+			}
+			sendAck(conn, chatMsg.SeqID)
+
+		case protocol.CmdTypePresence:
+			log.Printf("Presence: %s", string(msg.Body))
+
+		case protocol.CmdTypeScheduled:
+			log.Printf("Scheduled: %s", string(msg.Body))
+
+		case protocol.CmdTypeCredit:
+			var grant struct {
+				Credits int `json:"credits"`
+			}
+			json.Unmarshal(msg.Body, &grant)
+			if grant.Credits == 0 {
+				log.Printf("Server rejected a message: send credits exhausted")
+				continue
+			}
+			addCredits(grant.Credits)
+
+		case protocol.CmdTypeHeartbeat:
+			// Heartbeat response received
+
+		case protocol.CmdTypeError:
+			var e protocol.ErrorBody
+			json.Unmarshal(msg.Body, &e)
+			log.Printf("Server error %s: %s (%s)", e.Code, e.Message, protocol.CmdTypeName(e.CmdType))
+
+		case protocol.CmdTypeKick:
+			var hint server.ReconnectHint
+			json.Unmarshal(msg.Body, &hint)
+			if !hint.Reconnect {
+				log.Printf("Disconnected by server: %s", hint.Reason)
+				continue
+			}
+			log.Printf("Server requested reconnect (%s), alternates: %v", hint.Reason, hint.Alternates)
+			if len(hint.Alternates) > 0 {
+				go reconnect(hint.Alternates)
+			}
+
+		case protocol.CmdTypeMigrate:
+			var inst service.MigrateInstruction
+			if err := json.Unmarshal(msg.Body, &inst); err != nil {
+				log.Printf("Invalid migrate instruction: %v", err)
+				continue
+			}
+			go migrate(&inst)
+
+		default:
+			log.Printf("Unknown message type: %s", protocol.CmdTypeName(msg.CmdType))
+		}
+	}
+}
+
+func sendAuth(conn net.Conn, token string) {
+	data, _ := json.Marshal(authRequest("token", token))
+	msg := &protocol.Message{
+		CmdType: protocol.CmdTypeAuth,
+		Body:    data,
+	}
+	sendPacket(conn, msg)
+}
+
+// sendReconnect resumes the stored session on conn, reporting the highest
+// sequence ID received so the server skips what we already have.
+// It returns false when there is no session to resume.
+func sendReconnect(conn net.Conn) bool {
+	sessionMu.Lock()
+	id := sessionID
+	resuming = id != ""
+	sessionMu.Unlock()
+	if id == "" {
+		return false
+	}
+
+	req := map[string]interface{}{"session_id": id, "last_seq": lastSeq.Load()}
+	if compressFrames {
+		req["compression"] = protocol.CompressionDictV1
+	}
+	data, _ := json.Marshal(req)
+	sendPacket(conn, &protocol.Message{
+		CmdType: protocol.CmdTypeReconnect,
+		Body:    data,
+	})
+	return true
+}
+
+// finishResume reports whether the AuthAck being handled answers a reconnect.
+func finishResume() bool {
+	sessionMu.Lock()
+	defer sessionMu.Unlock()
+	was := resuming
+	resuming = false
+	return was
+}
+
+func setSessionID(id string) {
+	sessionMu.Lock()
+	sessionID = id
+	sessionMu.Unlock()
+}
+
+// migrate connects to the target gateway with the handoff token.
+// The old connection is closed by the server once it has flushed
+// buffered messages, so we keep reading from it until then.
+func migrate(inst *service.MigrateInstruction) {
+	log.Printf("Migrating to gateway %s (%s)", inst.TargetGateway, inst.TargetAddr)
+
+	newConn, err := net.Dial("tcp", inst.TargetAddr)
+	if err != nil {
+		log.Printf("Migration failed: %v", err)
+		return
+	}
+
+	go receiveMessages(newConn)
+
+	data, _ := json.Marshal(authRequest("handoff_token", inst.HandoffToken))
+	sendPacket(newConn, &protocol.Message{
+		CmdType: protocol.CmdTypeAuth,
+		Body:    data,
+	})
+
+	connMu.Lock()
+	conn = newConn
+	connMu.Unlock()
+}
+
+// reconnect connects to the first reachable alternate gateway, in the
+// order the server listed them (least loaded first), and authenticates again.
+func reconnect(addrs []string) {
+	for _, addr := range addrs {
+		newConn, err := net.DialTimeout("tcp", addr, 3*time.Second)
+		if err != nil {
+			log.Printf("Alternate %s unreachable: %v", addr, err)
+			continue
+		}
+		log.Printf("Reconnected to %s", addr)
+
+		go receiveMessages(newConn)
+		if !sendReconnect(newConn) {
+			sendAuth(newConn, authToken)
+		}
+
+		connMu.Lock()
+		conn = newConn
+		connMu.Unlock()
+		return
+	}
+	log.Printf("No alternate gateway reachable")
+}
+
+func sendMessage(conn net.Conn, toUserID, content string) {
+	data, _ := json.Marshal(map[string]string{
+		"to_user_id": toUserID,
+		"content":    content,
+	})
+	acquireCredit()
+	msg := &protocol.Message{
+		CmdType: protocol.CmdTypeMessage,
+		Body:    data,
+	}
+	sendPacket(conn, msg)
+	log.Printf("→ [%s] %s", toUserID, content)
+}
+
+// sendBatch sends several messages to one user in a single frame.
+// Each message consumes a send credit, just like sending them one by one.
+func sendBatch(conn net.Conn, toUserID string, contents []string) {
+	messages := make([]map[string]string, len(contents))
+	for i, content := range contents {
+		acquireCredit()
+		messages[i] = map[string]string{"to_user_id": toUserID, "content": content}
+	}
+	data, _ := json.Marshal(map[string]interface{}{"messages": messages})
+	sendPacket(conn, &protocol.Message{
+		CmdType: protocol.CmdTypeBatchMessage,
+		Body:    data,
+	})
+	log.Printf("→ [%s] %d messages", toUserID, len(contents))
+}
+
+func sendGroupMessage(conn net.Conn, groupID, content string) {
+	data, _ := json.Marshal(map[string]string{
+		"group_id": groupID,
+		"content":  content,
+	})
+	acquireCredit()
+	sendPacket(conn, &protocol.Message{
+		CmdType: protocol.CmdTypeMessage,
+		Body:    data,
+	})
+	log.Printf("→ [group %s] %s", groupID, content)
+}
+
+func sendReaction(conn net.Conn, toUserID string, seqID int64, emoji string) {
+	data, _ := json.Marshal(map[string]interface{}{
+		"to_user_id": toUserID,
+		"seq_id":     seqID,
+		"emoji":      emoji,
+	})
+	sendPacket(conn, &protocol.Message{
+		CmdType: protocol.CmdTypeReaction,
+		Body:    data,
+	})
+}
+
+func sendTyping(conn net.Conn, toUserID string, typing bool) {
+	data, _ := json.Marshal(map[string]interface{}{
+		"to_user_id": toUserID,
+		"typing":     typing,
+	})
+	sendPacket(conn, &protocol.Message{
+		CmdType: protocol.CmdTypeTyping,
+		Body:    data,
+	})
+}
+
+func sendConversations(conn net.Conn, req map[string]interface{}) {
+	data, _ := json.Marshal(req)
+	sendPacket(conn, &protocol.Message{
+		CmdType: protocol.CmdTypeConversations,
+		Body:    data,
+	})
+}
+
+func sendGroupEvent(conn net.Conn, groupID, action string) {
+	data, _ := json.Marshal(map[string]string{
+		"group_id": groupID,
+		"action":   action,
+	})
+	sendPacket(conn, &protocol.Message{
+		CmdType: protocol.CmdTypeGroupEvent,
+		Body:    data,
+	})
+}
+
+func sendTopic(conn net.Conn, req map[string]string) {
+	data, _ := json.Marshal(req)
+	sendPacket(conn, &protocol.Message{
+		CmdType: protocol.CmdTypeTopic,
+		Body:    data,
+	})
+}
+
+func sendPin(conn net.Conn, toUserID string, seqID int64, unpin bool) {
+	data, _ := json.Marshal(map[string]interface{}{
+		"to_user_id": toUserID,
+		"seq_id":     seqID,
+	})
+	var cmdType uint16 = protocol.CmdTypePin
+	if unpin {
+		cmdType = protocol.CmdTypeUnpin
+	}
+	sendPacket(conn, &protocol.Message{
+		CmdType: cmdType,
+		Body:    data,
+	})
+}
+
+func sendPresence(conn net.Conn, req map[string]string) {
+	data, _ := json.Marshal(req)
+	sendPacket(conn, &protocol.Message{
+		CmdType: protocol.CmdTypePresence,
+		Body:    data,
+	})
+}
+
+func sendScheduled(conn net.Conn, req map[string]interface{}) {
+	data, _ := json.Marshal(req)
+	sendPacket(conn, &protocol.Message{
+		CmdType: protocol.CmdTypeScheduled,
+		Body:    data,
+	})
+}
+
+func sendAck(conn net.Conn, seqID int64) {
+	for {
+		cur := lastSeq.Load()
+		if seqID <= cur || lastSeq.CompareAndSwap(cur, seqID) {
+			break
+		}
+	}
+	data, _ := json.Marshal(map[string]int64{"seq_id": seqID})
+	msg := &protocol.Message{
+		CmdType: protocol.CmdTypeMessageAck,
+		Body:    data,
+	}
+	sendPacket(conn, msg)
+}
+
+func sendNack(conn net.Conn, seqID int64) {
+	data, _ := json.Marshal(map[string]int64{"seq_id": seqID})
+	sendPacket(conn, &protocol.Message{
+		CmdType: protocol.CmdTypeNack,
+		Body:    data,
+	})
+}
+
+// readPointers tracks the newest message shown per conversation since the
+// last heartbeat; the next heartbeat carries them to sync read state.
+var (
+	readMu       sync.Mutex
+	readPointers = map[string]int64{}
+)
+
+func markSeen(convID string, seqID int64) {
+	readMu.Lock()
+	defer readMu.Unlock()
+	if seqID > readPointers[convID] {
+		readPointers[convID] = seqID
+	}
+}
+
+// heartbeatBody returns "ping", or the pending read pointers when there are any.
+func heartbeatBody() []byte {
+	readMu.Lock()
+	defer readMu.Unlock()
+	if len(readPointers) == 0 {
+		return []byte("ping")
+	}
+	data, _ := json.Marshal(map[string]interface{}{"read": readPointers})
+	readPointers = map[string]int64{}
+	return data
+}
+
+func heartbeat() {
+	ticker := time.NewTicker(30 * time.Second)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		msg := &protocol.Message{
+			CmdType: protocol.CmdTypeHeartbeat,
+			Body:    heartbeatBody(),
+		}
+		if err := sendPacket(currentConn(), msg); err != nil {
+			return
+		}
+	}
+}
+
+// authRequest builds an auth body, asking for frame compression when enabled
+// and for a resumable session ID.
+// Frames from the server are decompressed transparently by protocol.Unpack.
+func authRequest(key, value string) map[string]interface{} {
+	req := map[string]interface{}{key: value, "resumable": true}
+	if compressFrames {
+		req["compression"] = protocol.CompressionDictV1
+	}
+	if deviceID != "" {
+		req["device_id"] = deviceID
+	}
+	return req
+}
+
+func sendPacket(conn net.Conn, msg *protocol.Message) error {
+	pack := protocol.Pack
+	if frameSync {
+		pack = protocol.PackSynced
+	}
+	data, err := pack(msg)
+	if err != nil {
+		return err
+	}
+	_, err = conn.Write(data)
+	return err
+}
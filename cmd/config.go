@@ -0,0 +1,233 @@
+package main
+
+// ==================== 配置来源 ====================
+//
+// 命令行参数是唯一的配置清单，配置文件和环境变量使用相同的参数名：
+//
+//	默认值 < 配置文件（-config）< 环境变量（GOIM_<参数名>）< 命令行
+//
+// 配置文件为 JSON 对象，键是参数名（不带 "-"）：
+//
+//	{
+//	  "id": "gateway_2",
+//	  "redis": "10.0.0.5:6379",
+//	  "offline-grace": "30s",
+//	  "max-inflight": 1000,
+//	  "wal": true
+//	}
+//
+// 环境变量名为参数名转大写、"-" 换成 "_"，如 GOIM_OFFLINE_GRACE=30s。
+// 配置文件中出现未知的参数名视为错误，避免拼写错误的配置被静默忽略。
+//
+// 合并后的 Config 由 loadConfig 校验，各组件在 Initialize 中通过构造函数拿到自己的部分
+// （如 service.SessionConfig、service.OfflineConfig），不再读取包级默认值。
+// 不属于网关配置的两项：
+//   - protocol.MaxPayloadLength 是协议常量，客户端和服务端必须一致，不能按网关调整
+//   - 认证配置通过 service.ConfigureAuth 在启动时设置一次（Token 的签发和验证是包级函数，客户端工具也在使用）
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"go-im/server"
+	"go-im/service"
+)
+
+// configFlagName 指定配置文件的参数名
+const configFlagName = "config"
+
+// applyConfigSources 在解析命令行之前，用配置文件和环境变量的值覆盖参数默认值
+// 之后 fs.Parse 解析到的命令行参数优先级最高
+func applyConfigSources(fs *flag.FlagSet, args []string) error {
+	if path := configPathFromArgs(args); path != "" {
+		if err := applyConfigFile(fs, path); err != nil {
+			return err
+		}
+	}
+	return applyConfigEnv(fs, os.LookupEnv)
+}
+
+// configPathFromArgs 在命令行中找到 -config 的值（支持 -config x 和 -config=x）
+func configPathFromArgs(args []string) string {
+	for i, arg := range args {
+		name := strings.TrimLeft(arg, "-")
+		if name == arg {
+			continue
+		}
+		if v, ok := strings.CutPrefix(name, configFlagName+"="); ok {
+			return v
+		}
+		if name == configFlagName && i+1 < len(args) {
+			return args[i+1]
+		}
+	}
+	return ""
+}
+
+// applyConfigFile 读取 JSON 配置文件，逐项设置参数
+func applyConfigFile(fs *flag.FlagSet, path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	var values map[string]json.RawMessage
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(&values); err != nil {
+		return fmt.Errorf("invalid config file %s: %w", path, err)
+	}
+
+	for name, raw := range values {
+		if name == configFlagName || fs.Lookup(name) == nil {
+			return fmt.Errorf("config file %s: unknown option %q", path, name)
+		}
+		var v interface{}
+		dec := json.NewDecoder(bytes.NewReader(raw))
+		dec.UseNumber()
+		if err := dec.Decode(&v); err != nil {
+			return fmt.Errorf("config file %s: option %q: %w", path, name, err)
+		}
+		var s string
+		switch v := v.(type) {
+		case string:
+			s = v
+		case json.Number, bool:
+			s = fmt.Sprint(v)
+		default:
+			return fmt.Errorf("config file %s: option %q must be a string, number or boolean", path, name)
+		}
+		if err := fs.Set(name, s); err != nil {
+			return fmt.Errorf("config file %s: option %q: %w", path, name, err)
+		}
+	}
+	return nil
+}
+
+// applyConfigEnv 用 GOIM_<参数名> 环境变量设置参数
+func applyConfigEnv(fs *flag.FlagSet, lookup func(string) (string, bool)) error {
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		if err != nil || f.Name == configFlagName {
+			return
+		}
+		key := configEnvName(f.Name)
+		if v, ok := lookup(key); ok {
+			if setErr := fs.Set(f.Name, v); setErr != nil {
+				err = fmt.Errorf("environment variable %s: %w", key, setErr)
+			}
+		}
+	})
+	return err
+}
+
+// configEnvName 参数对应的环境变量名
+func configEnvName(flagName string) string {
+	return "GOIM_" + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// ==================== 配置校验 ====================
+
+// errNoJWTSecret 没有设置签名密钥，也没有显式允许使用开发密钥
+var errNoJWTSecret = errors.New("GOIM_JWT_SECRET must be set (pass -dev-secret to use the built-in development secret for local development)")
+
+// usesSecret 签名算法是否使用共享密钥（HMAC 系列），否则使用 RSA 密钥对
+func (c *Config) usesSecret() bool {
+	return strings.HasPrefix(c.JWTMethod, "HS")
+}
+
+// authConfig 认证配置
+// HMAC 算法：DevSecret 开启且未设置密钥时使用内置的开发密钥；RSA 算法：从 PEM 文件读取密钥对
+func (c *Config) authConfig() (*service.AuthConfig, error) {
+	cfg := &service.AuthConfig{
+		Method: c.JWTMethod,
+		Expiry: c.TokenExpiry,
+	}
+	if c.usesSecret() {
+		secret := c.JWTSecret
+		if secret == "" && c.DevSecret {
+			secret = service.DefaultJWTSecret
+		}
+		cfg.Secret = []byte(secret)
+		return cfg, nil
+	}
+
+	var err error
+	cfg.PrivateKey, cfg.PublicKey, err = service.LoadRSAKeys(c.JWTPrivateKey, c.JWTPublicKey)
+	if err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// Validate 检查配置，返回所有不合法的项
+func (c *Config) Validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+
+	check(c.GatewayID != "", "id must not be empty")
+	check(c.TCPAddr != "", "addr must not be empty")
+	check(c.RedisAddr != "", "redis must not be empty")
+
+	for name, v := range map[string]int{
+		"capacity":            c.Capacity,
+		"max-inflight":        c.MaxInFlight,
+		"send-credits":        c.SendCredits,
+		"inbound-queue":       c.InboundQueue,
+		"max-frame-rate":      c.MaxFrameRate,
+		"offline-rate":        c.OfflineRate,
+		"offline-batch":       c.OfflineBatch,
+		"pubsub-compress-min": c.PubSubCompressMin,
+		"goroutine-budget":    c.GoroutineBudget,
+	} {
+		check(v >= 0, "%s must not be negative, got %d", name, v)
+	}
+	for name, v := range map[string]time.Duration{
+		"away-after":        c.AwayAfter,
+		"offline-grace":     c.OfflineGrace,
+		"offline-sweep":     c.OfflineSweep,
+		"redis-timeout":     c.RedisTimeout,
+		"drain-interval":    c.DrainInterval,
+		"predecessor-grace": c.PredecessorGrace,
+		"token-recheck":     c.TokenRecheck,
+		"resume-ttl":        c.ResumeTTL,
+		"trace-sync":        c.TraceSync,
+	} {
+		check(v >= 0, "%s must not be negative, got %v", name, v)
+	}
+	check(c.OfflineShards >= 1, "offline-shards must be at least 1, got %d", c.OfflineShards)
+	check(c.OfflineMax >= 1, "offline-max must be at least 1, got %d", c.OfflineMax)
+	check(c.SessionTTL > 0, "session-ttl must be positive, got %v", c.SessionTTL)
+	check(c.OfflineTTL > 0, "offline-ttl must be positive, got %v", c.OfflineTTL)
+
+	// 签名密钥：生产环境必须显式设置，不能悄悄退回内置的开发密钥
+	if c.usesSecret() && c.JWTSecret == "" && !c.DevSecret {
+		errs = append(errs, errNoJWTSecret)
+	} else if auth, err := c.authConfig(); err != nil {
+		errs = append(errs, err)
+	} else if err := auth.Validate(); err != nil {
+		errs = append(errs, err)
+	}
+	check(c.JWTSecret != service.DefaultJWTSecret || c.DevSecret,
+		"GOIM_JWT_SECRET must not be the built-in development secret (pass -dev-secret for local development)")
+
+	check(c.OfflineFormat == service.OfflineFormatJSON || c.OfflineFormat == service.OfflineFormatMsgpack,
+		"offline-format must be %s or %s, got %q", service.OfflineFormatJSON, service.OfflineFormatMsgpack, c.OfflineFormat)
+	_, err := service.NewSelectionStrategy(c.GatewaySelect)
+	check(err == nil, "gateway-select must be %s, %s or %s, got %q",
+		service.StrategyLeastLoaded, service.StrategyWeighted, service.StrategyRoundRobin, c.GatewaySelect)
+	check(c.FramePolicy == server.FramePolicyThrottle || c.FramePolicy == server.FramePolicyClose,
+		"frame-policy must be %s or %s, got %q", server.FramePolicyThrottle, server.FramePolicyClose, c.FramePolicy)
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"go-im/pkg/redis"
+	"go-im/server"
+	"go-im/service"
+)
+
+// testConfig 一份可以通过校验的最小配置
+func testConfig() *Config {
+	return &Config{
+		GatewayID:     "gateway_test",
+		TCPAddr:       "127.0.0.1:0",
+		RedisAddr:     "127.0.0.1:6379",
+		GatewaySelect: service.StrategyLeastLoaded,
+		OfflineBatch:  100,
+		OfflineShards: 1,
+		SessionTTL:    service.SessionTTL,
+		OfflineMax:    service.MaxOfflineMessages,
+		OfflineTTL:    service.OfflineMessageTTL,
+		TokenExpiry:   time.Hour,
+		JWTMethod:     "HS256",
+		JWTSecret:     "test-secret",
+		OfflineFormat: service.OfflineFormatJSON,
+		FramePolicy:   server.FramePolicyThrottle,
+	}
+}
+
+func TestConfigValidateAccepts(t *testing.T) {
+	if err := testConfig().Validate(); err != nil {
+		t.Fatalf("valid config rejected: %v", err)
+	}
+
+	// 本地开发：显式允许使用内置密钥
+	cfg := testConfig()
+	cfg.JWTSecret = ""
+	cfg.DevSecret = true
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("-dev-secret without GOIM_JWT_SECRET rejected: %v", err)
+	}
+}
+
+func TestConfigValidateRejects(t *testing.T) {
+	cases := []struct {
+		name   string
+		modify func(c *Config)
+		want   string // 错误信息中应包含的内容
+	}{
+		{"missing secret", func(c *Config) { c.JWTSecret = "" }, "GOIM_JWT_SECRET must be set"},
+		{"built-in secret", func(c *Config) { c.JWTSecret = service.DefaultJWTSecret }, "built-in development secret"},
+		{"unknown jwt method", func(c *Config) { c.JWTMethod = "HS1024" }, "unknown signing method"},
+		{"none jwt method", func(c *Config) { c.JWTMethod = "none" }, "signing method"},
+		{"zero token expiry", func(c *Config) { c.TokenExpiry = 0 }, "expiry must be positive"},
+		{"token expiry too long", func(c *Config) { c.TokenExpiry = service.MaxTokenExpireDuration + time.Hour }, "exceeds"},
+		{"empty gateway id", func(c *Config) { c.GatewayID = "" }, "id must not be empty"},
+		{"negative inflight", func(c *Config) { c.MaxInFlight = -1 }, "max-inflight"},
+		{"negative grace", func(c *Config) { c.OfflineGrace = -time.Second }, "offline-grace"},
+		{"zero shards", func(c *Config) { c.OfflineShards = 0 }, "offline-shards"},
+		{"zero offline max", func(c *Config) { c.OfflineMax = 0 }, "offline-max"},
+		{"zero session ttl", func(c *Config) { c.SessionTTL = 0 }, "session-ttl"},
+		{"negative offline ttl", func(c *Config) { c.OfflineTTL = -time.Hour }, "offline-ttl"},
+		{"unknown offline format", func(c *Config) { c.OfflineFormat = "xml" }, "offline-format"},
+		{"unknown frame policy", func(c *Config) { c.FramePolicy = "drop" }, "frame-policy"},
+		{"unknown gateway select", func(c *Config) { c.GatewaySelect = "random" }, "gateway-select"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			cfg := testConfig()
+			c.modify(cfg)
+			err := cfg.Validate()
+			if err == nil || !strings.Contains(err.Error(), c.want) {
+				t.Fatalf("Validate() = %v, want error containing %q", err, c.want)
+			}
+		})
+	}
+}
+
+func TestInitializeRequiresSecret(t *testing.T) {
+	cfg := testConfig()
+	cfg.JWTSecret = ""
+	if err := NewApp(cfg).Initialize(); err != errNoJWTSecret {
+		t.Fatalf("Initialize() = %v, want errNoJWTSecret", err)
+	}
+}
+
+func TestLoadConfigFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "gateway.json")
+	file := `{
+		"id": "gateway_file",
+		"redis": "127.0.0.1:1",
+		"session-ttl": "2m",
+		"offline-max": 50,
+		"offline-ttl": "48h",
+		"token-expiry": "2h"
+	}`
+	if err := os.WriteFile(path, []byte(file), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("GOIM_JWT_SECRET", "file-test-secret")
+	t.Setenv("GOIM_OFFLINE_MAX", "60") // 环境变量覆盖配置文件
+
+	cfg, err := loadConfig(flag.NewFlagSet("test", flag.ContinueOnError),
+		[]string{"-config", path, "-offline-ttl", "72h"}) // 命令行覆盖配置文件
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.GatewayID != "gateway_file" || cfg.RedisAddr != "127.0.0.1:1" {
+		t.Fatalf("file values not loaded: id %q, redis %q", cfg.GatewayID, cfg.RedisAddr)
+	}
+
+	// 认证配置是包级状态，测试结束后恢复
+	method, secret, expiry := service.SigningMethod, service.JWTSecret, service.TokenExpireDuration
+	t.Cleanup(func() {
+		service.SigningMethod, service.JWTSecret, service.TokenExpireDuration = method, secret, expiry
+		redis.Close()
+	})
+
+	// Redis 不可达时降级启动，各组件照常创建
+	app := NewApp(cfg)
+	if err := app.Initialize(); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := app.session.TTL(); got != 2*time.Minute {
+		t.Errorf("session TTL = %v, want 2m", got)
+	}
+	if got := app.offline.MaxMessages(); got != 60 {
+		t.Errorf("offline max messages = %d, want 60", got)
+	}
+	if got := app.offline.TTL(); got != 72*time.Hour {
+		t.Errorf("offline TTL = %v, want 72h", got)
+	}
+	if got := service.TokenExpireDuration; got != 2*time.Hour {
+		t.Errorf("token expiry = %v, want 2h", got)
+	}
+	if got := string(service.JWTSecret); got != "file-test-secret" {
+		t.Errorf("JWT secret = %q, want the GOIM_JWT_SECRET value", got)
+	}
+}
@@ -0,0 +1,228 @@
+//go:build integration
+
+package main
+
+// ==================== 集成测试 ====================
+//
+// 在同一进程中启动两个网关（回环地址，系统分配端口），共用一个 Redis，
+// 用真实的 TCP 客户端走完整条链路：
+//
+//	alice ──TCP──▶ integration_1 ──Pub/Sub──▶ integration_2 ──TCP──▶ bob
+//
+// 需要可用的 Redis，因此只在指定 integration 构建标签时编译：
+//
+//	GOIM_TEST_REDIS_ADDR=127.0.0.1:6379 go test -tags integration ./cmd
+//
+// 未设置 GOIM_TEST_REDIS_ADDR 时使用 127.0.0.1:6379，Redis 不可达时测试失败。
+// 用户 ID 带随机后缀，不会与 Redis 中已有的数据冲突，也不依赖上一次运行的残留。
+// 新的场景写成 Test 函数，使用 startCluster 启动的网关和 dialTestClient 创建的客户端。
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"go-im/pkg/redis"
+	"go-im/protocol"
+	"go-im/service"
+)
+
+// integrationTimeout 集成测试中等待单个响应的超时
+const integrationTimeout = 5 * time.Second
+
+// integrationConfig 集成测试的网关配置：参数默认值 + 测试用的 Redis 和签名密钥
+func integrationConfig(t *testing.T) *Config {
+	t.Helper()
+	addr := os.Getenv("GOIM_TEST_REDIS_ADDR")
+	if addr == "" {
+		addr = "127.0.0.1:6379"
+	}
+	t.Setenv("GOIM_JWT_SECRET", "integration-secret")
+
+	cfg, err := loadConfig(flag.NewFlagSet("integration", flag.ContinueOnError), []string{"-redis", addr})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
+// startCluster 在回环地址上启动 n 个网关，ID 为 integration_1..n，测试结束时停止
+// 其余配置沿用 base
+func startCluster(t *testing.T, base *Config, n int) []*App {
+	t.Helper()
+	var gateways []*App
+	t.Cleanup(func() { stopCluster(gateways) })
+
+	for i := 1; i <= n; i++ {
+		cfg := *base
+		cfg.GatewayID = "integration_" + strconv.Itoa(i)
+		cfg.TCPAddr = "127.0.0.1:0"
+		cfg.AdvertiseAddr = ""
+		cfg.Predecessors = nil
+
+		app := NewApp(&cfg)
+		err := app.Initialize()
+		if err == nil {
+			err = app.Start()
+		}
+		if err != nil {
+			t.Fatalf("failed to start %s: %v", cfg.GatewayID, err)
+		}
+		gateways = append(gateways, app)
+	}
+
+	// 网关在 Redis 不可达时降级启动，集成测试要求 Redis 可用
+	if err := redis.Client.Ping(redis.Context()).Err(); err != nil {
+		t.Fatalf("redis unavailable at %s: %v", base.RedisAddr, err)
+	}
+	return gateways
+}
+
+// stopCluster 停止所有网关，最后关闭共享的 Redis 客户端
+func stopCluster(gateways []*App) {
+	for _, app := range gateways {
+		app.shutdown()
+	}
+	redis.Close()
+}
+
+// ==================== 场景 ====================
+
+// TestCrossGatewayDelivery alice 连接网关 1，bob 连接网关 2，
+// alice 发给 bob 的消息经 Pub/Sub 转发后送达
+func TestCrossGatewayDelivery(t *testing.T) {
+	gateways := startCluster(t, integrationConfig(t), 2)
+	suffix := strconv.FormatInt(time.Now().UnixNano(), 36)
+
+	alice, err := dialTestClient(gateways[0], "it_alice_"+suffix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer alice.Close()
+	bob, err := dialTestClient(gateways[1], "it_bob_"+suffix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bob.Close()
+
+	// 确认 bob 的会话登记在网关 2，消息必须跨网关投递
+	gatewayID, err := gateways[0].session.GetUserGateway(bob.userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gatewayID != gateways[1].config.GatewayID {
+		t.Fatalf("bob is registered on %q, want %s", gatewayID, gateways[1].config.GatewayID)
+	}
+
+	content := "hello across gateways " + suffix
+	body, _ := json.Marshal(map[string]string{"to_user_id": bob.userID, "content": content})
+	if err := alice.Send(protocol.CmdTypeMessage, body); err != nil {
+		t.Fatal(err)
+	}
+
+	var got service.ChatMessage
+	if _, err := bob.Await(protocol.CmdTypeMessage, &got); err != nil {
+		t.Fatalf("bob did not receive the message: %v", err)
+	}
+	if got.FromUserID != alice.userID || got.Content != content {
+		t.Fatalf("bob received %q from %s, want %q from %s", got.Content, got.FromUserID, content, alice.userID)
+	}
+
+	// 确认后离线盒子中不应残留
+	ack, _ := json.Marshal(map[string]int64{"seq_id": got.SeqID})
+	if err := bob.Send(protocol.CmdTypeMessageAck, ack); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// ==================== 测试客户端 ====================
+
+// testClient 集成测试使用的最小客户端：同步收发，没有重连和流控
+type testClient struct {
+	userID string
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// dialTestClient 连接网关并以 userID 完成认证
+func dialTestClient(app *App, userID string) (*testClient, error) {
+	conn, err := net.DialTimeout("tcp", app.tcpServer.Addr().String(), integrationTimeout)
+	if err != nil {
+		return nil, err
+	}
+	c := &testClient{userID: userID, conn: conn, reader: bufio.NewReader(conn)}
+
+	token, err := service.GenerateToken(userID, userID)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	body, _ := json.Marshal(map[string]string{"token": token})
+	if err := c.Send(protocol.CmdTypeAuth, body); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	var resp struct {
+		Success bool   `json:"success"`
+		Message string `json:"message"`
+	}
+	if _, err := c.Await(protocol.CmdTypeAuthAck, &resp); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("auth of %s: %w", userID, err)
+	}
+	if !resp.Success {
+		conn.Close()
+		return nil, fmt.Errorf("auth of %s rejected: %s", userID, resp.Message)
+	}
+	return c, nil
+}
+
+// Send 发送一帧
+func (c *testClient) Send(cmdType uint16, body []byte) error {
+	data, err := protocol.Pack(&protocol.Message{CmdType: cmdType, Body: body})
+	if err != nil {
+		return err
+	}
+	_, err = c.conn.Write(data)
+	return err
+}
+
+// Await 读取帧直到收到 cmdType，跳过其他帧（心跳、通知等）
+// v 不为 nil 时把消息体解析到 v
+func (c *testClient) Await(cmdType uint16, v interface{}) (*protocol.Message, error) {
+	c.conn.SetReadDeadline(time.Now().Add(integrationTimeout))
+	defer c.conn.SetReadDeadline(time.Time{})
+
+	for {
+		msg, err := protocol.Unpack(c.reader)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				return nil, fmt.Errorf("timed out waiting for %s", protocol.CmdTypeName(cmdType))
+			}
+			return nil, err
+		}
+		if msg.CmdType != cmdType {
+			continue
+		}
+		if v != nil {
+			if err := json.Unmarshal(msg.Body, v); err != nil {
+				return nil, err
+			}
+		}
+		return msg, nil
+	}
+}
+
+// Close 断开连接
+func (c *testClient) Close() error {
+	return c.conn.Close()
+}
@@ -1,345 +1,2363 @@
-/*
-Go-IM 服务端主程序
-
-=== 程序架构概览 ===
-
-	┌─────────────────────────────────────────────────────────────┐
-	│                        App (主程序)                         │
-	│  ┌──────────────────────────────────────────────────────┐  │
-	│  │                   TCPServer                          │  │
-	│  │  - 监听端口，接受连接                                │  │
-	│  │  - 管理连接生命周期                                  │  │
-	│  │  - 心跳检测                                          │  │
-	│  └──────────────────────────────────────────────────────┘  │
-	│                          │                                  │
-	│                          ▼ 消息分发                         │
-	│  ┌──────────────────────────────────────────────────────┐  │
-	│  │               MessageHandler                         │  │
-	│  │  - 认证处理                                          │  │
-	│  │  - 消息路由                                          │  │
-	│  │  - ACK 处理                                          │  │
-	│  └──────────────────────────────────────────────────────┘  │
-	│                          │                                  │
-	│          ┌───────────────┼───────────────┐                  │
-	│          ▼               ▼               ▼                  │
-	│   ┌───────────┐   ┌───────────┐   ┌───────────┐            │
-	│   │ Session   │   │  PubSub   │   │ Offline   │            │
-	│   │ Manager   │   │  Manager  │   │ Manager   │            │
-	│   └───────────┘   └───────────┘   └───────────┘            │
-	│          │               │               │                  │
-	│          └───────────────┼───────────────┘                  │
-	│                          ▼                                  │
-	│                 ┌───────────────┐                           │
-	│                 │     Redis     │                           │
-	│                 └───────────────┘                           │
-	└─────────────────────────────────────────────────────────────┘
-
-=== 启动流程 ===
-
-1. 解析命令行参数
-2. 初始化 Redis 连接
-3. 初始化各个 Service
-4. 启动 Pub/Sub 订阅
-5. 启动 TCP Server
-6. 等待关闭信号
-7. 优雅关闭所有组件
-
-=== 命令行参数 ===
-
-	-id     网关 ID（默认: gateway_1）
-	-addr   监听地址（默认: :8080）
-	-redis  Redis 地址（默认: 127.0.0.1:6379）
-
-示例:
-
-	./server -id gateway_1 -addr :8080 -redis 127.0.0.1:6379
-*/
-package main
-
-import (
-	"encoding/json"
-	"flag"
-	"go-im/pkg/redis"
-	"go-im/protocol"
-	"go-im/server"
-	"go-im/service"
-	"log"
-	"os"
-	"os/signal"
-	"syscall"
-)
-
-// ==================== 配置结构 ====================
-
-// Config 服务器配置
-type Config struct {
-	GatewayID string // 网关唯一标识
-	TCPAddr   string // TCP 监听地址
-	RedisAddr string // Redis 服务器地址
-}
-
-// ==================== 应用程序结构 ====================
-
-// App 应用程序主结构
-// 持有所有组件的引用，负责生命周期管理
-type App struct {
-	config     *Config                  // 配置
-	tcpServer  *server.TCPServer        // TCP 服务器
-	session    *service.SessionManager  // 会话管理
-	pubsub     *service.PubSubManager   // Pub/Sub 管理
-	sequence   *service.SequenceManager // 序列号管理
-	offline    *service.OfflineManager  // 离线消息管理
-	msgHandler *service.MessageHandler  // 消息处理器
-}
-
-// NewApp 创建应用实例
-func NewApp(config *Config) *App {
-	return &App{config: config}
-}
-
-// ==================== 初始化 ====================
-
-// Initialize 初始化所有组件
-// 创建顺序很重要：Redis → Services → TCP Server
-func (a *App) Initialize() error {
-	// 1. 初始化 Redis 连接
-	// 这是基础设施，其他组件都依赖它
-	if err := redis.Init(&redis.Config{
-		Addr:     a.config.RedisAddr,
-		PoolSize: 100,
-	}); err != nil {
-		return err
-	}
-
-	// 2. 初始化各个 Service
-	a.session = service.NewSessionManager(a.config.GatewayID)
-	a.pubsub = service.NewPubSubManager(a.config.GatewayID)
-	a.sequence = service.NewSequenceManager()
-	a.offline = service.NewOfflineManager()
-
-	// 3. 初始化 TCP 服务器
-	a.tcpServer = server.NewTCPServer(a.config.TCPAddr, a.config.GatewayID)
-
-	// 4. 初始化消息处理器
-	// 注入所有依赖的 Service
-	a.msgHandler = service.NewMessageHandler(
-		a.config.GatewayID,
-		a.tcpServer.ConnManager,
-		a.session,
-		a.pubsub,
-		a.sequence,
-		a.offline,
-	)
-
-	// 5. 将消息处理器注册到 TCP 服务器
-	// TCP 层收到消息后会调用 HandleConnection
-	a.tcpServer.SetHandler(a)
-
-	return nil
-}
-
-// ==================== 启动和停止 ====================
-
-// Start 启动所有组件
-func (a *App) Start() error {
-	// 启动 Pub/Sub 订阅
-	// 必须在 TCP 服务器之前启动，确保能收到其他节点的消息
-	if err := a.pubsub.Start(a.msgHandler.HandlePubSubMessage); err != nil {
-		return err
-	}
-
-	// 启动 TCP 服务器
-	if err := a.tcpServer.Start(); err != nil {
-		return err
-	}
-
-	return nil
-}
-
-// Stop 优雅停止所有组件
-// 停止顺序与启动顺序相反：TCP Server → Pub/Sub → Redis
-func (a *App) Stop() {
-	log.Println("[App] Stopping application...")
-
-	// 1. 停止 TCP 服务器（不再接受新连接，等待现有连接处理完）
-	a.tcpServer.Stop()
-
-	// 2. 停止 Pub/Sub
-	a.pubsub.Stop()
-
-	// 3. 关闭 Redis 连接
-	redis.Close()
-
-	log.Println("[App] Application stopped")
-}
-
-// ==================== 消息处理 ====================
-
-// HandleConnection 实现 server.MessageHandler 接口
-// TCP 层收到消息后会调用这个方法
-// 根据消息类型分发到不同的处理函数
-func (a *App) HandleConnection(conn *server.Connection, msg *protocol.Message) {
-	switch msg.CmdType {
-	case protocol.CmdTypeAuth:
-		// 认证请求
-		a.handleAuth(conn, msg)
-
-	case protocol.CmdTypeMessage:
-		// 聊天消息
-		a.handleMessage(conn, msg)
-
-	case protocol.CmdTypeMessageAck:
-		// 消息确认
-		a.handleMessageAck(conn, msg)
-
-	default:
-		log.Printf("[App] Unknown command type: %d", msg.CmdType)
-	}
-}
-
-// ==================== 认证处理 ====================
-
-// handleAuth 处理认证请求
-//
-// 流程：
-// 1. 解析请求中的 Token
-// 2. 验证 Token（JWT 签名、过期时间）
-// 3. 绑定用户到连接
-// 4. 在 Redis 中创建会话
-// 5. 发送响应
-// 6. 投递离线消息
-func (a *App) handleAuth(conn *server.Connection, msg *protocol.Message) {
-	// 解析请求
-	var authReq struct {
-		Token string `json:"token"`
-	}
-	if err := json.Unmarshal(msg.Body, &authReq); err != nil {
-		a.sendAuthResponse(conn, false, "Invalid request")
-		return
-	}
-
-	// 验证 Token
-	claims, err := service.ValidateToken(authReq.Token)
-	if err != nil {
-		a.sendAuthResponse(conn, false, err.Error())
-		return
-	}
-
-	// 绑定用户到连接
-	// 这样后续可以通过 UserID 找到这个连接
-	a.tcpServer.ConnManager.BindUser(claims.UserID, conn)
-
-	// 在 Redis 中创建会话
-	if err := a.session.Login(claims.UserID, conn.ID); err != nil {
-		log.Printf("[App] Failed to create session: %v", err)
-	}
-
-	// 发送认证成功响应
-	a.sendAuthResponse(conn, true, claims.UserID)
-
-	// 异步投递离线消息（不阻塞认证流程）
-	go a.msgHandler.DeliverOfflineMessages(claims.UserID, conn)
-
-	log.Printf("[App] User %s authenticated on conn-%d", claims.UserID, conn.ID)
-}
-
-// sendAuthResponse 发送认证响应
-func (a *App) sendAuthResponse(conn *server.Connection, success bool, message string) {
-	resp := map[string]interface{}{
-		"success": success,
-		"message": message,
-	}
-	data, _ := json.Marshal(resp)
-	conn.Send(&protocol.Message{
-		CmdType: protocol.CmdTypeAuthAck,
-		Body:    data,
-	})
-}
-
-// ==================== 消息处理 ====================
-
-// handleMessage 处理聊天消息
-func (a *App) handleMessage(conn *server.Connection, msg *protocol.Message) {
-	// 检查用户是否已认证
-	userID := conn.GetUserID()
-	if userID == "" {
-		log.Printf("[App] Unauthenticated message from conn-%d", conn.ID)
-		return
-	}
-
-	// 解析消息内容
-	var chatMsg struct {
-		ToUserID string `json:"to_user_id"`
-		Content  string `json:"content"`
-	}
-	if err := json.Unmarshal(msg.Body, &chatMsg); err != nil {
-		log.Printf("[App] Invalid message format: %v", err)
-		return
-	}
-
-	// 路由消息
-	if err := a.msgHandler.SendPrivateMessage(userID, chatMsg.ToUserID, []byte(chatMsg.Content)); err != nil {
-		log.Printf("[App] Failed to send message: %v", err)
-	}
-}
-
-// ==================== ACK 处理 ====================
-
-// handleMessageAck 处理消息确认
-//
-// 当客户端确认收到消息时，删除已确认的离线消息
-// 这确保消息不会重复推送
-func (a *App) handleMessageAck(conn *server.Connection, msg *protocol.Message) {
-	userID := conn.GetUserID()
-	if userID == "" {
-		return
-	}
-
-	// 解析 ACK 内容
-	var ackMsg struct {
-		SeqID int64 `json:"seq_id"`
-	}
-	if err := json.Unmarshal(msg.Body, &ackMsg); err != nil {
-		return
-	}
-
-	// 删除已确认的离线消息
-	a.offline.Remove(userID, ackMsg.SeqID)
-}
-
-// ==================== 主函数 ====================
-
-func main() {
-	// 解析命令行参数
-	gatewayID := flag.String("id", "gateway_1", "Gateway ID")
-	tcpAddr := flag.String("addr", ":8080", "TCP listen address")
-	redisAddr := flag.String("redis", "127.0.0.1:6379", "Redis address")
-	flag.Parse()
-
-	// 构造配置
-	config := &Config{
-		GatewayID: *gatewayID,
-		TCPAddr:   *tcpAddr,
-		RedisAddr: *redisAddr,
-	}
-
-	// 创建并初始化应用
-	app := NewApp(config)
-	if err := app.Initialize(); err != nil {
-		log.Fatalf("Failed to initialize: %v", err)
-	}
-
-	// 启动应用
-	if err := app.Start(); err != nil {
-		log.Fatalf("Failed to start: %v", err)
-	}
-
-	// 等待中断信号（Ctrl+C 或 kill）
-	// 这是 Go 程序优雅关闭的标准模式
-	quit := make(chan os.Signal, 1)
-	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
-	<-quit
-
-	// 收到信号，优雅关闭
-	app.Stop()
-}
+/*
+Go-IM 服务端主程序
+
+=== 程序架构概览 ===
+
+	┌─────────────────────────────────────────────────────────────┐
+	│                        App (主程序)                         │
+	│  ┌──────────────────────────────────────────────────────┐  │
+	│  │                   TCPServer                          │  │
+	│  │  - 监听端口，接受连接                                │  │
+	│  │  - 管理连接生命周期                                  │  │
+	│  │  - 心跳检测                                          │  │
+	│  └──────────────────────────────────────────────────────┘  │
+	│                          │                                  │
+	│                          ▼ 消息分发                         │
+	│  ┌──────────────────────────────────────────────────────┐  │
+	│  │               MessageHandler                         │  │
+	│  │  - 认证处理                                          │  │
+	│  │  - 消息路由                                          │  │
+	│  │  - ACK 处理                                          │  │
+	│  └──────────────────────────────────────────────────────┘  │
+	│                          │                                  │
+	│          ┌───────────────┼───────────────┐                  │
+	│          ▼               ▼               ▼                  │
+	│   ┌───────────┐   ┌───────────┐   ┌───────────┐            │
+	│   │ Session   │   │  PubSub   │   │ Offline   │            │
+	│   │ Manager   │   │  Manager  │   │ Manager   │            │
+	│   └───────────┘   └───────────┘   └───────────┘            │
+	│          │               │               │                  │
+	│          └───────────────┼───────────────┘                  │
+	│                          ▼                                  │
+	│                 ┌───────────────┐                           │
+	│                 │     Redis     │                           │
+	│                 └───────────────┘                           │
+	└─────────────────────────────────────────────────────────────┘
+
+=== 启动流程 ===
+
+1. 加载配置（配置文件、环境变量、命令行参数）并校验
+2. 初始化 Redis 连接
+3. 初始化各个 Service
+4. 启动 Pub/Sub 订阅
+5. 启动 TCP Server
+6. 等待关闭信号
+7. 优雅关闭所有组件
+
+=== 命令行参数 ===
+
+	-config  JSON 配置文件，键为参数名（默认: 空）
+	-id     网关 ID（默认: gateway_1）
+	-addr   监听地址（默认: :8080）
+	-advertise  客户端连接本网关使用的地址，登记到网关注册表，作为其他网关重连提示中的备选（默认: 空，不登记）
+	-capacity  本网关可承载的连接数，随地址一起登记，用于按负载率挑选网关（默认: 0，不登记）
+	-gateway-select  挑选备选网关的策略 least-loaded|weighted|round-robin（默认: least-loaded）
+	-redis  Redis 地址（默认: 127.0.0.1:6379）
+	-token-expiry  JWT 有效期（默认: 24h，最长 720h）
+	-token-recheck  复查已认证连接的 Token 是否过期或被吊销的间隔，失效的连接被踢下线（默认: 1m，0 表示关闭）
+	-resume-ttl  可恢复会话 ID 的有效期，断线后在此期间可用 CmdTypeReconnect 恢复（默认: 10m，0 表示关闭）
+	-jwt-method  JWT 签名算法 HS256|HS384|HS512|RS256|RS384|RS512|PS256|PS384|PS512（默认: HS256）
+	-jwt-private-key  RSA 系列算法签发 Token 使用的 RSA 私钥（PEM 文件，默认: 空，只验证不签发）
+	-jwt-public-key  RSA 系列算法验证 Token 使用的 RSA 公钥（PEM 文件，默认: 空，从私钥推出）
+	-dev-secret  允许不设置 GOIM_JWT_SECRET，使用内置的开发密钥签名，仅用于本地开发（默认: 关闭）
+	-redis-timeout  发送路径上 Redis 调用的超时，超时后降级（默认: 500ms，0 表示不限制）
+	-predecessors  前任网关 ID，逗号分隔（网关换 ID 重启时使用，默认: 空）
+	-predecessor-grace  启动后继续订阅前任网关频道的时长（默认: 2m）
+	-redis-max-ops  同时进行的 Redis 命令数上限（默认: 0，与连接池大小相同；负数表示不限制）
+	-redis-sender-share  单个发送者最多同时占用的投递名额，其余按发送者轮流分配（默认: 0，上限的四分之一；负数表示不按发送者排队）
+	-max-inflight  每个连接最大未 ACK 消息数，达到后暂停推送、改存离线，ACK 后恢复（默认: 0，不限制）
+	-send-credits  客户端发送额度窗口（默认: 32，0 表示不限制）
+	-inbound-queue  每个连接的入站队列长度（默认: 0，在读取循环中同步处理）
+	-max-frame-rate  每个连接每秒最多读取的帧数，包括心跳（默认: 0，不限制）
+	-frame-policy  帧速率超限时的处理 throttle|close（默认: throttle，暂停读取）
+	-goroutine-budget  连接相关 Goroutine 上限，接近时回收空闲连接，用完时拒绝新连接（默认: 0，不限制）
+	-check-recipients  退回发给从未登录过的用户的消息（默认: 关闭）
+	-offline-rate  离线积压推送速率上限，条/秒（默认: 0，不限速）
+	-offline-batch  上线投递离线消息时每批从 Redis 拉取的条数，整个离线盒子都会被投递（默认: 100）
+	-offline-shards  每个用户的离线盒子按 SeqID 分散到 N 个 Key，缓解大户热 Key；修改前需迁移已有消息（默认: 1，不分片）
+	-away-after  无业务请求多久后自动设置为离开（默认: 10m，0 表示关闭）
+	-offline-sweep  逐条清扫过期离线消息的间隔，不再依赖盒子 Key 的过期（默认: 0，关闭）
+	-offline-grace  断线后保持在线多久才登出，期间重连不会变为离线（默认: 0，立即登出）
+	-session-ttl  会话过期时间，客户端需要在此时间内发送心跳（默认: 5m）
+	-offline-max  每个用户最多保留的离线消息数，超出时删除最旧的（默认: 1000）
+	-offline-ttl  离线消息过期时间（默认: 168h）
+	-proxy-protocol  解析 PROXY 协议头获取真实客户端 IP（默认: 关闭）
+	-frame-sync  客户端发出的每一帧以同步标记开始，失步后在下一个标记处重新对齐；所有客户端须同时开启（默认: 关闭）
+	-offline-gzip  gzip 压缩存储离线消息，节省 Redis 内存（默认: 关闭）
+	-pubsub-compress-min  跨网关消息序列化后达到此字节数时 gzip 压缩发布，建议 1024；开启前所有网关须已升级（默认: 0，不压缩）
+	-offline-format  离线消息序列化格式 json|msgpack（默认: json）
+	-track-receipts  记录每条消息的存储/投递/确认/已读状态（默认: 关闭）
+	-conversations  维护每个用户的会话列表（最后消息预览、未读数）（默认: 关闭）
+	-wal  消息先写入预写日志，ACK 后删除，重启时重放未确认的消息（默认: 关闭）
+	-dead-letter  无法送达的消息（收件人不存在、存储失败、过期、重投用完）连同原因写入 dead_letter 列表（默认: 关闭）
+	-drain-interval  排空模式下相邻两次重连提示的间隔（默认: 20ms）
+	-trace-sync  从 Redis 的 trace_targets 集合同步帧追踪目标的间隔（见 service/trace.go，默认: 5s，0 表示关闭）
+
+环境变量：
+
+	GOIM_<参数名>  覆盖同名参数，参数名转大写、"-" 换成 "_"，如 GOIM_OFFLINE_GRACE=30s
+	GOIM_JWT_SECRET  JWT 签名密钥（必须设置，除非指定 -dev-secret）
+	GOIM_OFFLINE_KEYS  离线消息加密密钥，十六进制，逗号分隔；第一个用于加密，其余只用于解密（未设置时不加密）
+
+信号：
+
+	SIGUSR1          进入排空模式：不再接受新连接，逐个提示现有客户端重连，消息路由照常
+	SIGINT/SIGTERM   优雅关闭
+
+示例:
+
+	./server -id gateway_1 -addr :8080 -redis 127.0.0.1:6379
+	GOIM_MAX_INFLIGHT=1000 ./server -config gateway.json -id gateway_2
+
+=== 配置文件 ===
+
+配置来源的优先级为：默认值 < 配置文件 < GOIM_<参数名> 环境变量 < 命令行参数。
+配置文件是键为参数名的 JSON 对象（见 config.go），未知的键会导致启动失败：
+
+	{"id": "gateway_2", "redis": "10.0.0.5:6379", "offline-grace": "30s", "wal": true}
+
+所有来源合并后由 Config.Validate 统一校验，一次报告全部不合法的项。
+*/
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"go-im/pkg/redis"
+	"go-im/protocol"
+	"go-im/server"
+	"go-im/service"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// Version 服务端版本号
+// 构建时通过 -ldflags "-X main.Version=v1.2.3" 注入
+var Version = "dev"
+
+// maxUnknownCommands 单个连接允许的未知命令数，超过后关闭连接
+// 偶尔的未知命令多半是客户端比服务端新；持续发送则不兼容或是恶意客户端
+const maxUnknownCommands = 10
+
+// ==================== 配置结构 ====================
+
+// Config 服务器配置
+type Config struct {
+	GatewayID string // 网关唯一标识
+	TCPAddr   string // TCP 监听地址
+	RedisAddr string // Redis 服务器地址
+
+	AdvertiseAddr string // 登记到网关注册表的对外地址（为空表示不登记）
+	Capacity      int    // 登记到网关注册表的连接容量（0 表示不登记）
+	GatewaySelect string // 挑选备选网关的策略（least-loaded / weighted / round-robin）
+
+	MaxInFlight  int // 每个连接最大未 ACK 消息数（0 表示不限制）
+	SendCredits  int // 客户端发送额度窗口（0 表示不限制）
+	RedisMaxOps  int // Redis 并发命令数上限（0 表示与连接池相同，负数表示不限制）
+	SenderShare  int // 单个发送者最多占用的投递名额（0 表示上限的四分之一，负数表示不按发送者排队）
+	InboundQueue int // 每个连接的入站队列长度（0 表示同步处理）
+	MaxFrameRate int // 每个连接的入站帧速率上限，帧/秒（0 表示不限制）
+	OfflineRate  int // 离线积压推送速率上限，条/秒（0 表示不限速）
+	OfflineBatch int // 离线投递每批拉取的条数
+
+	OfflineShards int // 每个用户离线盒子的分片数（1 表示不分片）
+
+	PubSubCompressMin int // 跨网关消息达到此大小（字节）时压缩发布（0 表示不压缩）
+
+	GoroutineBudget int // 连接相关 Goroutine 上限（0 表示不限制）
+
+	AwayAfter    time.Duration // 空闲多久自动设置为离开（0 表示关闭）
+	OfflineGrace time.Duration // 断线宽限期（0 表示断线立即登出）
+	OfflineSweep time.Duration // 过期离线消息清扫间隔（0 表示关闭）
+	RedisTimeout time.Duration // 发送路径上 Redis 调用的超时（0 表示不限制）
+	TokenExpiry  time.Duration // JWT 有效期
+	TokenRecheck time.Duration // 连接凭据复查间隔（0 表示关闭）
+	ResumeTTL    time.Duration // 可恢复会话 ID 有效期（0 表示关闭）
+
+	SessionTTL time.Duration // 会话过期时间（SessionManager）
+	OfflineMax int           // 每个用户最多保留的离线消息数（OfflineManager）
+	OfflineTTL time.Duration // 离线消息过期时间（OfflineManager）
+
+	DrainInterval time.Duration // 排空模式下相邻两次重连提示的间隔
+	TraceSync     time.Duration // 帧追踪目标同步间隔（0 表示关闭）
+
+	Predecessors     []string      // 前任网关 ID（网关换 ID 重启时使用）
+	PredecessorGrace time.Duration // 继续订阅前任网关频道的时长
+
+	JWTMethod string // JWT 签名算法
+	JWTSecret string // JWT 签名密钥（从环境变量 GOIM_JWT_SECRET 读取）
+	DevSecret bool   // 未设置 JWTSecret 时允许使用内置的开发密钥
+
+	JWTPrivateKey string // RSA 私钥 PEM 文件（RS*/PS* 算法）
+	JWTPublicKey  string // RSA 公钥 PEM 文件（RS*/PS* 算法）
+
+	OfflineFormat string // 离线消息序列化格式（json / msgpack）
+	FramePolicy   string // 帧速率超限策略（throttle / close）
+	OfflineKeys   string // 离线消息加密密钥（从环境变量 GOIM_OFFLINE_KEYS 读取）
+
+	ProxyProtocol   bool // 是否解析 PROXY 协议头（部署在 TCP 负载均衡之后时开启）
+	FrameSync       bool // 入站帧是否带同步标记
+	OfflineGzip     bool // 是否压缩存储离线消息
+	CheckRecipients bool // 是否退回发给未知用户的消息
+	TrackReceipts   bool // 是否记录消息状态（存储/投递/确认/已读）
+	Conversations   bool // 是否维护会话列表
+	WAL             bool // 是否开启预写日志（至少一次投递）
+	DeadLetter      bool // 是否把无法送达的消息写入死信列表
+}
+
+// ==================== 应用程序结构 ====================
+
+// App 应用程序主结构
+// 持有所有组件的引用，负责生命周期管理
+type App struct {
+	config     *Config                      // 配置
+	tcpServer  *server.TCPServer            // TCP 服务器
+	session    *service.SessionManager      // 会话管理
+	pubsub     *service.PubSubManager       // Pub/Sub 管理
+	sequence   *service.SequenceManager     // 序列号管理
+	offline    *service.OfflineManager      // 离线消息管理
+	reactions  *service.ReactionManager     // 表情回应管理
+	groups     *service.GroupManager        // 群组管理
+	topics     *service.TopicManager        // 主题订阅管理
+	profiles   *service.ProfileManager      // 用户资料
+	scheduled  *service.ScheduledManager    // 定时消息管理
+	typing     *service.TypingManager       // 输入提示防抖
+	pins       *service.PinManager          // 消息置顶管理
+	convs      *service.ConversationManager // 会话列表（未开启时为 nil）
+	registry   *service.GatewayRegistry     // 网关注册表（重连提示中的备选网关）
+	selector   *service.GatewaySelector     // 从注册表中挑选备选网关
+	msgHandler *service.MessageHandler      // 消息处理器
+
+	// stopping 正在关闭，断开的连接需要把未确认的消息放回离线盒子
+	stopping atomic.Bool
+
+	// unknownCommands 收到的未知命令总数（在健康检查中报告）
+	unknownCommands atomic.Int64
+
+	// startTime 启动时间，用于健康检查返回运行时长
+	startTime time.Time
+}
+
+// NewApp 创建应用实例
+func NewApp(config *Config) *App {
+	return &App{config: config}
+}
+
+// ==================== 初始化 ====================
+
+// Initialize 初始化所有组件
+// 创建顺序很重要：Redis → Services → TCP Server
+func (a *App) Initialize() error {
+	// 0. 校验认证配置，配置错误时立即失败
+	if a.config.usesSecret() && a.config.JWTSecret == "" {
+		if !a.config.DevSecret {
+			return errNoJWTSecret
+		}
+		log.Println("[App] WARNING: GOIM_JWT_SECRET not set, using the built-in development secret (-dev-secret)")
+	}
+	auth, err := a.config.authConfig()
+	if err != nil {
+		return err
+	}
+	if err := service.ConfigureAuth(auth); err != nil {
+		return err
+	}
+
+	// 1. 初始化 Redis 连接
+	// 这是基础设施，其他组件都依赖它
+	// Redis 暂时不可达时降级启动：客户端会自动重连，Pub/Sub 在后台重试订阅
+	if err := redis.Init(&redis.Config{
+		Addr:          a.config.RedisAddr,
+		PoolSize:      100,
+		MaxConcurrent: a.config.RedisMaxOps,
+		SenderShare:   a.config.SenderShare,
+	}); err != nil {
+		if !errors.Is(err, redis.ErrUnreachable) {
+			return err
+		}
+		log.Printf("[App] Redis unavailable at startup, starting degraded: %v", err)
+	}
+	redis.SetCriticalTimeout(a.config.RedisTimeout)
+
+	// 2. 初始化各个 Service
+	a.session = service.NewSessionManagerWithConfig(a.config.GatewayID, service.SessionConfig{
+		TTL: a.config.SessionTTL,
+	})
+	a.session.SetOfflineGrace(a.config.OfflineGrace)
+	a.pubsub = service.NewPubSubManager(a.config.GatewayID)
+	a.pubsub.SetCompression(a.config.PubSubCompressMin)
+	if len(a.config.Predecessors) > 0 {
+		a.pubsub.SetPredecessors(a.config.Predecessors, a.config.PredecessorGrace)
+	}
+	a.sequence = service.NewSequenceManager()
+	a.offline = service.NewOfflineManagerWithConfig(service.OfflineConfig{
+		MaxMessages: a.config.OfflineMax,
+		TTL:         a.config.OfflineTTL,
+	})
+	a.offline.SetExpiryIndex(a.config.OfflineSweep > 0)
+	a.offline.SetShards(a.config.OfflineShards)
+	a.offline.SetCompression(a.config.OfflineGzip)
+	if err := a.offline.SetFormat(a.config.OfflineFormat); err != nil {
+		return err
+	}
+	if a.config.OfflineKeys != "" {
+		var keys [][]byte
+		for _, s := range strings.Split(a.config.OfflineKeys, ",") {
+			key, err := hex.DecodeString(strings.TrimSpace(s))
+			if err != nil {
+				return fmt.Errorf("invalid GOIM_OFFLINE_KEYS: %w", err)
+			}
+			keys = append(keys, key)
+		}
+		if err := a.offline.SetEncryption(keys...); err != nil {
+			return err
+		}
+	}
+	a.reactions = service.NewReactionManager()
+	a.groups = service.NewGroupManager()
+	a.topics = service.NewTopicManager()
+	a.profiles = service.NewProfileManager()
+	a.scheduled = service.NewScheduledManager()
+	a.pins = service.NewPinManager()
+
+	// 3. 初始化 TCP 服务器
+	a.tcpServer = server.NewTCPServer(a.config.TCPAddr, a.config.GatewayID)
+	a.tcpServer.SetProxyProtocol(a.config.ProxyProtocol)
+	a.tcpServer.SetFrameSync(a.config.FrameSync)
+	a.tcpServer.SetInboundQueue(a.config.InboundQueue)
+	if err := a.tcpServer.SetFrameRate(a.config.MaxFrameRate, a.config.FramePolicy); err != nil {
+		return err
+	}
+	a.tcpServer.SetGoroutineBudget(a.config.GoroutineBudget)
+	a.tcpServer.SetOnDisconnect(a.handleDisconnect)
+	a.tcpServer.SetStatsSink(logConnStats)
+	a.tcpServer.SetHeartbeatHook(a.handleHeartbeat)
+	a.registry = service.NewGatewayRegistry(a.config.GatewayID, a.config.AdvertiseAddr)
+	strategy, err := service.NewSelectionStrategy(a.config.GatewaySelect)
+	if err != nil {
+		return fmt.Errorf("%w: %q", err, a.config.GatewaySelect)
+	}
+	a.selector = service.NewGatewaySelector(a.registry, strategy)
+	a.tcpServer.SetAlternates(a.reconnectAlternates)
+
+	// 4. 初始化消息处理器
+	// 注入所有依赖的 Service
+	a.msgHandler = service.NewMessageHandler(
+		a.config.GatewayID,
+		a.tcpServer.ConnManager,
+		a.session,
+		a.pubsub,
+		a.sequence,
+		a.offline,
+		a.groups,
+	)
+	a.msgHandler.SetMaxInFlight(a.config.MaxInFlight)
+	a.msgHandler.SetRecipientCheck(a.config.CheckRecipients)
+	a.msgHandler.SetOfflinePacing(a.config.OfflineRate)
+	a.msgHandler.SetOfflineBatch(a.config.OfflineBatch)
+	if a.config.TrackReceipts {
+		a.msgHandler.SetReceipts(service.NewReceiptManager())
+	}
+	if a.config.Conversations {
+		a.convs = service.NewConversationManager()
+		a.msgHandler.SetConversations(a.convs)
+	}
+	if a.config.WAL {
+		a.msgHandler.SetWAL(service.NewWALManager(a.config.GatewayID))
+	}
+	if a.config.DeadLetter {
+		a.msgHandler.SetDeadLetter(service.NewDeadLetterList())
+	}
+	a.msgHandler.SetTopics(a.topics)
+	a.typing = service.NewTypingManager(a.msgHandler.SendTyping)
+	a.groups.SetOnChange(a.msgHandler.NotifyGroupEvent)
+
+	// 5. 将消息处理器注册到 TCP 服务器
+	// TCP 层收到消息后会调用 HandleConnection
+	a.tcpServer.SetHandler(a)
+
+	return nil
+}
+
+// ==================== 启动和停止 ====================
+
+// Start 启动所有组件
+func (a *App) Start() error {
+	a.startTime = time.Now()
+
+	// 启动 Pub/Sub 订阅
+	// 必须在 TCP 服务器之前启动，确保能收到其他节点的消息
+	// Redis 不可用时不会失败，而是在后台重试订阅
+	if err := a.pubsub.Start(a.msgHandler.HandlePubSubMessage); err != nil {
+		return err
+	}
+
+	// 重放上次运行中未确认的 WAL 条目（未开启 WAL 时无操作）
+	// 在 TCP 服务器启动之前执行：本地用户还没有连接，消息进入离线盒子，登录后投递
+	a.msgHandler.ReplayWAL()
+
+	// 启动定时消息轮询，到期后按普通私聊发送
+	a.scheduled.Start(func(m *service.ScheduledMessage) error {
+		return a.msgHandler.SendPrivateMessage(m.FromUserID, m.ToUserID, []byte(m.Content))
+	})
+
+	// 启动 TCP 服务器
+	if err := a.tcpServer.Start(); err != nil {
+		return err
+	}
+
+	// 空闲自动离开检测
+	if a.config.AwayAfter > 0 {
+		go a.awayLoop()
+	}
+
+	// 会话自检（续期，恢复被 Redis 淘汰的会话）
+	go a.sessionCheckLoop()
+
+	// 清扫逐条过期的离线消息
+	if a.config.OfflineSweep > 0 {
+		go a.offline.SweepLoop(a.config.OfflineSweep, a.stopping.Load)
+	}
+
+	// 登记到网关注册表
+	if a.config.AdvertiseAddr != "" {
+		go a.announceLoop()
+	}
+
+	// 复查长连接的 Token
+	if a.config.TokenRecheck > 0 {
+		go a.tokenCheckLoop()
+	}
+
+	// 同步帧追踪目标
+	if a.config.TraceSync > 0 {
+		go a.traceSyncLoop()
+	}
+
+	return nil
+}
+
+// Drain 进入排空模式（滚动升级的第一步）
+//
+// 不再接受新连接，并逐个提示现有客户端重连到其他网关；
+// 已有连接、Pub/Sub 和消息路由继续工作，直到 Stop
+func (a *App) Drain() {
+	// 先注销，其他网关不再把客户端引到这里
+	if err := a.registry.Withdraw(); err != nil {
+		log.Printf("[App] %v", err)
+	}
+	a.tcpServer.Drain(a.config.DrainInterval)
+}
+
+// Stop 优雅停止所有组件
+// 停止顺序与启动顺序相反：TCP Server → Pub/Sub → Redis
+func (a *App) Stop() {
+	a.shutdown()
+
+	// 3. 关闭 Redis 连接
+	redis.Close()
+
+	log.Println("[App] Application stopped")
+}
+
+// shutdown 停止网关自身的组件，不关闭进程共享的 Redis 客户端
+// 同一进程运行多个网关时（见 integration_test.go），全部 shutdown 之后再关闭 Redis
+func (a *App) shutdown() {
+	log.Println("[App] Stopping application...")
+
+	// 1. 停止 TCP 服务器（不再接受新连接，等待现有连接处理完）
+	// 连接关闭时 handleDisconnect 把已投递未确认的消息放回离线盒子，
+	// 因此 Redis 要在这之后才能关闭
+	a.stopping.Store(true)
+	if err := a.registry.Withdraw(); err != nil {
+		log.Printf("[App] %v", err)
+	}
+	a.tcpServer.Stop()
+	a.session.FlushPendingLogouts()
+
+	// 2. 停止定时消息轮询和 Pub/Sub
+	// Pub/Sub 停止后不会再有新的等待认证投递，等仍在等待的投递完成（它们需要 Redis）
+	a.scheduled.Stop()
+	a.pubsub.Stop()
+	a.msgHandler.WaitHandshakes()
+}
+
+// ==================== 消息处理 ====================
+
+// HandleConnection 实现 server.MessageHandler 接口
+// TCP 层收到消息后会调用这个方法
+// 根据消息类型分发到不同的处理函数
+func (a *App) HandleConnection(conn *server.Connection, msg *protocol.Message) {
+	// 健康检查直接应答：不需要认证，不计入活跃状态和发送额度
+	if msg.CmdType == protocol.CmdTypeHealth {
+		a.handleHealth(conn)
+		return
+	}
+
+	// 认证之前只允许 preAuthCommands 中的命令，其他命令直接拒绝
+	if !preAuthCommands[msg.CmdType] && !conn.IsAuthenticated() {
+		log.Printf("[App] Rejecting %s from unauthenticated conn-%d",
+			protocol.CmdTypeName(msg.CmdType), conn.ID)
+		a.sendAuthResponse(conn, false, "Authentication required")
+		return
+	}
+
+	// 有业务请求（心跳不会到达这里），撤销空闲自动设置的离开状态
+	if conn.TouchActivity() && conn.IsAuthenticated() {
+		if err := a.session.ClearAway(conn.GetUserID()); err != nil {
+			log.Printf("[App] Failed to clear away status: %v", err)
+		}
+	}
+
+	switch msg.CmdType {
+	case protocol.CmdTypeAuth:
+		// 认证请求
+		a.handleAuth(conn, msg)
+
+	case protocol.CmdTypeReconnect:
+		// 恢复会话
+		a.handleReconnect(conn, msg)
+
+	case protocol.CmdTypeMessage:
+		// 聊天消息
+		a.handleMessage(conn, msg)
+
+	case protocol.CmdTypeBatchMessage:
+		// 批量聊天消息
+		a.handleBatchMessage(conn, msg)
+
+	case protocol.CmdTypeMessageAck:
+		// 消息确认
+		a.handleMessageAck(conn, msg)
+
+	case protocol.CmdTypeReaction:
+		// 表情回应
+		a.handleReaction(conn, msg)
+
+	case protocol.CmdTypeWhoAmI:
+		// 查询身份
+		a.handleWhoAmI(conn)
+
+	case protocol.CmdTypeScheduled:
+		// 定时消息
+		a.handleScheduled(conn, msg)
+
+	case protocol.CmdTypeTyping:
+		// 正在输入提示
+		a.handleTyping(conn, msg)
+
+	case protocol.CmdTypePresence:
+		// 在线状态
+		a.handlePresence(conn, msg)
+
+	case protocol.CmdTypePin, protocol.CmdTypeUnpin:
+		// 置顶/取消置顶
+		a.handlePin(conn, msg)
+
+	case protocol.CmdTypeGroupEvent:
+		// 群成员变更
+		a.handleGroupEvent(conn, msg)
+
+	case protocol.CmdTypeConversations:
+		// 会话列表
+		a.handleConversations(conn, msg)
+
+	case protocol.CmdTypeUndelivered:
+		// 未送达消息查询
+		a.handleUndelivered(conn, msg)
+
+	case protocol.CmdTypeNack:
+		// 否定确认，重投消息
+		a.handleNack(conn, msg)
+
+	case protocol.CmdTypeTopic:
+		// 主题订阅
+		a.handleTopic(conn, msg)
+
+	case protocol.CmdTypeProfileQuery:
+		// 用户资料
+		a.handleProfile(conn, msg)
+
+	case protocol.CmdTypeTimeSync:
+		// 时钟同步
+		a.handleTimeSync(conn, msg)
+
+	case protocol.CmdTypePause, protocol.CmdTypeResume:
+		// 暂停/恢复实时推送
+		a.handlePause(conn, msg, msg.CmdType == protocol.CmdTypePause)
+
+	default:
+		a.handleUnknownCommand(conn, msg)
+	}
+}
+
+// handleUnknownCommand 回复 CmdTypeError，未知命令过多时关闭连接
+func (a *App) handleUnknownCommand(conn *server.Connection, msg *protocol.Message) {
+	total := a.unknownCommands.Add(1)
+	count := conn.CountUnknownCommand()
+	log.Printf("[App] Unknown command type %s from conn-%d (%d on this connection, %d total)",
+		protocol.CmdTypeName(msg.CmdType), conn.ID, count, total)
+
+	a.sendError(conn, protocol.ErrorCodeUnknownCommand, "Unknown command type", msg.CmdType)
+
+	if count >= maxUnknownCommands {
+		log.Printf("[App] Closing conn-%d after %d unknown commands", conn.ID, count)
+		// 稍等再关闭，让错误通知先发出去
+		time.AfterFunc(service.KickFlushDelay, func() { conn.Close(server.CloseReasonProtocolError) })
+	}
+}
+
+// sendError 回复 CmdTypeError
+func (a *App) sendError(conn *server.Connection, code, message string, cmdType uint16) {
+	data, _ := json.Marshal(&protocol.ErrorBody{
+		Code:    code,
+		Message: message,
+		CmdType: cmdType,
+	})
+	conn.Send(&protocol.Message{
+		CmdType: protocol.CmdTypeError,
+		Body:    data,
+	})
+}
+
+// preAuthCommands 认证之前允许处理的命令
+var preAuthCommands = map[uint16]bool{
+	protocol.CmdTypeAuth:      true,
+	protocol.CmdTypeReconnect: true,
+
+	// WhoAmI 自行返回"未认证"错误，方便客户端确认身份
+	protocol.CmdTypeWhoAmI: true,
+
+	// 时钟同步不涉及用户数据，客户端可以在认证之前校准时钟（如 Token 有效期）
+	protocol.CmdTypeTimeSync: true,
+}
+
+// ==================== 健康检查 ====================
+
+// handleHealth 返回网关状态
+//
+// 响应格式：
+//
+//	{"status": "ok", "version": "dev", "protocol": 1, "gateway_id": "gateway_1", "uptime": 3600,
+//	 "unknown_commands": 0, "redelivery_give_ups": 0}
+//
+// 排空模式下 status 为 "draining"；
+// Pub/Sub 订阅尚未建立（如 Redis 不可用）时 status 为 "degraded"：
+// 网关仍在接受连接，但跨网关消息暂时无法送达
+func (a *App) handleHealth(conn *server.Connection) {
+	status := "ok"
+	if a.tcpServer.IsDraining() {
+		// 负载均衡据此把节点摘除，不再分配新连接
+		status = "draining"
+	} else if !a.pubsub.Subscribed() {
+		status = "degraded"
+	}
+	data, _ := json.Marshal(map[string]interface{}{
+		"status":     status,
+		"version":    Version,
+		"protocol":   protocol.ProtocolVersion,
+		"gateway_id": a.config.GatewayID,
+		"uptime":     int64(time.Since(a.startTime).Seconds()),
+
+		"unknown_commands":    a.unknownCommands.Load(),
+		"redelivery_give_ups": a.msgHandler.RedeliveryGiveUps(),
+	})
+	conn.Send(&protocol.Message{
+		CmdType: protocol.CmdTypeHealthAck,
+		Body:    data,
+	})
+}
+
+// ==================== 认证处理 ====================
+
+// handleAuth 处理认证请求
+//
+// 流程：
+// 1. 解析请求中的 Token
+// 2. 验证 Token（JWT 签名、过期时间，或迁移用的 handoff token）
+// 3. 绑定用户到连接
+// 4. 在 Redis 中创建会话
+// 5. 发送响应（客户端请求时附带可恢复会话 ID）
+// 6. 投递离线消息
+func (a *App) handleAuth(conn *server.Connection, msg *protocol.Message) {
+	// 状态迁移：Unauthenticated → Authenticating
+	// 已认证或正在认证的连接不允许重复认证
+	if !conn.CompareAndSwapAuthState(server.AuthStateUnauthenticated, server.AuthStateAuthenticating) {
+		a.sendAuthResponse(conn, false, "Already authenticated")
+		return
+	}
+
+	// 解析请求
+	// 从其他网关迁移过来的客户端携带 handoff_token 而不是 JWT
+	var authReq struct {
+		Token        string `json:"token"`
+		HandoffToken string `json:"handoff_token"`
+		Compression  string `json:"compression"` // 可选，见 protocol.CompressionDictV1
+		DeviceID     string `json:"device_id"`   // 可选，未上报时为 conn-<连接ID>
+		Resumable    bool   `json:"resumable"`   // 可选，请求可恢复会话 ID
+	}
+	if err := json.Unmarshal(msg.Body, &authReq); err != nil {
+		conn.SetAuthState(server.AuthStateUnauthenticated)
+		a.sendAuthResponse(conn, false, "Invalid request")
+		return
+	}
+
+	// 验证 Token
+	var userID, username string
+	var claims *service.Claims // 迁移认证（handoff）时为 nil
+	if authReq.HandoffToken != "" {
+		uid, err := service.ConsumeHandoffToken(authReq.HandoffToken)
+		if err != nil {
+			conn.SetAuthState(server.AuthStateUnauthenticated)
+			if errors.Is(err, service.ErrInvalidHandoff) {
+				a.sendAuthResponse(conn, false, err.Error())
+			} else {
+				log.Printf("[App] Failed to consume handoff token: %v", err)
+				a.sendAuthResponse(conn, false, "Internal error")
+			}
+			return
+		}
+		userID = uid
+	} else {
+		var err error
+		claims, err = service.ValidateToken(authReq.Token)
+		if err != nil {
+			conn.SetAuthState(server.AuthStateUnauthenticated)
+			a.sendAuthResponse(conn, false, err.Error())
+			return
+		}
+		if !service.ValidTenantIDs(claims.TenantID, claims.UserID) {
+			conn.SetAuthState(server.AuthStateUnauthenticated)
+			a.sendAuthResponse(conn, false, "Invalid user ID")
+			return
+		}
+		// 之后所有路由和存储都使用带租户作用域的用户 ID
+		userID = service.ScopedID(claims.TenantID, claims.UserID)
+		username = claims.Username
+
+		// 签名有效但已被吊销；查询失败时放行（之后的定期复查会再检查）
+		if err := service.CheckRevoked(userID, claims, time.Now()); err != nil {
+			if errors.Is(err, service.ErrTokenRevoked) {
+				conn.SetAuthState(server.AuthStateUnauthenticated)
+				a.sendAuthResponse(conn, false, err.Error())
+				return
+			}
+			log.Printf("[App] %v", err)
+		}
+
+		// Token 中带有资料时更新（没有时保持不变）
+		if err := a.profiles.Set(userID, claims.DisplayName, claims.AvatarURL); err != nil {
+			log.Printf("[App] Failed to update profile of %s: %v", userID, err)
+		}
+	}
+
+	// 设备 ID 未上报时为 conn-<连接ID>
+	deviceID := authReq.DeviceID
+	if deviceID == "" {
+		deviceID = service.DefaultDeviceID(conn.ID)
+	}
+	auth := &authResult{
+		userID:   userID,
+		username: username,
+		claims:   claims,
+		authTime: time.Now(),
+		deviceID: deviceID,
+		compress: authReq.Compression == protocol.CompressionDictV1,
+	}
+
+	// 客户端请求时签发可恢复会话 ID，断线后用 CmdTypeReconnect 恢复（见 service/resume.go）
+	if authReq.Resumable && a.config.ResumeTTL > 0 {
+		id, ttl, err := service.CreateResumableSession(&service.ResumableSession{
+			UserID:   userID,
+			Username: username,
+			DeviceID: deviceID,
+			AuthTime: auth.authTime,
+			Claims:   claims,
+		}, a.config.ResumeTTL)
+		if err != nil {
+			log.Printf("[App] Failed to create resumable session for %s: %v", userID, err)
+		} else {
+			auth.resumeID, auth.resumeTTL = id, ttl
+		}
+	}
+
+	a.completeAuth(conn, auth)
+
+	// 异步投递离线消息（不阻塞认证流程）
+	// 迁移场景下即从最后 ACK 的位置继续
+	go a.msgHandler.DeliverOfflineMessages(userID, conn)
+
+	log.Printf("[App] User %s authenticated on conn-%d", userID, conn.ID)
+}
+
+// authResult 认证（JWT、handoff token 或恢复会话）得到的身份
+type authResult struct {
+	userID   string
+	username string
+	claims   *service.Claims // 迁移认证时为 nil
+	authTime time.Time       // 认证时间，恢复会话时为最初认证的时间
+	deviceID string
+	compress bool // 客户端支持字典压缩
+
+	resumeID  string        // 可恢复会话 ID，没有时为空
+	resumeTTL time.Duration // 会话 ID 的有效期
+	resumed   bool          // 由 CmdTypeReconnect 恢复
+}
+
+// completeAuth 认证通过后的公共流程
+//
+// 1. 绑定用户到连接
+// 2. 在 Redis 中创建会话，记录设备
+// 3. 发送 AuthAck
+//
+// 离线消息由调用方在之后投递（恢复会话时先确认客户端已收到的部分）
+func (a *App) completeAuth(conn *server.Connection, auth *authResult) {
+	userID := auth.userID
+
+	// 绑定用户到连接
+	// 这样后续可以通过 UserID 找到这个连接
+	a.tcpServer.ConnManager.BindUser(userID, conn)
+	conn.SetIdentity(auth.username, auth.authTime)
+	conn.SetCredential(auth.claims)
+	conn.SetResumeID(auth.resumeID)
+	conn.SetAuthState(server.AuthStateAuthenticated)
+
+	// 在 Redis 中创建会话
+	if err := a.session.Login(userID, conn.ID); err != nil {
+		log.Printf("[App] Failed to create session: %v", err)
+	}
+
+	// 记录设备（多设备查询、按设备踢出）
+	conn.SetDeviceID(auth.deviceID)
+	now := time.Now().Unix()
+	if err := a.session.RegisterDevice(userID, &service.DeviceInfo{
+		DeviceID:    auth.deviceID,
+		GatewayID:   a.config.GatewayID,
+		ConnID:      conn.ID,
+		Transport:   service.TransportTCP,
+		ConnectedAt: now,
+		LastActive:  now,
+	}); err != nil {
+		log.Printf("[App] Failed to register device: %v", err)
+	}
+
+	// 发送认证成功响应，附带初始发送额度
+	conn.GrantCredits(a.config.SendCredits)
+	resp := map[string]interface{}{
+		"success": true,
+		"message": userID,
+	}
+	if a.config.SendCredits > 0 {
+		resp["credits"] = a.config.SendCredits
+	}
+	// 附带非敏感的声明（用户名、角色、租户、过期时间），客户端无需解析 JWT
+	// 迁移认证没有 JWT，只返回用户和租户
+	if auth.claims != nil {
+		resp["claims"] = auth.claims.PublicClaims()
+	} else {
+		public := map[string]interface{}{"user_id": service.LocalID(userID)}
+		if tenantID := service.TenantOf(userID); tenantID != "" {
+			public["tenant_id"] = tenantID
+		}
+		resp["claims"] = public
+	}
+	if auth.resumeID != "" {
+		resp["session_id"] = auth.resumeID
+		resp["session_ttl"] = int64(auth.resumeTTL / time.Second)
+	}
+	if auth.resumed {
+		resp["resumed"] = true
+	}
+	if auth.compress {
+		resp["compression"] = protocol.CompressionDictV1
+	}
+	data, _ := json.Marshal(resp)
+	conn.Send(&protocol.Message{
+		CmdType: protocol.CmdTypeAuthAck,
+		Body:    data,
+	})
+	// AuthAck 本身不压缩，客户端看到回显后才知道之后的帧可能被压缩
+	conn.SetCompression(auth.compress)
+}
+
+// handleReconnect 用认证时签发的会话 ID 恢复会话，不需要重新发送 Token
+//
+// 请求: {"session_id": "...", "last_seq": 42, "compression": "dict-v1"}
+//
+// last_seq 为客户端收到的最大 SeqID，截断到上一个连接投递过的位置后作为累积 ACK，
+// 之后只投递剩余的离线消息。成功和失败都以 CmdTypeAuthAck 回复，
+// 失败时客户端应改用 CmdTypeAuth 完整认证
+func (a *App) handleReconnect(conn *server.Connection, msg *protocol.Message) {
+	if !conn.CompareAndSwapAuthState(server.AuthStateUnauthenticated, server.AuthStateAuthenticating) {
+		a.sendAuthResponse(conn, false, "Already authenticated")
+		return
+	}
+	fail := func(message string) {
+		conn.SetAuthState(server.AuthStateUnauthenticated)
+		a.sendAuthResponse(conn, false, message)
+	}
+
+	var req struct {
+		SessionID   string `json:"session_id"`
+		LastSeq     int64  `json:"last_seq"`
+		Compression string `json:"compression"` // 可选，见 protocol.CompressionDictV1
+	}
+	if err := json.Unmarshal(msg.Body, &req); err != nil {
+		fail("Invalid request")
+		return
+	}
+	if a.config.ResumeTTL <= 0 {
+		fail(service.ErrInvalidResume.Error())
+		return
+	}
+
+	sess, ttl, err := service.ResumeSession(req.SessionID, a.config.ResumeTTL, time.Now())
+	if err != nil {
+		if errors.Is(err, service.ErrInvalidResume) || errors.Is(err, service.ErrTokenExpired) {
+			fail(err.Error())
+		} else {
+			log.Printf("[App] %v", err)
+			fail("Internal error")
+		}
+		return
+	}
+
+	// 与认证相同：被吊销时拒绝，查询失败时放行
+	if err := service.CheckRevoked(sess.UserID, sess.Claims, sess.AuthTime); err != nil {
+		if errors.Is(err, service.ErrTokenRevoked) {
+			if derr := service.DropResumableSession(req.SessionID); derr != nil {
+				log.Printf("[App] %v", derr)
+			}
+			fail(err.Error())
+			return
+		}
+		log.Printf("[App] %v", err)
+	}
+
+	a.completeAuth(conn, &authResult{
+		userID:    sess.UserID,
+		username:  sess.Username,
+		claims:    sess.Claims,
+		authTime:  sess.AuthTime,
+		deviceID:  sess.DeviceID,
+		compress:  req.Compression == protocol.CompressionDictV1,
+		resumeID:  req.SessionID,
+		resumeTTL: ttl,
+		resumed:   true,
+	})
+
+	// 客户端已经收到的消息不再重新推送
+	if err := a.msgHandler.ResumeAck(conn, req.LastSeq, sess.Delivered); err != nil {
+		log.Printf("[App] Failed to ack resumed session of %s: %v", sess.UserID, err)
+	}
+	go a.msgHandler.DeliverOfflineMessages(sess.UserID, conn)
+
+	log.Printf("[App] User %s resumed session on conn-%d (last_seq %d)", sess.UserID, conn.ID, req.LastSeq)
+}
+
+// logConnStats 连接关闭时输出一行 JSON 统计摘要，供事后分析（见 server/stats.go）
+func logConnStats(stats *server.ConnStats) {
+	data, _ := json.Marshal(stats)
+	log.Printf("[App] Connection summary: %s", data)
+}
+
+// handleDisconnect 连接断开时登出会话
+// 由连接的统一清理流程调用，每个连接只执行一次
+//
+// 网关关闭期间，还会把已投递未确认的消息放回离线盒子，重启后不丢消息
+func (a *App) handleDisconnect(conn *server.Connection) {
+	if !conn.IsAuthenticated() {
+		return
+	}
+	if a.stopping.Load() {
+		if n := a.msgHandler.RequeueUnacked(conn); n > 0 {
+			log.Printf("[App] Requeued %d unacked messages for user %s", n, conn.GetUserID())
+		}
+	}
+	userID := conn.GetUserID()
+	if err := a.session.RemoveDevice(userID, conn.GetDeviceID(), conn.ID); err != nil {
+		log.Printf("[App] Failed to remove device of conn-%d: %v", conn.ID, err)
+	}
+	reason := conn.CloseReason()
+	a.saveResumableSession(conn, reason)
+
+	// 断线宽限期：推迟登出，期间重连则取消
+	// 网关关闭、被踢、违反协议、凭据失效时不会很快重连，立即登出
+	if a.stopping.Load() || reason == server.CloseReasonKicked || reason == server.CloseReasonProtocolError ||
+		reason == server.CloseReasonTokenInvalid {
+		a.logoutConn(userID, conn)
+		return
+	}
+	a.session.DeferLogout(userID, conn.ID, func() { a.logoutConn(userID, conn) })
+}
+
+// saveResumableSession 连接断开时更新它的可恢复会话
+// 被踢下线、凭据失效时删除会话；其他情况记录投递位置，有效期从现在起算
+func (a *App) saveResumableSession(conn *server.Connection, reason server.CloseReason) {
+	id := conn.ResumeID()
+	if id == "" {
+		return
+	}
+	var err error
+	if reason == server.CloseReasonKicked || reason == server.CloseReasonTokenInvalid {
+		err = service.DropResumableSession(id)
+	} else {
+		err = service.NoteResumeDelivered(id, conn.MaxSentSeq(), a.config.ResumeTTL)
+	}
+	if err != nil {
+		log.Printf("[App] %v", err)
+	}
+}
+
+// logoutConn 登出断开的连接，用户在本网关还有其他连接时会话改为指向它
+func (a *App) logoutConn(userID string, conn *server.Connection) {
+	if err := a.session.LogoutConn(userID, conn.ID); err != nil {
+		log.Printf("[App] Failed to log out conn-%d: %v", conn.ID, err)
+	}
+
+	// 用户在本网关已经没有连接，其他网关不再需要把消息转发到这里
+	other := a.tcpServer.ConnManager.GetByUserID(userID)
+	if other == nil || other == conn || other.IsClosed() {
+		if err := a.session.LeaveGateway(userID); err != nil {
+			log.Printf("[App] Failed to leave gateway set of %s: %v", userID, err)
+		}
+		return
+	}
+
+	// 会话随本连接删除了，但用户在本网关还有其他设备（如只踢掉了一个设备）：
+	// 会话改为指向仍在线的连接
+	if a.stopping.Load() || a.session.IsOnline(userID) {
+		return
+	}
+	if err := a.session.Login(userID, other.ID); err != nil {
+		log.Printf("[App] Failed to restore session for %s: %v", userID, err)
+	}
+}
+
+// sendAuthResponse 发送认证响应
+func (a *App) sendAuthResponse(conn *server.Connection, success bool, message string) {
+	resp := map[string]interface{}{
+		"success": success,
+		"message": message,
+	}
+	data, _ := json.Marshal(resp)
+	conn.Send(&protocol.Message{
+		CmdType: protocol.CmdTypeAuthAck,
+		Body:    data,
+	})
+}
+
+// ==================== 消息处理 ====================
+
+// handleMessage 处理聊天消息
+func (a *App) handleMessage(conn *server.Connection, msg *protocol.Message) {
+	// 检查用户是否已认证
+	userID := conn.GetUserID()
+	if userID == "" {
+		log.Printf("[App] Unauthenticated message from conn-%d", conn.ID)
+		return
+	}
+
+	// 基于额度的流控：超额发送的消息直接拒绝
+	if a.config.SendCredits > 0 {
+		if !conn.ConsumeCredit() {
+			log.Printf("[App] User %s exceeded send credits, dropping message", userID)
+			a.sendCredit(conn, 0)
+			return
+		}
+		defer a.replenishCredits(conn)
+	}
+
+	var chatMsg chatRequest
+	if err := json.Unmarshal(msg.Body, &chatMsg); err != nil {
+		log.Printf("[App] Invalid message format: %v", err)
+		return
+	}
+
+	_, err := a.sendChat(conn, userID, &chatMsg)
+	switch {
+	case errors.Is(err, errOutOfOrder):
+		log.Printf("[App] Rejecting out-of-order message from %s (client_seq %d)", userID, chatMsg.ClientSeq)
+		a.sendError(conn, protocol.ErrorCodeOutOfOrder, err.Error(), msg.CmdType)
+	case errors.Is(err, service.ErrUnknownRecipient):
+		// 退信：告诉发送者收件人不存在
+		service.SendSystemEvent(conn, &service.SystemEvent{
+			Event:    service.SystemEventUndeliverable,
+			ToUserID: chatMsg.ToUserID,
+		})
+	case errors.Is(err, service.ErrUnknownDeliveryPolicy), errors.Is(err, service.ErrInvalidClientID):
+		log.Printf("[App] Invalid message format: %v", err)
+	case err != nil:
+		log.Printf("[App] Failed to send message: %v", err)
+	}
+}
+
+// chatRequest CmdTypeMessage 的消息体，也是 CmdTypeBatchMessage 中的一项
+//
+// 带 group_id 的是群聊消息，否则是私聊消息
+// deliver_before 可选，Unix 毫秒，超过该时间仍未送达则丢弃
+// client_seq 可选，客户端自己的发送计数，同一会话内必须严格递增
+// content_bytes 可选，base64 编码的二进制内容，存在时代替 content（推送时原样下发）
+// delivery 可选，私聊消息的投递策略 online_only | store_if_offline | always_store（见 service/delivery.go）
+type chatRequest struct {
+	ToUserID      string `json:"to_user_id"`
+	GroupID       string `json:"group_id"`
+	Content       string `json:"content"`
+	DeliverBefore int64  `json:"deliver_before"`
+	ClientSeq     int64  `json:"client_seq"`
+	ContentBytes  []byte `json:"content_bytes"`
+	Delivery      string `json:"delivery"`
+}
+
+// errOutOfOrder 消息的客户端计数回退或重复
+var errOutOfOrder = errors.New("client_seq must increase within a conversation")
+
+// sendChat 路由一条客户端发来的消息
+// 返回私聊消息的路由结果，群聊消息的结果为 nil
+func (a *App) sendChat(conn *server.Connection, userID string, req *chatRequest) (*service.SendOutcome, error) {
+	// 带了客户端计数的消息：计数回退或重复说明客户端有问题（或在伪造顺序），拒绝
+	// 不带计数的客户端不受影响
+	if req.ClientSeq > 0 {
+		conversation := "u:" + req.ToUserID
+		if req.GroupID != "" {
+			conversation = "g:" + req.GroupID
+		}
+		if !conn.AdvanceClientSeq(conversation, req.ClientSeq) {
+			return nil, errOutOfOrder
+		}
+	}
+
+	content := []byte(req.Content)
+	if len(req.ContentBytes) > 0 {
+		content = req.ContentBytes
+	}
+
+	// 客户端只知道租户内的 ID，按发送者的租户补全作用域
+	if req.GroupID != "" {
+		groupID, err := service.ScopeForUser(userID, req.GroupID)
+		if err != nil {
+			return nil, err
+		}
+		if err := a.msgHandler.SendGroupMessage(userID, groupID, content); err != nil {
+			return nil, fmt.Errorf("failed to send group message: %w", err)
+		}
+		return nil, nil
+	}
+
+	// 路由消息
+	toUserID, err := service.ScopeForUser(userID, req.ToUserID)
+	if err != nil {
+		return nil, err
+	}
+	policy, err := service.ParseDeliveryPolicy(req.Delivery)
+	if err != nil {
+		return nil, err
+	}
+	var deliverBefore time.Time
+	if req.DeliverBefore > 0 {
+		deliverBefore = time.UnixMilli(req.DeliverBefore)
+	}
+	return a.msgHandler.SendPrivate(userID, toUserID, content, deliverBefore, policy)
+}
+
+// handleBatchMessage 处理批量聊天消息
+//
+// 逐条按 CmdTypeMessage 的规则路由，一条失败不影响其他消息，
+// 最后以同一命令类型回复每条的结果（见 service/batch.go）
+// 每条消息消耗一个发送额度
+func (a *App) handleBatchMessage(conn *server.Connection, msg *protocol.Message) {
+	userID := conn.GetUserID()
+
+	var batch struct {
+		Messages []json.RawMessage `json:"messages"`
+	}
+	if err := json.Unmarshal(msg.Body, &batch); err != nil {
+		log.Printf("[App] Invalid batch format: %v", err)
+		return
+	}
+	if len(batch.Messages) > service.MaxBatchMessages {
+		a.sendError(conn, protocol.ErrorCodeBatchTooLarge,
+			fmt.Sprintf("at most %d messages per batch, got %d", service.MaxBatchMessages, len(batch.Messages)), msg.CmdType)
+		return
+	}
+	if a.config.SendCredits > 0 {
+		defer a.replenishCredits(conn)
+	}
+
+	ack := &service.BatchAck{Results: make([]service.BatchResult, 0, len(batch.Messages))}
+	for i, raw := range batch.Messages {
+		result := service.BatchResult{Index: i, Status: service.BatchStatusFailed}
+
+		var req chatRequest
+		if err := json.Unmarshal(raw, &req); err != nil {
+			result.Error = service.BatchErrorInvalid
+			ack.Add(result)
+			continue
+		}
+		if a.config.SendCredits > 0 && !conn.ConsumeCredit() {
+			result.Error = service.BatchErrorNoCredits
+			ack.Add(result)
+			continue
+		}
+
+		outcome, err := a.sendChat(conn, userID, &req)
+		switch {
+		case errors.Is(err, errOutOfOrder):
+			result.Error = protocol.ErrorCodeOutOfOrder
+		case errors.Is(err, service.ErrUnknownRecipient):
+			result.Error = service.BatchErrorUnknownRecipient
+		case errors.Is(err, service.ErrUnknownDeliveryPolicy), errors.Is(err, service.ErrInvalidClientID):
+			result.Error = service.BatchErrorInvalid
+		case err != nil:
+			log.Printf("[App] Failed to send message %d of batch from %s: %v", i, userID, err)
+			result.Error = service.BatchErrorInternal
+		case outcome == nil:
+			result.Status = service.BatchStatusSent
+		default:
+			result.SeqID = outcome.SeqID
+			result.Status = service.BatchStatusSent
+			if outcome.Stored {
+				result.Status = service.BatchStatusStored
+			}
+		}
+		ack.Add(result)
+	}
+
+	data, _ := json.Marshal(ack)
+	conn.Send(&protocol.Message{
+		CmdType: protocol.CmdTypeBatchMessage,
+		Body:    data,
+	})
+}
+
+// ==================== 发送额度 ====================
+
+// replenishCredits 处理完消息后按批归还发送额度
+// 消耗达到窗口一半时补充，客户端不会在正常速率下用完额度
+func (a *App) replenishCredits(conn *server.Connection) {
+	threshold := a.config.SendCredits / 2
+	if threshold < 1 {
+		threshold = 1
+	}
+	if n := conn.ReplenishCredits(threshold); n > 0 {
+		a.sendCredit(conn, n)
+	}
+}
+
+// sendCredit 通知客户端新增的发送额度
+// credits 为 0 表示消息因额度耗尽被拒绝
+func (a *App) sendCredit(conn *server.Connection, credits int) {
+	data, _ := json.Marshal(map[string]int{"credits": credits})
+	conn.Send(&protocol.Message{
+		CmdType: protocol.CmdTypeCredit,
+		Body:    data,
+	})
+}
+
+// ==================== ACK 处理 ====================
+
+// handleMessageAck 处理消息确认
+//
+// 当客户端确认收到消息时，删除已确认的离线消息并释放在途名额
+// 这确保消息不会重复推送
+//
+// 支持两种形式：
+//   - {"seq_id": 10}        累积确认：10 及之前的消息都已收到
+//   - {"msg_ids": ["alice:bob:3", "group:g1:5"]}   选择性确认：只确认列出的消息（乱序场景），
+//     消息 ID 取推送中的 msg_id；SeqID 只在会话内唯一，不能单独用来确认
+func (a *App) handleMessageAck(conn *server.Connection, msg *protocol.Message) {
+	userID := conn.GetUserID()
+	if userID == "" {
+		return
+	}
+
+	// 解析 ACK 内容
+	var ackMsg struct {
+		SeqID  int64    `json:"seq_id"`
+		MsgIDs []string `json:"msg_ids"`
+		Read   []string `json:"read_msg_ids"` // 已读的消息 ID（可选）
+	}
+	if err := json.Unmarshal(msg.Body, &ackMsg); err != nil {
+		return
+	}
+
+	for _, msgID := range ackMsg.Read {
+		if err := a.msgHandler.MarkRead(userID, msgID); err != nil {
+			log.Printf("[App] Failed to mark %s read: %v", msgID, err)
+		}
+	}
+
+	if len(ackMsg.MsgIDs) > 0 {
+		if err := a.msgHandler.HandleSelectiveAck(conn, ackMsg.MsgIDs); err != nil {
+			log.Printf("[App] Failed to handle selective ack: %v", err)
+		}
+		return
+	}
+
+	// 删除已确认的离线消息，释放流控名额
+	if err := a.msgHandler.HandleAck(conn, ackMsg.SeqID); err != nil {
+		log.Printf("[App] Failed to handle ack: %v", err)
+	}
+}
+
+// handleNack 处理否定确认
+//
+// 请求: {"seq_id": 42}
+// 成功时直接重投消息；找不到消息或重投次数达到上限时回复 CmdTypeError
+func (a *App) handleNack(conn *server.Connection, msg *protocol.Message) {
+	var req struct {
+		SeqID int64 `json:"seq_id"`
+	}
+	if err := json.Unmarshal(msg.Body, &req); err != nil {
+		log.Printf("[App] Invalid nack from conn-%d", conn.ID)
+		return
+	}
+
+	_, err := a.msgHandler.HandleNack(conn, req.SeqID)
+	if err == nil {
+		return
+	}
+
+	code := protocol.ErrorCodeMessageNotFound
+	switch {
+	case errors.Is(err, service.ErrRedeliveryLimit):
+		code = protocol.ErrorCodeRedeliveryLimit
+	case !errors.Is(err, service.ErrMessageNotFound):
+		log.Printf("[App] Failed to redeliver seq %d to %s: %v", req.SeqID, conn.GetUserID(), err)
+		return
+	}
+	a.sendError(conn, code, err.Error(), msg.CmdType)
+}
+
+// ==================== 身份查询 ====================
+
+// handleWhoAmI 返回当前连接绑定的身份和会话信息
+//
+// 客户端重连后可以用它确认自己以正确的身份登录到了哪个网关
+func (a *App) handleWhoAmI(conn *server.Connection) {
+	var resp map[string]interface{}
+	if !conn.IsAuthenticated() {
+		resp = map[string]interface{}{
+			"success": false,
+			"message": "Not authenticated",
+		}
+	} else {
+		userID := conn.GetUserID()
+		resp = map[string]interface{}{
+			"success":    true,
+			"user_id":    service.LocalID(userID),
+			"tenant_id":  service.TenantOf(userID),
+			"username":   conn.GetUsername(),
+			"gateway_id": a.config.GatewayID,
+			"login_time": conn.GetAuthTime().Unix(),
+			"devices":    a.tcpServer.ConnManager.CountByUserID(userID),
+		}
+	}
+
+	data, _ := json.Marshal(resp)
+	conn.Send(&protocol.Message{
+		CmdType: protocol.CmdTypeWhoAmI,
+		Body:    data,
+	})
+}
+
+// ==================== 表情回应 ====================
+
+// handleReaction 处理表情回应
+//
+// 请求格式：
+//
+//	{"to_user_id": "alice", "seq_id": 42, "emoji": "👍"}
+//
+// to_user_id 是原消息的发送者，emoji 为空表示移除回应
+// 回应保存后通知原消息发送者
+func (a *App) handleReaction(conn *server.Connection, msg *protocol.Message) {
+	userID := conn.GetUserID()
+
+	var req struct {
+		ToUserID string `json:"to_user_id"`
+		SeqID    int64  `json:"seq_id"`
+		Emoji    string `json:"emoji"`
+	}
+	if err := json.Unmarshal(msg.Body, &req); err != nil || req.ToUserID == "" {
+		log.Printf("[App] Invalid reaction format from conn-%d", conn.ID)
+		return
+	}
+
+	toUserID, err := service.ScopeForUser(userID, req.ToUserID)
+	if err != nil {
+		log.Printf("[App] Invalid reaction from conn-%d: %v", conn.ID, err)
+		return
+	}
+	msgID := service.MessageID(service.ConversationID(userID, toUserID), req.SeqID)
+
+	if req.Emoji == "" {
+		err = a.reactions.Remove(msgID, userID)
+	} else {
+		err = a.reactions.Add(msgID, userID, req.Emoji)
+	}
+	if err != nil {
+		log.Printf("[App] Failed to save reaction: %v", err)
+		return
+	}
+
+	// 通知原消息发送者
+	payload, _ := json.Marshal(&service.ReactionNotification{
+		MsgID:   msgID,
+		SeqID:   req.SeqID,
+		UserID:  service.LocalID(userID),
+		Emoji:   req.Emoji,
+		Removed: req.Emoji == "",
+	})
+	if err := a.msgHandler.SendNotification(userID, toUserID, service.MsgTypeReaction, payload); err != nil {
+		log.Printf("[App] Failed to send reaction notification: %v", err)
+	}
+}
+
+// ==================== 定时消息 ====================
+
+// handleScheduled 处理定时消息的创建和取消
+//
+// 请求格式：
+//
+//	{"action": "schedule", "to_user_id": "bob", "content": "早安", "deliver_at": 1700000000000}
+//	{"action": "cancel", "id": "9f86d0..."}
+//
+// 响应使用同一命令类型：{"success": true, "id": "9f86d0..."}
+func (a *App) handleScheduled(conn *server.Connection, msg *protocol.Message) {
+	userID := conn.GetUserID()
+
+	var req struct {
+		Action    string `json:"action"`
+		ID        string `json:"id"`
+		ToUserID  string `json:"to_user_id"`
+		Content   string `json:"content"`
+		DeliverAt int64  `json:"deliver_at"`
+	}
+	if err := json.Unmarshal(msg.Body, &req); err != nil {
+		log.Printf("[App] Invalid scheduled request from conn-%d", conn.ID)
+		return
+	}
+
+	resp := map[string]interface{}{"success": true}
+	switch req.Action {
+	case "schedule":
+		toUserID, err := service.ScopeForUser(userID, req.ToUserID)
+		if err == nil {
+			var id string
+			if id, err = a.scheduled.Schedule(userID, toUserID, req.Content, time.UnixMilli(req.DeliverAt)); err == nil {
+				resp["id"] = id
+			}
+		}
+		if err != nil {
+			resp = map[string]interface{}{"success": false, "message": err.Error()}
+		}
+	case "cancel":
+		if err := a.scheduled.Cancel(userID, req.ID); err != nil {
+			resp = map[string]interface{}{"success": false, "message": err.Error()}
+		} else {
+			resp["id"] = req.ID
+		}
+	default:
+		resp = map[string]interface{}{"success": false, "message": "Unknown action"}
+	}
+
+	data, _ := json.Marshal(resp)
+	conn.Send(&protocol.Message{
+		CmdType: protocol.CmdTypeScheduled,
+		Body:    data,
+	})
+}
+
+// ==================== 输入提示 ====================
+
+// handleTyping 处理输入状态上报
+//
+// 请求格式：{"to_user_id": "bob", "typing": true}
+// 防抖和自动过期由 TypingManager 处理
+func (a *App) handleTyping(conn *server.Connection, msg *protocol.Message) {
+	userID := conn.GetUserID()
+
+	var req struct {
+		ToUserID string `json:"to_user_id"`
+		Typing   bool   `json:"typing"`
+	}
+	if err := json.Unmarshal(msg.Body, &req); err != nil || req.ToUserID == "" {
+		return
+	}
+
+	toUserID, err := service.ScopeForUser(userID, req.ToUserID)
+	if err != nil {
+		return
+	}
+	a.typing.Update(userID, toUserID, req.Typing)
+}
+
+// ==================== 会话列表 ====================
+
+// handleUndelivered 查询自己发给各收件人、仍未送达的消息数
+//
+// 请求: {"user_ids": ["bob", "carol"]}
+// 响应: {"success": true, "recipients": [{"user_id": "bob", "online": true, "pending": 0}, ...]}
+func (a *App) handleUndelivered(conn *server.Connection, msg *protocol.Message) {
+	userID := conn.GetUserID()
+
+	var req struct {
+		UserIDs []string `json:"user_ids"`
+	}
+	if err := json.Unmarshal(msg.Body, &req); err != nil {
+		log.Printf("[App] Invalid undelivered request from conn-%d", conn.ID)
+		return
+	}
+
+	reply := func(resp map[string]interface{}) {
+		data, _ := json.Marshal(resp)
+		conn.Send(&protocol.Message{CmdType: protocol.CmdTypeUndelivered, Body: data})
+	}
+
+	recipients := make([]string, len(req.UserIDs))
+	for i, id := range req.UserIDs {
+		scoped, err := service.ScopeForUser(userID, id)
+		if err != nil {
+			reply(map[string]interface{}{"success": false, "message": err.Error()})
+			return
+		}
+		recipients[i] = scoped
+	}
+
+	result, err := a.msgHandler.Undelivered(userID, recipients)
+	if errors.Is(err, service.ErrTooManyRecipients) {
+		reply(map[string]interface{}{"success": false, "message": err.Error()})
+		return
+	}
+	if err != nil {
+		log.Printf("[App] Failed to query undelivered messages: %v", err)
+		reply(map[string]interface{}{"success": false, "message": "Internal error"})
+		return
+	}
+	for _, d := range result {
+		d.UserID = service.LocalID(d.UserID)
+	}
+	reply(map[string]interface{}{"success": true, "recipients": result})
+}
+
+// handleHeartbeat 处理心跳捎带的已读位置
+//
+// 心跳体格式（普通心跳为 "ping"，由 TCP 层直接回复，不会到这里）：
+//
+//	{"read": {"alice": 42, "group:team": 17}}
+//
+// 已读位置只前进，读到会话最后一条消息时清零未读数（未开启会话列表时忽略）
+func (a *App) handleHeartbeat(conn *server.Connection, body []byte) {
+	if a.convs == nil {
+		return
+	}
+	var req struct {
+		Read map[string]int64 `json:"read"`
+	}
+	if err := json.Unmarshal(body, &req); err != nil || len(req.Read) == 0 {
+		return
+	}
+	if _, err := a.convs.ApplyReadPointers(conn.GetUserID(), req.Read); err != nil {
+		log.Printf("[App] Failed to sync read pointers of %s: %v", conn.GetUserID(), err)
+	}
+}
+
+// handleConversations 查询会话列表、清零未读数或归档会话
+//
+// 请求格式：
+//
+//	{"limit": 20}                            // 按最近活跃时间倒序列出会话（不含已归档）
+//	{"limit": 20, "include_archived": true}  // 列出会话，包括已归档的
+//	{"read": "alice"}                        // 清零与 alice 的会话未读数（群聊为 "group:<群 ID>"）
+//	{"archive": "alice"}                     // 归档会话，收到新消息时自动取消
+//	{"unarchive": "alice"}                   // 取消归档
+func (a *App) handleConversations(conn *server.Connection, msg *protocol.Message) {
+	userID := conn.GetUserID()
+
+	var req struct {
+		Limit           int    `json:"limit"`
+		IncludeArchived bool   `json:"include_archived"`
+		Read            string `json:"read"`
+		Archive         string `json:"archive"`
+		Unarchive       string `json:"unarchive"`
+	}
+	if err := json.Unmarshal(msg.Body, &req); err != nil {
+		log.Printf("[App] Invalid conversations request from conn-%d", conn.ID)
+		return
+	}
+
+	reply := func(resp map[string]interface{}) {
+		data, _ := json.Marshal(resp)
+		conn.Send(&protocol.Message{CmdType: protocol.CmdTypeConversations, Body: data})
+	}
+
+	if a.convs == nil {
+		reply(map[string]interface{}{"success": false, "message": "Conversation list is disabled"})
+		return
+	}
+
+	if req.Read != "" {
+		if err := a.convs.MarkRead(userID, req.Read); err != nil {
+			log.Printf("[App] Failed to mark conversation read: %v", err)
+			reply(map[string]interface{}{"success": false, "message": "Internal error"})
+			return
+		}
+		reply(map[string]interface{}{"success": true})
+		return
+	}
+
+	if req.Archive != "" {
+		err := a.convs.Archive(userID, req.Archive)
+		if errors.Is(err, service.ErrConversationNotFound) {
+			reply(map[string]interface{}{"success": false, "message": err.Error()})
+			return
+		}
+		if err != nil {
+			log.Printf("[App] Failed to archive conversation: %v", err)
+			reply(map[string]interface{}{"success": false, "message": "Internal error"})
+			return
+		}
+		reply(map[string]interface{}{"success": true, "archived": req.Archive})
+		return
+	}
+
+	if req.Unarchive != "" {
+		if err := a.convs.Unarchive(userID, req.Unarchive); err != nil {
+			log.Printf("[App] Failed to unarchive conversation: %v", err)
+			reply(map[string]interface{}{"success": false, "message": "Internal error"})
+			return
+		}
+		reply(map[string]interface{}{"success": true, "unarchived": req.Unarchive})
+		return
+	}
+
+	convs, err := a.convs.ListConversations(userID, req.Limit, req.IncludeArchived)
+	if err != nil {
+		log.Printf("[App] Failed to list conversations: %v", err)
+		reply(map[string]interface{}{"success": false, "message": "Internal error"})
+		return
+	}
+	reply(map[string]interface{}{"success": true, "conversations": convs})
+}
+
+// ==================== 群成员变更 ====================
+
+// handleGroupEvent 处理加入/退出群，以及添加/移除其他成员
+//
+// 请求格式：
+//
+//	{"group_id": "team", "action": "join"}                     // 自己加入
+//	{"group_id": "team", "action": "leave"}                    // 自己退出
+//	{"group_id": "team", "action": "join", "user_id": "bob"}   // 添加 bob（操作者须是成员）
+//	{"group_id": "team", "action": "leave", "user_id": "bob"}  // 移除 bob（操作者须是成员）
+//
+// 成功后 GroupManager 触发变更通知，由 MessageHandler 扇出给群成员
+func (a *App) handleGroupEvent(conn *server.Connection, msg *protocol.Message) {
+	userID := conn.GetUserID()
+
+	var req struct {
+		GroupID string `json:"group_id"`
+		Action  string `json:"action"`
+		UserID  string `json:"user_id"`
+	}
+	if err := json.Unmarshal(msg.Body, &req); err != nil || req.GroupID == "" {
+		log.Printf("[App] Invalid group event from conn-%d", conn.ID)
+		return
+	}
+
+	reply := func(success bool, message string) {
+		data, _ := json.Marshal(map[string]interface{}{"success": success, "message": message})
+		conn.Send(&protocol.Message{CmdType: protocol.CmdTypeGroupEvent, Body: data})
+	}
+
+	groupID, err := service.ScopeForUser(userID, req.GroupID)
+	if err != nil {
+		reply(false, err.Error())
+		return
+	}
+	target := userID
+	if req.UserID != "" {
+		if target, err = service.ScopeForUser(userID, req.UserID); err != nil {
+			reply(false, err.Error())
+			return
+		}
+	}
+
+	// 变更其他人的成员身份，操作者必须是群成员
+	if target != userID {
+		ok, err := a.groups.IsMember(groupID, userID)
+		if err != nil {
+			log.Printf("[App] Failed to check membership: %v", err)
+			reply(false, "Internal error")
+			return
+		}
+		if !ok {
+			reply(false, service.ErrNotGroupMember.Error())
+			return
+		}
+	}
+
+	switch req.Action {
+	case service.GroupEventJoin:
+		err = a.groups.AddMember(groupID, target, userID)
+	case service.GroupEventLeave:
+		err = a.groups.RemoveMember(groupID, target, userID)
+	default:
+		reply(false, "Unknown action")
+		return
+	}
+	if err != nil {
+		log.Printf("[App] Failed to %s group %s: %v", req.Action, groupID, err)
+		reply(false, "Internal error")
+		return
+	}
+	reply(true, req.Action)
+}
+
+// ==================== 主题订阅 ====================
+
+// handleTopic 处理主题订阅
+//
+// 请求格式：
+//
+//	{"action": "subscribe", "topic": "sports"}
+//	{"action": "unsubscribe", "topic": "sports"}
+//	{"action": "list"}
+//
+// 主题没有成员授权，任何用户都可以订阅；主题名按租户隔离
+// 发布由服务端调用 MessageHandler.PublishToTopic，客户端不能发布
+func (a *App) handleTopic(conn *server.Connection, msg *protocol.Message) {
+	userID := conn.GetUserID()
+
+	var req struct {
+		Action string `json:"action"`
+		Topic  string `json:"topic"`
+	}
+	if err := json.Unmarshal(msg.Body, &req); err != nil {
+		log.Printf("[App] Invalid topic request from conn-%d", conn.ID)
+		return
+	}
+
+	reply := func(resp map[string]interface{}) {
+		data, _ := json.Marshal(resp)
+		conn.Send(&protocol.Message{CmdType: protocol.CmdTypeTopic, Body: data})
+	}
+
+	topic, err := service.ScopeForUser(userID, req.Topic)
+	if err != nil {
+		reply(map[string]interface{}{"success": false, "message": err.Error()})
+		return
+	}
+	switch req.Action {
+	case "subscribe":
+		err = a.topics.Subscribe(topic, userID)
+	case "unsubscribe":
+		err = a.topics.Unsubscribe(topic, userID)
+	case "list":
+		topics, err := a.topics.Topics(userID)
+		if err != nil {
+			log.Printf("[App] Failed to list topics for %s: %v", userID, err)
+			reply(map[string]interface{}{"success": false, "message": "Internal error"})
+			return
+		}
+		for i, t := range topics {
+			topics[i] = service.LocalID(t)
+		}
+		reply(map[string]interface{}{"success": true, "topics": topics})
+		return
+	default:
+		reply(map[string]interface{}{"success": false, "message": "Unknown action"})
+		return
+	}
+	if errors.Is(err, service.ErrInvalidTopic) {
+		reply(map[string]interface{}{"success": false, "message": err.Error()})
+		return
+	}
+	if err != nil {
+		log.Printf("[App] Failed to %s topic %s: %v", req.Action, topic, err)
+		reply(map[string]interface{}{"success": false, "message": "Internal error"})
+		return
+	}
+	reply(map[string]interface{}{"success": true, "message": req.Action, "topic": req.Topic})
+}
+
+// ==================== 用户资料 ====================
+
+// handleProfile 查询用户资料或修改自己的资料
+//
+// 请求格式：
+//
+//	{"user_ids": ["alice", "bob"]}                                  // 批量查询（最多 100 个）
+//	{"set": {"display_name": "Bob", "avatar_url": "https://..."}}  // 修改自己的资料
+//
+// 没有资料的用户返回默认值（显示名为用户 ID），响应使用同一命令类型
+func (a *App) handleProfile(conn *server.Connection, msg *protocol.Message) {
+	userID := conn.GetUserID()
+
+	var req struct {
+		UserIDs []string `json:"user_ids"`
+		Set     *struct {
+			DisplayName string `json:"display_name"`
+			AvatarURL   string `json:"avatar_url"`
+		} `json:"set"`
+	}
+	if err := json.Unmarshal(msg.Body, &req); err != nil {
+		log.Printf("[App] Invalid profile request from conn-%d", conn.ID)
+		return
+	}
+
+	reply := func(resp map[string]interface{}) {
+		data, _ := json.Marshal(resp)
+		conn.Send(&protocol.Message{CmdType: protocol.CmdTypeProfileQuery, Body: data})
+	}
+
+	if req.Set != nil {
+		err := a.profiles.Set(userID, req.Set.DisplayName, req.Set.AvatarURL)
+		if errors.Is(err, service.ErrInvalidProfile) {
+			reply(map[string]interface{}{"success": false, "message": err.Error()})
+			return
+		}
+		if err != nil {
+			log.Printf("[App] Failed to set profile of %s: %v", userID, err)
+			reply(map[string]interface{}{"success": false, "message": "Internal error"})
+			return
+		}
+		reply(map[string]interface{}{"success": true})
+		return
+	}
+
+	if len(req.UserIDs) == 0 || len(req.UserIDs) > service.MaxProfileQuery {
+		reply(map[string]interface{}{"success": false,
+			"message": fmt.Sprintf("user_ids must have 1 to %d entries", service.MaxProfileQuery)})
+		return
+	}
+	scoped := make([]string, len(req.UserIDs))
+	for i, id := range req.UserIDs {
+		var err error
+		if scoped[i], err = service.ScopeForUser(userID, id); err != nil {
+			reply(map[string]interface{}{"success": false, "message": err.Error()})
+			return
+		}
+	}
+	profiles, err := a.profiles.GetMany(scoped)
+	if err != nil {
+		log.Printf("[App] Failed to get profiles: %v", err)
+		reply(map[string]interface{}{"success": false, "message": "Internal error"})
+		return
+	}
+	for i, p := range profiles {
+		p.UserID = req.UserIDs[i]
+	}
+	reply(map[string]interface{}{"success": true, "profiles": profiles})
+}
+
+// ==================== 时钟同步 ====================
+
+// handleTimeSync 回复服务器时间，供客户端估算时差（见 service.ClockOffset）
+//
+// 请求：{"client_time": 1700000000000}
+// 响应：{"client_time": 1700000000000, "server_recv": ..., "server_send": ...}（Unix 毫秒）
+func (a *App) handleTimeSync(conn *server.Connection, msg *protocol.Message) {
+	recv := service.ServerTime().UnixMilli()
+
+	var req struct {
+		ClientTime int64 `json:"client_time"`
+	}
+	if len(msg.Body) > 0 {
+		if err := json.Unmarshal(msg.Body, &req); err != nil {
+			log.Printf("[App] Invalid time sync from conn-%d", conn.ID)
+			return
+		}
+	}
+
+	data, _ := json.Marshal(map[string]int64{
+		"client_time": req.ClientTime,
+		"server_recv": recv,
+		"server_send": service.ServerTime().UnixMilli(),
+	})
+	conn.Send(&protocol.Message{CmdType: protocol.CmdTypeTimeSync, Body: data})
+}
+
+// ==================== 暂停/恢复推送 ====================
+
+// handlePause 暂停或恢复本连接的实时推送
+//
+// 客户端进入后台时发送 CmdTypePause（消息体可为空），之后的消息存入离线盒子；
+// 回到前台时发送 CmdTypeResume，恢复推送并投递暂停期间积压的消息
+// 响应：{"success": true, "paused": true|false}，使用同一命令类型
+func (a *App) handlePause(conn *server.Connection, msg *protocol.Message, paused bool) {
+	userID := conn.GetUserID()
+	changed := conn.SetPaused(paused)
+
+	data, _ := json.Marshal(map[string]interface{}{"success": true, "paused": paused})
+	conn.Send(&protocol.Message{CmdType: msg.CmdType, Body: data})
+
+	if !changed {
+		return
+	}
+	if paused {
+		log.Printf("[App] User %s paused delivery on conn-%d", userID, conn.ID)
+		return
+	}
+	log.Printf("[App] User %s resumed delivery on conn-%d", userID, conn.ID)
+	go a.msgHandler.DeliverOfflineMessages(userID, conn)
+}
+
+// ==================== 消息置顶 ====================
+
+// handlePin 处理置顶/取消置顶
+//
+// 请求格式（CmdTypePin 或 CmdTypeUnpin）：
+//
+//	{"to_user_id": "alice", "seq_id": 42}   // 私聊
+//	{"group_id": "team", "seq_id": 42}      // 群聊
+//	{"to_user_id": "alice", "list": true}   // 列出会话中置顶的消息
+//
+// 操作结果以同一命令类型回复，成功后通知会话其他成员
+func (a *App) handlePin(conn *server.Connection, msg *protocol.Message) {
+	userID := conn.GetUserID()
+
+	var req struct {
+		ToUserID string `json:"to_user_id"`
+		GroupID  string `json:"group_id"`
+		SeqID    int64  `json:"seq_id"`
+		List     bool   `json:"list"`
+	}
+	if err := json.Unmarshal(msg.Body, &req); err != nil || (req.ToUserID == "" && req.GroupID == "") {
+		log.Printf("[App] Invalid pin request from conn-%d", conn.ID)
+		return
+	}
+
+	reply := func(resp map[string]interface{}) {
+		data, _ := json.Marshal(resp)
+		conn.Send(&protocol.Message{CmdType: msg.CmdType, Body: data})
+	}
+
+	// 确定会话
+	var conversationID, toUserID, groupID string
+	if req.GroupID != "" {
+		var err error
+		if groupID, err = service.ScopeForUser(userID, req.GroupID); err != nil {
+			reply(map[string]interface{}{"success": false, "message": err.Error()})
+			return
+		}
+		ok, err := a.groups.IsMember(groupID, userID)
+		if err != nil || !ok {
+			reply(map[string]interface{}{"success": false, "message": service.ErrNotGroupMember.Error()})
+			return
+		}
+		conversationID = service.GroupConversationID(groupID)
+	} else {
+		var err error
+		if toUserID, err = service.ScopeForUser(userID, req.ToUserID); err != nil {
+			reply(map[string]interface{}{"success": false, "message": err.Error()})
+			return
+		}
+		conversationID = service.ConversationID(userID, toUserID)
+	}
+
+	if req.List {
+		pinned, err := a.pins.ListPinned(conversationID)
+		if err != nil {
+			log.Printf("[App] Failed to list pins: %v", err)
+			reply(map[string]interface{}{"success": false, "message": "Internal error"})
+			return
+		}
+		reply(map[string]interface{}{"success": true, "pinned": pinned})
+		return
+	}
+
+	msgID := service.MessageID(conversationID, req.SeqID)
+	unpin := msg.CmdType == protocol.CmdTypeUnpin
+
+	var err error
+	if unpin {
+		err = a.pins.Unpin(conversationID, msgID)
+	} else {
+		err = a.pins.Pin(conversationID, msgID)
+	}
+	if err != nil {
+		reply(map[string]interface{}{"success": false, "message": err.Error()})
+		return
+	}
+	reply(map[string]interface{}{"success": true, "msg_id": msgID})
+
+	// 通知会话其他成员
+	payload, _ := json.Marshal(&service.PinNotification{
+		MsgID:    msgID,
+		SeqID:    req.SeqID,
+		UserID:   service.LocalID(userID),
+		GroupID:  req.GroupID,
+		Unpinned: unpin,
+	})
+	msgType := service.MsgTypePin
+	if unpin {
+		msgType = service.MsgTypeUnpin
+	}
+	if groupID != "" {
+		err = a.msgHandler.SendGroupNotification(userID, groupID, msgType, payload)
+	} else {
+		err = a.msgHandler.SendNotification(userID, toUserID, msgType, payload)
+	}
+	if err != nil {
+		log.Printf("[App] Failed to send pin notification: %v", err)
+	}
+}
+
+// ==================== 在线状态 ====================
+
+// handlePresence 设置或查询在线状态
+//
+// 请求格式：
+//
+//	{"action": "set", "status": "busy", "text": "开会中"}
+//	{"action": "get", "user_id": "bob"}
+//
+// 响应使用同一命令类型
+func (a *App) handlePresence(conn *server.Connection, msg *protocol.Message) {
+	userID := conn.GetUserID()
+
+	var req struct {
+		Action string `json:"action"`
+		Status string `json:"status"`
+		Text   string `json:"text"`
+		UserID string `json:"user_id"`
+	}
+	if err := json.Unmarshal(msg.Body, &req); err != nil {
+		return
+	}
+
+	var resp interface{}
+	switch req.Action {
+	case "set":
+		if err := a.session.SetStatus(userID, req.Status, req.Text); err != nil {
+			resp = map[string]interface{}{"success": false, "message": err.Error()}
+		} else {
+			resp = map[string]interface{}{"success": true}
+		}
+	case "get":
+		target, err := service.ScopeForUser(userID, req.UserID)
+		if err != nil {
+			resp = map[string]interface{}{"success": false, "message": err.Error()}
+			break
+		}
+		presence, err := a.session.GetPresence(target)
+		if err != nil {
+			log.Printf("[App] Failed to get presence: %v", err)
+			resp = map[string]interface{}{"success": false, "message": "Internal error"}
+		} else {
+			presence.UserID = req.UserID
+			resp = presence
+		}
+	default:
+		resp = map[string]interface{}{"success": false, "message": "Unknown action"}
+	}
+
+	data, _ := json.Marshal(resp)
+	conn.Send(&protocol.Message{
+		CmdType: protocol.CmdTypePresence,
+		Body:    data,
+	})
+}
+
+// awayLoop 定期检查空闲连接，自动设置为离开
+// 只有心跳、没有业务请求的连接视为空闲（应用在后台）
+func (a *App) awayLoop() {
+	ticker := time.NewTicker(a.config.AwayAfter / 4)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		a.tcpServer.ConnManager.Range(func(conn *server.Connection) bool {
+			if conn.IsAuthenticated() && conn.MarkAwayIfIdle(a.config.AwayAfter) {
+				if err := a.session.MarkAway(conn.GetUserID()); err != nil {
+					log.Printf("[App] Failed to mark %s away: %v", conn.GetUserID(), err)
+				}
+			}
+			return true
+		})
+	}
+}
+
+// announceLoop 定期把本网关的地址、负载和健康状态登记到网关注册表
+// Pub/Sub 未订阅时收不到跨网关消息，登记为不健康
+// 关闭或排空后停止登记（Drain/Stop 中已注销）
+func (a *App) announceLoop() {
+	ticker := time.NewTicker(service.RegistryAnnounceInterval)
+	defer ticker.Stop()
+
+	for {
+		if a.stopping.Load() || a.tcpServer.IsDraining() {
+			return
+		}
+		if err := a.registry.Announce(service.GatewayLoad{
+			Conns:    a.tcpServer.ConnManager.Count(),
+			Capacity: a.config.Capacity,
+			Healthy:  a.pubsub.Subscribed(),
+		}); err != nil {
+			log.Printf("[App] %v", err)
+		}
+		<-ticker.C
+	}
+}
+
+// reconnectAlternates 重连提示中的备选网关，查询失败时不附带
+func (a *App) reconnectAlternates() []string {
+	addrs, err := a.selector.Addrs(service.MaxReconnectAlternates)
+	if err != nil {
+		log.Printf("[App] %v", err)
+		return nil
+	}
+	return addrs
+}
+
+// sessionCheckLoop 定期检查本地用户的会话，续期或恢复被 Redis 淘汰的会话
+// 每个用户只检查一次（会话指向的那个连接）
+func (a *App) sessionCheckLoop() {
+	ticker := time.NewTicker(service.SessionCheckInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if a.stopping.Load() {
+			return
+		}
+		a.tcpServer.ConnManager.Range(func(conn *server.Connection) bool {
+			userID := conn.GetUserID()
+			if !conn.IsAuthenticated() || conn.IsClosed() || a.tcpServer.ConnManager.GetByUserID(userID) != conn {
+				return true
+			}
+			if _, err := a.session.Refresh(userID, conn.ID); err != nil {
+				log.Printf("[App] Failed to check session of %s: %v", userID, err)
+			}
+			return true
+		})
+	}
+}
+
+// tokenCheckLoop 定期复查已认证连接的凭据，Token 过期或被吊销的连接被踢下线
+// 查询吊销状态失败时跳过该连接，等下一轮
+func (a *App) tokenCheckLoop() {
+	ticker := time.NewTicker(a.config.TokenRecheck)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if a.stopping.Load() {
+			return
+		}
+		now := time.Now()
+		a.tcpServer.ConnManager.Range(func(conn *server.Connection) bool {
+			if !conn.IsAuthenticated() || conn.IsClosed() {
+				return true
+			}
+			userID := conn.GetUserID()
+			claims, _ := conn.Credential().(*service.Claims)
+			err := service.CheckCredential(userID, claims, conn.GetAuthTime(), now)
+			switch {
+			case err == nil:
+			case errors.Is(err, service.ErrTokenExpired):
+				a.kickInvalidToken(conn, "token_expired")
+			case errors.Is(err, service.ErrTokenRevoked):
+				a.kickInvalidToken(conn, "token_revoked")
+			default:
+				log.Printf("[App] Failed to recheck token of conn-%d (%s): %v", conn.ID, userID, err)
+			}
+			return true
+		})
+	}
+}
+
+// kickInvalidToken 通知客户端凭据失效后断开，客户端应重新获取 Token 再连接
+func (a *App) kickInvalidToken(conn *server.Connection, reason string) {
+	log.Printf("[App] Kicking conn-%d (%s): %s", conn.ID, conn.GetUserID(), reason)
+	body, _ := json.Marshal(server.ReconnectHint{Reason: reason})
+	conn.SendControl(&protocol.Message{CmdType: protocol.CmdTypeKick, Body: body})
+	time.AfterFunc(service.KickFlushDelay, func() { conn.Close(server.CloseReasonTokenInvalid) })
+}
+
+// traceSyncLoop 定期从 Redis 读取帧追踪目标，应用到本网关的连接
+func (a *App) traceSyncLoop() {
+	ticker := time.NewTicker(a.config.TraceSync)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if a.stopping.Load() {
+			return
+		}
+		connIDs, userIDs, err := service.LoadTraceTargets(a.config.GatewayID)
+		if err != nil {
+			log.Printf("[App] %v", err)
+			continue
+		}
+		a.tcpServer.ConnManager.SetTraceTargets(connIDs, userIDs)
+	}
+}
+
+// ==================== 主函数 ====================
+
+// loadConfig 在 fs 上定义所有参数，合并配置文件、环境变量和命令行后校验
+func loadConfig(fs *flag.FlagSet, args []string) (*Config, error) {
+	fs.String(configFlagName, "", "JSON config file; keys are flag names (flags and GOIM_* env vars override it)")
+	gatewayID := fs.String("id", "gateway_1", "Gateway ID")
+	tcpAddr := fs.String("addr", ":8080", "TCP listen address")
+	advertiseAddr := fs.String("advertise", "", "Address clients use to reach this gateway, published for reconnect hints (empty = not published)")
+	capacity := fs.Int("capacity", 0, "Client connections this gateway can hold, published to the registry for gateway selection (0 = not published)")
+	gatewaySelect := fs.String("gateway-select", service.StrategyLeastLoaded, "How to pick alternate gateways: least-loaded, weighted or round-robin")
+	redisAddr := fs.String("redis", "127.0.0.1:6379", "Redis address")
+	maxInFlight := fs.Int("max-inflight", 0, "Max unacked messages per connection before delivery pauses until acks arrive, e.g. 500 (0 = unlimited)")
+	proxyProtocol := fs.Bool("proxy-protocol", false, "Expect HAProxy PROXY protocol header on each connection")
+	frameSync := fs.Bool("frame-sync", false, "Expect a sync marker before each client frame and resynchronize on it after garbage bytes (clients must enable it too)")
+	offlineGzip := fs.Bool("offline-gzip", false, "Gzip-compress offline messages stored in Redis")
+	offlineFormat := fs.String("offline-format", service.OfflineFormatJSON, "Offline message serialization: json or msgpack")
+	sendCredits := fs.Int("send-credits", 32, "Send credit window per connection (0 = unlimited)")
+	inboundQueue := fs.Int("inbound-queue", 0, "Per-connection inbound queue size (0 = handle in read loop)")
+	maxFrameRate := fs.Int("max-frame-rate", 0, "Max inbound frames per second per connection, heartbeats included (0 = unlimited)")
+	framePolicy := fs.String("frame-policy", server.FramePolicyThrottle, "What to do when a connection exceeds -max-frame-rate: throttle or close")
+	goroutineBudget := fs.Int("goroutine-budget", 0, "Max connection goroutines; reap idle connections near it and refuse accepts at it (0 = unlimited)")
+	checkRecipients := fs.Bool("check-recipients", false, "Bounce messages sent to users who never authenticated")
+	trackReceipts := fs.Bool("track-receipts", false, "Record stored/delivered/acked/read state per message")
+	conversations := fs.Bool("conversations", false, "Maintain per-user conversation lists with last message and unread count")
+	wal := fs.Bool("wal", false, "Write accepted messages to a Redis Stream until acked and replay them after a restart")
+	deadLetter := fs.Bool("dead-letter", false, "Record undeliverable messages with a reason in the dead_letter Redis list")
+	offlineBatch := fs.Int("offline-batch", service.DefaultOfflineBatch, "Offline messages fetched per Redis round trip when delivering a backlog")
+	offlineShards := fs.Int("offline-shards", 1, "Spread each user's offline box across this many Redis keys by sequence ID (1 = unsharded); migrate existing messages before changing it")
+	pubsubCompressMin := fs.Int("pubsub-compress-min", 0, fmt.Sprintf("Gzip cross-gateway Pub/Sub payloads of at least this many bytes, e.g. %d (0 = never); every gateway decodes both forms", service.DefaultPubSubCompressMinSize))
+	offlineRate := fs.Int("offline-rate", 0, "Max offline backlog messages per second per connection (0 = unlimited)")
+	awayAfter := fs.Duration("away-after", 10*time.Minute, "Mark users away after this long without activity (0 = disabled)")
+	offlineSweep := fs.Duration("offline-sweep", 0, "Interval for sweeping individually expired offline messages (0 = disabled)")
+	offlineGrace := fs.Duration("offline-grace", 0, "Keep a disconnected user online this long before logging them out (0 = immediately)")
+	sessionTTL := fs.Duration("session-ttl", service.SessionTTL, "Session lifetime; clients must heartbeat within it")
+	offlineMax := fs.Int("offline-max", service.MaxOfflineMessages, "Max offline messages kept per user; the oldest are dropped")
+	offlineTTL := fs.Duration("offline-ttl", service.OfflineMessageTTL, "Lifetime of stored offline messages")
+	tokenExpiry := fs.Duration("token-expiry", service.TokenExpireDuration, "JWT lifetime")
+	tokenRecheck := fs.Duration("token-recheck", service.DefaultTokenRecheckInterval, "Recheck authenticated connections for expired or revoked tokens and kick them (0 = disabled)")
+	resumeTTL := fs.Duration("resume-ttl", service.DefaultResumeTTL, "Lifetime of resumable session IDs issued on auth; clients reconnect with them via CmdTypeReconnect (0 = disabled)")
+	jwtMethod := fs.String("jwt-method", "HS256", "JWT signing method (HS256/384/512 with GOIM_JWT_SECRET, RS256/384/512 or PS256/384/512 with an RSA key pair)")
+	jwtPrivateKey := fs.String("jwt-private-key", "", "PEM file with the RSA private key for signing tokens (RS*/PS* methods; empty = verify only)")
+	jwtPublicKey := fs.String("jwt-public-key", "", "PEM file with the RSA public key for verifying tokens (RS*/PS* methods; empty = derived from the private key)")
+	devSecret := fs.Bool("dev-secret", false, "Allow starting without GOIM_JWT_SECRET and sign tokens with the built-in development secret (local development only)")
+	predecessors := fs.String("predecessors", "", "Comma-separated gateway IDs this gateway replaces")
+	predecessorGrace := fs.Duration("predecessor-grace", 2*time.Minute, "How long to keep receiving on predecessor channels")
+	redisMaxOps := fs.Int("redis-max-ops", 0, "Max concurrent Redis commands (0 = pool size, negative = unlimited)")
+	senderShare := fs.Int("redis-sender-share", 0, "Max concurrent deliveries one sender may hold under -redis-max-ops; the rest are shared round-robin (0 = a quarter of the cap, negative = no per-sender queueing)")
+	drainInterval := fs.Duration("drain-interval", 20*time.Millisecond, "Delay between reconnect hints in drain mode")
+	traceSync := fs.Duration("trace-sync", service.DefaultTraceSyncInterval, "Interval for loading per-connection frame tracing targets from the trace_targets Redis set (0 = disabled)")
+	redisTimeout := fs.Duration("redis-timeout", redis.DefaultCriticalTimeout, "Timeout for Redis calls on the send path (0 = no limit)")
+	if err := applyConfigSources(fs, args); err != nil {
+		return nil, err
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	// 构造配置
+	config := &Config{
+		GatewayID: *gatewayID,
+		TCPAddr:   *tcpAddr,
+		RedisAddr: *redisAddr,
+
+		AdvertiseAddr: *advertiseAddr,
+		Capacity:      *capacity,
+		GatewaySelect: *gatewaySelect,
+
+		MaxInFlight:  *maxInFlight,
+		SendCredits:  *sendCredits,
+		RedisMaxOps:  *redisMaxOps,
+		SenderShare:  *senderShare,
+		InboundQueue: *inboundQueue,
+		MaxFrameRate: *maxFrameRate,
+		OfflineRate:  *offlineRate,
+		OfflineBatch: *offlineBatch,
+
+		OfflineShards: *offlineShards,
+
+		PubSubCompressMin: *pubsubCompressMin,
+
+		GoroutineBudget: *goroutineBudget,
+
+		AwayAfter:    *awayAfter,
+		OfflineGrace: *offlineGrace,
+		OfflineSweep: *offlineSweep,
+		SessionTTL:   *sessionTTL,
+		OfflineMax:   *offlineMax,
+		OfflineTTL:   *offlineTTL,
+		RedisTimeout: *redisTimeout,
+		TokenExpiry:  *tokenExpiry,
+		TokenRecheck: *tokenRecheck,
+		ResumeTTL:    *resumeTTL,
+
+		DrainInterval: *drainInterval,
+		TraceSync:     *traceSync,
+
+		PredecessorGrace: *predecessorGrace,
+
+		JWTMethod: *jwtMethod,
+		JWTSecret: os.Getenv("GOIM_JWT_SECRET"),
+		DevSecret: *devSecret,
+
+		JWTPrivateKey: *jwtPrivateKey,
+		JWTPublicKey:  *jwtPublicKey,
+
+		OfflineFormat: *offlineFormat,
+		FramePolicy:   *framePolicy,
+		OfflineKeys:   os.Getenv("GOIM_OFFLINE_KEYS"),
+
+		ProxyProtocol:   *proxyProtocol,
+		FrameSync:       *frameSync,
+		OfflineGzip:     *offlineGzip,
+		CheckRecipients: *checkRecipients,
+		TrackReceipts:   *trackReceipts,
+		Conversations:   *conversations,
+		WAL:             *wal,
+		DeadLetter:      *deadLetter,
+	}
+
+	if *predecessors != "" {
+		config.Predecessors = strings.Split(*predecessors, ",")
+	}
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+func main() {
+	// 解析命令行参数
+	config, err := loadConfig(flag.CommandLine, os.Args[1:])
+	if err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+
+	// 创建并初始化应用
+	app := NewApp(config)
+	if err := app.Initialize(); err != nil {
+		log.Fatalf("Failed to initialize: %v", err)
+	}
+
+	// 启动应用
+	if err := app.Start(); err != nil {
+		log.Fatalf("Failed to start: %v", err)
+	}
+
+	// 等待中断信号（Ctrl+C 或 kill）
+	// 这是 Go 程序优雅关闭的标准模式
+	// SIGUSR1 进入排空模式（滚动升级），之后的 SIGTERM 完成关闭
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM, syscall.SIGUSR1)
+	for sig := range quit {
+		if sig != syscall.SIGUSR1 {
+			break
+		}
+		app.Drain()
+	}
+
+	// 收到信号，优雅关闭
+	app.Stop()
+}
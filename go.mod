@@ -2,10 +2,12 @@ module go-im
 
 go 1.25.5
 
+require (
+	github.com/golang-jwt/jwt/v5 v5.3.0
+	github.com/redis/go-redis/v9 v9.17.2
+)
+
 require (
 	github.com/cespare/xxhash/v2 v2.3.0 // indirect
 	github.com/dgryski/go-rendezvous v0.0.0-20200823014737-9f7001d12a5f // indirect
-	github.com/golang-jwt/jwt/v5 v5.3.0 // indirect
-	github.com/redis/go-redis/v9 v9.17.2 // indirect
-	google.golang.org/protobuf v1.36.11 // indirect
 )
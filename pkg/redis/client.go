@@ -1,170 +1,237 @@
-/*
-Package redis - Redis 客户端封装
-
-=== Redis 在 IM 系统中的作用 ===
-
-Redis 作为高性能的内存数据库，在本项目中承担多种角色：
-
-1. 用户状态存储（user_session:uid）
-  - 存储用户登录状态
-  - EXPIRE 实现自动过期
-
-2. 消息路由（user_gateway:uid）
-  - 记录用户连接在哪个 Gateway
-  - 支持跨节点消息转发
-
-3. 消息队列（Pub/Sub）
-  - 跨 Gateway 的消息广播
-  - 实时消息推送
-
-4. 离线消息（msg_box:uid）
-  - ZSet 存储离线消息
-  - 支持按序列号排序
-
-5. 消息序列号（seq:conversation）
-  - INCR 原子操作
-  - 保证消息时序
-
-=== 连接池的重要性 ===
-
-	┌─────────────────────────────────────────┐
-	│           Connection Pool               │
-	│  ┌─────┐ ┌─────┐ ┌─────┐ ┌─────┐       │
-	│  │Conn1│ │Conn2│ │Conn3│ │ConnN│       │
-	│  └──┬──┘ └──┬──┘ └──┬──┘ └──┬──┘       │
-	│     │       │       │       │           │
-	│     └───────┴───────┴───────┘           │
-	│              复用连接                    │
-	└─────────────────────────────────────────┘
-
-为什么需要连接池？
-- 避免频繁创建/销毁 TCP 连接的开销
-- 复用连接，减少延迟
-- 控制最大连接数，防止资源耗尽
-*/
-package redis
-
-import (
-	"context"
-	"fmt"
-	"log"
-	"time"
-
-	"github.com/redis/go-redis/v9"
-)
-
-// ==================== 全局变量 ====================
-
-var (
-	// Client Redis 客户端实例（全局单例）
-	Client *redis.Client
-
-	// ctx 默认上下文
-	ctx = context.Background()
-)
-
-// ==================== 配置结构 ====================
-
-// Config Redis 连接配置
-type Config struct {
-	// Addr Redis 服务器地址，如 "127.0.0.1:6379"
-	Addr string
-
-	// Password Redis 密码（可选）
-	Password string
-
-	// DB 数据库编号（0-15）
-	DB int
-
-	// PoolSize 连接池大小
-	// 根据并发量调整，默认 100
-	PoolSize int
-}
-
-// ==================== 初始化函数 ====================
-
-// Init 初始化 Redis 客户端
-// 这是项目启动时必须调用的函数
-func Init(cfg *Config) error {
-	// 默认连接池大小
-	if cfg.PoolSize == 0 {
-		cfg.PoolSize = 100
-	}
-
-	// 创建 Redis 客户端
-	Client = redis.NewClient(&redis.Options{
-		Addr:     cfg.Addr,
-		Password: cfg.Password,
-		DB:       cfg.DB,
-
-		// === 连接池配置 ===
-		PoolSize:     cfg.PoolSize, // 最大连接数
-		MinIdleConns: 10,           // 最小空闲连接
-
-		// === 超时配置 ===
-		DialTimeout:  5 * time.Second, // 连接超时
-		ReadTimeout:  3 * time.Second, // 读取超时
-		WriteTimeout: 3 * time.Second, // 写入超时
-	})
-
-	// 测试连接
-	// PING 命令验证 Redis 是否可达
-	if err := Client.Ping(ctx).Err(); err != nil {
-		return fmt.Errorf("redis connection failed: %w", err)
-	}
-
-	log.Println("[Redis] Connected successfully")
-	return nil
-}
-
-// Close 关闭 Redis 连接
-// 在程序退出时调用
-func Close() {
-	if Client != nil {
-		Client.Close()
-	}
-}
-
-// ==================== Pipeline 批量操作 ====================
-
-/*
-Pipeline 执行批量命令
-
-什么是 Pipeline？
-- 将多个命令打包成一次网络请求发送
-- 减少网络往返次数 (RTT)
-
-普通模式 vs Pipeline:
-
-普通模式（3次 RTT）:
-
-	Client ----GET----> Redis
-	Client <---value--- Redis
-	Client ----SET----> Redis
-	Client <---OK------ Redis
-	Client ----INCR---> Redis
-	Client <---1------- Redis
-
-Pipeline 模式（1次 RTT）:
-
-	Client --[GET,SET,INCR]--> Redis
-	Client <-[value,OK,1]----- Redis
-
-使用示例:
-
-	err := Pipeline(func(pipe redis.Pipeliner) error {
-	    pipe.Set(ctx, "key1", "value1", 0)
-	    pipe.Set(ctx, "key2", "value2", 0)
-	    pipe.Incr(ctx, "counter")
-	    return nil
-	})
-*/
-func Pipeline(fn func(pipe redis.Pipeliner) error) error {
-	_, err := Client.Pipelined(ctx, fn)
-	return err
-}
-
-// Context 获取默认上下文
-func Context() context.Context {
-	return ctx
-}
+/*
+Package redis - Redis 客户端封装
+
+=== Redis 在 IM 系统中的作用 ===
+
+Redis 作为高性能的内存数据库，在本项目中承担多种角色：
+
+1. 用户状态存储（user_session:uid）
+  - 存储用户登录状态
+  - EXPIRE 实现自动过期
+
+2. 消息路由（user_gateway:uid）
+  - 记录用户连接在哪个 Gateway
+  - 支持跨节点消息转发
+
+3. 消息队列（Pub/Sub）
+  - 跨 Gateway 的消息广播
+  - 实时消息推送
+
+4. 离线消息（msg_box:uid）
+  - ZSet 存储离线消息
+  - 支持按序列号排序
+
+5. 消息序列号（seq:conversation）
+  - INCR 原子操作
+  - 保证消息时序
+
+=== 连接池的重要性 ===
+
+	┌─────────────────────────────────────────┐
+	│           Connection Pool               │
+	│  ┌─────┐ ┌─────┐ ┌─────┐ ┌─────┐       │
+	│  │Conn1│ │Conn2│ │Conn3│ │ConnN│       │
+	│  └──┬──┘ └──┬──┘ └──┬──┘ └──┬──┘       │
+	│     │       │       │       │           │
+	│     └───────┴───────┴───────┘           │
+	│              复用连接                    │
+	└─────────────────────────────────────────┘
+
+为什么需要连接池？
+- 避免频繁创建/销毁 TCP 连接的开销
+- 复用连接，减少延迟
+- 控制最大连接数，防止资源耗尽
+*/
+package redis
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// ==================== 全局变量 ====================
+
+var (
+	// Client Redis 客户端实例（全局单例）
+	Client *redis.Client
+
+	// Fair 按发送者公平排队（见 fair.go），并发上限关闭时为 nil
+	Fair *FairQueue
+
+	// ctx 默认上下文
+	ctx = context.Background()
+
+	// criticalTimeout 关键路径上单次调用的超时（见 CriticalContext）
+	criticalTimeout = DefaultCriticalTimeout
+)
+
+// DefaultCriticalTimeout 关键路径 Redis 调用的默认超时
+const DefaultCriticalTimeout = 500 * time.Millisecond
+
+// ErrUnreachable 初始化时 PING 失败
+// 此时 Client 已经创建，Redis 恢复后可以直接使用（go-redis 会自动重连）
+var ErrUnreachable = errors.New("redis connection failed")
+
+// ==================== 配置结构 ====================
+
+// Config Redis 连接配置
+type Config struct {
+	// Addr Redis 服务器地址，如 "127.0.0.1:6379"
+	Addr string
+
+	// Password Redis 密码（可选）
+	Password string
+
+	// DB 数据库编号（0-15）
+	DB int
+
+	// PoolSize 连接池大小
+	// 根据并发量调整，默认 100
+	PoolSize int
+
+	// MaxConcurrent 同时进行的 Redis 命令数上限（见 limiter.go）
+	// 0 表示与 PoolSize 相同，负数表示不限制
+	MaxConcurrent int
+
+	// SenderShare 单个发送者最多同时占用的操作名额（见 fair.go）
+	// 0 表示 MaxConcurrent 的四分之一，负数表示不按发送者排队
+	SenderShare int
+}
+
+// ==================== 初始化函数 ====================
+
+// Init 初始化 Redis 客户端
+// 这是项目启动时必须调用的函数
+//
+// Redis 暂时不可达时返回 ErrUnreachable，调用方可以选择降级启动
+func Init(cfg *Config) error {
+	// 默认连接池大小
+	if cfg.PoolSize == 0 {
+		cfg.PoolSize = 100
+	}
+
+	// 创建 Redis 客户端
+	Client = redis.NewClient(&redis.Options{
+		Addr:     cfg.Addr,
+		Password: cfg.Password,
+		DB:       cfg.DB,
+
+		// === 连接池配置 ===
+		PoolSize:     cfg.PoolSize, // 最大连接数
+		MinIdleConns: 10,           // 最小空闲连接
+
+		// === 超时配置 ===
+		DialTimeout:  5 * time.Second, // 连接超时
+		ReadTimeout:  3 * time.Second, // 读取超时
+		WriteTimeout: 3 * time.Second, // 写入超时
+
+		// 让调用方 context 的 deadline 生效（见 CriticalContext）
+		ContextTimeoutEnabled: true,
+	})
+
+	// 网关级并发上限，避免连接池被耗尽后大量超时
+	maxConcurrent := cfg.MaxConcurrent
+	if maxConcurrent == 0 {
+		maxConcurrent = cfg.PoolSize
+	}
+	Fair = nil
+	if maxConcurrent > 0 {
+		Client.AddHook(newConcurrencyLimiter(maxConcurrent))
+
+		// 按发送者公平排队，避免一个发送者占满并发上限
+		share := cfg.SenderShare
+		if share == 0 {
+			share = maxConcurrent / 4
+		}
+		if share > 0 {
+			Fair = NewFairQueue(maxConcurrent, share)
+		}
+	}
+
+	// 测试连接
+	// PING 命令验证 Redis 是否可达
+	if err := Client.Ping(ctx).Err(); err != nil {
+		return fmt.Errorf("%w: %w", ErrUnreachable, err)
+	}
+
+	log.Println("[Redis] Connected successfully")
+	return nil
+}
+
+// Close 关闭 Redis 连接
+// 在程序退出时调用
+func Close() {
+	if Client != nil {
+		Client.Close()
+	}
+}
+
+// ==================== Pipeline 批量操作 ====================
+
+/*
+Pipeline 执行批量命令
+
+什么是 Pipeline？
+- 将多个命令打包成一次网络请求发送
+- 减少网络往返次数 (RTT)
+
+普通模式 vs Pipeline:
+
+普通模式（3次 RTT）:
+
+	Client ----GET----> Redis
+	Client <---value--- Redis
+	Client ----SET----> Redis
+	Client <---OK------ Redis
+	Client ----INCR---> Redis
+	Client <---1------- Redis
+
+Pipeline 模式（1次 RTT）:
+
+	Client --[GET,SET,INCR]--> Redis
+	Client <-[value,OK,1]----- Redis
+
+使用示例:
+
+	err := Pipeline(func(pipe redis.Pipeliner) error {
+	    pipe.Set(ctx, "key1", "value1", 0)
+	    pipe.Set(ctx, "key2", "value2", 0)
+	    pipe.Incr(ctx, "counter")
+	    return nil
+	})
+*/
+func Pipeline(fn func(pipe redis.Pipeliner) error) error {
+	_, err := Client.Pipelined(ctx, fn)
+	return err
+}
+
+// Context 获取默认上下文
+func Context() context.Context {
+	return ctx
+}
+
+// ==================== 关键路径超时 ====================
+
+// SetCriticalTimeout 设置关键路径调用的超时，<= 0 表示不额外限制
+// 需要在处理请求之前调用
+func SetCriticalTimeout(d time.Duration) {
+	criticalTimeout = d
+}
+
+// CriticalContext 返回带超时的上下文，用于发送路径上的同步调用
+// （如生成序列号、查询用户所在网关）
+//
+// Redis 很慢时这些调用会卡住发送者连接的读取循环，
+// 超时后快速失败，调用方走降级路径（本地兜底序号、离线存储）
+// 用完必须调用 cancel
+func CriticalContext() (context.Context, context.CancelFunc) {
+	if criticalTimeout <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, criticalTimeout)
+}
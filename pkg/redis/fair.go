@@ -0,0 +1,132 @@
+package redis
+
+import "sync"
+
+// ==================== 按发送者公平排队 ====================
+
+/*
+FairQueue 按发送者公平分配 Redis 访问名额
+
+并发上限（limiter.go）只限制总量，不区分是谁在用：
+一个用户向大群刷屏时，扇出的每个成员投递都要访问 Redis，
+这些投递占满名额后，其他用户的单聊只能排在它们后面：
+
+	无公平排队:  heavy×1000 ──▶ 名额(100) ◀── alice、bob 排在第 1001 位之后
+	公平排队:    heavy 最多占 share 个名额；有名额空出时按发送者轮流分配
+	             alice、bob 只需等待一个投递的时间
+
+FairQueue 与并发上限使用相同的容量，排在它前面：
+每个业务操作（一次单聊投递、扇出中一个成员的投递）先在这里按发送者取得名额，
+其中的 Redis 命令再经过并发上限。同一个操作内不能再次进入 FairQueue，否则可能死锁。
+
+全局实例为 Fair（见 Init），并发上限关闭时为 nil，Do 直接执行。
+*/
+type FairQueue struct {
+	mu       sync.Mutex
+	capacity int // 同时进行的操作数上限
+	share    int // 单个发送者同时进行的操作数上限
+
+	active  int                        // 进行中的操作数
+	perKey  map[string]int             // 发送者 → 进行中的操作数
+	waiting map[string][]chan struct{} // 发送者 → 等待中的操作（先到先得）
+	ring    []string                   // 有等待操作的发送者，轮流分配
+	next    int                        // 下一次分配从 ring 的这个位置开始
+}
+
+// NewFairQueue 创建公平队列，share 被限制在 [1, capacity]
+func NewFairQueue(capacity, share int) *FairQueue {
+	if capacity < 1 {
+		capacity = 1
+	}
+	share = min(max(share, 1), capacity)
+	return &FairQueue{
+		capacity: capacity,
+		share:    share,
+		perKey:   make(map[string]int),
+		waiting:  make(map[string][]chan struct{}),
+	}
+}
+
+// Do 以 key（通常是发送者 ID）的名义取得名额后执行 fn
+// q 为 nil 时直接执行
+func (q *FairQueue) Do(key string, fn func() error) error {
+	if q == nil {
+		return fn()
+	}
+	q.acquire(key)
+	defer q.release(key)
+	return fn()
+}
+
+// acquire 取得名额：没有人排队且未超出份额时直接通过，否则排队等待分配
+func (q *FairQueue) acquire(key string) {
+	q.mu.Lock()
+	if len(q.ring) == 0 && q.active < q.capacity && q.perKey[key] < q.share {
+		q.active++
+		q.perKey[key]++
+		q.mu.Unlock()
+		return
+	}
+
+	ready := make(chan struct{})
+	if len(q.waiting[key]) == 0 {
+		q.ring = append(q.ring, key)
+	}
+	q.waiting[key] = append(q.waiting[key], ready)
+	q.dispatch()
+	q.mu.Unlock()
+
+	<-ready
+}
+
+// release 归还名额，并分配给等待中的发送者
+func (q *FairQueue) release(key string) {
+	q.mu.Lock()
+	q.active--
+	if q.perKey[key]--; q.perKey[key] == 0 {
+		delete(q.perKey, key)
+	}
+	q.dispatch()
+	q.mu.Unlock()
+}
+
+// dispatch 有空闲名额时，从 next 开始轮流为未超出份额的发送者分配一个名额
+// 调用方持有 mu
+func (q *FairQueue) dispatch() {
+	for q.active < q.capacity {
+		granted := false
+		for i := 0; i < len(q.ring); i++ {
+			idx := (q.next + i) % len(q.ring)
+			key := q.ring[idx]
+			if q.perKey[key] >= q.share {
+				continue
+			}
+
+			queue := q.waiting[key]
+			ready := queue[0]
+			q.active++
+			q.perKey[key]++
+			close(ready)
+
+			// 下一次从这个发送者之后开始
+			if len(queue) == 1 {
+				delete(q.waiting, key)
+				q.ring = append(q.ring[:idx], q.ring[idx+1:]...)
+				q.next = idx
+			} else {
+				q.waiting[key] = queue[1:]
+				q.next = idx + 1
+			}
+			if len(q.ring) > 0 {
+				q.next %= len(q.ring)
+			} else {
+				q.next = 0
+			}
+			granted = true
+			break
+		}
+		if !granted {
+			return
+		}
+	}
+}
@@ -0,0 +1,192 @@
+package redis
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestNewFairQueueClamps(t *testing.T) {
+	tests := []struct {
+		capacity, share         int
+		wantCapacity, wantShare int
+	}{
+		{10, 3, 10, 3},
+		{0, 0, 1, 1},
+		{-5, 2, 1, 1},
+		{10, 0, 10, 1},
+		{10, 20, 10, 10},
+	}
+	for _, tt := range tests {
+		q := NewFairQueue(tt.capacity, tt.share)
+		if q.capacity != tt.wantCapacity || q.share != tt.wantShare {
+			t.Errorf("NewFairQueue(%d, %d) = (%d, %d), want (%d, %d)",
+				tt.capacity, tt.share, q.capacity, q.share, tt.wantCapacity, tt.wantShare)
+		}
+	}
+}
+
+func TestFairQueueNilRunsDirectly(t *testing.T) {
+	var q *FairQueue
+	want := errors.New("boom")
+	if err := q.Do("alice", func() error { return want }); err != want {
+		t.Fatalf("Do = %v, want %v", err, want)
+	}
+}
+
+// hold 以 key 的名义取得名额并一直占用，直到返回的函数被调用
+func hold(q *FairQueue, key string) (release func()) {
+	acquired := make(chan struct{})
+	done := make(chan struct{})
+	go q.Do(key, func() error {
+		close(acquired)
+		<-done
+		return nil
+	})
+	<-acquired
+	return func() { close(done) }
+}
+
+// waitQueued 等待 key 有 n 个操作在排队
+func waitQueued(t *testing.T, q *FairQueue, key string, n int) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		q.mu.Lock()
+		got := len(q.waiting[key])
+		q.mu.Unlock()
+		if got == n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%s has %d queued operations, want %d", key, got, n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestFairQueueShareLeavesRoomForOthers(t *testing.T) {
+	q := NewFairQueue(2, 1)
+
+	// heavy 占满自己的份额，后续操作排队
+	release := hold(q, "heavy")
+	defer release()
+	for i := 0; i < 5; i++ {
+		go q.Do("heavy", func() error { return nil })
+	}
+	waitQueued(t, q, "heavy", 5)
+
+	// alice 不需要等 heavy 释放
+	done := make(chan struct{})
+	go q.Do("alice", func() error {
+		close(done)
+		return nil
+	})
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("alice waited behind heavy's queue")
+	}
+}
+
+func TestFairQueueRoundRobin(t *testing.T) {
+	q := NewFairQueue(1, 1)
+	release := hold(q, "x")
+
+	// 名额被占用时依次排队：a×3、b×3、c×1
+	var (
+		mu    sync.Mutex
+		order []string
+		wg    sync.WaitGroup
+	)
+	enqueue := func(key string, n int) {
+		for i := 1; i <= n; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				q.Do(key, func() error {
+					mu.Lock()
+					order = append(order, key)
+					mu.Unlock()
+					return nil
+				})
+			}()
+			waitQueued(t, q, key, i)
+		}
+	}
+	enqueue("a", 3)
+	enqueue("b", 3)
+	enqueue("c", 1)
+
+	release()
+	wg.Wait()
+
+	// 有空闲名额时按发送者轮流分配，排在前面的 a 不能连续拿到名额
+	if want := []string{"a", "b", "c", "a", "b", "a", "b"}; !reflect.DeepEqual(order, want) {
+		t.Fatalf("grant order = %v, want %v", order, want)
+	}
+}
+
+func TestFairQueueLimits(t *testing.T) {
+	tests := []struct {
+		capacity, share int
+		keys            int
+	}{
+		{4, 2, 3},
+		{8, 8, 1},
+		{3, 1, 5},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("capacity=%d share=%d keys=%d", tt.capacity, tt.share, tt.keys), func(t *testing.T) {
+			q := NewFairQueue(tt.capacity, tt.share)
+
+			var (
+				total, maxTotal atomic.Int32
+				perKey          = make([]atomic.Int32, tt.keys)
+				maxPerKey       atomic.Int32
+				wg              sync.WaitGroup
+			)
+			raise := func(m *atomic.Int32, v int32) {
+				for {
+					cur := m.Load()
+					if v <= cur || m.CompareAndSwap(cur, v) {
+						return
+					}
+				}
+			}
+			for i := 0; i < 200; i++ {
+				k := i % tt.keys
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					q.Do(fmt.Sprintf("user%d", k), func() error {
+						raise(&maxTotal, total.Add(1))
+						raise(&maxPerKey, perKey[k].Add(1))
+						time.Sleep(100 * time.Microsecond)
+						perKey[k].Add(-1)
+						total.Add(-1)
+						return nil
+					})
+				}()
+			}
+			wg.Wait()
+
+			if got := int(maxTotal.Load()); got > tt.capacity {
+				t.Errorf("%d operations ran at once, capacity %d", got, tt.capacity)
+			}
+			if got := int(maxPerKey.Load()); got > tt.share {
+				t.Errorf("one sender ran %d operations at once, share %d", got, tt.share)
+			}
+			q.mu.Lock()
+			defer q.mu.Unlock()
+			if q.active != 0 || len(q.perKey) != 0 || len(q.waiting) != 0 || len(q.ring) != 0 {
+				t.Errorf("queue not empty after all operations: active=%d perKey=%v waiting=%d ring=%v",
+					q.active, q.perKey, len(q.waiting), q.ring)
+			}
+		})
+	}
+}
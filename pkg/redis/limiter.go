@@ -0,0 +1,77 @@
+package redis
+
+import (
+	"context"
+	"net"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// ==================== 并发上限 ====================
+
+/*
+concurrencyLimiter 网关级 Redis 并发上限（go-redis Hook）
+
+数千个连接 Goroutine 同时访问 Redis 时，连接池被耗尽，
+后来者在池上等待 PoolTimeout 后失败，失败又引发重试和离线存储，进一步加重负载：
+
+	无上限:  2000 个 Goroutine ──▶ 池(100) ──▶ 1900 个等待 PoolTimeout ──▶ 大量超时
+	有上限:  2000 个 Goroutine ──▶ 信号量(100) 排队 ──▶ 池(100) ──▶ 按顺序完成
+
+每条命令（或每个 Pipeline）占用一个名额，等待名额时尊重调用方 context 的取消/超时，
+因此关键路径（见 CriticalContext）排队过久同样会快速失败。
+*/
+type concurrencyLimiter struct {
+	sem chan struct{}
+}
+
+func newConcurrencyLimiter(limit int) *concurrencyLimiter {
+	return &concurrencyLimiter{sem: make(chan struct{}, limit)}
+}
+
+// acquire 获取名额，context 结束时放弃
+func (l *concurrencyLimiter) acquire(ctx context.Context) error {
+	select {
+	case l.sem <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (l *concurrencyLimiter) release() {
+	<-l.sem
+}
+
+// DialHook 建立连接不占用名额
+func (l *concurrencyLimiter) DialHook(next redis.DialHook) redis.DialHook {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return next(ctx, network, addr)
+	}
+}
+
+// ProcessHook 单条命令占用一个名额
+func (l *concurrencyLimiter) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		if err := l.acquire(ctx); err != nil {
+			cmd.SetErr(err)
+			return err
+		}
+		defer l.release()
+		return next(ctx, cmd)
+	}
+}
+
+// ProcessPipelineHook 整个 Pipeline（及 TxPipeline）占用一个名额
+func (l *concurrencyLimiter) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		if err := l.acquire(ctx); err != nil {
+			for _, cmd := range cmds {
+				cmd.SetErr(err)
+			}
+			return err
+		}
+		defer l.release()
+		return next(ctx, cmds)
+	}
+}
@@ -0,0 +1,106 @@
+/*
+Package protocol - 预置字典压缩
+
+=== 为什么需要字典？===
+
+大部分帧是很小的 JSON，字段名大量重复：
+
+	{"from_user_id":"alice","to_user_id":"bob","content":"hi","msg_type":1,"seq_id":42,...}
+
+对单个小帧直接 gzip/deflate，压缩器还没"学会"这些字段名帧就结束了，
+加上压缩头，结果往往比原文还大。
+
+预置字典（preset dictionary）让 deflate 一开始就能引用字典中的常见片段，
+小帧也能压缩得很好。字典双方内置，不随帧传输。
+
+=== 协商与帧格式 ===
+
+- 客户端在认证请求中携带 "compression": "dict-v1"，服务端在 AuthAck 中回显表示接受
+- 接受后服务端发出的帧可能被压缩；客户端是否压缩上行帧由客户端自行决定
+- 压缩帧在 Version 字段最高位置 1（FlagDictCompressed），消息体为 deflate 数据
+- 压缩后没有变小的帧按原样发送，因此任何时候收到未压缩帧都是合法的
+- Unpack 自动识别并解压，未协商的旧客户端永远不会收到压缩帧
+*/
+package protocol
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ==================== 常量定义 ====================
+
+const (
+	// FlagDictCompressed Version 字段最高位：消息体使用预置字典 deflate 压缩
+	FlagDictCompressed uint16 = 0x8000
+
+	// CompressionDictV1 认证时协商的压缩方案名称
+	CompressionDictV1 = "dict-v1"
+
+	// compressMinSize 小于此大小的消息体不尝试压缩
+	compressMinSize = 32
+)
+
+// ErrCorruptBody 压缩帧的消息体无法解压
+var ErrCorruptBody = errors.New("corrupt compressed message body")
+
+// dictV1 预置字典
+// deflate 优先匹配距离近的内容，因此最常见的片段放在末尾
+var dictV1 = []byte(`"success":false,"message":"credits":"pinned":"unpinned":"status":"text":` +
+	`"event":"delivery_expired","undeliverable","emoji":"removed":"typing":true` +
+	`"msg_id":"user_id":"group_id":"deliver_before":"unsequenced":true,` +
+	`{"success":true,"message":"` +
+	`{"from_user_id":"","to_user_id":"","content":"","msg_type":1,"seq_id":,"timestamp":17`)
+
+// ==================== 压缩封包 ====================
+
+// PackCompressed 与 Pack 相同，但尝试用预置字典压缩消息体
+// 压缩后没有变小时退化为普通帧
+func PackCompressed(msg *Message) ([]byte, error) {
+	if len(msg.Body) < compressMinSize || len(msg.Body) > MaxPayloadLength {
+		return Pack(msg)
+	}
+
+	// 小于几百字节的输入，只有 BestCompression 会真正引用字典做匹配，
+	// 其他级别对这么短的数据几乎不压缩；帧很小，CPU 开销可以接受
+	var buf bytes.Buffer
+	zw, err := flate.NewWriterDict(&buf, flate.BestCompression, dictV1)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := zw.Write(msg.Body); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	if buf.Len() >= len(msg.Body) {
+		return Pack(msg)
+	}
+
+	data, err := Pack(&Message{CmdType: msg.CmdType, Body: buf.Bytes()})
+	if err != nil {
+		return nil, err
+	}
+	// 在头部的 Version 字段上打压缩标记
+	data[4] |= byte(FlagDictCompressed >> 8)
+	return data, nil
+}
+
+// decompressBody 解压消息体，解压后超过 MaxPayloadLength 视为过大
+func decompressBody(body []byte) ([]byte, error) {
+	zr := flate.NewReaderDict(bytes.NewReader(body), dictV1)
+	defer zr.Close()
+
+	data, err := io.ReadAll(io.LimitReader(zr, MaxPayloadLength+1))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrCorruptBody, err)
+	}
+	if len(data) > MaxPayloadLength {
+		return nil, ErrPayloadTooLarge
+	}
+	return data, nil
+}
@@ -0,0 +1,108 @@
+package protocol
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"testing"
+)
+
+// unpackBytes 从字节数组解出一帧
+func unpackBytes(t *testing.T, data []byte) (*Message, error) {
+	t.Helper()
+	return Unpack(bufio.NewReader(bytes.NewReader(data)))
+}
+
+// frameVersion 帧头中的 Version 字段（含标志位）
+func frameVersion(data []byte) uint16 {
+	return binary.BigEndian.Uint16(data[4:6])
+}
+
+func TestPackCompressedRoundTrip(t *testing.T) {
+	random := make([]byte, 256)
+	if _, err := rand.Read(random); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		body       []byte
+		compressed bool // 是否应该打上 FlagDictCompressed
+	}{
+		{"chat message", []byte(`{"from_user_id":"alice","to_user_id":"bob","content":"hello there","msg_type":1,"seq_id":42,"timestamp":1700000000000}`), true},
+		{"ack reply", []byte(`{"success":true,"message":"authenticated","user_id":"alice"}`), true},
+		{"below min size", []byte(`{"seq_id":1}`), false},
+		{"empty", nil, false},
+		{"incompressible", random, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := PackCompressed(&Message{CmdType: CmdTypeMessage, Body: tt.body})
+			if err != nil {
+				t.Fatal(err)
+			}
+			flagged := frameVersion(data)&FlagDictCompressed != 0
+			if flagged != tt.compressed {
+				t.Fatalf("compressed flag = %v, want %v", flagged, tt.compressed)
+			}
+			if frameVersion(data)&^FlagDictCompressed != ProtocolVersion {
+				t.Fatalf("version = %#x, want %d with optional flag", frameVersion(data), ProtocolVersion)
+			}
+			if tt.compressed && len(data)-HeaderLength >= len(tt.body) {
+				t.Fatalf("compressed body is %d bytes, original %d", len(data)-HeaderLength, len(tt.body))
+			}
+
+			msg, err := unpackBytes(t, data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if msg.Version != ProtocolVersion {
+				t.Errorf("unpacked version = %#x, want %d (flag cleared)", msg.Version, ProtocolVersion)
+			}
+			if msg.CmdType != CmdTypeMessage || !bytes.Equal(msg.Body, tt.body) {
+				t.Errorf("unpacked (%d, %q), want (%d, %q)", msg.CmdType, msg.Body, CmdTypeMessage, tt.body)
+			}
+		})
+	}
+}
+
+// compressedFrame 把任意数据作为压缩帧的消息体
+func compressedFrame(t *testing.T, body []byte) []byte {
+	t.Helper()
+	data, err := Pack(&Message{CmdType: CmdTypeMessage, Body: body})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[4] |= byte(FlagDictCompressed >> 8)
+	return data
+}
+
+func TestUnpackCorruptCompressedBody(t *testing.T) {
+	_, err := unpackBytes(t, compressedFrame(t, []byte{0xff, 0xff, 0xff, 0xff}))
+	if !errors.Is(err, ErrCorruptBody) {
+		t.Fatalf("err = %v, want ErrCorruptBody", err)
+	}
+}
+
+func TestUnpackCompressedBodyTooLarge(t *testing.T) {
+	// 几 KB 的压缩数据解压后超过 MaxPayloadLength
+	var buf bytes.Buffer
+	zw, err := flate.NewWriterDict(&buf, flate.BestCompression, dictV1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := zw.Write(make([]byte, MaxPayloadLength+1)); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = unpackBytes(t, compressedFrame(t, buf.Bytes()))
+	if !errors.Is(err, ErrPayloadTooLarge) {
+		t.Fatalf("err = %v, want ErrPayloadTooLarge", err)
+	}
+}
@@ -0,0 +1,118 @@
+/*
+Package protocol - 批量解码
+
+=== 使用场景 ===
+
+网关之间的批量导入（如迁移历史消息）把大量帧直接拼接写入文件或网络流：
+
+	[帧1头部][帧1体][帧2头部][帧2体]...[帧N头部][帧N体的前半部分]
+	                                              ↑ 写入方中途崩溃
+
+与在线连接上的 Unpack 不同，批量场景需要区分三种结束方式：
+
+	正好在帧边界结束      → io.EOF，全部帧都有效
+	最后一帧不完整        → ErrIncomplete，之前的帧有效，Offset 为可以续传的位置
+	头部非法 / 消息体过大 → ErrInvalidHeader / ErrPayloadTooLarge，数据已损坏
+
+头部解析、长度校验和解压与 Unpack 共用同一套逻辑（parseHeader / finishBody）。
+*/
+package protocol
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ErrIncomplete 数据流在一帧的中间结束（末尾的帧被截断）
+var ErrIncomplete = errors.New("incomplete trailing frame")
+
+// Decoder 从任意 io.Reader 中依次读取拼接在一起的协议帧
+type Decoder struct {
+	reader *bufio.Reader
+	offset int64 // 已完整读取的帧的总字节数
+	frames int   // 已完整读取的帧数
+}
+
+// NewDecoder 创建批量解码器
+func NewDecoder(r io.Reader) *Decoder {
+	br, ok := r.(*bufio.Reader)
+	if !ok {
+		br = bufio.NewReader(r)
+	}
+	return &Decoder{reader: br}
+}
+
+// Next 读取下一帧
+//
+// 数据流正好在帧边界结束时返回 io.EOF；
+// 在帧中间结束时返回包装了 ErrIncomplete 的错误（可用 errors.Is 判断）
+func (d *Decoder) Next() (*Message, error) {
+	header := make([]byte, HeaderLength)
+	if n, err := io.ReadFull(d.reader, header); err != nil {
+		if err == io.EOF {
+			return nil, io.EOF
+		}
+		return nil, d.incomplete(n, HeaderLength, err)
+	}
+
+	msg, bodyLen, err := parseHeader(header)
+	if err != nil {
+		return nil, fmt.Errorf("frame %d at offset %d: %w", d.frames, d.offset, err)
+	}
+
+	if bodyLen > 0 {
+		msg.Body = make([]byte, bodyLen)
+		if n, err := io.ReadFull(d.reader, msg.Body); err != nil {
+			return nil, d.incomplete(HeaderLength+n, HeaderLength+bodyLen, err)
+		}
+	}
+
+	if err := finishBody(msg); err != nil {
+		return nil, fmt.Errorf("frame %d at offset %d: %w", d.frames, d.offset, err)
+	}
+
+	d.offset += int64(HeaderLength + bodyLen)
+	d.frames++
+	return msg, nil
+}
+
+// incomplete 把读取中途遇到的 EOF 转换为 ErrIncomplete，其他读取错误原样返回
+func (d *Decoder) incomplete(got, want int, err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return fmt.Errorf("%w: frame %d at offset %d has %d of %d bytes",
+			ErrIncomplete, d.frames, d.offset, got, want)
+	}
+	return err
+}
+
+// Offset 已完整读取的帧的总字节数
+// 遇到 ErrIncomplete 后，从这个位置开始重新读取即可续传
+func (d *Decoder) Offset() int64 {
+	return d.offset
+}
+
+// Frames 已完整读取的帧数
+func (d *Decoder) Frames() int {
+	return d.frames
+}
+
+// DecodeAll 读取数据流中的所有帧
+//
+// 正常结束时 error 为 nil；末尾的帧被截断时返回之前所有完整的帧和 ErrIncomplete；
+// 遇到损坏的帧时返回之前的帧和对应的错误
+func DecodeAll(r io.Reader) ([]*Message, error) {
+	d := NewDecoder(r)
+	var msgs []*Message
+	for {
+		msg, err := d.Next()
+		if err == io.EOF {
+			return msgs, nil
+		}
+		if err != nil {
+			return msgs, err
+		}
+		msgs = append(msgs, msg)
+	}
+}
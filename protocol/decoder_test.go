@@ -0,0 +1,128 @@
+package protocol
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+)
+
+// packFrames 依次打包 bodies，返回拼接后的数据流
+func packFrames(t *testing.T, bodies ...string) []byte {
+	t.Helper()
+	var stream []byte
+	for _, body := range bodies {
+		data, err := Pack(&Message{CmdType: CmdTypeMessage, Body: []byte(body)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		stream = append(stream, data...)
+	}
+	return stream
+}
+
+// bodiesOf 消息体列表
+func bodiesOf(msgs []*Message) []string {
+	bodies := make([]string, len(msgs))
+	for i, msg := range msgs {
+		bodies[i] = string(msg.Body)
+	}
+	return bodies
+}
+
+func TestDecoderTruncatedTailResumes(t *testing.T) {
+	bodies := []string{"first", "second", "", "fourth frame"}
+	stream := packFrames(t, bodies...)
+	lastStart := len(packFrames(t, bodies[:3]...))
+
+	// 在最后一帧的每一个位置截断：头部中间、头部结束、消息体中间
+	for cut := lastStart + 1; cut < len(stream); cut++ {
+		t.Run(fmt.Sprintf("cut at %d", cut), func(t *testing.T) {
+			d := NewDecoder(bytes.NewReader(stream[:cut]))
+			var got []*Message
+			var err error
+			for {
+				var msg *Message
+				if msg, err = d.Next(); err != nil {
+					break
+				}
+				got = append(got, msg)
+			}
+			if !errors.Is(err, ErrIncomplete) {
+				t.Fatalf("err = %v, want ErrIncomplete", err)
+			}
+			if fmt.Sprint(bodiesOf(got)) != fmt.Sprint(bodies[:3]) {
+				t.Fatalf("decoded %q before the cut, want %q", bodiesOf(got), bodies[:3])
+			}
+			if d.Offset() != int64(lastStart) || d.Frames() != 3 {
+				t.Fatalf("offset %d, frames %d, want %d, 3", d.Offset(), d.Frames(), lastStart)
+			}
+
+			// 写入方补齐剩余数据后，从 Offset 续传得到最后一帧
+			rest, err := DecodeAll(bytes.NewReader(stream[d.Offset():]))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fmt.Sprint(bodiesOf(rest)) != fmt.Sprint(bodies[3:]) {
+				t.Fatalf("resumed %q, want %q", bodiesOf(rest), bodies[3:])
+			}
+		})
+	}
+}
+
+func TestDecodeAll(t *testing.T) {
+	stream := packFrames(t, "a", "b", "c")
+
+	msgs, err := DecodeAll(bytes.NewReader(stream))
+	if err != nil || fmt.Sprint(bodiesOf(msgs)) != "[a b c]" {
+		t.Fatalf("DecodeAll = (%q, %v), want ([a b c], nil)", bodiesOf(msgs), err)
+	}
+
+	msgs, err = DecodeAll(bytes.NewReader(stream[:len(stream)-1]))
+	if !errors.Is(err, ErrIncomplete) || fmt.Sprint(bodiesOf(msgs)) != "[a b]" {
+		t.Fatalf("truncated DecodeAll = (%q, %v), want ([a b], ErrIncomplete)", bodiesOf(msgs), err)
+	}
+
+	msgs, err = DecodeAll(bytes.NewReader(nil))
+	if err != nil || len(msgs) != 0 {
+		t.Fatalf("empty DecodeAll = (%q, %v), want ([], nil)", bodiesOf(msgs), err)
+	}
+}
+
+func TestDecoderCorruptFrame(t *testing.T) {
+	stream := packFrames(t, "ok")
+	stream = append(stream, 0, 0, 0, 1, 0, 1, 0, 1) // Length 小于 4
+	d := NewDecoder(bytes.NewReader(stream))
+	if _, err := d.Next(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Next(); !errors.Is(err, ErrInvalidHeader) || errors.Is(err, ErrIncomplete) {
+		t.Fatalf("err = %v, want ErrInvalidHeader", err)
+	}
+}
+
+// errReader 读完 data 后返回 err
+type errReader struct {
+	data []byte
+	err  error
+}
+
+func (r *errReader) Read(p []byte) (int, error) {
+	if len(r.data) == 0 {
+		return 0, r.err
+	}
+	n := copy(p, r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+func TestDecoderReadErrorIsNotIncomplete(t *testing.T) {
+	broken := errors.New("disk failure")
+	stream := packFrames(t, "whole frame")
+	d := NewDecoder(&errReader{data: stream[:5], err: broken})
+	_, err := d.Next()
+	if !errors.Is(err, broken) || errors.Is(err, ErrIncomplete) || err == io.EOF {
+		t.Fatalf("err = %v, want the underlying read error", err)
+	}
+}
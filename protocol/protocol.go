@@ -1,264 +1,483 @@
-/*
-Package protocol - 自定义二进制协议实现
-
-=== 为什么需要自定义协议？===
-
-TCP 是流式协议，数据像水流一样连续传输，没有消息边界。
-这会导致两个经典问题：
-
- 1. 粘包 (Sticky Packet)：多个消息粘在一起
-    发送: [消息A][消息B] → 接收: [消息A消息B]
-
- 2. 拆包 (Half Packet)：一个消息被拆成多次接收
-    发送: [消息A] → 接收: [消息A前半部分] + [消息A后半部分]
-
-=== 解决方案：长度前缀协议 (Length-Prefixed Protocol) ===
-
-消息格式:
-+----------+----------+----------+-----------------+
-|  Length  | Version  | CmdType  |      Body       |
-|  4字节   |  2字节   |  2字节   |     N字节       |
-+----------+----------+----------+-----------------+
-|<-------- 固定 8 字节头部 ------->|<-- 变长消息体 -->|
-
-解包步骤：
-1. 先读取固定 8 字节头部
-2. 从头部解析出 Length 字段，得知消息体长度
-3. 再精确读取 N 字节的消息体
-4. 这样就能准确切分每个消息，解决粘包/拆包问题
-
-=== 与其他方案的对比 ===
-
-| 方案            | 优点           | 缺点                |
-|-----------------|----------------|---------------------|
-| 长度前缀 (本项目)| 高效、精确     | 需要自己实现        |
-| 分隔符 (\n)     | 简单           | 消息体不能包含分隔符|
-| HTTP/JSON       | 通用           | 开销大、解析慢      |
-| Protobuf        | 高效、跨语言   | 需要预定义 schema   |
-*/
-package protocol
-
-import (
-	"bufio"
-	"encoding/binary"
-	"errors"
-	"io"
-)
-
-// ==================== 协议常量定义 ====================
-
-const (
-	// HeaderLength 协议头部固定长度
-	// Length(4) + Version(2) + CmdType(2) = 8 字节
-	HeaderLength = 8
-
-	// MaxPayloadLength 消息体最大长度限制 (1MB)
-	// 这是一个重要的安全措施：
-	// - 防止恶意客户端发送超大包，导致服务器 OOM (内存溢出)
-	// - 参考了 Redis 的 query buffer 限制设计
-	MaxPayloadLength = 1024 * 1024
-
-	// ProtocolVersion 当前协议版本号
-	// 用于后续协议升级时的兼容性处理
-	ProtocolVersion = 1
-)
-
-// ==================== 命令类型定义 ====================
-// 类似 HTTP 的请求方法，定义了不同的操作类型
-
-const (
-	// CmdTypeHeartbeat 心跳包
-	// 客户端定期发送，用于：
-	// 1. 保持连接活跃（防止被中间设备如 NAT 断开）
-	// 2. 检测连接是否存活
-	CmdTypeHeartbeat = iota + 1
-
-	// CmdTypeAuth 认证请求
-	// 客户端连接后发送，携带 JWT Token
-	CmdTypeAuth
-
-	// CmdTypeAuthAck 认证响应
-	// 服务端返回认证结果
-	CmdTypeAuthAck
-
-	// CmdTypeMessage 聊天消息
-	// 客户端发送的聊天内容
-	CmdTypeMessage
-
-	// CmdTypeMessageAck 消息确认
-	// 客户端收到消息后回复，用于可靠性保证
-	CmdTypeMessageAck
-
-	// CmdTypeKick 踢出通知
-	// 服务端通知客户端断开（如：重复登录、服务器重启）
-	CmdTypeKick
-)
-
-// ==================== 消息结构体 ====================
-
-/*
-Message 表示一个完整的协议消息
-
-内存布局示例 (发送 "Hello"):
-+--------+--------+--------+-------------------+
-| 00 00  | 00 01  | 00 04  | H  e  l  l  o     |
-| 00 09  |        |        |                   |
-+--------+--------+--------+-------------------+
-
-	Length   Version  CmdType      Body
-	= 9       = 1      = 4      = "Hello"
-
-Length = 4 (Version+CmdType) + 5 (Body长度) = 9
-*/
-type Message struct {
-	// Length 消息长度（不包括 Length 字段本身的 4 字节）
-	// Length = 2(Version) + 2(CmdType) + len(Body)
-	Length uint32
-
-	// Version 协议版本号，用于兼容性
-	Version uint16
-
-	// CmdType 命令类型，见上方常量定义
-	CmdType uint16
-
-	// Body 消息体，实际内容（通常是 JSON）
-	Body []byte
-}
-
-// ==================== 错误定义 ====================
-
-var (
-	// ErrPayloadTooLarge 消息体过大错误
-	ErrPayloadTooLarge = errors.New("payload exceeds maximum allowed size")
-
-	// ErrInvalidHeader 无效的消息头
-	ErrInvalidHeader = errors.New("invalid message header")
-)
-
-// ==================== 封包函数 ====================
-
-/*
-Pack 将 Message 结构体序列化为字节数组（封包）
-
-使用场景：发送消息前，将结构体转换为字节流
-
-示例：
-
-	msg := &Message{CmdType: CmdTypeMessage, Body: []byte("Hello")}
-	data, err := Pack(msg)
-	conn.Write(data)  // 发送到网络
-
-字节序：使用大端序 (Big Endian)
-- 网络传输的标准字节序
-- 高位字节在前，符合人类阅读习惯
-- 例如：数字 258 → [0x01, 0x02] 而非 [0x02, 0x01]
-*/
-func Pack(msg *Message) ([]byte, error) {
-	bodyLen := len(msg.Body)
-
-	// 安全检查：防止发送过大的消息
-	if bodyLen > MaxPayloadLength {
-		return nil, ErrPayloadTooLarge
-	}
-
-	// 计算 Length 字段值
-	// Length = Version(2字节) + CmdType(2字节) + Body(N字节)
-	msg.Length = uint32(4 + bodyLen)
-	msg.Version = ProtocolVersion
-
-	// 分配缓冲区：头部(8字节) + 消息体(N字节)
-	data := make([]byte, HeaderLength+bodyLen)
-
-	// 写入头部（使用大端序）
-	// binary.BigEndian 确保跨平台的字节序一致性
-	binary.BigEndian.PutUint32(data[0:4], msg.Length)  // 字节 0-3: Length
-	binary.BigEndian.PutUint16(data[4:6], msg.Version) // 字节 4-5: Version
-	binary.BigEndian.PutUint16(data[6:8], msg.CmdType) // 字节 6-7: CmdType
-
-	// 写入消息体
-	if bodyLen > 0 {
-		copy(data[HeaderLength:], msg.Body)
-	}
-
-	return data, nil
-}
-
-// ==================== 解包函数 ====================
-
-/*
-Unpack 从 Reader 中读取并解析一个完整的 Message（解包）
-
-这是解决 TCP 粘包/拆包的核心函数！
-
-关键技术：io.ReadFull
-- 普通的 Read() 可能只读取部分数据就返回
-- ReadFull() 保证读取指定数量的字节，否则返回错误
-- 这确保了我们能精确读取完整的消息
-
-解包流程图：
-
-	┌─────────────────────────────────────────┐
-	│          TCP 字节流                      │
-	│  [消息1头部][消息1体][消息2头部][消息2体]... │
-	└─────────────────────────────────────────┘
-	                ↓ ReadFull(8字节)
-	┌─────────────┐
-	│  消息1头部   │ → 解析得到 Length=100
-	└─────────────┘
-	                ↓ ReadFull(96字节)  // 100-4=96
-	┌─────────────┐
-	│  消息1体     │ → 得到完整消息1
-	└─────────────┘
-	                ↓ 循环处理消息2...
-
-参数：
-- reader: bufio.Reader 包装的网络连接，提供缓冲读取
-
-返回：
-- *Message: 解析出的完整消息
-- error: 错误信息（EOF 表示连接关闭）
-*/
-func Unpack(reader *bufio.Reader) (*Message, error) {
-	// ========== 步骤 1: 读取固定长度的头部 (8 字节) ==========
-	header := make([]byte, HeaderLength)
-	_, err := io.ReadFull(reader, header)
-	if err != nil {
-		// EOF: 对端正常关闭连接
-		// ErrUnexpectedEOF: 读取中途连接断开
-		return nil, err
-	}
-
-	// ========== 步骤 2: 解析头部字段 ==========
-	msg := &Message{
-		Length:  binary.BigEndian.Uint32(header[0:4]),
-		Version: binary.BigEndian.Uint16(header[4:6]),
-		CmdType: binary.BigEndian.Uint16(header[6:8]),
-	}
-
-	// ========== 步骤 3: 计算并验证消息体长度 ==========
-	// bodyLen = Length - Version(2) - CmdType(2)
-	bodyLen := int(msg.Length) - 4
-
-	// 安全检查 1: 防止负数长度（可能是协议错误或攻击）
-	if bodyLen < 0 {
-		return nil, ErrInvalidHeader
-	}
-
-	// 安全检查 2: 防止恶意大包攻击
-	// 如果不检查，攻击者可以发送 Length=0xFFFFFFFF
-	// 导致服务器尝试分配 4GB 内存，造成 OOM
-	if bodyLen > MaxPayloadLength {
-		return nil, ErrPayloadTooLarge
-	}
-
-	// ========== 步骤 4: 读取消息体 ==========
-	if bodyLen > 0 {
-		msg.Body = make([]byte, bodyLen)
-		_, err = io.ReadFull(reader, msg.Body)
-		if err != nil {
-			return nil, err
-		}
-	}
-
-	return msg, nil
-}
+/*
+Package protocol - 自定义二进制协议实现
+
+=== 为什么需要自定义协议？===
+
+TCP 是流式协议，数据像水流一样连续传输，没有消息边界。
+这会导致两个经典问题：
+
+ 1. 粘包 (Sticky Packet)：多个消息粘在一起
+    发送: [消息A][消息B] → 接收: [消息A消息B]
+
+ 2. 拆包 (Half Packet)：一个消息被拆成多次接收
+    发送: [消息A] → 接收: [消息A前半部分] + [消息A后半部分]
+
+=== 解决方案：长度前缀协议 (Length-Prefixed Protocol) ===
+
+消息格式:
++----------+----------+----------+-----------------+
+|  Length  | Version  | CmdType  |      Body       |
+|  4字节   |  2字节   |  2字节   |     N字节       |
++----------+----------+----------+-----------------+
+|<-------- 固定 8 字节头部 ------->|<-- 变长消息体 -->|
+
+解包步骤：
+1. 先读取固定 8 字节头部
+2. 从头部解析出 Length 字段，得知消息体长度
+3. 再精确读取 N 字节的消息体
+4. 这样就能准确切分每个消息，解决粘包/拆包问题
+
+=== 与其他方案的对比 ===
+
+| 方案            | 优点           | 缺点                |
+|-----------------|----------------|---------------------|
+| 长度前缀 (本项目)| 高效、精确     | 需要自己实现        |
+| 分隔符 (\n)     | 简单           | 消息体不能包含分隔符|
+| HTTP/JSON       | 通用           | 开销大、解析慢      |
+| Protobuf        | 高效、跨语言   | 需要预定义 schema   |
+*/
+package protocol
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+// ==================== 协议常量定义 ====================
+
+const (
+	// HeaderLength 协议头部固定长度
+	// Length(4) + Version(2) + CmdType(2) = 8 字节
+	HeaderLength = 8
+
+	// MaxPayloadLength 消息体最大长度限制 (1MB)
+	// 这是一个重要的安全措施：
+	// - 防止恶意客户端发送超大包，导致服务器 OOM (内存溢出)
+	// - 参考了 Redis 的 query buffer 限制设计
+	// 即使调大，Length 字段（uint32）仍限制消息体不超过 2^32-1-4 字节（见 frameLength）
+	MaxPayloadLength = 1024 * 1024
+
+	// ProtocolVersion 当前协议版本号
+	// 用于后续协议升级时的兼容性处理
+	ProtocolVersion = 1
+)
+
+// ==================== 命令类型定义 ====================
+// 类似 HTTP 的请求方法，定义了不同的操作类型
+
+const (
+	// CmdTypeHeartbeat 心跳包
+	// 客户端定期发送，用于：
+	// 1. 保持连接活跃（防止被中间设备如 NAT 断开）
+	// 2. 检测连接是否存活
+	CmdTypeHeartbeat = iota + 1
+
+	// CmdTypeAuth 认证请求
+	// 客户端连接后发送，携带 JWT Token
+	CmdTypeAuth
+
+	// CmdTypeAuthAck 认证响应
+	// 服务端返回认证结果
+	CmdTypeAuthAck
+
+	// CmdTypeMessage 聊天消息
+	// 客户端发送的聊天内容
+	CmdTypeMessage
+
+	// CmdTypeMessageAck 消息确认
+	// 客户端收到消息后回复，用于可靠性保证
+	CmdTypeMessageAck
+
+	// CmdTypeKick 踢出通知
+	// 服务端通知客户端断开（如：重复登录、服务器重启）
+	CmdTypeKick
+
+	// CmdTypeMigrate 迁移指令
+	// 服务端通知客户端携带 handoff token 连接到另一个网关
+	CmdTypeMigrate
+
+	// CmdTypeReaction 表情回应
+	// 客户端发送：对某条消息添加/移除表情
+	// 服务端推送：通知原消息发送者有新的回应
+	CmdTypeReaction
+
+	// CmdTypeWhoAmI 查询当前连接绑定的身份和会话信息
+	// 请求和响应使用同一命令类型
+	CmdTypeWhoAmI
+
+	// CmdTypeCredit 发送额度授予
+	// 服务端通知客户端还可以再发送多少条消息（基于额度的流控）
+	CmdTypeCredit
+
+	// CmdTypeScheduled 定时消息
+	// 客户端发送：创建/取消定时消息；服务端回复：结果（同一命令类型）
+	CmdTypeScheduled
+
+	// CmdTypeTyping 正在输入提示
+	// 客户端上报输入状态，服务端防抖后推送给对方
+	CmdTypeTyping
+
+	// CmdTypePresence 在线状态
+	// 客户端发送：设置自己的状态 / 查询他人的状态；服务端回复结果
+	CmdTypePresence
+
+	// CmdTypePin 置顶消息
+	// 客户端发送：置顶会话中的一条消息；服务端推送：通知会话其他成员
+	CmdTypePin
+
+	// CmdTypeUnpin 取消置顶
+	// 请求和通知格式与 CmdTypePin 相同
+	CmdTypeUnpin
+
+	// CmdTypeGroupEvent 群成员变更
+	// 客户端发送：加入/退出群，或添加/移除其他成员；服务端推送：通知群成员
+	CmdTypeGroupEvent
+
+	// CmdTypeConversations 会话列表
+	// 客户端发送：查询会话列表或清零某个会话的未读数；服务端以同一命令类型回复
+	CmdTypeConversations
+
+	// CmdTypeHealth 健康检查（无需认证）
+	// 供负载均衡/编排系统探活，不需要建立完整的客户端会话
+	CmdTypeHealth
+
+	// CmdTypeHealthAck 健康检查响应（状态、版本、运行时长）
+	CmdTypeHealthAck
+
+	// CmdTypeUndelivered 未送达消息查询
+	// 客户端发送收件人列表；服务端以同一命令类型回复每个收件人是否在线、有多少条消息未送达
+	CmdTypeUndelivered
+
+	// CmdTypeError 错误通知
+	// 服务端无法处理客户端的请求时发送，Body 为 ErrorBody
+	CmdTypeError
+
+	// CmdTypeNack 否定确认
+	// 客户端收到损坏/无法解码的消息时发送 {"seq_id": N}，服务端重新投递该消息
+	CmdTypeNack
+
+	// CmdTypeTopic 主题频道订阅
+	// 客户端发送：订阅/取消订阅/列出订阅；服务端以同一命令类型回复
+	// 主题消息本身以 CmdTypeMessage 推送（带 topic 字段）
+	CmdTypeTopic
+
+	// CmdTypeProfileQuery 用户资料
+	// 客户端发送：批量查询用户资料，或修改自己的资料；服务端以同一命令类型回复
+	CmdTypeProfileQuery
+
+	// CmdTypePause 暂停实时推送
+	// 客户端进入后台时发送：之后发给该连接的消息存入离线盒子，不再推送
+	// 服务端以同一命令类型回复
+	CmdTypePause
+
+	// CmdTypeResume 恢复实时推送
+	// 客户端回到前台时发送：恢复推送，并投递暂停期间积压的离线消息
+	// 服务端以同一命令类型回复
+	CmdTypeResume
+
+	// CmdTypeTimeSync 时钟同步
+	// 客户端发送 {"client_time": 毫秒}，服务端回复原样带回的 client_time
+	// 和收到/发出时的服务器时间，客户端据此估算时差（不需要认证）
+	CmdTypeTimeSync
+
+	// CmdTypeBatchMessage 批量发送
+	// 客户端发送 {"messages": [...]}，每项格式与 CmdTypeMessage 相同；
+	// 服务端逐条路由后以同一命令类型回复每条的结果（见 service/batch.go）
+	CmdTypeBatchMessage
+
+	// CmdTypeReconnect 恢复会话
+	// 客户端断线重连时发送 {"session_id": "...", "last_seq": N} 代替 CmdTypeAuth，
+	// 会话 ID 由认证时的 AuthAck 签发；服务端以 CmdTypeAuthAck 回复（见 service/resume.go）
+	CmdTypeReconnect
+)
+
+// 错误码（ErrorBody.Code）
+const (
+	// ErrorCodeUnknownCommand 服务端不认识的命令类型（客户端版本不兼容）
+	ErrorCodeUnknownCommand = "unknown_command"
+
+	// ErrorCodeMessageNotFound NACK 的消息已不在服务端（已确认或已过期）
+	ErrorCodeMessageNotFound = "message_not_found"
+
+	// ErrorCodeRedeliveryLimit NACK 的消息重投次数已达上限，不再重投
+	ErrorCodeRedeliveryLimit = "redelivery_limit"
+
+	// ErrorCodeOutOfOrder 消息的客户端计数（client_seq）不大于同一会话上一条消息的计数
+	ErrorCodeOutOfOrder = "out_of_order"
+
+	// ErrorCodeBatchTooLarge 批量发送的消息数超过上限，整个批次被拒绝
+	ErrorCodeBatchTooLarge = "batch_too_large"
+)
+
+// ErrorBody CmdTypeError 的消息体
+type ErrorBody struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	CmdType uint16 `json:"cmd_type,omitempty"` // 出错请求的命令类型
+}
+
+// cmdTypeNames 命令类型 → 可读名称
+var cmdTypeNames = map[uint16]string{
+	CmdTypeHeartbeat:     "Heartbeat",
+	CmdTypeAuth:          "Auth",
+	CmdTypeAuthAck:       "AuthAck",
+	CmdTypeMessage:       "Message",
+	CmdTypeMessageAck:    "MessageAck",
+	CmdTypeKick:          "Kick",
+	CmdTypeMigrate:       "Migrate",
+	CmdTypeReaction:      "Reaction",
+	CmdTypeWhoAmI:        "WhoAmI",
+	CmdTypeCredit:        "Credit",
+	CmdTypeScheduled:     "Scheduled",
+	CmdTypeTyping:        "Typing",
+	CmdTypePresence:      "Presence",
+	CmdTypePin:           "Pin",
+	CmdTypeUnpin:         "Unpin",
+	CmdTypeGroupEvent:    "GroupEvent",
+	CmdTypeConversations: "Conversations",
+	CmdTypeHealth:        "Health",
+	CmdTypeHealthAck:     "HealthAck",
+	CmdTypeUndelivered:   "Undelivered",
+	CmdTypeError:         "Error",
+	CmdTypeNack:          "Nack",
+	CmdTypeTopic:         "Topic",
+	CmdTypeProfileQuery:  "ProfileQuery",
+	CmdTypePause:         "Pause",
+	CmdTypeResume:        "Resume",
+	CmdTypeTimeSync:      "TimeSync",
+	CmdTypeBatchMessage:  "BatchMessage",
+	CmdTypeReconnect:     "Reconnect",
+}
+
+// CmdTypeName 返回命令类型的可读名称，用于日志和统计
+// 未知类型返回 "unknown(N)"
+func CmdTypeName(cmdType uint16) string {
+	if name, ok := cmdTypeNames[cmdType]; ok {
+		return name
+	}
+	return fmt.Sprintf("unknown(%d)", cmdType)
+}
+
+// ==================== 消息结构体 ====================
+
+/*
+Message 表示一个完整的协议消息
+
+内存布局示例 (发送 "Hello"):
++--------+--------+--------+-------------------+
+| 00 00  | 00 01  | 00 04  | H  e  l  l  o     |
+| 00 09  |        |        |                   |
++--------+--------+--------+-------------------+
+
+	Length   Version  CmdType      Body
+	= 9       = 1      = 4      = "Hello"
+
+Length = 4 (Version+CmdType) + 5 (Body长度) = 9
+*/
+type Message struct {
+	// Length 消息长度（不包括 Length 字段本身的 4 字节）
+	// Length = 2(Version) + 2(CmdType) + len(Body)
+	Length uint32
+
+	// Version 协议版本号，用于兼容性
+	Version uint16
+
+	// CmdType 命令类型，见上方常量定义
+	CmdType uint16
+
+	// Body 消息体，实际内容（通常是 JSON）
+	Body []byte
+}
+
+// ==================== 错误定义 ====================
+
+var (
+	// ErrPayloadTooLarge 消息体过大错误
+	ErrPayloadTooLarge = errors.New("payload exceeds maximum allowed size")
+
+	// ErrInvalidHeader 无效的消息头
+	ErrInvalidHeader = errors.New("invalid message header")
+)
+
+// ==================== 封包函数 ====================
+
+/*
+Pack 将 Message 结构体序列化为字节数组（封包）
+
+使用场景：发送消息前，将结构体转换为字节流
+
+示例：
+
+	msg := &Message{CmdType: CmdTypeMessage, Body: []byte("Hello")}
+	data, err := Pack(msg)
+	conn.Write(data)  // 发送到网络
+
+字节序：使用大端序 (Big Endian)
+- 网络传输的标准字节序
+- 高位字节在前，符合人类阅读习惯
+- 例如：数字 258 → [0x01, 0x02] 而非 [0x02, 0x01]
+*/
+func Pack(msg *Message) ([]byte, error) {
+	bodyLen := len(msg.Body)
+
+	// 计算 Length 字段值
+	// Length = Version(2字节) + CmdType(2字节) + Body(N字节)
+	// 安全检查：防止发送过大的消息，以及 Length 溢出 uint32
+	length, err := frameLength(bodyLen, MaxPayloadLength)
+	if err != nil {
+		return nil, err
+	}
+	msg.Length = length
+	msg.Version = ProtocolVersion
+
+	// 分配缓冲区：头部(8字节) + 消息体(N字节)
+	data := make([]byte, HeaderLength+bodyLen)
+
+	// 写入头部（使用大端序）
+	// binary.BigEndian 确保跨平台的字节序一致性
+	binary.BigEndian.PutUint32(data[0:4], msg.Length)  // 字节 0-3: Length
+	binary.BigEndian.PutUint16(data[4:6], msg.Version) // 字节 4-5: Version
+	binary.BigEndian.PutUint16(data[6:8], msg.CmdType) // 字节 6-7: CmdType
+
+	// 写入消息体
+	if bodyLen > 0 {
+		copy(data[HeaderLength:], msg.Body)
+	}
+
+	return data, nil
+}
+
+// frameLength 计算 bodyLen 字节消息体对应的 Length 字段值
+//
+// 消息体超过 limit，或 Length、整帧长度（HeaderLength+bodyLen）超出 uint32 / int 的范围时
+// 返回 ErrPayloadTooLarge。先比较再相加，4 + bodyLen 本身不会溢出，
+// 因此无论 MaxPayloadLength 设为多大，都不会写出截断的 Length 导致对端错误分帧
+func frameLength(bodyLen, limit int) (uint32, error) {
+	if bodyLen < 0 || bodyLen > limit {
+		return 0, ErrPayloadTooLarge
+	}
+	if uint64(bodyLen) > math.MaxUint32-4 || bodyLen > math.MaxInt-HeaderLength {
+		return 0, ErrPayloadTooLarge
+	}
+	return uint32(bodyLen) + 4, nil
+}
+
+// ==================== 解包函数 ====================
+
+/*
+Unpack 从 Reader 中读取并解析一个完整的 Message（解包）
+
+这是解决 TCP 粘包/拆包的核心函数！
+
+关键技术：io.ReadFull
+- 普通的 Read() 可能只读取部分数据就返回
+- ReadFull() 保证读取指定数量的字节，否则返回错误
+- 这确保了我们能精确读取完整的消息
+
+解包流程图：
+
+	┌─────────────────────────────────────────┐
+	│          TCP 字节流                      │
+	│  [消息1头部][消息1体][消息2头部][消息2体]... │
+	└─────────────────────────────────────────┘
+	                ↓ ReadFull(8字节)
+	┌─────────────┐
+	│  消息1头部   │ → 解析得到 Length=100
+	└─────────────┘
+	                ↓ ReadFull(96字节)  // 100-4=96
+	┌─────────────┐
+	│  消息1体     │ → 得到完整消息1
+	└─────────────┘
+	                ↓ 循环处理消息2...
+
+参数：
+- reader: bufio.Reader 包装的网络连接，提供缓冲读取
+
+返回：
+- *Message: 解析出的完整消息
+- error: 错误信息（EOF 表示连接关闭）
+*/
+func Unpack(reader *bufio.Reader) (*Message, error) {
+	// ========== 步骤 1: 读取固定长度的头部 (8 字节) ==========
+	header := make([]byte, HeaderLength)
+	_, err := io.ReadFull(reader, header)
+	if err != nil {
+		// EOF: 对端正常关闭连接
+		// ErrUnexpectedEOF: 读取中途连接断开
+		return nil, err
+	}
+
+	// ========== 步骤 2-3: 解析头部字段，验证消息体长度 ==========
+	msg, bodyLen, err := parseHeader(header)
+	if err != nil {
+		return nil, err
+	}
+
+	// ========== 步骤 4: 读取消息体 ==========
+	if bodyLen > 0 {
+		msg.Body = make([]byte, bodyLen)
+		_, err = io.ReadFull(reader, msg.Body)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// ========== 步骤 5: 解压（见 compress.go）==========
+	if err := finishBody(msg); err != nil {
+		return nil, err
+	}
+
+	return msg, nil
+}
+
+// parseHeader 解析 8 字节头部，返回消息（尚无消息体）和消息体长度
+func parseHeader(header []byte) (*Message, int, error) {
+	msg := &Message{
+		Length:  binary.BigEndian.Uint32(header[0:4]),
+		Version: binary.BigEndian.Uint16(header[4:6]),
+		CmdType: binary.BigEndian.Uint16(header[6:8]),
+	}
+
+	// 安全检查 1: 防止负数长度（可能是协议错误或攻击）
+	if msg.Length < 4 {
+		return nil, 0, ErrInvalidHeader
+	}
+
+	// bodyLen = Length - Version(2) - CmdType(2)
+	// 在 uint32 上相减（已保证不会下溢），比较后再转换为 int，
+	// 32 位平台上 int(0xFFFFFFFF) 不会变成负数绕过检查
+	bodyLen := msg.Length - 4
+
+	// 安全检查 2: 防止恶意大包攻击
+	// 如果不检查，攻击者可以发送 Length=0xFFFFFFFF
+	// 导致服务器尝试分配 4GB 内存，造成 OOM
+	if uint64(bodyLen) > MaxPayloadLength {
+		return nil, 0, ErrPayloadTooLarge
+	}
+
+	// 安全检查 3: 只接受当前协议版本（可带压缩标志）
+	// 未知版本说明对端不兼容或数据流已经错位，继续按本版本解析只会得到垃圾
+	if msg.Version&^FlagDictCompressed != ProtocolVersion {
+		return nil, 0, fmt.Errorf("%w: version %d", ErrInvalidHeader, msg.Version)
+	}
+
+	return msg, int(bodyLen), nil
+}
+
+// finishBody 读完消息体后的处理：按版本标志解压
+func finishBody(msg *Message) error {
+	if msg.Version&FlagDictCompressed == 0 {
+		return nil
+	}
+	msg.Version &^= FlagDictCompressed
+	body, err := decompressBody(msg.Body)
+	if err != nil {
+		return err
+	}
+	msg.Body = body
+	return nil
+}
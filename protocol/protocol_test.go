@@ -0,0 +1,150 @@
+package protocol
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"testing"
+)
+
+func TestFrameLength(t *testing.T) {
+	// 运行时转换：32 位平台上这些长度超出 int，对应用例跳过
+	maxUint32 := uint64(math.MaxUint32)
+	is64 := strconv.IntSize == 64
+
+	tests := []struct {
+		name    string
+		bodyLen int
+		limit   int
+		want    uint32
+		wantErr bool
+		needs64 bool
+	}{
+		{"empty body", 0, MaxPayloadLength, 4, false, false},
+		{"one byte", 1, MaxPayloadLength, 5, false, false},
+		{"exactly max payload", MaxPayloadLength, MaxPayloadLength, MaxPayloadLength + 4, false, false},
+		{"one over max payload", MaxPayloadLength + 1, MaxPayloadLength, 0, true, false},
+		{"negative", -1, MaxPayloadLength, 0, true, false},
+		{"largest length field", int(maxUint32 - 4), math.MaxInt, math.MaxUint32, false, true},
+		{"length field overflow", int(maxUint32 - 3), math.MaxInt, 0, true, true},
+		{"frame overflows int", math.MaxInt - HeaderLength + 1, math.MaxInt, 0, true, false},
+		{"max int", math.MaxInt, math.MaxInt, 0, true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.needs64 && !is64 {
+				t.Skip("length does not fit in a 32-bit int")
+			}
+			got, err := frameLength(tt.bodyLen, tt.limit)
+			if tt.wantErr {
+				if !errors.Is(err, ErrPayloadTooLarge) {
+					t.Fatalf("frameLength(%d) = (%d, %v), want ErrPayloadTooLarge", tt.bodyLen, got, err)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Fatalf("frameLength(%d) = (%d, %v), want %d", tt.bodyLen, got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestPackMaxPayload(t *testing.T) {
+	data, err := Pack(&Message{CmdType: CmdTypeMessage, Body: make([]byte, MaxPayloadLength)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := Unpack(bufio.NewReader(bytes.NewReader(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msg.Body) != MaxPayloadLength {
+		t.Fatalf("body length = %d, want %d", len(msg.Body), MaxPayloadLength)
+	}
+
+	if _, err := Pack(&Message{CmdType: CmdTypeMessage, Body: make([]byte, MaxPayloadLength+1)}); !errors.Is(err, ErrPayloadTooLarge) {
+		t.Fatalf("err = %v, want ErrPayloadTooLarge", err)
+	}
+}
+
+// rawHeader 手工构造头部
+func rawHeader(length uint32, version, cmdType uint16) []byte {
+	h := make([]byte, HeaderLength)
+	binary.BigEndian.PutUint32(h[0:4], length)
+	binary.BigEndian.PutUint16(h[4:6], version)
+	binary.BigEndian.PutUint16(h[6:8], cmdType)
+	return h
+}
+
+func TestParseHeaderLength(t *testing.T) {
+	tests := []struct {
+		name    string
+		length  uint32
+		bodyLen int
+		wantErr error
+	}{
+		{"zero", 0, 0, ErrInvalidHeader},
+		{"smaller than version and cmd type", 3, 0, ErrInvalidHeader},
+		{"empty body", 4, 0, nil},
+		{"max payload", MaxPayloadLength + 4, MaxPayloadLength, nil},
+		{"one over max payload", MaxPayloadLength + 5, 0, ErrPayloadTooLarge},
+		{"max uint32", math.MaxUint32, 0, ErrPayloadTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, bodyLen, err := parseHeader(rawHeader(tt.length, ProtocolVersion, CmdTypeMessage))
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("err = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil || bodyLen != tt.bodyLen {
+				t.Fatalf("parseHeader = (%d, %v), want %d", bodyLen, err, tt.bodyLen)
+			}
+		})
+	}
+}
+
+func TestCmdTypeName(t *testing.T) {
+	tests := []struct {
+		cmdType uint16
+		want    string
+	}{
+		{CmdTypeHeartbeat, "Heartbeat"},
+		{CmdTypeMessage, "Message"},
+		{CmdTypeHealthAck, "HealthAck"},
+		{CmdTypeReconnect, "Reconnect"},
+		{0, "unknown(0)"},
+		{CmdTypeReconnect + 1, fmt.Sprintf("unknown(%d)", CmdTypeReconnect+1)},
+		{math.MaxUint16, "unknown(65535)"},
+	}
+	for _, tt := range tests {
+		if got := CmdTypeName(tt.cmdType); got != tt.want {
+			t.Errorf("CmdTypeName(%d) = %q, want %q", tt.cmdType, got, tt.want)
+		}
+	}
+}
+
+// TestCmdTypeNamesComplete 新增命令类型时必须同时登记名称，名称不能重复
+func TestCmdTypeNamesComplete(t *testing.T) {
+	seen := make(map[string]uint16)
+	for cmdType := uint16(CmdTypeHeartbeat); cmdType <= CmdTypeReconnect; cmdType++ {
+		name, ok := cmdTypeNames[cmdType]
+		if !ok {
+			t.Errorf("command type %d has no name", cmdType)
+			continue
+		}
+		if prev, dup := seen[name]; dup {
+			t.Errorf("command types %d and %d are both named %q", prev, cmdType, name)
+		}
+		seen[name] = cmdType
+	}
+	if len(cmdTypeNames) != len(seen) {
+		t.Errorf("cmdTypeNames has %d entries, want %d", len(cmdTypeNames), len(seen))
+	}
+}
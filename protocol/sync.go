@@ -0,0 +1,133 @@
+/*
+Package protocol - 帧同步标记
+
+=== 失步问题 ===
+
+协议帧没有分隔符，完全依赖 Length 字段确定下一帧的位置。
+客户端或中间代理一旦在流中插入了非协议字节，之后的每个"头部"都是错位的数据：
+
+	[帧1][垃圾字节][帧2]...
+	       ↑ 被当成帧2的头部：Length 非法或巨大 → ErrInvalidHeader / ErrPayloadTooLarge
+
+没有同步标记时无法找到下一帧的起点，只能关闭连接（见 IsDesync）。
+
+=== 同步标记（可选）===
+
+开启后（服务端 -frame-sync，客户端同时开启），客户端发出的每一帧前面多 2 字节标记：
+
+	┌────────────┬──────────────────────────────────┐
+	│ 0xA5 0x5A  │ Length | Version | CmdType | Body │
+	└────────────┴──────────────────────────────────┘
+
+UnpackSynced 跳过标记之前的字节，头部校验（包括 Version 必须为 ProtocolVersion）
+失败时只消费标记本身，下一次从标记之后继续寻找，
+落在消息体中的伪标记不会吞掉真正的帧。
+只有客户端到服务端方向带标记，服务端发出的帧格式不变。
+*/
+package protocol
+
+import (
+	"bufio"
+	"errors"
+	"io"
+)
+
+const (
+	// SyncMarkerLength 同步标记长度
+	SyncMarkerLength = 2
+
+	// MaxSyncScan 寻找一个同步标记时最多跳过的字节数
+	MaxSyncScan = MaxPayloadLength + HeaderLength
+)
+
+// syncMarker 帧同步标记
+var syncMarker = [SyncMarkerLength]byte{0xA5, 0x5A}
+
+// ErrDesync 在 MaxSyncScan 字节内找不到同步标记
+var ErrDesync = errors.New("protocol stream desynchronized")
+
+// IsDesync 读取错误是否说明数据流已失步（头部非法、长度过大或找不到同步标记）
+// 这类错误之后流中的位置不再可信
+func IsDesync(err error) bool {
+	return errors.Is(err, ErrInvalidHeader) || errors.Is(err, ErrPayloadTooLarge) || errors.Is(err, ErrDesync)
+}
+
+// PackSynced 与 Pack 相同，在帧前加上同步标记
+func PackSynced(msg *Message) ([]byte, error) {
+	frame, err := Pack(msg)
+	if err != nil {
+		return nil, err
+	}
+	data := make([]byte, SyncMarkerLength+len(frame))
+	copy(data, syncMarker[:])
+	copy(data[SyncMarkerLength:], frame)
+	return data, nil
+}
+
+// UnpackSynced 读取一个带同步标记的帧，返回帧和标记之前跳过的字节数
+//
+// 头部校验失败时返回 ErrInvalidHeader / ErrPayloadTooLarge，只消费了标记，
+// 可以再次调用以在后面的标记处重新对齐
+func UnpackSynced(reader *bufio.Reader) (*Message, int, error) {
+	skipped, err := seekSyncMarker(reader)
+	if err != nil {
+		return nil, skipped, err
+	}
+
+	// 先 Peek 头部：校验失败时不消费，下一次从这里继续寻找标记
+	header, err := reader.Peek(HeaderLength)
+	if err != nil {
+		return nil, skipped, unexpectedEOF(err)
+	}
+	msg, bodyLen, err := parseHeader(header)
+	if err != nil {
+		return nil, skipped, err
+	}
+	reader.Discard(HeaderLength)
+
+	if bodyLen > 0 {
+		msg.Body = make([]byte, bodyLen)
+		if _, err := io.ReadFull(reader, msg.Body); err != nil {
+			return nil, skipped, err
+		}
+	}
+	if err := finishBody(msg); err != nil {
+		return nil, skipped, err
+	}
+	return msg, skipped, nil
+}
+
+// seekSyncMarker 消费到下一个同步标记之后，返回标记之前跳过的字节数
+func seekSyncMarker(reader *bufio.Reader) (int, error) {
+	skipped := 0
+	for {
+		b, err := reader.ReadByte()
+		if err != nil {
+			if skipped > 0 {
+				err = unexpectedEOF(err)
+			}
+			return skipped, err
+		}
+		if b == syncMarker[0] {
+			next, err := reader.Peek(1)
+			if err != nil {
+				return skipped, unexpectedEOF(err)
+			}
+			if next[0] == syncMarker[1] {
+				reader.Discard(1)
+				return skipped, nil
+			}
+		}
+		if skipped++; skipped > MaxSyncScan {
+			return skipped, ErrDesync
+		}
+	}
+}
+
+// unexpectedEOF 标记之后数据流结束属于帧不完整，而不是在帧边界正常关闭
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
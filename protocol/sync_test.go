@@ -0,0 +1,134 @@
+package protocol
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"testing"
+)
+
+// badSyncedHeader 标记之后跟一个 Length 非法的头部（伪标记）
+var badSyncedHeader = []byte{0xA5, 0x5A, 0, 0, 0, 0, 0, 1, 0, 1}
+
+// mustPackSynced 打包一个带同步标记的帧
+func mustPackSynced(t *testing.T, body string) []byte {
+	t.Helper()
+	data, err := PackSynced(&Message{CmdType: CmdTypeMessage, Body: []byte(body)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// joinBytes 拼接多段字节
+func joinBytes(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
+
+func TestUnpackSyncedSkipsGarbage(t *testing.T) {
+	stream := joinBytes(
+		mustPackSynced(t, "first"),
+		[]byte("garbage\xA5not a marker"),
+		mustPackSynced(t, "second"),
+	)
+	r := bufio.NewReader(bytes.NewReader(stream))
+
+	for _, want := range []struct {
+		body    string
+		skipped int
+	}{
+		{"first", 0},
+		{"second", len("garbage\xA5not a marker")},
+	} {
+		msg, skipped, err := UnpackSynced(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(msg.Body) != want.body || skipped != want.skipped {
+			t.Fatalf("got (%q, skipped %d), want (%q, skipped %d)", msg.Body, skipped, want.body, want.skipped)
+		}
+	}
+
+	// 在帧边界结束是正常关闭
+	if _, _, err := UnpackSynced(r); err != io.EOF {
+		t.Fatalf("err at end of stream = %v, want io.EOF", err)
+	}
+}
+
+func TestUnpackSyncedResyncsAfterFalseMarker(t *testing.T) {
+	stream := joinBytes(badSyncedHeader, mustPackSynced(t, "real"))
+	r := bufio.NewReader(bytes.NewReader(stream))
+
+	// 伪标记后的头部非法：只消费标记，返回失步错误
+	_, _, err := UnpackSynced(r)
+	if !errors.Is(err, ErrInvalidHeader) || !IsDesync(err) {
+		t.Fatalf("err = %v, want ErrInvalidHeader", err)
+	}
+
+	// 再次读取时跳过伪头部，在真正的标记处对齐
+	msg, skipped, err := UnpackSynced(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(msg.Body) != "real" || skipped != len(badSyncedHeader)-SyncMarkerLength {
+		t.Fatalf("got (%q, skipped %d), want (\"real\", skipped %d)", msg.Body, skipped, len(badSyncedHeader)-SyncMarkerLength)
+	}
+}
+
+func TestUnpackSyncedMarkerInsideBody(t *testing.T) {
+	// 消息体中的标记字节不影响分帧
+	stream := joinBytes(mustPackSynced(t, "\xA5\x5A\x00\x00\x00\x10"), mustPackSynced(t, "next"))
+	r := bufio.NewReader(bytes.NewReader(stream))
+	for _, want := range []string{"\xA5\x5A\x00\x00\x00\x10", "next"} {
+		msg, skipped, err := UnpackSynced(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(msg.Body) != want || skipped != 0 {
+			t.Fatalf("got (%q, skipped %d), want (%q, skipped 0)", msg.Body, skipped, want)
+		}
+	}
+}
+
+func TestUnpackSyncedErrors(t *testing.T) {
+	unknownVersion := mustPackSynced(t, "v2")
+	binary.BigEndian.PutUint16(unknownVersion[SyncMarkerLength+4:], ProtocolVersion+1)
+	full := mustPackSynced(t, "truncated body")
+
+	tests := []struct {
+		name   string
+		stream []byte
+		want   error
+	}{
+		{"garbage then eof", []byte("no marker here"), io.ErrUnexpectedEOF},
+		{"marker then eof", []byte{0xA5, 0x5A}, io.ErrUnexpectedEOF},
+		{"half marker then eof", []byte{0xA5}, io.ErrUnexpectedEOF},
+		{"truncated body", full[:len(full)-3], io.ErrUnexpectedEOF},
+		{"unknown version", unknownVersion, ErrInvalidHeader},
+		{"too large", joinBytes([]byte{0xA5, 0x5A}, []byte{0x7f, 0xff, 0xff, 0xff, 0, 1, 0, 1}), ErrPayloadTooLarge},
+		{"no marker within scan limit", make([]byte, MaxSyncScan+1), ErrDesync},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := UnpackSynced(bufio.NewReader(bytes.NewReader(tt.stream)))
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("err = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestUnpackRejectsUnknownVersion(t *testing.T) {
+	for _, version := range []uint16{0, ProtocolVersion + 1, 0x7fff, FlagDictCompressed} {
+		data, err := Pack(&Message{CmdType: CmdTypeMessage, Body: []byte("hello")})
+		if err != nil {
+			t.Fatal(err)
+		}
+		binary.BigEndian.PutUint16(data[4:6], version)
+		if _, err := Unpack(bufio.NewReader(bytes.NewReader(data))); !errors.Is(err, ErrInvalidHeader) {
+			t.Errorf("version %#x: err = %v, want ErrInvalidHeader", version, err)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+/*
+Package server - 连接协程预算
+
+=== 问题 ===
+
+每个连接至少占用两个 Goroutine（读取循环 + 写入循环），开启入站队列时还有一个工作协程。
+连接洪泛、或者大量半开连接（对端已消失但 TCP 没有断开）时，
+Goroutine 数量会一直增长，直到内存耗尽。
+
+=== 预算 ===
+
+SetGoroutineBudget 设置连接相关 Goroutine 的上限：
+
+	已用 / 预算
+	0% ─────────────────── 90% ─────────── 100%
+	      正常接受连接          │ 触发回收       │ 拒绝新连接
+	                           ▼               ▼
+	                    回收空闲连接       直接关闭新 accept 的连接
+
+回收规则（比平时激进）：
+  - 未认证且超过 BudgetReapUnauthenticated 没有任何数据的连接
+  - 超过 BudgetReapIdle 没有任何数据（包括心跳）的连接
+
+回收只关闭连接，Goroutine 随连接退出后释放预算。
+*/
+package server
+
+import (
+	"log"
+	"time"
+)
+
+const (
+	// BudgetReapWatermark 已用预算达到这个百分比时开始回收空闲连接
+	BudgetReapWatermark = 90
+
+	// BudgetReapIdle 回收时，超过这个时间没有任何数据的连接被关闭
+	// 客户端每 30 秒发送一次心跳，两个周期都没有数据视为半开连接
+	BudgetReapIdle = 60 * time.Second
+
+	// BudgetReapUnauthenticated 回收时，未认证连接的空闲上限
+	BudgetReapUnauthenticated = 10 * time.Second
+)
+
+// SetGoroutineBudget 设置连接相关 Goroutine 的上限，<= 0 表示不限制
+func (s *TCPServer) SetGoroutineBudget(budget int) {
+	s.goroutineBudget = int64(budget)
+}
+
+// ConnGoroutines 当前连接相关的 Goroutine 数（读取循环、写入循环、入站工作协程）
+func (s *TCPServer) ConnGoroutines() int64 {
+	return s.connGoroutines.Load()
+}
+
+// goConn 启动一个计入预算的连接 Goroutine
+func (s *TCPServer) goConn(fn func()) {
+	s.connGoroutines.Add(1)
+	go func() {
+		defer s.connGoroutines.Add(-1)
+		fn()
+	}()
+}
+
+// connGoroutineCost 每个连接占用的 Goroutine 数
+func (s *TCPServer) connGoroutineCost() int64 {
+	if s.inboundQueueSize > 0 && s.handler != nil {
+		return 3
+	}
+	return 2
+}
+
+// admitConnection 检查预算是否允许再接受一个连接
+// 接近上限时在后台回收空闲连接，超过上限时返回 false
+func (s *TCPServer) admitConnection() bool {
+	if s.goroutineBudget <= 0 {
+		return true
+	}
+
+	used := s.connGoroutines.Load() + s.connGoroutineCost()
+	if used*100 >= s.goroutineBudget*BudgetReapWatermark && s.reaping.CompareAndSwap(false, true) {
+		go func() {
+			defer s.reaping.Store(false)
+			s.reapIdle()
+		}()
+	}
+	return used <= s.goroutineBudget
+}
+
+// reapIdle 关闭空闲连接，返回关闭的连接数
+func (s *TCPServer) reapIdle() int {
+	reaped := 0
+	s.ConnManager.Range(func(conn *Connection) bool {
+		idle := time.Since(conn.GetLastActive())
+		if idle >= BudgetReapIdle || (!conn.IsAuthenticated() && idle >= BudgetReapUnauthenticated) {
+			conn.Close(CloseReasonIdleReaped)
+			reaped++
+		}
+		return true
+	})
+	if reaped > 0 {
+		log.Printf("[Server] Goroutine budget: reaped %d idle connections (%d goroutines in use)",
+			reaped, s.connGoroutines.Load())
+	}
+	return reaped
+}
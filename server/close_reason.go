@@ -0,0 +1,110 @@
+/*
+Package server - 连接关闭原因
+
+=== 为什么需要关闭原因？===
+
+连接可能因为很多原因关闭：客户端主动断开、读写错误、超时、被踢、服务器关闭……
+原因原本只散落在各处的日志里，断开回调和统计拿不到。
+
+Close(reason) 在关闭前记录原因，只有第一次记录生效：
+
+	写循环: Write 失败 ──▶ Close(CloseReasonWriteError)   ← 记录
+	读循环: Unpack 失败 ─▶ Close(CloseReasonReadError)    ← 已关闭，忽略
+
+之后断开回调（SetOnDisconnect）、统计摘要（ConnStats.CloseReason）和关闭日志
+都通过 Connection.CloseReason() 读取同一个原因。
+*/
+package server
+
+import (
+	"errors"
+	"io"
+	"net"
+
+	"go-im/protocol"
+)
+
+// CloseReason 连接关闭原因
+type CloseReason int32
+
+const (
+	// CloseReasonUnknown 未记录原因（连接尚未关闭）
+	CloseReasonUnknown CloseReason = iota
+
+	// CloseReasonClientEOF 客户端主动断开
+	CloseReasonClientEOF
+
+	// CloseReasonReadError 读取或解析帧失败
+	CloseReasonReadError
+
+	// CloseReasonWriteError 写入失败（包括写超时）
+	CloseReasonWriteError
+
+	// CloseReasonTimeout 读取超时，对端长时间没有任何数据
+	CloseReasonTimeout
+
+	// CloseReasonKicked 被踢下线（踢设备、迁移到其他网关）
+	CloseReasonKicked
+
+	// CloseReasonShutdown 服务器关闭
+	CloseReasonShutdown
+
+	// CloseReasonIdleReaped Goroutine 预算紧张时被回收的空闲连接
+	CloseReasonIdleReaped
+
+	// CloseReasonProtocolError 客户端违反协议（如连续发送未知命令）
+	CloseReasonProtocolError
+
+	// CloseReasonFrameFlood 入站帧速率超过上限（见 framerate.go）
+	CloseReasonFrameFlood
+
+	// CloseReasonTokenInvalid 复查时发现 Token 已过期或被吊销
+	CloseReasonTokenInvalid
+
+	// CloseReasonDesync 数据流失步：头部非法、长度过大，或无法在同步标记处重新对齐（见 framesync.go）
+	CloseReasonDesync
+)
+
+// closeReasonNames 日志和统计中使用的名称
+var closeReasonNames = map[CloseReason]string{
+	CloseReasonUnknown:       "unknown",
+	CloseReasonClientEOF:     "client_eof",
+	CloseReasonReadError:     "read_error",
+	CloseReasonWriteError:    "write_error",
+	CloseReasonTimeout:       "timeout",
+	CloseReasonKicked:        "kicked",
+	CloseReasonShutdown:      "shutdown",
+	CloseReasonIdleReaped:    "idle_reaped",
+	CloseReasonProtocolError: "protocol_error",
+	CloseReasonFrameFlood:    "frame_flood",
+	CloseReasonTokenInvalid:  "token_invalid",
+	CloseReasonDesync:        "protocol_desync",
+}
+
+// String 返回关闭原因的名称
+func (r CloseReason) String() string {
+	if name, ok := closeReasonNames[r]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+// readCloseReason 根据读取错误判断关闭原因
+func readCloseReason(err error) CloseReason {
+	var netErr net.Error
+	switch {
+	case errors.Is(err, io.EOF):
+		return CloseReasonClientEOF
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return CloseReasonTimeout
+	case protocol.IsDesync(err):
+		return CloseReasonDesync
+	default:
+		return CloseReasonReadError
+	}
+}
+
+// CloseReason 连接关闭的原因（尚未关闭时为 CloseReasonUnknown）
+func (c *Connection) CloseReason() CloseReason {
+	return CloseReason(c.closeReason.Load())
+}
@@ -0,0 +1,122 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"testing"
+	"time"
+
+	"go-im/protocol"
+)
+
+func TestReadCloseReason(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want CloseReason
+	}{
+		{"eof", io.EOF, CloseReasonClientEOF},
+		{"wrapped eof", fmt.Errorf("read header: %w", io.EOF), CloseReasonClientEOF},
+		{"eof mid frame", io.ErrUnexpectedEOF, CloseReasonReadError},
+		{"deadline", os.ErrDeadlineExceeded, CloseReasonTimeout},
+		{"invalid header", fmt.Errorf("%w: version 9", protocol.ErrInvalidHeader), CloseReasonDesync},
+		{"payload too large", protocol.ErrPayloadTooLarge, CloseReasonDesync},
+		{"resync failed", protocol.ErrDesync, CloseReasonDesync},
+		{"other", errors.New("connection reset by peer"), CloseReasonReadError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := readCloseReason(tt.err); got != tt.want {
+				t.Fatalf("readCloseReason(%v) = %s, want %s", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCloseReasonNames(t *testing.T) {
+	seen := make(map[string]CloseReason)
+	for r := CloseReasonUnknown; r <= CloseReasonDesync; r++ {
+		name, ok := closeReasonNames[r]
+		if !ok {
+			t.Errorf("close reason %d has no name", r)
+			continue
+		}
+		if prev, dup := seen[name]; dup {
+			t.Errorf("close reasons %d and %d share name %q", prev, r, name)
+		}
+		seen[name] = r
+		if r.String() != name {
+			t.Errorf("CloseReason(%d).String() = %q, want %q", r, r.String(), name)
+		}
+	}
+	if got := CloseReason(-1).String(); got != "unknown" {
+		t.Errorf("invalid reason String() = %q, want unknown", got)
+	}
+}
+
+func TestFirstCloseReasonWins(t *testing.T) {
+	c, _ := newTestConn(t)
+	var atTeardown CloseReason
+	c.SetTeardown(func(conn *Connection) { atTeardown = conn.CloseReason() })
+
+	if got := c.CloseReason(); got != CloseReasonUnknown {
+		t.Fatalf("reason before close = %s, want unknown", got)
+	}
+	c.Close(CloseReasonKicked)
+	c.Close(CloseReasonReadError)
+
+	if got := c.CloseReason(); got != CloseReasonKicked {
+		t.Fatalf("reason = %s, want kicked", got)
+	}
+	if atTeardown != CloseReasonKicked {
+		t.Fatalf("reason seen by teardown = %s, want kicked", atTeardown)
+	}
+	if got := c.Stats().CloseReason; got != "kicked" {
+		t.Fatalf("stats close reason = %q, want kicked", got)
+	}
+}
+
+func TestServerRecordsCloseReason(t *testing.T) {
+	tests := []struct {
+		name  string
+		close func(t *testing.T, c io.WriteCloser)
+		want  CloseReason
+	}{
+		{"client eof", func(t *testing.T, c io.WriteCloser) {
+			c.Close()
+		}, CloseReasonClientEOF},
+		{"desync", func(t *testing.T, c io.WriteCloser) {
+			c.Write(make([]byte, protocol.HeaderLength)) // 全零头部：Length 小于 4
+		}, CloseReasonDesync},
+		{"truncated frame", func(t *testing.T, c io.WriteCloser) {
+			c.Write([]byte{0x00, 0x00})
+			c.Close()
+		}, CloseReasonReadError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reasons := make(chan CloseReason, 1)
+			stats := make(chan *ConnStats, 1)
+			s := startTestServer(t, handlerFunc(func(*Connection, *protocol.Message) {}), func(s *TCPServer) {
+				s.SetOnDisconnect(func(conn *Connection) { reasons <- conn.CloseReason() })
+				s.SetStatsSink(func(st *ConnStats) { stats <- st })
+			})
+			c, _ := dialTestServer(t, s)
+			tt.close(t, c)
+
+			select {
+			case got := <-reasons:
+				if got != tt.want {
+					t.Fatalf("close reason = %s, want %s", got, tt.want)
+				}
+			case <-time.After(2 * time.Second):
+				t.Fatal("connection not closed")
+			}
+			if st := <-stats; st.CloseReason != tt.want.String() {
+				t.Fatalf("stats close reason = %q, want %q", st.CloseReason, tt.want)
+			}
+		})
+	}
+}
@@ -1,363 +1,1109 @@
-/*
-Package server - 连接管理模块
-
-=== 连接抽象的必要性 ===
-
-为什么不直接使用 net.Conn？
-
-1. 需要绑定用户信息（UserID）
-2. 需要实现异步写入（避免写入阻塞读取）
-3. 需要连接状态管理（活跃时间、关闭状态）
-4. 需要全局连接查找（根据 UserID 找到 Connection）
-
-=== 读写分离架构 ===
-
-每个连接有两个 Goroutine：
-
-	┌──────────────────────────────────────┐
-	│            Connection                 │
-	│                                      │
-	│   ┌─────────┐      ┌─────────┐      │
-	│   │ 读协程  │      │ 写协程  │      │
-	│   │readLoop │      │writeLoop│      │
-	│   └────┬────┘      └────▲────┘      │
-	│        │                │           │
-	│        ▼                │           │
-	│   ┌─────────────────────────┐       │
-	│   │      writeChan          │       │
-	│   │   (带缓冲的通道)         │       │
-	│   └─────────────────────────┘       │
-	└──────────────────────────────────────┘
-
-为什么要读写分离？
-- 避免写入阻塞读取（网络慢时写入可能阻塞）
-- 异步发送，提高吞吐量
-- 通过通道安全地在 Goroutine 间传递数据
-*/
-package server
-
-import (
-	"bufio"
-	"go-im/protocol"
-	"log"
-	"net"
-	"sync"
-	"time"
-)
-
-// ==================== 连接结构体 ====================
-
-// Connection 表示一个客户端连接
-// 封装了 net.Conn，提供更高级的功能
-type Connection struct {
-	// ID 连接唯一标识，由服务器分配
-	ID uint64
-
-	// UserID 绑定的用户 ID
-	// 用户认证后会设置这个字段
-	// 消息路由时通过 UserID 找到对应的 Connection
-	UserID string
-
-	// Conn 底层的 TCP 连接
-	Conn net.Conn
-
-	// reader 带缓冲的读取器
-	// bufio.Reader 减少系统调用，提高读取效率
-	reader *bufio.Reader
-
-	// writeChan 写入通道（带缓冲）
-	// 发送消息时先放入通道，由 writeLoop 实际发送
-	// 缓冲大小 256：允许短时间内积累一定数量的消息
-	writeChan chan []byte
-
-	// closeChan 关闭信号通道
-	// close(closeChan) 会通知所有监听者连接已关闭
-	closeChan chan struct{}
-
-	// closeOnce 确保只关闭一次
-	// 防止多次调用 Close() 导致 panic
-	closeOnce sync.Once
-
-	// lastActive 最后活跃时间
-	// 用于心跳检测和空闲连接清理
-	lastActive time.Time
-
-	// mu 读写锁，保护共享字段
-	mu sync.RWMutex
-}
-
-// ==================== 构造函数 ====================
-
-// NewConnection 创建新的连接包装器
-func NewConnection(id uint64, conn net.Conn) *Connection {
-	return &Connection{
-		ID:         id,
-		Conn:       conn,
-		reader:     bufio.NewReader(conn),
-		writeChan:  make(chan []byte, 256), // 带缓冲通道
-		closeChan:  make(chan struct{}),    // 无缓冲，用于广播信号
-		lastActive: time.Now(),
-	}
-}
-
-// ==================== 读写循环 ====================
-
-// Start 启动读写循环
-// handler: 消息处理回调函数
-func (c *Connection) Start(handler func(*Connection, *protocol.Message)) {
-	go c.readLoop(handler)
-	go c.writeLoop()
-}
-
-// readLoop 读取循环
-// 持续从连接读取消息，调用 handler 处理
-// 注意：当前实现中，tcp_server.go 直接在 handleConnection 中读取
-//
-//	这个方法是备用的更优雅的实现
-func (c *Connection) readLoop(handler func(*Connection, *protocol.Message)) {
-	defer c.Close()
-
-	for {
-		// 检查关闭信号
-		select {
-		case <-c.closeChan:
-			return
-		default:
-		}
-
-		// 设置读取超时
-		// 90秒内没有数据（包括心跳）则认为连接死亡
-		c.Conn.SetReadDeadline(time.Now().Add(90 * time.Second))
-
-		// 读取消息
-		msg, err := protocol.Unpack(c.reader)
-		if err != nil {
-			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
-				log.Printf("[Conn-%d] Read timeout, closing connection", c.ID)
-			} else if err.Error() != "EOF" {
-				log.Printf("[Conn-%d] Read error: %v", c.ID, err)
-			}
-			return
-		}
-
-		// 更新活跃时间
-		c.updateLastActive()
-
-		// 调用处理器
-		handler(c, msg)
-	}
-}
-
-// writeLoop 写入循环
-// 从 writeChan 读取数据并发送到网络
-//
-// 为什么用单独的协程写入？
-// 1. 解耦：发送方不需要等待网络 I/O
-// 2. 性能：可以批量发送缓冲区中的数据
-// 3. 安全：通道保证了并发安全
-func (c *Connection) writeLoop() {
-	defer c.Close()
-
-	for {
-		select {
-		case <-c.closeChan:
-			// 连接关闭，退出循环
-			return
-
-		case data := <-c.writeChan:
-			// 设置写入超时，防止网络阻塞
-			c.Conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
-
-			// 实际写入网络
-			if _, err := c.Conn.Write(data); err != nil {
-				log.Printf("[Conn-%d] Write error: %v", c.ID, err)
-				return
-			}
-		}
-	}
-}
-
-// ==================== 发送消息 ====================
-
-// Send 发送消息（异步）
-// 消息会被放入 writeChan，由 writeLoop 实际发送
-//
-// 返回值：
-//   - nil: 消息已放入队列（不代表已发送成功）
-//   - error: 连接已关闭或通道已满
-func (c *Connection) Send(msg *protocol.Message) error {
-	// 序列化消息
-	data, err := protocol.Pack(msg)
-	if err != nil {
-		return err
-	}
-
-	// 非阻塞发送
-	select {
-	case c.writeChan <- data:
-		// 成功放入通道
-		return nil
-
-	case <-c.closeChan:
-		// 连接已关闭
-		return net.ErrClosed
-
-	default:
-		// 通道已满，说明客户端处理不过来
-		// 这里选择丢弃消息而不是阻塞
-		// 在生产环境可能需要更复杂的处理（如：断开连接）
-		log.Printf("[Conn-%d] Write channel full, dropping message", c.ID)
-		return nil
-	}
-}
-
-// ==================== 连接生命周期 ====================
-
-// Close 关闭连接
-// 使用 sync.Once 保证只执行一次
-func (c *Connection) Close() {
-	c.closeOnce.Do(func() {
-		// 关闭信号通道，通知所有监听者
-		close(c.closeChan)
-		// 关闭底层连接
-		c.Conn.Close()
-	})
-}
-
-// IsClosed 检查连接是否已关闭
-func (c *Connection) IsClosed() bool {
-	select {
-	case <-c.closeChan:
-		return true
-	default:
-		return false
-	}
-}
-
-// ==================== 活跃时间管理 ====================
-
-// updateLastActive 更新最后活跃时间
-func (c *Connection) updateLastActive() {
-	c.mu.Lock()
-	c.lastActive = time.Now()
-	c.mu.Unlock()
-}
-
-// GetLastActive 获取最后活跃时间
-func (c *Connection) GetLastActive() time.Time {
-	c.mu.RLock()
-	defer c.mu.RUnlock()
-	return c.lastActive
-}
-
-// ==================== 用户绑定 ====================
-
-// SetUserID 绑定用户 ID
-// 在用户认证成功后调用
-func (c *Connection) SetUserID(uid string) {
-	c.mu.Lock()
-	c.UserID = uid
-	c.mu.Unlock()
-}
-
-// GetUserID 获取用户 ID
-func (c *Connection) GetUserID() string {
-	c.mu.RLock()
-	defer c.mu.RUnlock()
-	return c.UserID
-}
-
-// ==================================================================
-// ConnectionManager - 连接管理器
-// ==================================================================
-
-/*
-ConnectionManager 管理所有活跃连接
-
-核心数据结构：
-
- 1. connections: ConnID → Connection
-    用于按连接 ID 查找
-
- 2. userConns: UserID → Connection
-    用于消息路由（根据用户 ID 找到其连接）
-
-为什么用 sync.Map 而不是 map + mutex？
-- sync.Map 对读多写少的场景优化
-- 连接查找（读）远多于连接建立/断开（写）
-- 内置并发安全，代码更简洁
-*/
-type ConnectionManager struct {
-	// connections 连接 ID → 连接对象
-	connections sync.Map
-
-	// userConns 用户 ID → 连接对象
-	// 用于消息路由：知道用户 ID，需要找到其连接
-	userConns sync.Map
-}
-
-// NewConnectionManager 创建连接管理器
-func NewConnectionManager() *ConnectionManager {
-	return &ConnectionManager{}
-}
-
-// Add 添加连接
-func (m *ConnectionManager) Add(conn *Connection) {
-	m.connections.Store(conn.ID, conn)
-}
-
-// Remove 移除连接
-func (m *ConnectionManager) Remove(conn *Connection) {
-	// 从连接表中移除
-	m.connections.Delete(conn.ID)
-
-	// 如果已绑定用户，也要从用户表中移除
-	if uid := conn.GetUserID(); uid != "" {
-		m.userConns.Delete(uid)
-	}
-}
-
-// BindUser 绑定用户到连接
-// 在用户认证成功后调用
-// 这使得后续可以通过 UserID 快速找到连接
-func (m *ConnectionManager) BindUser(uid string, conn *Connection) {
-	conn.SetUserID(uid)
-	m.userConns.Store(uid, conn)
-}
-
-// GetByUserID 根据用户 ID 获取连接
-// 这是消息路由的核心：知道要发送给谁，找到他的连接
-func (m *ConnectionManager) GetByUserID(uid string) *Connection {
-	if v, ok := m.userConns.Load(uid); ok {
-		return v.(*Connection)
-	}
-	return nil
-}
-
-// GetByConnID 根据连接 ID 获取连接
-func (m *ConnectionManager) GetByConnID(id uint64) *Connection {
-	if v, ok := m.connections.Load(id); ok {
-		return v.(*Connection)
-	}
-	return nil
-}
-
-// Count 获取当前连接数
-func (m *ConnectionManager) Count() int {
-	count := 0
-	m.connections.Range(func(_, _ interface{}) bool {
-		count++
-		return true
-	})
-	return count
-}
-
-// Broadcast 广播消息给所有连接
-// 用于系统公告等场景
-func (m *ConnectionManager) Broadcast(msg *protocol.Message) {
-	m.connections.Range(func(_, v interface{}) bool {
-		conn := v.(*Connection)
-		conn.Send(msg)
-		return true
-	})
-}
+/*
+Package server - 连接管理模块
+
+=== 连接抽象的必要性 ===
+
+为什么不直接使用 net.Conn？
+
+1. 需要绑定用户信息（UserID）
+2. 需要实现异步写入（避免写入阻塞读取）
+3. 需要连接状态管理（活跃时间、关闭状态）
+4. 需要全局连接查找（根据 UserID 找到 Connection）
+
+=== 读写分离架构 ===
+
+每个连接有两个 Goroutine：
+
+	┌──────────────────────────────────────┐
+	│            Connection                 │
+	│                                      │
+	│   ┌─────────┐      ┌─────────┐      │
+	│   │ 读协程  │      │ 写协程  │      │
+	│   │readLoop │      │writeLoop│      │
+	│   └────┬────┘      └────▲────┘      │
+	│        │                │           │
+	│        ▼                │           │
+	│   ┌─────────────────────────┐       │
+	│   │      writeChan          │       │
+	│   │   (带缓冲的通道)         │       │
+	│   └─────────────────────────┘       │
+	└──────────────────────────────────────┘
+
+为什么要读写分离？
+- 避免写入阻塞读取（网络慢时写入可能阻塞）
+- 异步发送，提高吞吐量
+- 通过通道安全地在 Goroutine 间传递数据
+*/
+package server
+
+import (
+	"bufio"
+	"errors"
+	"go-im/protocol"
+	"log"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ==================== 出站拦截器 ====================
+
+// OutboundInterceptor 出站帧拦截器
+//
+// writeLoop 在写入网络前对每一帧调用拦截器：
+//   - 观察：原样返回 (frame, true)
+//   - 延迟：在拦截器内 sleep 后返回（会阻塞该连接后续所有帧，用于流量整形）
+//   - 修改：返回新的帧数据
+//   - 丢弃：返回 (nil, false)，该帧不会写入网络
+//
+// 主要用于故障注入测试（模拟丢包）和流量整形
+type OutboundInterceptor func(c *Connection, frame []byte) ([]byte, bool)
+
+// ErrWriteQueueFull 写队列已满，消息被丢弃（客户端处理不过来）
+var ErrWriteQueueFull = errors.New("write queue full")
+
+// ==================== 写超时配置 ====================
+
+var (
+	// WriteTimeoutBase 写超时基础值
+	WriteTimeoutBase = 5 * time.Second
+
+	// WriteTimeoutPerKB 每 KB 数据额外给予的写入时间
+	// 50ms/KB 约等于按 20KB/s 的慢速链路估算
+	WriteTimeoutPerKB = 50 * time.Millisecond
+
+	// WriteTimeoutMin / WriteTimeoutMax 写超时的上下限
+	WriteTimeoutMin = 2 * time.Second
+	WriteTimeoutMax = 60 * time.Second
+)
+
+// writeTimeout 根据帧大小计算写超时
+//
+// 固定超时的问题：
+// - 大帧（如媒体元数据）在慢速链路上可能还没写完就超时
+// - 小帧（心跳）却拿到了过于宽松的超时，死连接发现得慢
+//
+// 计算方式：base + 帧大小 × 每字节配额，并限制在 [min, max] 之间
+func writeTimeout(frameLen int) time.Duration {
+	d := WriteTimeoutBase + time.Duration(frameLen)*WriteTimeoutPerKB/1024
+	if d < WriteTimeoutMin {
+		return WriteTimeoutMin
+	}
+	if d > WriteTimeoutMax {
+		return WriteTimeoutMax
+	}
+	return d
+}
+
+// ==================== 认证状态 ====================
+
+// AuthState 连接的认证状态
+//
+//	Unauthenticated ──Auth 请求──▶ Authenticating ──校验通过──▶ Authenticated
+//	       ▲                             │
+//	       └────────校验失败──────────────┘
+type AuthState int32
+
+const (
+	// AuthStateUnauthenticated 未认证（新连接的初始状态）
+	AuthStateUnauthenticated AuthState = iota
+
+	// AuthStateAuthenticating 认证中（已收到 Auth 请求，正在校验）
+	// 这个中间状态防止同一连接并发提交多个 Auth 请求
+	AuthStateAuthenticating
+
+	// AuthStateAuthenticated 已认证
+	AuthStateAuthenticated
+)
+
+// ==================== 连接结构体 ====================
+
+// Connection 表示一个客户端连接
+// 封装了 net.Conn，提供更高级的功能
+type Connection struct {
+	// ID 连接唯一标识，由服务器分配
+	ID uint64
+
+	// UserID 绑定的用户 ID
+	// 用户认证后会设置这个字段
+	// 消息路由时通过 UserID 找到对应的 Connection
+	UserID string
+
+	// username 用户名（来自认证 Token，用于展示）
+	username string
+
+	// authTime 认证成功的时间
+	authTime time.Time
+
+	// credential 认证使用的凭据（如 Token 声明），用于定期复查（见 SetCredential）
+	credential interface{}
+
+	// deviceID 设备 ID（认证时由客户端上报，见 SetDeviceID）
+	deviceID string
+
+	// resumeID 可恢复会话 ID（客户端请求时由上层签发，见 SetResumeID）
+	resumeID string
+
+	// unknownCommands 收到的未知命令数（见 CountUnknownCommand）
+	unknownCommands int
+
+	// stats 流量统计（见 stats.go）
+	stats connStats
+
+	// Conn 底层的 TCP 连接
+	Conn net.Conn
+
+	// realAddr 真实客户端地址（来自 PROXY 协议头）
+	// 为 nil 时使用 Conn.RemoteAddr()
+	realAddr net.Addr
+
+	// reader 带缓冲的读取器
+	// bufio.Reader 减少系统调用，提高读取效率
+	reader *bufio.Reader
+
+	// writeChan 写入通道（带缓冲）
+	// 发送消息时先放入通道，由 writeLoop 实际发送
+	// 缓冲大小 256：允许短时间内积累一定数量的消息
+	writeChan chan []byte
+
+	// writeLock 写锁（容量为 1 的通道，可以带超时获取）
+	// writeLoop 与控制帧直写（见 control.go）互斥，保证帧不会交错
+	writeLock chan struct{}
+
+	// closeChan 关闭信号通道
+	// close(closeChan) 会通知所有监听者连接已关闭
+	closeChan chan struct{}
+
+	// closeOnce 确保只关闭一次
+	// 防止多次调用 Close() 导致 panic
+	closeOnce sync.Once
+
+	// closeReason 关闭原因（CloseReason），第一次 Close 时记录
+	closeReason atomic.Int32
+
+	// teardown 连接关闭时的清理函数（见 SetTeardown）
+	teardown func(*Connection)
+
+	// lastActive 最后活跃时间
+	// 用于心跳检测和空闲连接清理
+	lastActive time.Time
+
+	// lastActivity 最后一次业务请求的时间（不含心跳），用于判断用户是否离开
+	lastActivity time.Time
+
+	// away 是否因空闲被自动标记为"离开"
+	away bool
+
+	// paused 客户端是否暂停了实时推送（见 SetPaused）
+	paused bool
+
+	// inFlight 已投递但尚未 ACK 的消息（SeqID → 消息）
+	// 用于流控：客户端只读不 ACK 时限制继续推送
+	// SeqID 只在会话内唯一，同一 SeqID 下的消息用 ID 区分（见 InFlightRef）
+	// 只存在于连接上、不在离线盒子里的消息会带上消息本身（见 PendingUnacked），
+	// 已在离线盒子中的消息记为 nil，仅占用名额
+	inFlight map[int64][]inFlightEntry
+
+	// inFlightCount 在途消息总数
+	inFlightCount int
+
+	// redeliveries 客户端 NACK 触发的重投次数（SeqID → 次数），确认后清除
+	redeliveries map[int64]int
+
+	// clientSeqs 客户端自带的发送计数，每个会话最后接受的值（见 AdvanceClientSeq）
+	clientSeqs map[string]int64
+
+	// throttled 是否因在途消息过多而暂停了实时推送
+	// 暂停期间的消息进入离线盒子，ACK 后恢复
+	throttled bool
+
+	// sendCredits 客户端剩余的发送额度（基于额度的上行流控）
+	sendCredits int
+
+	// creditsConsumed 自上次补充以来消耗的额度
+	creditsConsumed int
+
+	// ackedSeq 本连接已累积确认的最大 SeqID（hasAcked 为 false 时无效）
+	// 用于在内存中过滤重复/回退的 ACK，省去一次 Redis 往返
+	ackedSeq int64
+	hasAcked bool
+
+	// sentSeq 本连接投递过的最大 SeqID
+	// ACK 不能超过它，否则客户端可以用一个很大的 SeqID 清空整个离线盒子
+	sentSeq int64
+
+	// interceptor 出站帧拦截器（为 nil 时不做任何额外处理）
+	interceptor atomic.Pointer[OutboundInterceptor]
+
+	// compress 下发帧是否使用预置字典压缩（认证时协商）
+	compress atomic.Bool
+
+	// tracing 是否输出每一帧的追踪日志（见 trace.go）
+	tracing atomic.Bool
+
+	// authState 认证状态（原子操作，见 AuthState）
+	authState atomic.Int32
+
+	// mu 读写锁，保护共享字段
+	mu sync.RWMutex
+}
+
+// ==================== 构造函数 ====================
+
+// NewConnection 创建新的连接包装器
+func NewConnection(id uint64, conn net.Conn) *Connection {
+	return &Connection{
+		ID:         id,
+		Conn:       conn,
+		reader:     bufio.NewReader(conn),
+		writeChan:  make(chan []byte, 256), // 带缓冲通道
+		writeLock:  make(chan struct{}, 1),
+		closeChan:  make(chan struct{}), // 无缓冲，用于广播信号
+		lastActive: time.Now(),
+		inFlight:   make(map[int64][]inFlightEntry),
+
+		lastActivity: time.Now(),
+		stats:        connStats{connectedAt: time.Now()},
+	}
+}
+
+// ==================== 读写循环 ====================
+
+// Start 启动读写循环
+// handler: 消息处理回调函数
+func (c *Connection) Start(handler func(*Connection, *protocol.Message)) {
+	go c.readLoop(handler)
+	go c.writeLoop()
+}
+
+// readLoop 读取循环
+// 持续从连接读取消息，调用 handler 处理
+// 注意：当前实现中，tcp_server.go 直接在 handleConnection 中读取
+//
+//	这个方法是备用的更优雅的实现
+func (c *Connection) readLoop(handler func(*Connection, *protocol.Message)) {
+	reason := CloseReasonUnknown
+	defer func() { c.Close(reason) }()
+
+	for {
+		// 检查关闭信号
+		select {
+		case <-c.closeChan:
+			return
+		default:
+		}
+
+		// 设置读取超时
+		// 90秒内没有数据（包括心跳）则认为连接死亡
+		c.Conn.SetReadDeadline(time.Now().Add(90 * time.Second))
+
+		// 读取消息
+		msg, err := protocol.Unpack(c.reader)
+		if err != nil {
+			reason = readCloseReason(err)
+			if reason == CloseReasonTimeout {
+				log.Printf("[Conn-%d] Read timeout, closing connection", c.ID)
+			} else if reason == CloseReasonReadError || reason == CloseReasonDesync {
+				log.Printf("[Conn-%d] Read error: %v", c.ID, err)
+			}
+			return
+		}
+
+		// 更新活跃时间
+		c.updateLastActive()
+		c.recordInbound(msg)
+
+		// 调用处理器
+		handler(c, msg)
+	}
+}
+
+// writeLoop 写入循环
+// 从 writeChan 读取数据并发送到网络
+//
+// 为什么用单独的协程写入？
+// 1. 解耦：发送方不需要等待网络 I/O
+// 2. 性能：可以批量发送缓冲区中的数据
+// 3. 安全：通道保证了并发安全
+func (c *Connection) writeLoop() {
+	reason := CloseReasonUnknown
+	defer func() { c.Close(reason) }()
+
+	for {
+		select {
+		case <-c.closeChan:
+			// 连接关闭，退出循环
+			return
+
+		case data := <-c.writeChan:
+			// 出站拦截器（未设置时只有一次原子读取）
+			if fn := c.interceptor.Load(); fn != nil {
+				var ok bool
+				if data, ok = (*fn)(c, data); !ok {
+					continue
+				}
+			}
+
+			// 实际写入网络（持有写锁，与控制帧直写互斥，见 control.go）
+			// 超时随帧大小增长，大帧有更多时间写完
+			if err := c.writeFrame(data); err != nil {
+				log.Printf("[Conn-%d] Write error: %v", c.ID, err)
+				reason = CloseReasonWriteError
+				return
+			}
+		}
+	}
+}
+
+// SetOutboundInterceptor 设置出站帧拦截器，传 nil 取消
+// 可以在连接运行期间随时设置，对之后写出的帧生效
+func (c *Connection) SetOutboundInterceptor(fn OutboundInterceptor) {
+	if fn == nil {
+		c.interceptor.Store(nil)
+		return
+	}
+	c.interceptor.Store(&fn)
+}
+
+// ==================== 发送消息 ====================
+
+// Send 发送消息（异步）
+// 消息会被放入 writeChan，由 writeLoop 实际发送
+//
+// 返回值：
+//   - nil: 消息已放入队列（不代表已发送成功）
+//   - net.ErrClosed: 连接已关闭
+//   - ErrWriteQueueFull: 通道已满，消息被丢弃（控制帧使用 SendControl）
+//   - 其他: 打包失败（如消息体超过 MaxPayloadLength）
+func (c *Connection) Send(msg *protocol.Message) error {
+	data, err := c.pack(msg)
+	if err != nil {
+		return err
+	}
+	return c.sendFrame(data)
+}
+
+// pack 序列化发往该连接的消息（协商了字典压缩的连接尝试压缩）
+func (c *Connection) pack(msg *protocol.Message) ([]byte, error) {
+	if c.compress.Load() {
+		return protocol.PackCompressed(msg)
+	}
+	return protocol.Pack(msg)
+}
+
+// SetCompression 开启或关闭发往该连接的帧的字典压缩
+// 只能在客户端协商接受后开启（见 protocol.CompressionDictV1）
+func (c *Connection) SetCompression(enabled bool) {
+	c.compress.Store(enabled)
+}
+
+// sendFrame 将已打包的帧放入写队列（非阻塞）
+func (c *Connection) sendFrame(data []byte) error {
+	// select 在多个分支同时就绪时随机选择：先检查关闭，保证关闭之后的发送一定失败
+	if c.IsClosed() {
+		return net.ErrClosed
+	}
+	select {
+	case c.writeChan <- data:
+		// 成功放入通道
+		c.recordQueueDepth(len(c.writeChan))
+		return nil
+
+	case <-c.closeChan:
+		// 连接已关闭
+		return net.ErrClosed
+
+	default:
+		// 通道已满，说明客户端处理不过来
+		// 这里选择丢弃消息而不是阻塞
+		// 在生产环境可能需要更复杂的处理（如：断开连接）
+		log.Printf("[Conn-%d] Write channel full, dropping message", c.ID)
+		c.stats.dropped.Add(1)
+		return ErrWriteQueueFull
+	}
+}
+
+// ==================== 连接生命周期 ====================
+
+// SetTeardown 设置连接关闭时的清理函数
+//
+// 无论是读循环、写循环还是服务器主动关闭，谁先调用 Close，
+// 清理函数都只执行一次，且顺序固定：
+//  1. 关闭 closeChan（之后的 Send 立即失败）
+//  2. 执行清理函数（从 ConnectionManager 移除、登出会话等）
+//  3. 关闭底层连接
+//
+// 清理函数在 Close 内部执行，不能再调用 Close（sync.Once 会死锁）
+func (c *Connection) SetTeardown(fn func(*Connection)) {
+	c.teardown = fn
+}
+
+// Close 关闭连接，并记录关闭原因（见 close_reason.go）
+// 使用 sync.Once 保证只执行一次，只有第一次调用的原因生效
+func (c *Connection) Close(reason CloseReason) {
+	c.closeReason.CompareAndSwap(int32(CloseReasonUnknown), int32(reason))
+	c.closeOnce.Do(func() {
+		// 关闭信号通道，通知所有监听者
+		close(c.closeChan)
+		// 统一清理（移除、登出），与是哪个循环发现的错误无关
+		if c.teardown != nil {
+			c.teardown(c)
+		}
+		// 关闭底层连接
+		c.Conn.Close()
+	})
+}
+
+// Done 返回连接关闭时被关闭的通道，用于在 select 中等待连接关闭
+func (c *Connection) Done() <-chan struct{} {
+	return c.closeChan
+}
+
+// IsClosed 检查连接是否已关闭
+func (c *Connection) IsClosed() bool {
+	select {
+	case <-c.closeChan:
+		return true
+	default:
+		return false
+	}
+}
+
+// ==================== 活跃时间管理 ====================
+
+// updateLastActive 更新最后活跃时间
+func (c *Connection) updateLastActive() {
+	c.mu.Lock()
+	c.lastActive = time.Now()
+	c.mu.Unlock()
+}
+
+// GetLastActive 获取最后活跃时间
+func (c *Connection) GetLastActive() time.Time {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.lastActive
+}
+
+// TouchActivity 记录一次业务请求（心跳不算）
+// 返回 true 表示连接此前被自动标记为离开，调用方应恢复在线状态
+func (c *Connection) TouchActivity() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.lastActivity = time.Now()
+	wasAway := c.away
+	c.away = false
+	return wasAway
+}
+
+// MarkAwayIfIdle 超过 idle 没有业务请求时标记为离开
+// 返回 true 表示本次新标记，调用方应更新在线状态
+func (c *Connection) MarkAwayIfIdle(idle time.Duration) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.away || time.Since(c.lastActivity) < idle {
+		return false
+	}
+	c.away = true
+	return true
+}
+
+// ==================== 暂停推送 ====================
+
+// SetPaused 设置连接是否暂停实时推送
+//
+// 客户端进入后台时暂停，发给该连接的消息改存离线盒子，回到前台时恢复并拉取积压
+// 返回 true 表示状态发生了变化
+func (c *Connection) SetPaused(paused bool) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	changed := c.paused != paused
+	c.paused = paused
+	return changed
+}
+
+// IsPaused 连接是否暂停了实时推送
+func (c *Connection) IsPaused() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.paused
+}
+
+// ==================== 在途消息流控 ====================
+
+// InFlightRef 一条在途消息的标识
+// SeqID 只在会话内唯一，ID 区分 SeqID 相同的不同消息（业务层的消息 ID）
+type InFlightRef struct {
+	SeqID int64
+	ID    string
+}
+
+// inFlightEntry 在途消息：ID 和只存在于连接上的消息本身（见 ReserveInFlight）
+type inFlightEntry struct {
+	id      string
+	pending interface{}
+}
+
+// ReserveInFlight 为一条即将投递的消息占用在途名额
+//
+// limit <= 0 表示不限制
+// id 区分 SeqID 相同的不同消息，选择性确认按它释放（见 ReleaseInFlightRefs）
+// pending 为消息本身（仅在消息不在离线盒子中时传入，否则传 nil），
+// ACK 之前可以通过 PendingUnacked 取回
+// 返回 false 表示已达上限，调用方应改为离线存储，
+// 同时连接被标记为暂停状态，等待 ACK 释放名额后恢复
+func (c *Connection) ReserveInFlight(seqID int64, id string, limit int, pending interface{}) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if limit > 0 && c.inFlightCount >= limit {
+		c.throttled = true
+		return false
+	}
+	c.inFlight[seqID] = append(c.inFlight[seqID], inFlightEntry{id: id, pending: pending})
+	c.inFlightCount++
+	if seqID > c.sentSeq {
+		c.sentSeq = seqID
+	}
+	return true
+}
+
+// MaxSentSeq 本连接投递过的最大 SeqID（还没有投递过消息时为 0）
+// 投递过的消息都经过 ReserveInFlight，确认位置不应超过它
+func (c *Connection) MaxSentSeq() int64 {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.sentSeq
+}
+
+// ReleaseInFlight 释放 SeqID <= ackSeq 的在途消息
+//
+// ACK 是累积确认，与 OfflineManager.Remove 语义一致
+// 返回 true 表示连接此前处于暂停状态且现已回落到上限以下，
+// 调用方应恢复投递（例如推送暂停期间积压的离线消息）
+func (c *Connection) ReleaseInFlight(ackSeq int64, limit int) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for seq, pending := range c.inFlight {
+		if seq <= ackSeq {
+			c.inFlightCount -= len(pending)
+			delete(c.inFlight, seq)
+		}
+	}
+	for seq := range c.redeliveries {
+		if seq <= ackSeq {
+			delete(c.redeliveries, seq)
+		}
+	}
+
+	return c.checkResume(limit)
+}
+
+// ReleaseInFlightRefs 只释放指定的在途消息（选择性确认、投递失败）
+// SeqID 相同的其他消息（其他会话）不受影响
+// 返回值含义同 ReleaseInFlight
+func (c *Connection) ReleaseInFlightRefs(refs []InFlightRef, limit int) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, ref := range refs {
+		entries := c.inFlight[ref.SeqID]
+		for i, e := range entries {
+			if e.id == ref.ID {
+				entries = append(entries[:i], entries[i+1:]...)
+				c.inFlightCount--
+				break
+			}
+		}
+		if len(entries) > 0 {
+			c.inFlight[ref.SeqID] = entries
+			continue
+		}
+		delete(c.inFlight, ref.SeqID)
+		delete(c.redeliveries, ref.SeqID)
+	}
+
+	return c.checkResume(limit)
+}
+
+// IsInFlight 消息是否已投递且尚未确认
+// 恢复投递时据此跳过仍在途的消息，避免重复推送并重复占用名额
+func (c *Connection) IsInFlight(ref InFlightRef) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	for _, e := range c.inFlight[ref.SeqID] {
+		if e.id == ref.ID {
+			return true
+		}
+	}
+	return false
+}
+
+// checkResume 检查暂停的连接是否可以恢复投递
+// 调用方必须持有 c.mu
+func (c *Connection) checkResume(limit int) bool {
+	if c.throttled && (limit <= 0 || c.inFlightCount < limit) {
+		c.throttled = false
+		return true
+	}
+	return false
+}
+
+// AdvanceAck 尝试推进累积确认位置
+//
+// 返回 false 表示 seqID 不大于已确认的最大值（客户端重传或乱序到达的旧 ACK），
+// 累积删除已经覆盖了它，调用方可以直接忽略
+func (c *Connection) AdvanceAck(seqID int64) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.hasAcked && seqID <= c.ackedSeq {
+		return false
+	}
+	c.ackedSeq = seqID
+	c.hasAcked = true
+	return true
+}
+
+// PendingUnacked 按 SeqID 顺序返回已投递未确认、且只存在于连接上的消息
+// 用于关闭时把这些消息放回离线盒子，重连后重新投递
+func (c *Connection) PendingUnacked() []interface{} {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	seqs := make([]int64, 0, len(c.inFlight))
+	for seq := range c.inFlight {
+		seqs = append(seqs, seq)
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+
+	var pending []interface{}
+	for _, seq := range seqs {
+		for _, e := range c.inFlight[seq] {
+			if e.pending != nil {
+				pending = append(pending, e.pending)
+			}
+		}
+	}
+	return pending
+}
+
+// PendingBySeq 返回指定 SeqID 已投递未确认、且只存在于连接上的消息
+func (c *Connection) PendingBySeq(seqID int64) []interface{} {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	var pending []interface{}
+	for _, e := range c.inFlight[seqID] {
+		if e.pending != nil {
+			pending = append(pending, e.pending)
+		}
+	}
+	return pending
+}
+
+// CountRedelivery 记录一次 SeqID 的重投，返回该 SeqID 在本连接上的累计重投次数
+// 次数在该 SeqID 被确认后清零
+func (c *Connection) CountRedelivery(seqID int64) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.redeliveries == nil {
+		c.redeliveries = make(map[int64]int)
+	}
+	c.redeliveries[seqID]++
+	return c.redeliveries[seqID]
+}
+
+// InFlightCount 获取在途（已投递未确认）消息数
+func (c *Connection) InFlightCount() int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.inFlightCount
+}
+
+// ==================== 上行发送额度 ====================
+
+// GrantCredits 授予客户端发送额度（认证成功时调用）
+func (c *Connection) GrantCredits(n int) {
+	c.mu.Lock()
+	c.sendCredits = n
+	c.creditsConsumed = 0
+	c.mu.Unlock()
+}
+
+// ConsumeCredit 消耗一条发送额度
+// 返回 false 表示客户端超额发送，调用方应拒绝该消息
+func (c *Connection) ConsumeCredit() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.sendCredits <= 0 {
+		return false
+	}
+	c.sendCredits--
+	c.creditsConsumed++
+	return true
+}
+
+// ReplenishCredits 消耗的额度达到 threshold 时归还给客户端
+//
+// 返回本次补充的额度数（0 表示还不需要补充），
+// 调用方负责通过 CmdTypeCredit 通知客户端。
+// 按批补充而不是逐条补充，减少额度帧的数量
+func (c *Connection) ReplenishCredits(threshold int) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.creditsConsumed < threshold {
+		return 0
+	}
+	n := c.creditsConsumed
+	c.sendCredits += n
+	c.creditsConsumed = 0
+	return n
+}
+
+// ==================== 客户端地址 ====================
+
+// SetRemoteAddr 设置真实客户端地址（PROXY 协议解析结果）
+func (c *Connection) SetRemoteAddr(addr net.Addr) {
+	c.mu.Lock()
+	c.realAddr = addr
+	c.mu.Unlock()
+}
+
+// RemoteAddr 获取客户端地址
+// 经过负载均衡时返回 PROXY 协议携带的真实地址，否则返回 TCP 对端地址
+func (c *Connection) RemoteAddr() net.Addr {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.realAddr != nil {
+		return c.realAddr
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// ==================== 认证状态 ====================
+
+// AuthState 获取当前认证状态
+func (c *Connection) AuthState() AuthState {
+	return AuthState(c.authState.Load())
+}
+
+// SetAuthState 设置认证状态
+func (c *Connection) SetAuthState(state AuthState) {
+	c.authState.Store(int32(state))
+}
+
+// CompareAndSwapAuthState 仅当当前状态为 old 时切换到 new
+// 用于认证流程的状态迁移，避免并发认证
+func (c *Connection) CompareAndSwapAuthState(old, new AuthState) bool {
+	return c.authState.CompareAndSwap(int32(old), int32(new))
+}
+
+// IsAuthenticated 是否已完成认证
+func (c *Connection) IsAuthenticated() bool {
+	return c.AuthState() == AuthStateAuthenticated
+}
+
+// ==================== 用户绑定 ====================
+
+// SetUserID 绑定用户 ID
+// 在用户认证成功后调用
+func (c *Connection) SetUserID(uid string) {
+	c.mu.Lock()
+	c.UserID = uid
+	c.mu.Unlock()
+}
+
+// GetUserID 获取用户 ID
+func (c *Connection) GetUserID() string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.UserID
+}
+
+// SetIdentity 记录认证得到的用户名和认证时间
+func (c *Connection) SetIdentity(username string, authTime time.Time) {
+	c.mu.Lock()
+	c.username = username
+	c.authTime = authTime
+	c.mu.Unlock()
+}
+
+// SetCredential 保存认证使用的凭据
+// server 包不关心凭据的类型，由上层在复查时断言
+func (c *Connection) SetCredential(credential interface{}) {
+	c.mu.Lock()
+	c.credential = credential
+	c.mu.Unlock()
+}
+
+// Credential 获取认证使用的凭据，未保存时为 nil
+func (c *Connection) Credential() interface{} {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.credential
+}
+
+// GetUsername 获取用户名
+func (c *Connection) GetUsername() string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.username
+}
+
+// GetAuthTime 获取认证时间
+func (c *Connection) GetAuthTime() time.Time {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.authTime
+}
+
+// CountUnknownCommand 记录一次未知命令，返回本连接累计的未知命令数
+func (c *Connection) CountUnknownCommand() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.unknownCommands++
+	return c.unknownCommands
+}
+
+// AdvanceClientSeq 检查并记录客户端在某个会话上的发送计数
+//
+// 计数必须严格递增，返回 false 表示不大于上次接受的值（回退或重复），消息应被拒绝
+// 计数属于客户端实例，按连接记录：重连后从头开始
+func (c *Connection) AdvanceClientSeq(conversation string, seq int64) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if last, ok := c.clientSeqs[conversation]; ok && seq <= last {
+		return false
+	}
+	if c.clientSeqs == nil {
+		c.clientSeqs = make(map[string]int64)
+	}
+	c.clientSeqs[conversation] = seq
+	return true
+}
+
+// SetDeviceID 设置设备 ID
+func (c *Connection) SetDeviceID(deviceID string) {
+	c.mu.Lock()
+	c.deviceID = deviceID
+	c.mu.Unlock()
+}
+
+// GetDeviceID 获取设备 ID
+func (c *Connection) GetDeviceID() string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.deviceID
+}
+
+// SetResumeID 设置可恢复会话 ID
+func (c *Connection) SetResumeID(id string) {
+	c.mu.Lock()
+	c.resumeID = id
+	c.mu.Unlock()
+}
+
+// ResumeID 获取可恢复会话 ID，没有时为空
+func (c *Connection) ResumeID() string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.resumeID
+}
+
+// ==================================================================
+// ConnectionManager - 连接管理器
+// ==================================================================
+
+/*
+ConnectionManager 管理所有活跃连接
+
+核心数据结构：
+
+ 1. connections: ConnID → Connection
+    用于按连接 ID 查找
+
+ 2. userConns: UserID → Connection
+    用于消息路由（根据用户 ID 找到其连接）
+
+为什么用 sync.Map 而不是 map + mutex？
+- sync.Map 对读多写少的场景优化
+- 连接查找（读）远多于连接建立/断开（写）
+- 内置并发安全，代码更简洁
+*/
+type ConnectionManager struct {
+	// connections 连接 ID → 连接对象
+	connections sync.Map
+
+	// userConns 用户 ID → 连接对象
+	// 用于消息路由：知道用户 ID，需要找到其连接
+	userConns sync.Map
+
+	// trace 追踪目标（见 trace.go），traceMu 保护
+	trace   *traceTargets
+	traceMu sync.Mutex
+}
+
+// NewConnectionManager 创建连接管理器
+func NewConnectionManager() *ConnectionManager {
+	return &ConnectionManager{}
+}
+
+// Add 添加连接
+func (m *ConnectionManager) Add(conn *Connection) {
+	m.connections.Store(conn.ID, conn)
+	m.applyTrace(conn)
+}
+
+// Remove 移除连接
+func (m *ConnectionManager) Remove(conn *Connection) {
+	// 从连接表中移除
+	m.connections.Delete(conn.ID)
+
+	// 如果已绑定用户，也要从用户表中移除
+	// 只有映射仍指向本连接时才删除：用户可能已经重连并 BindUser 了新连接
+	// 同一用户在本网关还有其他设备时，路由改为指向其中一个
+	if uid := conn.GetUserID(); uid != "" {
+		if m.userConns.CompareAndDelete(uid, conn) {
+			if other := m.findByUser(uid, func(*Connection) bool { return true }); other != nil {
+				m.userConns.LoadOrStore(uid, other)
+			}
+		}
+	}
+}
+
+// BindUser 绑定用户到连接
+// 在用户认证成功后调用
+// 这使得后续可以通过 UserID 快速找到连接
+func (m *ConnectionManager) BindUser(uid string, conn *Connection) {
+	conn.SetUserID(uid)
+	m.userConns.Store(uid, conn)
+	m.applyTrace(conn)
+}
+
+// GetByUserID 根据用户 ID 获取连接
+// 这是消息路由的核心：知道要发送给谁，找到他的连接
+func (m *ConnectionManager) GetByUserID(uid string) *Connection {
+	if v, ok := m.userConns.Load(uid); ok {
+		return v.(*Connection)
+	}
+	return nil
+}
+
+// GetByDevice 根据用户 ID 和设备 ID 获取本网关上的连接
+// 需要遍历所有连接，只用于踢设备等低频场景
+func (m *ConnectionManager) GetByDevice(uid, deviceID string) *Connection {
+	return m.findByUser(uid, func(conn *Connection) bool {
+		return conn.GetDeviceID() == deviceID
+	})
+}
+
+// findByUser 查找用户在本网关上第一个满足 match 的未关闭连接
+func (m *ConnectionManager) findByUser(uid string, match func(*Connection) bool) *Connection {
+	var found *Connection
+	m.connections.Range(func(_, v interface{}) bool {
+		conn := v.(*Connection)
+		if !conn.IsClosed() && conn.GetUserID() == uid && match(conn) {
+			found = conn
+			return false
+		}
+		return true
+	})
+	return found
+}
+
+// GetByConnID 根据连接 ID 获取连接
+func (m *ConnectionManager) GetByConnID(id uint64) *Connection {
+	if v, ok := m.connections.Load(id); ok {
+		return v.(*Connection)
+	}
+	return nil
+}
+
+// CountByUserID 统计某个用户在本网关上的连接数（设备数）
+// 需要遍历所有连接，只用于低频的查询场景
+func (m *ConnectionManager) CountByUserID(uid string) int {
+	count := 0
+	m.connections.Range(func(_, v interface{}) bool {
+		conn := v.(*Connection)
+		if !conn.IsClosed() && conn.GetUserID() == uid {
+			count++
+		}
+		return true
+	})
+	return count
+}
+
+// Count 获取当前连接数
+func (m *ConnectionManager) Count() int {
+	count := 0
+	m.connections.Range(func(_, _ interface{}) bool {
+		count++
+		return true
+	})
+	return count
+}
+
+// Range 遍历所有连接，fn 返回 false 时停止
+func (m *ConnectionManager) Range(fn func(*Connection) bool) {
+	m.connections.Range(func(_, v interface{}) bool {
+		return fn(v.(*Connection))
+	})
+}
+
+// BroadcastResult 广播结果汇总
+type BroadcastResult struct {
+	Sent   int   // 成功放入写队列的连接数
+	Failed int   // 发送失败的连接数（已关闭、队列满）
+	Err    error // 打包失败时的错误（此时没有连接收到消息）
+}
+
+// Broadcast 广播消息给所有连接
+// 用于系统公告等场景
+//
+// 消息最多打包两次：普通帧，以及第一次遇到协商了字典压缩的连接时打包的压缩帧，
+// 之后所有连接共享这两份数据；打包失败（如超过 MaxPayloadLength）时直接返回错误，
+// 单个连接的发送失败计入 Failed，不影响其他连接
+func (m *ConnectionManager) Broadcast(msg *protocol.Message) BroadcastResult {
+	data, err := protocol.Pack(msg)
+	if err != nil {
+		log.Printf("[ConnManager] Broadcast dropped: %v", err)
+		return BroadcastResult{Err: err}
+	}
+
+	var compressed []byte
+	var result BroadcastResult
+	m.connections.Range(func(_, v interface{}) bool {
+		conn := v.(*Connection)
+		frame := data
+		if conn.compress.Load() {
+			if compressed == nil {
+				// 压缩失败时退回普通帧，客户端任何时候都接受未压缩帧
+				if compressed, err = protocol.PackCompressed(msg); err != nil {
+					compressed = data
+				}
+			}
+			frame = compressed
+		}
+		if err := conn.sendFrame(frame); err != nil {
+			result.Failed++
+		} else {
+			result.Sent++
+		}
+		return true
+	})
+
+	if result.Failed > 0 {
+		log.Printf("[ConnManager] Broadcast sent to %d connections, %d failed", result.Sent, result.Failed)
+	}
+	return result
+}
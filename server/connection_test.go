@@ -0,0 +1,406 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go-im/protocol"
+)
+
+// newTestConn 基于内存管道的连接，peer 为客户端一侧，测试结束时关闭两端
+func newTestConn(t *testing.T) (c *Connection, peer net.Conn) {
+	t.Helper()
+	return newTestConnID(t, 1)
+}
+
+// newTestConnID 同 newTestConn，使用指定的连接 ID
+func newTestConnID(t *testing.T, id uint64) (c *Connection, peer net.Conn) {
+	t.Helper()
+	server, client := net.Pipe()
+	c = NewConnection(id, server)
+	t.Cleanup(func() {
+		c.Close(CloseReasonShutdown)
+		client.Close()
+	})
+	return c, client
+}
+
+func TestInFlightPausesAndResumes(t *testing.T) {
+	c, _ := newTestConn(t)
+	const limit = 3
+
+	// 两个会话的消息 SeqID 相同，各占一个名额
+	a1 := InFlightRef{SeqID: 1, ID: "alice:bob:1"}
+	c1 := InFlightRef{SeqID: 1, ID: "bob:carol:1"}
+	a2 := InFlightRef{SeqID: 2, ID: "alice:bob:2"}
+	for _, ref := range []InFlightRef{a1, c1, a2} {
+		if !c.ReserveInFlight(ref.SeqID, ref.ID, limit, nil) {
+			t.Fatalf("reserve %s below the limit refused", ref.ID)
+		}
+	}
+
+	// 达到上限：暂停，调用方改存离线
+	if c.ReserveInFlight(3, "alice:bob:3", limit, nil) {
+		t.Fatal("reserve at the limit accepted")
+	}
+	if got := c.InFlightCount(); got != limit {
+		t.Fatalf("in-flight count = %d, want %d", got, limit)
+	}
+
+	// 选择性确认只释放 alice 的 1，carol 的 1 仍在途；回落到上限以下，通知恢复投递
+	if !c.ReleaseInFlightRefs([]InFlightRef{a1}, limit) {
+		t.Fatal("release below the limit did not report resume")
+	}
+	if c.IsInFlight(a1) || !c.IsInFlight(c1) || !c.IsInFlight(a2) {
+		t.Fatalf("after releasing %s: in flight a1=%v c1=%v a2=%v", a1.ID, c.IsInFlight(a1), c.IsInFlight(c1), c.IsInFlight(a2))
+	}
+
+	// 恢复后可以继续投递，再次达到上限时重新暂停
+	if !c.ReserveInFlight(3, "alice:bob:3", limit, nil) {
+		t.Fatal("reserve after resume refused")
+	}
+	if c.ReserveInFlight(4, "alice:bob:4", limit, nil) {
+		t.Fatal("reserve at the limit accepted after resume")
+	}
+
+	// 累积确认释放 SeqID <= 2 的全部消息
+	if !c.ReleaseInFlight(2, limit) {
+		t.Fatal("cumulative ack did not report resume")
+	}
+	if got := c.InFlightCount(); got != 1 {
+		t.Fatalf("in-flight count after cumulative ack = %d, want 1", got)
+	}
+
+	// 没有暂停过的连接释放名额时不需要恢复
+	if c.ReleaseInFlight(3, limit) {
+		t.Fatal("resume reported for a connection that was not paused")
+	}
+}
+
+func TestInFlightUnlimited(t *testing.T) {
+	c, _ := newTestConn(t)
+	for seq := int64(1); seq <= 1000; seq++ {
+		if !c.ReserveInFlight(seq, "", 0, nil) {
+			t.Fatalf("reserve %d refused without a limit", seq)
+		}
+	}
+	if c.ReleaseInFlight(1000, 0) {
+		t.Fatal("resume reported without a limit")
+	}
+}
+
+func TestPendingUnackedKeepsOrder(t *testing.T) {
+	c, _ := newTestConn(t)
+	c.ReserveInFlight(3, "x:3", 0, "third")
+	c.ReserveInFlight(1, "x:1", 0, "first")
+	c.ReserveInFlight(2, "x:2", 0, nil) // 已在离线盒子中，只占名额
+	c.ReserveInFlight(1, "y:1", 0, "first-other")
+
+	got := c.PendingUnacked()
+	if len(got) != 3 || got[0] != "first" || got[1] != "first-other" || got[2] != "third" {
+		t.Fatalf("PendingUnacked() = %v", got)
+	}
+}
+
+func TestAdvanceAck(t *testing.T) {
+	c, _ := newTestConn(t)
+	steps := []struct {
+		name string
+		seq  int64
+		want bool
+	}{
+		{"first ack", 5, true},
+		{"duplicate", 5, false},
+		{"regression", 3, false},
+		{"advance", 6, true},
+		{"jump", 10, true},
+		{"stale after jump", 7, false},
+		{"zero", 0, false},
+		{"negative", -1, false},
+	}
+	for _, s := range steps {
+		if got := c.AdvanceAck(s.seq); got != s.want {
+			t.Fatalf("%s: AdvanceAck(%d) = %v, want %v", s.name, s.seq, got, s.want)
+		}
+	}
+
+	// 第一次 ACK 总是推进，哪怕是兜底的负序号
+	fresh, _ := newTestConnID(t, 2)
+	if !fresh.AdvanceAck(-2) {
+		t.Fatal("first ack with negative seq not accepted")
+	}
+	if fresh.AdvanceAck(-2) || !fresh.AdvanceAck(-1) {
+		t.Fatal("negative seqs not ordered after first ack")
+	}
+}
+
+func TestBroadcastCompressesPerConnection(t *testing.T) {
+	m := NewConnectionManager()
+	plain, plainPeer := newTestConnID(t, 1)
+	dict, dictPeer := newTestConnID(t, 2)
+	dict.SetCompression(true)
+	for _, c := range []*Connection{plain, dict} {
+		c.Start(func(*Connection, *protocol.Message) {})
+		m.Add(c)
+	}
+
+	body := []byte(`{"event":"maintenance","message":"the service restarts at 02:00 UTC","timestamp":1700000000000}`)
+	if res := m.Broadcast(&protocol.Message{CmdType: protocol.CmdTypeMessage, Body: body}); res.Sent != 2 || res.Err != nil {
+		t.Fatalf("broadcast result = %+v, want 2 sent", res)
+	}
+
+	for _, tc := range []struct {
+		name       string
+		peer       net.Conn
+		compressed bool
+	}{
+		{"plain", plainPeer, false},
+		{"dict-v1", dictPeer, true},
+	} {
+		tc.peer.SetReadDeadline(time.Now().Add(2 * time.Second))
+		r := bufio.NewReader(tc.peer)
+		header, err := r.Peek(protocol.HeaderLength)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		flagged := binary.BigEndian.Uint16(header[4:6])&protocol.FlagDictCompressed != 0
+		if flagged != tc.compressed {
+			t.Errorf("%s: compressed = %v, want %v", tc.name, flagged, tc.compressed)
+		}
+		msg, err := protocol.Unpack(r)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if !bytes.Equal(msg.Body, body) {
+			t.Errorf("%s: body = %q, want %q", tc.name, msg.Body, body)
+		}
+	}
+}
+
+// withWriteTimeouts 临时修改写超时配置
+func withWriteTimeouts(t *testing.T, base, perKB, min, max time.Duration) {
+	t.Helper()
+	oldBase, oldPerKB, oldMin, oldMax := WriteTimeoutBase, WriteTimeoutPerKB, WriteTimeoutMin, WriteTimeoutMax
+	WriteTimeoutBase, WriteTimeoutPerKB, WriteTimeoutMin, WriteTimeoutMax = base, perKB, min, max
+	t.Cleanup(func() {
+		WriteTimeoutBase, WriteTimeoutPerKB, WriteTimeoutMin, WriteTimeoutMax = oldBase, oldPerKB, oldMin, oldMax
+	})
+}
+
+func TestWriteTimeout(t *testing.T) {
+	tests := []struct {
+		name     string
+		frameLen int
+		want     time.Duration
+	}{
+		{"heartbeat", protocol.HeaderLength, 5*time.Second + protocol.HeaderLength*50*time.Millisecond/1024},
+		{"empty", 0, 5 * time.Second},
+		{"1 KB", 1024, 5*time.Second + 50*time.Millisecond},
+		{"100 KB", 100 * 1024, 10 * time.Second},
+		{"max payload", protocol.MaxPayloadLength + protocol.HeaderLength, 56*time.Second + 200*time.Millisecond + protocol.HeaderLength*50*time.Millisecond/1024},
+		{"capped", 2 * 1024 * 1024, WriteTimeoutMax},
+	}
+	for _, tt := range tests {
+		if got := writeTimeout(tt.frameLen); got != tt.want {
+			t.Errorf("%s: writeTimeout(%d) = %v, want %v", tt.name, tt.frameLen, got, tt.want)
+		}
+	}
+
+	// 基础值低于下限时，小帧取下限
+	withWriteTimeouts(t, 0, 50*time.Millisecond, 2*time.Second, 60*time.Second)
+	if got := writeTimeout(1024); got != 2*time.Second {
+		t.Errorf("with zero base: writeTimeout(1024) = %v, want the 2s minimum", got)
+	}
+}
+
+func TestWriteTimeoutClosesStalledConnection(t *testing.T) {
+	withWriteTimeouts(t, 20*time.Millisecond, 0, 20*time.Millisecond, 20*time.Millisecond)
+	c, _ := newTestConn(t)
+	c.Start(func(*Connection, *protocol.Message) {})
+
+	// 对端不读取，写入在超时后失败，连接以 WriteError 关闭
+	if err := c.Send(&protocol.Message{CmdType: protocol.CmdTypeMessage, Body: []byte("stuck")}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-c.Done():
+	case <-time.After(2 * time.Second):
+		t.Fatal("connection not closed after write timeout")
+	}
+	if got := c.CloseReason(); got != CloseReasonWriteError {
+		t.Fatalf("close reason = %v, want %v", got, CloseReasonWriteError)
+	}
+}
+
+// readFrames 从 peer 读出 n 帧
+func readFrames(t *testing.T, r *bufio.Reader, peer net.Conn, n int) []*protocol.Message {
+	t.Helper()
+	peer.SetReadDeadline(time.Now().Add(2 * time.Second))
+	msgs := make([]*protocol.Message, n)
+	for i := range msgs {
+		msg, err := protocol.Unpack(r)
+		if err != nil {
+			t.Fatalf("frame %d: %v", i, err)
+		}
+		msgs[i] = msg
+	}
+	return msgs
+}
+
+func TestOutboundInterceptor(t *testing.T) {
+	c, peer := newTestConn(t)
+	c.Start(func(*Connection, *protocol.Message) {})
+	r := bufio.NewReader(peer)
+	send := func(body string) {
+		t.Helper()
+		if err := c.Send(&protocol.Message{CmdType: protocol.CmdTypeMessage, Body: []byte(body)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 丢弃 "drop"，改写 "rewrite"，其余原样通过
+	var seen atomic.Int32
+	c.SetOutboundInterceptor(func(conn *Connection, frame []byte) ([]byte, bool) {
+		if conn != c {
+			t.Errorf("interceptor called with connection %d", conn.ID)
+		}
+		seen.Add(1)
+		switch string(frame[protocol.HeaderLength:]) {
+		case "drop":
+			return nil, false
+		case "rewrite":
+			out, err := protocol.Pack(&protocol.Message{CmdType: protocol.CmdTypeMessage, Body: []byte("rewritten")})
+			if err != nil {
+				t.Error(err)
+			}
+			return out, true
+		}
+		return frame, true
+	})
+	for _, body := range []string{"keep", "drop", "rewrite", "after"} {
+		send(body)
+	}
+	msgs := readFrames(t, r, peer, 3)
+	if got := []string{string(msgs[0].Body), string(msgs[1].Body), string(msgs[2].Body)}; fmt.Sprint(got) != "[keep rewritten after]" {
+		t.Fatalf("frames = %q, want [keep rewritten after]", got)
+	}
+	if n := seen.Load(); n != 4 {
+		t.Fatalf("interceptor saw %d frames, want 4", n)
+	}
+
+	// 运行期间替换和取消，对之后的帧生效
+	c.SetOutboundInterceptor(func(_ *Connection, frame []byte) ([]byte, bool) {
+		out, _ := protocol.Pack(&protocol.Message{CmdType: protocol.CmdTypeMessage, Body: []byte("replaced")})
+		return out, true
+	})
+	send("one")
+	if msg := readFrames(t, r, peer, 1)[0]; string(msg.Body) != "replaced" {
+		t.Fatalf("after replacing: frame = %q, want \"replaced\"", msg.Body)
+	}
+	c.SetOutboundInterceptor(nil)
+	send("drop")
+	if msg := readFrames(t, r, peer, 1)[0]; string(msg.Body) != "drop" {
+		t.Fatalf("after removing: frame = %q, want \"drop\"", msg.Body)
+	}
+}
+
+// creditStep 额度操作：creditConsume 的 want 为 1/0 表示 true/false
+type creditStep struct{ op, arg, want int }
+
+const (
+	creditGrant = iota
+	creditConsume
+	creditReplenish
+)
+
+func TestSendCredits(t *testing.T) {
+	tests := []struct {
+		name  string
+		steps []creditStep
+	}{
+		{"no credits before auth", []creditStep{
+			{creditConsume, 0, 0},
+		}},
+		{"window exhausted", []creditStep{
+			{creditGrant, 2, 0}, {creditConsume, 0, 1}, {creditConsume, 0, 1}, {creditConsume, 0, 0},
+		}},
+		{"creditReplenish below threshold", []creditStep{
+			{creditGrant, 4, 0}, {creditConsume, 0, 1}, {creditReplenish, 2, 0}, {creditConsume, 0, 1}, {creditReplenish, 2, 2},
+			{creditReplenish, 2, 0}, // 已归还的额度不再重复归还
+		}},
+		{"creditReplenish restores window", []creditStep{
+			{creditGrant, 2, 0}, {creditConsume, 0, 1}, {creditConsume, 0, 1}, {creditConsume, 0, 0},
+			{creditReplenish, 1, 2}, {creditConsume, 0, 1}, {creditConsume, 0, 1}, {creditConsume, 0, 0},
+		}},
+		{"rejected sends are not replenished", []creditStep{
+			{creditGrant, 1, 0}, {creditConsume, 0, 1}, {creditConsume, 0, 0}, {creditConsume, 0, 0}, {creditReplenish, 1, 1},
+		}},
+		{"regrant resets consumed", []creditStep{
+			{creditGrant, 4, 0}, {creditConsume, 0, 1}, {creditConsume, 0, 1}, {creditGrant, 4, 0}, {creditReplenish, 1, 0},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, _ := newTestConn(t)
+			for i, s := range tt.steps {
+				switch s.op {
+				case creditGrant:
+					c.GrantCredits(s.arg)
+				case creditConsume:
+					if got := c.ConsumeCredit(); got != (s.want == 1) {
+						t.Fatalf("step %d: ConsumeCredit() = %v, want %v", i, got, s.want == 1)
+					}
+				case creditReplenish:
+					if got := c.ReplenishCredits(s.arg); got != s.want {
+						t.Fatalf("step %d: ReplenishCredits(%d) = %d, want %d", i, s.arg, got, s.want)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestTeardownRunsOnce(t *testing.T) {
+	c, _ := newTestConn(t)
+
+	var calls atomic.Int32
+	c.SetTeardown(func(conn *Connection) {
+		calls.Add(1)
+		// 清理时 closeChan 已关闭（Send 立即失败），底层连接还没有关闭
+		if !conn.IsClosed() {
+			t.Error("teardown ran before closeChan was closed")
+		}
+		if conn.Send(&protocol.Message{CmdType: protocol.CmdTypeMessage}) == nil {
+			t.Error("Send succeeded during teardown")
+		}
+		if err := conn.Conn.SetDeadline(time.Time{}); err != nil {
+			t.Errorf("underlying connection closed before teardown: %v", err)
+		}
+	})
+
+	// 读循环、写循环和踢人同时关闭
+	reasons := []CloseReason{CloseReasonClientEOF, CloseReasonWriteError, CloseReasonKicked, CloseReasonShutdown}
+	done := make(chan struct{})
+	for i := 0; i < 20; i++ {
+		go func(reason CloseReason) {
+			c.Close(reason)
+			done <- struct{}{}
+		}(reasons[i%len(reasons)])
+	}
+	for i := 0; i < 20; i++ {
+		<-done
+	}
+
+	if n := calls.Load(); n != 1 {
+		t.Fatalf("teardown ran %d times, want 1", n)
+	}
+	if err := c.Conn.SetDeadline(time.Time{}); err == nil {
+		t.Fatal("underlying connection still open after Close")
+	}
+}
@@ -0,0 +1,113 @@
+/*
+Package server - 控制帧直写
+
+=== 队列满时的控制帧 ===
+
+Send 只把帧放进 writeChan，队列满时直接丢弃（ErrWriteQueueFull）。
+对普通消息这是合理的，但踢出通知（CmdTypeKick）也会被丢掉：
+一个卡住不读数据的客户端恰恰是最需要被踢下线的，却收不到通知。
+
+SendControl 用于这类控制帧，队列满时退而直接写入 socket：
+
+	SendControl(kick)
+	     │
+	     ├── 放入 writeChan 成功 ──▶ 与普通帧一样由 writeLoop 发送
+	     │
+	     └── 队列已满 ──▶ 获取写锁（与 writeLoop 互斥，帧不会交错）
+	                      ──▶ 在 ControlWriteTimeout 内直接写入 socket
+
+=== 注意 ===
+
+  - 获取写锁和写入共用 ControlWriteTimeout，调用方最多阻塞这么久
+  - 直写的帧越过了队列中积压的帧，只适合随后就要关闭连接的控制帧
+  - 直写的帧不经过出站拦截器（拦截器的延迟可能正是队列积压的原因）
+  - 直写失败时帧可能只写出一部分，数据流不再可信，立即关闭连接（CloseReasonWriteError）
+*/
+package server
+
+import (
+	"errors"
+	"log"
+	"net"
+	"time"
+
+	"go-im/protocol"
+)
+
+// ControlWriteTimeout 控制帧直写（含等待写锁）的超时时间
+var ControlWriteTimeout = 500 * time.Millisecond
+
+// ErrControlWriteTimeout 写队列已满，且在 ControlWriteTimeout 内没能拿到写锁
+var ErrControlWriteTimeout = errors.New("control frame write timed out")
+
+// SendControl 发送控制帧（如踢出通知），写队列已满时直接写入 socket
+//
+// 返回值与 Send 相同，只是不会返回 ErrWriteQueueFull：
+// 直写超时或失败时返回对应的错误，并关闭连接
+func (c *Connection) SendControl(msg *protocol.Message) error {
+	data, err := c.pack(msg)
+	if err != nil {
+		return err
+	}
+	if c.IsClosed() {
+		return net.ErrClosed
+	}
+	select {
+	case c.writeChan <- data:
+		c.recordQueueDepth(len(c.writeChan))
+		return nil
+	case <-c.closeChan:
+		return net.ErrClosed
+	default:
+		return c.writeDirect(data)
+	}
+}
+
+// writeDirect 越过写队列直接写入一帧
+func (c *Connection) writeDirect(data []byte) error {
+	deadline := time.Now().Add(ControlWriteTimeout)
+	timer := time.NewTimer(ControlWriteTimeout)
+	defer timer.Stop()
+
+	select {
+	case c.writeLock <- struct{}{}:
+	case <-c.closeChan:
+		return net.ErrClosed
+	case <-timer.C:
+		log.Printf("[Conn-%d] Timed out waiting to write control frame, closing connection", c.ID)
+		c.Close(CloseReasonWriteError)
+		return ErrControlWriteTimeout
+	}
+	defer func() { <-c.writeLock }()
+
+	if c.IsClosed() {
+		return net.ErrClosed
+	}
+	if err := c.writeLocked(data, deadline); err != nil {
+		log.Printf("[Conn-%d] Control frame write error: %v", c.ID, err)
+		c.Close(CloseReasonWriteError)
+		return err
+	}
+	log.Printf("[Conn-%d] Write channel full, wrote control frame directly", c.ID)
+	return nil
+}
+
+// writeFrame 在写锁内写出一帧，超时随帧大小增长（writeLoop 使用）
+func (c *Connection) writeFrame(data []byte) error {
+	c.writeLock <- struct{}{}
+	defer func() { <-c.writeLock }()
+	return c.writeLocked(data, time.Now().Add(writeTimeout(len(data))))
+}
+
+// writeLocked 设置写超时并写入网络，调用方持有写锁
+func (c *Connection) writeLocked(data []byte, deadline time.Time) error {
+	c.Conn.SetWriteDeadline(deadline)
+	if _, err := c.Conn.Write(data); err != nil {
+		return err
+	}
+	c.recordOutbound(data)
+	if c.tracing.Load() {
+		c.traceOutbound(data)
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"testing"
+	"time"
+
+	"go-im/protocol"
+)
+
+// fillWriteQueue 在没有 writeLoop 的连接上塞满写队列
+func fillWriteQueue(t *testing.T, c *Connection) {
+	t.Helper()
+	for i := 0; ; i++ {
+		err := c.Send(&protocol.Message{CmdType: protocol.CmdTypeMessage, Body: []byte("backlog")})
+		if errors.Is(err, ErrWriteQueueFull) {
+			return
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i > cap(c.writeChan) {
+			t.Fatal("write queue never filled")
+		}
+	}
+}
+
+// withControlWriteTimeout 临时修改 ControlWriteTimeout
+func withControlWriteTimeout(t *testing.T, d time.Duration) {
+	t.Helper()
+	old := ControlWriteTimeout
+	ControlWriteTimeout = d
+	t.Cleanup(func() { ControlWriteTimeout = old })
+}
+
+func TestSendControlBypassesFullQueue(t *testing.T) {
+	c, peer := newTestConn(t)
+	fillWriteQueue(t, c)
+
+	// 普通帧被丢弃，踢出通知越过积压的帧直接写出
+	if err := c.Send(&protocol.Message{CmdType: protocol.CmdTypeMessage}); !errors.Is(err, ErrWriteQueueFull) {
+		t.Fatalf("Send err = %v, want ErrWriteQueueFull", err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- c.SendControl(&protocol.Message{CmdType: protocol.CmdTypeKick, Body: []byte(`{"reason":"test"}`)})
+	}()
+
+	peer.SetReadDeadline(time.Now().Add(2 * time.Second))
+	msg, err := protocol.Unpack(bufio.NewReader(peer))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.CmdType != protocol.CmdTypeKick {
+		t.Fatalf("first frame = %s, want Kick", protocol.CmdTypeName(msg.CmdType))
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("SendControl = %v", err)
+	}
+	if c.IsClosed() {
+		t.Fatal("connection closed after a successful direct write")
+	}
+}
+
+func TestSendControlQueuesWhenRoom(t *testing.T) {
+	c, _ := newTestConn(t)
+	if err := c.SendControl(&protocol.Message{CmdType: protocol.CmdTypeKick}); err != nil {
+		t.Fatal(err)
+	}
+	if got := len(c.writeChan); got != 1 {
+		t.Fatalf("write queue depth = %d, want 1", got)
+	}
+}
+
+func TestSendControlWriteTimeoutCloses(t *testing.T) {
+	withControlWriteTimeout(t, 50*time.Millisecond)
+
+	t.Run("peer not reading", func(t *testing.T) {
+		c, _ := newTestConn(t)
+		fillWriteQueue(t, c)
+
+		start := time.Now()
+		err := c.SendControl(&protocol.Message{CmdType: protocol.CmdTypeKick})
+		if err == nil {
+			t.Fatal("SendControl succeeded with a stalled peer")
+		}
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Fatalf("SendControl blocked for %v", elapsed)
+		}
+		if !c.IsClosed() || c.CloseReason() != CloseReasonWriteError {
+			t.Fatalf("closed = %v, reason = %v, want closed with %v", c.IsClosed(), c.CloseReason(), CloseReasonWriteError)
+		}
+	})
+
+	t.Run("write lock held", func(t *testing.T) {
+		c, _ := newTestConn(t)
+		fillWriteQueue(t, c)
+
+		// writeLoop 卡在一次慢写入中
+		c.writeLock <- struct{}{}
+		defer func() { <-c.writeLock }()
+
+		err := c.SendControl(&protocol.Message{CmdType: protocol.CmdTypeKick})
+		if !errors.Is(err, ErrControlWriteTimeout) {
+			t.Fatalf("err = %v, want ErrControlWriteTimeout", err)
+		}
+		if !c.IsClosed() || c.CloseReason() != CloseReasonWriteError {
+			t.Fatalf("closed = %v, reason = %v, want closed with %v", c.IsClosed(), c.CloseReason(), CloseReasonWriteError)
+		}
+	})
+}
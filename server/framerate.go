@@ -0,0 +1,117 @@
+/*
+Package server - 入站帧速率限制（防突发）
+
+=== 与消息限流的区别 ===
+
+发送额度（send credits）只限制业务消息。客户端仍然可以用大量很小的合法帧
+（心跳、查询）刷屏，每一帧都要解包、分发，CPU 消耗在解析上。
+
+帧速率限制作用在读取循环，对所有帧（包括心跳）计数，按令牌桶计算：
+
+	速率 N 帧/秒，桶容量 N（允许一秒的突发）
+
+	每读到一帧消耗一个令牌
+	令牌用完时按策略处理：
+	  throttle ──▶ 暂停读取，令牌恢复后再读下一帧（数据留在内核缓冲区，TCP 自然背压）
+	  close    ──▶ 视为恶意连接，直接关闭（CloseReasonFrameFlood）
+
+健康检查（CmdTypeHealth）例外：和认证前的分发一样不受限制，
+既不消耗令牌也不会被暂停，负载均衡的探测不会被限速或断开。
+*/
+package server
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// 帧速率超限时的处理策略
+const (
+	// FramePolicyThrottle 暂停读取，直到令牌恢复
+	FramePolicyThrottle = "throttle"
+
+	// FramePolicyClose 关闭连接
+	FramePolicyClose = "close"
+)
+
+// ErrUnknownFramePolicy 未知的帧速率策略
+var ErrUnknownFramePolicy = errors.New("unknown frame rate policy")
+
+// SetFrameRate 设置每个连接的入站帧速率上限（帧/秒），<= 0 表示不限制
+// policy 为 FramePolicyThrottle 或 FramePolicyClose
+func (s *TCPServer) SetFrameRate(perSecond int, policy string) error {
+	switch policy {
+	case FramePolicyThrottle, FramePolicyClose:
+	default:
+		return fmt.Errorf("%w: %q", ErrUnknownFramePolicy, policy)
+	}
+	s.frameRate = perSecond
+	s.framePolicy = policy
+	return nil
+}
+
+// frameGovernor 单个连接的令牌桶（只由读取循环使用，不需要加锁）
+type frameGovernor struct {
+	rate   float64   // 每秒恢复的令牌数
+	burst  float64   // 桶容量
+	tokens float64   // 当前令牌数，可以为负（欠下的令牌）
+	last   time.Time // 上次更新时间
+}
+
+// newFrameGovernor 创建令牌桶，perSecond <= 0 时返回 nil（不限制）
+func newFrameGovernor(perSecond int) *frameGovernor {
+	if perSecond <= 0 {
+		return nil
+	}
+	return &frameGovernor{
+		rate:   float64(perSecond),
+		burst:  float64(perSecond),
+		tokens: float64(perSecond),
+		last:   time.Now(),
+	}
+}
+
+// take 消耗一个令牌，返回令牌恢复到非负还需要等待的时间（0 表示没有超限）
+func (g *frameGovernor) take(now time.Time) time.Duration {
+	g.tokens += now.Sub(g.last).Seconds() * g.rate
+	if g.tokens > g.burst {
+		g.tokens = g.burst
+	}
+	g.last = now
+
+	g.tokens--
+	if g.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-g.tokens / g.rate * float64(time.Second))
+}
+
+// governFrame 读到一帧后调用，超限时按策略等待或要求关闭
+// 返回 false 表示应该关闭连接
+func (s *TCPServer) governFrame(conn *Connection, g *frameGovernor) bool {
+	if g == nil {
+		return true
+	}
+	wait := g.take(time.Now())
+	if wait == 0 {
+		return true
+	}
+	if s.framePolicy == FramePolicyClose {
+		conn.stats.throttled.Add(1)
+		return false
+	}
+
+	// 暂停读取，期间连接关闭或服务器关闭时立即返回
+	conn.stats.throttled.Add(1)
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-conn.closeChan:
+		return false
+	case <-s.quit:
+		return true
+	}
+}
@@ -0,0 +1,125 @@
+package server
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go-im/protocol"
+)
+
+func TestFrameGovernorTake(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	tests := []struct {
+		name  string
+		rate  int
+		takes []time.Duration // 每次 take 相对 start 的时间
+		waits []time.Duration // 对应的等待时间
+	}{
+		{"burst within capacity", 3,
+			[]time.Duration{0, 0, 0},
+			[]time.Duration{0, 0, 0}},
+		{"over burst", 2,
+			[]time.Duration{0, 0, 0, 0},
+			[]time.Duration{0, 0, 500 * time.Millisecond, time.Second}},
+		{"refills over time", 2,
+			[]time.Duration{0, 0, 500 * time.Millisecond, 500 * time.Millisecond},
+			[]time.Duration{0, 0, 0, 500 * time.Millisecond}},
+		{"idle does not exceed burst", 2,
+			[]time.Duration{0, time.Hour, time.Hour, time.Hour},
+			[]time.Duration{0, 0, 0, 500 * time.Millisecond}},
+		{"steady rate never waits", 10,
+			[]time.Duration{0, 100 * time.Millisecond, 200 * time.Millisecond, 300 * time.Millisecond},
+			[]time.Duration{0, 0, 0, 0}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := newFrameGovernor(tt.rate)
+			g.last = start
+			for i, at := range tt.takes {
+				if got := g.take(start.Add(at)); got != tt.waits[i] {
+					t.Fatalf("take %d at +%v: wait %v, want %v", i, at, got, tt.waits[i])
+				}
+			}
+		})
+	}
+}
+
+func TestNewFrameGovernorDisabled(t *testing.T) {
+	for _, rate := range []int{0, -1} {
+		if g := newFrameGovernor(rate); g != nil {
+			t.Errorf("newFrameGovernor(%d) = %+v, want nil", rate, g)
+		}
+	}
+}
+
+func TestSetFrameRatePolicy(t *testing.T) {
+	s := NewTCPServer("127.0.0.1:0", "gateway_test")
+	for _, policy := range []string{FramePolicyThrottle, FramePolicyClose} {
+		if err := s.SetFrameRate(10, policy); err != nil {
+			t.Errorf("SetFrameRate(%q) = %v", policy, err)
+		}
+	}
+	if err := s.SetFrameRate(10, "drop"); !errors.Is(err, ErrUnknownFramePolicy) {
+		t.Fatalf("SetFrameRate(drop) = %v, want ErrUnknownFramePolicy", err)
+	}
+}
+
+func TestFrameFloodPolicy(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  string
+		cmdType uint16
+		closed  bool
+	}{
+		{"close", FramePolicyClose, protocol.CmdTypeMessage, true},
+		{"throttle", FramePolicyThrottle, protocol.CmdTypeMessage, false},
+		{"health exempt from close", FramePolicyClose, protocol.CmdTypeHealth, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			const frames = 30
+			var handled atomic.Int32
+			reasons := make(chan CloseReason, 1)
+			s := startTestServer(t, handlerFunc(func(*Connection, *protocol.Message) { handled.Add(1) }), func(s *TCPServer) {
+				if err := s.SetFrameRate(20, tt.policy); err != nil {
+					t.Fatal(err)
+				}
+				s.SetOnDisconnect(func(conn *Connection) { reasons <- conn.CloseReason() })
+			})
+			c, _ := dialTestServer(t, s)
+
+			// 速率 20 帧/秒（允许突发 20 帧），连续发送 30 帧
+			for i := 0; i < frames; i++ {
+				writeFrame(t, c, tt.cmdType, "")
+			}
+
+			if tt.closed {
+				select {
+				case got := <-reasons:
+					if got != CloseReasonFrameFlood {
+						t.Fatalf("close reason = %s, want frame_flood", got)
+					}
+				case <-time.After(2 * time.Second):
+					t.Fatal("flooding connection not closed")
+				}
+				return
+			}
+
+			// 不关闭：所有帧最终都被处理（throttle 暂停约 0.5 秒）
+			deadline := time.Now().Add(2 * time.Second)
+			for handled.Load() < frames && time.Now().Before(deadline) {
+				time.Sleep(5 * time.Millisecond)
+			}
+			if got := handled.Load(); got != frames {
+				t.Fatalf("handled %d frames, want %d", got, frames)
+			}
+			select {
+			case got := <-reasons:
+				t.Fatalf("connection closed (%s)", got)
+			default:
+			}
+		})
+	}
+}
@@ -0,0 +1,47 @@
+/*
+Package server - 协议失步处理
+
+读取循环遇到头部非法或长度过大的帧时，说明数据流已经失步（见 protocol/sync.go）：
+
+	未开启同步标记   无法找到下一帧的起点，立即关闭连接（CloseReasonDesync）
+	开启同步标记     跳过垃圾字节，在下一个标记处重新对齐；
+	                 连续 maxResyncs 次对齐后仍读不出有效帧时关闭连接
+
+每次成功读出一帧都会重置计数，偶发的注入不会导致断线，持续的垃圾数据不会让读取循环空转。
+*/
+package server
+
+import (
+	"bufio"
+	"log"
+
+	"go-im/protocol"
+)
+
+// maxResyncs 连续重新对齐的次数上限
+const maxResyncs = 3
+
+// SetFrameSync 开启/关闭入站帧同步标记
+// 开启后客户端发出的每一帧都必须以 protocol.PackSynced 的标记开始
+func (s *TCPServer) SetFrameSync(enabled bool) {
+	s.frameSync = enabled
+}
+
+// readFrame 读取下一帧，开启同步标记时在失步后重新对齐
+// 返回的错误满足 protocol.IsDesync 时，关闭原因为 CloseReasonDesync
+func (s *TCPServer) readFrame(conn *Connection, reader *bufio.Reader) (*protocol.Message, error) {
+	if !s.frameSync {
+		return protocol.Unpack(reader)
+	}
+
+	for resyncs := 0; ; resyncs++ {
+		msg, skipped, err := protocol.UnpackSynced(reader)
+		if skipped > 0 {
+			log.Printf("[Conn-%d] Skipped %d bytes before frame sync marker", conn.ID, skipped)
+		}
+		if err == nil || !protocol.IsDesync(err) || resyncs >= maxResyncs {
+			return msg, err
+		}
+		log.Printf("[Conn-%d] Bad frame after sync marker (%v), resynchronizing", conn.ID, err)
+	}
+}
@@ -0,0 +1,91 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+
+	"go-im/protocol"
+)
+
+// badSyncedHeader 同步标记之后跟一个 Length 非法的头部
+var badSyncedHeader = []byte{0xA5, 0x5A, 0, 0, 0, 0, 0, 1, 0, 1}
+
+func TestReadFrameResyncLimit(t *testing.T) {
+	conn, _ := newTestConn(t)
+	s := &TCPServer{frameSync: true}
+
+	frame, err := protocol.PackSynced(&protocol.Message{CmdType: protocol.CmdTypeMessage, Body: []byte("real")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		bad     int
+		wantErr error
+	}{
+		{"no resync", 0, nil},
+		{"one resync", 1, nil},
+		{"at the limit", maxResyncs, nil},
+		{"over the limit", maxResyncs + 1, protocol.ErrInvalidHeader},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stream := append(bytes.Repeat(badSyncedHeader, tt.bad), frame...)
+			msg, err := s.readFrame(conn, bufio.NewReader(bytes.NewReader(stream)))
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) || !protocol.IsDesync(err) {
+					t.Fatalf("err = %v, want desync %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(msg.Body) != "real" {
+				t.Fatalf("body = %q, want \"real\"", msg.Body)
+			}
+		})
+	}
+}
+
+func TestReadFrameResyncCounterResets(t *testing.T) {
+	conn, _ := newTestConn(t)
+	s := &TCPServer{frameSync: true}
+
+	// 每帧前都有 maxResyncs 个伪标记：每次成功读帧都重新计数，不会断开
+	var stream []byte
+	for _, body := range []string{"a", "b", "c"} {
+		frame, err := protocol.PackSynced(&protocol.Message{CmdType: protocol.CmdTypeMessage, Body: []byte(body)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		stream = append(stream, bytes.Repeat(badSyncedHeader, maxResyncs)...)
+		stream = append(stream, frame...)
+	}
+	r := bufio.NewReader(bytes.NewReader(stream))
+	for _, want := range []string{"a", "b", "c"} {
+		msg, err := s.readFrame(conn, r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(msg.Body) != want {
+			t.Fatalf("body = %q, want %q", msg.Body, want)
+		}
+	}
+	if _, err := s.readFrame(conn, r); err != io.EOF {
+		t.Fatalf("err at end of stream = %v, want io.EOF", err)
+	}
+}
+
+func TestReadFrameWithoutSyncClosesOnDesync(t *testing.T) {
+	conn, _ := newTestConn(t)
+	s := &TCPServer{}
+	_, err := s.readFrame(conn, bufio.NewReader(bytes.NewReader([]byte{0, 0, 0, 0, 0, 1, 0, 1})))
+	if !protocol.IsDesync(err) {
+		t.Fatalf("err = %v, want desync", err)
+	}
+}
@@ -0,0 +1,166 @@
+/*
+Package server - HAProxy PROXY 协议解析
+
+=== 为什么需要 PROXY 协议？===
+
+Go-IM 部署在 TCP 负载均衡（HAProxy、NLB 等）之后时：
+
+	Client(1.2.3.4) ──▶ LB(10.0.0.1) ──▶ Gateway
+
+Gateway 看到的 RemoteAddr 是 LB 的地址 10.0.0.1，
+按 IP 限流、审计日志都会失效。
+
+PROXY 协议由 LB 在连接建立后、业务数据之前写入一个头部，
+携带真实的客户端地址：
+
+	v1（文本）: "PROXY TCP4 1.2.3.4 10.0.0.1 56324 8080\r\n"
+	v2（二进制）: 12 字节签名 + 版本/命令 + 地址族 + 长度 + 地址
+
+=== 注意 ===
+
+开启后每个连接都必须以 PROXY 头开始，否则连接会被拒绝。
+只能在所有流量都经过 LB 时开启，否则客户端可以伪造地址。
+*/
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// ==================== 常量定义 ====================
+
+const (
+	// proxyV1MaxLength v1 头部最大长度（含 \r\n），见协议规范
+	proxyV1MaxLength = 107
+
+	// proxyV2HeaderLength v2 固定头部长度：签名(12) + 版本命令(1) + 地址族(1) + 长度(2)
+	proxyV2HeaderLength = 16
+)
+
+// proxyV2Signature v2 协议签名
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// ErrInvalidProxyHeader PROXY 头部缺失或格式错误
+var ErrInvalidProxyHeader = errors.New("invalid PROXY protocol header")
+
+// ==================== 解析入口 ====================
+
+// readProxyHeader 从连接开头读取 PROXY 头部，返回真实客户端地址
+//
+// 返回 nil 地址表示头部合法但不携带地址（v1 UNKNOWN / v2 LOCAL），
+// 此时调用方应继续使用底层连接的地址
+func readProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	sig, err := r.Peek(len(proxyV2Signature))
+	if err != nil {
+		return nil, err
+	}
+
+	if bytes.Equal(sig, proxyV2Signature) {
+		return readProxyV2(r)
+	}
+	if bytes.HasPrefix(sig, []byte("PROXY ")) {
+		return readProxyV1(r)
+	}
+	return nil, ErrInvalidProxyHeader
+}
+
+// ==================== v1 文本格式 ====================
+
+// readProxyV1 解析 v1 头部
+// 格式: PROXY <TCP4|TCP6|UNKNOWN> <src> <dst> <sport> <dport>\r\n
+func readProxyV1(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for len(line) < proxyV1MaxLength {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, ErrInvalidProxyHeader
+	}
+
+	fields := strings.Fields(string(line[:len(line)-2]))
+	if len(fields) < 2 || fields[0] != "PROXY" {
+		return nil, ErrInvalidProxyHeader
+	}
+	if fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, ErrInvalidProxyHeader
+	}
+
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.Atoi(fields[4])
+	if ip == nil || err != nil || port < 0 || port > 65535 {
+		return nil, ErrInvalidProxyHeader
+	}
+	return &net.TCPAddr{IP: ip, Port: port}, nil
+}
+
+// ==================== v2 二进制格式 ====================
+
+// readProxyV2 解析 v2 头部
+//
+//	+------------+---------+--------+--------+------------------+
+//	| 签名 12字节 | ver|cmd | fam    | len 2B | 地址 (len 字节)   |
+//	+------------+---------+--------+--------+------------------+
+func readProxyV2(r *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, proxyV2HeaderLength)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+
+	verCmd := header[12]
+	family := header[13]
+	length := binary.BigEndian.Uint16(header[14:16])
+
+	if verCmd>>4 != 2 {
+		return nil, fmt.Errorf("%w: unsupported version %d", ErrInvalidProxyHeader, verCmd>>4)
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+
+	// LOCAL 命令：LB 自身的健康检查连接，没有真实客户端地址
+	if verCmd&0x0F == 0x0 {
+		return nil, nil
+	}
+
+	switch family >> 4 {
+	case 0x1: // AF_INET: src(4) dst(4) sport(2) dport(2)
+		if len(payload) < 12 {
+			return nil, ErrInvalidProxyHeader
+		}
+		return &net.TCPAddr{
+			IP:   net.IP(payload[0:4]),
+			Port: int(binary.BigEndian.Uint16(payload[8:10])),
+		}, nil
+	case 0x2: // AF_INET6: src(16) dst(16) sport(2) dport(2)
+		if len(payload) < 36 {
+			return nil, ErrInvalidProxyHeader
+		}
+		return &net.TCPAddr{
+			IP:   net.IP(payload[0:16]),
+			Port: int(binary.BigEndian.Uint16(payload[32:34])),
+		}, nil
+	default:
+		// AF_UNSPEC / AF_UNIX：不携带可用的 TCP 地址
+		return nil, nil
+	}
+}
@@ -0,0 +1,111 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+// proxyV2 构造 v2 头部：verCmd 为版本/命令字节，family 为地址族字节
+func proxyV2(verCmd, family byte, payload []byte) []byte {
+	h := append([]byte(nil), proxyV2Signature...)
+	h = append(h, verCmd, family)
+	h = binary.BigEndian.AppendUint16(h, uint16(len(payload)))
+	return append(h, payload...)
+}
+
+// proxyV2Inet AF_INET 地址块：src dst sport dport
+func proxyV2Inet(src, dst string, sport, dport uint16) []byte {
+	b := append([]byte(nil), net.ParseIP(src).To4()...)
+	b = append(b, net.ParseIP(dst).To4()...)
+	b = binary.BigEndian.AppendUint16(b, sport)
+	return binary.BigEndian.AppendUint16(b, dport)
+}
+
+// proxyV2Inet6 AF_INET6 地址块：src dst sport dport
+func proxyV2Inet6(src, dst string, sport, dport uint16) []byte {
+	b := append([]byte(nil), net.ParseIP(src).To16()...)
+	b = append(b, net.ParseIP(dst).To16()...)
+	b = binary.BigEndian.AppendUint16(b, sport)
+	return binary.BigEndian.AppendUint16(b, dport)
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	inet := proxyV2Inet("1.2.3.4", "10.0.0.1", 56324, 8080)
+	inet6 := proxyV2Inet6("2001:db8::1", "2001:db8::2", 443, 8080)
+
+	tests := []struct {
+		name    string
+		header  []byte
+		addr    string // 空表示不携带地址
+		wantErr error  // nil 表示成功
+	}{
+		{"v1 tcp4", []byte("PROXY TCP4 1.2.3.4 10.0.0.1 56324 8080\r\n"), "1.2.3.4:56324", nil},
+		{"v1 tcp6", []byte("PROXY TCP6 2001:db8::1 2001:db8::2 443 8080\r\n"), "[2001:db8::1]:443", nil},
+		{"v1 unknown", []byte("PROXY UNKNOWN\r\n"), "", nil},
+		{"v1 unknown with addresses", []byte("PROXY UNKNOWN ffff::1 ffff::2 1 2\r\n"), "", nil},
+		{"v1 bad protocol", []byte("PROXY UDP4 1.2.3.4 10.0.0.1 1 2\r\n"), "", ErrInvalidProxyHeader},
+		{"v1 bad ip", []byte("PROXY TCP4 1.2.3 10.0.0.1 1 2\r\n"), "", ErrInvalidProxyHeader},
+		{"v1 bad port", []byte("PROXY TCP4 1.2.3.4 10.0.0.1 70000 2\r\n"), "", ErrInvalidProxyHeader},
+		{"v1 missing fields", []byte("PROXY TCP4 1.2.3.4\r\n"), "", ErrInvalidProxyHeader},
+		{"v1 bare newline", []byte("PROXY TCP4 1.2.3.4 10.0.0.1 1 2\n"), "", ErrInvalidProxyHeader},
+		{"v1 over-long", []byte("PROXY TCP4 " + strings.Repeat("1", proxyV1MaxLength) + "\r\n"), "", ErrInvalidProxyHeader},
+		{"v1 truncated", []byte("PROXY TCP4 1.2.3.4 10.0"), "", io.EOF},
+
+		{"v2 tcp4", proxyV2(0x21, 0x11, inet), "1.2.3.4:56324", nil},
+		{"v2 tcp6", proxyV2(0x21, 0x21, inet6), "[2001:db8::1]:443", nil},
+		{"v2 tcp4 with tlvs", proxyV2(0x21, 0x11, append(inet, 0x04, 0x00, 0x01, 0xff)), "1.2.3.4:56324", nil},
+		{"v2 local", proxyV2(0x20, 0x00, nil), "", nil},
+		{"v2 local ignores address", proxyV2(0x20, 0x11, inet), "", nil},
+		{"v2 unspec", proxyV2(0x21, 0x00, nil), "", nil},
+		{"v2 unix", proxyV2(0x21, 0x31, make([]byte, 216)), "", nil},
+		{"v2 bad version", proxyV2(0x11, 0x11, inet), "", ErrInvalidProxyHeader},
+		{"v2 short inet", proxyV2(0x21, 0x11, inet[:11]), "", ErrInvalidProxyHeader},
+		{"v2 short inet6", proxyV2(0x21, 0x21, inet6[:35]), "", ErrInvalidProxyHeader},
+		{"v2 truncated header", proxyV2(0x21, 0x11, inet)[:proxyV2HeaderLength-1], "", io.ErrUnexpectedEOF},
+		{"v2 truncated payload", proxyV2(0x21, 0x11, inet)[:proxyV2HeaderLength+5], "", io.ErrUnexpectedEOF},
+		{"v2 length beyond data", append(proxyV2(0x21, 0x11, nil)[:14], 0xff, 0xff), "", io.EOF},
+
+		{"no header", []byte("\x00\x10hello world!"), "", ErrInvalidProxyHeader},
+		{"too short to detect", []byte("PROXY"), "", io.EOF},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// 头部之后紧跟业务数据，解析不能多读
+			const rest = "\x00\x00\x00\x05hello"
+			r := bufio.NewReader(bytes.NewReader(append(append([]byte(nil), tt.header...), rest...)))
+			if tt.wantErr != nil {
+				r = bufio.NewReader(bytes.NewReader(tt.header))
+			}
+
+			addr, err := readProxyHeader(r)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("err = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			switch {
+			case tt.addr == "" && addr != nil:
+				t.Fatalf("addr = %v, want none", addr)
+			case tt.addr != "" && (addr == nil || addr.String() != tt.addr):
+				t.Fatalf("addr = %v, want %s", addr, tt.addr)
+			}
+
+			left, _ := io.ReadAll(r)
+			if string(left) != rest {
+				t.Fatalf("data after header = %q, want %q", left, rest)
+			}
+		})
+	}
+}
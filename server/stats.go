@@ -0,0 +1,150 @@
+/*
+Package server - 连接统计
+
+=== 使用场景 ===
+
+客户端行为异常（刷屏、只读不 ACK、频繁重连）往往是事后才被发现的。
+每个连接在关闭时输出一份摘要，便于事后分析：
+
+	{"conn_id":12,"user_id":"alice","lifetime_ms":73000,"compressed":true,
+	 "bytes_in":5120,"bytes_out":88210,
+	 "frames_in":{"Heartbeat":2,"Message":40},"frames_out":{"Message":310},
+	 "dropped":3,"throttled":0,"peak_queue_depth":256,"close_reason":"client_eof"}
+
+=== 统计口径 ===
+
+- bytes_in / frames_in：读取循环解出的帧，按线上字节数（压缩后）计算，包括心跳
+- bytes_out / frames_out：写循环真正写入网络的帧（被出站拦截器丢弃的不计）
+- dropped：写队列已满被丢弃的帧（见 ErrWriteQueueFull）
+- throttled：入站帧超过速率上限的次数（见 framerate.go）
+- peak_queue_depth：写队列的最大积压深度，接近 256 说明客户端读得太慢
+- close_reason：连接关闭的原因（见 close_reason.go）
+
+字节数和丢弃数用原子计数，按命令类型的帧数只由读/写循环各自更新，
+锁没有竞争，对吞吐没有可见影响。
+*/
+package server
+
+import (
+	"encoding/binary"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go-im/protocol"
+)
+
+// ConnStats 连接统计摘要（见 Connection.Stats）
+type ConnStats struct {
+	ConnID     uint64 `json:"conn_id"`
+	UserID     string `json:"user_id,omitempty"`
+	RemoteAddr string `json:"remote_addr"`
+	LifetimeMs int64  `json:"lifetime_ms"`
+	Compressed bool   `json:"compressed"`
+
+	BytesIn   uint64            `json:"bytes_in"`
+	BytesOut  uint64            `json:"bytes_out"`
+	FramesIn  map[string]uint64 `json:"frames_in"`
+	FramesOut map[string]uint64 `json:"frames_out"`
+
+	Dropped        uint64 `json:"dropped"`
+	Throttled      uint64 `json:"throttled"`
+	PeakQueueDepth int    `json:"peak_queue_depth"`
+
+	CloseReason string `json:"close_reason"`
+}
+
+// connStats 连接生命周期内的计数器
+type connStats struct {
+	connectedAt time.Time
+
+	bytesIn   atomic.Uint64
+	bytesOut  atomic.Uint64
+	dropped   atomic.Uint64
+	throttled atomic.Uint64
+	peakQueue atomic.Int64
+
+	// mu 保护按命令类型的帧计数
+	mu        sync.Mutex
+	framesIn  map[uint16]uint64
+	framesOut map[uint16]uint64
+}
+
+// recordInbound 记录读取循环解出的一帧
+func (c *Connection) recordInbound(msg *protocol.Message) {
+	// Length 不含自身的 4 字节
+	c.stats.bytesIn.Add(uint64(msg.Length) + 4)
+
+	c.stats.mu.Lock()
+	if c.stats.framesIn == nil {
+		c.stats.framesIn = make(map[uint16]uint64)
+	}
+	c.stats.framesIn[msg.CmdType]++
+	c.stats.mu.Unlock()
+}
+
+// recordOutbound 记录写循环写入网络的一帧
+func (c *Connection) recordOutbound(frame []byte) {
+	c.stats.bytesOut.Add(uint64(len(frame)))
+	if len(frame) < protocol.HeaderLength {
+		return
+	}
+
+	c.stats.mu.Lock()
+	if c.stats.framesOut == nil {
+		c.stats.framesOut = make(map[uint16]uint64)
+	}
+	c.stats.framesOut[binary.BigEndian.Uint16(frame[6:8])]++
+	c.stats.mu.Unlock()
+}
+
+// recordQueueDepth 记录写队列的积压深度，保留最大值
+func (c *Connection) recordQueueDepth(depth int) {
+	for {
+		peak := c.stats.peakQueue.Load()
+		if int64(depth) <= peak || c.stats.peakQueue.CompareAndSwap(peak, int64(depth)) {
+			return
+		}
+	}
+}
+
+// Stats 返回连接到目前为止的统计摘要（连接关闭前后都可以调用）
+func (c *Connection) Stats() *ConnStats {
+	s := &ConnStats{
+		ConnID:     c.ID,
+		UserID:     c.GetUserID(),
+		RemoteAddr: c.RemoteAddr().String(),
+		LifetimeMs: time.Since(c.stats.connectedAt).Milliseconds(),
+		Compressed: c.compress.Load(),
+
+		BytesIn:  c.stats.bytesIn.Load(),
+		BytesOut: c.stats.bytesOut.Load(),
+
+		Dropped:        c.stats.dropped.Load(),
+		Throttled:      c.stats.throttled.Load(),
+		PeakQueueDepth: int(c.stats.peakQueue.Load()),
+
+		CloseReason: c.CloseReason().String(),
+	}
+
+	c.stats.mu.Lock()
+	s.FramesIn = namedCounts(c.stats.framesIn)
+	s.FramesOut = namedCounts(c.stats.framesOut)
+	c.stats.mu.Unlock()
+	return s
+}
+
+// namedCounts 命令类型 → 可读名称
+func namedCounts(counts map[uint16]uint64) map[string]uint64 {
+	named := make(map[string]uint64, len(counts))
+	for cmd, n := range counts {
+		named[protocol.CmdTypeName(cmd)] += n
+	}
+	return named
+}
+
+// SetStatsSink 设置连接统计摘要的接收函数
+// 每个连接关闭时调用一次（在 OnDisconnect 回调之后），nil 表示不输出
+func (s *TCPServer) SetStatsSink(fn func(*ConnStats)) {
+	s.statsSink = fn
+}
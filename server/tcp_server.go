@@ -1,318 +1,597 @@
-/*
-Package server - TCP 服务器实现
-
-=== Go 的高并发网络模型 ===
-
-本项目采用 Goroutine-per-Connection 模型：
-- 每个客户端连接分配一个独立的 Goroutine 处理
-- 代码写起来像同步阻塞，但底层是非阻塞的
-- Go 运行时的 Netpoller 负责将阻塞调用转换为高效的 epoll 事件
-
-对比传统模型：
-
-1. 多线程模型 (每连接一线程)
-  - 问题：线程创建开销大，1万连接 = 1万线程 = 内存爆炸
-  - C10K 问题的根源
-
-2. 事件驱动模型 (Reactor/epoll 回调)
-  - 如：Nginx、Redis、Netty
-  - 问题：代码复杂，需要手动管理状态机
-
-3. Goroutine 模型 (本项目) ✓
-  - 每连接一 Goroutine，但 Goroutine 很轻量（2KB 初始栈）
-  - 1万连接 = 1万 Goroutine = 约 20MB 内存
-  - 底层自动使用 epoll，开发者无感知
-
-=== 架构图 ===
-
-	┌─────────────────────────────────────────────────┐
-	│                   TCP Server                     │
-	│  ┌─────────────────────────────────────────┐    │
-	│  │            Accept Loop                   │    │
-	│  │    listener.Accept() → 新连接            │    │
-	│  └──────────────────┬──────────────────────┘    │
-	│                     │ 每个连接启动一个 Goroutine  │
-	│        ┌────────────┼────────────┐              │
-	│        ▼            ▼            ▼              │
-	│   ┌─────────┐  ┌─────────┐  ┌─────────┐        │
-	│   │ Conn 1  │  │ Conn 2  │  │ Conn N  │        │
-	│   │Goroutine│  │Goroutine│  │Goroutine│        │
-	│   └─────────┘  └─────────┘  └─────────┘        │
-	│        │            │            │              │
-	│   ┌────┴────────────┴────────────┴────┐        │
-	│   │        Connection Manager          │        │
-	│   │       (UID → Connection 映射)      │        │
-	│   └────────────────────────────────────┘        │
-	└─────────────────────────────────────────────────┘
-*/
-package server
-
-import (
-	"bufio"
-	"fmt"
-	"go-im/protocol"
-	"log"
-	"net"
-	"sync"
-	"sync/atomic"
-)
-
-// ==================== 接口定义 ====================
-
-// MessageHandler 消息处理器接口
-// 使用接口实现 TCP 层与业务层的解耦
-// TCP 层只负责网络 I/O，具体业务逻辑由实现此接口的对象处理
-type MessageHandler interface {
-	HandleConnection(conn *Connection, msg *protocol.Message)
-}
-
-// ==================== TCP 服务器结构体 ====================
-
-// TCPServer TCP 服务器
-// 职责：监听端口、接受连接、管理连接生命周期
-type TCPServer struct {
-	// addr 监听地址，如 ":8080" 或 "0.0.0.0:8080"
-	addr string
-
-	// gatewayID 网关唯一标识
-	// 在分布式部署中区分不同的网关节点
-	gatewayID string
-
-	// listener TCP 监听器
-	// 调用 Accept() 接受新连接
-	listener net.Listener
-
-	// quit 关闭信号通道
-	// 实现优雅关闭：close(quit) 通知所有 Goroutine 退出
-	quit chan struct{}
-
-	// wg WaitGroup 用于等待所有 Goroutine 结束
-	// 确保优雅关闭时不丢失正在处理的消息
-	wg sync.WaitGroup
-
-	// connID 连接 ID 计数器
-	// 使用 atomic 保证并发安全的自增
-	connID uint64
-
-	// ConnManager 连接管理器
-	// 维护 UID → Connection 的映射，用于消息路由
-	ConnManager *ConnectionManager
-
-	// handler 消息处理器
-	// 收到消息后委托给它处理（依赖注入）
-	handler MessageHandler
-}
-
-// ==================== 构造函数 ====================
-
-// NewTCPServer 创建新的 TCP 服务器实例
-// 参数:
-//   - addr: 监听地址，如 ":8080"
-//   - gatewayID: 网关标识，如 "gateway_1"
-func NewTCPServer(addr, gatewayID string) *TCPServer {
-	return &TCPServer{
-		addr:        addr,
-		gatewayID:   gatewayID,
-		quit:        make(chan struct{}), // 无缓冲通道，用于广播关闭信号
-		ConnManager: NewConnectionManager(),
-	}
-}
-
-// SetHandler 设置消息处理器（依赖注入）
-func (s *TCPServer) SetHandler(handler MessageHandler) {
-	s.handler = handler
-}
-
-// ==================== 服务器生命周期 ====================
-
-// Start 启动 TCP 服务器
-// 这是一个非阻塞调用，实际的监听在单独的 Goroutine 中进行
-func (s *TCPServer) Start() error {
-	// 创建 TCP 监听器
-	// net.Listen 会绑定端口，但还不会接受连接
-	listener, err := net.Listen("tcp", s.addr)
-	if err != nil {
-		return fmt.Errorf("failed to listen on %s: %w", s.addr, err)
-	}
-	s.listener = listener
-	log.Printf("[Server] Gateway %s started on %s", s.gatewayID, s.addr)
-
-	// 启动接受连接的 Goroutine
-	s.wg.Add(1)
-	go s.acceptLoop()
-
-	return nil
-}
-
-// Stop 优雅关闭服务器
-// 优雅关闭 (Graceful Shutdown) 的步骤：
-// 1. 停止接受新连接
-// 2. 等待现有连接处理完成
-// 3. 通知客户端重连（可选）
-// 4. 关闭所有资源
-//
-// 为什么需要优雅关闭？
-// - 防止消息丢失
-// - 让客户端有机会重连到其他节点
-// - 在滚动更新时保证服务可用性
-func (s *TCPServer) Stop() {
-	log.Println("[Server] Initiating graceful shutdown...")
-
-	// 步骤 1: 关闭 quit 通道，广播关闭信号
-	// 所有 select 监听 quit 的 Goroutine 都会收到通知
-	close(s.quit)
-
-	// 步骤 2: 关闭 listener，使 Accept() 返回错误
-	if s.listener != nil {
-		s.listener.Close()
-	}
-
-	// 步骤 3: 等待所有 Goroutine 结束
-	log.Println("[Server] Waiting for existing connections to finish...")
-	s.wg.Wait()
-
-	log.Println("[Server] Server stopped gracefully")
-}
-
-// ==================== 连接接受循环 ====================
-
-// acceptLoop 持续接受新的客户端连接
-// 这是服务器的主循环，运行在独立的 Goroutine 中
-func (s *TCPServer) acceptLoop() {
-	defer s.wg.Done()
-
-	for {
-		// Accept 会阻塞直到有新连接到来
-		// Go 运行时会在底层使用 epoll 等待，不会占用 CPU
-		conn, err := s.listener.Accept()
-		if err != nil {
-			// 检查是否是关闭信号导致的错误
-			select {
-			case <-s.quit:
-				// 正常关闭，退出循环
-				return
-			default:
-				// 其他错误，记录日志继续
-				log.Printf("[Server] Accept error: %v", err)
-				continue
-			}
-		}
-
-		// 为新连接分配唯一 ID
-		// atomic.AddUint64 保证并发安全
-		connID := atomic.AddUint64(&s.connID, 1)
-
-		// 每个连接启动一个 Goroutine 处理
-		// 这就是 Goroutine-per-Connection 模型
-		s.wg.Add(1)
-		go s.handleConnection(conn, connID)
-	}
-}
-
-// ==================== 连接处理 ====================
-
-// handleConnection 处理单个客户端连接
-// 这是每个连接的主循环，负责：
-// 1. 读取消息
-// 2. 分发给业务处理器
-// 3. 管理连接生命周期
-func (s *TCPServer) handleConnection(netConn net.Conn, connID uint64) {
-	defer s.wg.Done()
-
-	clientAddr := netConn.RemoteAddr().String()
-	log.Printf("[Conn-%d] New connection from %s", connID, clientAddr)
-
-	// 创建连接包装器
-	// Connection 提供了更高级的抽象：用户绑定、异步写入等
-	conn := NewConnection(connID, netConn)
-	s.ConnManager.Add(conn)
-
-	// ★★★ 关键：启动写入协程 ★★★
-	// Connection 使用通道实现异步写入
-	// 必须启动 writeLoop 才能真正发送消息
-	go conn.writeLoop()
-
-	// 确保连接关闭时清理资源
-	defer func() {
-		s.ConnManager.Remove(conn)
-		conn.Close()
-		log.Printf("[Conn-%d] Connection closed", connID)
-	}()
-
-	// 创建带缓冲的 Reader
-	// bufio.Reader 提供缓冲，减少系统调用次数
-	reader := bufio.NewReader(netConn)
-
-	// 连接的读取循环
-	for {
-		// 检查关闭信号
-		select {
-		case <-s.quit:
-			// 服务器关闭，发送重连指令
-			s.sendReconnectInstruction(conn)
-			return
-		case <-conn.closeChan:
-			// 连接已关闭
-			return
-		default:
-			// 继续处理
-		}
-
-		// 读取并解析消息
-		// Unpack 会阻塞直到读取到完整消息
-		msg, err := protocol.Unpack(reader)
-		if err != nil {
-			if err.Error() != "EOF" {
-				log.Printf("[Conn-%d] Read error: %v", connID, err)
-			}
-			return
-		}
-
-		// 心跳消息直接处理，不走业务逻辑
-		if msg.CmdType == protocol.CmdTypeHeartbeat {
-			s.handleHeartbeat(conn)
-			continue
-		}
-
-		// 其他消息委托给业务处理器
-		if s.handler != nil {
-			s.handler.HandleConnection(conn, msg)
-		}
-	}
-}
-
-// ==================== 心跳处理 ====================
-
-// handleHeartbeat 处理心跳请求
-// 心跳的作用：
-// 1. 保持连接活跃（NAT 穿透、防止被中间设备断开）
-// 2. 检测连接是否存活
-// 3. 服务端可以据此更新用户在线状态
-func (s *TCPServer) handleHeartbeat(conn *Connection) {
-	// 回复 pong
-	ack := &protocol.Message{
-		CmdType: protocol.CmdTypeHeartbeat,
-		Body:    []byte("pong"),
-	}
-	conn.Send(ack)
-}
-
-// ==================== 优雅关闭辅助 ====================
-
-// sendReconnectInstruction 发送重连指令
-// 在服务器关闭时通知客户端：
-// - 服务器即将关闭
-// - 请重新连接到其他节点
-// 这是优雅关闭的重要组成部分
-func (s *TCPServer) sendReconnectInstruction(conn *Connection) {
-	msg := &protocol.Message{
-		CmdType: protocol.CmdTypeKick,
-		Body:    []byte(`{"reason":"server_restart","reconnect":true}`),
-	}
-	conn.Send(msg)
-}
-
-// GetGatewayID 获取网关 ID
-func (s *TCPServer) GetGatewayID() string {
-	return s.gatewayID
-}
+/*
+Package server - TCP 服务器实现
+
+=== Go 的高并发网络模型 ===
+
+本项目采用 Goroutine-per-Connection 模型：
+- 每个客户端连接分配一个独立的 Goroutine 处理
+- 代码写起来像同步阻塞，但底层是非阻塞的
+- Go 运行时的 Netpoller 负责将阻塞调用转换为高效的 epoll 事件
+
+对比传统模型：
+
+1. 多线程模型 (每连接一线程)
+  - 问题：线程创建开销大，1万连接 = 1万线程 = 内存爆炸
+  - C10K 问题的根源
+
+2. 事件驱动模型 (Reactor/epoll 回调)
+  - 如：Nginx、Redis、Netty
+  - 问题：代码复杂，需要手动管理状态机
+
+3. Goroutine 模型 (本项目) ✓
+  - 每连接一 Goroutine，但 Goroutine 很轻量（2KB 初始栈）
+  - 1万连接 = 1万 Goroutine = 约 20MB 内存
+  - 底层自动使用 epoll，开发者无感知
+
+=== 架构图 ===
+
+	┌─────────────────────────────────────────────────┐
+	│                   TCP Server                     │
+	│  ┌─────────────────────────────────────────┐    │
+	│  │            Accept Loop                   │    │
+	│  │    listener.Accept() → 新连接            │    │
+	│  └──────────────────┬──────────────────────┘    │
+	│                     │ 每个连接启动一个 Goroutine  │
+	│        ┌────────────┼────────────┐              │
+	│        ▼            ▼            ▼              │
+	│   ┌─────────┐  ┌─────────┐  ┌─────────┐        │
+	│   │ Conn 1  │  │ Conn 2  │  │ Conn N  │        │
+	│   │Goroutine│  │Goroutine│  │Goroutine│        │
+	│   └─────────┘  └─────────┘  └─────────┘        │
+	│        │            │            │              │
+	│   ┌────┴────────────┴────────────┴────┐        │
+	│   │        Connection Manager          │        │
+	│   │       (UID → Connection 映射)      │        │
+	│   └────────────────────────────────────┘        │
+	└─────────────────────────────────────────────────┘
+*/
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"go-im/protocol"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// proxyHeaderTimeout 读取 PROXY 协议头的超时时间
+const proxyHeaderTimeout = 5 * time.Second
+
+// ==================== 接口定义 ====================
+
+// MessageHandler 消息处理器接口
+// 使用接口实现 TCP 层与业务层的解耦
+// TCP 层只负责网络 I/O，具体业务逻辑由实现此接口的对象处理
+type MessageHandler interface {
+	HandleConnection(conn *Connection, msg *protocol.Message)
+}
+
+// ==================== TCP 服务器结构体 ====================
+
+// TCPServer TCP 服务器
+// 职责：监听端口、接受连接、管理连接生命周期
+type TCPServer struct {
+	// addr 监听地址，如 ":8080" 或 "0.0.0.0:8080"
+	addr string
+
+	// gatewayID 网关唯一标识
+	// 在分布式部署中区分不同的网关节点
+	gatewayID string
+
+	// listener TCP 监听器
+	// 调用 Accept() 接受新连接
+	listener net.Listener
+
+	// quit 关闭信号通道
+	// 实现优雅关闭：close(quit) 通知所有 Goroutine 退出
+	quit chan struct{}
+
+	// wg WaitGroup 用于等待所有 Goroutine 结束
+	// 确保优雅关闭时不丢失正在处理的消息
+	wg sync.WaitGroup
+
+	// connID 连接 ID 计数器
+	// 使用 atomic 保证并发安全的自增
+	connID uint64
+
+	// ConnManager 连接管理器
+	// 维护 UID → Connection 的映射，用于消息路由
+	ConnManager *ConnectionManager
+
+	// handler 消息处理器
+	// 收到消息后委托给它处理（依赖注入）
+	handler MessageHandler
+
+	// proxyProtocol 是否解析 HAProxy PROXY 协议头
+	// 部署在 TCP 负载均衡之后时开启，用于获取真实客户端 IP
+	proxyProtocol bool
+
+	// inboundQueueSize 每个连接的入站队列长度（0 表示在读取循环中同步处理）
+	inboundQueueSize int
+
+	// frameRate 每个连接的入站帧速率上限（帧/秒，0 表示不限制），framePolicy 超限策略（见 framerate.go）
+	frameRate   int
+	framePolicy string
+
+	// frameSync 入站帧是否带同步标记（见 framesync.go）
+	frameSync bool
+
+	// onDisconnect 连接断开时的业务回调（如登出会话），在连接清理中执行一次
+	onDisconnect func(*Connection)
+
+	// statsSink 连接关闭时接收统计摘要（见 stats.go）
+	statsSink func(*ConnStats)
+
+	// heartbeatHook 处理心跳捎带的数据（JSON 心跳体，仅已认证连接）
+	heartbeatHook func(conn *Connection, body []byte)
+
+	// alternates 返回可供客户端重连的其他网关地址（见 SetAlternates）
+	alternates func() []string
+
+	// shutdownHint 关闭时发给客户端的重连提示，在 Stop 开始时生成一次
+	shutdownHint []byte
+
+	// draining 是否处于排空模式（见 Drain）
+	draining atomic.Bool
+
+	// goroutineBudget 连接相关 Goroutine 的上限，0 表示不限制（见 budget.go）
+	goroutineBudget int64
+
+	// connGoroutines 当前连接相关的 Goroutine 数
+	connGoroutines atomic.Int64
+
+	// reaping 是否正在回收空闲连接
+	reaping atomic.Bool
+}
+
+// ==================== 构造函数 ====================
+
+// NewTCPServer 创建新的 TCP 服务器实例
+// 参数:
+//   - addr: 监听地址，如 ":8080"
+//   - gatewayID: 网关标识，如 "gateway_1"
+func NewTCPServer(addr, gatewayID string) *TCPServer {
+	return &TCPServer{
+		addr:        addr,
+		gatewayID:   gatewayID,
+		quit:        make(chan struct{}), // 无缓冲通道，用于广播关闭信号
+		ConnManager: NewConnectionManager(),
+	}
+}
+
+// SetHandler 设置消息处理器（依赖注入）
+func (s *TCPServer) SetHandler(handler MessageHandler) {
+	s.handler = handler
+}
+
+// SetProxyProtocol 开启/关闭 PROXY 协议解析
+// 开启后每个连接必须以 PROXY 头开始，否则会被拒绝
+func (s *TCPServer) SetProxyProtocol(enabled bool) {
+	s.proxyProtocol = enabled
+}
+
+// SetInboundQueue 开启每连接的有界入站队列
+//
+// 默认情况下业务处理器在读取循环中同步执行，处理器做 Redis I/O 时
+// 读取循环也随之停顿。开启后：
+//   - 读取循环只负责解包和入队，可以领先处理器读取后续帧
+//   - 每个连接一个工作协程按到达顺序处理，保持连接内的消息顺序
+//   - 队列满时读取循环阻塞（背压），最终通过 TCP 窗口传导到客户端
+//
+// size <= 0 表示关闭（同步处理）
+func (s *TCPServer) SetInboundQueue(size int) {
+	s.inboundQueueSize = size
+}
+
+// SetOnDisconnect 设置连接断开时的业务回调
+// 回调在连接从 ConnectionManager 移除之后、底层连接关闭之前执行，
+// 每个连接只执行一次
+func (s *TCPServer) SetOnDisconnect(fn func(*Connection)) {
+	s.onDisconnect = fn
+}
+
+// SetAlternates 设置重连提示中备选网关地址的来源
+// 关闭和排空时各调用一次，结果附在发给所有客户端的 CmdTypeKick 中
+func (s *TCPServer) SetAlternates(fn func() []string) {
+	s.alternates = fn
+}
+
+// ==================== 服务器生命周期 ====================
+
+// Start 启动 TCP 服务器
+// 这是一个非阻塞调用，实际的监听在单独的 Goroutine 中进行
+func (s *TCPServer) Start() error {
+	// 创建 TCP 监听器
+	// net.Listen 会绑定端口，但还不会接受连接
+	listener, err := net.Listen("tcp", s.addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", s.addr, err)
+	}
+	s.listener = listener
+	log.Printf("[Server] Gateway %s started on %s", s.gatewayID, s.addr)
+
+	// 启动接受连接的 Goroutine
+	s.wg.Add(1)
+	go s.acceptLoop()
+
+	return nil
+}
+
+// Addr 实际监听的地址（Start 之前为 nil）
+// 监听 ":0" 时用它获取系统分配的端口
+func (s *TCPServer) Addr() net.Addr {
+	if s.listener == nil {
+		return nil
+	}
+	return s.listener.Addr()
+}
+
+// Stop 优雅关闭服务器
+// 优雅关闭 (Graceful Shutdown) 的步骤：
+// 1. 停止接受新连接
+// 2. 等待现有连接处理完成
+// 3. 通知客户端重连（可选）
+// 4. 关闭所有资源
+//
+// 为什么需要优雅关闭？
+// - 防止消息丢失
+// - 让客户端有机会重连到其他节点
+// - 在滚动更新时保证服务可用性
+func (s *TCPServer) Stop() {
+	log.Println("[Server] Initiating graceful shutdown...")
+
+	// 备选网关只查询一次，所有连接共用同一个提示
+	s.shutdownHint = s.reconnectHint("server_restart")
+
+	// 步骤 1: 关闭 quit 通道，广播关闭信号
+	// 所有 select 监听 quit 的 Goroutine 都会收到通知
+	close(s.quit)
+
+	// 步骤 2: 关闭 listener，使 Accept() 返回错误
+	// 排空模式下 listener 已经关闭
+	if s.listener != nil && !s.draining.Load() {
+		s.listener.Close()
+	}
+
+	// 步骤 3: 等待所有 Goroutine 结束
+	log.Println("[Server] Waiting for existing connections to finish...")
+	s.wg.Wait()
+
+	log.Println("[Server] Server stopped gracefully")
+}
+
+// ==================== 连接接受循环 ====================
+
+// acceptLoop 持续接受新的客户端连接
+// 这是服务器的主循环，运行在独立的 Goroutine 中
+func (s *TCPServer) acceptLoop() {
+	defer s.wg.Done()
+
+	for {
+		// Accept 会阻塞直到有新连接到来
+		// Go 运行时会在底层使用 epoll 等待，不会占用 CPU
+		conn, err := s.listener.Accept()
+		if err != nil {
+			// 检查是否是关闭信号导致的错误
+			select {
+			case <-s.quit:
+				// 正常关闭，退出循环
+				return
+			default:
+				// 排空模式关闭了 listener，同样退出
+				if s.draining.Load() {
+					return
+				}
+				// 其他错误，记录日志继续
+				log.Printf("[Server] Accept error: %v", err)
+				continue
+			}
+		}
+
+		// Goroutine 预算用完时拒绝新连接
+		if !s.admitConnection() {
+			log.Printf("[Server] Goroutine budget exhausted, rejecting connection from %s", conn.RemoteAddr())
+			conn.Close()
+			continue
+		}
+
+		// 为新连接分配唯一 ID
+		// atomic.AddUint64 保证并发安全
+		connID := atomic.AddUint64(&s.connID, 1)
+
+		// 每个连接启动一个 Goroutine 处理
+		// 这就是 Goroutine-per-Connection 模型
+		s.wg.Add(1)
+		s.goConn(func() { s.handleConnection(conn, connID) })
+	}
+}
+
+// ==================== 连接处理 ====================
+
+// handleConnection 处理单个客户端连接
+// 这是每个连接的主循环，负责：
+// 1. 读取消息
+// 2. 分发给业务处理器
+// 3. 管理连接生命周期
+func (s *TCPServer) handleConnection(netConn net.Conn, connID uint64) {
+	defer s.wg.Done()
+
+	// 创建带缓冲的 Reader
+	// bufio.Reader 提供缓冲，减少系统调用次数
+	reader := bufio.NewReader(netConn)
+
+	// 解析 PROXY 协议头，获取负载均衡之后的真实客户端地址
+	var realAddr net.Addr
+	if s.proxyProtocol {
+		netConn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+		addr, err := readProxyHeader(reader)
+		netConn.SetReadDeadline(time.Time{})
+		if err != nil {
+			log.Printf("[Conn-%d] Rejecting connection from %s: %v", connID, netConn.RemoteAddr(), err)
+			netConn.Close()
+			return
+		}
+		realAddr = addr
+	}
+
+	// 创建连接包装器
+	// Connection 提供了更高级的抽象：用户绑定、异步写入等
+	conn := NewConnection(connID, netConn)
+	if realAddr != nil {
+		conn.SetRemoteAddr(realAddr)
+	}
+	conn.SetTeardown(s.teardown)
+	s.ConnManager.Add(conn)
+
+	log.Printf("[Conn-%d] New connection from %s", connID, conn.RemoteAddr())
+
+	// ★★★ 关键：启动写入协程 ★★★
+	// Connection 使用通道实现异步写入
+	// 必须启动 writeLoop 才能真正发送消息
+	s.goConn(conn.writeLoop)
+
+	// 确保连接关闭时清理资源
+	// 具体清理在 teardown 中执行，写循环先发现错误时也走同一路径
+	reason := CloseReasonUnknown
+	defer func() { conn.Close(reason) }()
+
+	// 入站队列（可选）：工作协程按序处理，读取循环退出时等待队列处理完
+	// 这个 defer 在上面的 Close 之前执行，保证队列中的消息先处理完
+	var inbound chan *protocol.Message
+	if s.inboundQueueSize > 0 && s.handler != nil {
+		inbound = make(chan *protocol.Message, s.inboundQueueSize)
+		workerDone := make(chan struct{})
+		s.goConn(func() {
+			defer close(workerDone)
+			for msg := range inbound {
+				s.dispatch(conn, msg)
+			}
+		})
+		defer func() {
+			close(inbound)
+			<-workerDone
+		}()
+	}
+
+	// 入站帧速率限制（未设置时为 nil）
+	governor := newFrameGovernor(s.frameRate)
+
+	// 连接的读取循环
+	for {
+		// 检查关闭信号
+		select {
+		case <-s.quit:
+			// 服务器关闭，发送重连指令
+			s.sendReconnectInstruction(conn)
+			reason = CloseReasonShutdown
+			return
+		case <-conn.closeChan:
+			// 连接已关闭
+			return
+		default:
+			// 继续处理
+		}
+
+		// 读取并解析消息
+		// Unpack 会阻塞直到读取到完整消息
+		msg, err := s.readFrame(conn, reader)
+		if err != nil {
+			reason = readCloseReason(err)
+			switch reason {
+			case CloseReasonClientEOF:
+			case CloseReasonDesync:
+				log.Printf("[Conn-%d] Protocol stream desynchronized (%v), closing connection", connID, err)
+			default:
+				log.Printf("[Conn-%d] Read error: %v", connID, err)
+			}
+			return
+		}
+		conn.updateLastActive()
+		conn.recordInbound(msg)
+		if conn.tracing.Load() {
+			conn.traceInbound(msg)
+		}
+
+		// 帧速率超限：暂停读取（throttle）或关闭连接（close）
+		// 健康检查不计数，与认证前的分发一致：负载均衡的探测不能被限速或断开
+		if msg.CmdType != protocol.CmdTypeHealth && !s.governFrame(conn, governor) {
+			if s.framePolicy == FramePolicyClose {
+				log.Printf("[Conn-%d] Frame rate above %d/s, closing connection", connID, s.frameRate)
+				reason = CloseReasonFrameFlood
+			}
+			return
+		}
+
+		// 心跳消息直接处理，不走业务逻辑
+		if msg.CmdType == protocol.CmdTypeHeartbeat {
+			s.handleHeartbeat(conn, msg.Body)
+			continue
+		}
+
+		// 其他消息委托给业务处理器
+		if inbound != nil {
+			if !s.enqueueInbound(conn, inbound, msg) {
+				return
+			}
+		} else if s.handler != nil {
+			s.dispatch(conn, msg)
+		}
+	}
+}
+
+// enqueueInbound 将消息放入连接的入站队列
+// 队列满时阻塞等待（背压），连接关闭时返回 false
+func (s *TCPServer) enqueueInbound(conn *Connection, inbound chan<- *protocol.Message, msg *protocol.Message) bool {
+	select {
+	case inbound <- msg:
+		return true
+	default:
+	}
+
+	log.Printf("[Conn-%d] Inbound queue full, applying backpressure", conn.ID)
+	select {
+	case inbound <- msg:
+		return true
+	case <-conn.closeChan:
+		return false
+	}
+}
+
+// teardown 连接清理，由 Connection.Close 保证只执行一次
+// 顺序：移除连接 → 业务回调（登出） → （Close 随后关闭底层连接）
+// 执行时关闭原因已经记录，回调中可以通过 conn.CloseReason() 读取
+func (s *TCPServer) teardown(conn *Connection) {
+	s.ConnManager.Remove(conn)
+	if s.onDisconnect != nil {
+		s.onDisconnect(conn)
+	}
+	if s.statsSink != nil {
+		s.statsSink(conn.Stats())
+	}
+	log.Printf("[Conn-%d] Connection closed (%s)", conn.ID, conn.CloseReason())
+}
+
+// ==================== 排空模式 ====================
+
+// Drain 进入排空模式（滚动升级）
+//
+// 与 Stop 不同，排空模式只是不再接受新连接：
+//  1. 关闭 listener，新连接被拒绝
+//  2. 每隔 interval 向一个现有连接发送重连提示，避免所有客户端同时重连
+//  3. 已有连接继续正常收发消息，直到客户端自行断开或调用 Stop
+//
+// 重复调用无效果
+func (s *TCPServer) Drain(interval time.Duration) {
+	if !s.draining.CompareAndSwap(false, true) {
+		return
+	}
+	log.Println("[Server] Entering drain mode, no longer accepting connections")
+
+	if s.listener != nil {
+		s.listener.Close()
+	}
+
+	go func() {
+		hint := s.reconnectHint("drain")
+
+		var conns []*Connection
+		s.ConnManager.Range(func(conn *Connection) bool {
+			conns = append(conns, conn)
+			return true
+		})
+
+		for _, conn := range conns {
+			select {
+			case <-s.quit:
+				return
+			default:
+			}
+			if !conn.IsClosed() {
+				conn.SendControl(&protocol.Message{
+					CmdType: protocol.CmdTypeKick,
+					Body:    hint,
+				})
+			}
+			time.Sleep(interval)
+		}
+		log.Printf("[Server] Sent reconnect hints to %d connections", len(conns))
+	}()
+}
+
+// IsDraining 是否处于排空模式
+func (s *TCPServer) IsDraining() bool {
+	return s.draining.Load()
+}
+
+// ==================== 心跳处理 ====================
+
+// handleHeartbeat 处理心跳请求
+// 心跳的作用：
+// 1. 保持连接活跃（NAT 穿透、防止被中间设备断开）
+// 2. 检测连接是否存活
+// 3. 服务端可以据此更新用户在线状态
+//
+// 心跳体可以是普通的 "ping"，也可以是 JSON 对象捎带业务数据（如已读位置），
+// 后者先回复 pong，再交给 SetHeartbeatHook 设置的处理函数
+func (s *TCPServer) handleHeartbeat(conn *Connection, body []byte) {
+	// 回复 pong
+	ack := &protocol.Message{
+		CmdType: protocol.CmdTypeHeartbeat,
+		Body:    []byte("pong"),
+	}
+	conn.Send(ack)
+
+	if s.heartbeatHook != nil && len(body) > 0 && body[0] == '{' && conn.IsAuthenticated() {
+		s.heartbeatHook(conn, body)
+	}
+}
+
+// SetHeartbeatHook 设置心跳捎带数据的处理函数
+// 在读取循环中同步调用，处理函数应尽快返回
+func (s *TCPServer) SetHeartbeatHook(fn func(conn *Connection, body []byte)) {
+	s.heartbeatHook = fn
+}
+
+// ==================== 优雅关闭辅助 ====================
+
+// sendReconnectInstruction 发送重连指令
+// 在服务器关闭时通知客户端：
+// - 服务器即将关闭
+// - 请重新连接到其他节点
+// 这是优雅关闭的重要组成部分
+func (s *TCPServer) sendReconnectInstruction(conn *Connection) {
+	msg := &protocol.Message{
+		CmdType: protocol.CmdTypeKick,
+		Body:    s.shutdownHint,
+	}
+	conn.SendControl(msg)
+}
+
+// ReconnectHint 要求客户端重连的 CmdTypeKick 消息体
+type ReconnectHint struct {
+	Reason    string `json:"reason"`
+	Reconnect bool   `json:"reconnect"`
+
+	// Alternates 可以直接连接的其他网关地址，负载低的在前（为空时客户端自行选择）
+	Alternates []string `json:"alternates,omitempty"`
+}
+
+// reconnectHint 生成重连提示
+func (s *TCPServer) reconnectHint(reason string) []byte {
+	hint := &ReconnectHint{Reason: reason, Reconnect: true}
+	if s.alternates != nil {
+		hint.Alternates = s.alternates()
+	}
+	data, _ := json.Marshal(hint)
+	return data
+}
+
+// GetGatewayID 获取网关 ID
+func (s *TCPServer) GetGatewayID() string {
+	return s.gatewayID
+}
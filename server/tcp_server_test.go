@@ -0,0 +1,257 @@
+package server
+
+import (
+	"bufio"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"go-im/protocol"
+)
+
+// handlerFunc 把函数适配为 MessageHandler
+type handlerFunc func(conn *Connection, msg *protocol.Message)
+
+func (f handlerFunc) HandleConnection(conn *Connection, msg *protocol.Message) {
+	f(conn, msg)
+}
+
+// startTestServer 在随机端口上启动服务器，configure 在 Start 之前调整配置
+// 测试结束时停止服务器（Stop 等待所有连接退出，客户端应先关闭）
+func startTestServer(t *testing.T, handler MessageHandler, configure func(s *TCPServer)) *TCPServer {
+	t.Helper()
+	s := NewTCPServer("127.0.0.1:0", "gateway_test")
+	s.SetHandler(handler)
+	if configure != nil {
+		configure(s)
+	}
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.Stop)
+	return s
+}
+
+// dialTestServer 连接测试服务器，测试结束时（服务器停止之前）关闭
+func dialTestServer(t *testing.T, s *TCPServer) (net.Conn, *bufio.Reader) {
+	t.Helper()
+	c, err := net.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c, bufio.NewReader(c)
+}
+
+// writeFrame 客户端发送一帧
+func writeFrame(t *testing.T, c net.Conn, cmdType uint16, body string) {
+	t.Helper()
+	data, err := protocol.Pack(&protocol.Message{CmdType: cmdType, Body: []byte(body)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Write(data); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// recorder 记录处理器收到的消息体，第一条消息阻塞到 release 关闭
+type recorder struct {
+	mu      sync.Mutex
+	bodies  []string
+	release chan struct{}
+}
+
+func newRecorder() *recorder {
+	return &recorder{release: make(chan struct{})}
+}
+
+func (r *recorder) HandleConnection(conn *Connection, msg *protocol.Message) {
+	r.mu.Lock()
+	first := len(r.bodies) == 0
+	r.bodies = append(r.bodies, string(msg.Body))
+	r.mu.Unlock()
+	if first {
+		<-r.release
+	}
+}
+
+// waitFor 等待处理器收到 n 条消息，返回收到的消息体
+func (r *recorder) waitFor(t *testing.T, n int) []string {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		r.mu.Lock()
+		got := append([]string(nil), r.bodies...)
+		r.mu.Unlock()
+		if len(got) >= n || time.Now().After(deadline) {
+			return got
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestInboundQueue(t *testing.T) {
+	tests := []struct {
+		name      string
+		queueSize int
+		readAhead bool // 处理器阻塞时读取循环是否继续读取（心跳能否得到回复）
+	}{
+		{"synchronous", 0, false},
+		{"queued", 8, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := newRecorder()
+			s := startTestServer(t, rec, func(s *TCPServer) { s.SetInboundQueue(tt.queueSize) })
+			c, r := dialTestServer(t, s)
+
+			const n = 5
+			for i := 1; i <= n; i++ {
+				writeFrame(t, c, protocol.CmdTypeMessage, strconv.Itoa(i))
+			}
+			writeFrame(t, c, protocol.CmdTypeHeartbeat, "ping")
+
+			// 处理器阻塞在第一条消息上
+			c.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+			_, err := protocol.Unpack(r)
+			if got := err == nil; got != tt.readAhead {
+				t.Fatalf("pong while handler blocked = %v (err %v), want %v", got, err, tt.readAhead)
+			}
+
+			close(rec.release)
+			got := rec.waitFor(t, n)
+			if len(got) != n {
+				t.Fatalf("handled %d messages, want %d", len(got), n)
+			}
+			for i, body := range got {
+				if body != strconv.Itoa(i+1) {
+					t.Fatalf("handled %v, want messages in arrival order", got)
+				}
+			}
+		})
+	}
+}
+
+func TestInboundQueueDrainsBeforeTeardown(t *testing.T) {
+	const n = 20
+	var (
+		mu      sync.Mutex
+		handled int
+	)
+	atTeardown := make(chan int, 1)
+	handler := handlerFunc(func(*Connection, *protocol.Message) {
+		time.Sleep(time.Millisecond)
+		mu.Lock()
+		handled++
+		mu.Unlock()
+	})
+	// 队列比消息少：读取循环会遇到背压
+	s := startTestServer(t, handler, func(s *TCPServer) {
+		s.SetInboundQueue(2)
+		s.SetOnDisconnect(func(*Connection) {
+			mu.Lock()
+			atTeardown <- handled
+			mu.Unlock()
+		})
+	})
+	c, _ := dialTestServer(t, s)
+
+	for i := 0; i < n; i++ {
+		writeFrame(t, c, protocol.CmdTypeMessage, strconv.Itoa(i))
+	}
+	c.Close()
+
+	select {
+	case got := <-atTeardown:
+		if got != n {
+			t.Fatalf("handled %d of %d queued messages before teardown", got, n)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("connection not torn down")
+	}
+}
+
+func TestServerTeardownOnDisconnect(t *testing.T) {
+	disconnected := make(chan *Connection, 4)
+	s := startTestServer(t, handlerFunc(func(*Connection, *protocol.Message) {}), func(s *TCPServer) {
+		s.SetOnDisconnect(func(conn *Connection) { disconnected <- conn })
+	})
+	c, r := dialTestServer(t, s)
+
+	// 心跳回复之后连接一定已经注册
+	writeFrame(t, c, protocol.CmdTypeHeartbeat, "ping")
+	c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := protocol.Unpack(r); err != nil {
+		t.Fatal(err)
+	}
+	if n := s.ConnManager.Count(); n != 1 {
+		t.Fatalf("connections = %d, want 1", n)
+	}
+	c.Close()
+
+	select {
+	case conn := <-disconnected:
+		if s.ConnManager.GetByConnID(conn.ID) != nil {
+			t.Error("connection still registered during disconnect callback")
+		}
+		if !conn.IsClosed() {
+			t.Error("disconnect callback ran on an open connection")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("disconnect callback not called")
+	}
+
+	// 写循环随后也会退出，不能再次清理
+	time.Sleep(50 * time.Millisecond)
+	select {
+	case <-disconnected:
+		t.Fatal("disconnect callback called twice")
+	default:
+	}
+	if n := s.ConnManager.Count(); n != 0 {
+		t.Fatalf("connections = %d after disconnect, want 0", n)
+	}
+}
+
+func TestStopWaitsForProxyHandshake(t *testing.T) {
+	s := NewTCPServer("127.0.0.1:0", "gateway_test")
+	s.SetHandler(handlerFunc(func(*Connection, *protocol.Message) {}))
+	s.SetProxyProtocol(true)
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	c, err := net.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	// 等连接被接受：此后它停在 PROXY 头的读取上
+	deadline := time.Now().Add(2 * time.Second)
+	for s.ConnGoroutines() == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		s.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		t.Fatal("Stop returned while a connection was in the PROXY handshake")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// 握手完成后读取循环看到关闭信号，连接退出，Stop 随之返回
+	if _, err := c.Write([]byte("PROXY TCP4 1.2.3.4 10.0.0.1 56324 8080\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-stopped:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Stop did not return after the handshake finished")
+	}
+}
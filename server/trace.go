@@ -0,0 +1,131 @@
+/*
+Package server - 单连接帧追踪
+
+=== 使用场景 ===
+
+排查某个客户端的异常行为时，需要看到它收发的每一帧，
+但不能为此打开所有连接的详细日志。追踪只针对指定的目标：
+
+	连接 ID   只追踪这一个连接
+	用户 ID   追踪该用户在本网关上的所有连接（包括之后新认证的）
+
+被追踪的连接输出：
+
+	[Trace] conn-12 (alice) in Message 128B
+	[Trace] conn-12 (alice) dispatched Message in 1.3ms
+	[Trace] conn-12 (alice) out MessageAck 46B
+
+=== 开销 ===
+
+每个连接有一个原子标志，读写路径上只在标志为 true 时才记录，
+没有追踪目标时的额外开销只是每帧一次原子读取。
+目标变化时（SetTraceTargets）以及连接加入、认证时重新计算标志。
+*/
+package server
+
+import (
+	"encoding/binary"
+	"log"
+	"time"
+
+	"go-im/protocol"
+)
+
+// traceTargets 追踪目标
+type traceTargets struct {
+	conns map[uint64]bool
+	users map[string]bool
+}
+
+// matches 连接是否是追踪目标
+func (t *traceTargets) matches(conn *Connection) bool {
+	if t.conns[conn.ID] {
+		return true
+	}
+	uid := conn.GetUserID()
+	return uid != "" && t.users[uid]
+}
+
+// ==================== 连接管理器接入 ====================
+
+// SetTraceTargets 替换追踪目标（两者都为空表示关闭追踪），返回当前被追踪的连接数
+func (m *ConnectionManager) SetTraceTargets(connIDs []uint64, userIDs []string) int {
+	targets := &traceTargets{
+		conns: make(map[uint64]bool, len(connIDs)),
+		users: make(map[string]bool, len(userIDs)),
+	}
+	for _, id := range connIDs {
+		targets.conns[id] = true
+	}
+	for _, uid := range userIDs {
+		targets.users[uid] = true
+	}
+
+	m.traceMu.Lock()
+	m.trace = targets
+	m.traceMu.Unlock()
+
+	traced := 0
+	m.Range(func(conn *Connection) bool {
+		if m.applyTrace(conn) {
+			traced++
+		}
+		return true
+	})
+	return traced
+}
+
+// applyTrace 按当前追踪目标更新连接的追踪标志，返回是否被追踪
+func (m *ConnectionManager) applyTrace(conn *Connection) bool {
+	m.traceMu.Lock()
+	on := m.trace != nil && m.trace.matches(conn)
+	m.traceMu.Unlock()
+
+	if conn.tracing.Swap(on) != on {
+		state := "stopped"
+		if on {
+			state = "started"
+		}
+		log.Printf("[Trace] conn-%d (%s) tracing %s", conn.ID, conn.GetUserID(), state)
+	}
+	return on
+}
+
+// ==================== 追踪输出 ====================
+
+// IsTracing 连接是否正在被追踪
+func (c *Connection) IsTracing() bool {
+	return c.tracing.Load()
+}
+
+// traceInbound 记录读取循环解出的一帧（调用方已检查 tracing）
+func (c *Connection) traceInbound(msg *protocol.Message) {
+	log.Printf("[Trace] conn-%d (%s) in %s %dB",
+		c.ID, c.GetUserID(), protocol.CmdTypeName(msg.CmdType), msg.Length+4)
+}
+
+// traceDispatch 记录业务处理器处理一帧的耗时（调用方已检查 tracing）
+func (c *Connection) traceDispatch(msg *protocol.Message, elapsed time.Duration) {
+	log.Printf("[Trace] conn-%d (%s) dispatched %s in %v",
+		c.ID, c.GetUserID(), protocol.CmdTypeName(msg.CmdType), elapsed)
+}
+
+// traceOutbound 记录写循环写入网络的一帧（调用方已检查 tracing）
+func (c *Connection) traceOutbound(frame []byte) {
+	if len(frame) < protocol.HeaderLength {
+		return
+	}
+	log.Printf("[Trace] conn-%d (%s) out %s %dB",
+		c.ID, c.GetUserID(), protocol.CmdTypeName(binary.BigEndian.Uint16(frame[6:8])), len(frame))
+}
+
+// dispatch 把一帧交给业务处理器，被追踪的连接记录处理耗时
+func (s *TCPServer) dispatch(conn *Connection, msg *protocol.Message) {
+	if !conn.tracing.Load() {
+		s.handler.HandleConnection(conn, msg)
+		return
+	}
+	start := time.Now()
+	s.handler.HandleConnection(conn, msg)
+	conn.traceDispatch(msg, time.Since(start))
+}
@@ -1,181 +1,408 @@
-/*
-Package service - 用户认证服务
-
-=== JWT (JSON Web Token) 简介 ===
-
-JWT 是一种无状态的认证机制，由三部分组成：
-
-	Header.Payload.Signature
-	(头部).(载荷).(签名)
-
-示例 Token:
-
-		eyJhbGciOiJIUzI1NiJ9.eyJ1c2VyX2lkIjoiYWxpY2UifQ.xxxxx
-
-	 1. Header（头部）: 算法类型
-	    {"alg": "HS256", "typ": "JWT"}
-
-	 2. Payload（载荷）: 用户数据
-	    {"user_id": "alice", "exp": 1699999999}
-
-	 3. Signature（签名）: 防篡改
-	    HMAC-SHA256(Header + Payload, 密钥)
-
-=== 为什么用 JWT？===
-
-对比 Session 方式：
-
-Session 方式:
-
-	Client ──────────────────────> Gateway-1
-	          SessionID: abc123
-	                 │
-	                 ▼
-	           ┌──────────┐
-	           │  Redis   │  需要查询 Session
-	           │ abc123→  │
-	           │ {user:x} │
-	           └──────────┘
-
-JWT 方式:
-
-	Client ──────────────────────> Gateway-1
-	          Token: eyJxxx...
-	                 │
-	                 ▼
-	           本地验证签名即可，无需查询 Redis ✓
-
-优势：
-- 无状态：不需要在服务端存储 Session
-- 可扩展：任何 Gateway 都能验证，天然支持分布式
-- 性能高：本地验证，不需要网络请求
-*/
-package service
-
-import (
-	"errors"
-	"time"
-
-	"github.com/golang-jwt/jwt/v5"
-)
-
-// ==================== 配置常量 ====================
-
-var (
-	// JWTSecret 签名密钥
-	// 警告：生产环境必须使用复杂的随机字符串，并从配置文件读取
-	JWTSecret = []byte("go-im-secret-key-change-in-production")
-
-	// TokenExpireDuration Token 过期时间
-	TokenExpireDuration = 24 * time.Hour
-)
-
-// ==================== 错误定义 ====================
-
-var (
-	// ErrInvalidToken Token 无效（格式错误或签名不匹配）
-	ErrInvalidToken = errors.New("invalid token")
-
-	// ErrTokenExpired Token 已过期
-	ErrTokenExpired = errors.New("token expired")
-)
-
-// ==================== Claims 结构 ====================
-
-// Claims JWT 载荷
-// 继承 jwt.RegisteredClaims 获得标准字段（过期时间等）
-type Claims struct {
-	// UserID 用户唯一标识
-	UserID string `json:"user_id"`
-
-	// Username 用户名（可选，用于显示）
-	Username string `json:"username"`
-
-	// RegisteredClaims 标准字段
-	// - ExpiresAt: 过期时间
-	// - IssuedAt: 签发时间
-	// - Issuer: 签发者
-	jwt.RegisteredClaims
-}
-
-// ==================== Token 生成 ====================
-
-// GenerateToken 生成 JWT Token
-//
-// 参数:
-//   - userID: 用户唯一标识
-//   - username: 用户名
-//
-// 返回:
-//   - string: 生成的 Token 字符串
-//   - error: 错误信息
-//
-// 示例:
-//
-//	token, err := GenerateToken("user123", "Alice")
-//	// token = "eyJhbGciOiJIUzI1NiJ9.eyJ1c2VyX2lkIjoidXNlcjEyMyJ9.xxxxx"
-func GenerateToken(userID, username string) (string, error) {
-	// 构造 Claims
-	claims := &Claims{
-		UserID:   userID,
-		Username: username,
-		RegisteredClaims: jwt.RegisteredClaims{
-			// 过期时间
-			ExpiresAt: jwt.NewNumericDate(time.Now().Add(TokenExpireDuration)),
-			// 签发时间
-			IssuedAt: jwt.NewNumericDate(time.Now()),
-			// 签发者
-			Issuer: "go-im",
-		},
-	}
-
-	// 创建 Token 对象
-	// HS256 = HMAC + SHA256，是最常用的对称加密算法
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-
-	// 使用密钥签名，生成最终的 Token 字符串
-	return token.SignedString(JWTSecret)
-}
-
-// ==================== Token 验证 ====================
-
-// ValidateToken 验证 JWT Token
-//
-// 验证过程：
-// 1. 解析 Token 字符串
-// 2. 验证签名（使用相同的密钥）
-// 3. 检查是否过期
-// 4. 返回解析出的用户信息
-//
-// 参数:
-//   - tokenString: 要验证的 Token
-//
-// 返回:
-//   - *Claims: 解析出的用户信息
-//   - error: 验证失败的原因
-func ValidateToken(tokenString string) (*Claims, error) {
-	// 解析并验证 Token
-	token, err := jwt.ParseWithClaims(
-		tokenString,
-		&Claims{},
-		func(token *jwt.Token) (interface{}, error) {
-			// 返回签名密钥，用于验证签名
-			return JWTSecret, nil
-		},
-	)
-
-	if err != nil {
-		// 检查是否是过期错误
-		if errors.Is(err, jwt.ErrTokenExpired) {
-			return nil, ErrTokenExpired
-		}
-		return nil, ErrInvalidToken
-	}
-
-	// 类型断言，提取 Claims
-	if claims, ok := token.Claims.(*Claims); ok && token.Valid {
-		return claims, nil
-	}
-
-	return nil, ErrInvalidToken
-}
+/*
+Package service - 用户认证服务
+
+=== JWT (JSON Web Token) 简介 ===
+
+JWT 是一种无状态的认证机制，由三部分组成：
+
+	Header.Payload.Signature
+	(头部).(载荷).(签名)
+
+示例 Token:
+
+		eyJhbGciOiJIUzI1NiJ9.eyJ1c2VyX2lkIjoiYWxpY2UifQ.xxxxx
+
+	 1. Header（头部）: 算法类型
+	    {"alg": "HS256", "typ": "JWT"}
+
+	 2. Payload（载荷）: 用户数据
+	    {"user_id": "alice", "exp": 1699999999}
+
+	 3. Signature（签名）: 防篡改
+	    HMAC-SHA256(Header + Payload, 密钥)
+
+=== 为什么用 JWT？===
+
+对比 Session 方式：
+
+Session 方式:
+
+	Client ──────────────────────> Gateway-1
+	          SessionID: abc123
+	                 │
+	                 ▼
+	           ┌──────────┐
+	           │  Redis   │  需要查询 Session
+	           │ abc123→  │
+	           │ {user:x} │
+	           └──────────┘
+
+JWT 方式:
+
+	Client ──────────────────────> Gateway-1
+	          Token: eyJxxx...
+	                 │
+	                 ▼
+	           本地验证签名即可，无需查询 Redis ✓
+
+优势：
+- 无状态：不需要在服务端存储 Session
+- 可扩展：任何 Gateway 都能验证，天然支持分布式
+- 性能高：本地验证，不需要网络请求
+*/
+package service
+
+import (
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// ==================== 配置常量 ====================
+
+var (
+	// JWTSecret 签名密钥
+	// 警告：生产环境必须使用复杂的随机字符串，并从配置文件读取
+	JWTSecret = []byte(DefaultJWTSecret)
+
+	// TokenExpireDuration Token 过期时间
+	TokenExpireDuration = 24 * time.Hour
+
+	// SigningMethod 签名算法，只接受用该算法签名的 Token
+	SigningMethod jwt.SigningMethod = jwt.SigningMethodHS256
+
+	// rsaPrivateKey / rsaPublicKey RSA 系列算法的密钥对（见 AuthConfig）
+	// 只验证 Token 的网关没有私钥，此时不能签发 Token
+	rsaPrivateKey *rsa.PrivateKey
+	rsaPublicKey  *rsa.PublicKey
+)
+
+// MaxTokenExpireDuration Token 有效期上限
+// 更长的有效期意味着泄露的 Token 长期可用
+const MaxTokenExpireDuration = 30 * 24 * time.Hour
+
+// DefaultJWTSecret 内置的开发用密钥，生产环境必须替换
+const DefaultJWTSecret = "go-im-secret-key-change-in-production"
+
+// ==================== 错误定义 ====================
+
+var (
+	// ErrInvalidToken Token 无效（格式错误或签名不匹配）
+	ErrInvalidToken = errors.New("invalid token")
+
+	// ErrTokenExpired Token 已过期
+	ErrTokenExpired = errors.New("token expired")
+
+	// ErrInvalidAuthConfig 认证配置无效
+	ErrInvalidAuthConfig = errors.New("invalid auth config")
+
+	// ErrNoSigningKey 配置的是 RSA 算法但没有私钥，只能验证不能签发 Token
+	ErrNoSigningKey = errors.New("no private key configured for signing tokens")
+)
+
+// ==================== 认证配置 ====================
+
+// AuthConfig 认证配置
+// 启动时通过 ConfigureAuth 校验并生效，配置错误立即失败，
+// 而不是等到第一次签发/验证 Token 时才暴露
+type AuthConfig struct {
+	// Method 签名算法名称，如 "HS256"
+	Method string
+
+	// Secret HMAC 签名密钥（HS256/HS384/HS512）
+	Secret []byte
+
+	// PrivateKey / PublicKey RSA 密钥对（RS256/RS384/RS512、PS256/PS384/PS512）
+	// 签发 Token 需要私钥；只验证 Token 的网关可以只配置公钥
+	PrivateKey *rsa.PrivateKey
+	PublicKey  *rsa.PublicKey
+
+	// Expiry Token 有效期
+	Expiry time.Duration
+}
+
+// Validate 检查配置
+//
+//   - HMAC 系列（HS256/HS384/HS512）：共享密钥不能为空
+//   - RSA 系列（RS*/PS*）：至少配置私钥或公钥之一，同时配置时必须是同一对
+//   - 其他算法（ECDSA、EdDSA、"none"）不支持
+//   - 有效期必须在 (0, MaxTokenExpireDuration] 之间
+func (c *AuthConfig) Validate() error {
+	method := jwt.GetSigningMethod(c.Method)
+	if method == nil {
+		return fmt.Errorf("%w: unknown signing method %q", ErrInvalidAuthConfig, c.Method)
+	}
+	switch method.(type) {
+	case *jwt.SigningMethodHMAC:
+		if len(c.Secret) == 0 {
+			return fmt.Errorf("%w: empty secret", ErrInvalidAuthConfig)
+		}
+	case *jwt.SigningMethodRSA, *jwt.SigningMethodRSAPSS:
+		if c.PrivateKey == nil && c.PublicKey == nil {
+			return fmt.Errorf("%w: signing method %s needs an RSA key", ErrInvalidAuthConfig, c.Method)
+		}
+		if c.PrivateKey != nil && c.PublicKey != nil && !c.PrivateKey.PublicKey.Equal(c.PublicKey) {
+			return fmt.Errorf("%w: RSA public key does not match the private key", ErrInvalidAuthConfig)
+		}
+	default:
+		return fmt.Errorf("%w: unsupported signing method %s", ErrInvalidAuthConfig, c.Method)
+	}
+	if c.Expiry <= 0 {
+		return fmt.Errorf("%w: token expiry must be positive, got %v", ErrInvalidAuthConfig, c.Expiry)
+	}
+	if c.Expiry > MaxTokenExpireDuration {
+		return fmt.Errorf("%w: token expiry %v exceeds %v", ErrInvalidAuthConfig, c.Expiry, MaxTokenExpireDuration)
+	}
+	return nil
+}
+
+// ConfigureAuth 校验配置并替换全局的签名算法、密钥和有效期
+// 需要在签发或验证任何 Token 之前调用
+func ConfigureAuth(cfg *AuthConfig) error {
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+	SigningMethod = jwt.GetSigningMethod(cfg.Method)
+	JWTSecret = cfg.Secret
+	rsaPrivateKey, rsaPublicKey = cfg.PrivateKey, cfg.PublicKey
+	if rsaPublicKey == nil && rsaPrivateKey != nil {
+		rsaPublicKey = &rsaPrivateKey.PublicKey
+	}
+	TokenExpireDuration = cfg.Expiry
+	return nil
+}
+
+// LoadRSAKeys 从 PEM 文件读取 RSA 私钥和公钥，路径为空的一项返回 nil
+func LoadRSAKeys(privatePath, publicPath string) (*rsa.PrivateKey, *rsa.PublicKey, error) {
+	var (
+		private *rsa.PrivateKey
+		public  *rsa.PublicKey
+	)
+	if privatePath != "" {
+		data, err := os.ReadFile(privatePath)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read RSA private key: %w", err)
+		}
+		if private, err = jwt.ParseRSAPrivateKeyFromPEM(data); err != nil {
+			return nil, nil, fmt.Errorf("invalid RSA private key %s: %w", privatePath, err)
+		}
+	}
+	if publicPath != "" {
+		data, err := os.ReadFile(publicPath)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read RSA public key: %w", err)
+		}
+		if public, err = jwt.ParseRSAPublicKeyFromPEM(data); err != nil {
+			return nil, nil, fmt.Errorf("invalid RSA public key %s: %w", publicPath, err)
+		}
+	}
+	return private, public, nil
+}
+
+// signingKey 当前算法签发 Token 使用的密钥
+func signingKey() (interface{}, error) {
+	if _, ok := SigningMethod.(*jwt.SigningMethodHMAC); ok {
+		return JWTSecret, nil
+	}
+	if rsaPrivateKey == nil {
+		return nil, ErrNoSigningKey
+	}
+	return rsaPrivateKey, nil
+}
+
+// verifyingKey 当前算法验证 Token 使用的密钥
+func verifyingKey() interface{} {
+	if _, ok := SigningMethod.(*jwt.SigningMethodHMAC); ok {
+		return JWTSecret
+	}
+	return rsaPublicKey
+}
+
+// ==================== Claims 结构 ====================
+
+// Claims JWT 载荷
+// 继承 jwt.RegisteredClaims 获得标准字段（过期时间等）
+type Claims struct {
+	// UserID 用户唯一标识
+	UserID string `json:"user_id"`
+
+	// Username 用户名（可选，用于显示）
+	Username string `json:"username"`
+
+	// TenantID 租户 ID（可选，为空表示默认租户，见 tenant.go）
+	TenantID string `json:"tenant_id,omitempty"`
+
+	// Roles 用户角色（可选，如 "admin"），认证成功后原样返回给客户端
+	Roles []string `json:"roles,omitempty"`
+
+	// DisplayName、AvatarURL 用户资料（可选），认证时写入 profile:<userID>（见 profile.go）
+	DisplayName string `json:"display_name,omitempty"`
+	AvatarURL   string `json:"avatar_url,omitempty"`
+
+	// RegisteredClaims 标准字段
+	// - ExpiresAt: 过期时间
+	// - IssuedAt: 签发时间
+	// - Issuer: 签发者
+	jwt.RegisteredClaims
+}
+
+// ==================== Token 生成 ====================
+
+// GenerateToken 生成 JWT Token
+//
+// 参数:
+//   - userID: 用户唯一标识
+//   - username: 用户名
+//
+// 返回:
+//   - string: 生成的 Token 字符串
+//   - error: 错误信息
+//
+// 示例:
+//
+//	token, err := GenerateToken("user123", "Alice")
+//	// token = "eyJhbGciOiJIUzI1NiJ9.eyJ1c2VyX2lkIjoidXNlcjEyMyJ9.xxxxx"
+func GenerateToken(userID, username string) (string, error) {
+	return GenerateTenantToken("", userID, username)
+}
+
+// GenerateTenantToken 生成属于指定租户的 JWT Token，可附带角色
+// tenantID 为空、不带角色时等同于 GenerateToken
+func GenerateTenantToken(tenantID, userID, username string, roles ...string) (string, error) {
+	// 构造 Claims
+	claims := &Claims{
+		UserID:   userID,
+		Username: username,
+		TenantID: tenantID,
+		Roles:    roles,
+		RegisteredClaims: jwt.RegisteredClaims{
+			// 过期时间
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(TokenExpireDuration)),
+			// 签发时间
+			IssuedAt: jwt.NewNumericDate(time.Now()),
+			// 签发者
+			Issuer: "go-im",
+			// 唯一 ID（jti），用于单独吊销（见 revocation.go）
+			ID: newTokenID(),
+		},
+	}
+
+	// 创建 Token 对象
+	// 默认 HS256 = HMAC + SHA256，是最常用的对称加密算法
+	token := jwt.NewWithClaims(SigningMethod, claims)
+
+	// 使用密钥签名，生成最终的 Token 字符串
+	key, err := signingKey()
+	if err != nil {
+		return "", err
+	}
+	return token.SignedString(key)
+}
+
+// ==================== 批量生成（压测用） ====================
+
+// batchTenants 批量生成时轮流使用的租户（空字符串为默认租户）
+var batchTenants = []string{"", "acme", "globex"}
+
+// GenerateTokenBatch 批量生成 n 个 Token，用于压测和认证性能测试
+//
+// 声明由序号确定，同样的参数总是得到同样的用户：
+//   - 用户 ID: prefix + 序号（如 load0、load1 ...）
+//   - 租户: 在默认租户、acme、globex 之间轮换
+//   - 角色: 每 10 个用户中有一个 admin
+//
+// 签发时间不同，Token 字符串本身每次生成都不一样
+func GenerateTokenBatch(prefix string, n int) ([]string, error) {
+	tokens := make([]string, n)
+	for i := range tokens {
+		var roles []string
+		if i%10 == 0 {
+			roles = []string{"admin"}
+		}
+		userID := fmt.Sprintf("%s%d", prefix, i)
+		token, err := GenerateTenantToken(batchTenants[i%len(batchTenants)], userID, "User "+userID, roles...)
+		if err != nil {
+			return nil, fmt.Errorf("token %d: %w", i, err)
+		}
+		tokens[i] = token
+	}
+	return tokens, nil
+}
+
+// ValidateTokenBatch 逐个验证 Token，返回第一个失败的 Token 的错误
+func ValidateTokenBatch(tokens []string) error {
+	for i, token := range tokens {
+		if _, err := ValidateToken(token); err != nil {
+			return fmt.Errorf("token %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// PublicClaims 可以返回给客户端的声明（不含签名、签发者等内部字段）
+// 客户端据此渲染界面，不需要自己解析 JWT
+func (c *Claims) PublicClaims() map[string]interface{} {
+	public := map[string]interface{}{
+		"user_id":  c.UserID,
+		"username": c.Username,
+	}
+	if c.TenantID != "" {
+		public["tenant_id"] = c.TenantID
+	}
+	if len(c.Roles) > 0 {
+		public["roles"] = c.Roles
+	}
+	if c.ExpiresAt != nil {
+		public["expires_at"] = c.ExpiresAt.Unix()
+	}
+	return public
+}
+
+// ==================== Token 验证 ====================
+
+// ValidateToken 验证 JWT Token
+//
+// 验证过程：
+// 1. 解析 Token 字符串
+// 2. 验证签名（使用相同的密钥）
+// 3. 检查是否过期
+// 4. 返回解析出的用户信息
+//
+// 参数:
+//   - tokenString: 要验证的 Token
+//
+// 返回:
+//   - *Claims: 解析出的用户信息
+//   - error: 验证失败的原因
+func ValidateToken(tokenString string) (*Claims, error) {
+	// 解析并验证 Token
+	token, err := jwt.ParseWithClaims(
+		tokenString,
+		&Claims{},
+		func(token *jwt.Token) (interface{}, error) {
+			// 返回验证密钥（HMAC 为共享密钥，RSA 为公钥）
+			return verifyingKey(), nil
+		},
+		// 只接受配置的算法，防止伪造 alg 头（如 "none"）绕过签名校验
+		jwt.WithValidMethods([]string{SigningMethod.Alg()}),
+	)
+
+	if err != nil {
+		// 检查是否是过期错误
+		if errors.Is(err, jwt.ErrTokenExpired) {
+			return nil, ErrTokenExpired
+		}
+		return nil, ErrInvalidToken
+	}
+
+	// 类型断言，提取 Claims
+	if claims, ok := token.Claims.(*Claims); ok && token.Valid {
+		return claims, nil
+	}
+
+	return nil, ErrInvalidToken
+}
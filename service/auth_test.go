@@ -0,0 +1,190 @@
+package service
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+var (
+	testRSAOnce sync.Once
+	testRSAKey  *rsa.PrivateKey
+)
+
+// testRSAKeyPair 测试共用的 RSA 密钥对（生成较慢，只生成一次）
+func testRSAKeyPair(t testing.TB) *rsa.PrivateKey {
+	t.Helper()
+	testRSAOnce.Do(func() {
+		var err error
+		if testRSAKey, err = rsa.GenerateKey(rand.Reader, 2048); err != nil {
+			panic(err)
+		}
+	})
+	return testRSAKey
+}
+
+// withAuth 在测试期间使用 cfg，结束后恢复原来的认证配置
+func withAuth(t testing.TB, cfg *AuthConfig) {
+	t.Helper()
+	method, secret, expiry := SigningMethod, JWTSecret, TokenExpireDuration
+	private, public := rsaPrivateKey, rsaPublicKey
+	t.Cleanup(func() {
+		SigningMethod, JWTSecret, TokenExpireDuration = method, secret, expiry
+		rsaPrivateKey, rsaPublicKey = private, public
+	})
+	if err := ConfigureAuth(cfg); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// authConfigs HS256 与 RS256 两种配置
+func authConfigs(t testing.TB) map[string]*AuthConfig {
+	return map[string]*AuthConfig{
+		"HS256": {Method: "HS256", Secret: []byte("test-secret"), Expiry: time.Hour},
+		"RS256": {Method: "RS256", PrivateKey: testRSAKeyPair(t), Expiry: time.Hour},
+	}
+}
+
+func TestAuthConfigValidate(t *testing.T) {
+	valid := AuthConfig{Method: "HS256", Secret: []byte("test-secret"), Expiry: time.Hour}
+	if err := valid.Validate(); err != nil {
+		t.Fatalf("valid config rejected: %v", err)
+	}
+
+	cases := []struct {
+		name   string
+		modify func(c *AuthConfig)
+	}{
+		{"unknown method", func(c *AuthConfig) { c.Method = "HS1024" }},
+		{"empty method", func(c *AuthConfig) { c.Method = "" }},
+		{"none method", func(c *AuthConfig) { c.Method = "none" }},
+		{"rsa method without key", func(c *AuthConfig) { c.Method = "RS256"; c.Secret = nil }},
+		{"ecdsa method", func(c *AuthConfig) { c.Method = "ES256" }},
+		{"empty secret", func(c *AuthConfig) { c.Secret = nil }},
+		{"zero expiry", func(c *AuthConfig) { c.Expiry = 0 }},
+		{"negative expiry", func(c *AuthConfig) { c.Expiry = -time.Minute }},
+		{"expiry too long", func(c *AuthConfig) { c.Expiry = MaxTokenExpireDuration + time.Second }},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			cfg := valid
+			c.modify(&cfg)
+			if err := cfg.Validate(); !errors.Is(err, ErrInvalidAuthConfig) {
+				t.Fatalf("Validate() = %v, want ErrInvalidAuthConfig", err)
+			}
+		})
+	}
+}
+
+func TestAuthConfigValidateRSA(t *testing.T) {
+	key := testRSAKeyPair(t)
+	other, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, cfg := range []AuthConfig{
+		{Method: "RS256", PrivateKey: key, Expiry: time.Hour},
+		{Method: "RS256", PublicKey: &key.PublicKey, Expiry: time.Hour},
+		{Method: "PS256", PrivateKey: key, PublicKey: &key.PublicKey, Expiry: time.Hour},
+	} {
+		if err := cfg.Validate(); err != nil {
+			t.Errorf("valid RSA config rejected: %v", err)
+		}
+	}
+
+	mismatched := AuthConfig{Method: "RS256", PrivateKey: key, PublicKey: &other.PublicKey, Expiry: time.Hour}
+	if err := mismatched.Validate(); !errors.Is(err, ErrInvalidAuthConfig) {
+		t.Fatalf("mismatched key pair: Validate() = %v, want ErrInvalidAuthConfig", err)
+	}
+}
+
+func TestTokenBatchValidates(t *testing.T) {
+	for name, cfg := range authConfigs(t) {
+		t.Run(name, func(t *testing.T) {
+			withAuth(t, cfg)
+
+			const n = 50
+			tokens, err := GenerateTokenBatch("load", n)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(tokens) != n {
+				t.Fatalf("got %d tokens, want %d", len(tokens), n)
+			}
+			if err := ValidateTokenBatch(tokens); err != nil {
+				t.Fatal(err)
+			}
+
+			// 声明由序号确定：用户、租户轮换、每 10 个一个 admin
+			for i, token := range tokens {
+				claims, err := ValidateToken(token)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if want := fmt.Sprintf("load%d", i); claims.UserID != want {
+					t.Errorf("token %d: user %q, want %q", i, claims.UserID, want)
+				}
+				if want := batchTenants[i%len(batchTenants)]; claims.TenantID != want {
+					t.Errorf("token %d: tenant %q, want %q", i, claims.TenantID, want)
+				}
+				if admin := len(claims.Roles) > 0; admin != (i%10 == 0) {
+					t.Errorf("token %d: roles %v", i, claims.Roles)
+				}
+			}
+		})
+	}
+}
+
+func TestRSAVerifyOnly(t *testing.T) {
+	key := testRSAKeyPair(t)
+	withAuth(t, &AuthConfig{Method: "RS256", PrivateKey: key, Expiry: time.Hour})
+	token, err := GenerateToken("alice", "Alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 只有公钥的网关：能验证，不能签发
+	withAuth(t, &AuthConfig{Method: "RS256", PublicKey: &key.PublicKey, Expiry: time.Hour})
+	if claims, err := ValidateToken(token); err != nil || claims.UserID != "alice" {
+		t.Fatalf("ValidateToken() = (%v, %v)", claims, err)
+	}
+	if _, err := GenerateToken("bob", "Bob"); !errors.Is(err, ErrNoSigningKey) {
+		t.Fatalf("GenerateToken() without private key: err = %v, want ErrNoSigningKey", err)
+	}
+
+	// HS256 签名的 Token 不能冒充 RS256
+	withAuth(t, &AuthConfig{Method: "HS256", Secret: []byte("test-secret"), Expiry: time.Hour})
+	forged, err := GenerateToken("mallory", "Mallory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	withAuth(t, &AuthConfig{Method: "RS256", PublicKey: &key.PublicKey, Expiry: time.Hour})
+	if _, err := ValidateToken(forged); !errors.Is(err, ErrInvalidToken) {
+		t.Fatalf("HS256 token accepted by RS256 gateway: err = %v", err)
+	}
+}
+
+// BenchmarkValidateToken 认证热路径上的签名验证：HS256 对比 RS256
+func BenchmarkValidateToken(b *testing.B) {
+	for _, name := range []string{"HS256", "RS256"} {
+		b.Run(name, func(b *testing.B) {
+			withAuth(b, authConfigs(b)[name])
+			tokens, err := GenerateTokenBatch("bench", 100)
+			if err != nil {
+				b.Fatal(err)
+			}
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := ValidateToken(tokens[i%len(tokens)]); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
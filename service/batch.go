@@ -0,0 +1,96 @@
+/*
+Package service - 批量发送
+
+=== 使用场景 ===
+
+客户端离线编辑了多条消息，重新连上后一次性发出。逐条发送每条都是一帧，
+CmdTypeBatchMessage 把它们放进同一帧，服务端逐条路由（各自分配 SeqID），
+最后用一帧回复每条的结果：
+
+	请求  {"messages":[{"to_user_id":"bob","content":"hi"},
+	                  {"to_user_id":"carol","content":"hey"},
+	                  {"to_user_id":"nobody","content":"?"}]}
+
+	回复  {"results":[{"index":0,"seq_id":12,"status":"sent"},
+	                  {"index":1,"seq_id":3,"status":"stored"},
+	                  {"index":2,"status":"failed","error":"unknown_recipient"}],
+	       "sent":1,"stored":1,"failed":1}
+
+- sent：已推送到接收者的连接或转发到接收者所在的网关
+- stored：接收者不在线，已存入离线盒子，上线后投递
+- failed：没有发出，error 为原因，其余消息不受影响
+
+每条消息的格式与 CmdTypeMessage 相同（包括 client_seq、deliver_before、群聊），
+按数组顺序处理。超过 MaxBatchMessages 条的批次整体拒绝。
+*/
+package service
+
+import "time"
+
+// MaxBatchMessages 一个批次最多包含的消息数
+const MaxBatchMessages = 100
+
+// 批量发送中每条消息的状态
+const (
+	BatchStatusSent   = "sent"   // 已推送或转发
+	BatchStatusStored = "stored" // 接收者不在线，已存离线
+	BatchStatusFailed = "failed" // 没有发出
+)
+
+// 失败原因（BatchResult.Error）
+// 客户端计数回退时使用 protocol.ErrorCodeOutOfOrder
+const (
+	BatchErrorInvalid          = "invalid"           // 格式错误
+	BatchErrorNoCredits        = "no_credits"        // 发送额度用完
+	BatchErrorUnknownRecipient = "unknown_recipient" // 收件人不存在（开启收件人检查时）
+	BatchErrorInternal         = "internal"          // 路由失败（如 Redis 不可用）
+)
+
+// SendOutcome 一条私聊消息的路由结果
+type SendOutcome struct {
+	SeqID  int64 // 分配的序列号
+	Stored bool  // 接收者不在线，存入了离线盒子
+}
+
+// SendPrivate 按投递策略发送私聊消息并返回路由结果
+// deliverBefore 为零值时不限制投递截止时间
+func (h *MessageHandler) SendPrivate(fromUserID, toUserID string, content []byte, deliverBefore time.Time,
+	policy DeliveryPolicy) (*SendOutcome, error) {
+	if err := h.checkRecipient(fromUserID, toUserID, content); err != nil {
+		return nil, err
+	}
+	var before int64
+	if !deliverBefore.IsZero() {
+		before = deliverBefore.UnixMilli()
+	}
+	return h.send(fromUserID, toUserID, MsgTypePrivate, content, before, policy)
+}
+
+// BatchResult 批次中一条消息的结果
+type BatchResult struct {
+	Index  int    `json:"index"`            // 在请求数组中的位置
+	SeqID  int64  `json:"seq_id,omitempty"` // 分配的序列号（群聊和失败的消息没有）
+	Status string `json:"status"`           // BatchStatusXxx
+	Error  string `json:"error,omitempty"`  // 失败原因
+}
+
+// BatchAck CmdTypeBatchMessage 的回复
+type BatchAck struct {
+	Results []BatchResult `json:"results"`
+	Sent    int           `json:"sent"`
+	Stored  int           `json:"stored"`
+	Failed  int           `json:"failed"`
+}
+
+// Add 记录一条结果并更新汇总
+func (a *BatchAck) Add(r BatchResult) {
+	switch r.Status {
+	case BatchStatusSent:
+		a.Sent++
+	case BatchStatusStored:
+		a.Stored++
+	default:
+		a.Failed++
+	}
+	a.Results = append(a.Results, r)
+}
@@ -0,0 +1,129 @@
+/*
+Package service - 离线消息认领（多设备并发上线）
+
+=== 问题 ===
+
+同一用户的两个设备几乎同时上线，各自拉取离线盒子：
+
+	手机  ── Fetch ──▶ [1,2,3] ──▶ 推送 1,2,3
+	电脑  ── Fetch ──▶ [1,2,3] ──▶ 推送 1,2,3   （重复投递，随后两边的 ACK 竞争删除）
+
+=== 认领租约 ===
+
+拉到一批消息后，用 Lua 脚本原子地认领：
+
+	Key: offline_claims:bob   (Hash)
+	┌──────────────────┬──────────────────────────┐
+	│ 消息 ID           │ 设备ID|租约到期时间(毫秒)  │
+	├──────────────────┼──────────────────────────┤
+	│ alice:bob:1      │ iphone|1700000030000     │
+	│ bob:carol:1      │ pc|1700000030000         │
+	│ group:g1:7       │ iphone|1700000030000     │
+	└──────────────────┴──────────────────────────┘
+
+按消息 ID（会话 + SeqID，见 MessageID）认领：不同会话的 SeqID 可能相同，
+两台设备可以分别认领 SeqID 相同的两条消息，互不影响。
+
+- 没有认领、租约已过期、或者是同一设备的认领（断线重连）时认领成功
+- 被其他设备认领的消息跳过，由持有租约的设备投递
+- ACK 删除离线消息时一并删除认领；推送失败或中途停止时释放未推送的认领
+- 持有租约的设备断开且没有 ACK 时，租约到期后其他设备可以重新认领
+*/
+package service
+
+import (
+	"fmt"
+	"time"
+
+	pkgredis "go-im/pkg/redis"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// ==================== 常量定义 ====================
+
+const (
+	// OfflineClaimKeyPrefix 离线消息认领 Key 前缀
+	// 完整 Key: offline_claims:<userID>
+	OfflineClaimKeyPrefix = "offline_claims:"
+
+	// OfflineClaimLease 认领租约时长
+	// 持有者在这段时间内没有 ACK（如推送后立即断开），其他设备可以重新认领
+	OfflineClaimLease = 30 * time.Second
+)
+
+// claimScript 认领一批消息
+// KEYS: claims
+// ARGV: 设备 ID, 当前时间(毫秒), 租约(毫秒), 消息 ID...
+// 返回认领成功的消息 ID
+var claimScript = redis.NewScript(`
+local owner, now, lease = ARGV[1], tonumber(ARGV[2]), tonumber(ARGV[3])
+local value = owner .. "|" .. (now + lease)
+local claimed = {}
+for i = 4, #ARGV do
+	local cur = redis.call("HGET", KEYS[1], ARGV[i])
+	local ok = not cur
+	if cur then
+		local sep = string.find(cur, "|", 1, true)
+		ok = string.sub(cur, 1, sep - 1) == owner or tonumber(string.sub(cur, sep + 1)) <= now
+	end
+	if ok then
+		redis.call("HSET", KEYS[1], ARGV[i], value)
+		table.insert(claimed, ARGV[i])
+	end
+end
+redis.call("PEXPIRE", KEYS[1], lease)
+return claimed
+`)
+
+// releaseClaimsUpToScript 删除 SeqID 不大于指定值的认领（累积 ACK）
+// 消息 ID 最后一个冒号之后是 SeqID
+// KEYS: claims
+// ARGV: 最大 SeqID
+var releaseClaimsUpToScript = redis.NewScript(`
+local max = tonumber(ARGV[1])
+for _, id in ipairs(redis.call("HKEYS", KEYS[1])) do
+	local seq = tonumber(string.match(id, ":(-?%d+)$"))
+	if seq and seq <= max then
+		redis.call("HDEL", KEYS[1], id)
+	end
+end
+return 1
+`)
+
+// ==================== 认领与释放 ====================
+
+// Claim 为设备认领一批离线消息（按消息 ID），返回认领成功的消息 ID
+func (m *OfflineManager) Claim(userID, owner string, msgIDs []string) (map[string]bool, error) {
+	claimed := make(map[string]bool, len(msgIDs))
+	if len(msgIDs) == 0 {
+		return claimed, nil
+	}
+
+	args := []interface{}{owner, wallNow().UnixMilli(), OfflineClaimLease.Milliseconds()}
+	for _, id := range msgIDs {
+		args = append(args, id)
+	}
+	result, err := claimScript.Run(m.ctx, pkgredis.Client, []string{OfflineClaimKeyPrefix + userID}, args...).StringSlice()
+	if err != nil {
+		return nil, fmt.Errorf("failed to claim offline messages: %w", err)
+	}
+	for _, id := range result {
+		claimed[id] = true
+	}
+	return claimed, nil
+}
+
+// ReleaseClaims 释放认领（推送失败或中途停止），其他设备可以立即认领
+func (m *OfflineManager) ReleaseClaims(userID string, msgIDs []string) error {
+	if len(msgIDs) == 0 {
+		return nil
+	}
+	return pkgredis.Client.HDel(m.ctx, OfflineClaimKeyPrefix+userID, msgIDs...).Err()
+}
+
+// releaseClaimsUpTo 累积 ACK 后删除对应的认领
+func (m *OfflineManager) releaseClaimsUpTo(userID string, maxSeqID int64) error {
+	return releaseClaimsUpToScript.Run(m.ctx, pkgredis.Client,
+		[]string{OfflineClaimKeyPrefix + userID}, maxSeqID).Err()
+}
@@ -0,0 +1,119 @@
+package service
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+// claimAll 以 owner 的身份遍历离线盒子，返回本设备认领到的消息 ID（并标记为已推送）
+func claimAll(t *testing.T, h *MessageHandler, userID, owner string) []string {
+	t.Helper()
+	cursor := h.newOfflineCursor(userID, owner)
+	defer cursor.releaseUnsent()
+
+	var ids []string
+	for {
+		msg, err := cursor.next()
+		if err != nil {
+			t.Error(err)
+			return ids
+		}
+		if msg == nil {
+			return ids
+		}
+		if cursor.isClaimed(msg) {
+			cursor.markSent(msg)
+			ids = append(ids, msg.messageID())
+		}
+	}
+}
+
+func TestConcurrentFetchersClaimEachMessageOnce(t *testing.T) {
+	requireRedis(t)
+	offline := NewOfflineManager()
+	bob := offlineTestUser(t, offline)
+
+	// 两个会话的 SeqID 完全重叠
+	var all []string
+	for seq := int64(1); seq <= 20; seq++ {
+		for _, from := range []string{"alice", "carol"} {
+			storePrivate(t, offline, bob, from, seq)
+			all = append(all, MessageID(getConversationID(from, bob), seq))
+		}
+	}
+
+	h := NewMessageHandler("gateway_test", nil, nil, nil, nil, offline, nil)
+	h.SetOfflineBatch(7)
+
+	var (
+		wg  sync.WaitGroup
+		got [2][]string
+	)
+	for i := range got {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			got[i] = claimAll(t, h, bob, fmt.Sprintf("device%d", i))
+		}(i)
+	}
+	wg.Wait()
+
+	seen := make(map[string]int)
+	for _, ids := range got {
+		for _, id := range ids {
+			seen[id]++
+		}
+	}
+	for _, id := range all {
+		if seen[id] != 1 {
+			t.Errorf("message %s claimed %d times, want 1", id, seen[id])
+		}
+	}
+	if len(seen) != len(all) {
+		t.Errorf("claimed %d distinct messages, want %d", len(seen), len(all))
+	}
+}
+
+func TestSelectiveAckKeepsSameSeqClaim(t *testing.T) {
+	requireRedis(t)
+	offline := NewOfflineManager()
+	bob := offlineTestUser(t, offline)
+	storePrivate(t, offline, bob, "alice", 1)
+	storePrivate(t, offline, bob, "carol", 1)
+
+	alice := MessageID(getConversationID("alice", bob), 1)
+	carol := MessageID(getConversationID("carol", bob), 1)
+
+	claimed, err := offline.Claim(bob, "phone", []string{alice, carol})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !claimed[alice] || !claimed[carol] {
+		t.Fatalf("phone claimed %v, want both", claimed)
+	}
+
+	// 手机确认了 alice 的消息：carol 的同 SeqID 消息仍由手机认领，电脑不能再认领
+	if err := offline.RemoveMessages(bob, []string{alice}); err != nil {
+		t.Fatal(err)
+	}
+	claimed, err = offline.Claim(bob, "pc", []string{carol})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claimed[carol] {
+		t.Fatal("pc claimed a message still leased to phone")
+	}
+
+	// 累积确认按消息 ID 中的 SeqID 释放认领
+	if err := offline.Remove(bob, 1); err != nil {
+		t.Fatal(err)
+	}
+	claimed, err = offline.Claim(bob, "pc", []string{carol})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !claimed[carol] {
+		t.Fatal("claim not released by cumulative ack")
+	}
+}
@@ -0,0 +1,94 @@
+/*
+Package service - 时钟工具
+
+=== 为什么不能直接用 time.Now()？===
+
+服务器的墙上时钟 (wall clock) 并不保证单调递增：
+NTP 校时、手动改时间都可能让时钟向后跳。
+
+	真实时间 ──────────────────────────────────────▶
+	墙上时钟   10:00:00  10:00:05  09:59:58  10:00:03
+	                              ▲
+	                          NTP 回拨 7 秒
+
+直接用墙上时钟会导致：
+- 后发的消息时间戳比先发的还早，客户端排序错乱
+- 用两个墙上时间相减计算时间窗口，结果可能为负数
+
+=== 解决方案 ===
+
+ 1. 时间戳：使用 wallNow()，保证进程内返回值永不回退
+    （回拨期间停在上一次的值，直到真实时钟追上来）
+
+ 2. 时间窗口（如超时判断）：使用 time.Since(captured)
+    Go 的 time.Now() 携带单调时钟读数，time.Since 基于单调时钟计算，
+    不受墙上时钟跳变影响。不要用两个墙上时间戳相减。
+
+=== 客户端时钟同步（CmdTypeTimeSync）===
+
+客户端时钟不准时，定时消息、撤回时间窗口等依赖时间的功能会出错。
+客户端按 NTP 的方式估算自己与服务器的时差：
+
+	客户端 t0 ──── {"client_time": t0} ────▶ t1 服务器收到
+	客户端 t3 ◀─── {t0, t1, t2} ─────────── t2 服务器发出
+
+	offset = ((t1 - t0) + (t2 - t3)) / 2    // 服务器时间 - 客户端时间
+	rtt    = (t3 - t0) - (t2 - t1)
+
+服务器时间使用 ServerTime，与消息时间戳同源；计算见 ClockOffset。
+*/
+package service
+
+import (
+	"sync"
+	"time"
+)
+
+// ==================== 时钟源 ====================
+
+var (
+	// nowFunc 墙上时钟来源，默认 time.Now
+	nowFunc = time.Now
+
+	// clockMu 保护 lastWallTime
+	clockMu sync.Mutex
+
+	// lastWallTime 上一次发出的时间戳（不含单调时钟读数）
+	lastWallTime time.Time
+)
+
+// ServerTime 服务器的权威时间（与消息时间戳同源，不回退）
+func ServerTime() time.Time {
+	return wallNow()
+}
+
+// ClockOffset 根据一次时间同步的四个时间戳（Unix 毫秒）估算时钟偏差
+//
+// t0 客户端发送、t1 服务器收到、t2 服务器发出、t3 客户端收到
+// offset 为服务器时间减客户端时间，客户端时间加上 offset 即为服务器时间；
+// rtt 为扣除服务器处理时间后的网络往返时间
+func ClockOffset(t0, t1, t2, t3 int64) (offset, rtt int64) {
+	offset = ((t1 - t0) + (t2 - t3)) / 2
+	rtt = (t3 - t0) - (t2 - t1)
+	return offset, rtt
+}
+
+// wallNow 返回单调不回退的当前时间
+//
+// 如果系统时钟发生回拨，返回上一次发出的时间，
+// 保证同一进程内生成的消息时间戳始终非递减
+//
+// 比较前用 Round(0) 去掉单调时钟读数：两个 time.Now() 的返回值都带单调读数时，
+// Before 只比较单调时钟，墙上时钟回拨不会被发现
+func wallNow() time.Time {
+	now := nowFunc().Round(0)
+
+	clockMu.Lock()
+	defer clockMu.Unlock()
+
+	if now.Before(lastWallTime) {
+		return lastWallTime
+	}
+	lastWallTime = now
+	return now
+}
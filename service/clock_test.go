@@ -0,0 +1,56 @@
+package service
+
+import (
+	"testing"
+	"time"
+)
+
+// withClock 用 times 依次作为墙上时钟，测试结束后恢复
+func withClock(t *testing.T, times ...time.Time) {
+	t.Helper()
+	clockMu.Lock()
+	savedNow, savedLast := nowFunc, lastWallTime
+	lastWallTime = time.Time{}
+	clockMu.Unlock()
+
+	i := 0
+	nowFunc = func() time.Time {
+		now := times[i]
+		if i < len(times)-1 {
+			i++
+		}
+		return now
+	}
+	t.Cleanup(func() {
+		clockMu.Lock()
+		nowFunc, lastWallTime = savedNow, savedLast
+		clockMu.Unlock()
+	})
+}
+
+func TestWallNowClockStepBack(t *testing.T) {
+	base := time.UnixMilli(1_700_000_000_000)
+	withClock(t,
+		base,
+		base.Add(5*time.Second),
+		base.Add(-2*time.Second), // NTP 回拨 7 秒
+		base.Add(3*time.Second),  // 仍早于回拨前
+		base.Add(6*time.Second),  // 追上来了
+	)
+
+	want := []int64{0, 5000, 5000, 5000, 6000}
+	for i, w := range want {
+		got := wallNow().UnixMilli() - base.UnixMilli()
+		if got != w {
+			t.Fatalf("call %d: got +%dms, want +%dms", i, got, w)
+		}
+	}
+}
+
+func TestClockOffset(t *testing.T) {
+	// 客户端比服务器慢 100ms，单程延迟 20ms，服务器处理 5ms
+	offset, rtt := ClockOffset(1000, 1120, 1125, 1045)
+	if offset != 100 || rtt != 40 {
+		t.Fatalf("ClockOffset = (%d, %d), want (100, 40)", offset, rtt)
+	}
+}
@@ -0,0 +1,385 @@
+/*
+Package service - 会话列表
+
+=== 使用场景 ===
+
+聊天应用首页的会话列表：每个会话显示最后一条消息预览、时间和未读数，
+按最近活跃时间排序。
+
+=== Redis 数据结构 ===
+
+每个用户三个 Key，以会话 ID 为成员/字段（私聊为对方用户 ID，群聊为 group:<群 ID>）：
+
+	conv_list:bob     (ZSet)  Score = 最后活跃时间（Unix 毫秒）
+	┌────────────────┬──────────────────┐
+	│ 1700000009000  │ alice            │
+	│ 1700000005000  │ group:team       │
+	└────────────────┴──────────────────┘
+
+	conv_meta:bob     (Hash)  会话 ID → 最后一条消息（JSON）
+	conv_unread:bob   (Hash)  会话 ID → 未读数
+	conv_read:bob     (Hash)  会话 ID → 已读位置（SeqID，只前进不后退）
+	conv_archived:bob (Set)   已归档的会话 ID
+
+- 发送和接收都会更新会话；只有接收会增加未读数
+- 消息乱序到达时，只有更新的消息才会覆盖时间和预览（Lua 中比较 Score）
+- 每个用户最多保留 MaxConversations 个会话，最久未活跃的连同预览和未读数一起删除
+- 更新是可选的（MessageHandler.SetConversations），异步执行不阻塞发送
+
+=== 已读位置同步 ===
+
+客户端可以在心跳中捎带各会话的已读位置（见 ApplyReadPointers），一次心跳同时完成
+续期和多设备之间的已读同步，不需要为每个会话单独发送已读请求：
+
+	{"read": {"alice": 42, "group:team": 17}}
+
+已读位置只前进；达到会话最后一条消息的 SeqID 时清零未读数，
+位置落后于最后一条消息时（读完之后又收到新消息）未读数保持不变。
+
+=== 归档 ===
+
+归档的会话从默认列表中隐藏，但最后消息、未读数和历史都保留；
+ListConversations 传 includeArchived 时一起返回并标记 Archived。
+收到新消息的会话自动取消归档（在 touchConvScript 中与更新原子完成），
+自己发出的消息不会取消归档。
+*/
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+
+	pkgredis "go-im/pkg/redis"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// ==================== 常量定义 ====================
+
+const (
+	// ConvListKeyPrefix 会话列表 Key 前缀
+	// 完整 Key: conv_list:<userID>
+	ConvListKeyPrefix = "conv_list:"
+
+	// ConvMetaKeyPrefix 最后一条消息 Key 前缀
+	// 完整 Key: conv_meta:<userID>
+	ConvMetaKeyPrefix = "conv_meta:"
+
+	// ConvUnreadKeyPrefix 未读数 Key 前缀
+	// 完整 Key: conv_unread:<userID>
+	ConvUnreadKeyPrefix = "conv_unread:"
+
+	// ConvReadKeyPrefix 已读位置 Key 前缀
+	// 完整 Key: conv_read:<userID>
+	ConvReadKeyPrefix = "conv_read:"
+
+	// ConvArchivedKeyPrefix 已归档会话 Key 前缀
+	// 完整 Key: conv_archived:<userID>
+	ConvArchivedKeyPrefix = "conv_archived:"
+
+	// MaxReadPointers 一次同步最多处理的会话数，超出部分忽略
+	MaxReadPointers = 64
+
+	// MaxConversations 每个用户保留的最大会话数
+	MaxConversations = 500
+
+	// PreviewMaxRunes 消息预览的最大字符数
+	PreviewMaxRunes = 64
+)
+
+// ErrConversationNotFound 会话不在用户的会话列表中
+var ErrConversationNotFound = errors.New("conversation not found")
+
+// touchConvScript 更新会话，收到消息时取消归档
+// KEYS: list, meta, unread, read, archived
+// ARGV: 会话 ID, 时间, 最后消息 JSON, 是否增加未读(1/0), 最大会话数
+var touchConvScript = redis.NewScript(`
+local cur = redis.call("ZSCORE", KEYS[1], ARGV[1])
+if not cur or tonumber(cur) <= tonumber(ARGV[2]) then
+	redis.call("ZADD", KEYS[1], ARGV[2], ARGV[1])
+	redis.call("HSET", KEYS[2], ARGV[1], ARGV[3])
+end
+if ARGV[4] == "1" then
+	redis.call("HINCRBY", KEYS[3], ARGV[1], 1)
+	redis.call("SREM", KEYS[5], ARGV[1])
+end
+local excess = redis.call("ZCARD", KEYS[1]) - tonumber(ARGV[5])
+if excess > 0 then
+	local old = redis.call("ZRANGE", KEYS[1], 0, excess - 1)
+	redis.call("ZREMRANGEBYRANK", KEYS[1], 0, excess - 1)
+	for _, id in ipairs(old) do
+		redis.call("HDEL", KEYS[2], id)
+		redis.call("HDEL", KEYS[3], id)
+		redis.call("HDEL", KEYS[4], id)
+		redis.call("SREM", KEYS[5], id)
+	end
+end
+return 1
+`)
+
+// archiveConvScript 归档会话列表中已有的会话
+// KEYS: list, archived
+// ARGV: 会话 ID
+// 返回 0 表示会话不存在
+var archiveConvScript = redis.NewScript(`
+if not redis.call("ZSCORE", KEYS[1], ARGV[1]) then
+	return 0
+end
+redis.call("SADD", KEYS[2], ARGV[1])
+return 1
+`)
+
+// advanceReadScript 前进已读位置，读到最后一条消息时清零未读数
+// KEYS: meta, unread, read
+// ARGV: 会话 ID, 已读 SeqID
+// 返回 1 表示未读数已清零
+var advanceReadScript = redis.NewScript(`
+local seq = tonumber(ARGV[2])
+local cur = tonumber(redis.call("HGET", KEYS[3], ARGV[1]) or "0")
+if seq > cur then
+	redis.call("HSET", KEYS[3], ARGV[1], seq)
+else
+	seq = cur
+end
+local raw = redis.call("HGET", KEYS[1], ARGV[1])
+if raw then
+	local last = cjson.decode(raw)
+	if last.seq_id and seq < tonumber(last.seq_id) then
+		return 0
+	end
+end
+redis.call("HDEL", KEYS[2], ARGV[1])
+return 1
+`)
+
+// ==================== 结构体定义 ====================
+
+// LastMessage 会话的最后一条消息
+type LastMessage struct {
+	FromUserID string `json:"from_user_id"`
+	Preview    string `json:"preview"`
+	SeqID      int64  `json:"seq_id"`
+	Timestamp  int64  `json:"timestamp"`
+}
+
+// Conversation 会话列表中的一项
+type Conversation struct {
+	ID      string       `json:"id"`                 // 会话 ID（对方用户 ID 或 group:<群 ID>）
+	PeerID  string       `json:"peer_id,omitempty"`  // 私聊对方
+	GroupID string       `json:"group_id,omitempty"` // 群 ID
+	Last    *LastMessage `json:"last,omitempty"`     // 最后一条消息
+	Unread  int64        `json:"unread"`             // 未读数
+
+	LastRead int64 `json:"last_read,omitempty"` // 已读位置（SeqID）
+	Archived bool  `json:"archived,omitempty"`  // 是否已归档
+}
+
+// ConversationManager 会话列表管理器
+type ConversationManager struct {
+	ctx context.Context
+}
+
+// NewConversationManager 创建会话列表管理器
+func NewConversationManager() *ConversationManager {
+	return &ConversationManager{
+		ctx: pkgredis.Context(),
+	}
+}
+
+// ==================== 更新 ====================
+
+// Touch 用一条新消息更新用户的会话
+// incoming 为 true 表示用户是接收方，未读数加一
+func (m *ConversationManager) Touch(userID, convID string, last *LastMessage, incoming bool) error {
+	data, err := json.Marshal(last)
+	if err != nil {
+		return err
+	}
+	incr := "0"
+	if incoming {
+		incr = "1"
+	}
+	keys := []string{ConvListKeyPrefix + userID, ConvMetaKeyPrefix + userID,
+		ConvUnreadKeyPrefix + userID, ConvReadKeyPrefix + userID, ConvArchivedKeyPrefix + userID}
+	if err := touchConvScript.Run(m.ctx, pkgredis.Client, keys,
+		convID, last.Timestamp, data, incr, MaxConversations).Err(); err != nil {
+		return fmt.Errorf("failed to update conversation: %w", err)
+	}
+	return nil
+}
+
+// MarkRead 清零会话的未读数
+func (m *ConversationManager) MarkRead(userID, convID string) error {
+	return pkgredis.Client.HDel(m.ctx, ConvUnreadKeyPrefix+userID, convID).Err()
+}
+
+// ApplyReadPointers 批量前进已读位置（会话 ID → 已读 SeqID）
+// 最多处理 MaxReadPointers 个会话，返回清零了未读数的会话数
+func (m *ConversationManager) ApplyReadPointers(userID string, pointers map[string]int64) (int, error) {
+	keys := []string{ConvMetaKeyPrefix + userID, ConvUnreadKeyPrefix + userID, ConvReadKeyPrefix + userID}
+	cleared, applied := 0, 0
+	for convID, seq := range pointers {
+		if applied == MaxReadPointers {
+			break
+		}
+		if convID == "" || seq <= 0 {
+			continue
+		}
+		applied++
+		n, err := advanceReadScript.Run(m.ctx, pkgredis.Client, keys, convID, seq).Int()
+		if err != nil {
+			return cleared, fmt.Errorf("failed to apply read pointer: %w", err)
+		}
+		cleared += n
+	}
+	return cleared, nil
+}
+
+// ==================== 归档 ====================
+
+// Archive 归档会话，会话不在列表中时返回 ErrConversationNotFound
+func (m *ConversationManager) Archive(userID, convID string) error {
+	keys := []string{ConvListKeyPrefix + userID, ConvArchivedKeyPrefix + userID}
+	ok, err := archiveConvScript.Run(m.ctx, pkgredis.Client, keys, convID).Int()
+	if err != nil {
+		return fmt.Errorf("failed to archive conversation: %w", err)
+	}
+	if ok == 0 {
+		return ErrConversationNotFound
+	}
+	return nil
+}
+
+// Unarchive 取消归档（会话未归档时无操作）
+func (m *ConversationManager) Unarchive(userID, convID string) error {
+	return pkgredis.Client.SRem(m.ctx, ConvArchivedKeyPrefix+userID, convID).Err()
+}
+
+// ==================== 查询 ====================
+
+// LastSeq 会话最后一条消息的 SeqID（会话不存在时为 0）
+func (m *ConversationManager) LastSeq(userID, convID string) (int64, error) {
+	raw, err := pkgredis.Client.HGet(m.ctx, ConvMetaKeyPrefix+userID, convID).Result()
+	if err != nil {
+		if isNotFound(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	var last LastMessage
+	if err := json.Unmarshal([]byte(raw), &last); err != nil {
+		return 0, nil
+	}
+	return last.SeqID, nil
+}
+
+// ListConversations 按最近活跃时间倒序返回用户的会话
+// includeArchived 为 false 时跳过已归档的会话
+func (m *ConversationManager) ListConversations(userID string, limit int, includeArchived bool) ([]*Conversation, error) {
+	if limit <= 0 || limit > MaxConversations {
+		limit = MaxConversations
+	}
+
+	archivedIDs, err := pkgredis.Client.SMembers(m.ctx, ConvArchivedKeyPrefix+userID).Result()
+	if err != nil {
+		return nil, err
+	}
+	archived := make(map[string]bool, len(archivedIDs))
+	for _, id := range archivedIDs {
+		archived[id] = true
+	}
+
+	// 排除归档会话时多取这么多条，过滤后仍能凑满 limit
+	fetch := limit
+	if !includeArchived {
+		fetch += len(archived)
+	}
+	all, err := pkgredis.Client.ZRevRange(m.ctx, ConvListKeyPrefix+userID, 0, int64(fetch-1)).Result()
+	if err != nil {
+		return nil, err
+	}
+	ids := all[:0]
+	for _, id := range all {
+		if len(ids) == limit {
+			break
+		}
+		if includeArchived || !archived[id] {
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	pipe := pkgredis.Client.Pipeline()
+	metaCmd := pipe.HMGet(m.ctx, ConvMetaKeyPrefix+userID, ids...)
+	unreadCmd := pipe.HMGet(m.ctx, ConvUnreadKeyPrefix+userID, ids...)
+	readCmd := pipe.HMGet(m.ctx, ConvReadKeyPrefix+userID, ids...)
+	if _, err := pipe.Exec(m.ctx); err != nil {
+		return nil, err
+	}
+	metas, unreads, reads := metaCmd.Val(), unreadCmd.Val(), readCmd.Val()
+
+	convs := make([]*Conversation, 0, len(ids))
+	for i, id := range ids {
+		conv := &Conversation{ID: id, Archived: archived[id]}
+		if groupID, ok := strings.CutPrefix(id, "group:"); ok {
+			conv.GroupID = groupID
+		} else {
+			conv.PeerID = id
+		}
+		if s, ok := metas[i].(string); ok {
+			var last LastMessage
+			if err := json.Unmarshal([]byte(s), &last); err == nil {
+				conv.Last = &last
+			}
+		}
+		if s, ok := unreads[i].(string); ok {
+			conv.Unread, _ = strconv.ParseInt(s, 10, 64)
+		}
+		if s, ok := reads[i].(string); ok {
+			conv.LastRead, _ = strconv.ParseInt(s, 10, 64)
+		}
+		convs = append(convs, conv)
+	}
+	return convs, nil
+}
+
+// previewOf 截断消息内容作为预览
+func previewOf(content string) string {
+	runes := []rune(content)
+	if len(runes) <= PreviewMaxRunes {
+		return content
+	}
+	return string(runes[:PreviewMaxRunes]) + "…"
+}
+
+// ==================== 消息处理器接入 ====================
+
+// SetConversations 开启会话列表维护，nil 表示关闭
+func (h *MessageHandler) SetConversations(convs *ConversationManager) {
+	h.convs = convs
+}
+
+// touchConversation 异步更新会话列表
+func (h *MessageHandler) touchConversation(userID, convID string, msg *ChatMessage, incoming bool) {
+	if h.convs == nil {
+		return
+	}
+	last := &LastMessage{
+		FromUserID: LocalID(msg.FromUserID),
+		Preview:    previewOf(msg.Content),
+		SeqID:      msg.SeqID,
+		Timestamp:  msg.Timestamp,
+	}
+	go func() {
+		if err := h.convs.Touch(userID, convID, last, incoming); err != nil {
+			log.Printf("[Conversation] %v", err)
+		}
+	}()
+}
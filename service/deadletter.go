@@ -0,0 +1,165 @@
+/*
+Package service - 死信
+
+=== 使用场景 ===
+
+有些消息最终无法送达，过去只打一行日志就消失了：
+
+	收件人不存在（开启收件人检查）     → unknown_recipient
+	离线存储失败（如 Redis 写入出错）  → store_failed
+	超过投递截止时间                   → expired
+	离线投递时编码失败                 → encode_failed
+	客户端 NACK 重投次数用完           → redelivery_limit
+
+开启死信后，这些消息连同原因交给 DeadLetterHandler，运维可以查看、排查并重新处理。
+
+=== 默认实现：Redis List ===
+
+	dead_letter (List)  LPUSH 最新的在左边，最多保留 MaxDeadLetters 条
+	┌─────────────────────────────────────────────────────────────┐
+	│ {"reason":"store_failed","message":{...},"error":"...",...} │
+	│ {"reason":"expired","message":{...},...}                    │
+	└─────────────────────────────────────────────────────────────┘
+
+	LRANGE dead_letter 0 9     # 查看最近 10 条
+	RPOP dead_letter           # 取出最早的一条重新处理（见 DeadLetterList.Pop）
+
+也可以通过 MessageHandler.SetDeadLetter 注入其他实现（如写入消息队列）。
+死信写入是异步的，失败只记录日志，不影响原来的失败路径。
+*/
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+
+	pkgredis "go-im/pkg/redis"
+)
+
+// ==================== 常量定义 ====================
+
+const (
+	// DeadLetterKey 死信列表 Key
+	DeadLetterKey = "dead_letter"
+
+	// MaxDeadLetters 死信列表保留的最大条数，超出部分丢弃最早的
+	MaxDeadLetters = 10000
+)
+
+// 死信原因
+const (
+	DeadLetterUnknownRecipient = "unknown_recipient" // 收件人不存在
+	DeadLetterStoreFailed      = "store_failed"      // 离线存储失败
+	DeadLetterExpired          = "expired"           // 超过投递截止时间
+	DeadLetterEncodeFailed     = "encode_failed"     // 投递时编码失败
+	DeadLetterRedeliveryLimit  = "redelivery_limit"  // NACK 重投次数用完
+)
+
+// ==================== 结构体定义 ====================
+
+// DeadLetter 一条无法送达的消息
+type DeadLetter struct {
+	Reason    string       `json:"reason"`          // 原因（DeadLetterXxx）
+	Message   *ChatMessage `json:"message"`         // 原始消息
+	Error     string       `json:"error,omitempty"` // 导致失败的错误
+	GatewayID string       `json:"gateway_id"`      // 记录死信的网关
+	Timestamp int64        `json:"timestamp"`       // 记录时间（Unix 毫秒）
+}
+
+// DeadLetterHandler 死信接收者
+type DeadLetterHandler interface {
+	HandleDeadLetter(letter *DeadLetter) error
+}
+
+// DeadLetterList 基于 Redis List 的死信接收者
+type DeadLetterList struct {
+	ctx context.Context
+}
+
+// NewDeadLetterList 创建 Redis List 死信接收者
+func NewDeadLetterList() *DeadLetterList {
+	return &DeadLetterList{
+		ctx: pkgredis.Context(),
+	}
+}
+
+// HandleDeadLetter 写入死信列表，并裁剪到 MaxDeadLetters 条
+func (l *DeadLetterList) HandleDeadLetter(letter *DeadLetter) error {
+	data, err := json.Marshal(letter)
+	if err != nil {
+		return err
+	}
+	pipe := pkgredis.Client.TxPipeline()
+	pipe.LPush(l.ctx, DeadLetterKey, data)
+	pipe.LTrim(l.ctx, DeadLetterKey, 0, MaxDeadLetters-1)
+	if _, err := pipe.Exec(l.ctx); err != nil {
+		return fmt.Errorf("failed to write dead letter: %w", err)
+	}
+	return nil
+}
+
+// List 返回最近的 limit 条死信（从新到旧）
+func (l *DeadLetterList) List(limit int) ([]*DeadLetter, error) {
+	if limit <= 0 || limit > MaxDeadLetters {
+		limit = MaxDeadLetters
+	}
+	raws, err := pkgredis.Client.LRange(l.ctx, DeadLetterKey, 0, int64(limit-1)).Result()
+	if err != nil {
+		return nil, err
+	}
+	letters := make([]*DeadLetter, 0, len(raws))
+	for _, raw := range raws {
+		var letter DeadLetter
+		if err := json.Unmarshal([]byte(raw), &letter); err != nil {
+			continue
+		}
+		letters = append(letters, &letter)
+	}
+	return letters, nil
+}
+
+// Pop 取出最早的一条死信用于重新处理，列表为空时返回 nil
+func (l *DeadLetterList) Pop() (*DeadLetter, error) {
+	raw, err := pkgredis.Client.RPop(l.ctx, DeadLetterKey).Result()
+	if err != nil {
+		if isNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var letter DeadLetter
+	if err := json.Unmarshal([]byte(raw), &letter); err != nil {
+		return nil, fmt.Errorf("invalid dead letter: %w", err)
+	}
+	return &letter, nil
+}
+
+// ==================== 消息处理器接入 ====================
+
+// SetDeadLetter 设置死信接收者，nil 表示关闭（无法送达的消息只记录日志）
+func (h *MessageHandler) SetDeadLetter(handler DeadLetterHandler) {
+	h.deadLetters = handler
+}
+
+// deadLetter 把无法送达的消息交给死信接收者（异步）
+func (h *MessageHandler) deadLetter(msg *ChatMessage, reason string, cause error) {
+	if h.deadLetters == nil {
+		return
+	}
+	letter := &DeadLetter{
+		Reason:    reason,
+		Message:   msg,
+		GatewayID: h.gatewayID,
+		Timestamp: wallNow().UnixMilli(),
+	}
+	if cause != nil {
+		letter.Error = cause.Error()
+	}
+	go func() {
+		if err := h.deadLetters.HandleDeadLetter(letter); err != nil {
+			log.Printf("[DeadLetter] Failed to record %s message %d for %s: %v", reason, msg.SeqID, msg.ToUserID, err)
+		}
+	}()
+}
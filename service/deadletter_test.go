@@ -0,0 +1,184 @@
+package service
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	pkgredis "go-im/pkg/redis"
+	"go-im/protocol"
+	"go-im/server"
+)
+
+// fakeDeadLetters 把收到的死信放进通道（死信是异步记录的）
+type fakeDeadLetters struct {
+	ch chan *DeadLetter
+}
+
+func newFakeDeadLetters() *fakeDeadLetters {
+	return &fakeDeadLetters{ch: make(chan *DeadLetter, 16)}
+}
+
+func (f *fakeDeadLetters) HandleDeadLetter(letter *DeadLetter) error {
+	f.ch <- letter
+	return nil
+}
+
+// expect 等待一条死信并检查原因
+func (f *fakeDeadLetters) expect(t *testing.T, reason string) *DeadLetter {
+	t.Helper()
+	select {
+	case letter := <-f.ch:
+		if letter.Reason != reason {
+			t.Fatalf("dead letter reason = %q, want %q", letter.Reason, reason)
+		}
+		if letter.GatewayID != "gateway_test" {
+			t.Errorf("dead letter gateway = %q, want gateway_test", letter.GatewayID)
+		}
+		return letter
+	case <-time.After(2 * time.Second):
+		t.Fatalf("no %s dead letter recorded", reason)
+		return nil
+	}
+}
+
+// newDeadLetterHandler 使用真实 Redis 组件的消息处理器，死信交给 fake
+func newDeadLetterHandler(t *testing.T) (*MessageHandler, *fakeDeadLetters) {
+	t.Helper()
+	h := NewMessageHandler("gateway_test", server.NewConnectionManager(), NewSessionManager("gateway_test"), nil,
+		NewSequenceManager(), NewOfflineManager(), NewGroupManager())
+	letters := newFakeDeadLetters()
+	h.SetDeadLetter(letters)
+	return h, letters
+}
+
+func TestDeadLetterUnknownRecipient(t *testing.T) {
+	requireRedis(t)
+	h, letters := newDeadLetterHandler(t)
+	h.SetRecipientCheck(true)
+	nobody := offlineTestUser(t, h.offline)
+
+	err := h.SendPrivateMessage("alice", nobody, []byte("hello?"))
+	if !errors.Is(err, ErrUnknownRecipient) {
+		t.Fatalf("err = %v, want ErrUnknownRecipient", err)
+	}
+	letter := letters.expect(t, DeadLetterUnknownRecipient)
+	if letter.Message.ToUserID != nobody || letter.Message.Content != "hello?" {
+		t.Errorf("dead letter message = %+v", letter.Message)
+	}
+	if letter.Error != ErrUnknownRecipient.Error() {
+		t.Errorf("dead letter error = %q", letter.Error)
+	}
+}
+
+func TestDeadLetterStoreFailed(t *testing.T) {
+	requireRedis(t)
+	h, letters := newDeadLetterHandler(t)
+	bob := offlineTestUser(t, h.offline)
+
+	// 离线盒子的 Key 被占用为字符串：ZADD 返回 WRONGTYPE
+	if err := pkgredis.Client.Set(pkgredis.Context(), OfflineBoxPrefix+bob, "not a zset", 0).Err(); err != nil {
+		t.Fatal(err)
+	}
+	msg := &ChatMessage{FromUserID: "alice", ToUserID: bob, Content: "lost", MsgType: MsgTypePrivate, SeqID: 1}
+	if err := h.storeOfflineMessage(msg); err == nil {
+		t.Fatal("storeOfflineMessage succeeded, want error")
+	}
+	letter := letters.expect(t, DeadLetterStoreFailed)
+	if letter.Message.SeqID != 1 || letter.Error == "" {
+		t.Errorf("dead letter = %+v", letter)
+	}
+}
+
+func TestDeadLetterExpired(t *testing.T) {
+	requireRedis(t)
+	h, letters := newDeadLetterHandler(t)
+	bob := offlineTestUser(t, h.offline)
+	alice := offlineTestUser(t, h.offline)
+	t.Cleanup(func() {
+		pkgredis.Client.Del(pkgredis.Context(), SequenceKeyPrefix+getConversationID(alice, bob))
+	})
+
+	err := h.offline.Store(bob, &OfflineMessage{
+		FromUserID:    alice,
+		ToUserID:      bob,
+		Content:       []byte("too late"),
+		SeqID:         1,
+		DeliverBefore: time.Now().Add(-time.Minute).UnixMilli(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv, peer := net.Pipe()
+	go io.Copy(io.Discard, peer)
+	conn := server.NewConnection(1, srv)
+	conn.SetUserID(bob)
+	defer conn.Close(server.CloseReasonShutdown)
+	defer peer.Close()
+
+	if err := h.DeliverOfflineMessages(bob, conn); err != nil {
+		t.Fatal(err)
+	}
+	letter := letters.expect(t, DeadLetterExpired)
+	if letter.Message.Content != "too late" {
+		t.Errorf("dead letter message = %+v", letter.Message)
+	}
+	if ids := boxIDs(t, h.offline, bob); len(ids) != 0 {
+		t.Errorf("expired message still in box: %v", ids)
+	}
+
+	// 发送者收到过期通知（异步存入其离线盒子），等它写完再清理
+	deadline := time.Now().Add(2 * time.Second)
+	for len(boxIDs(t, h.offline, alice)) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("sender was not notified of the expired message")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// 重投上限只涉及连接上的在途消息，不需要 Redis
+func TestDeadLetterRedeliveryLimit(t *testing.T) {
+	h := NewMessageHandler("gateway_test", nil, nil, nil, nil, nil, nil)
+	letters := newFakeDeadLetters()
+	h.SetDeadLetter(letters)
+
+	srv, peer := net.Pipe()
+	go io.Copy(io.Discard, peer)
+	conn := server.NewConnection(1, srv)
+	conn.SetUserID("bob")
+	conn.Start(func(*server.Connection, *protocol.Message) {})
+	defer conn.Close(server.CloseReasonShutdown)
+	defer peer.Close()
+
+	msg := &ChatMessage{FromUserID: "alice", ToUserID: "bob", Content: "garbled", MsgType: MsgTypePrivate, SeqID: 7}
+	if !conn.ReserveInFlight(msg.SeqID, msg.messageID(), 0, msg) {
+		t.Fatal("ReserveInFlight failed")
+	}
+
+	for i := 1; i <= MaxRedeliveries; i++ {
+		if n, err := h.HandleNack(conn, msg.SeqID); err != nil || n != 1 {
+			t.Fatalf("nack %d: (%d, %v), want (1, nil)", i, n, err)
+		}
+	}
+	if _, err := h.HandleNack(conn, msg.SeqID); !errors.Is(err, ErrRedeliveryLimit) {
+		t.Fatalf("err = %v, want ErrRedeliveryLimit", err)
+	}
+	letter := letters.expect(t, DeadLetterRedeliveryLimit)
+	if letter.Message != msg || letter.Error != ErrRedeliveryLimit.Error() {
+		t.Errorf("dead letter = %+v", letter)
+	}
+
+	// 继续 NACK 不会重复记录
+	if _, err := h.HandleNack(conn, msg.SeqID); !errors.Is(err, ErrRedeliveryLimit) {
+		t.Fatalf("err = %v, want ErrRedeliveryLimit", err)
+	}
+	select {
+	case letter := <-letters.ch:
+		t.Fatalf("unexpected second dead letter %+v", letter)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
@@ -0,0 +1,95 @@
+/*
+Package service - 投递策略
+
+=== 为什么需要投递策略？===
+
+私聊消息默认"在线推送，不在线存离线"。但有些消息不适合这样处理：
+
+	临时通知（"对方正在通话中"）   过一会儿就没有意义，不在线时不应存储
+	需要留档的消息                 即使在线推送成功，也要在离线盒子里留一份
+
+与其在每个功能里各自判断，发送时为消息指定投递策略：
+
+	策略               接收者在线            接收者不在线 / 无法推送
+	store_if_offline   推送                  存离线（默认，原有行为）
+	online_only        推送                  丢弃，不存储、不唤醒推送
+	always_store       推送，并存一份离线    存离线
+
+=== 实现 ===
+
+  - 策略随消息经过 Pub/Sub 转发（PubSubMessage.Delivery），接收端网关按同样的规则处理
+  - 所有"改存离线"的分支都经过 storeOfflineMessage，策略在那里统一生效
+  - always_store 的副本在发送时由发送方网关存入（只存一次），之后的离线分支不再重复存储；
+    离线盒子中的副本与其他离线消息一样在 ACK 后删除，断线前未确认时重连会再次投递
+  - online_only 的消息不写入 WAL，网关重启时不会重放
+*/
+package service
+
+import (
+	"errors"
+	"fmt"
+	"log"
+)
+
+// DeliveryPolicy 私聊消息的投递策略
+type DeliveryPolicy int
+
+const (
+	// DeliveryStoreIfOffline 在线推送，不在线存离线（默认）
+	DeliveryStoreIfOffline DeliveryPolicy = iota
+
+	// DeliveryOnlineOnly 只推送给在线连接，不在线时丢弃
+	DeliveryOnlineOnly
+
+	// DeliveryAlwaysStore 在线推送的同时也存入离线盒子
+	DeliveryAlwaysStore
+)
+
+// deliveryPolicyNames 客户端请求中使用的名称
+var deliveryPolicyNames = map[DeliveryPolicy]string{
+	DeliveryStoreIfOffline: "store_if_offline",
+	DeliveryOnlineOnly:     "online_only",
+	DeliveryAlwaysStore:    "always_store",
+}
+
+// ErrUnknownDeliveryPolicy 未知的投递策略名称
+var ErrUnknownDeliveryPolicy = errors.New("unknown delivery policy")
+
+// String 返回策略名称
+func (p DeliveryPolicy) String() string {
+	if name, ok := deliveryPolicyNames[p]; ok {
+		return name
+	}
+	return fmt.Sprintf("DeliveryPolicy(%d)", int(p))
+}
+
+// ParseDeliveryPolicy 解析策略名称，空字符串表示默认策略
+func ParseDeliveryPolicy(name string) (DeliveryPolicy, error) {
+	if name == "" {
+		return DeliveryStoreIfOffline, nil
+	}
+	for p, n := range deliveryPolicyNames {
+		if n == name {
+			return p, nil
+		}
+	}
+	return 0, fmt.Errorf("%w: %q", ErrUnknownDeliveryPolicy, name)
+}
+
+// SendPrivateMessageWithPolicy 按指定的投递策略发送私聊消息
+func (h *MessageHandler) SendPrivateMessageWithPolicy(fromUserID, toUserID string, content []byte, policy DeliveryPolicy) error {
+	if err := h.checkRecipient(fromUserID, toUserID, content); err != nil {
+		return err
+	}
+	_, err := h.send(fromUserID, toUserID, MsgTypePrivate, content, 0, policy)
+	return err
+}
+
+// storeCopy 为 always_store 的消息在路由之前存入副本
+// 存储失败时退回默认策略，之后的离线分支会再尝试存储
+func (h *MessageHandler) storeCopy(msg *ChatMessage) {
+	if err := h.offline.Store(msg.ToUserID, msg.toOfflineMessage()); err != nil {
+		log.Printf("[Message] Failed to store copy of message %d for %s: %v", msg.SeqID, msg.ToUserID, err)
+		msg.Delivery = DeliveryStoreIfOffline
+	}
+}
@@ -0,0 +1,211 @@
+/*
+Package service - 多设备管理
+
+=== 使用场景 ===
+
+同一用户可以同时在手机、电脑等多个设备上登录。
+客服需要查看用户有哪些设备在线，并且能只踢掉其中一个（如丢失的手机），
+不影响其他设备。
+
+=== Redis 数据结构 ===
+
+	Key: user_devices:alice   (Hash)
+	┌──────────────┬──────────────────────────────────────────────┐
+	│ Field (设备)  │ Value (JSON)                                 │
+	├──────────────┼──────────────────────────────────────────────┤
+	│ iphone       │ {"gateway_id":"gateway_1","conn_id":12,...}  │
+	│ macbook      │ {"gateway_id":"gateway_2","conn_id":7,...}   │
+	└──────────────┴──────────────────────────────────────────────┘
+	TTL: 与会话相同，每次登录续期
+
+- 设备 ID 由客户端在认证请求中上报（device_id），未上报时为 conn-<连接ID>
+- 连接断开时只删除仍指向该连接的条目（设备可能已经在别处重连）
+
+=== 踢设备 ===
+
+	KickDevice(alice, iphone)
+	  1. 找到本网关上 alice 的 iphone 连接
+	  2. 发送 CmdTypeKick（reconnect=false），关闭连接
+	  3. 删除设备条目
+	  其他设备的连接不受影响
+
+设备连接在其他网关时返回 ErrDeviceNotLocal，调用方需要到对应网关执行。
+*/
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"time"
+
+	pkgredis "go-im/pkg/redis"
+	"go-im/protocol"
+	"go-im/server"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// ==================== 常量定义 ====================
+
+const (
+	// DeviceKeyPrefix 设备列表 Key 前缀
+	// 完整 Key: user_devices:<userID>
+	DeviceKeyPrefix = "user_devices:"
+
+	// TransportTCP TCP 长连接
+	TransportTCP = "tcp"
+
+	// KickFlushDelay 发出踢出通知后等待多久再关闭连接
+	// 给写协程时间把通知发出去
+	KickFlushDelay = 100 * time.Millisecond
+)
+
+var (
+	// ErrDeviceNotFound 用户没有这个设备
+	ErrDeviceNotFound = errors.New("device not found")
+
+	// ErrDeviceNotLocal 设备连接不在本网关
+	ErrDeviceNotLocal = errors.New("device is not connected to this gateway")
+)
+
+// ==================== 结构体定义 ====================
+
+// DeviceInfo 一个在线设备
+type DeviceInfo struct {
+	DeviceID    string `json:"device_id"`
+	GatewayID   string `json:"gateway_id"`
+	ConnID      uint64 `json:"conn_id"`
+	Transport   string `json:"transport"`
+	ConnectedAt int64  `json:"connected_at"` // Unix 秒
+	LastActive  int64  `json:"last_active"`  // Unix 秒
+}
+
+// DefaultDeviceID 客户端未上报设备 ID 时使用的默认值
+func DefaultDeviceID(connID uint64) string {
+	return "conn-" + strconv.FormatUint(connID, 10)
+}
+
+// ==================== 设备注册 ====================
+
+// RegisterDevice 登录后记录设备
+// 同一设备重复登录时覆盖旧条目
+func (m *SessionManager) RegisterDevice(userID string, info *DeviceInfo) error {
+	data, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+
+	key := DeviceKeyPrefix + userID
+	pipe := pkgredis.Client.Pipeline()
+	pipe.HSet(m.ctx, key, info.DeviceID, data)
+	pipe.Expire(m.ctx, key, m.ttl)
+	if _, err := pipe.Exec(m.ctx); err != nil {
+		return fmt.Errorf("failed to register device: %w", err)
+	}
+	return nil
+}
+
+// removeDeviceScript 仅当设备条目仍指向指定网关上的指定连接时才删除
+var removeDeviceScript = redis.NewScript(`
+local raw = redis.call("HGET", KEYS[1], ARGV[1])
+if not raw then
+	return 0
+end
+local info = cjson.decode(raw)
+if info.gateway_id == ARGV[2] and tostring(info.conn_id) == ARGV[3] then
+	redis.call("HDEL", KEYS[1], ARGV[1])
+	return 1
+end
+return 0
+`)
+
+// RemoveDevice 连接断开时删除设备条目
+// 设备已经重新连接（条目指向了新连接）时保持不变
+func (m *SessionManager) RemoveDevice(userID, deviceID string, connID uint64) error {
+	err := removeDeviceScript.Run(m.ctx, pkgredis.Client, []string{DeviceKeyPrefix + userID},
+		deviceID, m.gatewayID, strconv.FormatUint(connID, 10)).Err()
+	if err != nil {
+		return fmt.Errorf("failed to remove device: %w", err)
+	}
+	return nil
+}
+
+// ListDevices 获取用户的全部在线设备，按连接时间排序
+func (m *SessionManager) ListDevices(userID string) ([]*DeviceInfo, error) {
+	fields, err := pkgredis.Client.HGetAll(m.ctx, DeviceKeyPrefix+userID).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list devices: %w", err)
+	}
+
+	devices := make([]*DeviceInfo, 0, len(fields))
+	for _, raw := range fields {
+		var info DeviceInfo
+		if err := json.Unmarshal([]byte(raw), &info); err != nil {
+			continue
+		}
+		devices = append(devices, &info)
+	}
+	sort.Slice(devices, func(i, j int) bool {
+		if devices[i].ConnectedAt != devices[j].ConnectedAt {
+			return devices[i].ConnectedAt < devices[j].ConnectedAt
+		}
+		return devices[i].DeviceID < devices[j].DeviceID
+	})
+	return devices, nil
+}
+
+// ==================== 查询与踢出 ====================
+
+// ListDevices 获取用户的在线设备
+// 本网关上的设备用连接的实时数据填充最后活跃时间
+func (h *MessageHandler) ListDevices(userID string) ([]*DeviceInfo, error) {
+	devices, err := h.session.ListDevices(userID)
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range devices {
+		if d.GatewayID != h.gatewayID {
+			continue
+		}
+		if conn := h.connManager.GetByConnID(d.ConnID); conn != nil && conn.GetUserID() == userID {
+			d.LastActive = conn.GetLastActive().Unix()
+		}
+	}
+	return devices, nil
+}
+
+// KickDevice 踢掉用户的一个设备
+//
+// 只关闭目标设备的连接并删除其设备条目，用户的其他设备不受影响
+func (h *MessageHandler) KickDevice(userID, deviceID string) error {
+	conn := h.connManager.GetByDevice(userID, deviceID)
+	if conn == nil {
+		devices, err := h.session.ListDevices(userID)
+		if err != nil {
+			return err
+		}
+		for _, d := range devices {
+			if d.DeviceID == deviceID && d.GatewayID != h.gatewayID {
+				return fmt.Errorf("%w: %s", ErrDeviceNotLocal, d.GatewayID)
+			}
+		}
+		return ErrDeviceNotFound
+	}
+
+	conn.SendControl(&protocol.Message{
+		CmdType: protocol.CmdTypeKick,
+		Body:    []byte(`{"reason":"kicked","reconnect":false}`),
+	})
+	time.AfterFunc(KickFlushDelay, func() { conn.Close(server.CloseReasonKicked) })
+
+	if err := h.session.RemoveDevice(userID, deviceID, conn.ID); err != nil {
+		return err
+	}
+
+	log.Printf("[Device] Kicked device %s of user %s (conn-%d)", deviceID, userID, conn.ID)
+	return nil
+}
@@ -0,0 +1,132 @@
+/*
+Package service - 离线消息加密存储（可选）
+
+=== 使用场景 ===
+
+离线盒子里的消息默认是明文 JSON，能访问 Redis 的人都能读到消息内容。
+合规要求静态加密时，可以用部署密钥对成员做 AES-GCM 加密：
+
+	Member = 0x03 + KeyID(4) + Nonce(12) + AES-GCM(内层成员)
+
+- 内层成员就是未加密时的成员（可能已经 gzip 压缩、可能是 MessagePack）
+- KeyID 为密钥 SHA-256 的前 4 字节，用于在多个密钥中找到解密用的那个
+- Score 仍是 SeqID，按 SeqID 删除、范围查询不受影响
+- 与压缩、格式一样按首字节识别，开启加密前写入的明文成员仍可读取
+
+=== 密钥轮换 ===
+
+SetEncryption 的第一个密钥用于加密，其余密钥只用于解密：
+
+ 1. 配置 新密钥,旧密钥 重启：新消息用新密钥加密，旧消息仍能解密
+ 2. 旧消息被重新存储时（如 Export/Import 迁移）用新密钥重新加密
+ 3. 离线消息最多保留 OfflineMessageTTL（7 天），之后旧密钥加密的成员都已过期，
+    可以把旧密钥从配置中移除
+*/
+package service
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// encryptedMarker 加密成员的首字节标记
+const encryptedMarker = 0x03
+
+// offlineKeyIDSize 成员中密钥 ID 的字节数
+const offlineKeyIDSize = 4
+
+var (
+	// ErrInvalidOfflineKey 密钥长度不是 16/24/32 字节
+	ErrInvalidOfflineKey = errors.New("offline encryption key must be 16, 24 or 32 bytes")
+
+	// ErrOfflineKeyNotFound 成员使用的密钥没有配置
+	ErrOfflineKeyNotFound = errors.New("offline encryption key not configured")
+)
+
+// offlineCipher 离线消息加解密
+type offlineCipher struct {
+	primaryID uint32                 // 加密使用的密钥 ID
+	keys      map[uint32]cipher.AEAD // 密钥 ID → AEAD（包括 primary）
+}
+
+// newOfflineCipher 第一个密钥用于加密，全部密钥用于解密
+func newOfflineCipher(keys [][]byte) (*offlineCipher, error) {
+	c := &offlineCipher{keys: make(map[uint32]cipher.AEAD, len(keys))}
+	for i, key := range keys {
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, ErrInvalidOfflineKey
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		id := offlineKeyID(key)
+		if i == 0 {
+			c.primaryID = id
+		}
+		c.keys[id] = aead
+	}
+	return c, nil
+}
+
+// offlineKeyID 密钥 ID：SHA-256 的前 4 字节
+func offlineKeyID(key []byte) uint32 {
+	sum := sha256.Sum256(key)
+	return binary.BigEndian.Uint32(sum[:offlineKeyIDSize])
+}
+
+// seal 用主密钥加密
+func (c *offlineCipher) seal(plain []byte) ([]byte, error) {
+	aead := c.keys[c.primaryID]
+
+	out := make([]byte, 1+offlineKeyIDSize+aead.NonceSize(), 1+offlineKeyIDSize+aead.NonceSize()+len(plain)+aead.Overhead())
+	out[0] = encryptedMarker
+	binary.BigEndian.PutUint32(out[1:], c.primaryID)
+	nonce := out[1+offlineKeyIDSize:]
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	return aead.Seal(out, nonce, plain, nil), nil
+}
+
+// open 解密（data 不含首字节标记）
+func (c *offlineCipher) open(data []byte) ([]byte, error) {
+	if c == nil {
+		return nil, ErrOfflineKeyNotFound
+	}
+	if len(data) < offlineKeyIDSize {
+		return nil, errors.New("encrypted member too short")
+	}
+	aead, ok := c.keys[binary.BigEndian.Uint32(data)]
+	if !ok {
+		return nil, ErrOfflineKeyNotFound
+	}
+	data = data[offlineKeyIDSize:]
+	if len(data) < aead.NonceSize() {
+		return nil, errors.New("encrypted member too short")
+	}
+	return aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], nil)
+}
+
+// SetEncryption 开启离线消息加密存储
+//
+// keys[0] 用于加密之后写入的消息，所有密钥都可用于解密（见包文档的密钥轮换）
+// 不传密钥表示关闭加密，已加密的成员将无法读取
+func (m *OfflineManager) SetEncryption(keys ...[]byte) error {
+	if len(keys) == 0 {
+		m.cipher = nil
+		return nil
+	}
+	c, err := newOfflineCipher(keys)
+	if err != nil {
+		return err
+	}
+	m.cipher = c
+	return nil
+}
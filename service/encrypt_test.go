@@ -0,0 +1,167 @@
+package service
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+var (
+	testOfflineKeyOld = bytes.Repeat([]byte{0x11}, 32)
+	testOfflineKeyNew = bytes.Repeat([]byte{0x22}, 32)
+)
+
+// mustOfflineCipher 用给定密钥创建 offlineCipher，第一个为主密钥
+func mustOfflineCipher(t *testing.T, keys ...[]byte) *offlineCipher {
+	t.Helper()
+	c, err := newOfflineCipher(keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestOfflineCipherRoundTrip(t *testing.T) {
+	c := mustOfflineCipher(t, testOfflineKeyNew)
+	plain := []byte(`{"v":2,"from_user_id":"alice","content":"top secret"}`)
+
+	sealed, err := c.seal(plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sealed[0] != encryptedMarker {
+		t.Fatalf("marker = %#x, want %#x", sealed[0], encryptedMarker)
+	}
+	if bytes.Contains(sealed, []byte("top secret")) || bytes.Contains(sealed, []byte("alice")) {
+		t.Fatalf("sealed member contains plaintext: %q", sealed)
+	}
+
+	opened, err := c.open(sealed[1:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(opened, plain) {
+		t.Fatalf("open = %q, want %q", opened, plain)
+	}
+
+	// 每次加密使用新的 nonce，同一明文的密文不同
+	again, err := c.seal(plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(again, sealed) {
+		t.Fatal("sealing the same plaintext twice produced identical members")
+	}
+}
+
+func TestOfflineCipherInvalidKey(t *testing.T) {
+	if _, err := newOfflineCipher([][]byte{[]byte("short")}); !errors.Is(err, ErrInvalidOfflineKey) {
+		t.Fatalf("err = %v, want ErrInvalidOfflineKey", err)
+	}
+}
+
+func TestOfflineCipherKeyRotation(t *testing.T) {
+	plain := []byte("written before rotation")
+	old := mustOfflineCipher(t, testOfflineKeyOld)
+	sealedOld, err := old.seal(plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 轮换后：新密钥加密，旧密钥只用于解密
+	rotated := mustOfflineCipher(t, testOfflineKeyNew, testOfflineKeyOld)
+	opened, err := rotated.open(sealedOld[1:])
+	if err != nil {
+		t.Fatalf("open member sealed with old key: %v", err)
+	}
+	if !bytes.Equal(opened, plain) {
+		t.Fatalf("open = %q, want %q", opened, plain)
+	}
+
+	sealedNew, err := rotated.seal(plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := old.open(sealedNew[1:]); !errors.Is(err, ErrOfflineKeyNotFound) {
+		t.Fatalf("old-only cipher opening new member: err = %v, want ErrOfflineKeyNotFound", err)
+	}
+
+	// 旧密钥移除后，旧成员无法再解密
+	newOnly := mustOfflineCipher(t, testOfflineKeyNew)
+	if _, err := newOnly.open(sealedOld[1:]); !errors.Is(err, ErrOfflineKeyNotFound) {
+		t.Fatalf("err = %v, want ErrOfflineKeyNotFound", err)
+	}
+}
+
+func TestOfflineCipherMissingCipher(t *testing.T) {
+	sealed, err := mustOfflineCipher(t, testOfflineKeyNew).seal([]byte("x"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var c *offlineCipher
+	if _, err := c.open(sealed[1:]); !errors.Is(err, ErrOfflineKeyNotFound) {
+		t.Fatalf("err = %v, want ErrOfflineKeyNotFound", err)
+	}
+}
+
+func TestOfflineCipherMalformed(t *testing.T) {
+	c := mustOfflineCipher(t, testOfflineKeyNew)
+	sealed, err := c.seal([]byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := sealed[1:]
+
+	tampered := append([]byte(nil), body...)
+	tampered[len(tampered)-1] ^= 0xff
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"shorter than key id", body[:offlineKeyIDSize-1]},
+		{"shorter than nonce", body[:offlineKeyIDSize+4]},
+		{"truncated ciphertext", body[:len(body)-1]},
+		{"tampered tag", tampered},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := c.open(tt.data); err == nil {
+				t.Fatal("open succeeded, want error")
+			}
+		})
+	}
+}
+
+func TestOfflineEncryptedMemberRoundTrip(t *testing.T) {
+	m := NewOfflineManager()
+	if err := m.SetEncryption(testOfflineKeyNew); err != nil {
+		t.Fatal(err)
+	}
+	msg := &OfflineMessage{FromUserID: "alice", ToUserID: "bob", Content: []byte("top secret"), SeqID: 7}
+
+	member, err := m.encodeMember(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(member, []byte("top secret")) {
+		t.Fatalf("stored member contains plaintext: %q", member)
+	}
+
+	got, err := m.decodeMember(string(member))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.FromUserID != msg.FromUserID || string(got.Content) != string(msg.Content) || got.SeqID != msg.SeqID {
+		t.Fatalf("decoded %+v, want %+v", got, msg)
+	}
+
+	// 关闭加密后无法读取已加密的成员
+	if err := m.SetEncryption(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.decodeMember(string(member)); !errors.Is(err, ErrOfflineKeyNotFound) {
+		t.Fatalf("err = %v, want ErrOfflineKeyNotFound", err)
+	}
+}
@@ -0,0 +1,131 @@
+/*
+Package service - Redis 内存淘汰的防御
+
+=== 问题 ===
+
+Redis 配置了 maxmemory 和淘汰策略（如 allkeys-lru）时，内存紧张会直接删除 Key：
+
+	user_session:alice 被淘汰 ──▶ alice 仍连着网关，却被当成离线，消息全部进离线盒子
+	seq:alice:bob      被淘汰 ──▶ INCR 从 1 重新开始，与已发出的 SeqID 重复，
+	                              客户端按 SeqID 去重会把新消息当成旧消息丢掉
+
+=== 会话自检 ===
+
+网关每隔 SessionCheckInterval 检查本地每个已认证用户的会话：
+  - 会话还在：续期 TTL
+  - 会话不见了（被淘汰或过期）：用仍在线的连接重新登录
+
+=== 序列号重新播种 ===
+
+私聊的 NextSeq 返回 1 时，计数器是刚创建的：可能是第一条消息，也可能是被淘汰了。
+此时查找这个会话已经存储过的最大 SeqID：
+  - 双方离线盒子中对方发来的私聊消息
+  - 会话列表记录的最后一条消息（开启 -conversations 时）
+
+找到时把计数器推到它之后再分配（SeedSeq），没找到说明确实是第一条消息。
+每个会话只在计数器创建时扫描一次离线盒子。
+
+已经投递并确认的消息不再保存，找不到时仍可能重复；
+需要严格保证的部署应把淘汰策略设为 volatile-*，或给 IM 单独的 Redis 实例。
+群聊序列号不做播种（成员太多，无法逐个扫描）。
+*/
+package service
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	pkgredis "go-im/pkg/redis"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// SessionCheckInterval 会话自检的间隔
+// 远小于 SessionTTL，会话被淘汰后最多这么久就能恢复
+const SessionCheckInterval = time.Minute
+
+// ==================== 会话自检 ====================
+
+// Refresh 检查仍在线用户的会话
+//
+// 会话存在时续期，不存在时（被淘汰或过期）用 connID 重新登录
+// 返回是否重新创建了会话
+func (m *SessionManager) Refresh(userID string, connID uint64) (bool, error) {
+	online, err := m.presence.IsOnline(userID)
+	if err != nil {
+		return false, err
+	}
+	if online {
+		return false, m.Heartbeat(userID)
+	}
+
+	if err := m.Login(userID, connID); err != nil {
+		return false, err
+	}
+	log.Printf("[Session] Session of connected user %s had vanished, re-created", userID)
+	return true, nil
+}
+
+// ==================== 序列号重新播种 ====================
+
+// seedSeqScript 计数器不大于 floor 时先设为 floor，再自增
+var seedSeqScript = redis.NewScript(`
+local cur = tonumber(redis.call("GET", KEYS[1]) or "0")
+if cur < tonumber(ARGV[1]) then
+	redis.call("SET", KEYS[1], ARGV[1])
+end
+return redis.call("INCR", KEYS[1])
+`)
+
+// SeedSeq 保证之后分配的序列号大于 floor，返回新分配的序列号
+// 用于计数器被淘汰后从已知的最大 SeqID 之后继续
+//
+// 注意：与 GetCurrentSeq 一样直接访问 Redis
+func (m *SequenceManager) SeedSeq(conversationID string, floor int64) (int64, error) {
+	seq, err := seedSeqScript.Run(m.ctx, pkgredis.Client, []string{SequenceKeyPrefix + conversationID}, floor).Int64()
+	if err != nil {
+		return 0, fmt.Errorf("failed to seed sequence: %w", err)
+	}
+	return seq, nil
+}
+
+// reseedSequence NextSeq 返回 1 时检查计数器是否被淘汰过
+// 找到已存储的更大 SeqID 时重新分配，否则原样返回 1
+func (h *MessageHandler) reseedSequence(conversationID, fromUserID, toUserID string) int64 {
+	floor := h.storedMaxSeq(fromUserID, toUserID)
+	if floor < 1 {
+		return 1
+	}
+
+	seq, err := h.sequence.SeedSeq(conversationID, floor)
+	if err != nil {
+		log.Printf("[Message] Failed to reseed sequence of %s: %v", conversationID, err)
+		return 1
+	}
+	log.Printf("[Message] Sequence of %s was reset (evicted?), reseeded after %d", conversationID, floor)
+	return seq
+}
+
+// storedMaxSeq 两个用户之间已存储的私聊消息的最大 SeqID
+// 查询失败的来源跳过，尽力而为
+func (h *MessageHandler) storedMaxSeq(user1, user2 string) int64 {
+	var floor int64
+	raise := func(seq int64, err error) {
+		if err != nil {
+			log.Printf("[Message] Failed to look up stored seq of %s/%s: %v", user1, user2, err)
+			return
+		}
+		if seq > floor {
+			floor = seq
+		}
+	}
+
+	raise(h.offline.MaxSeqFrom(user2, user1))
+	raise(h.offline.MaxSeqFrom(user1, user2))
+	if h.convs != nil {
+		raise(h.convs.LastSeq(user1, LocalID(user2)))
+		raise(h.convs.LastSeq(user2, LocalID(user1)))
+	}
+	return floor
+}
@@ -0,0 +1,196 @@
+/*
+Package service - 离线消息逐条过期（可选）
+
+=== 问题 ===
+
+离线盒子只有 Key 级别的 EXPIRE（最后一次写入后 7 天）：
+
+	msg_box:bob  ── 每天都有新消息写入 ──▶ EXPIRE 不断被续期
+	             ── 一个月前的消息仍在盒子里，只会被数量上限挤掉
+
+消息的过期时间与 Key 的过期时间耦合在一起，活跃的盒子里永远不会有消息"过期"。
+
+=== 过期索引 ===
+
+开启后，每条离线消息写入时同时登记到全局过期索引：
+
+	Key: offline_expiry   (ZSet)
+	┌────────────────────────┬──────────────────┐
+	│ Score (过期时间, 毫秒) │ Member           │
+	├────────────────────────┼──────────────────┤
+	│ 1718000000000          │ 42:bob           │
+	│ 1718000005000          │ 7:acme/carol     │
+	└────────────────────────┴──────────────────┘
+
+	过期时间 = 消息时间戳 + 离线消息过期时间（默认 OfflineMessageTTL，有更早的投递截止时间时取截止时间）
+
+=== 清扫 ===
+
+后台任务定期执行 SweepExpired：
+
+ 1. ZRANGEBYSCORE offline_expiry -inf <当前时间> LIMIT 0 <上限>
+ 2. 对每个条目读取盒子中该 SeqID 的成员，只删除自身已经过期的成员
+    （不同会话的消息可能有相同的 SeqID，不能按 Score 一并删除）
+ 3. 从索引中删除处理过的条目
+
+每次最多处理 OfflineSweepBatch 个条目，积压时分多次清扫，不会长时间占用 Redis。
+已经被 ACK 或数量上限删除的消息，索引条目在到期后被清扫时顺带删除，
+因此索引大小约等于一个过期时间内写入的离线消息数。
+多个网关同时清扫是安全的：ZREM 是幂等的。
+*/
+package service
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	pkgredis "go-im/pkg/redis"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// ==================== 常量定义 ====================
+
+const (
+	// OfflineExpiryKey 全局过期索引
+	OfflineExpiryKey = "offline_expiry"
+
+	// OfflineSweepBatch 每次清扫最多处理的索引条目数
+	OfflineSweepBatch = 1000
+)
+
+// SetExpiryIndex 开启或关闭过期索引
+// 开启后写入的消息才会被清扫；需要有网关定期调用 SweepExpired，否则索引只增不减
+func (m *OfflineManager) SetExpiryIndex(enabled bool) {
+	m.expiryIndex = enabled
+}
+
+// offlineExpiry 消息的过期时间
+func (m *OfflineManager) offlineExpiry(msg *OfflineMessage) time.Time {
+	expiry := msg.Timestamp.Add(m.ttl)
+	if msg.DeliverBefore > 0 {
+		if before := time.UnixMilli(msg.DeliverBefore); before.Before(expiry) {
+			return before
+		}
+	}
+	return expiry
+}
+
+// expiryMember 索引成员：<SeqID>:<userID>
+// SeqID 放在前面，用户 ID 中有冒号也能正确解析
+func expiryMember(userID string, seqID int64) string {
+	return strconv.FormatInt(seqID, 10) + ":" + userID
+}
+
+// parseExpiryMember 解析索引成员
+func parseExpiryMember(member string) (userID string, seqID int64, ok bool) {
+	seq, user, found := strings.Cut(member, ":")
+	if !found {
+		return "", 0, false
+	}
+	seqID, err := strconv.ParseInt(seq, 10, 64)
+	if err != nil {
+		return "", 0, false
+	}
+	return user, seqID, true
+}
+
+// indexExpiry 在 Pipeline 中登记消息的过期时间（未开启时什么都不做）
+func (m *OfflineManager) indexExpiry(pipe redis.Pipeliner, userID string, msg *OfflineMessage) {
+	if !m.expiryIndex {
+		return
+	}
+	pipe.ZAdd(m.ctx, OfflineExpiryKey, redis.Z{
+		Score:  float64(m.offlineExpiry(msg).UnixMilli()),
+		Member: expiryMember(userID, msg.SeqID),
+	})
+}
+
+// SweepExpired 删除在 now 之前过期的离线消息
+//
+// 最多处理 limit 个索引条目（超出的留给下一次清扫），返回删除的消息数
+func (m *OfflineManager) SweepExpired(now time.Time, limit int64) (int, error) {
+	entries, err := pkgredis.Client.ZRangeByScore(m.ctx, OfflineExpiryKey, &redis.ZRangeBy{
+		Min:   "-inf",
+		Max:   strconv.FormatInt(now.UnixMilli(), 10),
+		Count: limit,
+	}).Result()
+	if err != nil {
+		return 0, fmt.Errorf("failed to read expiry index: %w", err)
+	}
+
+	removed := 0
+	for _, entry := range entries {
+		userID, seqID, ok := parseExpiryMember(entry)
+		if !ok {
+			continue
+		}
+		n, err := m.removeExpired(userID, seqID, now)
+		if err != nil {
+			return removed, err
+		}
+		removed += n
+	}
+
+	if len(entries) > 0 {
+		members := make([]interface{}, len(entries))
+		for i, e := range entries {
+			members[i] = e
+		}
+		if err := pkgredis.Client.ZRem(m.ctx, OfflineExpiryKey, members...).Err(); err != nil {
+			return removed, fmt.Errorf("failed to trim expiry index: %w", err)
+		}
+	}
+	return removed, nil
+}
+
+// removeExpired 删除盒子中该 SeqID 下已经过期的成员
+func (m *OfflineManager) removeExpired(userID string, seqID int64, now time.Time) (int, error) {
+	key := m.boxKey(userID, seqID)
+	score := strconv.FormatInt(seqID, 10)
+	members, err := pkgredis.Client.ZRangeByScore(m.ctx, key, &redis.ZRangeBy{Min: score, Max: score}).Result()
+	if err != nil {
+		return 0, fmt.Errorf("failed to read offline box: %w", err)
+	}
+
+	var expired []interface{}
+	for _, member := range members {
+		msg, err := m.decodeMember(member)
+		if err != nil {
+			continue
+		}
+		if !m.offlineExpiry(msg).After(now) {
+			expired = append(expired, member)
+		}
+	}
+	if len(expired) == 0 {
+		return 0, nil
+	}
+	if err := pkgredis.Client.ZRem(m.ctx, key, expired...).Err(); err != nil {
+		return 0, fmt.Errorf("failed to remove expired messages: %w", err)
+	}
+	return len(expired), nil
+}
+
+// SweepLoop 每隔 interval 清扫一次过期消息，直到 stop 返回 true
+// 每次最多处理 OfflineSweepBatch 个索引条目
+func (m *OfflineManager) SweepLoop(interval time.Duration, stop func() bool) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if stop() {
+			return
+		}
+		removed, err := m.SweepExpired(wallNow(), OfflineSweepBatch)
+		if err != nil {
+			log.Printf("[Offline] Expiry sweep failed: %v", err)
+		}
+		if removed > 0 {
+			log.Printf("[Offline] Swept %d expired messages", removed)
+		}
+	}
+}
@@ -0,0 +1,433 @@
+/*
+Package service - 群组与群聊扇出
+
+=== Redis 数据结构 ===
+
+	Key: group_members:<groupID>   (Set)
+	Members: alice, bob, carol, ...
+
+=== 超大群的扇出问题 ===
+
+10 万人的群，如果一次性 SMEMBERS：
+- 10 万个成员 ID 全部加载进内存
+- 同步逐个投递，最后一个成员要等前面所有人投递完
+
+本项目的做法：SSCAN 分批 + 有界并发
+
+	SSCAN 第 1 批 ──▶ 投递 ─┐
+	SSCAN 第 2 批 ──▶ 投递 ─┤  fanoutSem 限制同时进行的投递数
+	SSCAN 第 3 批 ──▶ 投递 ─┤  信号量满时 SSCAN 暂停（背压）
+	...                     ─┘
+
+- 内存中最多只有一批成员 + 正在投递的消息
+- 第一批成员不用等整个成员列表枚举完就能收到消息
+- fanoutSem 是网关级共享的，多个大群同时扇出也不会打爆 Redis
+- 每批中发往其他网关的消息按网关合并发布（见 remote_batch.go）
+
+=== 群序列号 ===
+
+一条群消息只分配一个序列号（seq:group:<groupID>），所有成员共享：
+
+	10 万人的群发一条消息 ──▶ 1 次 INCR（而不是 10 万次）
+
+成员的离线盒子以群序列号为 Score 存储这条消息；
+成员按群序列号排序和去重（自己发的消息、入群前的消息不会投递给自己，序列号会有空洞）。
+消息 ID 为 group:<groupID>:<SeqID>，与置顶、消息状态使用同一个 ID。
+
+=== 成员变更通知 ===
+
+AddMember / RemoveMember 真正改变了成员集合时触发 OnChange 回调，
+MessageHandler.NotifyGroupEvent 把 GroupEvent 扇出给当前成员（CmdTypeGroupEvent），
+被他人添加/移除的用户本人也会收到。
+
+=== 扇出过程中退群 ===
+
+SSCAN 不保证遍历期间被删除的成员不再出现。RemoveMember 在移除成员的同时
+记录退群时刻的群序列号：
+
+	Key: group_left:<groupID>   (Hash，短期过期)
+	Field: userID  Value: 退群时的群序列号
+
+扇出每批成员只做一次 HMGET，序列号大于退群序列号的消息（退群之后才发出）跳过该成员。
+不对每个成员单独查询 Redis；重新入群时清除记录。
+*/
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+
+	pkgredis "go-im/pkg/redis"
+)
+
+// ==================== 常量定义 ====================
+
+const (
+	// GroupMembersKeyPrefix 群成员 Key 前缀
+	// 完整 Key: group_members:<groupID>
+	GroupMembersKeyPrefix = "group_members:"
+
+	// GroupLeftKeyPrefix 退群序列号 Key 前缀
+	// 完整 Key: group_left:<groupID>
+	GroupLeftKeyPrefix = "group_left:"
+
+	// GroupLeftTTL 退群记录的保留时间，只需覆盖正在进行的扇出
+	GroupLeftTTL = time.Hour
+
+	// GroupScanChunkSize 每次 SSCAN 的建议数量
+	GroupScanChunkSize = 500
+
+	// DefaultFanoutWorkers 群聊扇出的默认并发上限
+	DefaultFanoutWorkers = 64
+)
+
+// 成员变更动作
+const (
+	GroupEventJoin  = "join"
+	GroupEventLeave = "leave"
+)
+
+// ErrNotGroupMember 发送者不是群成员
+var ErrNotGroupMember = errors.New("sender is not a member of the group")
+
+// GroupEvent 群成员变更事件
+type GroupEvent struct {
+	GroupID string `json:"group_id"`
+	UserID  string `json:"user_id"` // 加入/退出的成员
+	By      string `json:"by"`      // 操作者（自己加入/退出时与 UserID 相同）
+	Action  string `json:"action"`  // GroupEventJoin / GroupEventLeave
+}
+
+// ==================== 群组管理器 ====================
+
+// GroupManager 群组成员管理器
+type GroupManager struct {
+	ctx context.Context
+
+	// onChange 成员变更回调（为 nil 时不通知）
+	onChange func(*GroupEvent)
+}
+
+// NewGroupManager 创建群组管理器
+func NewGroupManager() *GroupManager {
+	return &GroupManager{
+		ctx: pkgredis.Context(),
+	}
+}
+
+// SetOnChange 设置成员变更回调
+// 回调在 AddMember / RemoveMember 中同步执行
+func (m *GroupManager) SetOnChange(fn func(*GroupEvent)) {
+	m.onChange = fn
+}
+
+// AddMember 添加群成员，by 为操作者
+// 用户已经是成员时不触发通知；用户与群不属于同一租户时返回 ErrCrossTenant
+func (m *GroupManager) AddMember(groupID, userID, by string) error {
+	if !sameTenant(groupID, userID) {
+		return ErrCrossTenant
+	}
+	pipe := pkgredis.Client.TxPipeline()
+	sadd := pipe.SAdd(m.ctx, GroupMembersKeyPrefix+groupID, userID)
+	pipe.HDel(m.ctx, GroupLeftKeyPrefix+groupID, userID)
+	if _, err := pipe.Exec(m.ctx); err != nil {
+		return err
+	}
+	added := sadd.Val()
+	if added > 0 && m.onChange != nil {
+		m.onChange(&GroupEvent{GroupID: groupID, UserID: userID, By: by, Action: GroupEventJoin})
+	}
+	return nil
+}
+
+// removeMemberScript 移除成员，并记录退群时的群序列号
+// KEYS[1] 成员集合，KEYS[2] 退群记录，KEYS[3] 群序列号
+// ARGV[1] userID，ARGV[2] 退群记录过期时间（秒）
+var removeMemberScript = redis.NewScript(`
+local removed = redis.call("SREM", KEYS[1], ARGV[1])
+if removed == 1 then
+	local seq = redis.call("GET", KEYS[3]) or "0"
+	redis.call("HSET", KEYS[2], ARGV[1], seq)
+	redis.call("EXPIRE", KEYS[2], ARGV[2])
+end
+return removed
+`)
+
+// RemoveMember 移除群成员，by 为操作者
+// 用户本来就不是成员时不触发通知
+func (m *GroupManager) RemoveMember(groupID, userID, by string) error {
+	keys := []string{
+		GroupMembersKeyPrefix + groupID,
+		GroupLeftKeyPrefix + groupID,
+		SequenceKeyPrefix + GroupConversationID(groupID),
+	}
+	removed, err := removeMemberScript.Run(m.ctx, pkgredis.Client, keys,
+		userID, int64(GroupLeftTTL/time.Second)).Int64()
+	if err != nil {
+		return err
+	}
+	if removed > 0 && m.onChange != nil {
+		m.onChange(&GroupEvent{GroupID: groupID, UserID: userID, By: by, Action: GroupEventLeave})
+	}
+	return nil
+}
+
+// IsMember 检查用户是否是群成员，其他租户的用户一律不是
+func (m *GroupManager) IsMember(groupID, userID string) (bool, error) {
+	if !sameTenant(groupID, userID) {
+		return false, nil
+	}
+	return pkgredis.Client.SIsMember(m.ctx, GroupMembersKeyPrefix+groupID, userID).Result()
+}
+
+// filterLeft 去掉在群序列号 seqID 分配之前已经退群的成员
+// 每批成员一次 HMGET；查询失败时原样返回（宁可多投递也不漏投）
+func (m *GroupManager) filterLeft(groupID string, members []string, seqID int64) []string {
+	left, err := pkgredis.Client.HMGet(m.ctx, GroupLeftKeyPrefix+groupID, members...).Result()
+	if err != nil {
+		log.Printf("[Group] Failed to check left members of group %s: %v", groupID, err)
+		return members
+	}
+
+	kept := members[:0:0]
+	for i, member := range members {
+		if raw, ok := left[i].(string); ok {
+			if leftSeq, err := strconv.ParseInt(raw, 10, 64); err == nil && seqID > leftSeq {
+				continue
+			}
+		}
+		kept = append(kept, member)
+	}
+	return kept
+}
+
+// ScanMembers 分批枚举群成员
+//
+// 使用 SSCAN 游标遍历，每批调用一次 fn，内存中只保留当前批次
+// fn 返回错误时停止遍历
+//
+// 注意：SSCAN 在遍历期间集合发生变化时，可能返回重复成员，
+// 为了保持内存有界这里不做去重，极少数情况下成员可能收到重复消息
+func (m *GroupManager) ScanMembers(groupID string, chunkSize int64, fn func(members []string) error) error {
+	key := GroupMembersKeyPrefix + groupID
+	var cursor uint64
+	for {
+		members, next, err := pkgredis.Client.SScan(m.ctx, key, cursor, "", chunkSize).Result()
+		if err != nil {
+			return fmt.Errorf("failed to scan group members: %w", err)
+		}
+
+		if len(members) > 0 {
+			if err := fn(members); err != nil {
+				return err
+			}
+		}
+
+		if next == 0 {
+			return nil
+		}
+		cursor = next
+	}
+}
+
+// ==================== 群聊消息 ====================
+
+// SendGroupMessage 发送群聊消息
+//
+// 1. 校验发送者是群成员
+// 2. SSCAN 分批枚举成员
+// 3. 每个成员的投递占用一个 fanoutSem 名额，名额用完时暂停枚举
+// 4. 每个成员按私聊路由投递（本地/远程/离线）
+func (h *MessageHandler) SendGroupMessage(fromUserID, groupID string, content []byte) error {
+	return h.sendGroup(fromUserID, groupID, MsgTypeGroup, content)
+}
+
+// SendGroupNotification 向群内其他成员发送通知（如置顶、回应）
+// 与群聊消息使用同样的扇出和路由，消息类型决定客户端收到的命令类型
+func (h *MessageHandler) SendGroupNotification(fromUserID, groupID string, msgType int, payload []byte) error {
+	return h.sendGroup(fromUserID, groupID, msgType, payload)
+}
+
+// sendGroup 群内扇出
+func (h *MessageHandler) sendGroup(fromUserID, groupID string, msgType int, content []byte) error {
+	if !sameTenant(fromUserID, groupID) {
+		return ErrCrossTenant
+	}
+
+	ok, err := h.groups.IsMember(groupID, fromUserID)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrNotGroupMember
+	}
+
+	if msgType == MsgTypeGroup {
+		h.touchConversation(fromUserID, GroupConversationID(LocalID(groupID)), &ChatMessage{
+			FromUserID: fromUserID,
+			Content:    string(content),
+			Timestamp:  wallNow().UnixMilli(),
+		}, false)
+	}
+
+	seqID := h.nextGroupSeq(groupID)
+
+	return h.fanoutGroup(groupID, fromUserID, seqID, func(member string) bool { return member != fromUserID },
+		func(member string, remote *remoteBatch) error {
+			return h.sendGroupMessageTo(fromUserID, groupID, member, msgType, content, seqID, remote)
+		})
+}
+
+// NotifyGroupEvent 将成员变更事件扇出给当前成员
+//
+// 变更的成员本人不重复通知自己的操作；被他人添加/移除时本人也会收到
+// （移除时本人已不在成员集合中，单独投递）
+func (h *MessageHandler) NotifyGroupEvent(ev *GroupEvent) {
+	payload, _ := json.Marshal(&GroupEvent{
+		GroupID: LocalID(ev.GroupID),
+		UserID:  LocalID(ev.UserID),
+		By:      LocalID(ev.By),
+		Action:  ev.Action,
+	})
+
+	seqID := h.nextGroupSeq(ev.GroupID)
+	send := func(member string, remote *remoteBatch) error {
+		return h.sendGroupMessageTo(ev.By, ev.GroupID, member, MsgTypeGroupEvent, payload, seqID, remote)
+	}
+
+	err := h.fanoutGroup(ev.GroupID, ev.By, seqID, func(member string) bool { return member != ev.UserID }, send)
+	if err != nil {
+		log.Printf("[Group] Failed to notify %s event in group %s: %v", ev.Action, ev.GroupID, err)
+	}
+
+	if ev.By != ev.UserID {
+		if err := send(ev.UserID, nil); err != nil {
+			log.Printf("[Group] Failed to notify %s of %s in group %s: %v", ev.UserID, ev.Action, ev.GroupID, err)
+		}
+	}
+}
+
+// fanoutGroup 分批枚举成员，对 include 返回 true 的成员并发执行 deliver
+// sender 为发起者，用于公平排队
+// seqID 为这条消息的群序列号，大于 0 时跳过在它分配之前已经退群的成员（见 filterLeft）
+// deliver 收到的 remoteBatch 由每批成员共享，这批投递完成后合并发布
+func (h *MessageHandler) fanoutGroup(groupID, sender string, seqID int64, include func(member string) bool,
+	deliver func(member string, remote *remoteBatch) error) error {
+	scan := func(fn func(members []string) error) error {
+		return h.groups.ScanMembers(groupID, GroupScanChunkSize, func(members []string) error {
+			if seqID > 0 {
+				members = h.groups.filterLeft(groupID, members, seqID)
+			}
+			return fn(members)
+		})
+	}
+	remote := newRemoteBatch()
+	return h.fanout("group "+groupID, sender, scan, include,
+		func(member string) error { return deliver(member, remote) },
+		func() int { return h.flushRemote(remote) })
+}
+
+// fanout 分批枚举接收者（群成员、主题订阅者），对 include 返回 true 的接收者并发执行 deliver
+// 所有扇出共享 fanoutSem，名额用完时暂停枚举；
+// 每个接收者的投递以 sender 的名义公平排队（见 pkg/redis/fair.go），大扇出不会饿死其他发送者
+//
+// flush 不为 nil 时，每批接收者全部投递完成后调用一次，返回这批中投递失败的数量
+func (h *MessageHandler) fanout(name, sender string, scan func(fn func(members []string) error) error,
+	include func(member string) bool, deliver func(member string) error, flush func() int) error {
+	var (
+		wg     sync.WaitGroup
+		total  int
+		failed int
+		mu     sync.Mutex
+	)
+
+	err := scan(func(members []string) error {
+		if flush != nil {
+			defer func() {
+				wg.Wait()
+				n := flush()
+				mu.Lock()
+				failed += n
+				mu.Unlock()
+			}()
+		}
+		for _, member := range members {
+			if !include(member) {
+				continue
+			}
+
+			// 获取扇出名额，满了就阻塞，从而暂停 SSCAN
+			h.fanoutSem <- struct{}{}
+			wg.Add(1)
+			total++
+
+			go func(member string) {
+				defer func() {
+					<-h.fanoutSem
+					wg.Done()
+				}()
+
+				err := pkgredis.Fair.Do(sender, func() error { return deliver(member) })
+				if err != nil {
+					log.Printf("[Fanout] Failed to deliver to %s in %s: %v", member, name, err)
+					mu.Lock()
+					failed++
+					mu.Unlock()
+				}
+			}(member)
+		}
+		return nil
+	})
+
+	wg.Wait()
+
+	log.Printf("[Fanout] Fan-out to %s: %d recipients, %d failed", name, total, failed)
+	return err
+}
+
+// nextGroupSeq 为一条群消息分配群序列号（所有成员共享）
+// 序列号服务不可用时降级为本地兜底序号
+func (h *MessageHandler) nextGroupSeq(groupID string) int64 {
+	seqID, err := h.sequence.NextSeq(GroupConversationID(groupID))
+	if err != nil {
+		seqID = h.nextFallbackSeq()
+		log.Printf("[Group] Sequence unavailable for group %s, using fallback seq %d: %v", groupID, seqID, err)
+	}
+	return seqID
+}
+
+// sendGroupMessageTo 向单个群成员投递群消息
+// seqID 为这条消息的群序列号，所有成员相同
+// remote 不为 nil 时，发往其他网关的消息收集到 remote 中合并发布
+func (h *MessageHandler) sendGroupMessageTo(fromUserID, groupID, toUserID string, msgType int, content []byte, seqID int64,
+	remote *remoteBatch) error {
+	msg := &ChatMessage{
+		FromUserID: fromUserID,
+		ToUserID:   toUserID,
+		Content:    string(content),
+		MsgType:    msgType,
+		SeqID:      seqID,
+		Timestamp:  wallNow().UnixMilli(),
+		GroupID:    groupID,
+
+		Unsequenced: seqID < 0,
+
+		remote: remote,
+	}
+	// 兜底：即使成员集合中混入了其他租户的用户，也不向其投递
+	if !sameTenant(groupID, toUserID) {
+		return ErrCrossTenant
+	}
+	if msgType == MsgTypeGroup {
+		h.touchConversation(toUserID, GroupConversationID(LocalID(groupID)), msg, true)
+	}
+	return h.routeMessage(msg)
+}
@@ -0,0 +1,109 @@
+package service
+
+import (
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	pkgredis "go-im/pkg/redis"
+	"go-im/server"
+)
+
+// groupTestID 唯一的测试群 ID，测试结束时清空成员、退群记录和群序列号
+func groupTestID(t *testing.T) string {
+	t.Helper()
+	groupID := "test_group_" + strconv.FormatInt(time.Now().UnixNano(), 36)
+	t.Cleanup(func() {
+		pkgredis.Client.Del(pkgredis.Context(),
+			GroupMembersKeyPrefix+groupID,
+			GroupLeftKeyPrefix+groupID,
+			SequenceKeyPrefix+GroupConversationID(groupID))
+	})
+	return groupID
+}
+
+func TestFilterLeftSkipsMembersWhoLeftBeforeSeq(t *testing.T) {
+	requireRedis(t)
+	groups := NewGroupManager()
+	seq := NewSequenceManager()
+	groupID := groupTestID(t)
+
+	for _, u := range []string{"alice", "bob", "carol"} {
+		if err := groups.AddMember(groupID, u, u); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 消息 1 在 bob 退群前分配，消息 2 在退群后分配
+	before, err := seq.NextSeq(GroupConversationID(groupID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := groups.RemoveMember(groupID, "bob", "bob"); err != nil {
+		t.Fatal(err)
+	}
+	after, err := seq.NextSeq(GroupConversationID(groupID))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 模拟 SSCAN 在 bob 退群之前已经返回了他
+	scanned := []string{"alice", "bob", "carol"}
+	if got := groups.filterLeft(groupID, scanned, before); !reflect.DeepEqual(got, scanned) {
+		t.Errorf("message sent before leave: got %v, want %v", got, scanned)
+	}
+	if got, want := groups.filterLeft(groupID, scanned, after), []string{"alice", "carol"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("message sent after leave: got %v, want %v", got, want)
+	}
+
+	// 重新入群后恢复接收
+	if err := groups.AddMember(groupID, "bob", "bob"); err != nil {
+		t.Fatal(err)
+	}
+	if got := groups.filterLeft(groupID, scanned, after); !reflect.DeepEqual(got, scanned) {
+		t.Errorf("after rejoin: got %v, want %v", got, scanned)
+	}
+}
+
+func TestGroupSendSharesOneSeq(t *testing.T) {
+	requireRedis(t)
+	h := NewMessageHandler("gateway_test", server.NewConnectionManager(), NewSessionManager("gateway_test"), nil,
+		NewSequenceManager(), NewOfflineManager(), NewGroupManager())
+	groupID := groupTestID(t)
+
+	// 所有成员都离线：消息进入各自的离线盒子
+	sender := offlineTestUser(t, h.offline)
+	members := []string{offlineTestUser(t, h.offline), offlineTestUser(t, h.offline), offlineTestUser(t, h.offline)}
+	for _, u := range append([]string{sender}, members...) {
+		if err := h.groups.AddMember(groupID, u, u); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := h.SendGroupMessage(sender, groupID, []byte("hello group")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 每条群消息只 INCR 一次群序列号，与成员数无关
+	got, err := pkgredis.Client.Get(pkgredis.Context(), SequenceKeyPrefix+GroupConversationID(groupID)).Int64()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != 2 {
+		t.Fatalf("group sequence = %d after 2 messages to %d members, want 2", got, len(members))
+	}
+
+	// 所有成员收到相同的 SeqID 和消息 ID；发送者不给自己投递
+	want := []string{MessageID(GroupConversationID(groupID), 1), MessageID(GroupConversationID(groupID), 2)}
+	for _, u := range members {
+		if ids := boxIDs(t, h.offline, u); !reflect.DeepEqual(ids, want) {
+			t.Errorf("member %s box = %v, want %v", u, ids, want)
+		}
+	}
+	if ids := boxIDs(t, h.offline, sender); len(ids) != 0 {
+		t.Errorf("sender box = %v, want empty", ids)
+	}
+}
@@ -0,0 +1,143 @@
+/*
+Package service - 一致性哈希环
+
+=== 使用场景 ===
+
+无状态的路由层需要决定新连接"应该"落在哪个网关。
+简单取模 hash(userID) % N 的问题：网关数 N 变化时，几乎所有用户都会换网关。
+
+=== 一致性哈希 ===
+
+把网关和用户都哈希到同一个环上，用户顺时针找到的第一个网关节点即为归属：
+
+	           gateway_1#0
+	         ╱            ╲
+	   user_a               gateway_2#1
+	     │                     │
+	gateway_2#0            user_b
+	         ╲            ╱
+	           gateway_1#1
+
+- 新增网关：只有落在新节点与前一个节点之间的用户迁移过去，约 1/(N+1)
+- 移除网关：只有原本属于它的用户迁移到下一个节点
+
+=== 虚拟节点 ===
+
+每个网关在环上放置多个虚拟节点（gateway_1#0, gateway_1#1, ...），
+避免网关较少时分布不均。
+
+注意：这里只给出"建议"的网关，用户实际所在网关仍以 SessionManager 为准。
+*/
+package service
+
+import (
+	"hash/crc32"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// DefaultVirtualNodes 每个网关的默认虚拟节点数
+const DefaultVirtualNodes = 160
+
+// HashRing 一致性哈希环（并发安全）
+type HashRing struct {
+	mu       sync.RWMutex
+	replicas int               // 每个网关的虚拟节点数
+	hashes   []uint32          // 已排序的虚拟节点哈希
+	nodes    map[uint32]string // 虚拟节点哈希 → 网关 ID
+	gateways map[string]bool   // 已加入的网关
+}
+
+// NewHashRing 创建一致性哈希环
+// replicas <= 0 时使用 DefaultVirtualNodes
+func NewHashRing(replicas int) *HashRing {
+	if replicas <= 0 {
+		replicas = DefaultVirtualNodes
+	}
+	return &HashRing{
+		replicas: replicas,
+		nodes:    make(map[uint32]string),
+		gateways: make(map[string]bool),
+	}
+}
+
+// AddGateway 将网关加入哈希环（重复加入无效果）
+func (r *HashRing) AddGateway(gatewayID string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.gateways[gatewayID] {
+		return
+	}
+	r.gateways[gatewayID] = true
+
+	for i := 0; i < r.replicas; i++ {
+		h := ringHash(gatewayID + "#" + strconv.Itoa(i))
+		// 极少数情况下虚拟节点哈希冲突，保留先加入的节点
+		if _, ok := r.nodes[h]; ok {
+			continue
+		}
+		r.nodes[h] = gatewayID
+		r.hashes = append(r.hashes, h)
+	}
+	sort.Slice(r.hashes, func(i, j int) bool { return r.hashes[i] < r.hashes[j] })
+}
+
+// RemoveGateway 将网关移出哈希环
+func (r *HashRing) RemoveGateway(gatewayID string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.gateways[gatewayID] {
+		return
+	}
+	delete(r.gateways, gatewayID)
+
+	hashes := r.hashes[:0]
+	for _, h := range r.hashes {
+		if r.nodes[h] == gatewayID {
+			delete(r.nodes, h)
+			continue
+		}
+		hashes = append(hashes, h)
+	}
+	r.hashes = hashes
+}
+
+// GetGateway 返回用户应该连接的网关
+// 环为空时返回空字符串
+func (r *HashRing) GetGateway(userID string) string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if len(r.hashes) == 0 {
+		return ""
+	}
+
+	h := ringHash(userID)
+	// 顺时针找到第一个 >= h 的虚拟节点，越过末尾则回到环首
+	i := sort.Search(len(r.hashes), func(i int) bool { return r.hashes[i] >= h })
+	if i == len(r.hashes) {
+		i = 0
+	}
+	return r.nodes[r.hashes[i]]
+}
+
+// Gateways 返回环上的全部网关 ID
+func (r *HashRing) Gateways() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	gateways := make([]string, 0, len(r.gateways))
+	for id := range r.gateways {
+		gateways = append(gateways, id)
+	}
+	sort.Strings(gateways)
+	return gateways
+}
+
+// ringHash 哈希函数
+func ringHash(key string) uint32 {
+	return crc32.ChecksumIEEE([]byte(key))
+}
@@ -0,0 +1,139 @@
+package service
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+// ringUsers 测试用的用户 ID
+func ringUsers(n int) []string {
+	users := make([]string, n)
+	for i := range users {
+		users[i] = fmt.Sprintf("user_%d", i)
+	}
+	return users
+}
+
+// assignments 每个用户当前的网关
+func assignments(r *HashRing, users []string) map[string]string {
+	m := make(map[string]string, len(users))
+	for _, u := range users {
+		m[u] = r.GetGateway(u)
+	}
+	return m
+}
+
+func TestHashRingEmpty(t *testing.T) {
+	r := NewHashRing(0)
+	if got := r.GetGateway("alice"); got != "" {
+		t.Fatalf("empty ring: GetGateway = %q, want empty", got)
+	}
+	if r.replicas != DefaultVirtualNodes {
+		t.Fatalf("replicas = %d, want DefaultVirtualNodes", r.replicas)
+	}
+
+	r.AddGateway("gateway_1")
+	r.RemoveGateway("gateway_1")
+	if got := r.GetGateway("alice"); got != "" || len(r.hashes) != 0 || len(r.nodes) != 0 {
+		t.Fatalf("after removing the only gateway: GetGateway = %q, %d hashes, %d nodes", got, len(r.hashes), len(r.nodes))
+	}
+}
+
+func TestHashRingMembership(t *testing.T) {
+	r := NewHashRing(10)
+	r.AddGateway("gateway_2")
+	r.AddGateway("gateway_1")
+	r.AddGateway("gateway_1") // 重复加入无效果
+	if got, want := r.Gateways(), []string{"gateway_1", "gateway_2"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("Gateways = %v, want %v", got, want)
+	}
+	if len(r.hashes) != 20 {
+		t.Fatalf("%d virtual nodes, want 20", len(r.hashes))
+	}
+
+	r.RemoveGateway("gateway_3") // 不存在的网关无效果
+	r.RemoveGateway("gateway_2")
+	if got, want := r.Gateways(), []string{"gateway_1"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("Gateways = %v, want %v", got, want)
+	}
+	for _, u := range ringUsers(100) {
+		if got := r.GetGateway(u); got != "gateway_1" {
+			t.Fatalf("GetGateway(%s) = %q, want gateway_1", u, got)
+		}
+	}
+}
+
+func TestHashRingDeterministic(t *testing.T) {
+	users := ringUsers(1000)
+	a, b := NewHashRing(0), NewHashRing(0)
+	for _, gw := range []string{"gateway_1", "gateway_2", "gateway_3"} {
+		a.AddGateway(gw)
+	}
+	// 加入顺序不影响结果
+	for _, gw := range []string{"gateway_3", "gateway_1", "gateway_2"} {
+		b.AddGateway(gw)
+	}
+	if !reflect.DeepEqual(assignments(a, users), assignments(b, users)) {
+		t.Fatal("rings with the same gateways assign users differently")
+	}
+}
+
+func TestHashRingMinimalMovement(t *testing.T) {
+	users := ringUsers(10000)
+	r := NewHashRing(0)
+	for _, gw := range []string{"gateway_1", "gateway_2", "gateway_3", "gateway_4"} {
+		r.AddGateway(gw)
+	}
+	before := assignments(r, users)
+
+	// 新增网关：只有迁往新网关的用户变化，约 1/5
+	r.AddGateway("gateway_5")
+	after := assignments(r, users)
+	moved := 0
+	for _, u := range users {
+		if before[u] != after[u] {
+			moved++
+			if after[u] != "gateway_5" {
+				t.Fatalf("%s moved from %s to %s, not to the new gateway", u, before[u], after[u])
+			}
+		}
+	}
+	if frac := float64(moved) / float64(len(users)); frac < 0.1 || frac > 0.3 {
+		t.Errorf("adding a gateway moved %.1f%% of users, want about 20%%", frac*100)
+	}
+
+	// 移除网关：只有原本属于它的用户变化，其他用户回到原来的网关
+	r.RemoveGateway("gateway_5")
+	if !reflect.DeepEqual(assignments(r, users), before) {
+		t.Fatal("removing the new gateway did not restore the original assignments")
+	}
+	r.RemoveGateway("gateway_2")
+	for u, gw := range assignments(r, users) {
+		if before[u] != "gateway_2" && gw != before[u] {
+			t.Fatalf("%s moved from %s to %s although its gateway stayed", u, before[u], gw)
+		}
+		if gw == "gateway_2" {
+			t.Fatalf("%s still assigned to the removed gateway", u)
+		}
+	}
+}
+
+func TestHashRingBalance(t *testing.T) {
+	users := ringUsers(20000)
+	r := NewHashRing(0)
+	gateways := []string{"gateway_1", "gateway_2", "gateway_3", "gateway_4"}
+	for _, gw := range gateways {
+		r.AddGateway(gw)
+	}
+	counts := make(map[string]int)
+	for _, gw := range assignments(r, users) {
+		counts[gw]++
+	}
+	mean := len(users) / len(gateways)
+	for _, gw := range gateways {
+		if c := counts[gw]; c < mean*7/10 || c > mean*13/10 {
+			t.Errorf("%s has %d users, want within 30%% of %d", gw, c, mean)
+		}
+	}
+}
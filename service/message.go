@@ -1,310 +1,1282 @@
-/*
-Package service - 消息路由服务
-
-=== 消息路由的核心问题 ===
-
-在分布式 IM 系统中，消息路由要回答一个问题：
-
-	"如何把消息从发送者传递到接收者？"
-
-这涉及几个子问题：
-1. 接收者在线吗？
-2. 接收者在哪个 Gateway？
-3. 是本地推送还是跨节点转发？
-4. 如果离线，消息存哪里？
-
-=== 消息路由流程图 ===
-
-	   Alice 发消息给 Bob
-
-	   ┌─────────────────────────────────────────────────────────┐
-	   │                     消息路由流程                         │
-	   └─────────────────────────────────────────────────────────┘
-	                           │
-	                           ▼
-	                   ┌───────────────┐
-	                   │ 生成消息 SeqID │
-	                   │ (Redis INCR)  │
-	                   └───────┬───────┘
-	                           │
-	                           ▼
-	                   ┌───────────────┐
-	                   │ 查询 Bob 在线？│
-	                   │ (Redis GET)   │
-	                   └───────┬───────┘
-	                           │
-	              ┌────────────┴────────────┐
-	              │                         │
-	          在线│                         │离线
-	              ▼                         ▼
-	   ┌─────────────────┐       ┌─────────────────┐
-	   │  查询 Bob 在     │       │  存入离线盒子   │
-	   │  哪个 Gateway    │       │  (Redis ZSet)   │
-	   └────────┬────────┘       └─────────────────┘
-	            │
-	   ┌────────┴────────┐
-	   │                 │
-	本地│              远程│
-	   ▼                 ▼
-
-┌─────────┐   ┌──────────────┐
-│直接推送 │   │ Pub/Sub 转发 │
-│(本地Map)│   │ 到其他Gateway│
-└─────────┘   └──────────────┘
-
-=== 本项目的简化处理 ===
-
-由于是 Demo 项目，Gateway 和 Logic Server 合并在一起：
-- 没有独立的 Logic Server
-- 消息路由逻辑直接在 Gateway 中处理
-- 这简化了部署，但在大规模系统中应该分离
-*/
-package service
-
-import (
-	"encoding/json"
-	"go-im/protocol"
-	"go-im/server"
-	"log"
-)
-
-// ==================== 常量定义 ====================
-
-// 消息类型
-const (
-	MsgTypePrivate = 1 // 单聊消息
-	MsgTypeGroup   = 2 // 群聊消息
-	MsgTypeSystem  = 3 // 系统消息
-)
-
-// ==================== 消息结构 ====================
-
-// ChatMessage 聊天消息结构
-// 这是业务层的消息格式，不同于协议层的 Message
-type ChatMessage struct {
-	FromUserID string `json:"from_user_id"` // 发送者
-	ToUserID   string `json:"to_user_id"`   // 接收者
-	Content    string `json:"content"`      // 消息内容
-	MsgType    int    `json:"msg_type"`     // 消息类型
-	SeqID      int64  `json:"seq_id"`       // 序列号
-	Timestamp  int64  `json:"timestamp"`    // 时间戳
-}
-
-// ==================== 消息处理器 ====================
-
-// MessageHandler 消息路由处理器
-// 协调各个服务组件，完成消息的路由和投递
-type MessageHandler struct {
-	gatewayID   string                    // 当前网关 ID
-	connManager *server.ConnectionManager // 连接管理器
-	session     *SessionManager           // 会话服务
-	pubsub      *PubSubManager            // Pub/Sub 服务
-	sequence    *SequenceManager          // 序列号服务
-	offline     *OfflineManager           // 离线消息服务
-}
-
-// NewMessageHandler 创建消息处理器
-// 通过依赖注入的方式，将各个服务组件组合在一起
-func NewMessageHandler(
-	gatewayID string,
-	connManager *server.ConnectionManager,
-	session *SessionManager,
-	pubsub *PubSubManager,
-	sequence *SequenceManager,
-	offline *OfflineManager,
-) *MessageHandler {
-	return &MessageHandler{
-		gatewayID:   gatewayID,
-		connManager: connManager,
-		session:     session,
-		pubsub:      pubsub,
-		sequence:    sequence,
-		offline:     offline,
-	}
-}
-
-// ==================== 发送私聊消息 ====================
-
-// SendPrivateMessage 发送私聊消息
-//
-// 这是消息路由的入口函数，完整流程：
-// 1. 生成序列号
-// 2. 查询目标用户位置
-// 3. 决定投递方式（本地/远程/离线）
-// 4. 执行投递
-func (h *MessageHandler) SendPrivateMessage(fromUserID, toUserID string, content []byte) error {
-	// Step 1: 生成消息序列号
-	// 用于消息排序和 ACK
-	conversationID := getConversationID(fromUserID, toUserID)
-	seqID, err := h.sequence.NextSeq(conversationID)
-	if err != nil {
-		return err
-	}
-
-	// Step 2: 查询目标用户所在的 Gateway
-	targetGateway, err := h.session.GetUserGateway(toUserID)
-	if err != nil {
-		// 用户不在线，存入离线消息盒子
-		log.Printf("[Message] User %s is offline, storing message", toUserID)
-		return h.storeOfflineMessage(fromUserID, toUserID, content, seqID)
-	}
-
-	// Step 3: 构造聊天消息
-	msg := &ChatMessage{
-		FromUserID: fromUserID,
-		ToUserID:   toUserID,
-		Content:    string(content),
-		MsgType:    MsgTypePrivate,
-		SeqID:      seqID,
-	}
-
-	// Step 4: 根据用户位置选择投递方式
-	if targetGateway == h.gatewayID {
-		// 用户在本地 Gateway，直接推送
-		return h.deliverLocal(toUserID, msg)
-	}
-
-	// 用户在其他 Gateway，通过 Pub/Sub 转发
-	return h.deliverRemote(targetGateway, msg)
-}
-
-// ==================== 本地投递 ====================
-
-// deliverLocal 本地投递消息
-//
-// 用户在当前 Gateway，直接从内存中查找连接并推送
-// 这是最快的投递方式，无需网络请求
-func (h *MessageHandler) deliverLocal(userID string, msg *ChatMessage) error {
-	// 从 ConnectionManager 中查找用户连接
-	conn := h.connManager.GetByUserID(userID)
-	if conn == nil {
-		// 连接不存在（可能刚刚断开），存入离线
-		log.Printf("[Message] Connection not found for user %s", userID)
-		return h.storeOfflineMessage(msg.FromUserID, msg.ToUserID, []byte(msg.Content), msg.SeqID)
-	}
-
-	// 序列化消息
-	data, err := json.Marshal(msg)
-	if err != nil {
-		return err
-	}
-
-	// 封装为协议消息并发送
-	protoMsg := &protocol.Message{
-		CmdType: protocol.CmdTypeMessage,
-		Body:    data,
-	}
-
-	log.Printf("[Message] Delivering message to user %s locally", userID)
-	return conn.Send(protoMsg)
-}
-
-// ==================== 远程投递 ====================
-
-// deliverRemote 远程投递消息（跨 Gateway）
-//
-// 用户在其他 Gateway，通过 Redis Pub/Sub 转发
-// 目标 Gateway 会收到消息并投递给用户
-func (h *MessageHandler) deliverRemote(targetGateway string, msg *ChatMessage) error {
-	// 构造 Pub/Sub 消息
-	pubsubMsg := &PubSubMessage{
-		FromUserID: msg.FromUserID,
-		ToUserID:   msg.ToUserID,
-		Content:    []byte(msg.Content),
-		MsgType:    msg.MsgType,
-		SeqID:      msg.SeqID,
-	}
-
-	log.Printf("[Message] Routing message to gateway %s via Pub/Sub", targetGateway)
-	return h.pubsub.Publish(targetGateway, pubsubMsg)
-}
-
-// ==================== 离线存储 ====================
-
-// storeOfflineMessage 存储离线消息
-func (h *MessageHandler) storeOfflineMessage(fromUserID, toUserID string, content []byte, seqID int64) error {
-	offlineMsg := &OfflineMessage{
-		FromUserID: fromUserID,
-		ToUserID:   toUserID,
-		Content:    content,
-		MsgType:    MsgTypePrivate,
-		SeqID:      seqID,
-	}
-	return h.offline.Store(toUserID, offlineMsg)
-}
-
-// ==================== Pub/Sub 消息处理 ====================
-
-// HandlePubSubMessage 处理从 Pub/Sub 收到的消息
-//
-// 当其他 Gateway 向本 Gateway 发送消息时，会通过这个方法处理
-// 本质上是将远程消息转换为本地投递
-func (h *MessageHandler) HandlePubSubMessage(msg *PubSubMessage) {
-	chatMsg := &ChatMessage{
-		FromUserID: msg.FromUserID,
-		ToUserID:   msg.ToUserID,
-		Content:    string(msg.Content),
-		MsgType:    msg.MsgType,
-		SeqID:      msg.SeqID,
-	}
-
-	// 尝试本地投递
-	if err := h.deliverLocal(msg.ToUserID, chatMsg); err != nil {
-		log.Printf("[Message] Failed to deliver Pub/Sub message: %v", err)
-	}
-}
-
-// ==================== 离线消息投递 ====================
-
-// DeliverOfflineMessages 投递离线消息
-//
-// 用户上线时调用，将存储的离线消息推送给用户
-func (h *MessageHandler) DeliverOfflineMessages(userID string, conn *server.Connection) error {
-	// 拉取最近的离线消息
-	messages, err := h.offline.FetchLatest(userID, 100)
-	if err != nil {
-		return err
-	}
-
-	// 逐条推送
-	for _, msg := range messages {
-		chatMsg := &ChatMessage{
-			FromUserID: msg.FromUserID,
-			ToUserID:   msg.ToUserID,
-			Content:    string(msg.Content),
-			MsgType:    msg.MsgType,
-			SeqID:      msg.SeqID,
-		}
-
-		data, err := json.Marshal(chatMsg)
-		if err != nil {
-			continue
-		}
-
-		protoMsg := &protocol.Message{
-			CmdType: protocol.CmdTypeMessage,
-			Body:    data,
-		}
-		conn.Send(protoMsg)
-	}
-
-	log.Printf("[Message] Delivered %d offline messages to user %s", len(messages), userID)
-	return nil
-}
-
-// ==================== 工具函数 ====================
-
-// getConversationID 生成会话标识
-//
-// 私聊的会话 ID 由两个用户 ID 组成，保证 A→B 和 B→A 使用相同的会话 ID
-// 实现方式：按字典序排序后拼接
-//
-// 示例：
-//   - getConversationID("alice", "bob") → "alice:bob"
-//   - getConversationID("bob", "alice") → "alice:bob" (相同)
-func getConversationID(user1, user2 string) string {
-	if user1 < user2 {
-		return user1 + ":" + user2
-	}
-	return user2 + ":" + user1
-}
+/*
+Package service - 消息路由服务
+
+=== 消息路由的核心问题 ===
+
+在分布式 IM 系统中，消息路由要回答一个问题：
+
+	"如何把消息从发送者传递到接收者？"
+
+这涉及几个子问题：
+1. 接收者在线吗？
+2. 接收者在哪个 Gateway？
+3. 是本地推送还是跨节点转发？
+4. 如果离线，消息存哪里？
+
+=== 消息路由流程图 ===
+
+	   Alice 发消息给 Bob
+
+	   ┌─────────────────────────────────────────────────────────┐
+	   │                     消息路由流程                         │
+	   └─────────────────────────────────────────────────────────┘
+	                           │
+	                           ▼
+	                   ┌───────────────┐
+	                   │ 生成消息 SeqID │
+	                   │ (Redis INCR)  │
+	                   └───────┬───────┘
+	                           │
+	                           ▼
+	                   ┌───────────────┐
+	                   │ 查询 Bob 在线？│
+	                   │ (Redis GET)   │
+	                   └───────┬───────┘
+	                           │
+	              ┌────────────┴────────────┐
+	              │                         │
+	          在线│                         │离线
+	              ▼                         ▼
+	   ┌─────────────────┐       ┌─────────────────┐
+	   │  查询 Bob 在     │       │  存入离线盒子   │
+	   │  哪个 Gateway    │       │  (Redis ZSet)   │
+	   └────────┬────────┘       └─────────────────┘
+	            │
+	   ┌────────┴────────┐
+	   │                 │
+	本地│              远程│
+	   ▼                 ▼
+
+┌─────────┐   ┌──────────────┐
+│直接推送 │   │ Pub/Sub 转发 │
+│(本地Map)│   │ 到其他Gateway│
+└─────────┘   └──────────────┘
+
+=== 本项目的简化处理 ===
+
+由于是 Demo 项目，Gateway 和 Logic Server 合并在一起：
+- 没有独立的 Logic Server
+- 消息路由逻辑直接在 Gateway 中处理
+- 这简化了部署，但在大规模系统中应该分离
+*/
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	pkgredis "go-im/pkg/redis"
+	"go-im/protocol"
+	"go-im/server"
+	"log"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+)
+
+// ==================== 常量定义 ====================
+
+// 消息类型
+const (
+	MsgTypePrivate = 1 // 单聊消息
+	MsgTypeGroup   = 2 // 群聊消息
+	MsgTypeSystem  = 3 // 系统消息
+
+	MsgTypeReaction   = 4 // 表情回应通知
+	MsgTypeTyping     = 5 // 正在输入提示（临时消息，不存离线）
+	MsgTypePin        = 6 // 消息置顶通知
+	MsgTypeUnpin      = 7 // 取消置顶通知
+	MsgTypeGroupEvent = 8 // 群成员变更通知
+	MsgTypeTopic      = 9 // 主题频道消息（GroupID 字段携带主题名，见 topic.go）
+)
+
+// isEphemeral 是否为临时消息（不分配序列号、不存离线、不需要 ACK）
+func isEphemeral(msgType int) bool {
+	return msgType == MsgTypeTyping
+}
+
+// ==================== 握手竞争重试 ====================
+
+const (
+	// HandshakeRetries 会话已指向本网关但本地还没有连接时的重试次数
+	HandshakeRetries = 5
+
+	// HandshakeRetryDelay 每次重试的间隔
+	HandshakeRetryDelay = 20 * time.Millisecond
+)
+
+// ==================== 系统通知事件 ====================
+
+const (
+	// SystemEventExpired 消息在投递截止时间前未能送达，已被丢弃
+	SystemEventExpired = "delivery_expired"
+
+	// SystemEventUndeliverable 收件人不存在，消息被退回
+	SystemEventUndeliverable = "undeliverable"
+)
+
+// ErrUnknownRecipient 收件人从未认证过（开启收件人检查时）
+var ErrUnknownRecipient = errors.New("recipient does not exist")
+
+// SystemEvent 系统通知（MsgTypeSystem）的内容
+type SystemEvent struct {
+	Event    string `json:"event"`                // 事件类型
+	ToUserID string `json:"to_user_id,omitempty"` // 相关的接收者
+	SeqID    int64  `json:"seq_id,omitempty"`     // 相关的消息序列号
+}
+
+// ==================== 消息结构 ====================
+
+// ChatMessage 聊天消息结构
+// 这是业务层的消息格式，不同于协议层的 Message
+type ChatMessage struct {
+	FromUserID string `json:"from_user_id"`       // 发送者
+	ToUserID   string `json:"to_user_id"`         // 接收者
+	Content    string `json:"content"`            // 消息内容
+	MsgType    int    `json:"msg_type"`           // 消息类型
+	SeqID      int64  `json:"seq_id"`             // 序列号
+	Timestamp  int64  `json:"timestamp"`          // 发送时间（Unix 毫秒）
+	GroupID    string `json:"group_id,omitempty"` // 群 ID（仅群聊消息）
+
+	// DeliverBefore 投递截止时间（Unix 毫秒），0 表示不限制
+	// 超过截止时间仍未送达的消息（如"现在给我打电话"）会被丢弃而不是迟到投递
+	DeliverBefore int64 `json:"deliver_before,omitempty"`
+
+	// Unsequenced 序列号服务不可用时分配的本地兜底序号（SeqID 为负数）
+	// 客户端不应依赖其排序，可在之后自行对账
+	Unsequenced bool `json:"unsequenced,omitempty"`
+
+	// Topic 主题名（仅主题消息），只出现在推送给客户端的视图中
+	// 内部各环节用 GroupID 携带主题名，不需要改变 Pub/Sub 和离线存储的格式
+	Topic string `json:"topic,omitempty"`
+
+	// ContentBytes 二进制内容（JSON 中为 base64），只出现在推送给客户端的视图中
+	// Content 不是合法 UTF-8 时 JSON 编码会把非法字节替换掉，
+	// 此时改用这个字段原样下发，Content 置空（见 clientView）
+	ContentBytes []byte `json:"content_bytes,omitempty"`
+
+	// MsgID 消息 ID（见 MessageID），只出现在推送给客户端的视图中
+	// 客户端原样回传用于选择性确认和已读回执，不需要自己拼接（租户前缀、主题名都已处理好）
+	MsgID string `json:"msg_id,omitempty"`
+
+	// Delivery 投递策略（见 delivery.go），不下发给客户端
+	Delivery DeliveryPolicy `json:"-"`
+
+	// stored 不为 nil 时，消息存入离线盒子后置为 true（见 SendOutcome）
+	// 存离线可能发生在其他 Goroutine（如迁移结束后），因此用原子变量
+	stored *atomic.Bool
+
+	// remote 不为 nil 时，发往其他网关的消息先收集起来合并发布（群聊扇出，见 remote_batch.go）
+	remote *remoteBatch
+}
+
+// ==================== 消息格式转换 ====================
+// ChatMessage 在不同环节有不同的载体：
+//   - 跨网关转发：PubSubMessage
+//   - 离线存储：OfflineMessage
+// 统一在这里转换，新增字段时只需要改这几个函数
+
+// toPubSubMessage ChatMessage → PubSubMessage
+func (msg *ChatMessage) toPubSubMessage() *PubSubMessage {
+	return &PubSubMessage{
+		FromUserID: msg.FromUserID,
+		ToUserID:   msg.ToUserID,
+		Content:    []byte(msg.Content),
+		MsgType:    msg.MsgType,
+		SeqID:      msg.SeqID,
+		Timestamp:  msg.Timestamp,
+		GroupID:    msg.GroupID,
+
+		DeliverBefore: msg.DeliverBefore,
+		Delivery:      msg.Delivery,
+	}
+}
+
+// toOfflineMessage ChatMessage → OfflineMessage
+// 保留消息原始的发送时间，而不是入库时间
+func (msg *ChatMessage) toOfflineMessage() *OfflineMessage {
+	offlineMsg := &OfflineMessage{
+		FromUserID: msg.FromUserID,
+		ToUserID:   msg.ToUserID,
+		Content:    []byte(msg.Content),
+		MsgType:    msg.MsgType,
+		SeqID:      msg.SeqID,
+		GroupID:    msg.GroupID,
+
+		DeliverBefore: msg.DeliverBefore,
+	}
+	if msg.Timestamp > 0 {
+		offlineMsg.Timestamp = time.UnixMilli(msg.Timestamp)
+	}
+	return offlineMsg
+}
+
+// chatFromPubSub PubSubMessage → ChatMessage
+func chatFromPubSub(msg *PubSubMessage) *ChatMessage {
+	return &ChatMessage{
+		FromUserID: msg.FromUserID,
+		ToUserID:   msg.ToUserID,
+		Content:    string(msg.Content),
+		MsgType:    msg.MsgType,
+		SeqID:      msg.SeqID,
+		Timestamp:  msg.Timestamp,
+		GroupID:    msg.GroupID,
+
+		DeliverBefore: msg.DeliverBefore,
+		Unsequenced:   msg.SeqID < 0,
+		Delivery:      msg.Delivery,
+	}
+}
+
+// chatFromOffline OfflineMessage → ChatMessage
+func chatFromOffline(msg *OfflineMessage) *ChatMessage {
+	return &ChatMessage{
+		FromUserID: msg.FromUserID,
+		ToUserID:   msg.ToUserID,
+		Content:    string(msg.Content),
+		MsgType:    msg.MsgType,
+		SeqID:      msg.SeqID,
+		Timestamp:  msg.Timestamp.UnixMilli(),
+		GroupID:    msg.GroupID,
+
+		DeliverBefore: msg.DeliverBefore,
+		Unsequenced:   msg.SeqID < 0,
+	}
+}
+
+// clientView 推送给客户端的视图
+//   - 带上消息 ID（MsgID），客户端确认时原样回传
+//   - 去掉用户 ID 和群 ID 的租户前缀
+//   - 二进制内容（非 UTF-8）改放在 ContentBytes 中，保证逐字节送达
+//   - 主题消息的主题名从 GroupID 移到 Topic
+//
+// 内部各环节（Pub/Sub、离线盒子、WAL）都按 []byte 传递内容，本身是二进制安全的
+func (msg *ChatMessage) clientView() *ChatMessage {
+	scoped := TenantOf(msg.ToUserID) != ""
+	binary := !utf8.ValidString(msg.Content)
+	topic := msg.MsgType == MsgTypeTopic
+	view := *msg
+	view.MsgID = msg.messageID()
+	if scoped {
+		view.FromUserID = LocalID(msg.FromUserID)
+		view.ToUserID = LocalID(msg.ToUserID)
+		if view.GroupID != "" {
+			view.GroupID = LocalID(msg.GroupID)
+		}
+	}
+	if binary {
+		view.ContentBytes = []byte(msg.Content)
+		view.Content = ""
+	}
+	if topic {
+		view.Topic, view.GroupID = view.GroupID, ""
+	}
+	return &view
+}
+
+// deliveryExpired 消息是否已超过投递截止时间
+func (msg *ChatMessage) deliveryExpired(now time.Time) bool {
+	return msg.DeliverBefore > 0 && now.UnixMilli() > msg.DeliverBefore
+}
+
+// ==================== 消息处理器 ====================
+
+// MessageHandler 消息路由处理器
+// 协调各个服务组件，完成消息的路由和投递
+type MessageHandler struct {
+	gatewayID   string                    // 当前网关 ID
+	connManager *server.ConnectionManager // 连接管理器
+	session     *SessionManager           // 会话服务
+	pubsub      *PubSubManager            // Pub/Sub 服务
+	sequence    *SequenceManager          // 序列号服务
+	offline     *OfflineManager           // 离线消息服务
+	groups      *GroupManager             // 群组服务
+
+	// maxInFlight 每个连接允许的最大未 ACK 消息数，0 表示不限制
+	maxInFlight int
+
+	// checkRecipients 发送私聊前是否检查收件人存在（见 SetRecipientCheck）
+	checkRecipients bool
+
+	// offlineRate 离线积压推送的速率上限（条/秒），0 表示不限速
+	offlineRate int
+
+	// offlineBatch 离线投递每批从 Redis 拉取的消息数（见 SetOfflineBatch）
+	offlineBatch int64
+
+	// fallbackSeq 本地兜底序号计数器（序列号服务故障时使用）
+	fallbackSeq int64
+
+	// fanoutSem 群聊扇出的并发上限（网关级共享的信号量）
+	fanoutSem chan struct{}
+
+	// pusher 离线推送渠道，prefs 通知偏好（见 push.go，均可为 nil）
+	pusher PushNotifier
+	prefs  *PrefsManager
+
+	// receipts 消息状态追踪（见 receipt.go，nil 表示关闭）
+	receipts *ReceiptManager
+
+	// convs 会话列表维护（见 conversation.go，nil 表示关闭）
+	convs *ConversationManager
+
+	// wal 预写日志（见 wal.go，nil 表示关闭）
+	wal *WALManager
+
+	// topics 主题频道（见 topic.go，nil 表示关闭）
+	topics *TopicManager
+
+	// deadLetters 无法送达的消息的去处（见 deadletter.go，nil 表示只记录日志）
+	deadLetters DeadLetterHandler
+
+	// redeliveryGiveUps 因 NACK 重投次数达到上限而放弃的次数（见 nack.go）
+	redeliveryGiveUps atomic.Int64
+
+	// migrations 正在迁移的用户（UserID → 迁移状态）
+	migrations map[string]*migration
+	migrateMu  sync.Mutex
+
+	// handshakes 等待用户完成认证后投递的 Goroutine（见 deliverAfterHandshake），关闭时等待
+	handshakes sync.WaitGroup
+}
+
+// NewMessageHandler 创建消息处理器
+// 通过依赖注入的方式，将各个服务组件组合在一起
+func NewMessageHandler(
+	gatewayID string,
+	connManager *server.ConnectionManager,
+	session *SessionManager,
+	pubsub *PubSubManager,
+	sequence *SequenceManager,
+	offline *OfflineManager,
+	groups *GroupManager,
+) *MessageHandler {
+	return &MessageHandler{
+		gatewayID:   gatewayID,
+		connManager: connManager,
+		session:     session,
+		pubsub:      pubsub,
+		sequence:    sequence,
+		offline:     offline,
+		groups:      groups,
+		migrations:  make(map[string]*migration),
+		fanoutSem:   make(chan struct{}, DefaultFanoutWorkers),
+
+		offlineBatch: DefaultOfflineBatch,
+	}
+}
+
+// SetMaxInFlight 设置每个连接的最大在途（未 ACK）消息数
+// 超过后新消息转入离线存储，直到客户端 ACK 释放名额
+func (h *MessageHandler) SetMaxInFlight(n int) {
+	h.maxInFlight = n
+}
+
+// SetRecipientCheck 开启/关闭收件人存在性检查
+//
+// 开启后发给从未认证过的用户的私聊消息返回 ErrUnknownRecipient，
+// 而不是存入离线盒子永远无人读取。
+// 预置账号的部署应通过 SessionManager.AddKnownUser 登记用户，或保持关闭
+func (h *MessageHandler) SetRecipientCheck(enabled bool) {
+	h.checkRecipients = enabled
+}
+
+// SetOfflinePacing 设置离线积压推送的速率上限（条/秒）
+//
+// 弱网下的移动端重连时，一次性推送大量积压消息会挤满下行带宽导致丢包。
+// 限速只作用于 DeliverOfflineMessages，实时消息不受影响，优先送达
+func (h *MessageHandler) SetOfflinePacing(perSecond int) {
+	h.offlineRate = perSecond
+}
+
+// SetOfflineBatch 设置离线投递每批拉取的消息数，<= 0 时使用 DefaultOfflineBatch
+// 只影响每次 Redis 往返拉取多少条，整个离线盒子都会被投递
+func (h *MessageHandler) SetOfflineBatch(n int) {
+	if n <= 0 {
+		n = DefaultOfflineBatch
+	}
+	h.offlineBatch = int64(n)
+}
+
+// ==================== 发送私聊消息 ====================
+
+// SendPrivateMessage 发送私聊消息
+//
+// 这是消息路由的入口函数，完整流程：
+// 1. 生成序列号
+// 2. 查询目标用户位置
+// 3. 决定投递方式（本地/远程/离线）
+// 4. 执行投递
+func (h *MessageHandler) SendPrivateMessage(fromUserID, toUserID string, content []byte) error {
+	if err := h.checkRecipient(fromUserID, toUserID, content); err != nil {
+		return err
+	}
+	return h.sendMessage(fromUserID, toUserID, MsgTypePrivate, content, 0)
+}
+
+// SendPrivateMessageBefore 发送带投递截止时间的私聊消息
+//
+// deliverBefore 之前未能送达（例如接收者一直离线）的消息会在投递时被丢弃，
+// 并通知发送者消息已过期未送达
+func (h *MessageHandler) SendPrivateMessageBefore(fromUserID, toUserID string, content []byte, deliverBefore time.Time) error {
+	if err := h.checkRecipient(fromUserID, toUserID, content); err != nil {
+		return err
+	}
+	return h.sendMessage(fromUserID, toUserID, MsgTypePrivate, content, deliverBefore.UnixMilli())
+}
+
+// SendNotification 发送通知类消息（如表情回应）
+//
+// 与私聊消息走同样的路由（本地/远程/离线）和序列号，
+// 保证通知与聊天消息在会话内的顺序一致，离线时也不会丢失
+// 客户端根据 msgType 对应的 CmdType 区分处理
+func (h *MessageHandler) SendNotification(fromUserID, toUserID string, msgType int, payload []byte) error {
+	return h.sendMessage(fromUserID, toUserID, msgType, payload, 0)
+}
+
+// checkRecipient 收件人存在性检查（未开启时直接通过）
+// 检查本身失败时放行，宁可存离线也不误退信；退信的消息记入死信
+func (h *MessageHandler) checkRecipient(fromUserID, toUserID string, content []byte) error {
+	if !h.checkRecipients {
+		return nil
+	}
+	known, err := h.session.IsKnownUser(toUserID)
+	if err != nil {
+		log.Printf("[Message] Failed to check recipient %s: %v", toUserID, err)
+		return nil
+	}
+	if !known {
+		h.deadLetter(&ChatMessage{
+			FromUserID: fromUserID,
+			ToUserID:   toUserID,
+			Content:    string(content),
+			MsgType:    MsgTypePrivate,
+			Timestamp:  wallNow().UnixMilli(),
+		}, DeadLetterUnknownRecipient, ErrUnknownRecipient)
+		return ErrUnknownRecipient
+	}
+	return nil
+}
+
+// SendSystemEvent 直接向连接推送一条系统事件
+//
+// 不分配序列号、不存离线（SeqID 为 0，客户端的 ACK 会被忽略），
+// 用于对刚发来请求的连接做即时反馈，例如退信
+func SendSystemEvent(conn *server.Connection, event *SystemEvent) error {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(&ChatMessage{
+		ToUserID:  LocalID(conn.GetUserID()),
+		Content:   string(payload),
+		MsgType:   MsgTypeSystem,
+		Timestamp: wallNow().UnixMilli(),
+	})
+	if err != nil {
+		return err
+	}
+	return conn.Send(&protocol.Message{
+		CmdType: protocol.CmdTypeMessage,
+		Body:    data,
+	})
+}
+
+// sendMessage 分配序列号、构造消息并路由
+// deliverBefore 为投递截止时间（Unix 毫秒），0 表示不限制
+func (h *MessageHandler) sendMessage(fromUserID, toUserID string, msgType int, content []byte, deliverBefore int64) error {
+	_, err := h.send(fromUserID, toUserID, msgType, content, deliverBefore, DeliveryStoreIfOffline)
+	return err
+}
+
+// send 同 sendMessage，按 policy 投递，并返回分配的序列号和是否存入了离线盒子
+func (h *MessageHandler) send(fromUserID, toUserID string, msgType int, content []byte, deliverBefore int64,
+	policy DeliveryPolicy) (*SendOutcome, error) {
+	if !sameTenant(fromUserID, toUserID) {
+		return nil, ErrCrossTenant
+	}
+
+	// Step 1: 生成消息序列号
+	// 用于消息排序和 ACK
+	conversationID := getConversationID(fromUserID, toUserID)
+	// 序列号服务故障（如 Redis 不可用）时降级为本地兜底序号：
+	// 丢失严格顺序好过丢失整条消息
+	seqID, err := h.sequence.NextSeq(conversationID)
+	if err != nil {
+		seqID = h.nextFallbackSeq()
+		log.Printf("[Message] Sequence unavailable for %s, using fallback seq %d: %v", conversationID, seqID, err)
+	} else if seqID == 1 {
+		// 计数器刚被创建：可能是第一条消息，也可能是被 Redis 淘汰了（见 eviction.go）
+		seqID = h.reseedSequence(conversationID, fromUserID, toUserID)
+	}
+
+	// Step 2: 构造聊天消息
+	// 时间戳使用 wallNow，时钟回拨时也不会早于之前的消息
+	msg := &ChatMessage{
+		FromUserID: fromUserID,
+		ToUserID:   toUserID,
+		Content:    string(content),
+		MsgType:    msgType,
+		SeqID:      seqID,
+		Timestamp:  wallNow().UnixMilli(),
+
+		DeliverBefore: deliverBefore,
+		Unsequenced:   seqID < 0,
+		Delivery:      policy,
+
+		stored: new(atomic.Bool),
+	}
+
+	// 聊天消息更新双方的会话列表（通知类消息不影响）
+	if msgType == MsgTypePrivate {
+		h.touchConversation(fromUserID, LocalID(toUserID), msg, false)
+		h.touchConversation(toUserID, LocalID(fromUserID), msg, true)
+	}
+
+	// 开启 WAL 时先持久化再路由，写入失败则拒绝这条消息
+	// 只推送给在线连接的消息不需要持久化
+	if policy != DeliveryOnlineOnly {
+		if err := h.appendWAL(msg); err != nil {
+			return nil, err
+		}
+	}
+	if policy == DeliveryAlwaysStore {
+		h.storeCopy(msg)
+	}
+
+	// 按发送者公平排队，刷屏的发送者不会占满 Redis 并发上限
+	if err := pkgredis.Fair.Do(fromUserID, func() error { return h.routeMessage(msg) }); err != nil {
+		return nil, err
+	}
+	return &SendOutcome{SeqID: seqID, Stored: msg.stored.Load()}, nil
+}
+
+// routeMessage 根据接收者位置投递消息
+func (h *MessageHandler) routeMessage(msg *ChatMessage) error {
+	// Step 3: 查询目标用户所在的 Gateway
+	targetGateway, err := h.session.GetUserGateway(msg.ToUserID)
+	if errors.Is(err, ErrUserOffline) {
+		// 会话已经删除（如最后登录的设备断开），其他网关上可能还有设备
+		if gateways := h.userGateways(msg.ToUserID, ""); len(gateways) > 0 {
+			return h.deliverMultiHomed(gateways, msg)
+		}
+		// 用户不在线，存入离线消息盒子
+		log.Printf("[Message] User %s is offline, storing message", msg.ToUserID)
+		return h.storeOfflineMessage(msg)
+	}
+	if err != nil {
+		// 查询失败，不知道用户在哪：本地有连接就直接推送，否则尽量存离线
+		log.Printf("[Message] Failed to look up gateway for user %s: %v", msg.ToUserID, err)
+		if conn := h.connManager.GetByUserID(msg.ToUserID); conn != nil {
+			return h.deliverLocal(msg.ToUserID, msg)
+		}
+		if storeErr := h.storeOfflineMessage(msg); storeErr != nil {
+			return fmt.Errorf("failed to route message to %s: lookup: %v, store: %w", msg.ToUserID, err, storeErr)
+		}
+		return nil
+	}
+
+	// Step 4: 根据用户位置选择投递方式
+	// 用户的设备分布在多个网关时，每个网关各投递一份（见 multihome.go）
+	if gateways := h.userGateways(msg.ToUserID, targetGateway); len(gateways) > 1 {
+		return h.deliverMultiHomed(gateways, msg)
+	}
+	if targetGateway == h.gatewayID {
+		// 用户在本地 Gateway，直接推送
+		return h.deliverLocal(msg.ToUserID, msg)
+	}
+
+	// 用户在其他 Gateway，通过 Pub/Sub 转发
+	return h.deliverRemote(targetGateway, msg)
+}
+
+// ==================== 本地投递 ====================
+
+// deliverLocal 本地投递消息
+//
+// 用户在当前 Gateway，直接从内存中查找连接并推送
+// 这是最快的投递方式，无需网络请求
+func (h *MessageHandler) deliverLocal(userID string, msg *ChatMessage) error {
+	// 用户正在迁移到其他网关，先缓冲，迁移结束后统一转发
+	if h.bufferForMigration(userID, msg) {
+		return nil
+	}
+
+	// 已超过投递截止时间（如跨网关转发耗时过长），直接丢弃
+	if msg.deliveryExpired(time.Now()) {
+		h.dropExpired(msg)
+		return nil
+	}
+
+	// 从 ConnectionManager 中查找用户连接
+	conn := h.connManager.GetByUserID(userID)
+	// 连接正在关闭（closeChan 已关闭但还没从 ConnectionManager 移除）
+	// 与连接不存在同等对待，否则 Send 会失败导致消息丢失
+	if conn == nil || conn.IsClosed() {
+		// 连接不存在（可能刚刚断开），存入离线
+		log.Printf("[Message] Connection not found for user %s", userID)
+		return h.storeOfflineMessage(msg)
+	}
+
+	// 客户端暂停了实时推送（进入后台），存入离线，恢复时一并投递
+	if conn.IsPaused() {
+		return h.storeOfflineMessage(msg)
+	}
+
+	// 流控：在途消息过多（客户端只读不 ACK），暂停推送改存离线
+	// 实时投递的消息不在离线盒子中，随名额一起记录，关闭时可以放回离线盒子
+	// （always_store 的消息已经在离线盒子中，不需要记录）
+	var pending interface{} = msg
+	if msg.Delivery == DeliveryAlwaysStore {
+		pending = nil
+	}
+	if !conn.ReserveInFlight(msg.SeqID, msg.messageID(), h.maxInFlight, pending) {
+		log.Printf("[Message] Too many unacked messages for user %s, storing offline", userID)
+		return h.storeOfflineMessage(msg)
+	}
+
+	// 序列化消息
+	data, err := json.Marshal(msg.clientView())
+	if err != nil {
+		return err
+	}
+
+	// 封装为协议消息并发送
+	protoMsg := &protocol.Message{
+		CmdType: cmdTypeFor(msg.MsgType),
+		Body:    data,
+	}
+
+	log.Printf("[Message] Delivering message to user %s locally", userID)
+	if err := conn.Send(protoMsg); err != nil {
+		// 检查与发送之间连接被关闭，或写队列已满丢弃了消息，兜底存入离线
+		if errors.Is(err, net.ErrClosed) || errors.Is(err, server.ErrWriteQueueFull) {
+			log.Printf("[Message] Failed to deliver to user %s (%v), storing offline", userID, err)
+			return h.storeOfflineMessage(msg)
+		}
+		return err
+	}
+	h.trackState(msg, true)
+	return nil
+}
+
+// ==================== 远程投递 ====================
+
+// deliverRemote 远程投递消息（跨 Gateway）
+//
+// 用户在其他 Gateway，通过 Redis Pub/Sub 转发
+// 目标 Gateway 会收到消息并投递给用户
+//
+// 兜底情况：
+//   - 目标就是本网关（如迁移目标与当前网关相同）：直接本地投递，不绕 Redis
+//   - 目标网关没有订阅者（会话过期前网关已下线）：消息不会被收到，改存离线
+//   - 目标网关在线但用户已不在那里：由目标网关的 HandlePubSubMessage 存离线
+func (h *MessageHandler) deliverRemote(targetGateway string, msg *ChatMessage) error {
+	if targetGateway == h.gatewayID {
+		return h.deliverLocal(msg.ToUserID, msg)
+	}
+
+	// 群聊扇出：收集起来，这批成员投递完后合并发布
+	if msg.remote != nil {
+		msg.remote.add(targetGateway, msg)
+		return nil
+	}
+
+	// 构造 Pub/Sub 消息
+	pubsubMsg := msg.toPubSubMessage()
+
+	log.Printf("[Message] Routing message to gateway %s via Pub/Sub", targetGateway)
+	err := h.pubsub.Publish(targetGateway, pubsubMsg)
+	if errors.Is(err, ErrNoSubscriber) {
+		// 目标网关没有在监听（下线或尚未完成订阅），消息不会被收到，改存离线
+		log.Printf("[Message] Gateway %s has no subscriber, storing message offline", targetGateway)
+		return h.storeOfflineMessage(msg)
+	}
+	return err
+}
+
+// ==================== 离线存储 ====================
+
+// storeOfflineMessage 存储离线消息，成功后触发离线推送
+// 按消息的投递策略：online_only 直接丢弃，always_store 已在发送时存储（见 delivery.go）
+func (h *MessageHandler) storeOfflineMessage(msg *ChatMessage) error {
+	switch msg.Delivery {
+	case DeliveryOnlineOnly:
+		log.Printf("[Message] User %s is not reachable, dropping online-only message %d", msg.ToUserID, msg.SeqID)
+		return nil
+	case DeliveryAlwaysStore:
+	default:
+		if err := h.offline.Store(msg.ToUserID, msg.toOfflineMessage()); err != nil {
+			h.deadLetter(msg, DeadLetterStoreFailed, err)
+			return err
+		}
+	}
+	if msg.stored != nil {
+		msg.stored.Store(true)
+	}
+	h.trackState(msg, false)
+	h.notifyOffline(msg)
+	return nil
+}
+
+// ==================== Pub/Sub 消息处理 ====================
+
+// HandlePubSubMessage 处理从 Pub/Sub 收到的消息
+//
+// 当其他 Gateway 向本 Gateway 发送消息时，会通过这个方法处理
+// 本质上是将远程消息转换为本地投递
+func (h *MessageHandler) HandlePubSubMessage(msg *PubSubMessage) {
+	chatMsg := chatFromPubSub(msg)
+
+	// 临时消息只推送给在线连接
+	if isEphemeral(msg.MsgType) {
+		h.deliverEphemeral(chatMsg)
+		return
+	}
+
+	// 本地没有连接，但会话已经指向本网关：用户正在这里完成认证
+	// （例如刚从其他网关迁移过来），稍等连接注册后再投递，而不是直接存离线
+	if conn := h.connManager.GetByUserID(msg.ToUserID); conn == nil || conn.IsClosed() {
+		if gw, err := h.session.GetUserGateway(msg.ToUserID); err == nil && gw == h.gatewayID {
+			h.handshakes.Add(1)
+			go func() {
+				defer h.handshakes.Done()
+				h.deliverAfterHandshake(chatMsg)
+			}()
+			return
+		}
+	}
+
+	// 尝试本地投递
+	if err := h.deliverLocal(msg.ToUserID, chatMsg); err != nil {
+		log.Printf("[Message] Failed to deliver Pub/Sub message: %v", err)
+	}
+}
+
+// deliverAfterHandshake 等待正在认证的用户连接出现后投递
+// 重试次数用完仍没有连接时，deliverLocal 会存入离线
+// 在独立的 Goroutine 中执行，不阻塞 Pub/Sub 接收循环（关闭时由 WaitHandshakes 等待）
+func (h *MessageHandler) deliverAfterHandshake(msg *ChatMessage) {
+	for i := 0; i < HandshakeRetries; i++ {
+		if conn := h.connManager.GetByUserID(msg.ToUserID); conn != nil && !conn.IsClosed() {
+			break
+		}
+		time.Sleep(HandshakeRetryDelay)
+	}
+	if err := h.deliverLocal(msg.ToUserID, msg); err != nil {
+		log.Printf("[Message] Failed to deliver Pub/Sub message after handshake wait: %v", err)
+	}
+}
+
+// WaitHandshakes 等待所有等待认证的投递结束（最多 HandshakeRetries 次重试加一次投递）
+//
+// 这些 Goroutine 由 Pub/Sub 处理器启动，在 PubSubManager.Stop 返回之后仍可能在运行。
+// 关闭时在 Pub/Sub 停止之后、Redis 关闭之前调用：
+// 此时不会再有新的等待，而仍在等待的消息需要 Redis 才能存入离线
+func (h *MessageHandler) WaitHandshakes() {
+	h.handshakes.Wait()
+}
+
+// ==================== 离线消息投递 ====================
+
+// DeliverOfflineMessages 投递离线消息
+//
+// 用户上线时调用，将存储的离线消息按 SeqID 从旧到新推送给用户
+// 按批拉取（见 offlineCursor），直到离线盒子取完或达到在途上限
+func (h *MessageHandler) DeliverOfflineMessages(userID string, conn *server.Connection) error {
+	// 暂停期间不推送（例如 ACK 释放名额触发的恢复投递），等 Resume 时再投递
+	if conn.IsPaused() {
+		return nil
+	}
+
+	// 多设备同时上线时，每条消息只由认领到它的设备投递（见 claim.go）
+	cursor := h.newOfflineCursor(userID, conn.GetDeviceID())
+	defer cursor.releaseUnsent()
+
+	// 限速：每条消息之间至少间隔 1/rate 秒
+	var pace <-chan time.Time
+	if h.offlineRate > 0 {
+		ticker := time.NewTicker(time.Second / time.Duration(h.offlineRate))
+		defer ticker.Stop()
+		pace = ticker.C
+	}
+
+	// 逐条推送
+	delivered, failed := 0, 0
+	var expired []string
+	var fetchErr error
+	for i := 0; ; i++ {
+		msg, err := cursor.next()
+		if err != nil {
+			fetchErr = err
+			break
+		}
+		if msg == nil {
+			break
+		}
+		if !cursor.isClaimed(msg) {
+			// 其他设备正在投递这条消息
+			continue
+		}
+		chatMsg := chatFromOffline(msg)
+		ref := server.InFlightRef{SeqID: msg.SeqID, ID: chatMsg.messageID()}
+
+		// 已经推送、还在等 ACK 的消息（ACK 释放名额后恢复投递时，盒子里仍有它们），
+		// 再推一次会重复投递并重复占用名额；认领保持不变，仍由本设备负责
+		if conn.IsInFlight(ref) {
+			cursor.markSent(msg)
+			continue
+		}
+
+		// 超过投递截止时间的消息不再投递，从离线盒子中删除
+		if chatMsg.deliveryExpired(time.Now()) {
+			h.dropExpired(chatMsg)
+			expired = append(expired, ref.ID)
+			continue
+		}
+
+		// 投递过程中客户端暂停了推送，剩余消息留到 Resume
+		if conn.IsPaused() {
+			break
+		}
+
+		// 流控：达到在途上限后停止，剩余消息等 ACK 后再推送
+		// 离线消息在 ACK 之前一直留在离线盒子中，只占用名额
+		if !conn.ReserveInFlight(ref.SeqID, ref.ID, h.maxInFlight, nil) {
+			log.Printf("[Message] In-flight limit reached for user %s, pausing offline delivery", userID)
+			break
+		}
+
+		data, err := json.Marshal(chatMsg.clientView())
+		if err != nil {
+			log.Printf("[Message] Failed to marshal offline message %d: %v", msg.SeqID, err)
+			h.deadLetter(chatMsg, DeadLetterEncodeFailed, err)
+			conn.ReleaseInFlightRefs([]server.InFlightRef{ref}, h.maxInFlight)
+			failed++
+			continue
+		}
+
+		if pace != nil && i > 0 {
+			select {
+			case <-pace:
+			case <-conn.Done():
+				// 连接已断开，剩余消息留在离线盒子中，下次上线再推送
+				conn.ReleaseInFlightRefs([]server.InFlightRef{ref}, h.maxInFlight)
+				log.Printf("[Message] Connection of user %s closed during offline delivery", userID)
+				return nil
+			}
+		}
+
+		protoMsg := &protocol.Message{
+			CmdType: cmdTypeFor(msg.MsgType),
+			Body:    data,
+		}
+		if err := conn.Send(protoMsg); err != nil {
+			// 消息仍在离线盒子中，释放在途名额；连接已关闭时后续也发不出去
+			conn.ReleaseInFlightRefs([]server.InFlightRef{ref}, h.maxInFlight)
+			failed++
+			log.Printf("[Message] Failed to deliver offline message %d to user %s: %v", msg.SeqID, userID, err)
+			if errors.Is(err, net.ErrClosed) {
+				break
+			}
+			continue
+		}
+		h.trackState(chatMsg, true)
+		cursor.markSent(msg)
+		delivered++
+	}
+
+	if len(expired) > 0 {
+		if err := h.offline.RemoveMessages(userID, expired); err != nil {
+			log.Printf("[Message] Failed to remove expired offline messages: %v", err)
+		}
+	}
+
+	log.Printf("[Message] Delivered %d offline messages to user %s", delivered, userID)
+	if fetchErr != nil {
+		return fetchErr
+	}
+	if failed > 0 {
+		return fmt.Errorf("failed to deliver %d of %d offline messages to user %s",
+			failed, delivered+failed, userID)
+	}
+	return nil
+}
+
+// offlineCursor 按批遍历离线盒子（SeqID 升序）
+//
+//	批次 1: SeqID >= -inf  ──▶ 1 .. 100
+//	批次 2: SeqID >= 100   ──▶ 100 .. 199（跳过已经返回过的 100）
+//	...
+//
+// 不同会话的消息 SeqID 可能相同，因此下一批从上一批最后的 SeqID（含）开始，
+// 并跳过边界 SeqID 上已经返回过的消息，而不是从 SeqID+1 开始（会漏掉同 SeqID 的消息）。
+// 按 Score 而不是按排名分页：投递过程中客户端 ACK 删除旧消息不会导致跳过
+type offlineCursor struct {
+	h      *MessageHandler
+	userID string
+	owner  string // 认领离线消息的设备 ID（见 claim.go）
+
+	// claimed 本设备认领的消息 ID（值为是否已推送），被其他设备认领的消息不投递
+	claimed map[string]bool
+
+	startSeq int64           // 下一批的起始 SeqID（含）
+	seen     map[string]bool // SeqID == startSeq 且已经返回过的消息
+	buf      []*OfflineMessage
+	done     bool // 离线盒子已经取完
+}
+
+// newOfflineCursor 从离线盒子最旧的消息开始遍历，每批拉取后为 owner 认领
+func (h *MessageHandler) newOfflineCursor(userID, owner string) *offlineCursor {
+	return &offlineCursor{
+		h:        h,
+		userID:   userID,
+		owner:    owner,
+		claimed:  make(map[string]bool),
+		startSeq: math.MinInt64,
+		seen:     make(map[string]bool),
+	}
+}
+
+// isClaimed 消息是否由本设备认领
+func (c *offlineCursor) isClaimed(msg *OfflineMessage) bool {
+	_, ok := c.claimed[msg.messageID()]
+	return ok
+}
+
+// markSent 消息已推送，结束时不再释放它的认领
+func (c *offlineCursor) markSent(msg *OfflineMessage) {
+	c.claimed[msg.messageID()] = true
+}
+
+// releaseUnsent 释放认领了但没有推送的消息，其他设备可以立即认领
+func (c *offlineCursor) releaseUnsent() {
+	var unsent []string
+	for id, sent := range c.claimed {
+		if !sent {
+			unsent = append(unsent, id)
+		}
+	}
+	if err := c.h.offline.ReleaseClaims(c.userID, unsent); err != nil {
+		log.Printf("[Message] Failed to release offline claims of %s: %v", c.userID, err)
+	}
+}
+
+// next 返回下一条消息，取完时返回 nil
+func (c *offlineCursor) next() (*OfflineMessage, error) {
+	for len(c.buf) == 0 {
+		if c.done {
+			return nil, nil
+		}
+		if err := c.fetch(); err != nil {
+			return nil, err
+		}
+	}
+
+	msg := c.buf[0]
+	c.buf = c.buf[1:]
+	if msg.SeqID != c.startSeq {
+		c.startSeq = msg.SeqID
+		c.seen = make(map[string]bool)
+	}
+	c.seen[offlineIdentity(msg)] = true
+	return msg, nil
+}
+
+// fetch 拉取下一批
+func (c *offlineCursor) fetch() error {
+	// 多拉边界上已返回过的条数，保证过滤后仍能凑满一批
+	limit := c.h.offlineBatch + int64(len(c.seen))
+	batch, err := c.h.offline.Fetch(c.userID, c.startSeq, limit)
+	if err != nil {
+		return err
+	}
+	if int64(len(batch)) < limit {
+		c.done = true
+	}
+
+	// 认领这一批（已经认领过的跳过），被其他设备认领的消息仍然返回，由调用方跳过
+	var ids []string
+	for _, msg := range batch {
+		id := msg.messageID()
+		if _, ok := c.claimed[id]; !ok {
+			ids = append(ids, id)
+		}
+	}
+	claimed, err := c.h.offline.Claim(c.userID, c.owner, ids)
+	if err != nil {
+		return err
+	}
+	for id := range claimed {
+		c.claimed[id] = false
+	}
+
+	for _, msg := range batch {
+		if msg.SeqID == c.startSeq && c.seen[offlineIdentity(msg)] {
+			continue
+		}
+		c.buf = append(c.buf, msg)
+	}
+	if len(c.buf) == 0 {
+		c.done = true
+	}
+	return nil
+}
+
+// offlineIdentity 离线消息的标识（区分 SeqID 相同的不同会话消息）
+func offlineIdentity(msg *OfflineMessage) string {
+	return fmt.Sprintf("%s|%s|%d|%d", msg.FromUserID, msg.GroupID, msg.SeqID, msg.Timestamp.UnixNano())
+}
+
+// dropExpired 丢弃超过投递截止时间的消息，并通知发送者
+func (h *MessageHandler) dropExpired(msg *ChatMessage) {
+	log.Printf("[Message] Dropping expired message %d from %s to %s", msg.SeqID, msg.FromUserID, msg.ToUserID)
+	h.deadLetter(msg, DeadLetterExpired, nil)
+
+	// 系统通知本身没有截止时间，不会递归过期
+	if msg.MsgType == MsgTypeSystem {
+		return
+	}
+
+	payload, _ := json.Marshal(&SystemEvent{
+		Event:    SystemEventExpired,
+		ToUserID: LocalID(msg.ToUserID),
+		SeqID:    msg.SeqID,
+	})
+	go func() {
+		if err := h.SendNotification(msg.ToUserID, msg.FromUserID, MsgTypeSystem, payload); err != nil {
+			log.Printf("[Message] Failed to notify sender of expired message: %v", err)
+		}
+	}()
+}
+
+// ==================== ACK 处理 ====================
+
+// HandleAck 处理客户端的消息确认
+//
+// 1. 确认位置截断到本连接投递过的最大 SeqID（见 boundAck）
+// 2. 忽略不推进确认位置的 ACK（重复/回退）
+// 3. 删除已确认的离线消息
+// 4. 释放连接的在途名额
+// 5. 如果连接此前因流控暂停，恢复投递积压的离线消息
+func (h *MessageHandler) HandleAck(conn *server.Connection, seqID int64) error {
+	userID := conn.GetUserID()
+	seqID = boundAck(conn, seqID)
+
+	// SeqID 0 是不进入离线盒子的即时通知（见 SendSystemEvent），无需确认
+	// 重复或回退的 ACK 已被之前的累积删除覆盖，无需再访问 Redis
+	if seqID == 0 || !conn.AdvanceAck(seqID) {
+		return nil
+	}
+
+	err := h.ackUpTo(userID, seqID)
+
+	if conn.ReleaseInFlight(seqID, h.maxInFlight) {
+		log.Printf("[Message] Resuming delivery to user %s", userID)
+		go h.DeliverOfflineMessages(userID, conn)
+	}
+
+	return err
+}
+
+// ackUpTo 累积确认：删除 SeqID 不大于 seqID 的离线消息，同步 WAL 和回执
+func (h *MessageHandler) ackUpTo(userID string, seqID int64) error {
+	err := h.offline.Remove(userID, seqID)
+	h.ackWAL(userID, seqID, nil)
+
+	if h.receipts != nil {
+		if rerr := h.receipts.RecordAck(userID, seqID); rerr != nil {
+			log.Printf("[Receipt] Failed to record ack for %s: %v", userID, rerr)
+		}
+	}
+	return err
+}
+
+// boundAck 把累积确认位置截断到连接投递过的最大 SeqID
+//
+// 离线盒子按 SeqID 累积删除，超过投递范围的 ACK（客户端错误或恶意）
+// 会删掉还没发出的消息；截断后只确认真正投递过的部分，还没投递过消息时返回 0
+func boundAck(conn *server.Connection, seqID int64) int64 {
+	if sent := conn.MaxSentSeq(); seqID > sent {
+		log.Printf("[Message] Ack %d from user %s exceeds delivered seq %d, capping", seqID, conn.GetUserID(), sent)
+		return sent
+	}
+	return seqID
+}
+
+// RequeueUnacked 把连接上已投递未确认的实时消息放回离线盒子
+//
+// 网关关闭时调用：这些消息可能还停留在客户端的 socket 缓冲区里，
+// 客户端如果同时重启就会丢失。放回离线盒子后，重连时会重新投递；
+// 客户端已经处理过的消息按 SeqID 去重即可
+// 返回放回的消息数
+func (h *MessageHandler) RequeueUnacked(conn *server.Connection) int {
+	requeued := 0
+	for _, p := range conn.PendingUnacked() {
+		msg, ok := p.(*ChatMessage)
+		if !ok {
+			continue
+		}
+		if err := h.offline.Store(msg.ToUserID, msg.toOfflineMessage()); err != nil {
+			log.Printf("[Message] Failed to requeue message %d for user %s: %v", msg.SeqID, msg.ToUserID, err)
+			continue
+		}
+		requeued++
+	}
+	return requeued
+}
+
+// HandleSelectiveAck 处理选择性确认
+//
+// 只确认列出的消息（消息 ID，见 MessageID），未列出的消息（包括中间的空洞）保留在离线盒子中
+// 适用于客户端乱序收到消息、无法做累积确认的情况
+//
+// SeqID 只在会话内唯一，因此按消息 ID 而不是 SeqID 确认：
+// 确认 alice:bob:5 不会删掉其他会话中 SeqID 同为 5 的消息
+func (h *MessageHandler) HandleSelectiveAck(conn *server.Connection, msgIDs []string) error {
+	userID := conn.GetUserID()
+
+	// 只确认投递过的范围，超出的 SeqID 对应的消息还没发出，不能删除
+	sent := conn.MaxSentSeq()
+	var ids []string
+	var refs []server.InFlightRef
+	for _, id := range msgIDs {
+		if _, seq, ok := parseMessageID(id); ok && seq > 0 && seq <= sent {
+			ids = append(ids, id)
+			refs = append(refs, server.InFlightRef{SeqID: seq, ID: id})
+		}
+	}
+	if len(ids) < len(msgIDs) {
+		log.Printf("[Message] Ignoring %d invalid or undelivered selective acks from user %s", len(msgIDs)-len(ids), userID)
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+
+	err := h.offline.RemoveMessages(userID, ids)
+	h.ackWAL(userID, 0, ids)
+
+	if conn.ReleaseInFlightRefs(refs, h.maxInFlight) {
+		log.Printf("[Message] Resuming delivery to user %s", userID)
+		go h.DeliverOfflineMessages(userID, conn)
+	}
+
+	return err
+}
+
+// ==================== 工具函数 ====================
+
+// ConversationID 获取两个用户之间的私聊会话 ID
+func ConversationID(user1, user2 string) string {
+	return getConversationID(user1, user2)
+}
+
+// cmdTypeFor 业务消息类型 → 下发给客户端的协议命令类型
+func cmdTypeFor(msgType int) uint16 {
+	switch msgType {
+	case MsgTypeReaction:
+		return protocol.CmdTypeReaction
+	case MsgTypeTyping:
+		return protocol.CmdTypeTyping
+	case MsgTypePin:
+		return protocol.CmdTypePin
+	case MsgTypeUnpin:
+		return protocol.CmdTypeUnpin
+	case MsgTypeGroupEvent:
+		return protocol.CmdTypeGroupEvent
+	default:
+		return protocol.CmdTypeMessage
+	}
+}
+
+// MessageID 生成消息的全局标识：会话 ID + 序列号
+//
+// 序列号只在会话内唯一，因此需要与会话 ID 组合
+// 示例：MessageID("alice:bob", 42) → "alice:bob:42"
+func MessageID(conversationID string, seqID int64) string {
+	return conversationID + ":" + strconv.FormatInt(seqID, 10)
+}
+
+// parseMessageID 拆分消息 ID 为会话 ID 和序列号（MessageID 的逆运算）
+// 会话 ID 本身含有冒号，因此按最后一个冒号拆分
+func parseMessageID(msgID string) (conversationID string, seqID int64, ok bool) {
+	i := strings.LastIndexByte(msgID, ':')
+	if i <= 0 {
+		return "", 0, false
+	}
+	seqID, err := strconv.ParseInt(msgID[i+1:], 10, 64)
+	if err != nil {
+		return "", 0, false
+	}
+	return msgID[:i], seqID, true
+}
+
+// messageID 消息 ID，会话部分与分配序列号时使用的 Key 一致
+// 群消息所有成员共享群序列号，消息 ID 对每个成员都相同
+func (m *ChatMessage) messageID() string {
+	if m.GroupID != "" {
+		return MessageID(GroupConversationID(m.GroupID), m.SeqID)
+	}
+	return privateMessageID(m.FromUserID, m.ToUserID, m.SeqID)
+}
+
+// messageID 离线消息的消息 ID，与投递时下发给客户端的一致
+func (m *OfflineMessage) messageID() string {
+	if m.GroupID != "" {
+		return MessageID(GroupConversationID(m.GroupID), m.SeqID)
+	}
+	return privateMessageID(m.FromUserID, m.ToUserID, m.SeqID)
+}
+
+// privateMessageID 等价于 MessageID(getConversationID(user1, user2), seqID)
+//
+// 每条消息都会计算（回执、去重），直接写入一块预先分配好的缓冲区：
+// 只分配一次，而不是先生成会话 ID、再拼接序列号（两次分配，见 BenchmarkPrivateMessageID）
+func privateMessageID(user1, user2 string, seqID int64) string {
+	if user2 < user1 {
+		user1, user2 = user2, user1
+	}
+	var num [20]byte // 足够容纳任意 int64 的十进制表示
+	seq := strconv.AppendInt(num[:0], seqID, 10)
+
+	var b strings.Builder
+	b.Grow(len(user1) + len(user2) + len(seq) + 2)
+	b.WriteString(user1)
+	b.WriteByte(':')
+	b.WriteString(user2)
+	b.WriteByte(':')
+	b.Write(seq)
+	return b.String()
+}
+
+// nextFallbackSeq 生成本地兜底序号
+//
+// 使用负数，与 Redis 生成的正数序号区分开，客户端据此识别未排序的消息
+// 在本网关内单调递减（-1, -2, -3...），离线盒子中排在正常消息之前，
+// 会随任意一次累积 ACK 一并删除
+func (h *MessageHandler) nextFallbackSeq() int64 {
+	return -atomic.AddInt64(&h.fallbackSeq, 1)
+}
+
+// getConversationID 生成会话标识
+//
+// 私聊的会话 ID 由两个用户 ID 组成，保证 A→B 和 B→A 使用相同的会话 ID
+// 实现方式：按字典序排序后拼接
+//
+// 示例：
+//   - getConversationID("alice", "bob") → "alice:bob"
+//   - getConversationID("bob", "alice") → "alice:bob" (相同)
+//
+// 只比较一次；三段字符串的 + 拼接由编译器合并为一次分配，
+// 与预分配容量的 strings.Builder 相同，不再额外优化（见 BenchmarkGetConversationID）
+func getConversationID(user1, user2 string) string {
+	if user2 < user1 {
+		user1, user2 = user2, user1
+	}
+	return user1 + ":" + user2
+}
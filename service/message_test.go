@@ -0,0 +1,217 @@
+package service
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	pkgredis "go-im/pkg/redis"
+	"go-im/protocol"
+	"go-im/server"
+)
+
+// benchSink 保存基准测试的结果，避免被编译器优化掉
+var benchSink string
+
+// 带租户前缀的用户 ID，拼接结果超过 32 字节，编译器不会放在栈上
+const (
+	benchUser1 = "tenant_a/user_bob_0001"
+	benchUser2 = "tenant_a/user_alice_0002"
+)
+
+func TestGetConversationID(t *testing.T) {
+	cases := []struct {
+		user1, user2 string
+		want         string
+	}{
+		{"alice", "bob", "alice:bob"},
+		{"bob", "alice", "alice:bob"},
+		{"alice", "alice", "alice:alice"}, // 相同 ID
+		{"al", "alice", "al:alice"},       // 一个是另一个的前缀
+		{"alice", "al", "al:alice"},
+		{"", "bob", ":bob"}, // 空 ID
+		{"bob", "", ":bob"},
+		{"", "", ":"},
+	}
+	for _, c := range cases {
+		if got := getConversationID(c.user1, c.user2); got != c.want {
+			t.Errorf("getConversationID(%q, %q) = %q, want %q", c.user1, c.user2, got, c.want)
+		}
+	}
+}
+
+// TestPrivateMessageID 单次分配的实现与 MessageID(getConversationID(...)) 结果一致
+func TestPrivateMessageID(t *testing.T) {
+	pairs := [][2]string{
+		{"alice", "bob"},
+		{"alice", "alice"},
+		{"al", "alice"},
+		{"", "bob"},
+		{"", ""},
+	}
+	seqs := []int64{0, 1, -1, 42, -9223372036854775808, 9223372036854775807}
+	for _, p := range pairs {
+		for _, seq := range seqs {
+			want := MessageID(getConversationID(p[0], p[1]), seq)
+			for _, got := range []string{privateMessageID(p[0], p[1], seq), privateMessageID(p[1], p[0], seq)} {
+				if got != want {
+					t.Errorf("privateMessageID(%q, %q, %d) = %q, want %q", p[0], p[1], seq, got, want)
+				}
+			}
+		}
+	}
+}
+
+// BenchmarkGetConversationID 每条私聊消息都会计算，应只有 1 次分配
+func BenchmarkGetConversationID(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		benchSink = getConversationID(benchUser1, benchUser2)
+	}
+}
+
+// BenchmarkPrivateMessageID 直接写入预分配缓冲区（1 次分配），
+// 对比先生成会话 ID 再拼接序列号（2 次分配）
+func BenchmarkPrivateMessageID(b *testing.B) {
+	b.Run("direct", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			benchSink = privateMessageID(benchUser1, benchUser2, int64(i))
+		}
+	})
+	b.Run("composed", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			benchSink = MessageID(getConversationID(benchUser1, benchUser2), int64(i))
+		}
+	})
+}
+
+// readDelivered 从客户端一侧读取 n 条推送的消息
+func readDelivered(t *testing.T, peer net.Conn, r *bufio.Reader, n int) []*ChatMessage {
+	t.Helper()
+	peer.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var msgs []*ChatMessage
+	for len(msgs) < n {
+		frame, err := protocol.Unpack(r)
+		if err != nil {
+			t.Fatalf("reading delivery %d: %v", len(msgs)+1, err)
+		}
+		var msg ChatMessage
+		if err := json.Unmarshal(frame.Body, &msg); err != nil {
+			t.Fatal(err)
+		}
+		msgs = append(msgs, &msg)
+	}
+	return msgs
+}
+
+// TestResumeSkipsInFlight 在途上限暂停后，ACK 触发的恢复投递只推送还没推送过的消息
+func TestResumeSkipsInFlight(t *testing.T) {
+	requireRedis(t)
+	offline := NewOfflineManager()
+	bob := offlineTestUser(t, offline)
+	for seq := int64(1); seq <= 4; seq++ {
+		storePrivate(t, offline, bob, "alice", seq)
+	}
+
+	h := NewMessageHandler("gateway_test", server.NewConnectionManager(), nil, nil, nil, offline, nil)
+	h.SetMaxInFlight(2)
+
+	srv, peer := net.Pipe()
+	conn := server.NewConnection(1, srv)
+	conn.SetUserID(bob)
+	conn.Start(func(*server.Connection, *protocol.Message) {})
+	defer conn.Close(server.CloseReasonShutdown)
+	defer peer.Close()
+	r := bufio.NewReader(peer)
+
+	// 达到上限后暂停：只推送前两条
+	if err := h.DeliverOfflineMessages(bob, conn); err != nil {
+		t.Fatal(err)
+	}
+	first := readDelivered(t, peer, r, 2)
+	if first[0].SeqID != 1 || first[1].SeqID != 2 {
+		t.Fatalf("first deliveries = %d, %d, want 1, 2", first[0].SeqID, first[1].SeqID)
+	}
+
+	// 选择性确认 2：1 仍在途，恢复投递应该跳过它，只推送 3（随后再次达到上限）
+	if err := h.HandleSelectiveAck(conn, []string{first[1].MsgID}); err != nil {
+		t.Fatal(err)
+	}
+	next := readDelivered(t, peer, r, 1)
+	if next[0].SeqID != 3 {
+		t.Fatalf("resumed delivery = seq %d, want 3 (seq 1 is still in flight)", next[0].SeqID)
+	}
+	deadline := time.Now().Add(time.Second)
+	for conn.InFlightCount() != 2 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if got := conn.InFlightCount(); got != 2 {
+		t.Fatalf("in-flight count = %d, want 2", got)
+	}
+}
+
+// TestDuplicateAckSkipsRedis 重复、回退和越界的 ACK 在访问 Redis 之前返回（处理器没有离线组件，访问即 panic）
+func TestDuplicateAckSkipsRedis(t *testing.T) {
+	h := NewMessageHandler("gateway_test", nil, nil, nil, nil, nil, nil)
+
+	srv, peer := net.Pipe()
+	conn := server.NewConnection(1, srv)
+	conn.SetUserID("bob")
+	defer conn.Close(server.CloseReasonShutdown)
+	defer peer.Close()
+
+	// 没有投递过消息：任何 ACK 都被截断为 0
+	if err := h.HandleAck(conn, 7); err != nil {
+		t.Fatalf("ack before any delivery: %v", err)
+	}
+
+	// 投递到 5，并且 5 已经确认过
+	conn.ReserveInFlight(5, "alice:bob:5", 0, nil)
+	conn.AdvanceAck(5)
+	for _, seq := range []int64{5, 3, 0, 99} {
+		if err := h.HandleAck(conn, seq); err != nil {
+			t.Fatalf("HandleAck(%d) = %v", seq, err)
+		}
+	}
+	if got := conn.InFlightCount(); got != 1 {
+		t.Fatalf("in-flight count = %d, want 1 (ignored acks release nothing)", got)
+	}
+}
+
+// TestWaitHandshakes 会话指向本网关但连接还没有注册：等待认证的投递在 WaitHandshakes 返回前完成
+func TestWaitHandshakes(t *testing.T) {
+	requireRedis(t)
+	offline := NewOfflineManager()
+	sessions := NewSessionManager("gateway_test")
+	h := NewMessageHandler("gateway_test", server.NewConnectionManager(), sessions, nil, nil, offline, nil)
+
+	bob := offlineTestUser(t, offline)
+	if err := sessions.Login(bob, 1); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		sessions.Logout(bob)
+		pkgredis.Client.Del(pkgredis.Context(), UserGatewaysKeyPrefix+bob)
+		pkgredis.Client.SRem(pkgredis.Context(), KnownUsersKey, bob)
+	})
+
+	h.HandlePubSubMessage(&PubSubMessage{
+		FromUserID: "alice",
+		ToUserID:   bob,
+		Content:    []byte("mid-handshake"),
+		MsgType:    MsgTypePrivate,
+		SeqID:      1,
+		Timestamp:  time.Now().UnixMilli(),
+	})
+
+	// 连接一直没有出现：等待结束后存入离线盒子
+	h.WaitHandshakes()
+	if got, want := boxIDs(t, offline, bob), []string{privateMessageID("alice", bob, 1)}; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("box after WaitHandshakes = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,219 @@
+/*
+Package service - 连接迁移（无缝切换网关）
+
+=== 使用场景 ===
+
+维护某个 Gateway 时，希望把用户从 gateway_1 平滑迁移到 gateway_2，
+用户侧不感知消息中断。
+
+=== 迁移流程 ===
+
+	Client            Gateway-1                 Gateway-2
+	  │                   │                         │
+	  │  CmdTypeMigrate   │                         │
+	  │◀──────────────────│ 1. 生成 handoff token    │
+	  │  (地址 + token)   │ 2. 开始缓冲新消息        │
+	  │                   │                         │
+	  │      CmdTypeAuth (handoff_token)            │
+	  │────────────────────────────────────────────▶│ 3. 校验 token，登录
+	  │                   │                         │    投递未 ACK 的离线消息
+	  │                   │  4. 缓冲窗口结束         │
+	  │                   │     Pub/Sub 转发缓冲消息 │
+	  │                   │────────────────────────▶│ 5. 本地投递（或存离线）
+	  │    关闭旧连接      │                         │
+	  │◀──────────────────│                         │
+
+=== 为什么需要缓冲？===
+
+客户端连上 Gateway-2 之前，其他用户的会话路由仍然指向 Gateway-1。
+这段时间到达的消息如果直接推送到即将关闭的旧连接，很可能丢失。
+缓冲后统一转发给 Gateway-2：
+- 用户已连上 Gateway-2：直接推送
+- 用户还没连上：Gateway-2 存入离线盒子，登录后投递
+两种情况都不会丢消息。
+
+=== Handoff Token ===
+
+一次性令牌，存储在 Redis：
+
+	Key:   handoff:<token>
+	Value: userID
+	TTL:   30 秒
+
+客户端用它在 Gateway-2 认证，无需重新获取 JWT。
+使用 GETDEL 读取并删除，保证只能使用一次。
+*/
+package service
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	pkgredis "go-im/pkg/redis"
+	"go-im/protocol"
+	"go-im/server"
+)
+
+// ==================== 常量定义 ====================
+
+const (
+	// HandoffKeyPrefix Handoff Token Key 前缀
+	// 完整 Key: handoff:<token>
+	HandoffKeyPrefix = "handoff:"
+
+	// HandoffTokenTTL Handoff Token 有效期
+	HandoffTokenTTL = 30 * time.Second
+
+	// MigrationBufferWindow 迁移缓冲窗口
+	// 窗口内到达的消息先缓冲，结束后统一转发到目标网关
+	MigrationBufferWindow = 3 * time.Second
+)
+
+// ErrInvalidHandoff Handoff Token 无效或已过期
+var ErrInvalidHandoff = errors.New("invalid or expired handoff token")
+
+// ==================== 结构体定义 ====================
+
+// MigrateInstruction 发给客户端的迁移指令
+type MigrateInstruction struct {
+	TargetGateway string `json:"target_gateway"` // 目标网关 ID
+	TargetAddr    string `json:"target_addr"`    // 目标网关地址
+	HandoffToken  string `json:"handoff_token"`  // 一次性认证令牌
+}
+
+// migration 迁移中的用户状态
+type migration struct {
+	targetGateway string         // 目标网关
+	buffer        []*ChatMessage // 缓冲窗口内到达的消息
+}
+
+// ==================== Handoff Token ====================
+
+// CreateHandoffToken 为用户生成一次性迁移令牌
+func CreateHandoffToken(userID string) (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(buf)
+
+	err := pkgredis.Client.Set(pkgredis.Context(), HandoffKeyPrefix+token, userID, HandoffTokenTTL).Err()
+	if err != nil {
+		return "", fmt.Errorf("failed to store handoff token: %w", err)
+	}
+	return token, nil
+}
+
+// ConsumeHandoffToken 校验并消费迁移令牌，返回对应的用户 ID
+// 令牌只能使用一次
+//
+// 令牌不存在或已过期时返回 ErrInvalidHandoff，其他错误表示 Redis 访问失败
+func ConsumeHandoffToken(token string) (string, error) {
+	userID, err := pkgredis.Client.GetDel(pkgredis.Context(), HandoffKeyPrefix+token).Result()
+	if err != nil {
+		if isNotFound(err) {
+			return "", ErrInvalidHandoff
+		}
+		return "", fmt.Errorf("failed to consume handoff token: %w", err)
+	}
+	if userID == "" {
+		return "", ErrInvalidHandoff
+	}
+	return userID, nil
+}
+
+// ==================== 迁移控制 ====================
+
+// MigrateUser 将本地用户迁移到目标网关
+//
+// 1. 生成 Handoff Token
+// 2. 开始缓冲该用户的新消息
+// 3. 向客户端发送 CmdTypeMigrate 指令
+// 4. 缓冲窗口结束后，把缓冲消息通过 Pub/Sub 转发给目标网关并关闭旧连接
+func (h *MessageHandler) MigrateUser(userID, targetGateway, targetAddr string) error {
+	conn := h.connManager.GetByUserID(userID)
+	if conn == nil {
+		return fmt.Errorf("user %s is not connected to this gateway", userID)
+	}
+
+	token, err := CreateHandoffToken(userID)
+	if err != nil {
+		return err
+	}
+
+	// 先开始缓冲，再通知客户端，避免指令发出后到达的消息被推送到旧连接
+	h.migrateMu.Lock()
+	if _, ok := h.migrations[userID]; ok {
+		h.migrateMu.Unlock()
+		return fmt.Errorf("user %s is already migrating", userID)
+	}
+	h.migrations[userID] = &migration{targetGateway: targetGateway}
+	h.migrateMu.Unlock()
+
+	data, _ := json.Marshal(&MigrateInstruction{
+		TargetGateway: targetGateway,
+		TargetAddr:    targetAddr,
+		HandoffToken:  token,
+	})
+	if err := conn.Send(&protocol.Message{
+		CmdType: protocol.CmdTypeMigrate,
+		Body:    data,
+	}); err != nil {
+		h.migrateMu.Lock()
+		delete(h.migrations, userID)
+		h.migrateMu.Unlock()
+		return err
+	}
+
+	log.Printf("[Migrate] Migrating user %s to gateway %s", userID, targetGateway)
+
+	time.AfterFunc(MigrationBufferWindow, func() {
+		h.finishMigration(userID)
+		conn.Close(server.CloseReasonKicked)
+	})
+	return nil
+}
+
+// bufferForMigration 如果用户正在迁移，缓冲消息并返回 true
+func (h *MessageHandler) bufferForMigration(userID string, msg *ChatMessage) bool {
+	h.migrateMu.Lock()
+	defer h.migrateMu.Unlock()
+
+	m, ok := h.migrations[userID]
+	if !ok {
+		return false
+	}
+	// 缓冲的消息稍后单独转发，不再属于扇出的合并批次（批次可能已经发布）
+	msg.remote = nil
+	m.buffer = append(m.buffer, msg)
+	return true
+}
+
+// finishMigration 结束迁移，将缓冲消息按到达顺序转发到目标网关
+//
+// 转发失败的消息存入离线盒子，保证不丢失
+func (h *MessageHandler) finishMigration(userID string) {
+	h.migrateMu.Lock()
+	m, ok := h.migrations[userID]
+	delete(h.migrations, userID)
+	h.migrateMu.Unlock()
+
+	if !ok {
+		return
+	}
+
+	for _, msg := range m.buffer {
+		if err := h.deliverRemote(m.targetGateway, msg); err != nil {
+			log.Printf("[Migrate] Failed to forward buffered message: %v", err)
+			h.storeOfflineMessage(msg)
+		}
+	}
+
+	log.Printf("[Migrate] Flushed %d buffered messages for user %s to gateway %s",
+		len(m.buffer), userID, m.targetGateway)
+}
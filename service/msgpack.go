@@ -0,0 +1,303 @@
+/*
+Package service - 离线消息的 MessagePack 编码
+
+=== 为什么不用 JSON？===
+
+JSON 里的 []byte 会被 base64 编码，体积膨胀约 1/3，
+二进制内容（图片缩略图、加密消息）存入离线盒子时尤其浪费。
+MessagePack 的 bin 类型按原始字节存储，没有这部分膨胀。
+
+=== 编码格式 ===
+
+只编码 OfflineMessage 一种结构，因此不引入通用的 msgpack 库，
+按固定字段顺序编码为一个数组（省去字段名）：
+
+	[from, to, content, msg_type, seq_id, timestamp, group_id, deliver_before]
+
+字段规则：
+  - 字符串使用 str 类型，Content 使用 bin 类型
+  - 整数使用 fixint 或 int64，Timestamp 编码为 UnixNano
+  - 解码时数组长度少于字段数时，缺失字段取零值；
+    多于字段数视为无法识别的新格式，返回错误
+*/
+package service
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// msgpackFieldCount OfflineMessage 编码的字段数
+const msgpackFieldCount = 8
+
+// errMsgpackShort 数据不完整
+var errMsgpackShort = errors.New("msgpack: unexpected end of data")
+
+// ==================== 编码 ====================
+
+// marshalMsgpack 将离线消息编码为 MessagePack 数组
+func marshalMsgpack(msg *OfflineMessage) []byte {
+	buf := make([]byte, 0, 64+len(msg.Content))
+	buf = append(buf, 0x90|msgpackFieldCount) // fixarray
+	buf = appendMsgpackString(buf, msg.FromUserID)
+	buf = appendMsgpackString(buf, msg.ToUserID)
+	buf = appendMsgpackBinary(buf, msg.Content)
+	buf = appendMsgpackInt(buf, int64(msg.MsgType))
+	buf = appendMsgpackInt(buf, msg.SeqID)
+	buf = appendMsgpackInt(buf, msg.Timestamp.UnixNano())
+	buf = appendMsgpackString(buf, msg.GroupID)
+	buf = appendMsgpackInt(buf, msg.DeliverBefore)
+	return buf
+}
+
+func appendMsgpackString(buf []byte, s string) []byte {
+	n := len(s)
+	switch {
+	case n < 32:
+		buf = append(buf, 0xa0|byte(n)) // fixstr
+	case n <= 0xff:
+		buf = append(buf, 0xd9, byte(n)) // str 8
+	case n <= 0xffff:
+		buf = append(buf, 0xda) // str 16
+		buf = binary.BigEndian.AppendUint16(buf, uint16(n))
+	default:
+		buf = append(buf, 0xdb) // str 32
+		buf = binary.BigEndian.AppendUint32(buf, uint32(n))
+	}
+	return append(buf, s...)
+}
+
+func appendMsgpackBinary(buf []byte, b []byte) []byte {
+	n := len(b)
+	switch {
+	case n <= 0xff:
+		buf = append(buf, 0xc4, byte(n)) // bin 8
+	case n <= 0xffff:
+		buf = append(buf, 0xc5) // bin 16
+		buf = binary.BigEndian.AppendUint16(buf, uint16(n))
+	default:
+		buf = append(buf, 0xc6) // bin 32
+		buf = binary.BigEndian.AppendUint32(buf, uint32(n))
+	}
+	return append(buf, b...)
+}
+
+func appendMsgpackInt(buf []byte, v int64) []byte {
+	switch {
+	case v >= 0 && v < 128:
+		return append(buf, byte(v)) // positive fixint
+	case v < 0 && v >= -32:
+		return append(buf, byte(v)) // negative fixint
+	default:
+		buf = append(buf, 0xd3) // int 64
+		return binary.BigEndian.AppendUint64(buf, uint64(v))
+	}
+}
+
+// ==================== 解码 ====================
+
+// msgpackReader 顺序读取 MessagePack 数据
+type msgpackReader struct {
+	data []byte
+	pos  int
+}
+
+// unmarshalMsgpack 解码 marshalMsgpack 生成的数据
+func unmarshalMsgpack(data []byte) (*OfflineMessage, error) {
+	r := &msgpackReader{data: data}
+
+	n, err := r.readArrayLen()
+	if err != nil {
+		return nil, err
+	}
+	if n > msgpackFieldCount {
+		return nil, fmt.Errorf("msgpack: unexpected field count %d", n)
+	}
+
+	var (
+		msg      OfflineMessage
+		msgType  int64
+		unixNano int64
+	)
+	fields := []func() error{
+		func() (err error) { msg.FromUserID, err = r.readString(); return },
+		func() (err error) { msg.ToUserID, err = r.readString(); return },
+		func() (err error) { msg.Content, err = r.readBinary(); return },
+		func() (err error) { msgType, err = r.readInt(); return },
+		func() (err error) { msg.SeqID, err = r.readInt(); return },
+		func() (err error) { unixNano, err = r.readInt(); return },
+		func() (err error) { msg.GroupID, err = r.readString(); return },
+		func() (err error) { msg.DeliverBefore, err = r.readInt(); return },
+	}
+	for _, read := range fields[:n] {
+		if err := read(); err != nil {
+			return nil, err
+		}
+	}
+
+	msg.MsgType = int(msgType)
+	if unixNano != 0 {
+		msg.Timestamp = time.Unix(0, unixNano)
+	}
+	return &msg, nil
+}
+
+func (r *msgpackReader) next(n int) ([]byte, error) {
+	if n < 0 || r.pos+n > len(r.data) {
+		return nil, errMsgpackShort
+	}
+	b := r.data[r.pos : r.pos+n]
+	r.pos += n
+	return b, nil
+}
+
+func (r *msgpackReader) readByte() (byte, error) {
+	b, err := r.next(1)
+	if err != nil {
+		return 0, err
+	}
+	return b[0], nil
+}
+
+// readLen 读取 1/2/4 字节的大端长度
+func (r *msgpackReader) readLen(size int) (int, error) {
+	b, err := r.next(size)
+	if err != nil {
+		return 0, err
+	}
+	switch size {
+	case 1:
+		return int(b[0]), nil
+	case 2:
+		return int(binary.BigEndian.Uint16(b)), nil
+	default:
+		return int(binary.BigEndian.Uint32(b)), nil
+	}
+}
+
+func (r *msgpackReader) readArrayLen() (int, error) {
+	c, err := r.readByte()
+	if err != nil {
+		return 0, err
+	}
+	switch {
+	case c&0xf0 == 0x90:
+		return int(c & 0x0f), nil
+	case c == 0xdc:
+		return r.readLen(2)
+	case c == 0xdd:
+		return r.readLen(4)
+	}
+	return 0, fmt.Errorf("msgpack: expected array, got 0x%02x", c)
+}
+
+func (r *msgpackReader) readString() (string, error) {
+	c, err := r.readByte()
+	if err != nil {
+		return "", err
+	}
+	var n int
+	switch {
+	case c&0xe0 == 0xa0:
+		n = int(c & 0x1f)
+	case c == 0xd9:
+		n, err = r.readLen(1)
+	case c == 0xda:
+		n, err = r.readLen(2)
+	case c == 0xdb:
+		n, err = r.readLen(4)
+	case c == 0xc0: // nil
+		return "", nil
+	default:
+		return "", fmt.Errorf("msgpack: expected string, got 0x%02x", c)
+	}
+	if err != nil {
+		return "", err
+	}
+	b, err := r.next(n)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+func (r *msgpackReader) readBinary() ([]byte, error) {
+	c, err := r.readByte()
+	if err != nil {
+		return nil, err
+	}
+	var n int
+	switch c {
+	case 0xc4:
+		n, err = r.readLen(1)
+	case 0xc5:
+		n, err = r.readLen(2)
+	case 0xc6:
+		n, err = r.readLen(4)
+	case 0xc0: // nil
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("msgpack: expected binary, got 0x%02x", c)
+	}
+	if err != nil {
+		return nil, err
+	}
+	b, err := r.next(n)
+	if err != nil {
+		return nil, err
+	}
+	// 拷贝一份，不持有整个成员的底层数组
+	return append([]byte(nil), b...), nil
+}
+
+func (r *msgpackReader) readInt() (int64, error) {
+	c, err := r.readByte()
+	if err != nil {
+		return 0, err
+	}
+	switch {
+	case c < 0x80: // positive fixint
+		return int64(c), nil
+	case c >= 0xe0: // negative fixint
+		return int64(int8(c)), nil
+	}
+
+	var size int
+	switch c {
+	case 0xcc, 0xd0:
+		size = 1
+	case 0xcd, 0xd1:
+		size = 2
+	case 0xce, 0xd2:
+		size = 4
+	case 0xcf, 0xd3:
+		size = 8
+	default:
+		return 0, fmt.Errorf("msgpack: expected integer, got 0x%02x", c)
+	}
+	b, err := r.next(size)
+	if err != nil {
+		return 0, err
+	}
+
+	switch c {
+	case 0xcc:
+		return int64(b[0]), nil
+	case 0xcd:
+		return int64(binary.BigEndian.Uint16(b)), nil
+	case 0xce:
+		return int64(binary.BigEndian.Uint32(b)), nil
+	case 0xcf:
+		return int64(binary.BigEndian.Uint64(b)), nil
+	case 0xd0:
+		return int64(int8(b[0])), nil
+	case 0xd1:
+		return int64(int16(binary.BigEndian.Uint16(b))), nil
+	case 0xd2:
+		return int64(int32(binary.BigEndian.Uint32(b))), nil
+	default:
+		return int64(binary.BigEndian.Uint64(b)), nil
+	}
+}
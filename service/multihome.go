@@ -0,0 +1,132 @@
+/*
+Package service - 多网关在线（多设备分布在不同网关）
+
+=== 问题 ===
+
+user_gateway:<userID> 只能指向一个网关。手机连在 gateway_1、电脑连在 gateway_2 时：
+
+	user_gateway:alice = gateway_2      （最后登录的设备）
+	消息只转发到 gateway_2，手机收不到
+
+=== 网关集合 ===
+
+每个用户额外维护一个集合，记录所有有该用户连接的网关：
+
+	Key: user_gateways:alice   (Set)
+	Members: gateway_1, gateway_2
+	TTL: 与会话相同，登录和心跳时续期
+
+- 登录、心跳时把本网关加入集合
+- 用户在本网关的最后一个连接登出时移出集合
+- 网关崩溃留下的成员：PUBLISH 没有订阅者时移除
+
+=== 路由 ===
+
+集合中有多个网关时，每个网关各投递一份（本网关直接推送，其他网关通过 Pub/Sub），
+由各网关投递给自己的连接。只要有一个网关接收了消息就不再存离线；
+都没有接收时存离线一次。
+
+同一条消息可能被多个设备各自 ACK，ACK 按 SeqID 删除离线/WAL 条目，重复 ACK 没有影响。
+*/
+package service
+
+import (
+	"errors"
+	"log"
+
+	pkgredis "go-im/pkg/redis"
+)
+
+// UserGatewaysKeyPrefix 用户所在网关集合 Key 前缀
+// 完整 Key: user_gateways:<userID>
+const UserGatewaysKeyPrefix = "user_gateways:"
+
+// ==================== 会话接入 ====================
+
+// joinGateway 把本网关加入用户的网关集合，并续期
+func (m *SessionManager) joinGateway(userID string) error {
+	key := UserGatewaysKeyPrefix + userID
+	pipe := pkgredis.Client.Pipeline()
+	pipe.SAdd(m.ctx, key, m.gatewayID)
+	pipe.Expire(m.ctx, key, m.ttl)
+	_, err := pipe.Exec(m.ctx)
+	return err
+}
+
+// LeaveGateway 用户在本网关已经没有连接，把本网关移出网关集合
+func (m *SessionManager) LeaveGateway(userID string) error {
+	return m.removeGateway(userID, m.gatewayID)
+}
+
+// removeGateway 把指定网关移出用户的网关集合
+func (m *SessionManager) removeGateway(userID, gatewayID string) error {
+	return pkgredis.Client.SRem(m.ctx, UserGatewaysKeyPrefix+userID, gatewayID).Err()
+}
+
+// GetUserGateways 获取所有有该用户连接的网关
+// 处于发送路径上，受 pkgredis.CriticalContext 的超时限制
+func (m *SessionManager) GetUserGateways(userID string) ([]string, error) {
+	ctx, cancel := pkgredis.CriticalContext()
+	defer cancel()
+	return pkgredis.Client.SMembers(ctx, UserGatewaysKeyPrefix+userID).Result()
+}
+
+// ==================== 路由 ====================
+
+// userGateways 合并网关集合与会话指向的网关（primary，可为空）
+// 查询失败时只返回 primary，退化为单网关路由
+func (h *MessageHandler) userGateways(userID, primary string) []string {
+	gateways, err := h.session.GetUserGateways(userID)
+	if err != nil {
+		log.Printf("[Message] Failed to look up gateways for user %s: %v", userID, err)
+		gateways = nil
+	}
+	if primary == "" {
+		return gateways
+	}
+	for _, gw := range gateways {
+		if gw == primary {
+			return gateways
+		}
+	}
+	return append(gateways, primary)
+}
+
+// deliverMultiHomed 向用户所在的每个网关各投递一份
+// 没有任何网关接收时存离线
+func (h *MessageHandler) deliverMultiHomed(gateways []string, msg *ChatMessage) error {
+	accepted := 0
+	for _, gw := range gateways {
+		if gw == h.gatewayID {
+			// 集合说用户在本网关，但连接可能已经断开（等待登出）
+			if conn := h.connManager.GetByUserID(msg.ToUserID); conn == nil || conn.IsClosed() {
+				continue
+			}
+			if err := h.deliverLocal(msg.ToUserID, msg); err != nil {
+				log.Printf("[Message] Failed to deliver to %s locally: %v", msg.ToUserID, err)
+				continue
+			}
+			accepted++
+			continue
+		}
+
+		err := h.pubsub.Publish(gw, msg.toPubSubMessage())
+		if errors.Is(err, ErrNoSubscriber) {
+			// 网关已经下线，清理残留的集合成员
+			log.Printf("[Message] Gateway %s has no subscriber, removing it from gateways of %s", gw, msg.ToUserID)
+			h.session.removeGateway(msg.ToUserID, gw)
+			continue
+		}
+		if err != nil {
+			log.Printf("[Message] Failed to route message to gateway %s: %v", gw, err)
+			continue
+		}
+		accepted++
+	}
+
+	if accepted == 0 {
+		return h.storeOfflineMessage(msg)
+	}
+	log.Printf("[Message] Delivered message for %s via %d gateways", msg.ToUserID, accepted)
+	return nil
+}
@@ -0,0 +1,143 @@
+/*
+Package service - NACK 重投
+
+=== 使用场景 ===
+
+弱网环境下客户端偶尔会收到损坏、无法解码的消息。
+ACK 只能表示"收到了"，客户端需要一种方式说"这条坏了，请重发"：
+
+	客户端                          Gateway
+	  │ ◀──── Message(seq=42) ──────── │
+	  │   解码失败                      │
+	  │ ───── Nack {"seq_id":42} ────▶ │  1. 先找连接上未确认的实时消息
+	  │                                │  2. 再找离线盒子
+	  │ ◀──── Message(seq=42) ──────── │  重投，计数 +1
+	  │   ...                          │
+	  │ ───── Nack {"seq_id":42} ────▶ │  超过 MaxRedeliveries：
+	  │ ◀──── Error(redelivery_limit) ─ │  放弃，记录日志和计数，消息记入死信（见 deadletter.go）
+
+- 计数按连接、按 SeqID 记录，该 SeqID 被 ACK 后清零
+- 重投不占用新的在途名额：消息本来就还没被确认
+- 不同会话的序列号互相独立，同一 SeqID 的多条消息会一起重投
+*/
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"time"
+
+	"go-im/protocol"
+	"go-im/server"
+)
+
+// MaxRedeliveries 同一条消息在一个连接上最多因 NACK 重投的次数
+const MaxRedeliveries = 3
+
+var (
+	// ErrMessageNotFound NACK 的消息已不在服务端（已确认、已过期或从未存在）
+	ErrMessageNotFound = errors.New("message not found")
+
+	// ErrRedeliveryLimit 重投次数已达上限
+	ErrRedeliveryLimit = errors.New("redelivery limit reached")
+)
+
+// HandleNack 处理客户端的否定确认，重新投递 SeqID 对应的消息
+//
+// 返回重投的消息数；超过 MaxRedeliveries 返回 ErrRedeliveryLimit，
+// 找不到消息返回 ErrMessageNotFound
+func (h *MessageHandler) HandleNack(conn *server.Connection, seqID int64) (int, error) {
+	userID := conn.GetUserID()
+
+	// SeqID 0 是即时通知（见 SendSystemEvent），服务端没有保存
+	if seqID == 0 {
+		return 0, ErrMessageNotFound
+	}
+
+	attempt := conn.CountRedelivery(seqID)
+	if attempt > MaxRedeliveries {
+		// 只在第一次超限时记录，客户端继续 NACK 也不会刷屏
+		if attempt == MaxRedeliveries+1 {
+			h.redeliveryGiveUps.Add(1)
+			log.Printf("[Message] Giving up redelivering seq %d to user %s after %d attempts",
+				seqID, userID, MaxRedeliveries)
+			h.deadLetterRedeliveries(conn, seqID)
+		}
+		return 0, ErrRedeliveryLimit
+	}
+
+	msgs, err := h.findForRedelivery(conn, seqID)
+	if err != nil {
+		return 0, err
+	}
+
+	now := time.Now()
+	sent := 0
+	for _, msg := range msgs {
+		if msg.deliveryExpired(now) {
+			continue
+		}
+		data, err := json.Marshal(msg.clientView())
+		if err != nil {
+			return sent, err
+		}
+		if err := conn.Send(&protocol.Message{
+			CmdType: cmdTypeFor(msg.MsgType),
+			Body:    data,
+		}); err != nil {
+			return sent, err
+		}
+		sent++
+	}
+	if sent == 0 {
+		return 0, ErrMessageNotFound
+	}
+
+	log.Printf("[Message] Redelivered seq %d to user %s (attempt %d/%d)", seqID, userID, attempt, MaxRedeliveries)
+	return sent, nil
+}
+
+// deadLetterRedeliveries 把放弃重投的消息记入死信
+// 消息本身仍按原来的方式等待 ACK 或过期，死信只是一份副本
+func (h *MessageHandler) deadLetterRedeliveries(conn *server.Connection, seqID int64) {
+	if h.deadLetters == nil {
+		return
+	}
+	msgs, err := h.findForRedelivery(conn, seqID)
+	if err != nil {
+		log.Printf("[Message] Failed to look up seq %d for dead letter: %v", seqID, err)
+		return
+	}
+	for _, msg := range msgs {
+		h.deadLetter(msg, DeadLetterRedeliveryLimit, ErrRedeliveryLimit)
+	}
+}
+
+// findForRedelivery 查找需要重投的消息
+// 实时投递的消息只在连接上，离线投递的消息仍在离线盒子中（ACK 之前不会删除）
+func (h *MessageHandler) findForRedelivery(conn *server.Connection, seqID int64) ([]*ChatMessage, error) {
+	var msgs []*ChatMessage
+	for _, p := range conn.PendingBySeq(seqID) {
+		if msg, ok := p.(*ChatMessage); ok {
+			msgs = append(msgs, msg)
+		}
+	}
+	if len(msgs) > 0 {
+		return msgs, nil
+	}
+
+	stored, err := h.offline.FetchSeq(conn.GetUserID(), seqID)
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range stored {
+		msgs = append(msgs, chatFromOffline(m))
+	}
+	return msgs, nil
+}
+
+// RedeliveryGiveUps 因重投次数达到上限而放弃的次数
+func (h *MessageHandler) RedeliveryGiveUps() int64 {
+	return h.redeliveryGiveUps.Load()
+}
@@ -1,240 +1,778 @@
-/*
-Package service - 离线消息服务
-
-=== 为什么需要离线消息存储？===
-
-用户不可能 24 小时在线，当用户离线时收到的消息需要：
-1. 临时存储在服务端
-2. 用户上线后推送给他
-3. 用户确认收到后删除
-
-=== Redis ZSet (有序集合) ===
-
-ZSet 是 Redis 的有序集合，每个元素有一个 Score 用于排序：
-
-	Key: msg_box:bob
-	┌─────────────────────────────────────┐
-	│  Score (SeqID)  │      Member       │
-	│─────────────────│───────────────────│
-	│       1         │  {"from":"alice"} │
-	│       2         │  {"from":"carol"} │
-	│       3         │  {"from":"alice"} │
-	│       4         │  {"from":"dave"}  │
-	└─────────────────────────────────────┘
-
-ZSet 的优势：
-- 自动按 Score (SeqID) 排序
-- O(log N) 的插入和查询
-- 支持范围查询（ZRANGEBYSCORE）
-- 支持反向查询（ZREVRANGE）
-
-=== 离线消息流程 ===
-
-1. Alice 给 Bob 发消息
-2. 检查 Bob 是否在线
-  - 在线：直接推送
-  - 离线：存入 msg_box:bob
-
-3. Bob 上线
-4. 拉取 msg_box:bob 中的消息
-5. Bob 发送 ACK
-6. 删除已确认的消息
-
-=== 消息拉取方式 ===
-
-1. ZRANGE: 从旧到新（按 SeqID 升序）
-  - 用于同步消息，确保顺序
-
-2. ZREVRANGE: 从新到旧（按 SeqID 降序）
-  - 用于"下拉加载历史"的 UI 交互
-*/
-package service
-
-import (
-	"context"
-	"encoding/json"
-	"fmt"
-	"log"
-	"time"
-
-	pkgredis "go-im/pkg/redis"
-
-	"github.com/redis/go-redis/v9"
-)
-
-// ==================== 常量定义 ====================
-
-const (
-	// OfflineBoxPrefix 离线消息盒子 Key 前缀
-	// 完整 Key: msg_box:bob
-	OfflineBoxPrefix = "msg_box:"
-
-	// MaxOfflineMessages 每个用户最多存储的离线消息数
-	// 超过此数量会删除最旧的消息
-	MaxOfflineMessages = 1000
-
-	// OfflineMessageTTL 离线消息过期时间
-	// 7 天后自动删除未读消息
-	OfflineMessageTTL = 7 * 24 * time.Hour
-)
-
-// ==================== 消息结构 ====================
-
-// OfflineMessage 离线消息结构
-type OfflineMessage struct {
-	FromUserID string    `json:"from_user_id"` // 发送者
-	ToUserID   string    `json:"to_user_id"`   // 接收者
-	Content    []byte    `json:"content"`      // 消息内容
-	MsgType    int       `json:"msg_type"`     // 消息类型
-	SeqID      int64     `json:"seq_id"`       // 序列号（用作 ZSet Score）
-	Timestamp  time.Time `json:"timestamp"`    // 发送时间
-}
-
-// ==================== 管理器结构 ====================
-
-// OfflineManager 离线消息管理器
-type OfflineManager struct {
-	ctx context.Context
-}
-
-// NewOfflineManager 创建离线消息管理器
-func NewOfflineManager() *OfflineManager {
-	return &OfflineManager{
-		ctx: pkgredis.Context(),
-	}
-}
-
-// ==================== 存储消息 ====================
-
-// Store 存储离线消息
-//
-// Redis 操作：
-// 1. ZADD msg_box:bob SeqID "消息JSON"
-// 2. ZREMRANGEBYRANK msg_box:bob 0 -(MaxOfflineMessages+1)  // 保留最新的 N 条
-// 3. EXPIRE msg_box:bob 604800  // 7天过期
-//
-// 参数:
-//   - userID: 接收者用户 ID
-//   - msg: 离线消息
-func (m *OfflineManager) Store(userID string, msg *OfflineMessage) error {
-	key := OfflineBoxPrefix + userID
-	msg.Timestamp = time.Now()
-
-	// 序列化消息为 JSON
-	data, err := json.Marshal(msg)
-	if err != nil {
-		return fmt.Errorf("failed to marshal message: %w", err)
-	}
-
-	// 添加到 ZSet
-	// Score = SeqID，用于排序
-	// Member = 消息 JSON
-	err = pkgredis.Client.ZAdd(m.ctx, key, redis.Z{
-		Score:  float64(msg.SeqID),
-		Member: string(data),
-	}).Err()
-	if err != nil {
-		return fmt.Errorf("failed to store offline message: %w", err)
-	}
-
-	// 限制消息数量（删除最旧的）
-	// ZREMRANGEBYRANK key 0 -(N+1) 保留最新的 N 条
-	pkgredis.Client.ZRemRangeByRank(m.ctx, key, 0, -MaxOfflineMessages-1)
-
-	// 设置过期时间
-	pkgredis.Client.Expire(m.ctx, key, OfflineMessageTTL)
-
-	log.Printf("[Offline] Stored message for user %s, seqID=%d", userID, msg.SeqID)
-	return nil
-}
-
-// ==================== 拉取消息 ====================
-
-// Fetch 按序列号范围拉取消息
-//
-// 使用 ZRANGEBYSCORE 查询：
-// - Min: 起始 SeqID
-// - Max: +inf（无上限）
-// - Offset: 0
-// - Count: 限制数量
-//
-// 返回的消息按 SeqID 升序排列（从旧到新）
-func (m *OfflineManager) Fetch(userID string, startSeq, count int64) ([]*OfflineMessage, error) {
-	key := OfflineBoxPrefix + userID
-
-	// ZRANGEBYSCORE: 按 Score 范围查询
-	results, err := pkgredis.Client.ZRangeByScore(m.ctx, key, &redis.ZRangeBy{
-		Min:    fmt.Sprintf("%d", startSeq),
-		Max:    "+inf",
-		Offset: 0,
-		Count:  count,
-	}).Result()
-	if err != nil {
-		return nil, fmt.Errorf("failed to fetch offline messages: %w", err)
-	}
-
-	// 反序列化
-	messages := make([]*OfflineMessage, 0, len(results))
-	for _, data := range results {
-		var msg OfflineMessage
-		if err := json.Unmarshal([]byte(data), &msg); err != nil {
-			log.Printf("[Offline] Failed to unmarshal message: %v", err)
-			continue
-		}
-		messages = append(messages, &msg)
-	}
-
-	return messages, nil
-}
-
-// FetchLatest 拉取最新的 N 条消息
-//
-// 使用 ZREVRANGE 查询（降序，从新到旧）
-// 适用于"下拉加载历史消息"的场景
-func (m *OfflineManager) FetchLatest(userID string, count int64) ([]*OfflineMessage, error) {
-	key := OfflineBoxPrefix + userID
-
-	// ZREVRANGE: 反向范围查询
-	// 0 到 count-1，返回最新的 count 条
-	results, err := pkgredis.Client.ZRevRange(m.ctx, key, 0, count-1).Result()
-	if err != nil {
-		return nil, fmt.Errorf("failed to fetch latest messages: %w", err)
-	}
-
-	messages := make([]*OfflineMessage, 0, len(results))
-	for _, data := range results {
-		var msg OfflineMessage
-		if err := json.Unmarshal([]byte(data), &msg); err != nil {
-			log.Printf("[Offline] Failed to unmarshal message: %v", err)
-			continue
-		}
-		messages = append(messages, &msg)
-	}
-
-	return messages, nil
-}
-
-// ==================== 删除消息（ACK 后）====================
-
-// Remove 删除已确认的消息
-//
-// 当客户端 ACK 某个 SeqID 时，删除该 SeqID 及之前的所有消息
-// 使用 ZREMRANGEBYSCORE 按 Score 范围删除
-func (m *OfflineManager) Remove(userID string, maxSeqID int64) error {
-	key := OfflineBoxPrefix + userID
-	return pkgredis.Client.ZRemRangeByScore(m.ctx, key, "-inf", fmt.Sprintf("%d", maxSeqID)).Err()
-}
-
-// ==================== 辅助方法 ====================
-
-// Count 获取离线消息数量
-func (m *OfflineManager) Count(userID string) (int64, error) {
-	key := OfflineBoxPrefix + userID
-	return pkgredis.Client.ZCard(m.ctx, key).Result()
-}
-
-// Clear 清空用户的所有离线消息
-func (m *OfflineManager) Clear(userID string) error {
-	key := OfflineBoxPrefix + userID
-	return pkgredis.Client.Del(m.ctx, key).Err()
-}
+/*
+Package service - 离线消息服务
+
+=== 为什么需要离线消息存储？===
+
+用户不可能 24 小时在线，当用户离线时收到的消息需要：
+1. 临时存储在服务端
+2. 用户上线后推送给他
+3. 用户确认收到后删除
+
+=== Redis ZSet (有序集合) ===
+
+ZSet 是 Redis 的有序集合，每个元素有一个 Score 用于排序：
+
+	Key: msg_box:bob
+	┌─────────────────────────────────────┐
+	│  Score (SeqID)  │      Member       │
+	│─────────────────│───────────────────│
+	│       1         │  {"from":"alice"} │
+	│       2         │  {"from":"carol"} │
+	│       3         │  {"from":"alice"} │
+	│       4         │  {"from":"dave"}  │
+	└─────────────────────────────────────┘
+
+ZSet 的优势：
+- 自动按 Score (SeqID) 排序
+- O(log N) 的插入和查询
+- 支持范围查询（ZRANGEBYSCORE）
+- 支持反向查询（ZREVRANGE）
+
+=== 离线消息流程 ===
+
+1. Alice 给 Bob 发消息
+2. 检查 Bob 是否在线
+  - 在线：直接推送
+  - 离线：存入 msg_box:bob
+
+3. Bob 上线
+4. 拉取 msg_box:bob 中的消息
+5. Bob 发送 ACK
+6. 删除已确认的消息
+
+=== 消息拉取方式 ===
+
+1. ZRANGE: 从旧到新（按 SeqID 升序）
+  - 用于同步消息，确保顺序
+
+2. ZREVRANGE: 从新到旧（按 SeqID 降序）
+  - 用于"下拉加载历史"的 UI 交互
+
+=== 压缩存储（可选）===
+
+每个用户最多 1000 条 JSON，用户量大时离线盒子很占 Redis 内存。
+开启压缩后，较大的消息以 gzip 压缩存储，用 CPU 换内存：
+
+	Member = 0x01 + gzip(消息JSON)     // 压缩
+	Member = {"from_user_id":...}      // 未压缩（以 '{' 开头）
+
+读取时根据首字节判断是否需要解压，因此开启/关闭压缩前后写入的
+消息可以混合存在。Score 仍是 SeqID，按 SeqID 删除不受影响。
+
+=== 序列化格式（可选）===
+
+默认 JSON；二进制内容较多时可以改用 MessagePack（见 msgpack.go），
+Content 按原始字节存储，没有 base64 膨胀：
+
+	Member = {"from_user_id":...}      // JSON
+	Member = 0x02 + msgpack            // MessagePack
+
+与压缩一样按首字节识别（压缩时先解压再识别），切换格式前后写入的消息可以混合存在。
+另外可以开启 AES-GCM 加密存储（见 encrypt.go），加密在最外层。
+
+=== 结构版本 ===
+
+离线消息会在 Redis 中保存 7 天，期间可能经历多次发布，
+OfflineMessage 的结构变化后，旧成员不能因为解析失败被直接丢弃。
+JSON 成员带有结构版本号 v（没有 v 的是加入版本号之前写入的，视为版本 1）：
+
+	{"v":2,"from_user_id":...}
+
+	读取时：
+	  v == OfflineSchemaVersion  ──▶ 直接解析
+	  v 有注册的解码器           ──▶ 解码器把旧结构迁移为当前结构
+	  v 比当前版本新（回滚部署）   ──▶ 按当前结构尽力解析，忽略不认识的字段
+
+结构再次变化时：OfflineSchemaVersion 加一，
+并用 RegisterOfflineDecoder 为上一个版本注册迁移函数。
+MessagePack 成员按数组长度兼容字段增减（见 msgpack.go），不使用版本号。
+*/
+package service
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strconv"
+	"time"
+
+	pkgredis "go-im/pkg/redis"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// ==================== 常量定义 ====================
+
+const (
+	// OfflineBoxPrefix 离线消息盒子 Key 前缀
+	// 完整 Key: msg_box:bob
+	OfflineBoxPrefix = "msg_box:"
+
+	// MaxOfflineMessages 默认每个用户最多存储的离线消息数（见 OfflineConfig）
+	// 超过此数量会删除最旧的消息
+	MaxOfflineMessages = 1000
+
+	// DefaultOfflineBatch 上线投递离线消息时每批拉取的条数
+	DefaultOfflineBatch = 100
+
+	// OfflineMessageTTL 默认的离线消息过期时间（见 OfflineConfig）
+	// 7 天后自动删除未读消息
+	OfflineMessageTTL = 7 * 24 * time.Hour
+
+	// OfflineCompressMinSize 开启压缩时，超过此大小的消息才压缩
+	// 太小的 JSON 压缩后反而可能变大
+	OfflineCompressMinSize = 256
+
+	// compressedMarker 压缩成员的首字节标记
+	// JSON 对象总是以 '{' 开头，不会与之冲突
+	compressedMarker = 0x01
+
+	// msgpackMarker MessagePack 编码的首字节标记
+	msgpackMarker = 0x02
+)
+
+// gzipMarked 压缩数据，结果以 compressedMarker 开头
+// 离线消息和 Pub/Sub 消息共用同一种格式
+func gzipMarked(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte(compressedMarker)
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(data); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// gunzipMarked 解压 gzipMarked 的结果（data 以 compressedMarker 开头）
+func gunzipMarked(data []byte) ([]byte, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(data[1:]))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	return io.ReadAll(zr)
+}
+
+// 离线消息序列化格式
+const (
+	OfflineFormatJSON    = "json"
+	OfflineFormatMsgpack = "msgpack"
+)
+
+// ErrUnknownOfflineFormat 不支持的序列化格式
+var ErrUnknownOfflineFormat = errors.New("unknown offline serialization format")
+
+// OfflineSchemaVersion 当前写入的 JSON 成员结构版本
+const OfflineSchemaVersion = 2
+
+// ==================== 消息结构 ====================
+
+// OfflineMessage 离线消息结构
+type OfflineMessage struct {
+	FromUserID string    `json:"from_user_id"`       // 发送者
+	ToUserID   string    `json:"to_user_id"`         // 接收者
+	Content    []byte    `json:"content"`            // 消息内容
+	MsgType    int       `json:"msg_type"`           // 消息类型
+	SeqID      int64     `json:"seq_id"`             // 序列号（用作 ZSet Score）
+	Timestamp  time.Time `json:"timestamp"`          // 发送时间
+	GroupID    string    `json:"group_id,omitempty"` // 群 ID（仅群聊消息）
+
+	DeliverBefore int64 `json:"deliver_before,omitempty"` // 投递截止时间（Unix 毫秒）
+}
+
+// versionedOfflineMessage 写入 Redis 的 JSON 结构：消息字段 + 结构版本号
+type versionedOfflineMessage struct {
+	Version int `json:"v"`
+	*OfflineMessage
+}
+
+// ==================== 版本解码器 ====================
+
+// OfflineDecoder 将某个旧版本的 JSON 成员解码并迁移为当前的 OfflineMessage
+type OfflineDecoder func(data []byte) (*OfflineMessage, error)
+
+// offlineDecoders 结构版本 → 解码器（不含当前版本）
+var offlineDecoders = map[int]OfflineDecoder{
+	1: decodeOfflineV1,
+}
+
+// RegisterOfflineDecoder 注册旧版本成员的解码器
+// 只应在初始化阶段调用（不是并发安全的）
+func RegisterOfflineDecoder(version int, dec OfflineDecoder) {
+	offlineDecoders[version] = dec
+}
+
+// decodeOfflineV1 版本 1：加入版本号之前的成员，字段与当前结构一致
+func decodeOfflineV1(data []byte) (*OfflineMessage, error) {
+	var msg OfflineMessage
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return nil, err
+	}
+	return &msg, nil
+}
+
+// ==================== 管理器结构 ====================
+
+// OfflineConfig 离线消息管理器配置
+type OfflineConfig struct {
+	// MaxMessages 每个用户最多存储的离线消息数（0 表示 MaxOfflineMessages）
+	MaxMessages int
+
+	// TTL 离线消息过期时间（0 表示 OfflineMessageTTL）
+	TTL time.Duration
+}
+
+// OfflineManager 离线消息管理器
+type OfflineManager struct {
+	ctx      context.Context
+	compress bool // 是否压缩存储
+	msgpack  bool // 是否使用 MessagePack 序列化
+
+	// cipher 加密存储（见 encrypt.go，nil 表示不加密）
+	cipher *offlineCipher
+
+	// expiryIndex 是否登记到全局过期索引（见 expiry.go）
+	expiryIndex bool
+
+	// shards 每个用户离线盒子的分片数（见 offline_shard.go，1 表示不分片）
+	shards int
+
+	// maxMsgs / ttl 每个用户最多存储的消息数和消息过期时间（见 OfflineConfig）
+	maxMsgs int
+	ttl     time.Duration
+}
+
+// NewOfflineManager 创建离线消息管理器
+func NewOfflineManager() *OfflineManager {
+	return NewOfflineManagerWithConfig(OfflineConfig{})
+}
+
+// NewOfflineManagerWithConfig 使用指定的数量上限和过期时间创建离线消息管理器
+func NewOfflineManagerWithConfig(cfg OfflineConfig) *OfflineManager {
+	m := &OfflineManager{
+		ctx:     pkgredis.Context(),
+		maxMsgs: cfg.MaxMessages,
+		ttl:     cfg.TTL,
+		shards:  1,
+	}
+	if m.maxMsgs <= 0 {
+		m.maxMsgs = MaxOfflineMessages
+	}
+	if m.ttl <= 0 {
+		m.ttl = OfflineMessageTTL
+	}
+	return m
+}
+
+// MaxMessages 每个用户最多存储的离线消息数
+func (m *OfflineManager) MaxMessages() int {
+	return m.maxMsgs
+}
+
+// TTL 离线消息过期时间
+func (m *OfflineManager) TTL() time.Duration {
+	return m.ttl
+}
+
+// SetCompression 开启或关闭离线消息的 gzip 压缩存储
+// 只影响之后写入的消息，已存储的消息读取时自动识别
+func (m *OfflineManager) SetCompression(enabled bool) {
+	m.compress = enabled
+}
+
+// SetFormat 设置离线消息的序列化格式（OfflineFormatJSON 或 OfflineFormatMsgpack）
+// 只影响之后写入的消息，已存储的消息读取时自动识别
+func (m *OfflineManager) SetFormat(format string) error {
+	switch format {
+	case OfflineFormatJSON, "":
+		m.msgpack = false
+	case OfflineFormatMsgpack:
+		m.msgpack = true
+	default:
+		return fmt.Errorf("%w: %q", ErrUnknownOfflineFormat, format)
+	}
+	return nil
+}
+
+// ==================== 存储消息 ====================
+
+// Store 存储离线消息
+//
+// Redis 操作：
+// 1. ZADD msg_box:bob SeqID "消息JSON"
+// 2. ZREMRANGEBYRANK msg_box:bob 0 -(MaxMessages+1)  // 保留最新的 N 条
+// 3. EXPIRE msg_box:bob 604800  // 7天过期
+//
+// 开启分片时写入 SeqID 对应的子 Key，数量上限按分片均摊（见 offline_shard.go）
+//
+// 参数:
+//   - userID: 接收者用户 ID
+//   - msg: 离线消息
+func (m *OfflineManager) Store(userID string, msg *OfflineMessage) error {
+	key := m.boxKey(userID, msg.SeqID)
+
+	// 优先保留消息原始发送时间；未设置时使用单调不回退的当前时间
+	if msg.Timestamp.IsZero() {
+		msg.Timestamp = wallNow()
+	}
+
+	// 序列化消息为 JSON（按配置压缩）
+	data, err := m.encodeMember(msg)
+	if err != nil {
+		return err
+	}
+
+	// 添加到 ZSet
+	// Score = SeqID，用于排序
+	// Member = 消息 JSON
+	err = pkgredis.Client.ZAdd(m.ctx, key, redis.Z{
+		Score:  float64(msg.SeqID),
+		Member: string(data),
+	}).Err()
+	if err != nil {
+		return fmt.Errorf("failed to store offline message: %w", err)
+	}
+
+	// 限制消息数量（删除最旧的）
+	// ZREMRANGEBYRANK key 0 -(N+1) 保留最新的 N 条
+	pkgredis.Client.ZRemRangeByRank(m.ctx, key, 0, -m.shardCap()-1)
+
+	// 设置过期时间
+	pkgredis.Client.Expire(m.ctx, key, m.ttl)
+
+	// 登记逐条过期时间（开启过期索引时）
+	if m.expiryIndex {
+		pipe := pkgredis.Client.Pipeline()
+		m.indexExpiry(pipe, userID, msg)
+		if _, err := pipe.Exec(m.ctx); err != nil {
+			log.Printf("[Offline] Failed to index expiry for %s: %v", userID, err)
+		}
+	}
+
+	log.Printf("[Offline] Stored message for user %s, seqID=%d", userID, msg.SeqID)
+	return nil
+}
+
+// ==================== 拉取消息 ====================
+
+// Fetch 按序列号范围拉取消息
+//
+// 使用 ZRANGEBYSCORE 查询：
+// - Min: 起始 SeqID
+// - Max: +inf（无上限）
+// - Offset: 0
+// - Count: 限制数量
+//
+// 返回的消息按 SeqID 升序排列（从旧到新）
+// 开启分片时每个子 Key 各取 min(count, 子 Key 上限) 条，合并后取前 count 条
+func (m *OfflineManager) Fetch(userID string, startSeq, count int64) ([]*OfflineMessage, error) {
+	perKey := count
+	if m.shards > 1 && count > 0 {
+		perKey = min(count, m.shardCap())
+	}
+	// ZRANGEBYSCORE: 按 Score 范围查询
+	results, err := m.rangeMembers(userID, func(pipe redis.Pipeliner, key string) *redis.ZSliceCmd {
+		return pipe.ZRangeByScoreWithScores(m.ctx, key, &redis.ZRangeBy{
+			Min:    fmt.Sprintf("%d", startSeq),
+			Max:    "+inf",
+			Offset: 0,
+			Count:  perKey,
+		})
+	}, false, count)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch offline messages: %w", err)
+	}
+
+	// 反序列化
+	return m.decodeMessages(results), nil
+}
+
+// FetchSeq 拉取 SeqID 等于 seqID 的消息
+// 不同会话的序列号互相独立，同一个 SeqID 可能对应多条消息
+func (m *OfflineManager) FetchSeq(userID string, seqID int64) ([]*OfflineMessage, error) {
+	score := fmt.Sprintf("%d", seqID)
+	results, err := pkgredis.Client.ZRangeByScore(m.ctx, m.boxKey(userID, seqID), &redis.ZRangeBy{
+		Min: score,
+		Max: score,
+	}).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch offline message: %w", err)
+	}
+	return m.decodeMessages(results), nil
+}
+
+// FetchLatest 拉取最新的 N 条消息
+//
+// 使用 ZREVRANGE 查询（降序，从新到旧）
+// 适用于"下拉加载历史消息"的场景
+func (m *OfflineManager) FetchLatest(userID string, count int64) ([]*OfflineMessage, error) {
+	// ZREVRANGE: 反向范围查询
+	// 0 到 count-1，返回最新的 count 条
+	results, err := m.revRange(userID, 0, count-1)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch latest messages: %w", err)
+	}
+
+	return m.decodeMessages(results), nil
+}
+
+// FetchSinceTime 拉取指定时间之后的消息（最多 limit 条）
+//
+// 适用于客户端丢失了最后的 SeqID（重装、清缓存）但仍想看最近消息的场景
+//
+// === 实现取舍 ===
+//
+// ZSet 的 Score 是 SeqID 而不是时间，有两种做法：
+//
+//  1. 维护一个按时间打分的平行索引 ZSet
+//     - 查询快（ZRANGEBYSCORE 直接命中）
+//     - 但每次写入/删除都要维护两份数据，ACK 删除也要同步，容易不一致
+//
+//  2. 读出整个盒子后在内存中过滤 Timestamp（本项目采用）
+//     - 无额外存储，不影响 Store/Remove 逻辑
+//     - 盒子最多 MaxMessages 条，扫描成本有上限
+//
+// SeqID 只在会话内递增，不同会话的 SeqID 与时间没有先后关系
+// （老会话的 SeqID 可能远大于新会话），因此不能按 SeqID 提前停止，必须扫描整个盒子
+//
+// 代价：每次调用都读出并解码整个盒子（解密、解压），与 limit 无关，
+// 成本是 O(盒子大小)，最坏为 MaxMessages 条。
+// 只适合恢复这类低频操作，不要放在每次连接或每条消息的路径上
+//
+// 返回的消息按时间从旧到新排列，时间相同时保持 SeqID 升序；超过 limit 时保留最新的 limit 条
+func (m *OfflineManager) FetchSinceTime(userID string, since time.Time, limit int64) ([]*OfflineMessage, error) {
+	results, err := m.allMembers(userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch messages since time: %w", err)
+	}
+
+	var matched []*OfflineMessage
+	for _, msg := range m.decodeMessages(results) {
+		if msg.Timestamp.After(since) {
+			matched = append(matched, msg)
+		}
+	}
+
+	sort.SliceStable(matched, func(i, j int) bool {
+		return matched[i].Timestamp.Before(matched[j].Timestamp)
+	})
+	if limit > 0 && int64(len(matched)) > limit {
+		matched = matched[int64(len(matched))-limit:]
+	}
+	return matched, nil
+}
+
+// encodeMember 将离线消息编码为 ZSet 成员
+func (m *OfflineManager) encodeMember(msg *OfflineMessage) ([]byte, error) {
+	var data []byte
+	if m.msgpack {
+		data = append([]byte{msgpackMarker}, marshalMsgpack(msg)...)
+	} else {
+		var err error
+		if data, err = json.Marshal(&versionedOfflineMessage{OfflineSchemaVersion, msg}); err != nil {
+			return nil, fmt.Errorf("failed to marshal message: %w", err)
+		}
+	}
+	if m.compress && len(data) >= OfflineCompressMinSize {
+		var err error
+		if data, err = gzipMarked(data); err != nil {
+			return nil, fmt.Errorf("failed to compress message: %w", err)
+		}
+	}
+
+	// 加密在最外层：先压缩再加密（密文不可压缩）
+	if m.cipher != nil {
+		return m.cipher.seal(data)
+	}
+	return data, nil
+}
+
+// decodeMember 解码 ZSet 成员，自动识别加密、压缩和序列化格式
+func (m *OfflineManager) decodeMember(member string) (*OfflineMessage, error) {
+	data := []byte(member)
+	if len(data) > 0 && data[0] == encryptedMarker {
+		var err error
+		if data, err = m.cipher.open(data[1:]); err != nil {
+			return nil, fmt.Errorf("failed to decrypt message: %w", err)
+		}
+	}
+	if len(data) > 0 && data[0] == compressedMarker {
+		var err error
+		if data, err = gunzipMarked(data); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(data) > 0 && data[0] == msgpackMarker {
+		return unmarshalMsgpack(data[1:])
+	}
+
+	var header struct {
+		Version int `json:"v"`
+	}
+	if err := json.Unmarshal(data, &header); err != nil {
+		return nil, err
+	}
+	if header.Version == 0 {
+		header.Version = 1
+	}
+	if header.Version != OfflineSchemaVersion {
+		if dec, ok := offlineDecoders[header.Version]; ok {
+			return dec(data)
+		}
+		if header.Version < OfflineSchemaVersion {
+			return nil, fmt.Errorf("no decoder for offline schema version %d", header.Version)
+		}
+	}
+
+	var msg OfflineMessage
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return nil, err
+	}
+	return &msg, nil
+}
+
+// decodeMessages 将 ZSet 成员反序列化为离线消息
+// 无法解析的成员会被记录日志并跳过
+func (m *OfflineManager) decodeMessages(results []string) []*OfflineMessage {
+	messages := make([]*OfflineMessage, 0, len(results))
+	for _, data := range results {
+		msg, err := m.decodeMember(data)
+		if err != nil {
+			log.Printf("[Offline] Failed to unmarshal message: %v", err)
+			continue
+		}
+		messages = append(messages, msg)
+	}
+	return messages
+}
+
+// ==================== 删除消息（ACK 后）====================
+
+// Remove 删除已确认的消息
+//
+// 当客户端 ACK 某个 SeqID 时，删除该 SeqID 及之前的所有消息
+// 使用 ZREMRANGEBYSCORE 按 Score 范围删除
+//
+// 同时删除这些消息的认领（见 claim.go）
+func (m *OfflineManager) Remove(userID string, maxSeqID int64) error {
+	pipe := pkgredis.Client.Pipeline()
+	for _, key := range m.boxKeys(userID) {
+		pipe.ZRemRangeByScore(m.ctx, key, "-inf", fmt.Sprintf("%d", maxSeqID))
+	}
+	if _, err := pipe.Exec(m.ctx); err != nil {
+		return err
+	}
+	return m.releaseClaimsUpTo(userID, maxSeqID)
+}
+
+// RemoveMessages 精确删除指定的消息（选择性确认、过期丢弃）
+//
+// 与 Remove 的累积删除不同，这里只删除列出的消息，
+// 中间未确认的消息保持不动，适用于客户端乱序收到消息的场景
+//
+// 消息用消息 ID（见 MessageID）标识：SeqID 只在会话内唯一，
+// 同一个盒子里不同会话的消息可能有相同的 SeqID，不能按 Score 删除。
+// 先按 SeqID 读出候选成员（Pipeline 一次往返），解码后比对消息 ID，
+// 再用 ZREM 删除匹配的成员（第二次往返）
+func (m *OfflineManager) RemoveMessages(userID string, msgIDs []string) error {
+	wanted := make(map[string]bool, len(msgIDs))
+	var seqs []int64
+	for _, id := range msgIDs {
+		_, seq, ok := parseMessageID(id)
+		if !ok || wanted[id] {
+			continue
+		}
+		wanted[id] = true
+		seqs = append(seqs, seq)
+	}
+	if len(seqs) == 0 {
+		return nil
+	}
+
+	pipe := pkgredis.Client.Pipeline()
+	cmds := make(map[int64]*redis.StringSliceCmd, len(seqs))
+	for _, seq := range seqs {
+		if cmds[seq] == nil {
+			score := strconv.FormatInt(seq, 10)
+			cmds[seq] = pipe.ZRangeByScore(m.ctx, m.boxKey(userID, seq), &redis.ZRangeBy{Min: score, Max: score})
+		}
+	}
+	if _, err := pipe.Exec(m.ctx); err != nil {
+		return fmt.Errorf("failed to read offline messages: %w", err)
+	}
+
+	pipe = pkgredis.Client.Pipeline()
+	var removed []string
+	for seq, cmd := range cmds {
+		var members []interface{}
+		for _, member := range cmd.Val() {
+			msg, err := m.decodeMember(member)
+			if err != nil {
+				continue
+			}
+			if id := msg.messageID(); wanted[id] {
+				members = append(members, member)
+				removed = append(removed, id)
+			}
+		}
+		if len(members) > 0 {
+			pipe.ZRem(m.ctx, m.boxKey(userID, seq), members...)
+		}
+	}
+	if len(removed) == 0 {
+		return nil
+	}
+	pipe.HDel(m.ctx, OfflineClaimKeyPrefix+userID, removed...)
+	if _, err := pipe.Exec(m.ctx); err != nil {
+		return fmt.Errorf("failed to remove offline messages: %w", err)
+	}
+	return nil
+}
+
+// ==================== 导出/导入 ====================
+
+// Export 按 SeqID 升序导出用户的全部离线消息
+// 用于在 Redis 实例之间迁移用户，或为调试保存快照
+func (m *OfflineManager) Export(userID string) ([]*OfflineMessage, error) {
+	results, err := m.allMembers(userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to export offline messages: %w", err)
+	}
+	return m.decodeMessages(results), nil
+}
+
+// Import 将导出的消息写回用户的离线盒子
+//
+// 导入是幂等的：按 offlineIdentity 去重，盒子中已有的消息和同一次导入中重复的消息都会跳过，
+// 重复导入同一份数据不会产生重复消息（即使编码后的字节不同，例如压缩设置不同）
+// SeqID 只在会话内唯一，不能按 SeqID 去重，否则会删掉其他会话中 SeqID 相同的消息
+//
+// 所有写入在一个 Pipeline 中完成，最后同样执行数量限制和过期设置
+func (m *OfflineManager) Import(userID string, msgs []*OfflineMessage) error {
+	if len(msgs) == 0 {
+		return nil
+	}
+
+	existing, err := m.allMembers(userID)
+	if err != nil {
+		return fmt.Errorf("failed to import offline messages: %w", err)
+	}
+	seen := make(map[string]bool, len(existing)+len(msgs))
+	for _, msg := range m.decodeMessages(existing) {
+		seen[offlineIdentity(msg)] = true
+	}
+
+	pipe := pkgredis.Client.Pipeline()
+	touched := make(map[string]bool)
+	imported := 0
+	for _, msg := range msgs {
+		id := offlineIdentity(msg)
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+
+		data, err := m.encodeMember(msg)
+		if err != nil {
+			return err
+		}
+		key := m.boxKey(userID, msg.SeqID)
+		touched[key] = true
+		imported++
+		pipe.ZAdd(m.ctx, key, redis.Z{
+			Score:  float64(msg.SeqID),
+			Member: string(data),
+		})
+		m.indexExpiry(pipe, userID, msg)
+	}
+	if imported == 0 {
+		return nil
+	}
+	for key := range touched {
+		pipe.ZRemRangeByRank(m.ctx, key, 0, -m.shardCap()-1)
+		pipe.Expire(m.ctx, key, m.ttl)
+	}
+
+	if _, err := pipe.Exec(m.ctx); err != nil {
+		return fmt.Errorf("failed to import offline messages: %w", err)
+	}
+
+	log.Printf("[Offline] Imported %d messages for user %s (%d already present)", imported, userID, len(msgs)-imported)
+	return nil
+}
+
+// ==================== 辅助方法 ====================
+
+// Count 获取离线消息数量
+func (m *OfflineManager) Count(userID string) (int64, error) {
+	keys := m.boxKeys(userID)
+	if len(keys) == 1 {
+		return pkgredis.Client.ZCard(m.ctx, keys[0]).Result()
+	}
+
+	pipe := pkgredis.Client.Pipeline()
+	cmds := make([]*redis.IntCmd, len(keys))
+	for i, key := range keys {
+		cmds[i] = pipe.ZCard(m.ctx, key)
+	}
+	if _, err := pipe.Exec(m.ctx); err != nil {
+		return 0, err
+	}
+	var total int64
+	for _, cmd := range cmds {
+		total += cmd.Val()
+	}
+	return total, nil
+}
+
+// CountFrom 统计离线盒子中来自某个发送者的消息数
+//
+// 离线盒子没有按发送者的索引，需要读取并解码整个盒子；
+// 盒子最多 MaxMessages 条，扫描成本有上限，只用于低频查询
+func (m *OfflineManager) CountFrom(userID, fromUserID string) (int, error) {
+	msgs, err := m.scanFrom(userID, fromUserID)
+	return len(msgs), err
+}
+
+// MaxSeqFrom 用户离线盒子中某个发送者私聊消息的最大 SeqID（没有时为 0）
+// 与 CountFrom 一样需要扫描整个盒子
+func (m *OfflineManager) MaxSeqFrom(userID, fromUserID string) (int64, error) {
+	msgs, err := m.scanFrom(userID, fromUserID)
+	var max int64
+	for _, msg := range msgs {
+		if msg.GroupID == "" && msg.SeqID > max {
+			max = msg.SeqID
+		}
+	}
+	return max, err
+}
+
+// scanFrom 扫描整个离线盒子，返回某个发送者的消息
+func (m *OfflineManager) scanFrom(userID, fromUserID string) ([]*OfflineMessage, error) {
+	results, err := m.allMembers(userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan offline box: %w", err)
+	}
+	var msgs []*OfflineMessage
+	for _, msg := range m.decodeMessages(results) {
+		if msg.FromUserID == fromUserID {
+			msgs = append(msgs, msg)
+		}
+	}
+	return msgs, nil
+}
+
+// Clear 清空用户的所有离线消息
+func (m *OfflineManager) Clear(userID string) error {
+	return pkgredis.Client.Del(m.ctx, m.boxKeys(userID)...).Err()
+}
@@ -0,0 +1,148 @@
+/*
+Package service - 离线盒子分片
+
+=== 为什么分片？===
+
+大多数用户的离线盒子只有几条消息，但个别"大户"（客服账号、机器人、
+被大量用户关注的账号）持续收到消息，msg_box:<userID> 成为热 Key：
+所有写入、拉取和 ACK 删除都落在同一个 Key（同一个 Redis 分片）上，
+且单个 ZSet 可能很大。
+
+开启分片（-offline-shards N，N > 1）后，消息按 SeqID 取模分散到 N 个子 Key：
+
+	msg_box:bob:0   SeqID % N == 0 的消息
+	msg_box:bob:1   SeqID % N == 1 的消息
+	...
+	msg_box:bob:N-1
+
+各操作的处理方式：
+
+  - 写入、按 SeqID 删除只访问一个子 Key
+  - 范围拉取（Fetch/FetchLatest/Export）在每个子 Key 上各取一段，按 SeqID 合并，
+    结果的顺序与不分片时一致（同一个 SeqID 总是落在同一个子 Key 中）；
+    拉取 count 条时每个子 Key 最多读 min(count, 子 Key 上限) 条，合并后丢掉多余的，
+    即最多读出 N 倍的数据，分片数不宜过大
+  - 累积删除（Remove）和清空在所有子 Key 上执行（一次 Pipeline）
+  - 数量上限按分片均摊：每个子 Key 最多保留 MaxMessages/N 条（向上取整）
+
+N = 1（默认）时仍使用 msg_box:<userID>，与不分片完全相同。
+
+分片数需要在部署时确定：修改分片数后，按旧分片数写入的消息不会再被读取，
+需要先用旧配置 Export、新配置 Import 迁移。
+*/
+package service
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+
+	pkgredis "go-im/pkg/redis"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// SetShards 设置每个用户离线盒子的分片数，n <= 1 表示不分片
+func (m *OfflineManager) SetShards(n int) {
+	m.shards = max(n, 1)
+}
+
+// boxKey 存放 seqID 这条消息的 Key
+func (m *OfflineManager) boxKey(userID string, seqID int64) string {
+	if m.shards <= 1 {
+		return OfflineBoxPrefix + userID
+	}
+	// 兜底序号为负数，取模结果调整到 [0, N)
+	shard := seqID % int64(m.shards)
+	if shard < 0 {
+		shard += int64(m.shards)
+	}
+	return OfflineBoxPrefix + userID + ":" + strconv.FormatInt(shard, 10)
+}
+
+// boxKeys 用户离线盒子的所有 Key
+func (m *OfflineManager) boxKeys(userID string) []string {
+	if m.shards <= 1 {
+		return []string{OfflineBoxPrefix + userID}
+	}
+	keys := make([]string, m.shards)
+	for i := range keys {
+		keys[i] = OfflineBoxPrefix + userID + ":" + strconv.Itoa(i)
+	}
+	return keys
+}
+
+// shardCap 每个 Key 最多保留的消息数
+func (m *OfflineManager) shardCap() int64 {
+	n := int64(max(m.shards, 1))
+	return (int64(m.maxMsgs) + n - 1) / n
+}
+
+// rangeMembers 在每个 Key 上执行 query，按 Score 合并成员
+//
+// desc 为 true 时从高到低；limit > 0 时只保留前 limit 条
+// Score 相同的成员来自同一个 Key，保持 Redis 返回的顺序
+func (m *OfflineManager) rangeMembers(userID string, query func(pipe redis.Pipeliner, key string) *redis.ZSliceCmd,
+	desc bool, limit int64) ([]string, error) {
+	keys := m.boxKeys(userID)
+	pipe := pkgredis.Client.Pipeline()
+	cmds := make([]*redis.ZSliceCmd, len(keys))
+	for i, key := range keys {
+		cmds[i] = query(pipe, key)
+	}
+	if _, err := pipe.Exec(m.ctx); err != nil && !errors.Is(err, redis.Nil) {
+		return nil, err
+	}
+
+	var merged []redis.Z
+	for _, cmd := range cmds {
+		merged = append(merged, cmd.Val()...)
+	}
+	if len(keys) > 1 {
+		sort.SliceStable(merged, func(i, j int) bool {
+			if desc {
+				return merged[i].Score > merged[j].Score
+			}
+			return merged[i].Score < merged[j].Score
+		})
+	}
+	if limit > 0 && int64(len(merged)) > limit {
+		merged = merged[:limit]
+	}
+
+	members := make([]string, len(merged))
+	for i, z := range merged {
+		members[i], _ = z.Member.(string)
+	}
+	return members, nil
+}
+
+// revRange 按 SeqID 从新到旧的第 start 到 stop 条（含），与 ZREVRANGE 相同
+//
+// 事先不知道最新的 stop+1 条落在哪些子 Key 上，每个子 Key 都要取前 stop+1 条，
+// 合并后丢掉多余的：N 个分片最多读出 N×(stop+1) 条。
+// 每个子 Key 最多保留 shardCap 条，单个子 Key 的读取量以此为上限，
+// 总读取量不超过 min(N×(stop+1), MaxMessages+N)
+func (m *OfflineManager) revRange(userID string, start, stop int64) ([]string, error) {
+	perKey := stop
+	if m.shards > 1 {
+		perKey = min(stop, m.shardCap()-1)
+	}
+	members, err := m.rangeMembers(userID, func(pipe redis.Pipeliner, key string) *redis.ZSliceCmd {
+		return pipe.ZRevRangeWithScores(m.ctx, key, 0, perKey)
+	}, true, stop+1)
+	if err != nil {
+		return nil, err
+	}
+	if start >= int64(len(members)) {
+		return nil, nil
+	}
+	return members[start:], nil
+}
+
+// allMembers 按 SeqID 升序返回盒子中的所有成员
+func (m *OfflineManager) allMembers(userID string) ([]string, error) {
+	return m.rangeMembers(userID, func(pipe redis.Pipeliner, key string) *redis.ZSliceCmd {
+		return pipe.ZRangeWithScores(m.ctx, key, 0, -1)
+	}, false, 0)
+}
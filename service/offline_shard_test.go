@@ -0,0 +1,171 @@
+package service
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+// offlineIDs 消息 ID（保持顺序）
+func offlineIDs(msgs []*OfflineMessage) []string {
+	ids := make([]string, len(msgs))
+	for i, msg := range msgs {
+		ids[i] = msg.messageID()
+	}
+	return ids
+}
+
+// seqOrder 只保留顺序中的 SeqID：同一个 SeqID 的多条消息之间没有顺序保证
+func seqOrder(msgs []*OfflineMessage) []int64 {
+	seqs := make([]int64, len(msgs))
+	for i, msg := range msgs {
+		seqs[i] = msg.SeqID
+	}
+	return seqs
+}
+
+func TestShardedBoxMatchesUnsharded(t *testing.T) {
+	requireRedis(t)
+	plain := NewOfflineManager()
+	sharded := NewOfflineManager()
+	sharded.SetShards(4)
+	plainUser := offlineTestUser(t, plain)
+	shardedUser := offlineTestUser(t, sharded)
+
+	// 两个会话的 SeqID 部分重叠，包括兜底的负序号
+	store := func(from string, seq int64) {
+		storePrivate(t, plain, plainUser, from, seq)
+		storePrivate(t, sharded, shardedUser, from, seq)
+	}
+	for seq := int64(1); seq <= 12; seq++ {
+		store("alice", seq)
+	}
+	for _, seq := range []int64{-2, 3, 5, 8, 13} {
+		store("carol", seq)
+	}
+
+	// 两个盒子中的消息 ID 相同（接收者不同，按发送者和 SeqID 比较）
+	key := func(msgs []*OfflineMessage) []string {
+		keys := make([]string, len(msgs))
+		for i, msg := range msgs {
+			keys[i] = fmt.Sprintf("%s:%d", msg.FromUserID, msg.SeqID)
+		}
+		return sorted(keys...)
+	}
+	compare := func(step string, got, want []*OfflineMessage) {
+		t.Helper()
+		if !reflect.DeepEqual(seqOrder(got), seqOrder(want)) {
+			t.Errorf("%s: sharded seqs %v, unsharded %v", step, seqOrder(got), seqOrder(want))
+		}
+		if !reflect.DeepEqual(key(got), key(want)) {
+			t.Errorf("%s: sharded %v, unsharded %v", step, key(got), key(want))
+		}
+	}
+	check := func(step string) {
+		t.Helper()
+		for _, c := range []struct{ start, count int64 }{{-100, 5}, {3, 4}, {8, 100}, {14, 5}} {
+			got, err := sharded.Fetch(shardedUser, c.start, c.count)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want, err := plain.Fetch(plainUser, c.start, c.count)
+			if err != nil {
+				t.Fatal(err)
+			}
+			compare(fmt.Sprintf("%s Fetch(%d, %d)", step, c.start, c.count), got, want)
+		}
+		for _, n := range []int64{1, 3, 50} {
+			got, err := sharded.FetchLatest(shardedUser, n)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want, err := plain.FetchLatest(plainUser, n)
+			if err != nil {
+				t.Fatal(err)
+			}
+			compare(fmt.Sprintf("%s FetchLatest(%d)", step, n), got, want)
+		}
+		got, err := sharded.Export(shardedUser)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want, err := plain.Export(plainUser)
+		if err != nil {
+			t.Fatal(err)
+		}
+		compare(step+" Export", got, want)
+	}
+	check("stored")
+
+	// 选择性删除：两边删除同一个会话中的同一批 SeqID
+	remove := func(from string, seqs ...int64) {
+		var plainIDs, shardedIDs []string
+		for _, seq := range seqs {
+			plainIDs = append(plainIDs, MessageID(getConversationID(from, plainUser), seq))
+			shardedIDs = append(shardedIDs, MessageID(getConversationID(from, shardedUser), seq))
+		}
+		if err := plain.RemoveMessages(plainUser, plainIDs); err != nil {
+			t.Fatal(err)
+		}
+		if err := sharded.RemoveMessages(shardedUser, shardedIDs); err != nil {
+			t.Fatal(err)
+		}
+	}
+	remove("alice", 3, 4, 9)
+	remove("carol", -2, 8)
+	check("after RemoveMessages")
+
+	// 累积删除
+	if err := plain.Remove(plainUser, 5); err != nil {
+		t.Fatal(err)
+	}
+	if err := sharded.Remove(shardedUser, 5); err != nil {
+		t.Fatal(err)
+	}
+	check("after Remove")
+
+	msgs, err := sharded.Export(shardedUser)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, msg := range msgs {
+		if msg.SeqID <= 5 {
+			t.Errorf("message %s survived cumulative removal", msg.messageID())
+		}
+	}
+}
+
+func TestShardedBoxCap(t *testing.T) {
+	requireRedis(t)
+	m := NewOfflineManagerWithConfig(OfflineConfig{MaxMessages: 8})
+	m.SetShards(4)
+	userID := offlineTestUser(t, m)
+	for seq := int64(1); seq <= 20; seq++ {
+		storePrivate(t, m, userID, "alice", seq)
+	}
+
+	// 每个子 Key 保留 2 条：最新的 8 条
+	msgs, err := m.Export(userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := seqOrder(msgs), []int64{13, 14, 15, 16, 17, 18, 19, 20}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("box = %v, want %v", got, want)
+	}
+
+	// 超过盒子上限的拉取与整个盒子一致
+	latest, err := m.FetchLatest(userID, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := seqOrder(latest), []int64{20, 19, 18, 17, 16, 15, 14, 13}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("FetchLatest = %v, want %v", got, want)
+	}
+	fetched, err := m.Fetch(userID, 0, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := offlineIDs(fetched); !reflect.DeepEqual(got, offlineIDs(msgs)) {
+		t.Fatalf("Fetch = %v, want %v", got, offlineIDs(msgs))
+	}
+}
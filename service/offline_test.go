@@ -0,0 +1,182 @@
+package service
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"testing"
+	"time"
+
+	pkgredis "go-im/pkg/redis"
+)
+
+// offlineTestUser 唯一的测试用户 ID，测试结束时清空其离线盒子和认领
+func offlineTestUser(t *testing.T, m *OfflineManager) string {
+	t.Helper()
+	userID := "test_" + strconv.FormatInt(time.Now().UnixNano(), 36)
+	t.Cleanup(func() {
+		m.Clear(userID)
+		pkgredis.Client.Del(pkgredis.Context(), OfflineClaimKeyPrefix+userID)
+	})
+	return userID
+}
+
+// storePrivate 存入一条 from → userID 的私聊离线消息
+func storePrivate(t *testing.T, m *OfflineManager, userID, from string, seq int64) {
+	t.Helper()
+	err := m.Store(userID, &OfflineMessage{
+		FromUserID: from,
+		ToUserID:   userID,
+		Content:    []byte(fmt.Sprintf("%s #%d", from, seq)),
+		SeqID:      seq,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// boxIDs 盒子中所有消息的消息 ID（排序后，不依赖同一 SeqID 下成员的顺序）
+func boxIDs(t *testing.T, m *OfflineManager, userID string) []string {
+	t.Helper()
+	msgs, err := m.Export(userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := make([]string, len(msgs))
+	for i, msg := range msgs {
+		ids[i] = msg.messageID()
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// sorted 排序后的消息 ID
+func sorted(ids ...string) []string {
+	sort.Strings(ids)
+	return ids
+}
+
+func TestRemoveMessagesLeavesGaps(t *testing.T) {
+	requireRedis(t)
+	m := NewOfflineManager()
+	bob := offlineTestUser(t, m)
+
+	// 两个会话的 SeqID 互相重叠
+	for seq := int64(1); seq <= 4; seq++ {
+		storePrivate(t, m, bob, "alice", seq)
+	}
+	storePrivate(t, m, bob, "carol", 2)
+	storePrivate(t, m, bob, "carol", 3)
+
+	alice := func(seq int64) string { return MessageID(getConversationID("alice", bob), seq) }
+	carol := func(seq int64) string { return MessageID(getConversationID("carol", bob), seq) }
+
+	// 选择性确认 alice 的 2 和 4：alice 的 1、3 成为空洞两侧的未确认消息，carol 的 2 不受影响
+	if err := m.RemoveMessages(bob, []string{alice(2), alice(4)}); err != nil {
+		t.Fatal(err)
+	}
+	got := fmt.Sprint(boxIDs(t, m, bob))
+	want := fmt.Sprint(sorted(alice(1), carol(2), alice(3), carol(3)))
+	if got != want {
+		t.Fatalf("after removing alice 2 and 4: box = %s, want %s", got, want)
+	}
+
+	// 重复确认、不存在的消息和格式错误的 ID 什么都不删
+	if err := m.RemoveMessages(bob, []string{alice(2), alice(9), "garbage"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := fmt.Sprint(boxIDs(t, m, bob)); got != want {
+		t.Fatalf("after no-op removal: box = %s, want %s", got, want)
+	}
+
+	if err := m.RemoveMessages(bob, []string{carol(3), alice(1)}); err != nil {
+		t.Fatal(err)
+	}
+	got = fmt.Sprint(boxIDs(t, m, bob))
+	want = fmt.Sprint(sorted(carol(2), alice(3)))
+	if got != want {
+		t.Fatalf("after removing carol 3 and alice 1: box = %s, want %s", got, want)
+	}
+}
+
+func TestParseMessageID(t *testing.T) {
+	cases := []struct {
+		id   string
+		conv string
+		seq  int64
+		ok   bool
+	}{
+		{"alice:bob:42", "alice:bob", 42, true},
+		{"group:g1:7", "group:g1", 7, true},
+		{"t1/alice:t1/bob:-3", "t1/alice:t1/bob", -3, true},
+		{MessageID(getConversationID("a:b", "c"), 5), "a:b:c", 5, true},
+		{"alice:bob:", "", 0, false},
+		{"42", "", 0, false},
+		{":42", "", 0, false},
+		{"alice:bob:x", "", 0, false},
+	}
+	for _, c := range cases {
+		conv, seq, ok := parseMessageID(c.id)
+		if ok != c.ok || conv != c.conv || seq != c.seq {
+			t.Errorf("parseMessageID(%q) = (%q, %d, %v), want (%q, %d, %v)", c.id, conv, seq, ok, c.conv, c.seq, c.ok)
+		}
+	}
+}
+
+func TestFetchSinceTime(t *testing.T) {
+	requireRedis(t)
+	m := NewOfflineManager()
+	bob := offlineTestUser(t, m)
+
+	// 时间顺序与 SeqID 顺序无关：老会话的 SeqID 比新会话大
+	since := time.Now().Add(-time.Hour).Truncate(time.Millisecond)
+	stored := []struct {
+		from string
+		seq  int64
+		at   time.Duration // 相对 since
+	}{
+		{"alice", 10, time.Minute},
+		{"alice", 11, 5 * time.Minute},
+		{"carol", 1, 3 * time.Minute},
+		{"carol", 2, -time.Minute}, // since 之前
+		{"dave", 100, 2 * time.Minute},
+		{"dave", 101, 0}, // 恰好在 since，不算之后
+	}
+	for _, s := range stored {
+		err := m.Store(bob, &OfflineMessage{
+			FromUserID: s.from,
+			ToUserID:   bob,
+			Content:    []byte(fmt.Sprintf("%s #%d", s.from, s.seq)),
+			SeqID:      s.seq,
+			Timestamp:  since.Add(s.at),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	id := func(from string, seq int64) string { return MessageID(getConversationID(from, bob), seq) }
+
+	tests := []struct {
+		name  string
+		since time.Time
+		limit int64
+		want  []string
+	}{
+		{"all after since", since, 0, []string{id("alice", 10), id("dave", 100), id("carol", 1), id("alice", 11)}},
+		{"limit keeps newest", since, 2, []string{id("carol", 1), id("alice", 11)}},
+		{"limit above matches", since, 10, []string{id("alice", 10), id("dave", 100), id("carol", 1), id("alice", 11)}},
+		{"later since", since.Add(150 * time.Second), 0, []string{id("carol", 1), id("alice", 11)}},
+		{"nothing newer", since.Add(time.Hour), 0, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msgs, err := m.FetchSinceTime(bob, tt.since, tt.limit)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := offlineIDs(msgs); fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Fatalf("FetchSinceTime = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,113 @@
+/*
+Package service - 消息置顶
+
+=== Redis 数据结构 ===
+
+每个会话一个 ZSet，Score 为置顶时间，保证按置顶顺序列出：
+
+	Key: pins:alice:bob          （私聊：会话 ID）
+	Key: pins:group:team         （群聊：group:<群 ID>）
+	┌──────────────────┬────────────────────┐
+	│ Score (置顶时间)  │ Member (消息 ID)    │
+	├──────────────────┼────────────────────┤
+	│ 1700000000000    │ alice:bob:42       │
+	│ 1700000100000    │ alice:bob:57       │
+	└──────────────────┴────────────────────┘
+
+- 每个会话最多 MaxPinnedMessages 条，超过时拒绝（不会自动挤掉旧的置顶）
+- 检查数量和写入在 Lua 脚本中原子完成，并发置顶不会超过上限
+- 置顶/取消置顶后通过 SendNotification / SendGroupNotification 通知会话其他成员
+*/
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	pkgredis "go-im/pkg/redis"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// ==================== 常量定义 ====================
+
+const (
+	// PinKeyPrefix 置顶 Key 前缀
+	// 完整 Key: pins:<conversationID>
+	PinKeyPrefix = "pins:"
+
+	// MaxPinnedMessages 每个会话最多置顶的消息数
+	MaxPinnedMessages = 10
+)
+
+// ErrTooManyPins 会话置顶数已达上限
+var ErrTooManyPins = errors.New("too many pinned messages in conversation")
+
+// pinScript 未达上限时置顶；已置顶的消息重复置顶不改变顺序
+// 返回 1 成功（含已置顶），0 已达上限
+var pinScript = redis.NewScript(`
+if redis.call("ZSCORE", KEYS[1], ARGV[1]) then
+	return 1
+end
+if redis.call("ZCARD", KEYS[1]) >= tonumber(ARGV[3]) then
+	return 0
+end
+redis.call("ZADD", KEYS[1], ARGV[2], ARGV[1])
+return 1
+`)
+
+// ==================== 结构体定义 ====================
+
+// PinNotification 推送给会话其他成员的置顶通知
+type PinNotification struct {
+	MsgID    string `json:"msg_id"`             // 被置顶的消息 ID
+	SeqID    int64  `json:"seq_id"`             // 被置顶消息的序列号
+	UserID   string `json:"user_id"`            // 操作者
+	GroupID  string `json:"group_id,omitempty"` // 群 ID（仅群聊）
+	Unpinned bool   `json:"unpinned"`           // 是否为取消置顶
+}
+
+// PinManager 消息置顶管理器
+type PinManager struct {
+	ctx context.Context
+}
+
+// NewPinManager 创建消息置顶管理器
+func NewPinManager() *PinManager {
+	return &PinManager{
+		ctx: pkgredis.Context(),
+	}
+}
+
+// GroupConversationID 群聊的会话 ID
+func GroupConversationID(groupID string) string {
+	return "group:" + groupID
+}
+
+// ==================== 置顶/取消 ====================
+
+// Pin 置顶消息
+// 达到 MaxPinnedMessages 时返回 ErrTooManyPins
+func (m *PinManager) Pin(conversationID, msgID string) error {
+	ok, err := pinScript.Run(m.ctx, pkgredis.Client, []string{PinKeyPrefix + conversationID},
+		msgID, time.Now().UnixMilli(), MaxPinnedMessages).Int()
+	if err != nil {
+		return fmt.Errorf("failed to pin message: %w", err)
+	}
+	if ok == 0 {
+		return ErrTooManyPins
+	}
+	return nil
+}
+
+// Unpin 取消置顶
+func (m *PinManager) Unpin(conversationID, msgID string) error {
+	return pkgredis.Client.ZRem(m.ctx, PinKeyPrefix+conversationID, msgID).Err()
+}
+
+// ListPinned 按置顶时间顺序列出会话中置顶的消息 ID
+func (m *PinManager) ListPinned(conversationID string) ([]string, error) {
+	return pkgredis.Client.ZRange(m.ctx, PinKeyPrefix+conversationID, 0, -1).Result()
+}
@@ -0,0 +1,212 @@
+/*
+Package service - 在线状态后端
+
+=== 为什么可插拔？===
+
+有些部署已经有自己的在线状态服务，希望 Go-IM 的上线/下线直接写到那里，
+路由时也从那里查询用户所在的网关：
+
+	           ┌──────────────────────┐
+	Login ────▶│                      │──▶ RedisPresenceBackend（默认）
+	Logout ───▶│   PresenceBackend    │
+	路由查询 ──▶│                      │──▶ 外部在线状态服务（自行实现）
+	           └──────────────────────┘
+
+SessionManager 的 Login、LogoutConn、IsOnline、GetUserGateway 委托给后端。
+需要同时写 Redis 和外部服务时，实现一个包装 RedisPresenceBackend 的后端即可。
+
+=== 后端需要满足的语义 ===
+
+ 1. SetOnline 之后 IsOnline 为 true，GetGateway 返回该网关
+ 2. SetOffline 只在记录仍指向同一网关上的同一连接时才删除（用户可能已经重连），
+    返回是否真的删除了
+ 3. 不在线时 GetGateway 返回 ErrUserOffline，其他错误表示查询本身失败
+ 4. 会被多个连接的 Goroutine 并发调用
+
+跨网关的路由依赖所有网关看到同一份在线状态，内存实现只能用于单进程测试。
+*/
+package service
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	pkgredis "go-im/pkg/redis"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// ==================== 接口定义 ====================
+
+// PresenceBackend 在线状态后端接口
+//
+// 默认实现基于 Redis 会话（RedisPresenceBackend）
+// 测试时可以注入内存实现（MemoryPresenceBackend）
+type PresenceBackend interface {
+	// SetOnline 记录用户在 gatewayID 的 connID 连接上线（覆盖旧记录）
+	SetOnline(userID, gatewayID string, connID uint64) error
+
+	// SetOffline 仅当记录仍指向 gatewayID 上的 connID 时删除，返回是否删除
+	SetOffline(userID, gatewayID string, connID uint64) (bool, error)
+
+	// IsOnline 用户是否在线
+	IsOnline(userID string) (bool, error)
+
+	// GetGateway 用户所在的网关，不在线时返回 ErrUserOffline
+	GetGateway(userID string) (string, error)
+}
+
+// ==================== Redis 实现 ====================
+
+// RedisPresenceBackend 基于 Redis 会话的在线状态后端
+type RedisPresenceBackend struct {
+	ctx context.Context
+	ttl time.Duration // 会话过期时间
+}
+
+// NewRedisPresenceBackend 创建 Redis 在线状态后端（会话过期时间为 SessionTTL）
+func NewRedisPresenceBackend() *RedisPresenceBackend {
+	return &RedisPresenceBackend{ctx: pkgredis.Context(), ttl: SessionTTL}
+}
+
+// SetOnline 创建会话
+//
+// 执行以下 Redis 操作（使用 Pipeline 减少 RTT）：
+// 1. HSET user_session:uid {gateway_id, conn_id, login_time, status}
+// 2. EXPIRE user_session:uid 300
+// 3. SET user_gateway:uid gateway_id EX 300
+func (b *RedisPresenceBackend) SetOnline(userID, gatewayID string, connID uint64) error {
+	pipe := pkgredis.Client.Pipeline()
+
+	sessionKey := SessionKeyPrefix + userID
+
+	// 存储会话详情（Hash 结构）
+	pipe.HSet(b.ctx, sessionKey, map[string]interface{}{
+		"gateway_id": gatewayID,
+		"conn_id":    connID,
+		"login_time": time.Now().Unix(),
+		"status":     StatusOnline,
+	})
+	pipe.HDel(b.ctx, sessionKey, "status_text", "status_auto")
+	pipe.Expire(b.ctx, sessionKey, b.ttl)
+
+	// 存储网关位置（用于快速路由查询）
+	pipe.Set(b.ctx, GatewayKeyPrefix+userID, gatewayID, b.ttl)
+
+	if _, err := pipe.Exec(b.ctx); err != nil {
+		return fmt.Errorf("failed to create session: %w", err)
+	}
+	return nil
+}
+
+// logoutIfCurrentScript 仅当会话仍属于指定网关上的指定连接时才删除
+// 用户可能已经重连到其他连接/网关，此时不能误删新会话
+var logoutIfCurrentScript = redis.NewScript(`
+local gw = redis.call("HGET", KEYS[1], "gateway_id")
+local conn = redis.call("HGET", KEYS[1], "conn_id")
+if gw == ARGV[1] and conn == ARGV[2] then
+	redis.call("DEL", KEYS[1], KEYS[2])
+	return 1
+end
+return 0
+`)
+
+// SetOffline 删除仍指向该连接的会话
+func (b *RedisPresenceBackend) SetOffline(userID, gatewayID string, connID uint64) (bool, error) {
+	keys := []string{SessionKeyPrefix + userID, GatewayKeyPrefix + userID}
+	removed, err := logoutIfCurrentScript.Run(b.ctx, pkgredis.Client, keys,
+		gatewayID, strconv.FormatUint(connID, 10)).Int()
+	if err != nil {
+		return false, fmt.Errorf("failed to remove session: %w", err)
+	}
+	return removed == 1, nil
+}
+
+// IsOnline 检查会话是否存在
+func (b *RedisPresenceBackend) IsOnline(userID string) (bool, error) {
+	exists, err := pkgredis.Client.Exists(b.ctx, SessionKeyPrefix+userID).Result()
+	if err != nil {
+		return false, err
+	}
+	return exists > 0, nil
+}
+
+// GetGateway 读取网关位置
+// 处于发送路径上，Redis 很慢时超时失败，由调用方降级
+func (b *RedisPresenceBackend) GetGateway(userID string) (string, error) {
+	ctx, cancel := pkgredis.CriticalContext()
+	defer cancel()
+
+	gatewayID, err := pkgredis.Client.Get(ctx, GatewayKeyPrefix+userID).Result()
+	if err != nil {
+		if isNotFound(err) {
+			return "", ErrUserOffline
+		}
+		return "", fmt.Errorf("failed to get user gateway: %w", err)
+	}
+	return gatewayID, nil
+}
+
+// ==================== 内存实现 ====================
+
+// presenceEntry 内存后端中的一条在线记录
+type presenceEntry struct {
+	gatewayID string
+	connID    uint64
+}
+
+// MemoryPresenceBackend 内存在线状态后端（仅用于测试）
+//
+// 语义与 RedisPresenceBackend 一致，但没有过期时间
+// 注意：只在单进程内有效，不能用于多网关部署
+type MemoryPresenceBackend struct {
+	mu      sync.RWMutex
+	entries map[string]presenceEntry
+}
+
+// NewMemoryPresenceBackend 创建内存在线状态后端
+func NewMemoryPresenceBackend() *MemoryPresenceBackend {
+	return &MemoryPresenceBackend{entries: make(map[string]presenceEntry)}
+}
+
+// SetOnline 记录用户上线
+func (b *MemoryPresenceBackend) SetOnline(userID, gatewayID string, connID uint64) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.entries[userID] = presenceEntry{gatewayID: gatewayID, connID: connID}
+	return nil
+}
+
+// SetOffline 删除仍指向该连接的记录
+func (b *MemoryPresenceBackend) SetOffline(userID, gatewayID string, connID uint64) (bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	e, ok := b.entries[userID]
+	if !ok || e.gatewayID != gatewayID || e.connID != connID {
+		return false, nil
+	}
+	delete(b.entries, userID)
+	return true, nil
+}
+
+// IsOnline 用户是否在线
+func (b *MemoryPresenceBackend) IsOnline(userID string) (bool, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	_, ok := b.entries[userID]
+	return ok, nil
+}
+
+// GetGateway 用户所在的网关
+func (b *MemoryPresenceBackend) GetGateway(userID string) (string, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	e, ok := b.entries[userID]
+	if !ok {
+		return "", ErrUserOffline
+	}
+	return e.gatewayID, nil
+}
@@ -0,0 +1,156 @@
+/*
+Package service - 用户资料
+
+=== 使用场景 ===
+
+客户端渲染消息时需要发送者的显示名和头像，不值得为此单独部署一个资料服务。
+这里只保存轻量的展示信息：
+
+	Key: profile:alice   (Hash)
+	┌──────────────┬────────────────────────────────┐
+	│ display_name │ Alice                          │
+	│ avatar_url   │ https://cdn.example.com/a.png  │
+	│ updated_at   │ 1700000000000                  │
+	└──────────────┴────────────────────────────────┘
+
+- 认证时用 Token 中的 display_name / avatar_url（有则写入）更新资料
+- 用户也可以通过 CmdTypeProfileQuery 修改自己的资料
+- 没有资料的用户返回默认值：显示名为用户 ID，头像为空
+
+=== 客户端缓存 ===
+
+每份资料带有 updated_at（Unix 毫秒）。客户端可以缓存资料，
+只在消息中出现未缓存的用户时批量查询（一次最多 MaxProfileQuery 个），
+updated_at 变化时再替换缓存。
+*/
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	pkgredis "go-im/pkg/redis"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// ==================== 常量定义 ====================
+
+const (
+	// ProfileKeyPrefix 用户资料 Key 前缀
+	// 完整 Key: profile:<userID>
+	ProfileKeyPrefix = "profile:"
+
+	// MaxProfileQuery 一次最多查询的用户数
+	MaxProfileQuery = 100
+
+	// MaxDisplayNameRunes 显示名的最大字符数
+	MaxDisplayNameRunes = 64
+
+	// MaxAvatarURLLength 头像地址的最大长度
+	MaxAvatarURLLength = 512
+)
+
+// ErrInvalidProfile 显示名过长或头像地址不合法
+var ErrInvalidProfile = errors.New("invalid profile")
+
+// ==================== 结构体定义 ====================
+
+// Profile 用户资料
+type Profile struct {
+	UserID      string `json:"user_id"`
+	DisplayName string `json:"display_name"`
+	AvatarURL   string `json:"avatar_url,omitempty"`
+	UpdatedAt   int64  `json:"updated_at,omitempty"` // Unix 毫秒，0 表示从未设置（默认资料）
+}
+
+// ProfileManager 用户资料管理器
+type ProfileManager struct {
+	ctx context.Context
+}
+
+// NewProfileManager 创建用户资料管理器
+func NewProfileManager() *ProfileManager {
+	return &ProfileManager{
+		ctx: pkgredis.Context(),
+	}
+}
+
+// validProfile 检查显示名和头像地址
+func validProfile(displayName, avatarURL string) bool {
+	if utf8.RuneCountInString(displayName) > MaxDisplayNameRunes {
+		return false
+	}
+	if avatarURL == "" {
+		return true
+	}
+	return len(avatarURL) <= MaxAvatarURLLength &&
+		(strings.HasPrefix(avatarURL, "https://") || strings.HasPrefix(avatarURL, "http://"))
+}
+
+// ==================== 读写 ====================
+
+// Set 更新用户资料，空字段保持不变
+func (m *ProfileManager) Set(userID, displayName, avatarURL string) error {
+	if !validProfile(displayName, avatarURL) {
+		return ErrInvalidProfile
+	}
+	if displayName == "" && avatarURL == "" {
+		return nil
+	}
+
+	fields := map[string]interface{}{"updated_at": wallNow().UnixMilli()}
+	if displayName != "" {
+		fields["display_name"] = displayName
+	}
+	if avatarURL != "" {
+		fields["avatar_url"] = avatarURL
+	}
+	if err := pkgredis.Client.HSet(m.ctx, ProfileKeyPrefix+userID, fields).Err(); err != nil {
+		return fmt.Errorf("failed to set profile: %w", err)
+	}
+	return nil
+}
+
+// Get 获取用户资料（没有资料时返回默认值）
+func (m *ProfileManager) Get(userID string) (*Profile, error) {
+	profiles, err := m.GetMany([]string{userID})
+	if err != nil {
+		return nil, err
+	}
+	return profiles[0], nil
+}
+
+// GetMany 批量获取用户资料，顺序与 userIDs 一致（一次 Pipeline 往返）
+// 返回的 UserID 为传入的用户 ID
+func (m *ProfileManager) GetMany(userIDs []string) ([]*Profile, error) {
+	if len(userIDs) == 0 {
+		return nil, nil
+	}
+
+	pipe := pkgredis.Client.Pipeline()
+	cmds := make([]*redis.MapStringStringCmd, len(userIDs))
+	for i, userID := range userIDs {
+		cmds[i] = pipe.HGetAll(m.ctx, ProfileKeyPrefix+userID)
+	}
+	if _, err := pipe.Exec(m.ctx); err != nil {
+		return nil, fmt.Errorf("failed to get profiles: %w", err)
+	}
+
+	profiles := make([]*Profile, len(userIDs))
+	for i, userID := range userIDs {
+		p := &Profile{UserID: userID, DisplayName: LocalID(userID)}
+		fields := cmds[i].Val()
+		if name := fields["display_name"]; name != "" {
+			p.DisplayName = name
+		}
+		p.AvatarURL = fields["avatar_url"]
+		p.UpdatedAt, _ = strconv.ParseInt(fields["updated_at"], 10, 64)
+		profiles[i] = p
+	}
+	return profiles, nil
+}
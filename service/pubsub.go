@@ -1,207 +1,509 @@
-/*
-Package service - Redis Pub/Sub 消息路由
-
-=== 为什么需要 Pub/Sub？===
-
-在分布式 IM 系统中，用户可能连接在不同的 Gateway：
-
-	┌─────────────┐          ┌─────────────┐
-	│  Gateway-1  │          │  Gateway-2  │
-	│   (Alice)   │          │    (Bob)    │
-	└──────┬──────┘          └──────┬──────┘
-	       │                        │
-	       │    Alice → Bob 消息    │
-	       │                        │
-	       └────────────────────────┘
-	                 如何传递？
-
-解决方案：Redis Pub/Sub
-
-	┌─────────────┐                    ┌─────────────┐
-	│  Gateway-1  │                    │  Gateway-2  │
-	│   (Alice)   │                    │    (Bob)    │
-	└──────┬──────┘                    └──────┬──────┘
-	       │                                  │
-	       │ PUBLISH channel:gateway_2 msg    │ SUBSCRIBE channel:gateway_2
-	       │                                  │
-	       ▼                                  ▼
-	┌──────────────────────────────────────────────┐
-	│                    Redis                      │
-	│         Pub/Sub 消息分发中心                  │
-	└──────────────────────────────────────────────┘
-
-=== Pub/Sub vs 消息队列 ===
-
-| 特性      | Pub/Sub        | 消息队列 (如 Kafka)  |
-|-----------|----------------|---------------------|
-| 持久化    | ❌ 不持久化    | ✓ 持久化            |
-| 消费模式  | 广播（所有订阅者）| 竞争（只有一个消费）|
-| 适用场景  | 实时通知       | 可靠消息传递        |
-| 复杂度    | 简单           | 复杂                |
-
-本项目使用 Pub/Sub 因为：
-- 消息是实时的，不需要持久化（离线消息有专门的存储）
-- 每个 Gateway 只关心自己的 Channel
-- 实现简单，延迟低
-*/
-package service
-
-import (
-	"context"
-	"encoding/json"
-	"log"
-
-	pkgredis "go-im/pkg/redis"
-
-	"github.com/redis/go-redis/v9"
-)
-
-// ==================== 消息结构 ====================
-
-// PubSubMessage Pub/Sub 传输的消息格式
-// 这是跨 Gateway 传递的消息结构
-type PubSubMessage struct {
-	FromUserID string `json:"from_user_id"` // 发送者
-	ToUserID   string `json:"to_user_id"`   // 接收者
-	Content    []byte `json:"content"`      // 消息内容
-	MsgType    int    `json:"msg_type"`     // 消息类型
-	SeqID      int64  `json:"seq_id"`       // 序列号
-}
-
-// ==================== Pub/Sub 管理器 ====================
-
-// PubSubManager Redis Pub/Sub 管理器
-// 每个 Gateway 实例有一个 PubSubManager
-type PubSubManager struct {
-	// gatewayID 当前网关 ID
-	gatewayID string
-
-	// channelKey 本网关订阅的频道
-	// 格式: channel:gateway_xxx
-	channelKey string
-
-	// pubsub Redis Pub/Sub 订阅器
-	pubsub *redis.PubSub
-
-	// ctx 上下文，用于取消订阅
-	ctx context.Context
-
-	// cancel 取消函数
-	cancel context.CancelFunc
-
-	// handler 消息处理回调
-	handler func(*PubSubMessage)
-}
-
-// ==================== 构造函数 ====================
-
-// NewPubSubManager 创建 Pub/Sub 管理器
-func NewPubSubManager(gatewayID string) *PubSubManager {
-	ctx, cancel := context.WithCancel(context.Background())
-	return &PubSubManager{
-		gatewayID:  gatewayID,
-		channelKey: "channel:gateway_" + gatewayID, // 每个 Gateway 有自己的频道
-		ctx:        ctx,
-		cancel:     cancel,
-	}
-}
-
-// ==================== 订阅 ====================
-
-// Start 开始订阅消息
-//
-// 订阅流程：
-// 1. 订阅自己的频道 (channel:gateway_xxx)
-// 2. 启动接收循环
-// 3. 收到消息后调用 handler 处理
-func (m *PubSubManager) Start(handler func(*PubSubMessage)) error {
-	m.handler = handler
-
-	// 订阅频道
-	m.pubsub = pkgredis.Client.Subscribe(m.ctx, m.channelKey)
-
-	// 等待订阅确认
-	// 这确保订阅已经生效
-	_, err := m.pubsub.Receive(m.ctx)
-	if err != nil {
-		return err
-	}
-
-	log.Printf("[PubSub] Subscribed to channel: %s", m.channelKey)
-
-	// 启动接收循环（后台 Goroutine）
-	go m.receiveLoop()
-	return nil
-}
-
-// receiveLoop 消息接收循环
-// 持续从 Redis 接收消息并处理
-func (m *PubSubManager) receiveLoop() {
-	// 获取消息通道
-	ch := m.pubsub.Channel()
-
-	for {
-		select {
-		case <-m.ctx.Done():
-			// 收到取消信号，退出
-			return
-
-		case msg, ok := <-ch:
-			if !ok {
-				// 通道关闭
-				return
-			}
-
-			// 解析消息
-			var pubsubMsg PubSubMessage
-			if err := json.Unmarshal([]byte(msg.Payload), &pubsubMsg); err != nil {
-				log.Printf("[PubSub] Failed to unmarshal message: %v", err)
-				continue
-			}
-
-			// 调用处理器
-			if m.handler != nil {
-				m.handler(&pubsubMsg)
-			}
-		}
-	}
-}
-
-// ==================== 发布 ====================
-
-// Publish 发布消息到指定网关
-//
-// 流程：
-// 1. 将消息序列化为 JSON
-// 2. PUBLISH 到目标网关的频道
-// 3. 目标网关的 receiveLoop 会收到消息
-//
-// 参数:
-//   - targetGatewayID: 目标网关 ID
-//   - msg: 要发送的消息
-func (m *PubSubManager) Publish(targetGatewayID string, msg *PubSubMessage) error {
-	// 序列化消息
-	data, err := json.Marshal(msg)
-	if err != nil {
-		return err
-	}
-
-	// 构造目标频道名
-	channelKey := "channel:gateway_" + targetGatewayID
-
-	// 发布消息
-	return pkgredis.Client.Publish(m.ctx, channelKey, data).Err()
-}
-
-// ==================== 停止 ====================
-
-// Stop 停止 Pub/Sub
-func (m *PubSubManager) Stop() {
-	// 取消上下文，通知 receiveLoop 退出
-	m.cancel()
-
-	// 关闭订阅
-	if m.pubsub != nil {
-		m.pubsub.Close()
-	}
-}
+/*
+Package service - Redis Pub/Sub 消息路由
+
+=== 为什么需要 Pub/Sub？===
+
+在分布式 IM 系统中，用户可能连接在不同的 Gateway：
+
+	┌─────────────┐          ┌─────────────┐
+	│  Gateway-1  │          │  Gateway-2  │
+	│   (Alice)   │          │    (Bob)    │
+	└──────┬──────┘          └──────┬──────┘
+	       │                        │
+	       │    Alice → Bob 消息    │
+	       │                        │
+	       └────────────────────────┘
+	                 如何传递？
+
+解决方案：Redis Pub/Sub
+
+	┌─────────────┐                    ┌─────────────┐
+	│  Gateway-1  │                    │  Gateway-2  │
+	│   (Alice)   │                    │    (Bob)    │
+	└──────┬──────┘                    └──────┬──────┘
+	       │                                  │
+	       │ PUBLISH channel:gateway_2 msg    │ SUBSCRIBE channel:gateway_2
+	       │                                  │
+	       ▼                                  ▼
+	┌──────────────────────────────────────────────┐
+	│                    Redis                      │
+	│         Pub/Sub 消息分发中心                  │
+	└──────────────────────────────────────────────┘
+
+=== Pub/Sub vs 消息队列 ===
+
+| 特性      | Pub/Sub        | 消息队列 (如 Kafka)  |
+|-----------|----------------|---------------------|
+| 持久化    | ❌ 不持久化    | ✓ 持久化            |
+| 消费模式  | 广播（所有订阅者）| 竞争（只有一个消费）|
+| 适用场景  | 实时通知       | 可靠消息传递        |
+| 复杂度    | 简单           | 复杂                |
+
+本项目使用 Pub/Sub 因为：
+- 消息是实时的，不需要持久化（离线消息有专门的存储）
+- 每个 Gateway 只关心自己的 Channel
+- 实现简单，延迟低
+
+=== 网关 ID 变更（前任频道）===
+
+容器重新调度后网关可能换了 ID，其他网关缓存的会话仍指向旧 ID，
+继续 PUBLISH 到 channel:gateway_<旧ID>，没有订阅者时消息直接丢失。
+
+SetPredecessors 配置前任网关 ID 和宽限期：启动后宽限期内同时订阅前任频道，
+收到的消息按正常流程处理（用户在本网关则推送，否则存离线），宽限期结束后退订。
+
+=== 压缩（可选）===
+
+较大的跨网关消息（如带媒体元数据的消息、群聊批量信封）会占用 Redis 的
+Pub/Sub 带宽。SetCompression 开启后，序列化结果达到阈值的消息以 gzip 压缩发布，
+格式与离线消息的压缩成员相同：
+
+	Payload = 0x01 + gzip(JSON)     // 压缩
+	Payload = {"from_user_id":...}  // 未压缩（以 '{' 开头）
+
+接收端按首字节识别，无论本网关是否开启压缩都能解码两种格式。
+滚动升级时先让所有网关升级到能解码的版本，再开启压缩。
+*/
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	pkgredis "go-im/pkg/redis"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// ==================== 常量定义 ====================
+
+const (
+	// PubSubRetryMin 订阅失败后的首次重试间隔
+	PubSubRetryMin = 1 * time.Second
+
+	// PubSubRetryMax 订阅重试的最大间隔
+	PubSubRetryMax = 30 * time.Second
+
+	// PubSubStopTimeout Stop 等待正在处理的消息完成的最长时间
+	// 处理器卡住（如 Redis 无响应）时不会让关闭流程无限等待
+	PubSubStopTimeout = 5 * time.Second
+
+	// DefaultPubSubCompressMinSize 开启压缩时的默认阈值（字节）
+	DefaultPubSubCompressMinSize = 1024
+)
+
+// ErrNoSubscriber 目标网关没有订阅自己的频道（网关已下线或尚未完成订阅）
+// PUBLISH 不保证送达，接收者为 0 时消息直接丢失，调用方应改存离线
+var ErrNoSubscriber = errors.New("no subscriber on target gateway channel")
+
+// ==================== 消息结构 ====================
+
+// PubSubMessage Pub/Sub 传输的消息格式
+// 这是跨 Gateway 传递的消息结构
+type PubSubMessage struct {
+	FromUserID string `json:"from_user_id"`       // 发送者
+	ToUserID   string `json:"to_user_id"`         // 接收者
+	Content    []byte `json:"content"`            // 消息内容
+	MsgType    int    `json:"msg_type"`           // 消息类型
+	SeqID      int64  `json:"seq_id"`             // 序列号
+	Timestamp  int64  `json:"timestamp"`          // 发送时间（Unix 毫秒）
+	GroupID    string `json:"group_id,omitempty"` // 群 ID（仅群聊消息）
+
+	DeliverBefore int64          `json:"deliver_before,omitempty"` // 投递截止时间（Unix 毫秒）
+	Delivery      DeliveryPolicy `json:"delivery,omitempty"`       // 投递策略（见 delivery.go）
+}
+
+// PubSubBatch 批量消息信封
+// 一次 PUBLISH 携带多条消息，用于群聊等扇出场景，减少 Redis 往返
+type PubSubBatch struct {
+	Messages []*PubSubMessage `json:"batch"`
+}
+
+// pubsubEnvelope 接收端的解码结构
+// 同时兼容单条消息和批量信封：有 batch 字段即为批量消息
+type pubsubEnvelope struct {
+	PubSubMessage
+	Batch []*PubSubMessage `json:"batch"`
+}
+
+// ==================== Pub/Sub 管理器 ====================
+
+// PubSubManager Redis Pub/Sub 管理器
+// 每个 Gateway 实例有一个 PubSubManager
+type PubSubManager struct {
+	// gatewayID 当前网关 ID
+	gatewayID string
+
+	// channelKey 本网关订阅的频道
+	// 格式: channel:gateway_xxx
+	channelKey string
+
+	// pubsub Redis Pub/Sub 订阅器（订阅成功前为 nil）
+	pubsub *redis.PubSub
+
+	// mu 保护 pubsub（后台重试与 Stop 并发访问）
+	mu sync.Mutex
+
+	// subscribed 是否已订阅成功
+	subscribed atomic.Bool
+
+	// ctx 上下文，用于取消订阅
+	ctx context.Context
+
+	// cancel 取消函数
+	cancel context.CancelFunc
+
+	// handler 消息处理回调
+	handler func(*PubSubMessage)
+
+	// loops 接收循环（含后台重试订阅），Stop 等待其退出后再关闭订阅
+	loops sync.WaitGroup
+
+	// predecessors 前任网关的频道，graceUntil 之前一并订阅
+	predecessors []string
+	graceUntil   time.Time
+
+	// compressMin 达到此大小的消息压缩后发布（0 表示不压缩）
+	compressMin int
+}
+
+// ==================== 构造函数 ====================
+
+// NewPubSubManager 创建 Pub/Sub 管理器
+func NewPubSubManager(gatewayID string) *PubSubManager {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &PubSubManager{
+		gatewayID:  gatewayID,
+		channelKey: "channel:gateway_" + gatewayID, // 每个 Gateway 有自己的频道
+		ctx:        ctx,
+		cancel:     cancel,
+	}
+}
+
+// SetCompression 设置压缩阈值：序列化后达到 minSize 字节的消息压缩后发布
+// minSize <= 0 表示不压缩；接收端总是能解码压缩消息，与此设置无关
+func (m *PubSubManager) SetCompression(minSize int) {
+	m.compressMin = max(minSize, 0)
+}
+
+// ==================== 订阅 ====================
+
+// Start 开始订阅消息
+//
+// 订阅流程：
+// 1. 订阅自己的频道 (channel:gateway_xxx)
+// 2. 启动接收循环
+// 3. 收到消息后调用 handler 处理
+//
+// 启动时 Redis 不可用不会导致失败：订阅改为在后台按指数退避重试，
+// 网关照常接受连接。订阅成功之前其他网关 PUBLISH 给本网关会得到
+// ErrNoSubscriber，消息降级为离线存储，用户仍能在重连/上线后收到
+func (m *PubSubManager) Start(handler func(*PubSubMessage)) error {
+	m.handler = handler
+
+	if len(m.predecessors) > 0 {
+		time.AfterFunc(time.Until(m.graceUntil), m.dropPredecessors)
+	}
+
+	m.loops.Add(1)
+	if err := m.subscribe(); err != nil {
+		log.Printf("[PubSub] Subscribe failed, retrying in background: %v", err)
+		go func() {
+			defer m.loops.Done()
+			m.subscribeWithRetry()
+		}()
+		return nil
+	}
+
+	// 启动接收循环（后台 Goroutine）
+	go func() {
+		defer m.loops.Done()
+		m.receiveLoop()
+	}()
+	return nil
+}
+
+// Subscribed 是否已成功订阅本网关频道
+func (m *PubSubManager) Subscribed() bool {
+	return m.subscribed.Load()
+}
+
+// SetPredecessors 在启动后的 grace 时间内同时订阅前任网关的频道
+// 需要在 Start 之前调用
+func (m *PubSubManager) SetPredecessors(gatewayIDs []string, grace time.Duration) {
+	m.predecessors = m.predecessors[:0]
+	for _, id := range gatewayIDs {
+		if id != "" && id != m.gatewayID {
+			m.predecessors = append(m.predecessors, "channel:gateway_"+id)
+		}
+	}
+	m.graceUntil = time.Now().Add(grace)
+}
+
+// dropPredecessors 宽限期结束，退订前任频道
+func (m *PubSubManager) dropPredecessors() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.pubsub == nil || m.ctx.Err() != nil {
+		return
+	}
+	if err := m.pubsub.Unsubscribe(m.ctx, m.predecessors...); err != nil {
+		log.Printf("[PubSub] Failed to unsubscribe predecessor channels: %v", err)
+		return
+	}
+	log.Printf("[PubSub] Grace window over, unsubscribed from %v", m.predecessors)
+}
+
+// subscribe 订阅频道并等待确认
+func (m *PubSubManager) subscribe() error {
+	channels := []string{m.channelKey}
+	if len(m.predecessors) > 0 && time.Now().Before(m.graceUntil) {
+		channels = append(channels, m.predecessors...)
+	}
+	ps := pkgredis.Client.Subscribe(m.ctx, channels...)
+
+	// 等待订阅确认
+	// 这确保订阅已经生效
+	if _, err := ps.Receive(m.ctx); err != nil {
+		ps.Close()
+		return err
+	}
+
+	m.mu.Lock()
+	m.pubsub = ps
+	m.mu.Unlock()
+	m.subscribed.Store(true)
+
+	log.Printf("[PubSub] Subscribed to channels: %v", channels)
+	return nil
+}
+
+// subscribeWithRetry 后台重试订阅，直到成功或 Stop
+//
+// 退避间隔从 PubSubRetryMin 翻倍到 PubSubRetryMax，并加入随机抖动：
+// Redis 恢复时大量网关不会在同一时刻一起重连（重连风暴）
+func (m *PubSubManager) subscribeWithRetry() {
+	backoff := PubSubRetryMin
+	for {
+		jitter := time.Duration(rand.Int64N(int64(backoff) / 2))
+		select {
+		case <-m.ctx.Done():
+			return
+		case <-time.After(backoff/2 + jitter):
+		}
+
+		if err := m.subscribe(); err != nil {
+			log.Printf("[PubSub] Subscribe retry failed: %v", err)
+			backoff *= 2
+			if backoff > PubSubRetryMax {
+				backoff = PubSubRetryMax
+			}
+			continue
+		}
+
+		m.receiveLoop()
+		return
+	}
+}
+
+// receiveLoop 消息接收循环
+// 持续从 Redis 接收消息并处理
+//
+// 只在两条消息之间检查停止信号：正在处理的消息（包括批量信封中的剩余消息）
+// 会处理完再退出，Stop 等待这一刻之后才关闭订阅
+func (m *PubSubManager) receiveLoop() {
+	// 获取消息通道
+	m.mu.Lock()
+	ch := m.pubsub.Channel()
+	m.mu.Unlock()
+
+	for {
+		select {
+		case <-m.ctx.Done():
+			// 收到取消信号，退出
+			return
+
+		case msg, ok := <-ch:
+			if !ok {
+				// 通道关闭
+				return
+			}
+
+			// 解析消息（单条或批量）
+			env, err := decodePayload([]byte(msg.Payload))
+			if err != nil {
+				log.Printf("[PubSub] Failed to decode message: %v", err)
+				continue
+			}
+
+			// 调用处理器
+			// 停止信号与消息同时就绪时 select 随机选择，这里再检查一次：
+			// 已经开始关闭时不再处理新消息
+			if m.handler == nil || m.ctx.Err() != nil {
+				continue
+			}
+			if len(env.Batch) > 0 {
+				for _, item := range env.Batch {
+					m.handler(item)
+				}
+			} else {
+				m.handler(&env.PubSubMessage)
+			}
+		}
+	}
+}
+
+// ==================== 发布 ====================
+
+// Publish 发布消息到指定网关
+//
+// 流程：
+// 1. 将消息序列化为 JSON
+// 2. PUBLISH 到目标网关的频道
+// 3. 目标网关的 receiveLoop 会收到消息
+//
+// 参数:
+//   - targetGatewayID: 目标网关 ID
+//   - msg: 要发送的消息
+func (m *PubSubManager) Publish(targetGatewayID string, msg *PubSubMessage) error {
+	// 序列化消息
+	data, err := m.encodePayload(msg)
+	if err != nil {
+		return err
+	}
+
+	// 构造目标频道名
+	channelKey := "channel:gateway_" + targetGatewayID
+
+	// 发布消息
+	// 返回值是收到消息的订阅者数量，为 0 说明目标网关没有在监听
+	receivers, err := pkgredis.Client.Publish(m.ctx, channelKey, data).Result()
+	if err != nil {
+		return err
+	}
+	if receivers == 0 {
+		return ErrNoSubscriber
+	}
+	return nil
+}
+
+// PublishBatch 批量发布消息
+//
+// 按目标网关分组：每个网关的所有消息打包成一个 PubSubBatch，只 PUBLISH 一次；
+// 所有网关的 PUBLISH 通过 Pipeline 一次性发送
+//
+// 对于群聊扇出，N 个成员分布在 K 个网关上：
+//   - Publish 逐条发送：N 次 Redis 往返
+//   - PublishBatch：1 次往返，K 条 PUBLISH
+//
+// 参数:
+//   - byGateway: 目标网关 ID → 该网关上要投递的消息
+//
+// 返回值：发布失败的网关 ID → 错误，全部成功时为空
+// 与 Publish 相同，目标网关没有订阅者时该网关的错误为 ErrNoSubscriber，
+// 调用方应将发往失败网关的消息改存离线
+func (m *PubSubManager) PublishBatch(byGateway map[string][]*PubSubMessage) map[string]error {
+	failed := make(map[string]error)
+	pipe := pkgredis.Client.Pipeline()
+	cmds := make(map[string]*redis.IntCmd, len(byGateway))
+	for gatewayID, msgs := range byGateway {
+		if len(msgs) == 0 {
+			continue
+		}
+
+		data, err := m.encodePayload(&PubSubBatch{Messages: msgs})
+		if err != nil {
+			failed[gatewayID] = err
+			continue
+		}
+		cmds[gatewayID] = pipe.Publish(m.ctx, "channel:gateway_"+gatewayID, data)
+	}
+	if len(cmds) == 0 {
+		return failed
+	}
+
+	// Exec 只返回第一个错误，逐条检查每个网关的结果
+	pipe.Exec(m.ctx)
+	for gatewayID, cmd := range cmds {
+		receivers, err := cmd.Result()
+		if err == nil && receivers == 0 {
+			err = ErrNoSubscriber
+		}
+		if err != nil {
+			failed[gatewayID] = err
+		}
+	}
+	return failed
+}
+
+// ==================== 编解码 ====================
+
+// encodePayload 序列化消息或批量信封，达到阈值时压缩
+func (m *PubSubManager) encodePayload(v interface{}) ([]byte, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	if m.compressMin > 0 && len(data) >= m.compressMin {
+		if data, err = gzipMarked(data); err != nil {
+			return nil, fmt.Errorf("failed to compress pubsub message: %w", err)
+		}
+	}
+	return data, nil
+}
+
+// decodePayload 解码收到的消息，自动识别压缩
+func decodePayload(data []byte) (*pubsubEnvelope, error) {
+	if len(data) > 0 && data[0] == compressedMarker {
+		var err error
+		if data, err = gunzipMarked(data); err != nil {
+			return nil, err
+		}
+	}
+	var env pubsubEnvelope
+	if err := json.Unmarshal(data, &env); err != nil {
+		return nil, err
+	}
+	return &env, nil
+}
+
+// ==================== 停止 ====================
+
+// Stop 停止 Pub/Sub
+//
+// 关闭顺序：
+//  1. 取消上下文，通知 receiveLoop 不再接收新消息
+//  2. 等待 receiveLoop 处理完当前消息并退出（最多 PubSubStopTimeout）
+//  3. 关闭订阅
+//
+// 直接关闭订阅会让正在投递的跨网关消息半途丢失
+func (m *PubSubManager) Stop() {
+	// 取消上下文，通知 receiveLoop 退出
+	m.cancel()
+
+	// 等待正在处理的消息完成
+	done := make(chan struct{})
+	go func() {
+		m.loops.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(PubSubStopTimeout):
+		log.Printf("[PubSub] Timed out after %v waiting for in-flight messages", PubSubStopTimeout)
+	}
+
+	// 关闭订阅
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.pubsub != nil {
+		m.pubsub.Close()
+	}
+}
@@ -0,0 +1,192 @@
+/*
+Package service - 离线推送与免打扰
+
+=== 推送时机 ===
+
+用户不在线时消息存入离线盒子，同时可以通过 APNs / FCM 等渠道
+推送一条通知唤醒客户端。推送渠道由部署方实现 PushNotifier 接入。
+
+=== 免打扰（服务端判断）===
+
+每个用户一份通知偏好，存储在 Redis：
+
+	Key:   notify_prefs:<userID>   (String, JSON)
+	Value: {"quiet_start":"22:00","quiet_end":"07:00",
+	        "timezone":"Asia/Shanghai","muted":["bob","team"]}
+
+- quiet_start / quiet_end：每天的免打扰时段（按 timezone 解释，可跨午夜）
+- muted：静音的会话（对方用户 ID 或群 ID）
+
+存离线之后、推送之前检查偏好：命中免打扰时消息照常存储，只是不推送，
+用户上线后仍能收到全部消息。
+
+在服务端判断而不是客户端判断：客户端离线时根本没有机会判断，
+只能在推送发出之前拦截。
+*/
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"slices"
+	"time"
+
+	pkgredis "go-im/pkg/redis"
+)
+
+// ==================== 常量定义 ====================
+
+// NotifyPrefsKeyPrefix 通知偏好 Key 前缀
+// 完整 Key: notify_prefs:<userID>
+const NotifyPrefsKeyPrefix = "notify_prefs:"
+
+// ==================== 推送接口 ====================
+
+// PushNotifier 离线推送渠道（APNs、FCM 等），由部署方实现
+type PushNotifier interface {
+	// Push 通知离线用户有新消息
+	Push(userID string, msg *ChatMessage) error
+}
+
+// ==================== 通知偏好 ====================
+
+// NotificationPrefs 用户的通知偏好
+type NotificationPrefs struct {
+	QuietStart string   `json:"quiet_start,omitempty"` // 免打扰开始时间 "HH:MM"
+	QuietEnd   string   `json:"quiet_end,omitempty"`   // 免打扰结束时间 "HH:MM"
+	Timezone   string   `json:"timezone,omitempty"`    // IANA 时区，为空使用 UTC
+	Muted      []string `json:"muted,omitempty"`       // 静音的会话（对方用户 ID 或群 ID）
+}
+
+// InQuietHours 判断 t 是否处于免打扰时段
+// 开始时间晚于结束时间表示跨午夜（如 22:00–07:00）
+func (p *NotificationPrefs) InQuietHours(t time.Time) bool {
+	start, ok1 := parseClock(p.QuietStart)
+	end, ok2 := parseClock(p.QuietEnd)
+	if !ok1 || !ok2 || start == end {
+		return false
+	}
+
+	if p.Timezone != "" {
+		if loc, err := time.LoadLocation(p.Timezone); err == nil {
+			t = t.In(loc)
+		}
+	} else {
+		t = t.UTC()
+	}
+	now := t.Hour()*60 + t.Minute()
+
+	if start < end {
+		return now >= start && now < end
+	}
+	return now >= start || now < end
+}
+
+// IsMuted 判断会话是否被静音
+func (p *NotificationPrefs) IsMuted(conversation string) bool {
+	return slices.Contains(p.Muted, conversation)
+}
+
+// AllowPush 判断是否允许为这条消息发送推送
+func (p *NotificationPrefs) AllowPush(msg *ChatMessage, now time.Time) bool {
+	conversation := msg.FromUserID
+	if msg.GroupID != "" {
+		conversation = msg.GroupID
+	}
+	return !p.IsMuted(conversation) && !p.InQuietHours(now)
+}
+
+// parseClock 解析 "HH:MM"，返回当天的分钟数
+func parseClock(s string) (int, bool) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, false
+	}
+	return t.Hour()*60 + t.Minute(), true
+}
+
+// ==================== 偏好管理器 ====================
+
+// PrefsManager 通知偏好管理器
+type PrefsManager struct {
+	ctx context.Context
+}
+
+// NewPrefsManager 创建通知偏好管理器
+func NewPrefsManager() *PrefsManager {
+	return &PrefsManager{
+		ctx: pkgredis.Context(),
+	}
+}
+
+// Get 获取用户的通知偏好
+// 用户没有设置过时返回空偏好（不免打扰、不静音）
+func (m *PrefsManager) Get(userID string) (*NotificationPrefs, error) {
+	data, err := pkgredis.Client.Get(m.ctx, NotifyPrefsKeyPrefix+userID).Bytes()
+	if err != nil {
+		if isNotFound(err) {
+			return &NotificationPrefs{}, nil
+		}
+		return nil, fmt.Errorf("failed to get notification prefs: %w", err)
+	}
+
+	var prefs NotificationPrefs
+	if err := json.Unmarshal(data, &prefs); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal notification prefs: %w", err)
+	}
+	return &prefs, nil
+}
+
+// Set 保存用户的通知偏好
+func (m *PrefsManager) Set(userID string, prefs *NotificationPrefs) error {
+	if prefs.Timezone != "" {
+		if _, err := time.LoadLocation(prefs.Timezone); err != nil {
+			return fmt.Errorf("invalid timezone %q: %w", prefs.Timezone, err)
+		}
+	}
+
+	data, err := json.Marshal(prefs)
+	if err != nil {
+		return err
+	}
+	return pkgredis.Client.Set(m.ctx, NotifyPrefsKeyPrefix+userID, data, 0).Err()
+}
+
+// ==================== 推送触发 ====================
+
+// SetPushNotifier 设置离线推送渠道和通知偏好来源
+// pusher 为 nil 表示不推送；prefs 为 nil 表示不检查偏好
+func (h *MessageHandler) SetPushNotifier(pusher PushNotifier, prefs *PrefsManager) {
+	h.pusher = pusher
+	h.prefs = prefs
+}
+
+// notifyOffline 消息存入离线盒子后按用户偏好决定是否推送
+// 异步执行，不阻塞消息路由
+func (h *MessageHandler) notifyOffline(msg *ChatMessage) {
+	if h.pusher == nil {
+		return
+	}
+	// 用户在本网关有连接（例如因流控暂存离线），不需要推送唤醒
+	if h.connManager.GetByUserID(msg.ToUserID) != nil {
+		return
+	}
+
+	go func() {
+		if h.prefs != nil {
+			prefs, err := h.prefs.Get(msg.ToUserID)
+			if err != nil {
+				log.Printf("[Push] Failed to load prefs for %s: %v", msg.ToUserID, err)
+			} else if !prefs.AllowPush(msg, time.Now()) {
+				log.Printf("[Push] Suppressed push to %s (quiet hours or muted)", msg.ToUserID)
+				return
+			}
+		}
+
+		if err := h.pusher.Push(msg.ToUserID, msg.clientView()); err != nil {
+			log.Printf("[Push] Failed to push to %s: %v", msg.ToUserID, err)
+		}
+	}()
+}
@@ -0,0 +1,99 @@
+/*
+Package service - 表情回应服务
+
+=== Redis 数据结构 ===
+
+每条消息一个 Hash，记录每个用户的回应：
+
+	Key: reactions:alice:bob:42     （消息 ID = 会话 ID + SeqID）
+	┌──────────────┬─────────┐
+	│ Field (用户)  │ Value   │
+	├──────────────┼─────────┤
+	│ bob          │ 👍      │
+	│ carol        │ ❤️      │
+	└──────────────┴─────────┘
+
+- 每个用户对一条消息只保留一个回应，再次回应会覆盖（HSET）
+- 移除回应即 HDEL
+- 查询一条消息的全部回应即 HGETALL
+
+=== 通知流程 ===
+
+	Bob 对 Alice 的消息回应 👍
+	  1. HSET reactions:<msgID> bob 👍
+	  2. 通过 MessageHandler.SendNotification 通知 Alice
+	     （与聊天消息同样的路由：在线推送 / 跨网关转发 / 离线存储）
+*/
+package service
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	pkgredis "go-im/pkg/redis"
+)
+
+// ==================== 常量定义 ====================
+
+const (
+	// ReactionKeyPrefix 表情回应 Key 前缀
+	// 完整 Key: reactions:<msgID>
+	ReactionKeyPrefix = "reactions:"
+
+	// ReactionTTL 回应数据的保留时间
+	// 每次写入都会续期，长期无人回应的消息会自动清理
+	ReactionTTL = 30 * 24 * time.Hour
+)
+
+// ==================== 结构体定义 ====================
+
+// ReactionNotification 推送给原消息发送者的回应通知
+type ReactionNotification struct {
+	MsgID   string `json:"msg_id"`  // 被回应的消息 ID
+	SeqID   int64  `json:"seq_id"`  // 被回应消息的序列号
+	UserID  string `json:"user_id"` // 回应者
+	Emoji   string `json:"emoji"`   // 表情（移除时为空）
+	Removed bool   `json:"removed"` // 是否为移除回应
+}
+
+// ReactionManager 表情回应管理器
+type ReactionManager struct {
+	ctx context.Context
+}
+
+// NewReactionManager 创建表情回应管理器
+func NewReactionManager() *ReactionManager {
+	return &ReactionManager{
+		ctx: pkgredis.Context(),
+	}
+}
+
+// ==================== 添加/移除 ====================
+
+// Add 添加回应
+// 同一用户对同一消息重复回应时覆盖旧的表情
+func (m *ReactionManager) Add(msgID, userID, emoji string) error {
+	key := ReactionKeyPrefix + msgID
+
+	pipe := pkgredis.Client.Pipeline()
+	pipe.HSet(m.ctx, key, userID, emoji)
+	pipe.Expire(m.ctx, key, ReactionTTL)
+
+	if _, err := pipe.Exec(m.ctx); err != nil {
+		return fmt.Errorf("failed to add reaction: %w", err)
+	}
+	return nil
+}
+
+// Remove 移除用户对消息的回应
+func (m *ReactionManager) Remove(msgID, userID string) error {
+	return pkgredis.Client.HDel(m.ctx, ReactionKeyPrefix+msgID, userID).Err()
+}
+
+// ==================== 查询 ====================
+
+// GetReactions 获取消息的全部回应（用户 ID → 表情）
+func (m *ReactionManager) GetReactions(msgID string) (map[string]string, error) {
+	return pkgredis.Client.HGetAll(m.ctx, ReactionKeyPrefix+msgID).Result()
+}
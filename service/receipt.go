@@ -0,0 +1,271 @@
+/*
+Package service - 消息状态追踪（回执）
+
+=== 使用场景 ===
+
+客服需要回答"对方到底收到这条消息没有？"。
+开启追踪后，每条消息记录存储/投递/已读时间，每个用户记录累积确认位置：
+
+	Key: msg_state:alice:bob:42      （Hash，消息 ID → 状态）
+	┌──────────────┬────────────────┐
+	│ to           │ bob            │
+	│ stored_at    │ 1700000000000  │  存入离线盒子
+	│ delivered_at │ 1700000005000  │  推送到客户端连接
+	│ read_at      │ 1700000009000  │  客户端上报已读
+	└──────────────┴────────────────┘
+
+	Key: ack_state:bob               （Hash，用户 → 累积确认位置）
+	┌──────────────┬────────────────┐
+	│ seq          │ 42             │
+	│ at           │ 1700000006000  │
+	└──────────────┴────────────────┘
+
+=== 为什么 ACK 不按消息记录？===
+
+ACK 是累积确认（确认 SeqID 及之前的全部消息），逐条写入代价太高。
+查询时用消息的 SeqID 与接收者的累积确认位置比较即可，
+acked_at 取覆盖这条消息的最近一次 ACK 的时间（近似值）。
+
+只追踪私聊消息：群消息所有成员共享同一个消息 ID（见 group.go），
+每个成员的状态无法记录在一个 Hash 里。
+
+所有记录随 OfflineMessageTTL 过期；追踪是可选的（MessageHandler.SetReceipts），
+关闭时投递路径没有额外的 Redis 写入。
+*/
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+
+	pkgredis "go-im/pkg/redis"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// ==================== 常量定义 ====================
+
+const (
+	// MsgStateKeyPrefix 消息状态 Key 前缀
+	// 完整 Key: msg_state:<msgID>
+	MsgStateKeyPrefix = "msg_state:"
+
+	// AckStateKeyPrefix 用户累积确认位置 Key 前缀
+	// 完整 Key: ack_state:<userID>
+	AckStateKeyPrefix = "ack_state:"
+)
+
+// advanceAckScript 只在新的 SeqID 更大时推进确认位置
+var advanceAckScript = redis.NewScript(`
+local cur = tonumber(redis.call("HGET", KEYS[1], "seq") or "")
+if cur and cur >= tonumber(ARGV[1]) then
+	return 0
+end
+redis.call("HSET", KEYS[1], "seq", ARGV[1], "at", ARGV[2])
+redis.call("PEXPIRE", KEYS[1], ARGV[3])
+return 1
+`)
+
+// ErrNotRecipient 只有消息的接收者可以标记已读
+var ErrNotRecipient = errors.New("not the recipient of the message")
+
+// ==================== 结构体定义 ====================
+
+// MessageState 一条消息的投递状态
+// 时间均为 Unix 毫秒，0 表示尚未发生
+type MessageState struct {
+	MsgID       string `json:"msg_id"`
+	ToUserID    string `json:"to_user_id,omitempty"`
+	Stored      bool   `json:"stored"`
+	StoredAt    int64  `json:"stored_at,omitempty"`
+	Delivered   bool   `json:"delivered"`
+	DeliveredAt int64  `json:"delivered_at,omitempty"`
+	Acked       bool   `json:"acked"`
+	AckedAt     int64  `json:"acked_at,omitempty"`
+	Read        bool   `json:"read"`
+	ReadAt      int64  `json:"read_at,omitempty"`
+}
+
+// ReceiptManager 消息状态管理器
+type ReceiptManager struct {
+	ctx context.Context
+}
+
+// NewReceiptManager 创建消息状态管理器
+func NewReceiptManager() *ReceiptManager {
+	return &ReceiptManager{
+		ctx: pkgredis.Context(),
+	}
+}
+
+// ==================== 记录 ====================
+
+// mark 记录消息的某个状态时间（已记录的不覆盖）
+func (m *ReceiptManager) mark(msgID, toUserID, field string) error {
+	key := MsgStateKeyPrefix + msgID
+
+	pipe := pkgredis.Client.Pipeline()
+	if toUserID != "" {
+		pipe.HSetNX(m.ctx, key, "to", toUserID)
+	}
+	pipe.HSetNX(m.ctx, key, field, wallNow().UnixMilli())
+	pipe.Expire(m.ctx, key, OfflineMessageTTL)
+
+	if _, err := pipe.Exec(m.ctx); err != nil {
+		return fmt.Errorf("failed to record %s for %s: %w", field, msgID, err)
+	}
+	return nil
+}
+
+// MarkStored 记录消息已存入离线盒子
+func (m *ReceiptManager) MarkStored(msgID, toUserID string) error {
+	return m.mark(msgID, toUserID, "stored_at")
+}
+
+// MarkDelivered 记录消息已推送到客户端连接
+func (m *ReceiptManager) MarkDelivered(msgID, toUserID string) error {
+	return m.mark(msgID, toUserID, "delivered_at")
+}
+
+// MarkRead 记录消息已读
+// 只有接收者可以标记；没有记录的消息（未追踪或已过期）返回 ErrNotRecipient
+func (m *ReceiptManager) MarkRead(msgID, userID string) error {
+	to, err := pkgredis.Client.HGet(m.ctx, MsgStateKeyPrefix+msgID, "to").Result()
+	if err != nil && !isNotFound(err) {
+		return err
+	}
+	if to != userID {
+		return ErrNotRecipient
+	}
+	return m.mark(msgID, "", "read_at")
+}
+
+// RecordAck 推进用户的累积确认位置（回退的 ACK 被忽略）
+func (m *ReceiptManager) RecordAck(userID string, seqID int64) error {
+	return advanceAckScript.Run(m.ctx, pkgredis.Client, []string{AckStateKeyPrefix + userID},
+		seqID, wallNow().UnixMilli(), OfflineMessageTTL.Milliseconds()).Err()
+}
+
+// ==================== 查询 ====================
+
+// AckedSeq 返回用户的累积确认位置和确认时间
+// 从未确认过时 ok 为 false
+func (m *ReceiptManager) AckedSeq(userID string) (seqID, at int64, ok bool, err error) {
+	vals, err := pkgredis.Client.HMGet(m.ctx, AckStateKeyPrefix+userID, "seq", "at").Result()
+	if err != nil {
+		return 0, 0, false, err
+	}
+	if vals[0] == nil {
+		return 0, 0, false, nil
+	}
+	seqID, _ = strconv.ParseInt(vals[0].(string), 10, 64)
+	if vals[1] != nil {
+		at, _ = strconv.ParseInt(vals[1].(string), 10, 64)
+	}
+	return seqID, at, true, nil
+}
+
+// State 查询消息状态
+// 没有任何记录（未开启追踪或已过期）时返回全部为 false 的状态
+func (m *ReceiptManager) State(msgID string) (*MessageState, error) {
+	fields, err := pkgredis.Client.HGetAll(m.ctx, MsgStateKeyPrefix+msgID).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	state := &MessageState{MsgID: msgID, ToUserID: fields["to"]}
+	state.StoredAt, _ = strconv.ParseInt(fields["stored_at"], 10, 64)
+	state.DeliveredAt, _ = strconv.ParseInt(fields["delivered_at"], 10, 64)
+	state.ReadAt, _ = strconv.ParseInt(fields["read_at"], 10, 64)
+	state.Stored = state.StoredAt > 0
+	state.Delivered = state.DeliveredAt > 0
+	state.Read = state.ReadAt > 0
+
+	// 已读意味着一定收到了
+	if state.Read {
+		state.Acked = true
+	}
+
+	if state.ToUserID != "" {
+		seqID, ok := seqFromMessageID(msgID)
+		ackedSeq, ackedAt, acked, err := m.AckedSeq(state.ToUserID)
+		if err != nil {
+			return nil, err
+		}
+		if ok && acked && seqID <= ackedSeq {
+			state.Acked = true
+			state.AckedAt = ackedAt
+		}
+	}
+	return state, nil
+}
+
+// seqFromMessageID 从消息 ID（<会话 ID>:<SeqID>）中解析 SeqID
+func seqFromMessageID(msgID string) (int64, bool) {
+	i := strings.LastIndexByte(msgID, ':')
+	if i < 0 {
+		return 0, false
+	}
+	seqID, err := strconv.ParseInt(msgID[i+1:], 10, 64)
+	return seqID, err == nil
+}
+
+// ==================== 消息处理器接入 ====================
+
+// SetReceipts 开启消息状态追踪，nil 表示关闭
+func (h *MessageHandler) SetReceipts(receipts *ReceiptManager) {
+	h.receipts = receipts
+}
+
+// trackState 异步记录消息状态，不阻塞投递
+func (h *MessageHandler) trackState(msg *ChatMessage, delivered bool) {
+	if h.receipts == nil || msg.Unsequenced || msg.GroupID != "" || isEphemeral(msg.MsgType) {
+		return
+	}
+	msgID := msg.messageID()
+	go func() {
+		var err error
+		if delivered {
+			err = h.receipts.MarkDelivered(msgID, msg.ToUserID)
+		} else {
+			err = h.receipts.MarkStored(msgID, msg.ToUserID)
+		}
+		if err != nil {
+			log.Printf("[Receipt] %v", err)
+		}
+	}()
+}
+
+// IsAcked 接收者是否已确认该 SeqID 的消息
+// 未开启追踪或查询失败时返回 false
+func (h *MessageHandler) IsAcked(userID string, seqID int64) bool {
+	if h.receipts == nil {
+		return false
+	}
+	ackedSeq, _, ok, err := h.receipts.AckedSeq(userID)
+	if err != nil {
+		log.Printf("[Receipt] Failed to load ack state for %s: %v", userID, err)
+		return false
+	}
+	return ok && seqID <= ackedSeq
+}
+
+// MessageState 查询消息的存储/投递/确认/已读状态
+func (h *MessageHandler) MessageState(msgID string) (*MessageState, error) {
+	if h.receipts == nil {
+		return nil, fmt.Errorf("message state tracking is disabled")
+	}
+	return h.receipts.State(msgID)
+}
+
+// MarkRead 记录接收者已读消息
+func (h *MessageHandler) MarkRead(userID, msgID string) error {
+	if h.receipts == nil {
+		return nil
+	}
+	return h.receipts.MarkRead(msgID, userID)
+}
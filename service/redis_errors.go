@@ -0,0 +1,31 @@
+/*
+Package service - Redis 错误处理约定
+
+=== redis.Nil 不是"出错" ===
+
+go-redis 在 Key 不存在时返回 redis.Nil，它和"Redis 挂了"是完全不同的两件事：
+
+	GET user_gateway:bob
+	  → redis.Nil          用户不在线，应该存离线消息
+	  → connection refused  不知道用户在不在线，不能当作离线处理
+
+各 Manager 统一约定：
+- 用 isNotFound(err) 判断（errors.Is，兼容 %w 包装），不要比较错误字符串
+- Key 不存在时返回明确的结果（零值或 ErrUserOffline 等哨兵错误）
+- 真正的 Redis 错误用 %w 包装后原样返回，由调用方决定如何降级
+*/
+package service
+
+import (
+	"errors"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// ErrUserOffline 用户没有在线会话（user_gateway Key 不存在）
+var ErrUserOffline = errors.New("user is offline")
+
+// isNotFound 判断错误是否表示 Key 不存在
+func isNotFound(err error) bool {
+	return errors.Is(err, redis.Nil)
+}
@@ -0,0 +1,29 @@
+package service
+
+import (
+	"os"
+	"sync"
+	"testing"
+
+	pkgredis "go-im/pkg/redis"
+)
+
+var (
+	testRedisOnce sync.Once
+	testRedisErr  error
+)
+
+// requireRedis 连接 GOIM_TEST_REDIS_ADDR 指定的 Redis（使用 15 号库），未设置时跳过测试
+func requireRedis(t testing.TB) {
+	t.Helper()
+	addr := os.Getenv("GOIM_TEST_REDIS_ADDR")
+	if addr == "" {
+		t.Skip("GOIM_TEST_REDIS_ADDR not set")
+	}
+	testRedisOnce.Do(func() {
+		testRedisErr = pkgredis.Init(&pkgredis.Config{Addr: addr, DB: 15})
+	})
+	if testRedisErr != nil {
+		t.Fatalf("redis %s: %v", addr, testRedisErr)
+	}
+}
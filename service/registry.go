@@ -0,0 +1,151 @@
+/*
+Package service - 网关注册表
+
+=== 使用场景 ===
+
+网关关闭或排空时会通知客户端重连（CmdTypeKick）。
+如果客户端只会重试原来的地址，就会一直撞在正在下线的节点上。
+每个网关定期把自己的地址和连接数登记到 Redis，
+需要客户端重连时，从注册表中挑出其他存活的网关（排序策略见 selector.go）：
+
+	{"reason":"server_restart","reconnect":true,
+	 "alternates":["10.0.0.2:8080","10.0.0.3:8080"]}
+
+=== Redis 数据结构 ===
+
+	Key: gateway_registry   (Hash)
+	┌──────────────┬────────────────────────────────────────────────────┐
+	│ Field (网关)  │ Value (JSON)                                       │
+	├──────────────┼────────────────────────────────────────────────────┤
+	│ gateway_1    │ {"addr":"10.0.0.1:8080","conns":1200,"capacity":10000,...} │
+	│ gateway_2    │ {"addr":"10.0.0.2:8080","conns":800,"unhealthy":true,...}  │
+	└──────────────┴────────────────────────────────────────────────────┘
+
+- 每隔 RegistryAnnounceInterval 登记一次，超过 RegistryStaleAfter 没有更新的条目视为已下线
+- 进程崩溃来不及注销时，条目也会因此自然失效
+- 关闭或进入排空模式时立即注销，不再被推荐给其他网关的客户端
+- 没有配置对外地址（-advertise）的网关不登记，但仍可以读取注册表推荐其他网关
+*/
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	pkgredis "go-im/pkg/redis"
+)
+
+// ==================== 常量定义 ====================
+
+const (
+	// GatewayRegistryKey 网关注册表 Key
+	GatewayRegistryKey = "gateway_registry"
+
+	// RegistryAnnounceInterval 网关登记的间隔
+	RegistryAnnounceInterval = 10 * time.Second
+
+	// RegistryStaleAfter 超过这个时间没有登记的网关视为已下线
+	RegistryStaleAfter = 3 * RegistryAnnounceInterval
+
+	// MaxReconnectAlternates 重连提示中最多附带的备选网关数
+	MaxReconnectAlternates = 3
+)
+
+// ==================== 结构体定义 ====================
+
+// GatewayInfo 注册表中的一个网关
+type GatewayInfo struct {
+	GatewayID string `json:"-"`
+	Addr      string `json:"addr"`       // 客户端可以连接的地址
+	Conns     int    `json:"conns"`      // 当前连接数
+	UpdatedAt int64  `json:"updated_at"` // 最后登记时间（Unix 秒）
+
+	Capacity  int  `json:"capacity,omitempty"`  // 可承载的连接数（0 表示未登记）
+	Unhealthy bool `json:"unhealthy,omitempty"` // 是否不健康（如 Pub/Sub 未订阅，收不到跨网关消息）
+}
+
+// GatewayLoad 网关登记时上报的负载和健康状态
+type GatewayLoad struct {
+	Conns    int  // 当前连接数
+	Capacity int  // 可承载的连接数（0 表示未知）
+	Healthy  bool // 是否健康
+}
+
+// GatewayRegistry 网关注册表
+type GatewayRegistry struct {
+	ctx       context.Context
+	gatewayID string
+	addr      string // 本网关对外地址，为空表示不登记
+}
+
+// NewGatewayRegistry 创建网关注册表
+// addr 为客户端连接本网关使用的地址，为空时本网关只读取注册表、不登记自己
+func NewGatewayRegistry(gatewayID, addr string) *GatewayRegistry {
+	return &GatewayRegistry{
+		ctx:       pkgredis.Context(),
+		gatewayID: gatewayID,
+		addr:      addr,
+	}
+}
+
+// ==================== 登记 ====================
+
+// Announce 登记本网关的地址、负载和健康状态
+func (r *GatewayRegistry) Announce(load GatewayLoad) error {
+	if r.addr == "" {
+		return nil
+	}
+	data, err := json.Marshal(&GatewayInfo{
+		Addr:      r.addr,
+		Conns:     load.Conns,
+		UpdatedAt: wallNow().Unix(),
+		Capacity:  load.Capacity,
+		Unhealthy: !load.Healthy,
+	})
+	if err != nil {
+		return err
+	}
+	if err := pkgredis.Client.HSet(r.ctx, GatewayRegistryKey, r.gatewayID, data).Err(); err != nil {
+		return fmt.Errorf("failed to announce gateway: %w", err)
+	}
+	return nil
+}
+
+// Withdraw 注销本网关（关闭或排空时调用）
+func (r *GatewayRegistry) Withdraw() error {
+	if r.addr == "" {
+		return nil
+	}
+	if err := pkgredis.Client.HDel(r.ctx, GatewayRegistryKey, r.gatewayID).Err(); err != nil {
+		return fmt.Errorf("failed to withdraw gateway: %w", err)
+	}
+	return nil
+}
+
+// ==================== 查询 ====================
+
+// Live 其他存活网关（超过 RegistryStaleAfter 没有登记的视为已下线），顺序不定
+// 排序和过滤不健康、已满的网关由 GatewaySelector 负责
+func (r *GatewayRegistry) Live() ([]*GatewayInfo, error) {
+	fields, err := pkgredis.Client.HGetAll(r.ctx, GatewayRegistryKey).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read gateway registry: %w", err)
+	}
+
+	cutoff := wallNow().Add(-RegistryStaleAfter).Unix()
+	var live []*GatewayInfo
+	for id, raw := range fields {
+		if id == r.gatewayID {
+			continue
+		}
+		var info GatewayInfo
+		if err := json.Unmarshal([]byte(raw), &info); err != nil || info.Addr == "" || info.UpdatedAt < cutoff {
+			continue
+		}
+		info.GatewayID = id
+		live = append(live, &info)
+	}
+	return live, nil
+}
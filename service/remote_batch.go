@@ -0,0 +1,77 @@
+/*
+Package service - 群聊扇出的跨网关合并发布
+
+群成员分布在多个网关上时，逐个成员 deliverRemote 会为每个成员 PUBLISH 一次：
+
+	500 个成员 / 3 个网关   逐条：500 次 PUBLISH
+	                        合并：每批成员 3 次 PUBLISH（一次 Pipeline）
+
+扇出时每条成员消息带上同一个 remoteBatch，deliverRemote 只把消息按目标网关收集起来；
+每批成员（GroupScanChunkSize）投递完成后 flushRemote 用 PublishBatch 合并发布。
+
+PublishBatch 按网关返回失败：目标网关没有订阅者或发布失败时，
+发往该网关的消息逐条改存离线，与 deliverRemote 收到 ErrNoSubscriber 时的处理相同。
+*/
+package service
+
+import (
+	"log"
+	"sync"
+)
+
+// remoteBatch 一批扇出中发往其他网关的消息
+type remoteBatch struct {
+	mu        sync.Mutex
+	byGateway map[string][]*ChatMessage
+}
+
+// newRemoteBatch 创建空的批次
+func newRemoteBatch() *remoteBatch {
+	return &remoteBatch{byGateway: make(map[string][]*ChatMessage)}
+}
+
+// add 收集一条发往 gatewayID 的消息
+func (b *remoteBatch) add(gatewayID string, msg *ChatMessage) {
+	b.mu.Lock()
+	b.byGateway[gatewayID] = append(b.byGateway[gatewayID], msg)
+	b.mu.Unlock()
+}
+
+// take 取出已收集的消息并清空批次
+func (b *remoteBatch) take() map[string][]*ChatMessage {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	taken := b.byGateway
+	b.byGateway = make(map[string][]*ChatMessage)
+	return taken
+}
+
+// flushRemote 合并发布批次中的消息，返回最终没能投递（发布和存离线都失败）的消息数
+func (h *MessageHandler) flushRemote(b *remoteBatch) int {
+	byGateway := b.take()
+	if len(byGateway) == 0 {
+		return 0
+	}
+
+	payload := make(map[string][]*PubSubMessage, len(byGateway))
+	for gatewayID, msgs := range byGateway {
+		pubsubMsgs := make([]*PubSubMessage, len(msgs))
+		for i, msg := range msgs {
+			pubsubMsgs[i] = msg.toPubSubMessage()
+		}
+		payload[gatewayID] = pubsubMsgs
+	}
+
+	failed := 0
+	for gatewayID, err := range h.pubsub.PublishBatch(payload) {
+		msgs := byGateway[gatewayID]
+		log.Printf("[Message] Failed to publish %d messages to gateway %s (%v), storing offline", len(msgs), gatewayID, err)
+		for _, msg := range msgs {
+			if err := h.storeOfflineMessage(msg); err != nil {
+				log.Printf("[Message] Failed to store message %d for %s: %v", msg.SeqID, msg.ToUserID, err)
+				failed++
+			}
+		}
+	}
+	return failed
+}
@@ -0,0 +1,221 @@
+/*
+Package service - 可恢复会话
+
+=== 使用场景 ===
+
+移动网络切换、短暂断网后，客户端要尽快重新连上。完整认证需要重新发送 JWT，
+并且离线盒子里已经收到、还没来得及 ACK 的消息会全部重新推送一遍。
+
+认证时客户端可以请求一个会话 ID（"resumable": true），保存在本地；
+断线后用 CmdTypeReconnect 出示它即可恢复：
+
+	Client                          Gateway                     Redis
+	  │ CmdTypeAuth {token, resumable: true}                      │
+	  │────────────────────────────────▶│ HSET resume:<id> ...     │
+	  │◀────────────────────────────────│                          │
+	  │ AuthAck {session_id, session_ttl}                         │
+	  │            ......  断线  ......  │ HSET delivered, EXPIRE   │
+	  │ CmdTypeReconnect {session_id, last_seq}                   │
+	  │────────────────────────────────▶│ 校验、续期               │
+	  │◀────────────────────────────────│ 确认 last_seq 之前的消息 │
+	  │ AuthAck {resumed: true, ...}      投递之后的离线消息       │
+
+=== 与 Handoff Token 的区别 ===
+
+	            Handoff Token（migration.go）   会话 ID
+	有效期      30 秒                           DefaultResumeTTL，每次断线/恢复后续期
+	使用次数    一次（GETDEL）                  有效期内可多次恢复
+	签发时机    网关主动迁移用户                客户端认证时请求
+
+=== Redis 存储 ===
+
+	resume:<id>  (Hash)
+	├── user_id     带租户作用域的用户 ID
+	├── username    用户名
+	├── device_id   设备 ID（恢复后沿用）
+	├── auth_time   最初认证的时间（Unix 毫秒），按用户吊销时比较
+	├── claims      最初认证的 JWT 声明（JSON），迁移认证时没有
+	└── delivered   上一个连接投递过的最大 SeqID（断线时记录）
+
+TTL 不超过 Token 的剩余有效期：会话 ID 不会让过期的 Token 继续有效，
+恢复后的连接同样被定期复查（见 revocation.go）。
+被踢下线、凭据失效的连接断开时删除会话，不能再恢复。
+
+=== 从最后确认的位置继续 ===
+
+恢复时客户端上报 last_seq（本地收到的最大 SeqID），
+服务端把它截断到 delivered 后作为累积 ACK 处理，再投递剩余的离线消息：
+客户端已经收到的消息不会重新推送，没有真正投递过的消息也不会被误删。
+*/
+package service
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	pkgredis "go-im/pkg/redis"
+	"go-im/server"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// ResumeKeyPrefix 可恢复会话 Key 前缀
+	// 完整 Key: resume:<id>
+	ResumeKeyPrefix = "resume:"
+
+	// DefaultResumeTTL 默认的会话 ID 有效期（从签发、断线或恢复时起算）
+	DefaultResumeTTL = 10 * time.Minute
+)
+
+// ErrInvalidResume 会话 ID 无效或已过期
+var ErrInvalidResume = errors.New("invalid or expired session id")
+
+// ResumableSession 可恢复会话保存的身份
+type ResumableSession struct {
+	UserID    string
+	Username  string
+	DeviceID  string
+	AuthTime  time.Time // 最初认证的时间
+	Claims    *Claims   // 迁移认证时为 nil
+	Delivered int64     // 上一个连接投递过的最大 SeqID
+}
+
+// resumeTTL 会话 ID 的有效期，不超过 Token 的剩余有效期
+func resumeTTL(claims *Claims, ttl time.Duration, now time.Time) time.Duration {
+	if claims != nil && claims.ExpiresAt != nil {
+		ttl = min(ttl, claims.ExpiresAt.Sub(now))
+	}
+	return ttl
+}
+
+// CreateResumableSession 签发会话 ID，返回 ID 和有效期
+func CreateResumableSession(s *ResumableSession, ttl time.Duration) (string, time.Duration, error) {
+	ttl = resumeTTL(s.Claims, ttl, time.Now())
+	if ttl <= 0 {
+		return "", 0, ErrTokenExpired
+	}
+
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", 0, err
+	}
+	id := hex.EncodeToString(buf)
+
+	fields := map[string]interface{}{
+		"user_id":   s.UserID,
+		"username":  s.Username,
+		"device_id": s.DeviceID,
+		"auth_time": s.AuthTime.UnixMilli(),
+	}
+	if s.Claims != nil {
+		data, err := json.Marshal(s.Claims)
+		if err != nil {
+			return "", 0, err
+		}
+		fields["claims"] = data
+	}
+
+	key := ResumeKeyPrefix + id
+	pipe := pkgredis.Client.TxPipeline()
+	pipe.HSet(pkgredis.Context(), key, fields)
+	pipe.Expire(pkgredis.Context(), key, ttl)
+	if _, err := pipe.Exec(pkgredis.Context()); err != nil {
+		return "", 0, fmt.Errorf("failed to store resumable session: %w", err)
+	}
+	return id, ttl, nil
+}
+
+// ResumeSession 读取会话并续期，返回会话和新的有效期
+//
+// 会话不存在时返回 ErrInvalidResume；
+// Token 已过期时删除会话并返回 ErrTokenExpired。吊销由调用方检查（CheckRevoked）
+func ResumeSession(id string, ttl time.Duration, now time.Time) (*ResumableSession, time.Duration, error) {
+	if id == "" {
+		return nil, 0, ErrInvalidResume
+	}
+	key := ResumeKeyPrefix + id
+	vals, err := pkgredis.Client.HGetAll(pkgredis.Context(), key).Result()
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to load resumable session: %w", err)
+	}
+	if vals["user_id"] == "" {
+		return nil, 0, ErrInvalidResume
+	}
+
+	s := &ResumableSession{
+		UserID:   vals["user_id"],
+		Username: vals["username"],
+		DeviceID: vals["device_id"],
+	}
+	authTime, _ := strconv.ParseInt(vals["auth_time"], 10, 64)
+	s.AuthTime = time.UnixMilli(authTime)
+	s.Delivered, _ = strconv.ParseInt(vals["delivered"], 10, 64)
+	if data := vals["claims"]; data != "" {
+		s.Claims = &Claims{}
+		if err := json.Unmarshal([]byte(data), s.Claims); err != nil {
+			return nil, 0, ErrInvalidResume
+		}
+	}
+
+	ttl = resumeTTL(s.Claims, ttl, now)
+	if ttl <= 0 {
+		DropResumableSession(id)
+		return nil, 0, ErrTokenExpired
+	}
+	if err := pkgredis.Client.Expire(pkgredis.Context(), key, ttl).Err(); err != nil {
+		return nil, 0, fmt.Errorf("failed to renew resumable session: %w", err)
+	}
+	return s, ttl, nil
+}
+
+// resumeDeliveredScript 记录投递位置并续期，会话已过期时不重新创建
+// KEYS: resume:<id>
+// ARGV: 最大 SeqID, 有效期(毫秒)
+var resumeDeliveredScript = redis.NewScript(`
+if redis.call("EXISTS", KEYS[1]) == 0 then
+	return 0
+end
+local cur = tonumber(redis.call("HGET", KEYS[1], "delivered") or "0")
+if tonumber(ARGV[1]) > cur then
+	redis.call("HSET", KEYS[1], "delivered", ARGV[1])
+end
+redis.call("PEXPIRE", KEYS[1], ARGV[2])
+return 1
+`)
+
+// NoteResumeDelivered 连接断开时记录它投递过的最大 SeqID，有效期从断线时重新起算
+// Token 在此期间过期时，ResumeSession 会拒绝恢复
+func NoteResumeDelivered(id string, delivered int64, ttl time.Duration) error {
+	err := resumeDeliveredScript.Run(pkgredis.Context(), pkgredis.Client,
+		[]string{ResumeKeyPrefix + id}, delivered, ttl.Milliseconds()).Err()
+	if err != nil {
+		return fmt.Errorf("failed to update resumable session: %w", err)
+	}
+	return nil
+}
+
+// DropResumableSession 删除会话，之后不能再用它恢复
+func DropResumableSession(id string) error {
+	if err := pkgredis.Client.Del(pkgredis.Context(), ResumeKeyPrefix+id).Err(); err != nil {
+		return fmt.Errorf("failed to drop resumable session: %w", err)
+	}
+	return nil
+}
+
+// ResumeAck 恢复会话时确认客户端在之前的连接上已经收到的消息
+//
+// lastSeq 为客户端上报的最大 SeqID，截断到之前的连接投递过的 delivered，
+// 应在投递离线消息之前调用
+func (h *MessageHandler) ResumeAck(conn *server.Connection, lastSeq, delivered int64) error {
+	seqID := min(lastSeq, delivered)
+	if seqID <= 0 || !conn.AdvanceAck(seqID) {
+		return nil
+	}
+	return h.ackUpTo(conn.GetUserID(), seqID)
+}
@@ -0,0 +1,138 @@
+/*
+Package service - Token 吊销与复查
+
+=== 为什么需要复查？===
+
+Token 只在认证时检查一次。用 24 小时 Token 建立的连接在 Token 过期后仍然有效，
+Token 被吊销（账号被盗、用户在别处"退出所有设备"）后也不会断开。
+
+网关定期复查每个已认证连接保存的声明（见 Connection.SetCredential）：
+
+	过期（ExpiresAt 已过）   → 踢下线，reason = token_expired
+	被吊销                   → 踢下线，reason = token_revoked
+
+客户端收到后应重新获取 Token 再连接。
+
+=== 吊销的两种粒度（Redis）===
+
+	revoked_token:<jti>              (String)  单个 Token，TTL = Token 剩余有效期
+	tokens_revoked_before:<userID>   (String)  Unix 秒，该用户在此之前签发的 Token 全部失效，
+	                                           TTL = MaxTokenExpireDuration
+
+- 本服务签发的 Token 带有 jti（RegisteredClaims.ID），可以单独吊销
+- 外部签发、没有 jti 的 Token 只能按用户整体吊销
+- 迁移认证（handoff）的连接没有 Token，按认证时间与用户吊销时间比较
+
+认证时同样检查吊销；查询吊销状态失败（Redis 不可用）时放行，只有过期检查不依赖 Redis。
+*/
+package service
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	pkgredis "go-im/pkg/redis"
+)
+
+// ==================== 常量定义 ====================
+
+const (
+	// RevokedTokenKeyPrefix 单个 Token 的吊销标记 Key 前缀
+	// 完整 Key: revoked_token:<jti>
+	RevokedTokenKeyPrefix = "revoked_token:"
+
+	// RevokedBeforeKeyPrefix 用户级吊销时间 Key 前缀
+	// 完整 Key: tokens_revoked_before:<userID>
+	RevokedBeforeKeyPrefix = "tokens_revoked_before:"
+
+	// DefaultTokenRecheckInterval 默认的连接凭据复查间隔
+	DefaultTokenRecheckInterval = time.Minute
+)
+
+// ErrTokenRevoked Token 已被吊销
+var ErrTokenRevoked = errors.New("token revoked")
+
+// newTokenID 生成 Token 的唯一 ID（jti）
+func newTokenID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// ==================== 吊销 ====================
+
+// RevokeToken 吊销单个 Token（需要 jti），标记保留到 Token 过期
+func RevokeToken(claims *Claims) error {
+	if claims.ID == "" {
+		return errors.New("token has no ID; revoke the user's tokens instead")
+	}
+	ttl := MaxTokenExpireDuration
+	if claims.ExpiresAt != nil {
+		ttl = time.Until(claims.ExpiresAt.Time)
+		if ttl <= 0 {
+			return nil // 已经过期，无需吊销
+		}
+	}
+	if err := pkgredis.Client.Set(pkgredis.Context(), RevokedTokenKeyPrefix+claims.ID, 1, ttl).Err(); err != nil {
+		return fmt.Errorf("failed to revoke token: %w", err)
+	}
+	return nil
+}
+
+// RevokeUserTokens 吊销用户在 before 之前签发的所有 Token（"退出所有设备"）
+// userID 为带租户作用域的 ID
+func RevokeUserTokens(userID string, before time.Time) error {
+	err := pkgredis.Client.Set(pkgredis.Context(), RevokedBeforeKeyPrefix+userID,
+		before.Unix(), MaxTokenExpireDuration).Err()
+	if err != nil {
+		return fmt.Errorf("failed to revoke tokens of %s: %w", userID, err)
+	}
+	return nil
+}
+
+// ==================== 检查 ====================
+
+// CheckRevoked 检查凭据是否被吊销
+//
+// claims 为 nil（迁移认证的连接）时用 authTime 与用户吊销时间比较
+// 被吊销返回 ErrTokenRevoked，其他错误表示查询失败
+func CheckRevoked(userID string, claims *Claims, authTime time.Time) error {
+	issued := authTime
+	keys := []string{RevokedBeforeKeyPrefix + userID}
+	if claims != nil {
+		if claims.IssuedAt != nil {
+			issued = claims.IssuedAt.Time
+		}
+		if claims.ID != "" {
+			keys = append(keys, RevokedTokenKeyPrefix+claims.ID)
+		}
+	}
+
+	vals, err := pkgredis.Client.MGet(pkgredis.Context(), keys...).Result()
+	if err != nil {
+		return fmt.Errorf("failed to check token revocation: %w", err)
+	}
+	if len(vals) > 1 && vals[1] != nil {
+		return ErrTokenRevoked
+	}
+	if s, ok := vals[0].(string); ok {
+		before, _ := strconv.ParseInt(s, 10, 64)
+		if issued.Unix() < before {
+			return ErrTokenRevoked
+		}
+	}
+	return nil
+}
+
+// CheckCredential 复查连接的凭据：先检查过期（不访问 Redis），再检查吊销
+// 返回 ErrTokenExpired、ErrTokenRevoked，或查询吊销状态失败的错误
+func CheckCredential(userID string, claims *Claims, authTime, now time.Time) error {
+	if claims != nil && claims.ExpiresAt != nil && !now.Before(claims.ExpiresAt.Time) {
+		return ErrTokenExpired
+	}
+	return CheckRevoked(userID, claims, authTime)
+}
@@ -0,0 +1,231 @@
+/*
+Package service - 定时消息
+
+=== Redis 数据结构 ===
+
+	Key: scheduled:pending   (ZSet)
+	┌──────────────────────┬──────────────┐
+	│ Score (投递时间 ms)   │ Member (ID)  │
+	├──────────────────────┼──────────────┤
+	│ 1700000000000        │ 9f86d0...    │
+	│ 1700003600000        │ 2c26b4...    │
+	└──────────────────────┴──────────────┘
+
+	Key: scheduled:items     (Hash)
+	Field: ID → Value: 消息 JSON
+
+ZSet 只存 ID，取消时按 ID 直接 ZREM，不需要知道消息内容。
+
+=== 投递流程 ===
+
+每个网关都运行一个轮询协程，每隔 ScheduledPollInterval：
+
+ 1. ZRANGEBYSCORE scheduled:pending -inf <now> LIMIT 0 N  取出到期的 ID
+ 2. ZREM 认领：只有返回 1 的网关负责投递，多个网关不会重复发送
+ 3. HGET + HDEL 取出消息内容
+ 4. 交给 MessageHandler 按普通私聊路由（在线推送 / 跨网关 / 离线）
+
+取消即 ZREM + HDEL：已被认领（正在投递）的消息无法再取消。
+*/
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	pkgredis "go-im/pkg/redis"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// ==================== 常量定义 ====================
+
+const (
+	// ScheduledPendingKey 待投递定时消息的 ZSet
+	ScheduledPendingKey = "scheduled:pending"
+
+	// ScheduledItemsKey 定时消息内容的 Hash
+	ScheduledItemsKey = "scheduled:items"
+
+	// ScheduledPollInterval 到期检查间隔（也是投递时间的最大误差）
+	ScheduledPollInterval = 1 * time.Second
+
+	// ScheduledBatchSize 每次轮询最多处理的到期消息数
+	ScheduledBatchSize = 100
+)
+
+var (
+	// ErrScheduleNotFound 定时消息不存在（已投递、已取消或 ID 错误）
+	ErrScheduleNotFound = errors.New("scheduled message not found")
+
+	// ErrScheduleInPast 投递时间已经过去
+	ErrScheduleInPast = errors.New("deliver_at must be in the future")
+)
+
+// ==================== 结构体定义 ====================
+
+// ScheduledMessage 定时消息
+type ScheduledMessage struct {
+	ID         string `json:"id"`           // 定时消息 ID
+	FromUserID string `json:"from_user_id"` // 发送者
+	ToUserID   string `json:"to_user_id"`   // 接收者
+	Content    string `json:"content"`      // 消息内容
+	DeliverAt  int64  `json:"deliver_at"`   // 投递时间（Unix 毫秒）
+}
+
+// ScheduledManager 定时消息管理器
+type ScheduledManager struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// NewScheduledManager 创建定时消息管理器
+func NewScheduledManager() *ScheduledManager {
+	ctx, cancel := context.WithCancel(pkgredis.Context())
+	return &ScheduledManager{
+		ctx:    ctx,
+		cancel: cancel,
+	}
+}
+
+// ==================== 创建/取消 ====================
+
+// Schedule 创建定时消息，返回消息 ID
+func (m *ScheduledManager) Schedule(fromUserID, toUserID, content string, deliverAt time.Time) (string, error) {
+	if !deliverAt.After(time.Now()) {
+		return "", ErrScheduleInPast
+	}
+
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	msg := &ScheduledMessage{
+		ID:         hex.EncodeToString(buf),
+		FromUserID: fromUserID,
+		ToUserID:   toUserID,
+		Content:    content,
+		DeliverAt:  deliverAt.UnixMilli(),
+	}
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return "", err
+	}
+
+	// 先写内容再写索引，轮询协程不会看到没有内容的 ID
+	pipe := pkgredis.Client.TxPipeline()
+	pipe.HSet(m.ctx, ScheduledItemsKey, msg.ID, data)
+	pipe.ZAdd(m.ctx, ScheduledPendingKey, redis.Z{
+		Score:  float64(msg.DeliverAt),
+		Member: msg.ID,
+	})
+	if _, err := pipe.Exec(m.ctx); err != nil {
+		return "", fmt.Errorf("failed to schedule message: %w", err)
+	}
+
+	log.Printf("[Scheduled] %s scheduled message %s to %s at %s",
+		fromUserID, msg.ID, toUserID, deliverAt.Format(time.RFC3339))
+	return msg.ID, nil
+}
+
+// Cancel 取消尚未投递的定时消息
+// 只有发送者本人可以取消
+func (m *ScheduledManager) Cancel(userID, id string) error {
+	data, err := pkgredis.Client.HGet(m.ctx, ScheduledItemsKey, id).Bytes()
+	if err != nil {
+		if isNotFound(err) {
+			return ErrScheduleNotFound
+		}
+		return fmt.Errorf("failed to get scheduled message: %w", err)
+	}
+
+	var msg ScheduledMessage
+	if err := json.Unmarshal(data, &msg); err != nil || msg.FromUserID != userID {
+		return ErrScheduleNotFound
+	}
+
+	// ZREM 失败说明已被轮询协程认领，正在投递
+	removed, err := pkgredis.Client.ZRem(m.ctx, ScheduledPendingKey, id).Result()
+	if err != nil {
+		return fmt.Errorf("failed to cancel scheduled message: %w", err)
+	}
+	if removed == 0 {
+		return ErrScheduleNotFound
+	}
+	pkgredis.Client.HDel(m.ctx, ScheduledItemsKey, id)
+
+	log.Printf("[Scheduled] %s cancelled scheduled message %s", userID, id)
+	return nil
+}
+
+// ==================== 到期投递 ====================
+
+// Start 启动到期轮询协程
+// send 负责实际发送（通常是 MessageHandler.SendPrivateMessage）
+func (m *ScheduledManager) Start(send func(*ScheduledMessage) error) {
+	go func() {
+		ticker := time.NewTicker(ScheduledPollInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-m.ctx.Done():
+				return
+			case <-ticker.C:
+				m.deliverDue(send)
+			}
+		}
+	}()
+}
+
+// Stop 停止轮询
+func (m *ScheduledManager) Stop() {
+	m.cancel()
+}
+
+// deliverDue 认领并投递所有到期的消息
+func (m *ScheduledManager) deliverDue(send func(*ScheduledMessage) error) {
+	ids, err := pkgredis.Client.ZRangeByScore(m.ctx, ScheduledPendingKey, &redis.ZRangeBy{
+		Min:   "-inf",
+		Max:   strconv.FormatInt(time.Now().UnixMilli(), 10),
+		Count: ScheduledBatchSize,
+	}).Result()
+	if err != nil {
+		if m.ctx.Err() == nil {
+			log.Printf("[Scheduled] Failed to poll due messages: %v", err)
+		}
+		return
+	}
+
+	for _, id := range ids {
+		// ZREM 认领，返回 0 说明其他网关已经认领或刚被取消
+		removed, err := pkgredis.Client.ZRem(m.ctx, ScheduledPendingKey, id).Result()
+		if err != nil || removed == 0 {
+			continue
+		}
+
+		data, err := pkgredis.Client.HGet(m.ctx, ScheduledItemsKey, id).Bytes()
+		pkgredis.Client.HDel(m.ctx, ScheduledItemsKey, id)
+		if err != nil {
+			log.Printf("[Scheduled] Failed to load scheduled message %s: %v", id, err)
+			continue
+		}
+
+		var msg ScheduledMessage
+		if err := json.Unmarshal(data, &msg); err != nil {
+			log.Printf("[Scheduled] Invalid scheduled message %s: %v", id, err)
+			continue
+		}
+
+		if err := send(&msg); err != nil {
+			log.Printf("[Scheduled] Failed to deliver scheduled message %s: %v", id, err)
+		}
+	}
+}
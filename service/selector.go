@@ -0,0 +1,225 @@
+/*
+Package service - 网关选择
+
+=== 为什么只看连接数不够？===
+
+注册表中的网关规格不同：小网关连接数少但可能已经接近上限，
+按连接数排序会把客户端优先引到它上面。每个网关除了连接数，
+还登记自己的容量（-capacity）和健康状态（Pub/Sub 是否订阅成功）：
+
+	gateway_1  conns=1200  capacity=10000  → 负载 12%
+	gateway_2  conns=800   capacity=1000   → 负载 80%
+	gateway_3  conns=50    unhealthy       → 收不到跨网关消息，不推荐
+
+=== 选择策略 ===
+
+	least-loaded   按负载率从低到高（未登记容量的按连接数，排在有容量的之后）
+	weighted       按剩余容量加权随机，把新连接按比例分散到各网关，避免同时涌向同一个
+	round-robin    按网关 ID 轮流，不看负载
+
+所有策略都会排除不健康和已满（连接数达到容量）的网关。
+GatewaySelector 从注册表读取存活网关后交给策略排序，重连提示等需要挑选网关的地方都通过它。
+*/
+package service
+
+import (
+	"errors"
+	"math/rand/v2"
+	"sort"
+	"sync/atomic"
+)
+
+// 选择策略名称（-gateway-select）
+const (
+	StrategyLeastLoaded = "least-loaded"
+	StrategyWeighted    = "weighted"
+	StrategyRoundRobin  = "round-robin"
+)
+
+// ErrUnknownStrategy 未知的网关选择策略
+var ErrUnknownStrategy = errors.New("unknown gateway selection strategy")
+
+// SelectionStrategy 网关排序策略
+// 传入的网关都是健康且未满的，返回推荐顺序（可以就地修改切片）
+type SelectionStrategy interface {
+	Order(gateways []*GatewayInfo) []*GatewayInfo
+}
+
+// NewSelectionStrategy 按名称创建选择策略
+func NewSelectionStrategy(name string) (SelectionStrategy, error) {
+	switch name {
+	case StrategyLeastLoaded:
+		return LeastLoaded{}, nil
+	case StrategyWeighted:
+		return WeightedRandom{}, nil
+	case StrategyRoundRobin:
+		return &RoundRobin{}, nil
+	default:
+		return nil, ErrUnknownStrategy
+	}
+}
+
+// ==================== 负载计算 ====================
+
+// Load 负载率（连接数 / 容量），未登记容量时为 -1
+func (g *GatewayInfo) Load() float64 {
+	if g.Capacity <= 0 {
+		return -1
+	}
+	return float64(g.Conns) / float64(g.Capacity)
+}
+
+// Free 剩余容量，未登记容量时为 -1
+func (g *GatewayInfo) Free() int {
+	if g.Capacity <= 0 {
+		return -1
+	}
+	return max(g.Capacity-g.Conns, 0)
+}
+
+// available 网关是否可以推荐：健康且未满
+func (g *GatewayInfo) available() bool {
+	return !g.Unhealthy && g.Free() != 0
+}
+
+// ==================== 策略 ====================
+
+// LeastLoaded 按负载率从低到高
+// 未登记容量的网关无法比较负载率，按连接数排在有容量的网关之后
+type LeastLoaded struct{}
+
+// Order 实现 SelectionStrategy
+func (LeastLoaded) Order(gateways []*GatewayInfo) []*GatewayInfo {
+	sort.Slice(gateways, func(i, j int) bool {
+		a, b := gateways[i], gateways[j]
+		la, lb := a.Load(), b.Load()
+		if (la < 0) != (lb < 0) {
+			return la >= 0
+		}
+		if la != lb {
+			return la < lb
+		}
+		if a.Conns != b.Conns {
+			return a.Conns < b.Conns
+		}
+		return a.GatewayID < b.GatewayID
+	})
+	return gateways
+}
+
+// WeightedRandom 按剩余容量加权随机排序
+// 未登记容量的网关按已登记网关的平均剩余容量计权（都没有登记时权重相同）
+type WeightedRandom struct{}
+
+// Order 实现 SelectionStrategy
+//
+// 依次按权重抽取（不放回），剩余容量越大越可能排在前面
+func (WeightedRandom) Order(gateways []*GatewayInfo) []*GatewayInfo {
+	weights := make([]float64, len(gateways))
+	known, total := 0, 0
+	for _, g := range gateways {
+		if free := g.Free(); free > 0 {
+			known++
+			total += free
+		}
+	}
+	fallback := 1.0
+	if known > 0 {
+		fallback = float64(total) / float64(known)
+	}
+	for i, g := range gateways {
+		if free := g.Free(); free > 0 {
+			weights[i] = float64(free)
+		} else {
+			weights[i] = fallback
+		}
+	}
+
+	ordered := make([]*GatewayInfo, 0, len(gateways))
+	for len(gateways) > 0 {
+		sum := 0.0
+		for _, w := range weights {
+			sum += w
+		}
+		pick, r := len(gateways)-1, rand.Float64()*sum
+		for i, w := range weights {
+			if r < w {
+				pick = i
+				break
+			}
+			r -= w
+		}
+		ordered = append(ordered, gateways[pick])
+		gateways = append(gateways[:pick], gateways[pick+1:]...)
+		weights = append(weights[:pick], weights[pick+1:]...)
+	}
+	return ordered
+}
+
+// RoundRobin 按网关 ID 轮流作为第一个
+type RoundRobin struct {
+	next atomic.Uint64
+}
+
+// Order 实现 SelectionStrategy
+func (r *RoundRobin) Order(gateways []*GatewayInfo) []*GatewayInfo {
+	if len(gateways) == 0 {
+		return gateways
+	}
+	sort.Slice(gateways, func(i, j int) bool { return gateways[i].GatewayID < gateways[j].GatewayID })
+	start := int((r.next.Add(1) - 1) % uint64(len(gateways)))
+	return append(gateways[start:], gateways[:start]...)
+}
+
+// ==================== 选择器 ====================
+
+// GatewaySelector 从注册表中挑选网关
+type GatewaySelector struct {
+	registry *GatewayRegistry
+	strategy SelectionStrategy
+}
+
+// NewGatewaySelector 创建网关选择器，strategy 为 nil 时使用 LeastLoaded
+func NewGatewaySelector(registry *GatewayRegistry, strategy SelectionStrategy) *GatewaySelector {
+	if strategy == nil {
+		strategy = LeastLoaded{}
+	}
+	return &GatewaySelector{registry: registry, strategy: strategy}
+}
+
+// Select 按策略返回最多 limit 个可推荐的其他网关（limit <= 0 表示不限制）
+func (s *GatewaySelector) Select(limit int) ([]*GatewayInfo, error) {
+	live, err := s.registry.Live()
+	if err != nil {
+		return nil, err
+	}
+	return selectFrom(live, s.strategy, limit), nil
+}
+
+// Addrs 同 Select，只返回地址（用于重连提示）
+func (s *GatewaySelector) Addrs(limit int) ([]string, error) {
+	selected, err := s.Select(limit)
+	if err != nil {
+		return nil, err
+	}
+	addrs := make([]string, len(selected))
+	for i, g := range selected {
+		addrs[i] = g.Addr
+	}
+	return addrs, nil
+}
+
+// selectFrom 过滤不可推荐的网关，按策略排序后截取前 limit 个
+func selectFrom(gateways []*GatewayInfo, strategy SelectionStrategy, limit int) []*GatewayInfo {
+	candidates := make([]*GatewayInfo, 0, len(gateways))
+	for _, g := range gateways {
+		if g.available() {
+			candidates = append(candidates, g)
+		}
+	}
+	ordered := strategy.Order(candidates)
+	if limit > 0 && len(ordered) > limit {
+		ordered = ordered[:limit]
+	}
+	return ordered
+}
@@ -1,164 +1,266 @@
-/*
-Package service - 消息序列号服务
-
-=== 为什么需要序列号？===
-
-在分布式系统中，消息可能通过不同路径到达，导致乱序：
-
-	时间 ─────────────────────────────────────────▶
-
-	发送端:    消息1 ────▶ 消息2 ────▶ 消息3
-	            │          │          │
-	            ▼          ▼          ▼
-	网络:      路径A      路径B      路径A
-	            │          │          │
-	            ▼          ▼          ▼
-	接收端:    消息1 ────▶ 消息3 ────▶ 消息2  (乱序!)
-
-解决方案：为每条消息分配递增的序列号
-
-	发送端:    消息(seq=1) → 消息(seq=2) → 消息(seq=3)
-	                           ↓
-	接收端按序列号排序:    1 → 2 → 3  ✓
-
-=== Redis INCR 的原子性 ===
-
-多个 Gateway 同时生成序列号时：
-
-	Gateway-1: INCR seq:alice:bob → 返回 1
-	Gateway-2: INCR seq:alice:bob → 返回 2  (自动 +1)
-	Gateway-1: INCR seq:alice:bob → 返回 3
-
-Redis 的 INCR 是原子操作，保证：
-- 不会有两个请求得到相同的值
-- 自增操作不会被中断
-
-=== 序列号的作用 ===
-
-1. 消息排序：接收端按 SeqID 排序显示
-2. ACK 机制：客户端 ACK 某个 SeqID，表示该 SeqID 之前的消息都已收到
-3. 断点续传：客户端记住最后收到的 SeqID，重连后请求后续消息
-4. 去重：相同 SeqID 的消息只处理一次
-*/
-package service
-
-import (
-	"context"
-	"fmt"
-	"log"
-
-	pkgredis "go-im/pkg/redis"
-)
-
-// ==================== 常量定义 ====================
-
-const (
-	// SequenceKeyPrefix 序列号 Key 前缀
-	// 完整 Key 格式: seq:alice:bob （会话维度）
-	// 也可以用 seq:group_123 （群聊维度）
-	SequenceKeyPrefix = "seq:"
-)
-
-// ==================== 结构体定义 ====================
-
-// SequenceManager 序列号管理器
-type SequenceManager struct {
-	ctx context.Context
-}
-
-// ==================== 构造函数 ====================
-
-// NewSequenceManager 创建序列号管理器
-func NewSequenceManager() *SequenceManager {
-	return &SequenceManager{
-		ctx: pkgredis.Context(),
-	}
-}
-
-// ==================== 序列号生成 ====================
-
-// NextSeq 生成下一个序列号
-//
-// 使用 Redis INCR 命令：
-// - 如果 Key 不存在，会自动创建并从 1 开始
-// - 每次调用返回递增的值：1, 2, 3, ...
-// - INCR 是原子操作，并发安全
-//
-// 参数:
-//   - conversationID: 会话标识，如 "alice:bob" 或 "group_123"
-//
-// 返回:
-//   - int64: 新生成的序列号
-func (m *SequenceManager) NextSeq(conversationID string) (int64, error) {
-	key := SequenceKeyPrefix + conversationID
-
-	// INCR: 原子自增并返回新值
-	seq, err := pkgredis.Client.Incr(m.ctx, key).Result()
-	if err != nil {
-		return 0, fmt.Errorf("failed to generate sequence: %w", err)
-	}
-	return seq, nil
-}
-
-// NextSeqBatch 批量生成序列号
-//
-// 一次性获取多个序列号，减少 Redis 请求次数
-// 适用于批量发送消息的场景
-//
-// 示例:
-//
-//	start, end, _ := NextSeqBatch("room:123", 10)
-//	// start=1, end=10 → 分配序列号 1,2,3...10
-//
-// 参数:
-//   - conversationID: 会话标识
-//   - count: 需要的序列号数量
-//
-// 返回:
-//   - startSeq: 起始序列号
-//   - endSeq: 结束序列号
-func (m *SequenceManager) NextSeqBatch(conversationID string, count int64) (startSeq int64, endSeq int64, err error) {
-	key := SequenceKeyPrefix + conversationID
-
-	// INCRBY: 原子自增指定值
-	endSeq, err = pkgredis.Client.IncrBy(m.ctx, key, count).Result()
-	if err != nil {
-		return 0, 0, fmt.Errorf("failed to generate sequence batch: %w", err)
-	}
-
-	// 计算起始序列号
-	startSeq = endSeq - count + 1
-	return startSeq, endSeq, nil
-}
-
-// ==================== 查询 ====================
-
-// GetCurrentSeq 获取当前序列号（不自增）
-//
-// 用于查询当前进度，不会改变序列号
-func (m *SequenceManager) GetCurrentSeq(conversationID string) (int64, error) {
-	key := SequenceKeyPrefix + conversationID
-
-	seq, err := pkgredis.Client.Get(m.ctx, key).Int64()
-	if err != nil {
-		if err.Error() == "redis: nil" {
-			// Key 不存在，返回 0
-			return 0, nil
-		}
-		return 0, err
-	}
-	return seq, nil
-}
-
-// ==================== 重置（仅测试用）====================
-
-// ResetSeq 重置序列号
-// 警告：生产环境不应该使用此方法，会导致消息序号重复
-func (m *SequenceManager) ResetSeq(conversationID string) error {
-	key := SequenceKeyPrefix + conversationID
-	return pkgredis.Client.Del(m.ctx, key).Err()
-}
-
-func init() {
-	log.Println("[Sequence] Sequence manager initialized")
-}
+/*
+Package service - 消息序列号服务
+
+=== 为什么需要序列号？===
+
+在分布式系统中，消息可能通过不同路径到达，导致乱序：
+
+	时间 ─────────────────────────────────────────▶
+
+	发送端:    消息1 ────▶ 消息2 ────▶ 消息3
+	            │          │          │
+	            ▼          ▼          ▼
+	网络:      路径A      路径B      路径A
+	            │          │          │
+	            ▼          ▼          ▼
+	接收端:    消息1 ────▶ 消息3 ────▶ 消息2  (乱序!)
+
+解决方案：为每条消息分配递增的序列号
+
+	发送端:    消息(seq=1) → 消息(seq=2) → 消息(seq=3)
+	                           ↓
+	接收端按序列号排序:    1 → 2 → 3  ✓
+
+=== Redis INCR 的原子性 ===
+
+多个 Gateway 同时生成序列号时：
+
+	Gateway-1: INCR seq:alice:bob → 返回 1
+	Gateway-2: INCR seq:alice:bob → 返回 2  (自动 +1)
+	Gateway-1: INCR seq:alice:bob → 返回 3
+
+Redis 的 INCR 是原子操作，保证：
+- 不会有两个请求得到相同的值
+- 自增操作不会被中断
+
+=== 批量分配 ===
+
+NextSeqBatch 用 INCRBY 一次分配一段连续的序列号，与 NextSeq 的 INCR 作用于同一个计数器：
+
+	NextSeq       INCR   seq:room → 1          得到 1
+	NextSeqBatch  INCRBY seq:room 3 → 4        得到 2..4
+	NextSeq       INCR   seq:room → 5          得到 5
+
+任意交错下分配出的区间互不重叠且没有空洞，前提是：
+- 两个 API 使用同一个序列号来源（注入的内存实现也必须同时支持批量分配）
+- count 必须为正数：INCRBY 0 会返回已经分配出去的值，负数会让计数器倒退
+
+=== 序列号的作用 ===
+
+1. 消息排序：接收端按 SeqID 排序显示
+2. ACK 机制：客户端 ACK 某个 SeqID，表示该 SeqID 之前的消息都已收到
+3. 断点续传：客户端记住最后收到的 SeqID，重连后请求后续消息
+4. 去重：相同 SeqID 的消息只处理一次
+*/
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+
+	pkgredis "go-im/pkg/redis"
+)
+
+// ==================== 常量定义 ====================
+
+const (
+	// SequenceKeyPrefix 序列号 Key 前缀
+	// 完整 Key 格式: seq:alice:bob （会话维度）
+	// 也可以用 seq:group_123 （群聊维度）
+	SequenceKeyPrefix = "seq:"
+)
+
+// ErrInvalidSeqCount 批量分配的数量不是正数
+var ErrInvalidSeqCount = errors.New("sequence batch count must be positive")
+
+// ==================== 序列号来源 ====================
+
+// SequenceSource 序列号来源接口
+//
+// 默认实现基于 Redis INCR（RedisSequenceSource）
+// 测试时可以注入内存实现（MemorySequenceSource），
+// 让消息路由的测试不依赖 Redis 状态，序列号分配可复现
+type SequenceSource interface {
+	// Next 返回 key 对应的下一个序列号（从 1 开始递增）
+	Next(key string) (int64, error)
+
+	// NextN 原子地分配 n 个连续序列号，返回其中最大的一个
+	// 与 Next 共用同一个计数器
+	NextN(key string, n int64) (int64, error)
+}
+
+// RedisSequenceSource 基于 Redis INCR 的序列号来源
+type RedisSequenceSource struct {
+	ctx context.Context
+}
+
+// Next 使用 INCR 原子自增
+// 处于发送路径上，受 pkgredis.CriticalContext 的超时限制
+func (s *RedisSequenceSource) Next(key string) (int64, error) {
+	ctx, cancel := pkgredis.CriticalContext()
+	defer cancel()
+	return pkgredis.Client.Incr(ctx, key).Result()
+}
+
+// NextN 使用 INCRBY 原子自增 n
+func (s *RedisSequenceSource) NextN(key string, n int64) (int64, error) {
+	return pkgredis.Client.IncrBy(s.ctx, key, n).Result()
+}
+
+// MemorySequenceSource 内存序列号来源（仅用于测试）
+//
+// 每个 key 独立计数，从 1 开始，结果完全确定
+// 注意：只在单进程内有效，不能用于多网关部署
+type MemorySequenceSource struct {
+	mu       sync.Mutex
+	counters map[string]int64
+}
+
+// NewMemorySequenceSource 创建内存序列号来源
+func NewMemorySequenceSource() *MemorySequenceSource {
+	return &MemorySequenceSource{counters: make(map[string]int64)}
+}
+
+// Next 返回 key 的下一个序列号
+func (s *MemorySequenceSource) Next(key string) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.counters[key]++
+	return s.counters[key], nil
+}
+
+// NextN 分配 n 个连续序列号，返回最大的一个
+func (s *MemorySequenceSource) NextN(key string, n int64) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.counters[key] += n
+	return s.counters[key], nil
+}
+
+// ==================== 结构体定义 ====================
+
+// SequenceManager 序列号管理器
+type SequenceManager struct {
+	ctx context.Context
+
+	// source 序列号来源，默认为 Redis
+	source SequenceSource
+}
+
+// ==================== 构造函数 ====================
+
+// NewSequenceManager 创建序列号管理器（使用 Redis 作为序列号来源）
+func NewSequenceManager() *SequenceManager {
+	ctx := pkgredis.Context()
+	return &SequenceManager{
+		ctx:    ctx,
+		source: &RedisSequenceSource{ctx: ctx},
+	}
+}
+
+// NewSequenceManagerWithSource 使用指定的序列号来源创建管理器
+// 主要用于测试注入确定性的内存实现
+//
+// 注意：GetCurrentSeq、ResetSeq 仍然直接访问 Redis
+func NewSequenceManagerWithSource(source SequenceSource) *SequenceManager {
+	return &SequenceManager{
+		ctx:    pkgredis.Context(),
+		source: source,
+	}
+}
+
+// ==================== 序列号生成 ====================
+
+// NextSeq 生成下一个序列号
+//
+// 使用 Redis INCR 命令：
+// - 如果 Key 不存在，会自动创建并从 1 开始
+// - 每次调用返回递增的值：1, 2, 3, ...
+// - INCR 是原子操作，并发安全
+//
+// 参数:
+//   - conversationID: 会话标识，如 "alice:bob" 或 "group_123"
+//
+// 返回:
+//   - int64: 新生成的序列号
+func (m *SequenceManager) NextSeq(conversationID string) (int64, error) {
+	key := SequenceKeyPrefix + conversationID
+
+	// 默认来源为 Redis INCR: 原子自增并返回新值
+	seq, err := m.source.Next(key)
+	if err != nil {
+		return 0, fmt.Errorf("failed to generate sequence: %w", err)
+	}
+	return seq, nil
+}
+
+// NextSeqBatch 批量生成序列号
+//
+// 一次性获取多个序列号，减少 Redis 请求次数
+// 适用于批量发送消息的场景
+//
+// 示例:
+//
+//	start, end, _ := NextSeqBatch("room:123", 10)
+//	// start=1, end=10 → 分配序列号 1,2,3...10
+//
+// 参数:
+//   - conversationID: 会话标识
+//   - count: 需要的序列号数量
+//
+// 返回:
+//   - startSeq: 起始序列号
+//   - endSeq: 结束序列号
+//
+// count 不是正数时返回 ErrInvalidSeqCount，计数器不变
+func (m *SequenceManager) NextSeqBatch(conversationID string, count int64) (startSeq int64, endSeq int64, err error) {
+	if count <= 0 {
+		return 0, 0, ErrInvalidSeqCount
+	}
+	key := SequenceKeyPrefix + conversationID
+
+	// 默认来源为 Redis INCRBY: 原子自增指定值，与 NextSeq 共用计数器
+	endSeq, err = m.source.NextN(key, count)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to generate sequence batch: %w", err)
+	}
+
+	// 计算起始序列号
+	startSeq = endSeq - count + 1
+	return startSeq, endSeq, nil
+}
+
+// ==================== 查询 ====================
+
+// GetCurrentSeq 获取当前序列号（不自增）
+//
+// 用于查询当前进度，不会改变序列号
+func (m *SequenceManager) GetCurrentSeq(conversationID string) (int64, error) {
+	key := SequenceKeyPrefix + conversationID
+
+	seq, err := pkgredis.Client.Get(m.ctx, key).Int64()
+	if err != nil {
+		if isNotFound(err) {
+			// Key 不存在，返回 0
+			return 0, nil
+		}
+		return 0, err
+	}
+	return seq, nil
+}
+
+// ==================== 重置（仅测试用）====================
+
+// ResetSeq 重置序列号
+// 警告：生产环境不应该使用此方法，会导致消息序号重复
+func (m *SequenceManager) ResetSeq(conversationID string) error {
+	key := SequenceKeyPrefix + conversationID
+	return pkgredis.Client.Del(m.ctx, key).Err()
+}
+
+func init() {
+	log.Println("[Sequence] Sequence manager initialized")
+}
@@ -0,0 +1,121 @@
+package service
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"testing"
+)
+
+// hammerSequence 多个协程交替调用 NextSeq 和 NextSeqBatch，
+// 检查分配到的序列号互不重复且连续（1..总数，没有空洞）
+func hammerSequence(t *testing.T, m *SequenceManager, conversationID string) {
+	const (
+		workers   = 16
+		rounds    = 100
+		batchSize = 5
+	)
+
+	var (
+		mu   sync.Mutex
+		seqs []int64
+		wg   sync.WaitGroup
+	)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			local := make([]int64, 0, rounds*(batchSize+1))
+			for i := 0; i < rounds; i++ {
+				seq, err := m.NextSeq(conversationID)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				local = append(local, seq)
+
+				start, end, err := m.NextSeqBatch(conversationID, batchSize)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if end-start+1 != batchSize {
+					t.Errorf("batch [%d, %d] has %d seqs, want %d", start, end, end-start+1, batchSize)
+				}
+				for s := start; s <= end; s++ {
+					local = append(local, s)
+				}
+			}
+			mu.Lock()
+			seqs = append(seqs, local...)
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	want := workers * rounds * (batchSize + 1)
+	if len(seqs) != want {
+		t.Fatalf("got %d seqs, want %d", len(seqs), want)
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+	for i, seq := range seqs {
+		if seq != int64(i+1) {
+			t.Fatalf("seqs[%d] = %d, want %d (duplicate or gap)", i, seq, i+1)
+		}
+	}
+}
+
+func TestSequenceConcurrentMemory(t *testing.T) {
+	m := NewSequenceManagerWithSource(NewMemorySequenceSource())
+	hammerSequence(t, m, "alice:bob")
+}
+
+func TestSequenceConcurrentRedis(t *testing.T) {
+	requireRedis(t)
+	m := NewSequenceManager()
+	conversationID := "test:hammer"
+	if err := m.ResetSeq(conversationID); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { m.ResetSeq(conversationID) })
+	hammerSequence(t, m, conversationID)
+}
+
+func TestNextSeqBatchInvalidCount(t *testing.T) {
+	m := NewSequenceManagerWithSource(NewMemorySequenceSource())
+	for _, count := range []int64{0, -1} {
+		if _, _, err := m.NextSeqBatch("alice:bob", count); err != ErrInvalidSeqCount {
+			t.Fatalf("NextSeqBatch(%d) error = %v, want ErrInvalidSeqCount", count, err)
+		}
+	}
+	if seq, _ := m.NextSeq("alice:bob"); seq != 1 {
+		t.Fatalf("counter moved after invalid batch: next seq = %d", seq)
+	}
+}
+
+// 内存序列号来源让序列号分配可复现：每个会话独立从 1 开始
+func ExampleNewSequenceManagerWithSource() {
+	m := NewSequenceManagerWithSource(NewMemorySequenceSource())
+
+	a, _ := m.NextSeq(getConversationID("bob", "alice"))
+	b, _ := m.NextSeq(getConversationID("alice", "bob"))
+	start, end, _ := m.NextSeqBatch("alice:bob", 3)
+	other, _ := m.NextSeq(getConversationID("alice", "carol"))
+
+	fmt.Println(a, b, start, end, other)
+	// Output: 1 2 3 5 1
+}
+
+// 同一个来源可以在多个管理器之间共享，计数器按会话累计
+func ExampleMemorySequenceSource() {
+	source := NewMemorySequenceSource()
+	m1 := NewSequenceManagerWithSource(source)
+	m2 := NewSequenceManagerWithSource(source)
+
+	s1, _ := m1.NextSeq("group:dev")
+	s2, _ := m2.NextSeq("group:dev")
+	s3, _ := m1.NextSeq("group:dev")
+
+	fmt.Println(s1, s2, s3)
+	// Output: 1 2 3
+}
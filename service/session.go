@@ -1,217 +1,494 @@
-/*
-Package service - 会话管理服务
-
-=== 会话 (Session) 的作用 ===
-
-会话管理解决两个核心问题：
-
-1. 用户在线状态
-  - 知道某个用户是否在线
-  - 用于消息推送决策（在线推送 vs 离线存储）
-
-2. 用户位置路由
-  - 知道用户连接在哪个 Gateway
-  - 跨节点消息转发的基础
-
-=== Redis 数据结构 ===
-
- 1. 会话信息（Hash）
-    Key: user_session:alice
-    Fields:
-    - gateway_id: "gateway_1"
-    - conn_id: "123"
-    - login_time: "1699999999"
-    TTL: 5分钟（需要心跳续期）
-
- 2. 网关位置（String）
-    Key: user_gateway:alice
-    Value: "gateway_1"
-    TTL: 5分钟
-
-=== 心跳续期机制 ===
-
-	时间轴
-	────┬──────┬──────┬──────┬──────┬────▶
-	    │      │      │      │      │
-	   登录   心跳1  心跳2  心跳3   ...
-	    │      │      │      │
-	    ▼      ▼      ▼      ▼
-	   创建   续期   续期   续期
-	   TTL    TTL    TTL    TTL
-	  5分钟  5分钟  5分钟  5分钟
-
-如果客户端停止发送心跳，Key 自动过期，用户变为离线状态。
-这是利用 Redis 的 EXPIRE 特性实现的轻量级心跳检测。
-*/
-package service
-
-import (
-	"context"
-	"fmt"
-	"log"
-	"time"
-
-	pkgredis "go-im/pkg/redis"
-)
-
-// ==================== 常量定义 ====================
-
-const (
-	// SessionKeyPrefix 会话 Key 前缀
-	// 完整 Key: user_session:alice
-	SessionKeyPrefix = "user_session:"
-
-	// GatewayKeyPrefix 网关位置 Key 前缀
-	// 完整 Key: user_gateway:alice
-	GatewayKeyPrefix = "user_gateway:"
-
-	// SessionTTL 会话过期时间
-	// 客户端需要在此时间内发送心跳，否则会话过期
-	SessionTTL = 5 * time.Minute
-)
-
-// ==================== 结构体定义 ====================
-
-// Session 用户会话信息
-type Session struct {
-	UserID    string    // 用户 ID
-	GatewayID string    // 所在网关
-	ConnID    uint64    // 连接 ID
-	LoginTime time.Time // 登录时间
-}
-
-// SessionManager 会话管理器
-// 负责用户会话的创建、更新、删除和查询
-type SessionManager struct {
-	// gatewayID 当前网关的 ID
-	// 登录时会记录用户在哪个网关
-	gatewayID string
-
-	// ctx Redis 操作的上下文
-	ctx context.Context
-}
-
-// ==================== 构造函数 ====================
-
-// NewSessionManager 创建会话管理器
-// gatewayID: 当前网关的唯一标识
-func NewSessionManager(gatewayID string) *SessionManager {
-	return &SessionManager{
-		gatewayID: gatewayID,
-		ctx:       pkgredis.Context(),
-	}
-}
-
-// ==================== 登录/登出 ====================
-
-// Login 用户登录，创建会话
-//
-// 执行以下 Redis 操作（使用 Pipeline 减少 RTT）：
-// 1. HSET user_session:uid {gateway_id, conn_id, login_time}
-// 2. EXPIRE user_session:uid 300
-// 3. SET user_gateway:uid gateway_id
-// 4. EXPIRE user_gateway:uid 300
-func (m *SessionManager) Login(userID string, connID uint64) error {
-	client := pkgredis.Client
-
-	// 使用 Pipeline 批量执行，减少网络往返
-	pipe := client.Pipeline()
-
-	sessionKey := SessionKeyPrefix + userID
-	gatewayKey := GatewayKeyPrefix + userID
-
-	// 存储会话详情（Hash 结构）
-	pipe.HSet(m.ctx, sessionKey, map[string]interface{}{
-		"gateway_id": m.gatewayID,
-		"conn_id":    connID,
-		"login_time": time.Now().Unix(),
-	})
-	pipe.Expire(m.ctx, sessionKey, SessionTTL)
-
-	// 存储网关位置（用于快速路由查询）
-	pipe.Set(m.ctx, gatewayKey, m.gatewayID, SessionTTL)
-
-	// 执行 Pipeline
-	_, err := pipe.Exec(m.ctx)
-	if err != nil {
-		return fmt.Errorf("failed to create session: %w", err)
-	}
-
-	log.Printf("[Session] User %s logged in on gateway %s", userID, m.gatewayID)
-	return nil
-}
-
-// Logout 用户登出，删除会话
-func (m *SessionManager) Logout(userID string) error {
-	client := pkgredis.Client
-
-	pipe := client.Pipeline()
-	pipe.Del(m.ctx, SessionKeyPrefix+userID)
-	pipe.Del(m.ctx, GatewayKeyPrefix+userID)
-
-	_, err := pipe.Exec(m.ctx)
-	if err != nil {
-		return fmt.Errorf("failed to remove session: %w", err)
-	}
-
-	log.Printf("[Session] User %s logged out", userID)
-	return nil
-}
-
-// ==================== 心跳 ====================
-
-// Heartbeat 心跳续期
-//
-// 刷新会话的 TTL，防止过期
-// 客户端应该每隔 (SessionTTL / 3) 时间发送一次心跳
-// 例如：TTL=5分钟，心跳间隔=100秒
-func (m *SessionManager) Heartbeat(userID string) error {
-	client := pkgredis.Client
-
-	pipe := client.Pipeline()
-	// 刷新两个 Key 的过期时间
-	pipe.Expire(m.ctx, SessionKeyPrefix+userID, SessionTTL)
-	pipe.Expire(m.ctx, GatewayKeyPrefix+userID, SessionTTL)
-
-	_, err := pipe.Exec(m.ctx)
-	return err
-}
-
-// ==================== 查询 ====================
-
-// GetUserGateway 获取用户所在的网关
-//
-// 这是消息路由的核心：
-// 1. A 要发消息给 B
-// 2. 查询 B 在哪个 Gateway
-// 3. 如果在本地，直接推送
-// 4. 如果在远程，通过 Pub/Sub 转发
-func (m *SessionManager) GetUserGateway(userID string) (string, error) {
-	gatewayID, err := pkgredis.Client.Get(m.ctx, GatewayKeyPrefix+userID).Result()
-	if err != nil {
-		return "", err // 包括 redis.Nil（用户不在线）
-	}
-	return gatewayID, nil
-}
-
-// IsOnline 检查用户是否在线
-func (m *SessionManager) IsOnline(userID string) bool {
-	exists, _ := pkgredis.Client.Exists(m.ctx, SessionKeyPrefix+userID).Result()
-	return exists > 0
-}
-
-// GetOnlineUsers 获取所有在线用户（调试用）
-// 注意：KEYS 命令在生产环境要谨慎使用，可能阻塞 Redis
-func (m *SessionManager) GetOnlineUsers() ([]string, error) {
-	keys, err := pkgredis.Client.Keys(m.ctx, SessionKeyPrefix+"*").Result()
-	if err != nil {
-		return nil, err
-	}
-
-	users := make([]string, len(keys))
-	for i, key := range keys {
-		// 去掉前缀，只保留用户 ID
-		users[i] = key[len(SessionKeyPrefix):]
-	}
-	return users, nil
-}
+/*
+Package service - 会话管理服务
+
+=== 会话 (Session) 的作用 ===
+
+会话管理解决两个核心问题：
+
+1. 用户在线状态
+  - 知道某个用户是否在线
+  - 用于消息推送决策（在线推送 vs 离线存储）
+
+2. 用户位置路由
+  - 知道用户连接在哪个 Gateway
+  - 跨节点消息转发的基础
+
+=== Redis 数据结构 ===
+
+ 1. 会话信息（Hash）
+    Key: user_session:alice
+    Fields:
+    - gateway_id: "gateway_1"
+    - conn_id: "123"
+    - login_time: "1699999999"
+    - status: "online" | "away" | "busy"
+    - status_text: 自定义状态文字（可选）
+    - status_auto: "1" 表示 away 是空闲自动设置的（有活动时自动恢复）
+    TTL: 5分钟（需要心跳续期）
+
+ 2. 网关位置（String）
+    Key: user_gateway:alice
+    Value: "gateway_1"
+    TTL: 5分钟
+
+=== 心跳续期机制 ===
+
+	时间轴
+	────┬──────┬──────┬──────┬──────┬────▶
+	    │      │      │      │      │
+	   登录   心跳1  心跳2  心跳3   ...
+	    │      │      │      │
+	    ▼      ▼      ▼      ▼
+	   创建   续期   续期   续期
+	   TTL    TTL    TTL    TTL
+	  5分钟  5分钟  5分钟  5分钟
+
+如果客户端停止发送心跳，Key 自动过期，用户变为离线状态。
+这是利用 Redis 的 EXPIRE 特性实现的轻量级心跳检测。
+
+=== 断线宽限期 ===
+
+移动网络下客户端频繁断线重连，每次断线都立即登出会导致在线状态来回跳变。
+设置宽限期后（SetOfflineGrace），断线时的登出推迟执行：
+
+	断线 ──────── 宽限期 ────────▶ 登出（会话删除，变为离线）
+	  │                 ▲
+	  └── 期间重新登录 ──┘ 取消登出，在线状态不变
+
+宽限期内会话仍指向本网关，发给该用户的消息找不到连接，存入离线盒子，
+重连后照常投递，不会丢失。
+*/
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	pkgredis "go-im/pkg/redis"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// ==================== 常量定义 ====================
+
+const (
+	// SessionKeyPrefix 会话 Key 前缀
+	// 完整 Key: user_session:alice
+	SessionKeyPrefix = "user_session:"
+
+	// GatewayKeyPrefix 网关位置 Key 前缀
+	// 完整 Key: user_gateway:alice
+	GatewayKeyPrefix = "user_gateway:"
+
+	// KnownUsersKey 认证过的用户集合（Set），用于识别不存在的收件人
+	KnownUsersKey = "known_users"
+
+	// SessionTTL 默认的会话过期时间（见 SessionConfig）
+	// 客户端需要在此时间内发送心跳，否则会话过期
+	SessionTTL = 5 * time.Minute
+)
+
+// 在线状态
+const (
+	StatusOnline  = "online"  // 在线
+	StatusAway    = "away"    // 离开（手动设置或空闲自动设置）
+	StatusBusy    = "busy"    // 忙碌
+	StatusOffline = "offline" // 离线（没有会话，只用于查询结果）
+)
+
+// ErrInvalidStatus 不支持的状态值
+var ErrInvalidStatus = errors.New("invalid status")
+
+// ==================== 结构体定义 ====================
+
+// Session 用户会话信息
+type Session struct {
+	UserID    string    // 用户 ID
+	GatewayID string    // 所在网关
+	ConnID    uint64    // 连接 ID
+	LoginTime time.Time // 登录时间
+}
+
+// Presence 用户的在线状态
+type Presence struct {
+	UserID string `json:"user_id"`
+	Status string `json:"status"`         // online / away / busy / offline
+	Text   string `json:"text,omitempty"` // 自定义状态文字
+}
+
+// SessionConfig 会话管理器配置
+type SessionConfig struct {
+	// TTL 会话、网关位置、网关集合和设备列表的过期时间（0 表示 SessionTTL）
+	// 客户端需要在此时间内发送心跳，否则会话过期
+	TTL time.Duration
+}
+
+// SessionManager 会话管理器
+// 负责用户会话的创建、更新、删除和查询
+type SessionManager struct {
+	// gatewayID 当前网关的 ID
+	// 登录时会记录用户在哪个网关
+	gatewayID string
+
+	// ttl 会话过期时间（见 SessionConfig）
+	ttl time.Duration
+
+	// ctx Redis 操作的上下文
+	ctx context.Context
+
+	// presence 在线状态后端（上线/下线/路由查询），默认为 Redis
+	presence PresenceBackend
+
+	// offlineGrace 断线后延迟多久才登出（见 SetOfflineGrace）
+	offlineGrace time.Duration
+
+	// pendingLogouts 宽限期内等待执行的登出（UserID → 连接 ID → 登出）
+	pendingLogouts map[string]map[uint64]*pendingLogout
+	graceMu        sync.Mutex
+}
+
+// ==================== 构造函数 ====================
+
+// NewSessionManager 创建会话管理器
+// gatewayID: 当前网关的唯一标识
+func NewSessionManager(gatewayID string) *SessionManager {
+	return NewSessionManagerWithConfig(gatewayID, SessionConfig{})
+}
+
+// NewSessionManagerWithConfig 使用指定配置创建会话管理器（Redis 在线状态后端）
+func NewSessionManagerWithConfig(gatewayID string, cfg SessionConfig) *SessionManager {
+	ttl := cfg.TTL
+	if ttl <= 0 {
+		ttl = SessionTTL
+	}
+	ctx := pkgredis.Context()
+	return &SessionManager{
+		gatewayID: gatewayID,
+		ttl:       ttl,
+		ctx:       ctx,
+		presence:  &RedisPresenceBackend{ctx: ctx, ttl: ttl},
+	}
+}
+
+// NewSessionManagerWithBackend 使用指定的在线状态后端创建会话管理器
+// 用于接入已有的在线状态服务，或在测试中注入内存实现
+//
+// 注意：在线状态（SetStatus、MarkAway 等）、已知用户和设备列表仍然直接访问 Redis
+func NewSessionManagerWithBackend(gatewayID string, backend PresenceBackend) *SessionManager {
+	return &SessionManager{
+		gatewayID: gatewayID,
+		ttl:       SessionTTL,
+		ctx:       pkgredis.Context(),
+		presence:  backend,
+	}
+}
+
+// TTL 会话过期时间
+func (m *SessionManager) TTL() time.Duration {
+	return m.ttl
+}
+
+// ==================== 登录/登出 ====================
+
+// Login 用户登录，创建会话
+//
+// 1. 在线状态后端记录用户在本网关上线（Redis 后端见 RedisPresenceBackend.SetOnline）
+// 2. 记录为已知用户（首次认证后即可接收消息）
+func (m *SessionManager) Login(userID string, connID uint64) error {
+	// 宽限期内重新登录，取消等待中的登出
+	m.cancelPendingLogouts(userID)
+
+	if err := m.presence.SetOnline(userID, m.gatewayID, connID); err != nil {
+		return err
+	}
+
+	if err := pkgredis.Client.SAdd(m.ctx, KnownUsersKey, userID).Err(); err != nil {
+		return fmt.Errorf("failed to record known user: %w", err)
+	}
+
+	// 多网关在线：记录用户在本网关有连接（见 multihome.go）
+	if err := m.joinGateway(userID); err != nil {
+		return fmt.Errorf("failed to record user gateway: %w", err)
+	}
+
+	log.Printf("[Session] User %s logged in on gateway %s", userID, m.gatewayID)
+	return nil
+}
+
+// Logout 用户登出，删除会话
+func (m *SessionManager) Logout(userID string) error {
+	client := pkgredis.Client
+
+	pipe := client.Pipeline()
+	pipe.Del(m.ctx, SessionKeyPrefix+userID)
+	pipe.Del(m.ctx, GatewayKeyPrefix+userID)
+
+	_, err := pipe.Exec(m.ctx)
+	if err != nil {
+		return fmt.Errorf("failed to remove session: %w", err)
+	}
+
+	log.Printf("[Session] User %s logged out", userID)
+	return nil
+}
+
+// LogoutConn 连接断开时登出
+//
+// 与 Logout 不同，只有会话仍指向本网关的这个连接时才删除；
+// 如果用户已经在别处重新登录，会话保持不变
+func (m *SessionManager) LogoutConn(userID string, connID uint64) error {
+	removed, err := m.presence.SetOffline(userID, m.gatewayID, connID)
+	if err != nil {
+		return err
+	}
+	if removed {
+		log.Printf("[Session] User %s logged out (conn %d closed)", userID, connID)
+	}
+	return nil
+}
+
+// ==================== 断线宽限期 ====================
+
+// pendingLogout 宽限期内等待执行的一次登出
+type pendingLogout struct {
+	timer  *time.Timer
+	logout func()
+}
+
+// SetOfflineGrace 设置断线宽限期，<= 0 表示断线立即登出
+func (m *SessionManager) SetOfflineGrace(grace time.Duration) {
+	m.offlineGrace = grace
+}
+
+// DeferLogout 宽限期之后执行 logout
+//
+// 宽限期内用户在本网关重新登录（Login）时取消；
+// 在其他网关重新登录时 logout 照常执行，LogoutConn 只删除仍指向旧连接的会话，不影响新会话
+// 未设置宽限期时立即执行
+func (m *SessionManager) DeferLogout(userID string, connID uint64, logout func()) {
+	if m.offlineGrace <= 0 {
+		logout()
+		return
+	}
+
+	m.graceMu.Lock()
+	defer m.graceMu.Unlock()
+	if m.pendingLogouts == nil {
+		m.pendingLogouts = make(map[string]map[uint64]*pendingLogout)
+	}
+	if m.pendingLogouts[userID] == nil {
+		m.pendingLogouts[userID] = make(map[uint64]*pendingLogout)
+	}
+	m.pendingLogouts[userID][connID] = &pendingLogout{
+		logout: logout,
+		timer: time.AfterFunc(m.offlineGrace, func() {
+			// 已被取消或已由 FlushPendingLogouts 执行时不再执行
+			if m.takePendingLogout(userID, connID) {
+				logout()
+			}
+		}),
+	}
+}
+
+// takePendingLogout 取出等待中的登出，返回是否存在
+func (m *SessionManager) takePendingLogout(userID string, connID uint64) bool {
+	m.graceMu.Lock()
+	defer m.graceMu.Unlock()
+	if _, ok := m.pendingLogouts[userID][connID]; !ok {
+		return false
+	}
+	delete(m.pendingLogouts[userID], connID)
+	if len(m.pendingLogouts[userID]) == 0 {
+		delete(m.pendingLogouts, userID)
+	}
+	return true
+}
+
+// cancelPendingLogouts 取消用户所有等待中的登出
+func (m *SessionManager) cancelPendingLogouts(userID string) {
+	m.graceMu.Lock()
+	defer m.graceMu.Unlock()
+	pending := m.pendingLogouts[userID]
+	if len(pending) == 0 {
+		return
+	}
+	for _, p := range pending {
+		p.timer.Stop()
+	}
+	delete(m.pendingLogouts, userID)
+	log.Printf("[Session] User %s reconnected within grace period", userID)
+}
+
+// FlushPendingLogouts 立即执行所有等待中的登出（网关关闭时调用）
+// 否则会话会一直指向已经下线的网关，直到 TTL 过期
+func (m *SessionManager) FlushPendingLogouts() {
+	m.graceMu.Lock()
+	var due []func()
+	for _, pending := range m.pendingLogouts {
+		for _, p := range pending {
+			p.timer.Stop()
+			due = append(due, p.logout)
+		}
+	}
+	m.pendingLogouts = nil
+	m.graceMu.Unlock()
+
+	for _, logout := range due {
+		logout()
+	}
+}
+
+// ==================== 在线状态 ====================
+
+// setStatusScript 会话存在时才更新状态，避免为离线用户创建没有 TTL 的残缺会话
+// ARGV[3] 为 "1" 时只在当前状态为 online 时设置（空闲自动离开，不覆盖 busy 等手动状态）
+var setStatusScript = redis.NewScript(`
+if redis.call("EXISTS", KEYS[1]) == 0 then
+	return 0
+end
+if ARGV[3] == "1" then
+	if redis.call("HGET", KEYS[1], "status") ~= "online" then
+		return 0
+	end
+	redis.call("HSET", KEYS[1], "status", ARGV[1], "status_auto", "1")
+	return 1
+end
+redis.call("HSET", KEYS[1], "status", ARGV[1], "status_text", ARGV[2])
+redis.call("HDEL", KEYS[1], "status_auto")
+return 1
+`)
+
+// clearAutoAwayScript 只有自动设置的 away 才恢复为 online
+var clearAutoAwayScript = redis.NewScript(`
+if redis.call("HGET", KEYS[1], "status_auto") == "1" then
+	redis.call("HSET", KEYS[1], "status", "online")
+	redis.call("HDEL", KEYS[1], "status_auto")
+	return 1
+end
+return 0
+`)
+
+// SetStatus 设置用户的状态和自定义文字
+func (m *SessionManager) SetStatus(userID, status, text string) error {
+	switch status {
+	case StatusOnline, StatusAway, StatusBusy:
+	default:
+		return ErrInvalidStatus
+	}
+
+	err := setStatusScript.Run(m.ctx, pkgredis.Client, []string{SessionKeyPrefix + userID},
+		status, text, "0").Err()
+	if err != nil {
+		return fmt.Errorf("failed to set status: %w", err)
+	}
+	return nil
+}
+
+// MarkAway 空闲自动设置为离开（仅当前状态为 online 时生效）
+func (m *SessionManager) MarkAway(userID string) error {
+	return setStatusScript.Run(m.ctx, pkgredis.Client, []string{SessionKeyPrefix + userID},
+		StatusAway, "", "1").Err()
+}
+
+// ClearAway 用户重新活跃时撤销自动设置的离开状态
+func (m *SessionManager) ClearAway(userID string) error {
+	return clearAutoAwayScript.Run(m.ctx, pkgredis.Client, []string{SessionKeyPrefix + userID}).Err()
+}
+
+// GetPresence 查询用户的在线状态
+// 没有会话时返回 StatusOffline
+func (m *SessionManager) GetPresence(userID string) (*Presence, error) {
+	vals, err := pkgredis.Client.HMGet(m.ctx, SessionKeyPrefix+userID, "gateway_id", "status", "status_text").Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get presence: %w", err)
+	}
+
+	presence := &Presence{UserID: userID, Status: StatusOffline}
+	if vals[0] == nil {
+		return presence, nil
+	}
+
+	presence.Status = StatusOnline
+	if s, ok := vals[1].(string); ok && s != "" {
+		presence.Status = s
+	}
+	if t, ok := vals[2].(string); ok {
+		presence.Text = t
+	}
+	return presence, nil
+}
+
+// ==================== 心跳 ====================
+
+// Heartbeat 心跳续期
+//
+// 刷新会话的 TTL，防止过期
+// 客户端应该每隔 (TTL / 3) 时间发送一次心跳
+// 例如：TTL=5分钟，心跳间隔=100秒
+func (m *SessionManager) Heartbeat(userID string) error {
+	client := pkgredis.Client
+
+	pipe := client.Pipeline()
+	// 刷新两个 Key 的过期时间
+	pipe.Expire(m.ctx, SessionKeyPrefix+userID, m.ttl)
+	pipe.Expire(m.ctx, GatewayKeyPrefix+userID, m.ttl)
+
+	// 网关集合：重新加入本网关（集合被淘汰或过期时恢复）并续期
+	pipe.SAdd(m.ctx, UserGatewaysKeyPrefix+userID, m.gatewayID)
+	pipe.Expire(m.ctx, UserGatewaysKeyPrefix+userID, m.ttl)
+
+	_, err := pipe.Exec(m.ctx)
+	return err
+}
+
+// ==================== 查询 ====================
+
+// GetUserGateway 获取用户所在的网关
+//
+// 这是消息路由的核心：
+// 1. A 要发消息给 B
+// 2. 查询 B 在哪个 Gateway
+// 3. 如果在本地，直接推送
+// 4. 如果在远程，通过 Pub/Sub 转发
+//
+// 用户不在线时返回 ErrUserOffline，其他错误表示查询本身失败
+func (m *SessionManager) GetUserGateway(userID string) (string, error) {
+	return m.presence.GetGateway(userID)
+}
+
+// IsKnownUser 检查用户是否至少认证过一次
+func (m *SessionManager) IsKnownUser(userID string) (bool, error) {
+	return pkgredis.Client.SIsMember(m.ctx, KnownUsersKey, userID).Result()
+}
+
+// AddKnownUser 预先登记用户（用于预置账号的部署，用户尚未登录也能收消息）
+func (m *SessionManager) AddKnownUser(userID string) error {
+	return pkgredis.Client.SAdd(m.ctx, KnownUsersKey, userID).Err()
+}
+
+// IsOnline 检查用户是否在线
+// 查询失败时视为不在线
+func (m *SessionManager) IsOnline(userID string) bool {
+	online, _ := m.presence.IsOnline(userID)
+	return online
+}
+
+// GetOnlineUsers 获取所有在线用户（调试用）
+// 注意：KEYS 命令在生产环境要谨慎使用，可能阻塞 Redis
+func (m *SessionManager) GetOnlineUsers() ([]string, error) {
+	keys, err := pkgredis.Client.Keys(m.ctx, SessionKeyPrefix+"*").Result()
+	if err != nil {
+		return nil, err
+	}
+
+	users := make([]string, len(keys))
+	for i, key := range keys {
+		// 去掉前缀，只保留用户 ID
+		users[i] = key[len(SessionKeyPrefix):]
+	}
+	return users, nil
+}
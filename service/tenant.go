@@ -0,0 +1,103 @@
+/*
+Package service - 多租户隔离
+
+=== 设计 ===
+
+多个租户共享同一套 Gateway 和 Redis 时，不同租户可能存在同名用户
+（两个租户都有 "alice"），必须保证他们的会话、离线消息、序列号互不干扰。
+
+本项目的做法：认证时把租户 ID 拼进用户 ID，得到"带作用域的用户 ID"
+
+	租户 acme 的 alice  →  acme/alice
+	默认租户的 alice     →  alice        （单租户部署不受影响）
+
+之后所有 Redis Key 都由带作用域的 ID 构造，天然按租户隔离：
+
+	user_session:acme/alice
+	msg_box:acme/alice
+	seq:acme/alice:acme/bob
+
+群 ID 同理（acme/team）。Pub/Sub 频道按网关划分，
+消息内携带的已经是带作用域的 ID，不需要额外隔离。
+
+=== 跨租户路由 ===
+
+MessageHandler 在路由前检查发送者与接收者的租户是否一致，
+不一致直接拒绝（ErrCrossTenant），不会查询会话，也不会存入离线盒子。
+
+推送给客户端时去掉租户前缀，客户端只看到本租户内的用户 ID。
+
+=== 客户端提交的 ID ===
+
+客户端请求中的用户 ID、群 ID、主题名都是租户内的 ID，一律通过 ScopeForUser 补全作用域。
+含分隔符的 ID 直接拒绝（ErrInvalidClientID）：否则默认租户的用户提交 "acme/team"，
+ScopedID 原样返回，就能加入 acme 的群、查询 acme 用户的资料和在线状态。
+GroupManager、TopicManager 再检查一次成员与群/主题属于同一租户，作为兜底。
+*/
+package service
+
+import (
+	"errors"
+	"strings"
+)
+
+// TenantSeparator 租户 ID 与用户 ID 之间的分隔符
+// 租户 ID 和原始用户 ID 中都不允许出现
+const TenantSeparator = "/"
+
+// ErrCrossTenant 发送者与接收者属于不同租户
+var ErrCrossTenant = errors.New("cross-tenant delivery is not allowed")
+
+// ErrInvalidClientID 客户端提交的 ID 包含租户分隔符
+var ErrInvalidClientID = errors.New("id must not contain " + TenantSeparator)
+
+// ScopedID 将租户内的 ID（用户 ID 或群 ID）转换为带作用域的 ID
+// 默认租户（空字符串）不加前缀
+func ScopedID(tenantID, id string) string {
+	if tenantID == "" {
+		return id
+	}
+	return tenantID + TenantSeparator + id
+}
+
+// ScopeForUser 将客户端提交的租户内 ID 转换为 userID 所在租户的带作用域 ID
+// id 包含分隔符时返回 ErrInvalidClientID，客户端不能借此指定其他租户
+func ScopeForUser(userID, id string) (string, error) {
+	if strings.Contains(id, TenantSeparator) {
+		return "", ErrInvalidClientID
+	}
+	return ScopedID(TenantOf(userID), id), nil
+}
+
+// TenantOf 返回带作用域 ID 所属的租户（默认租户为空字符串）
+func TenantOf(scopedID string) string {
+	tenant, _ := splitScopedID(scopedID)
+	return tenant
+}
+
+// LocalID 去掉租户前缀，返回租户内的 ID
+func LocalID(scopedID string) string {
+	_, id := splitScopedID(scopedID)
+	return id
+}
+
+// ValidTenantIDs 检查认证得到的租户 ID 和用户 ID 是否合法
+// 二者都不能包含分隔符，否则用户可以伪造其他租户的身份
+func ValidTenantIDs(tenantID, userID string) bool {
+	return userID != "" &&
+		!strings.Contains(tenantID, TenantSeparator) &&
+		!strings.Contains(userID, TenantSeparator)
+}
+
+// splitScopedID 按第一个分隔符拆分租户和 ID
+func splitScopedID(scopedID string) (tenant, id string) {
+	if i := strings.Index(scopedID, TenantSeparator); i >= 0 {
+		return scopedID[:i], scopedID[i+1:]
+	}
+	return "", scopedID
+}
+
+// sameTenant 两个带作用域的 ID 是否属于同一租户
+func sameTenant(a, b string) bool {
+	return TenantOf(a) == TenantOf(b)
+}
@@ -0,0 +1,46 @@
+package service
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestScopeForUser(t *testing.T) {
+	cases := []struct {
+		userID, id string
+		want       string
+		err        error
+	}{
+		{"alice", "bob", "bob", nil},
+		{"acme/alice", "bob", "acme/bob", nil},
+		{"acme/alice", "team", "acme/team", nil},
+		// 默认租户的用户不能借分隔符进入其他租户
+		{"alice", "acme/team", "", ErrInvalidClientID},
+		{"acme/alice", "other/bob", "", ErrInvalidClientID},
+		{"acme/alice", "/bob", "", ErrInvalidClientID},
+	}
+	for _, c := range cases {
+		got, err := ScopeForUser(c.userID, c.id)
+		if got != c.want || !errors.Is(err, c.err) {
+			t.Errorf("ScopeForUser(%q, %q) = (%q, %v), want (%q, %v)", c.userID, c.id, got, err, c.want, c.err)
+		}
+	}
+}
+
+func TestGroupRejectsOtherTenants(t *testing.T) {
+	m := &GroupManager{}
+	if err := m.AddMember("acme/team", "alice", "alice"); !errors.Is(err, ErrCrossTenant) {
+		t.Fatalf("AddMember across tenants: err = %v, want ErrCrossTenant", err)
+	}
+	if ok, err := m.IsMember("acme/team", "alice"); ok || err != nil {
+		t.Fatalf("IsMember across tenants = (%v, %v), want (false, nil)", ok, err)
+	}
+
+	topics := &TopicManager{}
+	if err := topics.Subscribe("acme/news", "alice"); !errors.Is(err, ErrCrossTenant) {
+		t.Fatalf("Subscribe across tenants: err = %v, want ErrCrossTenant", err)
+	}
+	if ok, err := topics.IsSubscribed("acme/news", "alice"); ok || err != nil {
+		t.Fatalf("IsSubscribed across tenants = (%v, %v), want (false, nil)", ok, err)
+	}
+}
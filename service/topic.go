@@ -0,0 +1,198 @@
+/*
+Package service - 主题频道
+
+=== 与群聊的区别 ===
+
+主题（如 announcements、sports）是轻量的一对多频道：
+  - 任何用户都可以订阅/取消订阅，没有成员授权
+  - 订阅者之间互相不可见，不能在主题里发言
+  - 消息由服务端发布（PublishToTopic），如运营公告、赛事比分推送
+
+=== Redis 数据结构 ===
+
+	Key: topic_subscribers:<topic>   (Set)   主题的订阅者，发布时 SSCAN 扇出
+	Key: user_topics:<userID>        (Set)   用户订阅的主题，用于列出订阅
+
+=== 投递 ===
+
+发布与群聊扇出相同：SSCAN 分批 + 共享的 fanoutSem，每个订阅者按私聊路由
+（在线推送 / 跨网关转发 / 离线存储）。
+
+一条主题消息只分配一个序列号（seq:topic:<topic>），所有订阅者共享；
+消息类型为 MsgTypeTopic，内部用 GroupID 字段携带主题名，推送给客户端时改为 topic 字段。
+*/
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+
+	pkgredis "go-im/pkg/redis"
+)
+
+// ==================== 常量定义 ====================
+
+const (
+	// TopicSubscribersKeyPrefix 主题订阅者 Key 前缀
+	// 完整 Key: topic_subscribers:<topic>
+	TopicSubscribersKeyPrefix = "topic_subscribers:"
+
+	// UserTopicsKeyPrefix 用户订阅的主题 Key 前缀
+	// 完整 Key: user_topics:<userID>
+	UserTopicsKeyPrefix = "user_topics:"
+
+	// MaxTopicNameLength 主题名的最大长度
+	MaxTopicNameLength = 64
+)
+
+// ErrInvalidTopic 主题名为空或过长
+var ErrInvalidTopic = errors.New("invalid topic name")
+
+// TopicConversationID 主题的会话 ID（用于序列号）
+func TopicConversationID(topic string) string {
+	return "topic:" + topic
+}
+
+// ==================== 主题管理器 ====================
+
+// TopicManager 主题订阅管理器
+type TopicManager struct {
+	ctx context.Context
+}
+
+// NewTopicManager 创建主题订阅管理器
+func NewTopicManager() *TopicManager {
+	return &TopicManager{
+		ctx: pkgredis.Context(),
+	}
+}
+
+// validTopic 检查主题名（可能带租户前缀，只检查本地部分）
+func validTopic(topic string) bool {
+	name := LocalID(topic)
+	return name != "" && len(name) <= MaxTopicNameLength
+}
+
+// Subscribe 订阅主题（重复订阅无效果）
+// 用户与主题不属于同一租户时返回 ErrCrossTenant
+func (m *TopicManager) Subscribe(topic, userID string) error {
+	if !validTopic(topic) {
+		return ErrInvalidTopic
+	}
+	if !sameTenant(topic, userID) {
+		return ErrCrossTenant
+	}
+	pipe := pkgredis.Client.TxPipeline()
+	pipe.SAdd(m.ctx, TopicSubscribersKeyPrefix+topic, userID)
+	pipe.SAdd(m.ctx, UserTopicsKeyPrefix+userID, topic)
+	if _, err := pipe.Exec(m.ctx); err != nil {
+		return fmt.Errorf("failed to subscribe: %w", err)
+	}
+	return nil
+}
+
+// Unsubscribe 取消订阅
+func (m *TopicManager) Unsubscribe(topic, userID string) error {
+	pipe := pkgredis.Client.TxPipeline()
+	pipe.SRem(m.ctx, TopicSubscribersKeyPrefix+topic, userID)
+	pipe.SRem(m.ctx, UserTopicsKeyPrefix+userID, topic)
+	if _, err := pipe.Exec(m.ctx); err != nil {
+		return fmt.Errorf("failed to unsubscribe: %w", err)
+	}
+	return nil
+}
+
+// IsSubscribed 用户是否订阅了主题，其他租户的用户一律没有订阅
+func (m *TopicManager) IsSubscribed(topic, userID string) (bool, error) {
+	if !sameTenant(topic, userID) {
+		return false, nil
+	}
+	return pkgredis.Client.SIsMember(m.ctx, TopicSubscribersKeyPrefix+topic, userID).Result()
+}
+
+// Topics 用户订阅的主题（按名称排序）
+func (m *TopicManager) Topics(userID string) ([]string, error) {
+	topics, err := pkgredis.Client.SMembers(m.ctx, UserTopicsKeyPrefix+userID).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list topics: %w", err)
+	}
+	sort.Strings(topics)
+	return topics, nil
+}
+
+// ScanSubscribers 分批枚举主题订阅者（与 GroupManager.ScanMembers 相同的 SSCAN 遍历）
+func (m *TopicManager) ScanSubscribers(topic string, chunkSize int64, fn func(subscribers []string) error) error {
+	key := TopicSubscribersKeyPrefix + topic
+	var cursor uint64
+	for {
+		subscribers, next, err := pkgredis.Client.SScan(m.ctx, key, cursor, "", chunkSize).Result()
+		if err != nil {
+			return fmt.Errorf("failed to scan topic subscribers: %w", err)
+		}
+
+		if len(subscribers) > 0 {
+			if err := fn(subscribers); err != nil {
+				return err
+			}
+		}
+
+		if next == 0 {
+			return nil
+		}
+		cursor = next
+	}
+}
+
+// ==================== 发布 ====================
+
+// SetTopics 开启主题频道（nil 表示关闭，发布返回错误）
+func (h *MessageHandler) SetTopics(topics *TopicManager) {
+	h.topics = topics
+}
+
+// PublishToTopic 向主题的所有订阅者发布消息
+//
+// 订阅者在线时实时推送，离线时存入离线盒子
+// 扇出过程中取消订阅的用户不再收到这条消息
+func (h *MessageHandler) PublishToTopic(topic string, content []byte) error {
+	if h.topics == nil {
+		return errors.New("topics are not enabled")
+	}
+	if !validTopic(topic) {
+		return ErrInvalidTopic
+	}
+
+	seqID, err := h.sequence.NextSeq(TopicConversationID(topic))
+	if err != nil {
+		seqID = h.nextFallbackSeq()
+		log.Printf("[Topic] Sequence unavailable for topic %s, using fallback seq %d: %v", topic, seqID, err)
+	}
+	timestamp := wallNow().UnixMilli()
+
+	scan := func(fn func(subscribers []string) error) error {
+		return h.topics.ScanSubscribers(topic, GroupScanChunkSize, fn)
+	}
+	remote := newRemoteBatch()
+	return h.fanout("topic "+topic, TopicConversationID(topic), scan, func(string) bool { return true },
+		func(subscriber string) error {
+			if ok, err := h.topics.IsSubscribed(topic, subscriber); err == nil && !ok {
+				return nil
+			}
+			return h.routeMessage(&ChatMessage{
+				ToUserID:  subscriber,
+				Content:   string(content),
+				MsgType:   MsgTypeTopic,
+				SeqID:     seqID,
+				Timestamp: timestamp,
+				GroupID:   topic,
+
+				Unsequenced: seqID < 0,
+
+				remote: remote,
+			})
+		},
+		func() int { return h.flushRemote(remote) })
+}
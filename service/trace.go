@@ -0,0 +1,102 @@
+/*
+Package service - 帧追踪目标
+
+=== 运行时开关 ===
+
+追踪目标保存在 Redis 中，所有网关定期读取（-trace-sync），
+运维不需要知道用户连接在哪个网关，也不需要重启：
+
+	trace_targets (Set)
+	┌────────────────────────┐
+	│ user:alice             │  追踪 alice 在所有网关上的连接
+	│ conn:gateway_1:12      │  只追踪 gateway_1 上的 conn-12
+	└────────────────────────┘
+
+	SADD trace_targets user:alice     # 开启
+	SREM trace_targets user:alice     # 关闭
+	DEL  trace_targets                # 全部关闭
+
+用户 ID 为带租户作用域的 ID（见 tenant.go）。
+每个网关只取 user: 目标和属于自己的 conn: 目标，交给 ConnectionManager.SetTraceTargets。
+*/
+package service
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	pkgredis "go-im/pkg/redis"
+)
+
+const (
+	// TraceTargetsKey 追踪目标集合 Key
+	TraceTargetsKey = "trace_targets"
+
+	// DefaultTraceSyncInterval 默认的追踪目标同步间隔
+	DefaultTraceSyncInterval = 5 * time.Second
+
+	traceUserPrefix = "user:"
+	traceConnPrefix = "conn:"
+)
+
+// TraceUserTarget 追踪某个用户的目标名称
+func TraceUserTarget(userID string) string {
+	return traceUserPrefix + userID
+}
+
+// TraceConnTarget 追踪某个网关上某个连接的目标名称
+func TraceConnTarget(gatewayID string, connID uint64) string {
+	return traceConnPrefix + gatewayID + ":" + strconv.FormatUint(connID, 10)
+}
+
+// SetTraceTarget 开启或关闭一个追踪目标（TraceUserTarget / TraceConnTarget）
+func SetTraceTarget(target string, on bool) error {
+	var err error
+	if on {
+		err = pkgredis.Client.SAdd(pkgredis.Context(), TraceTargetsKey, target).Err()
+	} else {
+		err = pkgredis.Client.SRem(pkgredis.Context(), TraceTargetsKey, target).Err()
+	}
+	if err != nil {
+		return fmt.Errorf("failed to update trace target %s: %w", target, err)
+	}
+	return nil
+}
+
+// LoadTraceTargets 读取与本网关相关的追踪目标
+// 格式不正确的目标和属于其他网关的连接被忽略
+func LoadTraceTargets(gatewayID string) (connIDs []uint64, userIDs []string, err error) {
+	targets, err := pkgredis.Client.SMembers(pkgredis.Context(), TraceTargetsKey).Result()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to load trace targets: %w", err)
+	}
+	connIDs, userIDs = parseTraceTargets(gatewayID, targets)
+	return connIDs, userIDs, nil
+}
+
+// parseTraceTargets 从目标名称中取出本网关的连接 ID 和用户 ID
+func parseTraceTargets(gatewayID string, targets []string) (connIDs []uint64, userIDs []string) {
+	for _, t := range targets {
+		if uid, ok := strings.CutPrefix(t, traceUserPrefix); ok {
+			if uid != "" {
+				userIDs = append(userIDs, uid)
+			}
+			continue
+		}
+		rest, ok := strings.CutPrefix(t, traceConnPrefix)
+		if !ok {
+			continue
+		}
+		// 网关 ID 可能包含冒号，连接 ID 取最后一段
+		i := strings.LastIndexByte(rest, ':')
+		if i < 0 || rest[:i] != gatewayID {
+			continue
+		}
+		if id, err := strconv.ParseUint(rest[i+1:], 10, 64); err == nil {
+			connIDs = append(connIDs, id)
+		}
+	}
+	return connIDs, userIDs
+}
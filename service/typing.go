@@ -0,0 +1,190 @@
+/*
+Package service - 正在输入提示
+
+=== 问题 ===
+
+客户端每敲一个键都可能发一次 typing=true：
+  - 接收方被大量提示帧淹没
+  - 客户端停止输入后如果没有发 typing=false（切后台、断网），
+    对方会一直显示"正在输入..."
+
+=== 服务端处理 ===
+
+按 (发送者, 接收者) 维护状态：
+
+	typing=true  ──▶ 距上次转发不足 TypingDebounce：丢弃
+	             ──▶ 否则转发，并重置过期计时器
+	超过 TypingTimeout 没有新的 typing=true ──▶ 自动向接收方发送 typing=false
+	typing=false ──▶ 取消计时器并转发（之前转发过 true 时）
+
+=== 临时消息 ===
+
+输入提示是临时消息（ephemeral）：不分配序列号、不存离线、不需要 ACK。
+接收方不在线就直接丢弃，上线后补发"正在输入"没有意义。
+*/
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"go-im/protocol"
+	"log"
+	"sync"
+	"time"
+)
+
+// ==================== 常量定义 ====================
+
+const (
+	// TypingDebounce 同一对用户之间转发 typing=true 的最小间隔
+	TypingDebounce = 1 * time.Second
+
+	// TypingTimeout 收不到新的 typing=true 后自动结束"正在输入"
+	TypingTimeout = 6 * time.Second
+)
+
+// ==================== 结构体定义 ====================
+
+// TypingNotification 推送给接收方的输入提示
+type TypingNotification struct {
+	UserID string `json:"user_id"` // 正在输入的用户
+	Typing bool   `json:"typing"`  // 是否正在输入
+}
+
+// typingState 一对用户之间的输入状态
+type typingState struct {
+	lastForward time.Time   // 上次转发 typing=true 的时间
+	expiry      *time.Timer // 自动结束计时器
+}
+
+// TypingManager 输入提示的防抖与自动过期（网关内存状态）
+//
+// 同一个用户的输入信号只会到达他所在的网关，因此状态不需要跨网关共享
+type TypingManager struct {
+	mu     sync.Mutex
+	states map[string]*typingState // "from\x00to" → 状态
+
+	// forward 实际向接收方发送提示
+	forward func(fromUserID, toUserID string, typing bool)
+}
+
+// NewTypingManager 创建输入提示管理器
+// forward 负责把提示发给接收方（通常是 MessageHandler.SendTyping）
+func NewTypingManager(forward func(fromUserID, toUserID string, typing bool)) *TypingManager {
+	return &TypingManager{
+		states:  make(map[string]*typingState),
+		forward: forward,
+	}
+}
+
+// Update 处理客户端上报的输入状态
+func (m *TypingManager) Update(fromUserID, toUserID string, typing bool) {
+	key := fromUserID + "\x00" + toUserID
+
+	m.mu.Lock()
+	state := m.states[key]
+
+	if !typing {
+		if state == nil {
+			m.mu.Unlock()
+			return
+		}
+		state.expiry.Stop()
+		delete(m.states, key)
+		m.mu.Unlock()
+		m.forward(fromUserID, toUserID, false)
+		return
+	}
+
+	send := false
+	if state == nil {
+		state = &typingState{}
+		state.expiry = time.AfterFunc(TypingTimeout, func() { m.expire(key, state, fromUserID, toUserID) })
+		m.states[key] = state
+		send = true
+	} else {
+		state.expiry.Reset(TypingTimeout)
+		send = time.Since(state.lastForward) >= TypingDebounce
+	}
+	if send {
+		state.lastForward = time.Now()
+	}
+	m.mu.Unlock()
+
+	if send {
+		m.forward(fromUserID, toUserID, true)
+	}
+}
+
+// expire 超时未收到新的输入信号，自动结束
+func (m *TypingManager) expire(key string, state *typingState, fromUserID, toUserID string) {
+	m.mu.Lock()
+	// 状态已被 typing=false 删除或替换，计时器触发与 Stop 竞争时忽略
+	if m.states[key] != state {
+		m.mu.Unlock()
+		return
+	}
+	delete(m.states, key)
+	m.mu.Unlock()
+
+	m.forward(fromUserID, toUserID, false)
+}
+
+// ==================== 临时消息投递 ====================
+
+// SendTyping 向接收方发送输入提示（临时消息）
+func (h *MessageHandler) SendTyping(fromUserID, toUserID string, typing bool) {
+	if !sameTenant(fromUserID, toUserID) {
+		return
+	}
+
+	payload, _ := json.Marshal(&TypingNotification{
+		UserID: LocalID(fromUserID),
+		Typing: typing,
+	})
+	msg := &ChatMessage{
+		FromUserID: fromUserID,
+		ToUserID:   toUserID,
+		Content:    string(payload),
+		MsgType:    MsgTypeTyping,
+		Timestamp:  wallNow().UnixMilli(),
+	}
+
+	if err := h.routeEphemeral(msg); err != nil {
+		log.Printf("[Typing] Failed to send typing to %s: %v", toUserID, err)
+	}
+}
+
+// routeEphemeral 路由临时消息：只推送给在线用户，不存离线
+func (h *MessageHandler) routeEphemeral(msg *ChatMessage) error {
+	targetGateway, err := h.session.GetUserGateway(msg.ToUserID)
+	if err != nil {
+		// 不在线（或查询失败）直接丢弃
+		return nil
+	}
+	if targetGateway == h.gatewayID {
+		h.deliverEphemeral(msg)
+		return nil
+	}
+	err = h.pubsub.Publish(targetGateway, msg.toPubSubMessage())
+	if errors.Is(err, ErrNoSubscriber) {
+		return nil
+	}
+	return err
+}
+
+// deliverEphemeral 本地推送临时消息，连接不存在则丢弃
+func (h *MessageHandler) deliverEphemeral(msg *ChatMessage) {
+	conn := h.connManager.GetByUserID(msg.ToUserID)
+	if conn == nil || conn.IsClosed() {
+		return
+	}
+	data, err := json.Marshal(msg.clientView())
+	if err != nil {
+		return
+	}
+	conn.Send(&protocol.Message{
+		CmdType: cmdTypeFor(msg.MsgType),
+		Body:    data,
+	})
+}
@@ -0,0 +1,62 @@
+/*
+Package service - 未送达消息查询
+
+=== 使用场景 ===
+
+发送者想知道自己发给若干联系人的消息中，还有多少没送达（对方离线，消息在离线盒子里）：
+
+	Undelivered(alice, [bob, carol])
+	  bob   在线                     → pending = 0
+	  carol 离线，盒子里有 3 条来自 alice → pending = 3
+
+=== 实现 ===
+
+离线盒子按 SeqID 组织，没有按发送者的索引；
+为每条消息额外维护发送者索引会让所有写入和 ACK 都多一次 Redis 操作，
+而这个查询是低频的，因此直接扫描收件人的离线盒子（见 OfflineManager.CountFrom）。
+每次查询的收件人数量限制为 MaxUndeliveredRecipients，扫描成本有上限。
+
+在线的收件人不扫描：离线盒子里可能还有等待 ACK 的积压，但它们正在投递中，不算"未送达"。
+*/
+package service
+
+import "errors"
+
+// MaxUndeliveredRecipients 一次查询最多的收件人数
+const MaxUndeliveredRecipients = 50
+
+// ErrTooManyRecipients 查询的收件人过多
+var ErrTooManyRecipients = errors.New("too many recipients in one query")
+
+// RecipientDelivery 一个收件人的送达情况
+type RecipientDelivery struct {
+	UserID  string `json:"user_id"`
+	Online  bool   `json:"online"`
+	Pending int    `json:"pending"` // 离线盒子中来自发送者的消息数（在线时为 0）
+}
+
+// Undelivered 查询发送者发给各收件人、仍在离线盒子中等待的消息数
+// recipients 与 fromUserID 使用同一种作用域的 ID（带租户前缀）
+func (h *MessageHandler) Undelivered(fromUserID string, recipients []string) ([]*RecipientDelivery, error) {
+	if len(recipients) > MaxUndeliveredRecipients {
+		return nil, ErrTooManyRecipients
+	}
+
+	result := make([]*RecipientDelivery, 0, len(recipients))
+	for _, to := range recipients {
+		if !sameTenant(fromUserID, to) {
+			return nil, ErrCrossTenant
+		}
+
+		d := &RecipientDelivery{UserID: to, Online: h.session.IsOnline(to)}
+		if !d.Online {
+			n, err := h.offline.CountFrom(to, fromUserID)
+			if err != nil {
+				return nil, err
+			}
+			d.Pending = n
+		}
+		result = append(result, d)
+	}
+	return result, nil
+}
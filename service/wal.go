@@ -0,0 +1,292 @@
+/*
+Package service - 预写日志（WAL，可选）
+
+=== 为什么需要 WAL？===
+
+默认的投递路径中，实时推送的消息只存在于网关内存和 TCP 缓冲区里：
+
+	发送者 ──▶ Gateway-1 ──Pub/Sub──▶ Gateway-2 ──▶ 接收者
+	                 ▲                      ▲
+	            崩溃：消息丢失          崩溃：消息丢失
+
+优雅关闭时未确认的消息会放回离线盒子（见 RequeueUnacked），但进程崩溃时来不及。
+需要"至少一次"语义的部署可以开启 WAL：
+
+ 1. 消息被接受（分配序列号之后、路由之前）先追加到 Redis Stream
+ 2. 接收者 ACK 之后才删除
+ 3. 网关重启时重放自己写入的、仍未确认的条目
+
+重放可能造成重复投递，客户端按 SeqID 去重。
+
+=== Redis 数据结构 ===
+
+	Key: wal:<接收者>        (Stream)
+	Entry: seq=42  gw=gateway_1  msg={PubSubMessage JSON}
+	TTL: 与离线消息相同，每次追加续期
+
+	Key: wal_index:<接收者>  (Sorted Set)
+	Score: SeqID  Member: <Stream 条目 ID>|<消息 ID>
+	TTL: 与 Stream 相同
+
+	Key: wal_users:<网关ID>  (Set)
+	Members: 该网关写过 WAL 的接收者，重启时据此找到需要重放的 Stream
+
+按接收者组织 Stream：ACK 发生在接收者所在的网关，不需要知道消息是哪个网关接受的。
+索引按 SeqID 找到条目 ID，ACK 时直接 XDEL，不需要扫描整个 Stream。
+
+=== 代价 ===
+
+每条消息多一次 XADD + ZADD（同一个脚本），每次 ACK 多一次 ZRANGEBYSCORE + XDEL + ZREM，
+与 Stream 长度无关；只记录私聊路径（私聊、回应、置顶等通知），临时消息（正在输入）不记录。
+
+Stream 与索引各自裁剪到 MaxWALEntries：长期不 ACK 的接收者超出上限时，
+索引丢掉的条目无法再被 ACK 删除，只会在 TTL 到期前被多重放一次（客户端按 SeqID 去重）。
+*/
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	pkgredis "go-im/pkg/redis"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// ==================== 常量定义 ====================
+
+const (
+	// WALKeyPrefix 预写日志 Key 前缀
+	// 完整 Key: wal:<userID>
+	WALKeyPrefix = "wal:"
+
+	// WALIndexKeyPrefix WAL 条目索引 Key 前缀
+	// 完整 Key: wal_index:<userID>
+	WALIndexKeyPrefix = "wal_index:"
+
+	// WALUsersKeyPrefix 网关写过 WAL 的接收者集合 Key 前缀
+	// 完整 Key: wal_users:<gatewayID>
+	WALUsersKeyPrefix = "wal_users:"
+
+	// MaxWALEntries 每个接收者最多保留的 WAL 条目数（近似裁剪）
+	// 与离线盒子上限一致，长期不 ACK 的接收者不会无限增长
+	MaxWALEntries = MaxOfflineMessages
+)
+
+// ==================== WAL 管理器 ====================
+
+// WALManager 预写日志管理器
+type WALManager struct {
+	ctx       context.Context
+	gatewayID string
+}
+
+// NewWALManager 创建预写日志管理器
+func NewWALManager(gatewayID string) *WALManager {
+	return &WALManager{
+		ctx:       pkgredis.Context(),
+		gatewayID: gatewayID,
+	}
+}
+
+// walAppendScript 追加条目并写入索引
+// KEYS[1] Stream，KEYS[2] 索引，KEYS[3] 网关的接收者集合
+// ARGV[1] seq，ARGV[2] gw，ARGV[3] msg，ARGV[4] 消息 ID，ARGV[5] 上限，ARGV[6] 接收者，ARGV[7] TTL（秒）
+var walAppendScript = redis.NewScript(`
+local id = redis.call("XADD", KEYS[1], "MAXLEN", "~", ARGV[5], "*", "seq", ARGV[1], "gw", ARGV[2], "msg", ARGV[3])
+redis.call("ZADD", KEYS[2], ARGV[1], id .. "|" .. ARGV[4])
+redis.call("ZREMRANGEBYRANK", KEYS[2], 0, -tonumber(ARGV[5]) - 1)
+redis.call("EXPIRE", KEYS[1], ARGV[7])
+redis.call("EXPIRE", KEYS[2], ARGV[7])
+redis.call("SADD", KEYS[3], ARGV[6])
+return id
+`)
+
+// Append 追加一条已接受的消息
+func (m *WALManager) Append(msg *ChatMessage) error {
+	data, err := json.Marshal(msg.toPubSubMessage())
+	if err != nil {
+		return err
+	}
+
+	keys := []string{
+		WALKeyPrefix + msg.ToUserID,
+		WALIndexKeyPrefix + msg.ToUserID,
+		WALUsersKeyPrefix + m.gatewayID,
+	}
+	err = walAppendScript.Run(m.ctx, pkgredis.Client, keys,
+		msg.SeqID, m.gatewayID, data, msg.messageID(), MaxWALEntries, msg.ToUserID,
+		int64(OfflineMessageTTL/time.Second)).Err()
+	if err != nil {
+		return fmt.Errorf("failed to append to WAL: %w", err)
+	}
+	return nil
+}
+
+// Ack 删除接收者已确认的条目
+// 与离线盒子的 ACK 一致：SeqID 不大于 seqID 的条目都视为已确认
+func (m *WALManager) Ack(userID string, seqID int64) error {
+	members, err := pkgredis.Client.ZRangeByScore(m.ctx, WALIndexKeyPrefix+userID, &redis.ZRangeBy{
+		Min: "-inf",
+		Max: strconv.FormatInt(seqID, 10),
+	}).Result()
+	if err != nil {
+		return fmt.Errorf("failed to read WAL index: %w", err)
+	}
+	return m.remove(userID, members)
+}
+
+// AckMessages 删除接收者选择性确认的条目（按消息 ID，见 MessageID）
+// 每个 SeqID 一次 ZRANGEBYSCORE（同一个 Pipeline），再按消息 ID 精确匹配
+func (m *WALManager) AckMessages(userID string, msgIDs []string) error {
+	wanted := make(map[string]bool, len(msgIDs))
+	cmds := make(map[int64]*redis.StringSliceCmd, len(msgIDs))
+	pipe := pkgredis.Client.Pipeline()
+	for _, id := range msgIDs {
+		_, seq, ok := parseMessageID(id)
+		if !ok {
+			continue
+		}
+		wanted[id] = true
+		if cmds[seq] == nil {
+			score := strconv.FormatInt(seq, 10)
+			cmds[seq] = pipe.ZRangeByScore(m.ctx, WALIndexKeyPrefix+userID, &redis.ZRangeBy{Min: score, Max: score})
+		}
+	}
+	if len(cmds) == 0 {
+		return nil
+	}
+	if _, err := pipe.Exec(m.ctx); err != nil {
+		return fmt.Errorf("failed to read WAL index: %w", err)
+	}
+
+	var members []string
+	for _, cmd := range cmds {
+		for _, member := range cmd.Val() {
+			if _, msgID, ok := strings.Cut(member, "|"); ok && wanted[msgID] {
+				members = append(members, member)
+			}
+		}
+	}
+	return m.remove(userID, members)
+}
+
+// remove 按索引成员删除 Stream 条目和索引
+func (m *WALManager) remove(userID string, members []string) error {
+	if len(members) == 0 {
+		return nil
+	}
+
+	ids := make([]string, 0, len(members))
+	index := make([]interface{}, 0, len(members))
+	for _, member := range members {
+		id, _, _ := strings.Cut(member, "|")
+		ids = append(ids, id)
+		index = append(index, member)
+	}
+
+	pipe := pkgredis.Client.Pipeline()
+	pipe.XDel(m.ctx, WALKeyPrefix+userID, ids...)
+	pipe.ZRem(m.ctx, WALIndexKeyPrefix+userID, index...)
+	if _, err := pipe.Exec(m.ctx); err != nil {
+		return fmt.Errorf("failed to trim WAL: %w", err)
+	}
+	return nil
+}
+
+// Replay 重放本网关写入的、仍未确认的条目
+//
+// 按接收者逐个读取 Stream，只重放 gw 为本网关的条目（其他网关重启时自己重放）
+// 已经没有本网关条目的接收者从 wal_users 集合中移除
+// 返回重放的条目数
+func (m *WALManager) Replay(fn func(*ChatMessage) error) (int, error) {
+	usersKey := WALUsersKeyPrefix + m.gatewayID
+	users, err := pkgredis.Client.SMembers(m.ctx, usersKey).Result()
+	if err != nil {
+		return 0, fmt.Errorf("failed to list WAL users: %w", err)
+	}
+
+	replayed := 0
+	for _, userID := range users {
+		entries, err := pkgredis.Client.XRange(m.ctx, WALKeyPrefix+userID, "-", "+").Result()
+		if err != nil {
+			return replayed, fmt.Errorf("failed to read WAL: %w", err)
+		}
+
+		pending := 0
+		for _, e := range entries {
+			if fmt.Sprint(e.Values["gw"]) != m.gatewayID {
+				continue
+			}
+			pending++
+
+			var msg PubSubMessage
+			if err := json.Unmarshal([]byte(fmt.Sprint(e.Values["msg"])), &msg); err != nil {
+				log.Printf("[WAL] Skipping corrupt entry %s for %s: %v", e.ID, userID, err)
+				continue
+			}
+			if err := fn(chatFromPubSub(&msg)); err != nil {
+				log.Printf("[WAL] Failed to replay entry %s for %s: %v", e.ID, userID, err)
+				continue
+			}
+			replayed++
+		}
+
+		if pending == 0 {
+			pkgredis.Client.SRem(m.ctx, usersKey, userID)
+		}
+	}
+	return replayed, nil
+}
+
+// ==================== 消息处理器接入 ====================
+
+// SetWAL 开启预写日志，nil 表示关闭
+func (h *MessageHandler) SetWAL(wal *WALManager) {
+	h.wal = wal
+}
+
+// appendWAL 路由之前记录消息（未开启或临时消息时直接返回）
+func (h *MessageHandler) appendWAL(msg *ChatMessage) error {
+	if h.wal == nil || isEphemeral(msg.MsgType) {
+		return nil
+	}
+	return h.wal.Append(msg)
+}
+
+// ackWAL 接收者确认后删除 WAL 条目
+// msgIDs 不为 nil 时是选择性确认，否则累积确认到 seqID
+func (h *MessageHandler) ackWAL(userID string, seqID int64, msgIDs []string) {
+	if h.wal == nil {
+		return
+	}
+	var err error
+	if msgIDs != nil {
+		err = h.wal.AckMessages(userID, msgIDs)
+	} else {
+		err = h.wal.Ack(userID, seqID)
+	}
+	if err != nil {
+		log.Printf("[WAL] Failed to ack for %s: %v", userID, err)
+	}
+}
+
+// ReplayWAL 启动时重放本网关未确认的 WAL 条目
+// 条目按原消息重新路由（不再追加 WAL），ACK 之后才删除
+func (h *MessageHandler) ReplayWAL() {
+	if h.wal == nil {
+		return
+	}
+	n, err := h.wal.Replay(h.routeMessage)
+	if err != nil {
+		log.Printf("[WAL] Replay failed: %v", err)
+	}
+	if n > 0 {
+		log.Printf("[WAL] Replayed %d unacked messages", n)
+	}
+}
@@ -0,0 +1,76 @@
+package service
+
+import (
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	pkgredis "go-im/pkg/redis"
+)
+
+// walTestUser 唯一的测试接收者，测试结束时清空其 WAL、索引和网关的接收者集合
+func walTestUser(t *testing.T, gatewayID string) string {
+	t.Helper()
+	userID := "test_" + strconv.FormatInt(time.Now().UnixNano(), 36)
+	t.Cleanup(func() {
+		pkgredis.Client.Del(pkgredis.Context(),
+			WALKeyPrefix+userID, WALIndexKeyPrefix+userID, WALUsersKeyPrefix+gatewayID)
+	})
+	return userID
+}
+
+// replayIDs 新建一个同名网关的 WALManager（模拟重启），返回重放的消息 ID
+func replayIDs(t *testing.T, gatewayID string) []string {
+	t.Helper()
+	var ids []string
+	_, err := NewWALManager(gatewayID).Replay(func(msg *ChatMessage) error {
+		ids = append(ids, msg.messageID())
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sorted(ids...)
+}
+
+func TestWALReplaysUnackedAfterRestart(t *testing.T) {
+	requireRedis(t)
+	gatewayID := "test_gw_" + strconv.FormatInt(time.Now().UnixNano(), 36)
+	userID := walTestUser(t, gatewayID)
+	wal := NewWALManager(gatewayID)
+
+	msgs := []*ChatMessage{
+		{FromUserID: "alice", ToUserID: userID, Content: "a1", SeqID: 1},
+		{FromUserID: "alice", ToUserID: userID, Content: "a2", SeqID: 2},
+		{FromUserID: "bob", ToUserID: userID, Content: "b2", SeqID: 2},
+		{FromUserID: "bob", ToUserID: userID, Content: "b3", SeqID: 3},
+	}
+	for _, msg := range msgs {
+		if err := wal.Append(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 选择性确认 alice 的 2 号消息：bob 的 2 号消息（同一 SeqID）仍然保留
+	if err := wal.AckMessages(userID, []string{msgs[1].messageID()}); err != nil {
+		t.Fatal(err)
+	}
+	want := sorted(msgs[0].messageID(), msgs[2].messageID(), msgs[3].messageID())
+	if got := replayIDs(t, gatewayID); !reflect.DeepEqual(got, want) {
+		t.Fatalf("after selective ack: replayed %v, want %v", got, want)
+	}
+
+	// 累积确认到 1，只剩 bob 的 2、3 号消息
+	if err := wal.Ack(userID, 1); err != nil {
+		t.Fatal(err)
+	}
+	want = sorted(msgs[2].messageID(), msgs[3].messageID())
+	if got := replayIDs(t, gatewayID); !reflect.DeepEqual(got, want) {
+		t.Fatalf("after cumulative ack: replayed %v, want %v", got, want)
+	}
+
+	if n, _ := pkgredis.Client.ZCard(pkgredis.Context(), WALIndexKeyPrefix+userID).Result(); n != 2 {
+		t.Errorf("index has %d entries, want 2", n)
+	}
+}